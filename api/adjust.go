@@ -0,0 +1,68 @@
+package api
+
+import (
+	"SirServer/canvas"
+	"fmt"
+	"image/color"
+	"net/url"
+	"strconv"
+)
+
+// parseAdjustment reads the gamma, brightness, contrast and saturation query
+// parameters of a tile request into an adjustment of the tile, the zero
+// Adjustment when none is given. Values out of range are errors.
+func parseAdjustment(query url.Values) (canvas.Adjustment, error) {
+	adjustment := canvas.DefaultAdjustment
+	given := false
+	for _, param := range []struct {
+		name  string
+		value *float64
+	}{
+		{"gamma", &adjustment.Gamma},
+		{"brightness", &adjustment.Brightness},
+		{"contrast", &adjustment.Contrast},
+		{"saturation", &adjustment.Saturation},
+	} {
+		value := query.Get(param.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return canvas.Adjustment{}, fmt.Errorf("%s %q is not a number", param.name, value)
+		}
+		*param.value = parsed
+		given = true
+	}
+	if !given {
+		return canvas.Adjustment{}, nil
+	}
+	if err := adjustment.Validate(); err != nil {
+		return canvas.Adjustment{}, err
+	}
+	return adjustment, nil
+}
+
+// parseTransparency reads the transparent and tolerance query parameters of a
+// tile request: the color made transparent, see canvas.MakeTransparent, nil
+// when none is given, and how far other colors may differ from it
+func parseTransparency(query url.Values) (color.Color, uint8, error) {
+	value := query.Get("transparent")
+	if value == "" {
+		if query.Get("tolerance") != "" {
+			return nil, 0, fmt.Errorf("tolerance needs a transparent color")
+		}
+		return nil, 0, nil
+	}
+	key, err := canvas.ParseColor(value)
+	if err != nil {
+		return nil, 0, fmt.Errorf("transparent: %w", err)
+	}
+	tolerance := 0
+	if value := query.Get("tolerance"); value != "" {
+		if tolerance, err = strconv.Atoi(value); err != nil || tolerance < 0 || tolerance > 0xff {
+			return nil, 0, fmt.Errorf("tolerance %q is not an integer from 0 to 255", value)
+		}
+	}
+	return key, uint8(tolerance), nil
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"SirServer/sfile"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// analysisEvents forwards the progress of background repository analyses to the
+// event stream and logs each finished analysis
+type analysisEvents struct {
+	events  *EventHub
+	catalog func() *sfile.RepositoryCatalog
+}
+
+// AnalysisObserver returns the observer to install with sfile.SetAnalysisObserver
+func (ac *ApiContext) AnalysisObserver() sfile.AnalysisObserver {
+	return analysisEvents{events: ac.events, catalog: ac.catalog}
+}
+
+// AnalysisProgress publishes progress as an "analysis" event
+func (a analysisEvents) AnalysisProgress(progress sfile.AnalysisProgress) {
+	if progress.Done {
+		// the listing holds the repository as it was before it was analysed
+		a.catalog().Invalidate()
+		if progress.Error != "" {
+			log.Printf("Analysis of repository %s failed: %s", progress.Repository, progress.Error)
+		} else {
+			log.Printf("Analysed repository %s: %d files, %.0f bytes", progress.Repository, progress.TotalFiles, progress.Bytes)
+		}
+	}
+	a.events.Publish(Event{Type: "analysis", Data: progress})
+}
+
+// rescanHandler queues a repository for analysis and has the result written to
+// its repository.json. The progress is published as "analysis" events.
+func (ac *ApiContext) rescanHandler(writer http.ResponseWriter, request *http.Request) {
+	name, err := routeName(request, "name")
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	dir, err := ac.repositoryDir(name)
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	if sfile.IsArchive(dir) || sfile.IsS3Root(ac.RepositoryRoot) {
+		WriteError(writer, http.StatusNotImplemented, "Rescanning is only available for local repositories of .s files")
+		return
+	}
+	if !isDirectory(dir) {
+		WriteError(writer, http.StatusNotFound, "Repository not found")
+		return
+	}
+	if err := sfile.RescanRepository(ac.RepositoryRoot, ac.repositoryKey(dir)); err != nil {
+		WriteError(writer, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusAccepted)
+	result, _ := json.Marshal(Ok(map[string]string{"repository": name}))
+	_, _ = writer.Write(result)
+}
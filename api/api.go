@@ -4,16 +4,27 @@ import (
 	"SirServer/canvas" // Assuming canvas is a sibling package
 	"SirServer/sfile"  // Assuming sfile is a sibling package
 	"bytes"
+	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
-	"image"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/text/unicode/norm"
+	"image/color"
 	"log"
+	"mime"
 	"net/http"
 	"net/url"
+	"os"
+	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // SirServer struct defines the server's metadata (moved here from main.go)
@@ -54,7 +65,7 @@ func WriteOk(writer http.ResponseWriter, data interface{}) {
 	writer.Header().Set("Content-Type", "application/json")
 	result, err := json.Marshal(Ok(data))
 	if err != nil {
-		log.Printf("Error marshalling success response: %v", err)
+		logError("Error marshalling success response: %v", err)
 		errorJson, _ := json.Marshal(Error(http.StatusInternalServerError, "Internal server error during response marshalling"))
 		writer.WriteHeader(http.StatusInternalServerError)
 		_, _ = writer.Write(errorJson)
@@ -69,7 +80,7 @@ func WriteError(writer http.ResponseWriter, code int, message string) {
 	writer.WriteHeader(code)
 	result, err := json.Marshal(Error(code, message))
 	if err != nil {
-		log.Printf("Error marshalling error response: %v", err)
+		logError("Error marshalling error response: %v", err)
 		fallbackErrorJson, _ := json.Marshal(Error(http.StatusInternalServerError, "Internal server error"))
 		_, _ = writer.Write(fallbackErrorJson)
 		return
@@ -79,12 +90,41 @@ func WriteError(writer http.ResponseWriter, code int, message string) {
 
 // WriteImage writes an image buffer as a PNG response (moved here)
 func WriteImage(writer http.ResponseWriter, buffer bytes.Buffer) {
+	WriteImageStatus(writer, http.StatusOK, buffer)
+}
+
+// WriteImageStatus writes a PNG image response with the given status
+func WriteImageStatus(writer http.ResponseWriter, status int, buffer bytes.Buffer) {
 	writer.Header().Set("Content-Type", "image/png")
-	writer.WriteHeader(http.StatusOK)
 	writer.Header().Set("Content-Length", strconv.Itoa(len(buffer.Bytes())))
+	writer.WriteHeader(status)
 	_, _ = writer.Write(buffer.Bytes())
 }
 
+// checkModified sets Last-Modified to modified, unless it is zero, and answers
+// 304 Not Modified when the request's If-Modified-Since is not older. It reports
+// whether the response was written.
+func checkModified(writer http.ResponseWriter, request *http.Request, modified time.Time) bool {
+	if modified.IsZero() {
+		return false
+	}
+	writer.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	since, err := http.ParseTime(request.Header.Get("If-Modified-Since"))
+	if err != nil || modified.Truncate(time.Second).After(since) {
+		return false
+	}
+	writer.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// WriteBlob writes raw bytes with the given content type
+func WriteBlob(writer http.ResponseWriter, contentType string, data []byte) {
+	writer.Header().Set("Content-Type", contentType)
+	writer.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	writer.WriteHeader(http.StatusOK)
+	_, _ = writer.Write(data)
+}
+
 // WriteHtml writes HTML content (moved here)
 func WriteHtml(writer http.ResponseWriter, content []byte) {
 	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -95,28 +135,87 @@ func WriteHtml(writer http.ResponseWriter, content []byte) {
 
 // ApiContext holds dependencies for API handlers
 type ApiContext struct {
-	RepositoryRoot string
-	SirServerInfo  SirServer
-	CanvasContext  *canvas.CanvasContext // Note: canvas.CanvasContext is not an interface, so we pass the concrete type
-	StaticFiles    embed.FS
+	RepositoryRoot  string
+	SirServerInfo   SirServer
+	CanvasContext   *canvas.CanvasContext // Note: canvas.CanvasContext is not an interface, so we pass the concrete type
+	StaticFiles     embed.FS
+	AdminToken      string // token required by admin endpoints, they are disabled when empty
+	MaxArchiveSize  int64  // maximum size in bytes of an uploaded repository archive, 0 means unlimited
+	RepositoryDepth int    // how many directory levels below the root are searched for repositories
+	FollowSymlinks  bool   // whether symlinked repository directories are listed and served
+	Debug           bool   // serves the /debug diagnostics endpoint
+	WriteEnabled    bool   // allows admin callers to modify tiles
+	Shedder         *LoadShedder
+	TileCache       *sfile.TileCache        // in memory cache of tile blobs, disabled with a zero budget
+	CatalogTTL      time.Duration           // how long the repository list is served before the root is scanned again
+	ErrorTileStyle  canvas.TileStyle        // look of the tiles answering invalid tile requests and unknown repositories
+	ErrorTileText   string                  // text of those tiles, {error} standing for the error; the error itself when ""
+	PlaceholderTile canvas.PlaceholderStyle // look of the tiles answering tiles a repository does not have
+	BurnAttribution bool                    // draws the attribution of every repository onto its raster tiles, see attributionOverlay
+	TileErrorStatus bool                    // answers error and placeholder tiles with their status rather than 200, see writeTileError
+	usageCache      *sfile.UsageCache
+	tileFlight      singleflight.Group // coalesces concurrent reads of the same tile
+	events          *EventHub
+	jobs            jobRegistry
+	scrubber        *sfile.Scrubber // set by ScrubRepositories
+	watermarks      sync.Map        // parsedWatermark by sfile.WatermarkSettings.Key, see watermarkOptions
+	catalogOnce     sync.Once
+	repositories    *sfile.RepositoryCatalog // created on first use by catalog
 }
 
 // NewApiContext creates and returns a new ApiContext
 func NewApiContext(repoRoot string, serverInfo SirServer, canvasCtx *canvas.CanvasContext, staticFs embed.FS) *ApiContext {
 	return &ApiContext{
-		RepositoryRoot: repoRoot,
-		SirServerInfo:  serverInfo,
-		CanvasContext:  canvasCtx,
-		StaticFiles:    staticFs,
+		RepositoryRoot:  repoRoot,
+		SirServerInfo:   serverInfo,
+		CanvasContext:   canvasCtx,
+		StaticFiles:     staticFs,
+		usageCache:      sfile.NewUsageCache(repoRoot),
+		events:          NewEventHub(),
+		RepositoryDepth: 1,
+		FollowSymlinks:  true,
+		Shedder:         &LoadShedder{},
+		TileCache:       sfile.NewTileCache(0, 0),
+		CatalogTTL:      sfile.DefaultCatalogTTL,
+		ErrorTileStyle:  canvas.TileStylePresets["default"],
+		PlaceholderTile: canvas.PlaceholderStylePresets["default"],
 	}
 }
 
-// RegisterRoutes registers all API routes to the given mux router
+// RegisterRoutes registers all API routes to the given mux router.
+// The router must match on encoded paths (mux.Router.UseEncodedPath), repository
+// names in route variables are decoded by the handlers themselves.
 func (ac *ApiContext) RegisterRoutes(r *mux.Router) {
 	// API Routes
 	r.HandleFunc("/api/v1/repositories", ac.listRepositoriesHandler).Methods("GET")
-	r.HandleFunc("/api/v1/xyz/{dir}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png", ac.xyzFileHandler).Methods("GET")
+	r.HandleFunc("/api/v1/xyz/{dir:.+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png", ac.Shedder.Wrap(ac.xyzFileHandler)).Methods("GET")
+	r.HandleFunc("/api/v1/xyz/{dir:.+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png", ac.requireWrite(ac.deleteTileHandler)).Methods("DELETE")
+	r.HandleFunc("/api/v1/raw/{dir:.+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}", ac.Shedder.Wrap(ac.rawTileHandler)).Methods("GET")
 	r.HandleFunc("/api/v1/server", ac.serverInfoHandler).Methods("GET")
+	r.HandleFunc("/api/v1/storage", ac.storageHandler).Methods("GET")
+	r.HandleFunc("/api/v1/staticmap", ac.staticMapHandler).Methods("GET")
+	r.HandleFunc("/api/v1/cache/purge", ac.requireAdmin(ac.cachePurgeHandler)).Methods("POST")
+	r.HandleFunc("/api/v1/repositories/{name:.+}/archive.tar.gz", ac.requireAdmin(ac.archiveDownloadHandler)).Methods("GET")
+	r.HandleFunc("/api/v1/repositories/{name:.+}/archive", ac.requireAdmin(ac.archiveRestoreHandler)).Methods("POST")
+	r.HandleFunc("/api/v1/repositories/{name:.+}/coverage", ac.coverageHandler).Methods("GET")
+	r.HandleFunc("/api/v1/repositories/{name:.+}/gaps", ac.gapsHandler).Methods("GET")
+	r.HandleFunc("/api/v1/repositories/{name:.+}/tilejson.json", ac.tileJSONHandler).Methods("GET")
+	r.HandleFunc("/api/v1/repositories/{name:.+}/recompute-size", ac.requireAdmin(ac.recomputeSizeHandler)).Methods("POST")
+	r.HandleFunc("/api/v1/repositories/{name:.+}/rescan", ac.requireAdmin(ac.rescanHandler)).Methods("POST")
+	r.HandleFunc("/api/v1/repositories/{name:.+}/pull", ac.requireAdmin(ac.pullHandler)).Methods("POST")
+	r.HandleFunc("/api/v1/repositories/{name:.+}/validate", ac.requireAdmin(ac.validateHandler)).Methods("POST")
+	r.HandleFunc("/api/v1/repositories/{name:.+}/clone", ac.requireWrite(ac.cloneHandler)).Methods("POST")
+	r.HandleFunc("/api/v1/repositories/{name:.+}/quarantine", ac.quarantineHandler).Methods("GET")
+	r.HandleFunc("/api/v1/repositories/{name:.+}/quarantine/restore", ac.requireWrite(ac.quarantineRestoreHandler)).Methods("POST")
+	// must come after the other repository routes, the name pattern swallows their suffixes
+	r.HandleFunc("/api/v1/repositories/{name:.+}", ac.repositoryDetailHandler).Methods("GET")
+	r.HandleFunc("/api/v1/events", ac.eventsHandler).Methods("GET")
+	r.HandleFunc("/api/v1/jobs", ac.listJobsHandler).Methods("GET")
+	r.HandleFunc("/api/v1/jobs/{id}", ac.jobHandler).Methods("GET")
+	r.HandleFunc("/api/v1/scrub/findings", ac.scrubFindingsHandler).Methods("GET")
+	if ac.Debug {
+		r.HandleFunc("/debug", ac.debugHandler).Methods("GET")
+	}
 
 	// Root path (index.html) - depends on static files, so keep it in this context if it references embedded static files
 	// If index.html is truly static and doesn't depend on server-side logic related to repo or canvas,
@@ -134,47 +233,544 @@ func (ac *ApiContext) RegisterRoutes(r *mux.Router) {
 	})
 }
 
+// repositoryDir resolves a repository name to its directory under the repository root.
+// Nested repositories are named by slash separated paths like "2023/cityA", up to
+// RepositoryDepth elements; every element must be a plain directory name, so a
+// request can never escape the root.
+func (ac *ApiContext) repositoryDir(name string) (string, error) {
+	name = normalizeName(ac.RepositoryRoot, name)
+	elements := strings.Split(name, "/")
+	depth := max(ac.RepositoryDepth, 1)
+	if len(elements) >= 2 && strings.EqualFold(path.Ext(elements[len(elements)-2]), ".gpkg") {
+		// a GeoPackage layer is addressed as file.gpkg/layer
+		depth++
+	}
+	if len(elements) > depth {
+		return "", fmt.Errorf("invalid repository name %q", name)
+	}
+	for _, element := range elements {
+		if element == "" || element == "." || element == ".." || strings.ContainsAny(element, "\\\x00") {
+			return "", fmt.Errorf("invalid repository name %q", name)
+		}
+	}
+	dir := filepath.Join(ac.RepositoryRoot, filepath.FromSlash(name))
+	if rel, err := filepath.Rel(ac.RepositoryRoot, dir); err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("invalid repository name %q", name)
+	}
+	if !ac.FollowSymlinks {
+		current := ac.RepositoryRoot
+		for _, element := range elements {
+			current = filepath.Join(current, element)
+			if info, err := os.Lstat(current); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				return "", fmt.Errorf("repository %q is a symlink and symlinks are not followed", name)
+			}
+		}
+	}
+	return dir, nil
+}
+
+// normalizeName returns the NFC form of a repository name, which is what clients
+// send, unless only the name exactly as given exists on disk (e.g. NFD names
+// created on macOS)
+func normalizeName(root string, name string) string {
+	normalized := norm.NFC.String(name)
+	if normalized == name {
+		return name
+	}
+	if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(normalized))); err != nil {
+		if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(name))); err == nil {
+			return name
+		}
+	}
+	return normalized
+}
+
+// routeName returns a repository name route variable percent-decoded. The router
+// matches on the encoded path, so a name with escaped CJK characters or spaces
+// arrives here intact and is decoded exactly once. Nested repositories are
+// separated by literal slashes; each element is decoded on its own and one that
+// decodes to a separator ("%2F" or "%5C") is refused, so an escaped slash can
+// not address a different repository than the one the path names.
+func routeName(request *http.Request, key string) (string, error) {
+	raw := mux.Vars(request)[key]
+	elements := strings.Split(raw, "/")
+	for i, element := range elements {
+		decoded, err := url.PathUnescape(element)
+		if err != nil || strings.ContainsAny(decoded, "/\\") {
+			return "", fmt.Errorf("invalid repository name %q", raw)
+		}
+		elements[i] = decoded
+	}
+	return strings.Join(elements, "/"), nil
+}
+
+// scanOptions returns how repositories are discovered under the repository root
+func (ac *ApiContext) scanOptions() sfile.ScanOptions {
+	return sfile.ScanOptions{Depth: ac.RepositoryDepth, FollowSymlinks: ac.FollowSymlinks}
+}
+
+// catalog returns the cached list of repositories under the repository root. It
+// is created on first use, once the scan options and TTL are configured.
+func (ac *ApiContext) catalog() *sfile.RepositoryCatalog {
+	ac.catalogOnce.Do(func() {
+		ac.repositories = sfile.NewRepositoryCatalog(ac.RepositoryRoot)
+		ac.repositories.SetScanOptions(ac.scanOptions())
+		ac.repositories.SetTTL(ac.CatalogTTL)
+	})
+	return ac.repositories
+}
+
+// tileSize returns the tile size in pixels of the repository named name, from the
+// catalog so no tile request reads repository.json
+func (ac *ApiContext) tileSize(name string) int {
+	if repo, ok := ac.catalog().Lookup(name); ok && repo.TileSize > 0 {
+		return repo.TileSize
+	}
+	return sfile.DefaultTileSize
+}
+
+// tileGrid returns the grid of the repository named name, from the catalog
+func (ac *ApiContext) tileGrid(name string) sfile.TileGrid {
+	if repo, ok := ac.catalog().Lookup(name); ok {
+		return repo.TileGrid()
+	}
+	return sfile.GridMercator
+}
+
+// WatchRepositories starts watching the repository root, so repositories copied
+// in or removed by hand show up in the listing without waiting for the catalog
+// TTL. S3 roots cannot be watched and return nil.
+func (ac *ApiContext) WatchRepositories() *sfile.RepositoryWatcher {
+	if sfile.IsS3Root(ac.RepositoryRoot) {
+		log.Printf("Warning: the S3 repository root %s cannot be watched, it is scanned every %s", ac.RepositoryRoot, ac.CatalogTTL)
+		return nil
+	}
+	return sfile.WatchRepositories(ac.catalog())
+}
+
+// SweepExpiredTiles starts deleting the expired tiles of the repositories with a
+// TTL, and pruning the versions of temporal repositories, every interval, at
+// most rate expired tiles per second. Repositories in S3 are not swept and
+// return nil.
+func (ac *ApiContext) SweepExpiredTiles(interval time.Duration, rate float64) *sfile.ExpirySweeper {
+	if sfile.IsS3Root(ac.RepositoryRoot) {
+		return nil
+	}
+	return sfile.StartExpirySweeper(ac.catalog(), interval, rate)
+}
+
+// isDirectory reports whether path exists and is a directory
+func isDirectory(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
 // listRepositoriesHandler provides a list of available repositories
 func (ac *ApiContext) listRepositoriesHandler(writer http.ResponseWriter, request *http.Request) {
-	repositories, err := sfile.ListRepositories(ac.RepositoryRoot)
+	format := request.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "geojson" && format != "csv" {
+		WriteError(writer, http.StatusBadRequest, "format must be one of json, geojson or csv")
+		return
+	}
+	repositories, _, err := ac.catalog().List()
 	if err != nil {
 		WriteError(writer, http.StatusInternalServerError, "Failed to list repositories")
 		return
 	}
-	WriteOk(writer, repositories)
+	for i := range repositories {
+		repositories[i] = repositories[i].Public()
+	}
+	switch format {
+	case "geojson":
+		writeRepositoriesGeoJSON(writer, repositories)
+	case "csv":
+		writeRepositoriesCSV(writer, repositories)
+	default:
+		WriteOk(writer, repositories)
+	}
+}
+
+// tileRequest holds the validated variables of a tile route
+type tileRequest struct {
+	Name string // repository name as given in the route
+	Dir  string // repository directory under the repository root
+	Key  string // normalized repository name the tile is cached under
+	X    int64
+	Y    int64
+	Z    int8
+	Time time.Time // asked for with ?time=, zero for the newest tile
+
+	// Adjust is the change of tone asked for with ?gamma= and the like, see
+	// parseAdjustment; only the xyz route reads it
+	Adjust canvas.Adjustment
+
+	// ColorKey is the color made transparent with ?transparent=, nil for none,
+	// and Tolerance how far other colors may differ from it, see parseTransparency;
+	// only the xyz route reads them
+	ColorKey  color.Color
+	Tolerance uint8
+
+	// Tone is the rendering asked for with ?style=, only the xyz route reads it
+	Tone canvas.Tone
+}
+
+// maxTileZoom is the highest zoom the shard naming can address
+const maxTileZoom = sfile.MaxTileZoom
+
+// parseTileRequest reads and validates the dir/z/x/y variables of a tile route
+func (ac *ApiContext) parseTileRequest(request *http.Request) (tileRequest, error) {
+	vars := mux.Vars(request)
+	name, err := routeName(request, "dir")
+	if err != nil {
+		return tileRequest{}, err
+	}
+	dir, err := ac.repositoryDir(name)
+	if err != nil {
+		return tileRequest{}, err
+	}
+	z, errZ := strconv.Atoi(vars["z"])
+	x, errX := strconv.ParseInt(vars["x"], 10, 64)
+	y, errY := strconv.ParseInt(vars["y"], 10, 64)
+	if errZ != nil || errX != nil || errY != nil {
+		return tileRequest{}, fmt.Errorf("tile %s/%s/%s is out of range", vars["z"], vars["x"], vars["y"])
+	}
+	// the zoom is range checked before it is narrowed to an int8
+	if err := ac.tileGrid(ac.repositoryKey(dir)).ValidateXYZ(x, y, z); err != nil {
+		return tileRequest{}, err
+	}
+	tile := tileRequest{Name: name, Dir: dir, Key: ac.repositoryKey(dir), X: x, Y: y, Z: int8(z)}
+	if value := request.URL.Query().Get("time"); value != "" {
+		if tile.Time, err = time.Parse(time.RFC3339, value); err != nil {
+			return tileRequest{}, fmt.Errorf("time %q is not an RFC 3339 time", value)
+		}
+	}
+	return tile, nil
+}
+
+// repositoryKey returns the slash separated name of a repository directory
+// relative to the root, which is how its tiles are keyed in the tile cache
+func (ac *ApiContext) repositoryKey(dir string) string {
+	rel, err := filepath.Rel(ac.RepositoryRoot, dir)
+	if err != nil {
+		return dir
+	}
+	return filepath.ToSlash(rel)
+}
+
+// tileSourceHeader tells whether a tile came from the tile cache, the repository
+// or, for upstream repositories, was just fetched from upstream
+const (
+	tileSourceHeader = "X-Tile-Source"
+	tileSourceCache  = "cache"
+)
+
+// tileTimeHeader tells the time of the version served for a tile asked for at a time
+const tileTimeHeader = "X-Tile-Time"
+
+// tileErrorHeader tells why a tile was answered with a message tile
+const tileErrorHeader = "X-Tile-Error"
+
+// fetchTile reads the stored blob of a tile, from the tile cache when possible.
+// Concurrent requests for a tile that is not cached share a single read; a caller
+// whose context ends stops waiting, but the shared read keeps going for the others.
+// Only missing tiles are remembered as failures, and only for the negative TTL.
+// The returned data is shared and must not be modified.
+func (ac *ApiContext) fetchTile(ctx context.Context, tile tileRequest) (sfile.CachedTile, error) {
+	if !tile.Time.IsZero() {
+		return ac.fetchTileAt(ctx, tile)
+	}
+	ctx, span := tracer.Start(ctx, "tile.fetch")
+	defer span.End()
+	cacheKey := sfile.TileKey{Repository: tile.Key, Z: tile.Z, X: tile.X, Y: tile.Y}
+	cached, ok := ac.lookupTile(ctx, cacheKey)
+	if ok {
+		span.SetAttributes(attribute.Bool("sir.tile.cached", true))
+		if cached.Missing {
+			return sfile.CachedTile{}, fmt.Errorf("%w: %s/%d/%d/%d", sfile.ErrTileNotFound, tile.Key, tile.Z, tile.X, tile.Y)
+		}
+		cached.Source = tileSourceCache
+		return cached, nil
+	}
+	key := fmt.Sprintf("%s/%d/%d/%d", tile.Dir, tile.Z, tile.X, tile.Y)
+	result := ac.tileFlight.DoChan(key, func() (interface{}, error) {
+		source, err := sfile.OpenTileSource(ac.RepositoryRoot, tile.Key)
+		if err != nil {
+			return nil, err
+		}
+		defer source.Close()
+		// the read is traced under whichever request started it, but shared with
+		// the other waiters, so it must not be cancelled when that request ends
+		// tiles stored compressed are cached compressed, see tileBody
+		var stored sfile.Tile
+		if encoded, ok := source.(sfile.EncodedTileReader); ok {
+			stored, err = encoded.GetEncodedTile(context.WithoutCancel(ctx), tile.Z, tile.X, tile.Y)
+		} else {
+			stored, err = source.GetTile(context.WithoutCancel(ctx), tile.Z, tile.X, tile.Y)
+		}
+		if errors.Is(err, sfile.ErrTileNotFound) {
+			ac.TileCache.PutMissing(cacheKey)
+		}
+		if err != nil {
+			return nil, err
+		}
+		cached := sfile.CachedTile{Data: stored.Data, ContentType: stored.ContentType, Source: stored.Source, Modified: stored.Modified, Encoding: stored.Encoding}
+		ac.TileCache.PutUntil(cacheKey, cached, stored.Expires)
+		return cached, nil
+	})
+	select {
+	case res := <-result:
+		span.SetAttributes(attribute.Bool("sir.tile.shared", res.Shared))
+		if res.Err != nil {
+			recordError(span, res.Err)
+			return sfile.CachedTile{}, res.Err
+		}
+		return res.Val.(sfile.CachedTile), nil
+	case <-ctx.Done():
+		recordError(span, ctx.Err())
+		return sfile.CachedTile{}, ctx.Err()
+	}
+}
+
+// lookupTile reads a tile from the tile cache in a span of its own
+func (ac *ApiContext) lookupTile(ctx context.Context, key sfile.TileKey) (sfile.CachedTile, bool) {
+	_, span := tracer.Start(ctx, "tile.cache_lookup")
+	defer span.End()
+	cached, ok := ac.TileCache.Get(key)
+	span.SetAttributes(attribute.Bool("sir.tile.cache_hit", ok))
+	if ok {
+		span.SetAttributes(attribute.Bool("sir.tile.missing", cached.Missing))
+	}
+	return cached, ok
+}
+
+// fetchTileAt reads the version of a tile current at the time asked for, which
+// is never cached. Sources keeping no versions answer sfile.ErrNotTemporal.
+func (ac *ApiContext) fetchTileAt(ctx context.Context, tile tileRequest) (sfile.CachedTile, error) {
+	ctx, span := tracer.Start(ctx, "tile.fetch_at")
+	defer span.End()
+	source, err := sfile.OpenTileSource(ac.RepositoryRoot, tile.Key)
+	if err != nil {
+		recordError(span, err)
+		return sfile.CachedTile{}, err
+	}
+	defer source.Close()
+	temporal, ok := source.(sfile.TemporalReader)
+	if !ok {
+		return sfile.CachedTile{}, fmt.Errorf("%w: %s", sfile.ErrNotTemporal, tile.Key)
+	}
+	stored, err := temporal.GetTileAt(ctx, tile.Z, tile.X, tile.Y, tile.Time)
+	if err != nil {
+		recordError(span, err)
+		return sfile.CachedTile{}, err
+	}
+	return sfile.CachedTile{Data: stored.Data, ContentType: stored.ContentType, Source: stored.Source, Modified: stored.Modified, Encoding: stored.Encoding}, nil
+}
+
+// writeTileTime tells the time of the version of tile served for a request with ?time=
+func writeTileTime(writer http.ResponseWriter, request tileRequest, tile sfile.CachedTile) {
+	if !request.Time.IsZero() && !tile.Modified.IsZero() {
+		writer.Header().Set(tileTimeHeader, tile.Modified.UTC().Format(time.RFC3339))
+	}
+}
+
+// tileBody returns the body answering request with tile. A tile stored
+// compressed is sent as stored with Content-Encoding when the client accepts
+// it, and decompressed otherwise.
+func tileBody(writer http.ResponseWriter, request *http.Request, tile sfile.CachedTile) ([]byte, error) {
+	if tile.Encoding == "" {
+		return tile.Data, nil
+	}
+	writer.Header().Add("Vary", "Accept-Encoding")
+	if acceptsEncoding(request, tile.Encoding) {
+		writer.Header().Set("Content-Encoding", tile.Encoding)
+		return tile.Data, nil
+	}
+	return sfile.DecodeTile(tile.Data, tile.Encoding)
+}
+
+// acceptsEncoding reports whether the Accept-Encoding of request lists encoding
+// without refusing it with q=0
+func acceptsEncoding(request *http.Request, encoding string) bool {
+	for _, accepted := range strings.Split(request.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(accepted, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+			continue
+		}
+		key, value, _ := strings.Cut(strings.ReplaceAll(params, " ", ""), "=")
+		if quality, err := strconv.ParseFloat(value, 64); key == "q" && err == nil {
+			return quality > 0
+		}
+		return true
+	}
+	return false
+}
+
+// isTileMiss reports whether err only means the tile or its repository does not
+// exist, as opposed to a failure reading it
+func isTileMiss(err error) bool {
+	return errors.Is(err, sfile.ErrTileNotFound) || errors.Is(err, sfile.ErrRepositoryNotFound)
+}
+
+// writeTileMessage answers a tile request with status and an image showing
+// message in the ErrorTileStyle, as large as the tiles of the repository so it
+// lines up with its neighbours. The image shows the ErrorTileText, message
+// itself is always sent in the X-Tile-Error header, so it must not name server
+// paths, see sanitizeTileError.
+func (ac *ApiContext) writeTileMessage(writer http.ResponseWriter, status int, name string, message string) {
+	size := ac.tileSize(name)
+	text := message
+	if ac.ErrorTileText != "" {
+		text = strings.ReplaceAll(ac.ErrorTileText, "{error}", message)
+	}
+	writer.Header().Set(tileErrorHeader, message)
+	data, _ := ac.CanvasContext.CreateCachedImage(size, size, ac.ErrorTileStyle, text)
+	WriteImageStatus(writer, status, *bytes.NewBuffer(data))
+}
+
+// writeTilePlaceholder answers a request for a tile the repository does not have
+// with status and a placeholder tile in the PlaceholderTile style, as large as
+// the tiles of the repository. Unlike error tiles it shows the repository and
+// coordinates rather than the error; message, sanitized like that of
+// writeTileMessage, is sent in the X-Tile-Error header.
+func (ac *ApiContext) writeTilePlaceholder(writer http.ResponseWriter, status int, tile tileRequest, message string) {
+	writer.Header().Set(tileErrorHeader, message)
+	buffer, err := ac.CanvasContext.CreatePlaceholderTile(tile.Key, int(tile.Z), tile.X, tile.Y, ac.tileSize(tile.Key), ac.PlaceholderTile)
+	if err != nil {
+		logError("Error drawing the placeholder of %s/%d/%d/%d: %v", tile.Key, tile.Z, tile.X, tile.Y, err)
+	}
+	WriteImageStatus(writer, status, buffer)
 }
 
 // xyzFileHandler processes requests for XYZ files
 func (ac *ApiContext) xyzFileHandler(writer http.ResponseWriter, request *http.Request) {
 	vars := mux.Vars(request)
 	fmt.Printf("Received request for XYZ: %v\n", vars)
-	dirName := vars["dir"]
-	x := vars["x"]
-	y := vars["y"]
-	z := vars["z"]
-	dir := filepath.Join(ac.RepositoryRoot, dirName)
-	NewSFile, err := sfile.NewRepository(dir, false)
+	tile, err := ac.parseTileRequest(request)
 	if err != nil {
-		// Use ac.CanvasContext
-		buffer, _ := ac.CanvasContext.CreateImage(256, 256, image.Transparent, image.Black, err.Error())
-		WriteImage(writer, buffer)
+		name, _ := routeName(request, "dir")
+		ac.writeTileError(writer, name, tileRequest{}, badTileRequest{err})
+		return
+	}
+	if tile.Adjust, err = parseAdjustment(request.URL.Query()); err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	if tile.ColorKey, tile.Tolerance, err = parseTransparency(request.URL.Query()); err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	if tile.Tone, err = canvas.ParseTone(request.URL.Query().Get("style")); err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
 		return
 	}
-	intx, _ := strconv.ParseInt(x, 10, 64)
-	inty, _ := strconv.ParseInt(y, 10, 64)
-	intz, _ := strconv.ParseInt(z, 10, 8)
 
-	xyz, err := NewSFile.GetXYZ(intx, inty, int8(intz))
+	var xyz sfile.CachedTile
+	if repo, ok := ac.catalog().Lookup(tile.Key); ok {
+		xyz, err = ac.fetchOverlaidTile(request.Context(), tile, repo)
+	} else {
+		xyz, err = ac.fetchTile(request.Context(), tile)
+	}
 	if err != nil {
-		// Use ac.CanvasContext
-		buffer, _ := ac.CanvasContext.CreateImage(256, 256, image.Transparent, image.Black, err.Error())
-		WriteImage(writer, buffer)
+		if request.Context().Err() == nil {
+			ac.writeTileError(writer, tile.Key, tile, err)
+		}
+		return
+	}
+	writer.Header().Set(tileSourceHeader, xyz.Source)
+	writeTileTime(writer, tile, xyz)
+	if checkModified(writer, request, xyz.Modified) {
+		return
+	}
+	body, err := tileBody(writer, request, xyz)
+	if err != nil {
+		logError("Error decoding tile %s/%d/%d/%d: %v", tile.Name, tile.Z, tile.X, tile.Y, err)
+		WriteError(writer, http.StatusInternalServerError, "Failed to read tile")
+		return
+	}
+	// the content type recorded for the tile, drawn tiles are labelled with the
+	// format they were encoded in
+	WriteBlob(writer, xyz.ContentType, body)
+}
+
+// rawTileHandler returns a stored tile exactly as it is, without any image handling.
+// The content type is sniffed from the data unless overridden with ?type=,
+// and failures are always reported as JSON.
+func (ac *ApiContext) rawTileHandler(writer http.ResponseWriter, request *http.Request) {
+	tile, err := ac.parseTileRequest(request)
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	contentType := ""
+	if override := request.URL.Query().Get("type"); override != "" {
+		contentType, err = parseContentTypeOverride(override)
+		if err != nil {
+			WriteError(writer, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	data, err := ac.fetchTile(request.Context(), tile)
+	if errors.Is(err, sfile.ErrNotTemporal) {
+		WriteError(writer, http.StatusBadRequest, "Repository keeps no tile history to serve a time from")
 		return
 	}
-	WriteImage(writer, *xyz)
+	if isTileMiss(err) {
+		log.Printf("Raw tile %s/%d/%d/%d not served: %v", tile.Name, tile.Z, tile.X, tile.Y, err)
+		WriteError(writer, http.StatusNotFound, "Tile not found")
+		return
+	}
+	if err != nil {
+		if request.Context().Err() == nil {
+			logError("Error reading tile %s/%d/%d/%d: %v", tile.Name, tile.Z, tile.X, tile.Y, err)
+			WriteError(writer, http.StatusInternalServerError, "Failed to read tile")
+		}
+		return
+	}
+	if contentType == "" {
+		contentType = data.ContentType
+	}
+	writer.Header().Set(tileSourceHeader, data.Source)
+	writeTileTime(writer, tile, data)
+	if checkModified(writer, request, data.Modified) {
+		return
+	}
+	body, err := tileBody(writer, request, data)
+	if err != nil {
+		logError("Error decoding tile %s/%d/%d/%d: %v", tile.Name, tile.Z, tile.X, tile.Y, err)
+		WriteError(writer, http.StatusInternalServerError, "Failed to read tile")
+		return
+	}
+	WriteBlob(writer, contentType, body)
+}
+
+// parseContentTypeOverride accepts either a full MIME type or a file extension like "pbf"
+func parseContentTypeOverride(value string) (string, error) {
+	if strings.Contains(value, "/") {
+		if _, _, err := mime.ParseMediaType(value); err != nil {
+			return "", fmt.Errorf("invalid content type %q", value)
+		}
+		return value, nil
+	}
+	switch strings.ToLower(value) {
+	case "pbf", "mvt":
+		return "application/x-protobuf", nil
+	}
+	if contentType := mime.TypeByExtension("." + strings.ToLower(value)); contentType != "" {
+		return contentType, nil
+	}
+	return "", fmt.Errorf("unknown content type %q", value)
+}
+
+// ServerInfo is the server metadata together with its current load
+type ServerInfo struct {
+	SirServer
+	Load      LoadState            `json:"load"`
+	TileCache sfile.TileCacheStats `json:"tile_cache"`
+	Existence sfile.ExistenceStats `json:"existence_index"`
 }
 
 // serverInfoHandler provides information about the server
 func (ac *ApiContext) serverInfoHandler(writer http.ResponseWriter, request *http.Request) {
-	WriteOk(writer, ac.SirServerInfo)
+	WriteOk(writer, ServerInfo{SirServer: ac.SirServerInfo, Load: ac.Shedder.State(), TileCache: ac.TileCache.Stats(), Existence: sfile.ExistenceIndexStats()})
 }
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"SirServer/sfile"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// archiveDownloadHandler streams a whole repository as a tar.gz archive
+func (ac *ApiContext) archiveDownloadHandler(writer http.ResponseWriter, request *http.Request) {
+	name, err := routeName(request, "name")
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	dir, err := ac.repositoryDir(name)
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !isDirectory(dir) {
+		WriteError(writer, http.StatusNotFound, "Repository not found")
+		return
+	}
+
+	if dryRun, _ := strconv.ParseBool(request.URL.Query().Get("dry-run")); dryRun {
+		summary, err := sfile.SummarizeArchive(dir)
+		if err != nil {
+			logError("Error summarizing archive of %s: %v", name, err)
+			WriteError(writer, http.StatusInternalServerError, "Failed to summarize repository")
+			return
+		}
+		WriteOk(writer, summary)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/gzip")
+	setAttachment(writer, name+".tar.gz")
+	writer.WriteHeader(http.StatusOK)
+	// the status line is already sent, so a failure can only be logged
+	if err := sfile.ArchiveRepository(dir, writer); err != nil {
+		logError("Error streaming archive of %s: %v", name, err)
+	}
+}
+
+// archiveRestoreHandler recreates a repository from an uploaded tar.gz or zip archive
+func (ac *ApiContext) archiveRestoreHandler(writer http.ResponseWriter, request *http.Request) {
+	name, err := routeName(request, "name")
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	dir, err := ac.repositoryDir(name)
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	if rejectReadOnly(writer, dir) {
+		return
+	}
+	overwrite, _ := strconv.ParseBool(request.URL.Query().Get("overwrite"))
+
+	body := request.Body
+	if ac.MaxArchiveSize > 0 {
+		body = http.MaxBytesReader(writer, request.Body, ac.MaxArchiveSize)
+	}
+	err = sfile.RestoreArchive(body, dir, sfile.RestoreOptions{
+		MaxSize:   ac.MaxArchiveSize,
+		Overwrite: overwrite,
+	})
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		switch {
+		case errors.Is(err, sfile.ErrRepositoryExists):
+			WriteError(writer, http.StatusConflict, "Repository already exists, use ?overwrite=true to replace it")
+		case errors.Is(err, sfile.ErrRepositoryLocked):
+			WriteError(writer, http.StatusConflict, repositoryLockedMessage)
+		case errors.Is(err, sfile.ErrArchiveTooLarge), errors.As(err, &maxBytesError):
+			WriteError(writer, http.StatusRequestEntityTooLarge, "Archive exceeds the size limit")
+		case errors.Is(err, sfile.ErrUnsafeArchivePath), errors.Is(err, sfile.ErrUnsupportedArchive), errors.Is(err, sfile.ErrInvalidShard):
+			WriteError(writer, http.StatusBadRequest, err.Error())
+		default:
+			logError("Error restoring archive into %s: %v", name, err)
+			WriteError(writer, http.StatusInternalServerError, "Failed to restore repository")
+		}
+		return
+	}
+	log.Printf("Repository %s restored from archive", name)
+	ac.TileCache.EvictRepository(ac.repositoryKey(dir))
+	ac.catalog().Invalidate()
+	WriteOk(writer, sfile.LoadRepository(ac.RepositoryRoot, name).Public())
+}
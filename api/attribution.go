@@ -0,0 +1,34 @@
+package api
+
+import (
+	"SirServer/canvas"
+	"SirServer/sfile"
+)
+
+// attributionOverlay returns the attribution overlay of repo with its text
+// resolved: its own, or the default one when BurnAttribution is on. It is nil
+// when no attribution is drawn, such as for a repository without attribution.
+func (ac *ApiContext) attributionOverlay(repo sfile.Repository) *sfile.AttributionOverlay {
+	overlay := sfile.AttributionOverlay{}
+	switch {
+	case repo.AttributionOverlay != nil:
+		overlay = *repo.AttributionOverlay
+	case !ac.BurnAttribution:
+		return nil
+	}
+	overlay = overlay.Resolve(repo)
+	if overlay.Text == "" {
+		return nil
+	}
+	return &overlay
+}
+
+// attributionOptions returns the canvas options of overlay, drawn in the font
+// of the canvas context
+func (ac *ApiContext) attributionOptions(overlay sfile.AttributionOverlay) (canvas.AttributionOptions, error) {
+	options, err := overlay.Options()
+	if ac.CanvasContext != nil {
+		options.Font = ac.CanvasContext.TrueTypeFont()
+	}
+	return options, err
+}
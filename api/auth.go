@@ -0,0 +1,45 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// requestToken extracts the caller's token from the Authorization bearer header,
+// the X-Admin-Token header or the token query parameter
+func requestToken(request *http.Request) string {
+	if auth := request.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if token := request.Header.Get("X-Admin-Token"); token != "" {
+		return token
+	}
+	return request.URL.Query().Get("token")
+}
+
+// isAdmin reports whether the request carries the configured admin token
+func (ac *ApiContext) isAdmin(request *http.Request) bool {
+	if ac.AdminToken == "" {
+		return false
+	}
+	token := requestToken(request)
+	return subtle.ConstantTimeCompare([]byte(token), []byte(ac.AdminToken)) == 1
+}
+
+// requireAdmin wraps a handler so it is only reachable by admin callers.
+// Admin endpoints are disabled entirely when no admin token is configured.
+func (ac *ApiContext) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if ac.AdminToken == "" {
+			WriteError(writer, http.StatusForbidden, "Admin endpoints are disabled, start the server with --admin-token")
+			return
+		}
+		if !ac.isAdmin(request) {
+			writer.Header().Set("WWW-Authenticate", `Bearer realm="SirServer"`)
+			WriteError(writer, http.StatusUnauthorized, "Admin token required")
+			return
+		}
+		next(writer, request)
+	}
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"SirServer/sfile"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// PurgeRequest selects the cache entries evicted by the purge endpoint.
+// Every field is optional, an empty request purges everything.
+type PurgeRequest struct {
+	Repository string      `json:"repository"`
+	MinZoom    *int        `json:"min_zoom"`
+	MaxZoom    *int        `json:"max_zoom"`
+	BBox       *[4]float64 `json:"bbox"` // minLng, minLat, maxLng, maxLat
+}
+
+// matchesRepository reports whether entries of the named repository are selected
+func (p PurgeRequest) matchesRepository(name string) bool {
+	return p.Repository == "" || p.Repository == name
+}
+
+// matchesTile reports whether the tile z/x/y of the named repository, cut in
+// grid, is selected
+func (p PurgeRequest) matchesTile(name string, grid sfile.TileGrid, z int8, x int64, y int64) bool {
+	if !p.matchesRepository(name) {
+		return false
+	}
+	if p.MinZoom != nil && int(z) < *p.MinZoom {
+		return false
+	}
+	if p.MaxZoom != nil && int(z) > *p.MaxZoom {
+		return false
+	}
+	if p.BBox != nil {
+		minX, minY, maxX, maxY := grid.TileRange(*p.BBox, z)
+		if x < minX || x > maxX || y < minY || y > maxY {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesMessage reports whether the cached message tile showing text is
+// selected. Message tiles show errors rather than the tiles of a repository,
+// so only purges of every repository select them.
+func (p PurgeRequest) matchesMessage(text string) bool {
+	return p.Repository == ""
+}
+
+// handleMatcher selects the cached shard handles below the named repository,
+// or every handle when name is empty
+func (ac *ApiContext) handleMatcher(name string) func(path string) bool {
+	if name == "" {
+		return func(string) bool { return true }
+	}
+	dir, err := ac.repositoryDir(name)
+	if err != nil {
+		return func(string) bool { return false }
+	}
+	if absolute, err := filepath.Abs(dir); err == nil {
+		dir = absolute
+	}
+	return func(path string) bool {
+		return strings.HasPrefix(path, dir+string(filepath.Separator))
+	}
+}
+
+// purgeMosaics deletes the contact sheets of the repositories purge selects,
+// see sfile.WriteMosaic, and returns how many it deleted
+func (ac *ApiContext) purgeMosaics(purge PurgeRequest) int {
+	var names []string
+	if purge.Repository != "" {
+		names = append(names, purge.Repository)
+	} else {
+		repos, _, err := ac.catalog().List()
+		if err != nil {
+			logError("Cache purge failed to list the repositories: %v", err)
+		}
+		for _, repo := range repos {
+			names = append(names, repo.Name)
+		}
+	}
+	deleted := 0
+	for _, name := range names {
+		dir, err := ac.repositoryDir(name)
+		if err != nil {
+			continue
+		}
+		removed, err := sfile.RemoveMosaic(dir)
+		if err != nil {
+			logError("Cache purge failed to delete the mosaic of %s: %v", name, err)
+		}
+		if removed {
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// cachePurgeHandler evicts matching entries from every server side cache,
+// deletes the contact sheets of the repositories matched and reports how many
+// entries each cache dropped
+func (ac *ApiContext) cachePurgeHandler(writer http.ResponseWriter, request *http.Request) {
+	var purge PurgeRequest
+	if err := json.NewDecoder(request.Body).Decode(&purge); err != nil && !errors.Is(err, io.EOF) {
+		WriteError(writer, http.StatusBadRequest, "Invalid purge request: "+err.Error())
+		return
+	}
+	if purge.BBox != nil && (purge.BBox[0] > purge.BBox[2] || purge.BBox[1] > purge.BBox[3]) {
+		WriteError(writer, http.StatusBadRequest, "bbox must be [minLng, minLat, maxLng, maxLat]")
+		return
+	}
+
+	evicted := map[string]int{
+		"storage":   ac.usageCache.EvictIf(purge.matchesRepository),
+		"handles":   sfile.FlushHandles(ac.handleMatcher(purge.Repository)),
+		"existence": sfile.ForgetExistence(ac.handleMatcher(purge.Repository)),
+		"tiles": ac.TileCache.EvictIf(func(key sfile.TileKey) bool {
+			return purge.matchesTile(key.Repository, ac.tileGrid(key.Repository), key.Z, key.X, key.Y)
+		}),
+		"messages": ac.CanvasContext.EvictCachedImages(purge.matchesMessage),
+		"mosaics":  ac.purgeMosaics(purge),
+	}
+	// the repository list is rescanned as a whole, whatever the purge matched
+	ac.catalog().Invalidate()
+	log.Printf("Cache purge %+v evicted %v", purge, evicted)
+	WriteOk(writer, evicted)
+}
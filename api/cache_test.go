@@ -0,0 +1,269 @@
+package api
+
+import (
+	"SirServer/sfile"
+	"SirServer/sfile/sfiletest"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newCacheTestServer serves source as the repository name with a tile cache of
+// budget bytes keeping missing tiles for negativeTTL, and returns the api
+// context with a router for it. The admin token is "secret".
+func newCacheTestServer(t *testing.T, name string, source sfile.TileSource, budget int64, negativeTTL time.Duration) (*ApiContext, http.Handler) {
+	t.Helper()
+	root := t.TempDir()
+	t.Cleanup(sfiletest.Serve(root, name, source))
+	ac := newTestApiContext(t, root)
+	ac.TileCache = sfile.NewTileCache(budget, negativeTTL)
+	ac.AdminToken = "secret"
+	return ac, newTestRouter(ac)
+}
+
+// getTile requests path of router and returns the response
+func getTile(router http.Handler, path string) *httptest.ResponseRecorder {
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, path, nil))
+	return response
+}
+
+// TestTileCache serves tiles of a memory source through the xyz handler and
+// checks stored tiles are read once, missing tiles are remembered for the
+// negative TTL only, failed reads are never cached, and a purge evicts the
+// tiles it selects and no other
+func TestTileCache(t *testing.T) {
+	source := sfiletest.NewMemSource(sfile.Repository{Name: "mem"})
+	tiles := map[string][]byte{
+		"3/2/1": pngTile(t, color.NRGBA{R: 0xff, A: 0xff}),
+		"4/4/2": pngTile(t, color.NRGBA{G: 0xff, A: 0xff}),
+		"4/5/2": pngTile(t, color.NRGBA{B: 0xff, A: 0xff}),
+	}
+	source.Put(3, 2, 1, tiles["3/2/1"])
+	source.Put(4, 4, 2, tiles["4/4/2"])
+	source.Put(4, 5, 2, tiles["4/5/2"])
+	source.FailTile(3, 7, 7, errors.New("disk on fire"))
+	const negativeTTL = 250 * time.Millisecond
+	ac, router := newCacheTestServer(t, "mem", source, 1<<20, negativeTTL)
+
+	// fetch requests the tile at address and checks it was served from want,
+	// with the stored data, and that it took reads more reads of the source
+	fetch := func(address string, want string, reads int64) {
+		t.Helper()
+		before := source.Reads()
+		response := getTile(router, "/api/v1/xyz/mem/"+address+".png")
+		if response.Code != http.StatusOK || !bytes.Equal(response.Body.Bytes(), tiles[address]) {
+			t.Fatalf("tile %s: status %d, %d bytes, want the stored tile", address, response.Code, response.Body.Len())
+		}
+		if from := response.Header().Get(tileSourceHeader); from != want {
+			t.Errorf("tile %s served from %q, want %q", address, from, want)
+		}
+		if got := source.Reads() - before; got != reads {
+			t.Errorf("tile %s read %d times from the source, want %d", address, got, reads)
+		}
+	}
+	for _, address := range []string{"3/2/1", "4/4/2", "4/5/2"} {
+		fetch(address, sfile.TileSourceLocal, 1)
+		fetch(address, tileSourceCache, 0)
+	}
+	if stats := ac.TileCache.Stats(); stats.Entries != 3 || stats.Hits != 3 || stats.Misses != 3 {
+		t.Errorf("stats %+v, want 3 entries, 3 hits and 3 misses", stats)
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		before := source.Reads()
+		// the raw route answers quickly, without drawing a placeholder
+		for range 3 {
+			if response := getTile(router, "/api/v1/raw/mem/3/0/0"); response.Code != http.StatusNotFound {
+				t.Fatalf("missing tile: status %d, want 404", response.Code)
+			}
+		}
+		if reads := source.Reads() - before; reads != 1 {
+			t.Errorf("missing tile read %d times, want once then remembered", reads)
+		}
+		// a tile written later shows up once the negative TTL ran out
+		tiles["3/0/0"] = pngTile(t, color.White)
+		source.Put(3, 0, 0, tiles["3/0/0"])
+		time.Sleep(negativeTTL + 50*time.Millisecond)
+		fetch("3/0/0", sfile.TileSourceLocal, 1)
+		fetch("3/0/0", tileSourceCache, 0)
+	})
+
+	t.Run("failing", func(t *testing.T) {
+		before := source.Reads()
+		for range 3 {
+			if response := getTile(router, "/api/v1/xyz/mem/3/7/7.png"); response.Code != http.StatusInternalServerError {
+				t.Fatalf("failing tile: status %d, want 500", response.Code)
+			}
+		}
+		if reads := source.Reads() - before; reads != 3 {
+			t.Errorf("failing tile read %d times, want every request to retry", reads)
+		}
+	})
+
+	t.Run("purge", func(t *testing.T) {
+		purge := func(body string) map[string]int {
+			t.Helper()
+			request := httptest.NewRequest(http.MethodPost, "/api/v1/cache/purge", strings.NewReader(body))
+			request.Header.Set("Authorization", "Bearer secret")
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, request)
+			if response.Code != http.StatusOK {
+				t.Fatalf("purge %s: status %d: %s", body, response.Code, response.Body)
+			}
+			var result struct {
+				Data map[string]int `json:"data"`
+			}
+			if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil {
+				t.Fatal(err)
+			}
+			return result.Data
+		}
+		if evicted := purge(`{"repository":"other"}`); evicted["tiles"] != 0 {
+			t.Errorf("purging another repository evicted %d tiles", evicted["tiles"])
+		}
+		// the bbox holds tile 4/4/2 but not 4/5/2
+		if evicted := purge(`{"repository":"mem","min_zoom":4,"bbox":[-80,75,-70,78]}`); evicted["tiles"] != 1 {
+			t.Errorf("purging zoom 4 in a bbox evicted %d tiles, want 1", evicted["tiles"])
+		}
+		fetch("4/4/2", sfile.TileSourceLocal, 1)
+		fetch("4/5/2", tileSourceCache, 0)
+		fetch("3/2/1", tileSourceCache, 0)
+
+		if evicted := purge(`{"repository":"mem","min_zoom":4}`); evicted["tiles"] != 2 {
+			t.Errorf("purging zoom 4 evicted %d tiles, want 2", evicted["tiles"])
+		}
+		fetch("4/5/2", sfile.TileSourceLocal, 1)
+		fetch("3/2/1", tileSourceCache, 0)
+
+		// everything cached so far: 3/2/1, 3/0/0 and 4/5/2
+		if evicted := purge(``); evicted["tiles"] != 3 {
+			t.Errorf("purging everything evicted %d tiles, want 3", evicted["tiles"])
+		}
+		if entries := ac.TileCache.Stats().Entries; entries != 0 {
+			t.Errorf("%d tiles cached after purging everything", entries)
+		}
+		fetch("3/2/1", sfile.TileSourceLocal, 1)
+	})
+}
+
+// TestTileCacheBudget fills a small tile cache and checks the least recently
+// used tiles are evicted first and tiles over a quarter of the budget are
+// never cached
+func TestTileCacheBudget(t *testing.T) {
+	const tileSize = 1000
+	source := sfiletest.NewMemSource(sfile.Repository{Name: "mem"})
+	for x := int64(0); x < 8; x++ {
+		source.Put(5, x, 0, append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{byte(x)}, tileSize-8)...))
+	}
+	source.Put(5, 0, 1, append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 3000)...))
+	// seven tiles of 1000 bytes with their bookkeeping fit, an eighth does not
+	ac, router := newCacheTestServer(t, "mem", source, 8000, 0)
+
+	fetch := func(x int64, y int64) string {
+		t.Helper()
+		response := getTile(router, fmt.Sprintf("/api/v1/xyz/mem/5/%d/%d.png", x, y))
+		if response.Code != http.StatusOK {
+			t.Fatalf("tile 5/%d/%d: status %d", x, y, response.Code)
+		}
+		return response.Header().Get(tileSourceHeader)
+	}
+	for x := int64(0); x < 7; x++ {
+		fetch(x, 0)
+	}
+	// tile 0 is used again, so tile 1 is now the least recently used
+	if from := fetch(0, 0); from != tileSourceCache {
+		t.Fatalf("tile 0 served from %q, want the cache", from)
+	}
+	fetch(7, 0)
+	if stats := ac.TileCache.Stats(); stats.Entries != 7 || stats.Evictions != 1 || stats.Bytes > stats.Budget {
+		t.Errorf("stats %+v, want 7 entries within the budget after 1 eviction", stats)
+	}
+	for x, want := range []string{tileSourceCache, sfile.TileSourceLocal} {
+		if from := fetch(int64(x), 0); from != want {
+			t.Errorf("tile %d served from %q, want %q", x, from, want)
+		}
+	}
+
+	before := source.Reads()
+	for range 2 {
+		if from := fetch(0, 1); from != sfile.TileSourceLocal {
+			t.Errorf("tile over a quarter of the budget served from %q", from)
+		}
+	}
+	if reads := source.Reads() - before; reads != 2 {
+		t.Errorf("tile over a quarter of the budget read %d times, want every time", reads)
+	}
+}
+
+// TestCachePurgePreviews checks a purge deletes the mosaics of the
+// repositories it selects and drops cached message tiles when it selects
+// every repository
+func TestCachePurgePreviews(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		dir := filepath.Join(root, name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "repository.json"), []byte(`{"name":"`+name+`"}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, sfile.MosaicFile), pngTile(t, color.White), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ac := newTestApiContext(t, root)
+	ac.AdminToken = "secret"
+	router := newTestRouter(ac)
+	if _, err := ac.CanvasContext.CreateCachedImage(256, 256, ac.ErrorTileStyle, "Tile not found"); err != nil {
+		t.Fatal(err)
+	}
+
+	purge := func(body string) map[string]int {
+		t.Helper()
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/cache/purge", strings.NewReader(body))
+		request.Header.Set("Authorization", "Bearer secret")
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		if response.Code != http.StatusOK {
+			t.Fatalf("purge %s: status %d: %s", body, response.Code, response.Body)
+		}
+		var result struct {
+			Data map[string]int `json:"data"`
+		}
+		if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		return result.Data
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(root, name, sfile.MosaicFile))
+		return err == nil
+	}
+
+	if evicted := purge(`{"repository":"a"}`); evicted["mosaics"] != 1 || evicted["messages"] != 0 {
+		t.Errorf("purging a evicted %v, want its mosaic and no message tile", evicted)
+	}
+	if exists("a") || !exists("b") {
+		t.Errorf("after purging a: mosaic of a %v, of b %v", exists("a"), exists("b"))
+	}
+	if evicted := purge(``); evicted["mosaics"] != 1 || evicted["messages"] != 1 {
+		t.Errorf("purging everything evicted %v, want the mosaic of b and the message tile", evicted)
+	}
+	if exists("b") || ac.CanvasContext.ImageCacheStats().Entries != 0 {
+		t.Error("mosaic or message tile left after purging everything")
+	}
+	if evicted := purge(``); evicted["mosaics"] != 0 || evicted["messages"] != 0 {
+		t.Errorf("purging again evicted %v", evicted)
+	}
+}
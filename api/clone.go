@@ -0,0 +1,99 @@
+package api
+
+import (
+	"SirServer/sfile"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+)
+
+// CloneRequest is the body of a clone request
+type CloneRequest struct {
+	Name    string `json:"name"`               // of the new repository
+	MinZoom *int   `json:"min_zoom,omitempty"` // lowest zoom copied, no limit when unset
+	MaxZoom *int   `json:"max_zoom,omitempty"` // highest zoom copied, no limit when unset
+}
+
+// cloneHandler starts a background job copying a repository, file by file, into
+// a new repository. Progress is published as job events.
+func (ac *ApiContext) cloneHandler(writer http.ResponseWriter, request *http.Request) {
+	name, err := routeName(request, "name")
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	dir, err := ac.repositoryDir(name)
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	if sfile.IsArchive(dir) || sfile.IsS3Root(ac.RepositoryRoot) {
+		WriteError(writer, http.StatusNotImplemented, "Cloning is only available for local repositories of .s files")
+		return
+	}
+	if !isDirectory(dir) {
+		WriteError(writer, http.StatusNotFound, "Repository not found")
+		return
+	}
+	var clone CloneRequest
+	if err := json.NewDecoder(request.Body).Decode(&clone); err != nil {
+		WriteError(writer, http.StatusBadRequest, "Invalid clone request: "+err.Error())
+		return
+	}
+	dstDir, err := ac.repositoryDir(clone.Name)
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	dstName := normalizeName(ac.RepositoryRoot, clone.Name)
+	if _, err := os.Stat(dstDir); err == nil {
+		WriteError(writer, http.StatusConflict, "Repository "+dstName+" already exists")
+		return
+	}
+	options := sfile.CloneOptions{Context: context.Background(), Root: ac.RepositoryRoot}
+	for _, zoom := range []*int{clone.MinZoom, clone.MaxZoom} {
+		if zoom != nil && (*zoom < 0 || *zoom > maxTileZoom) {
+			WriteError(writer, http.StatusBadRequest, fmt.Sprintf("zoom range must be within 0..%d", maxTileZoom))
+			return
+		}
+	}
+	if clone.MinZoom != nil && clone.MaxZoom != nil && *clone.MinZoom > *clone.MaxZoom {
+		WriteError(writer, http.StatusBadRequest, "min_zoom must not be above max_zoom")
+		return
+	}
+	if clone.MinZoom != nil {
+		minZoom := int8(*clone.MinZoom)
+		options.MinZoom = &minZoom
+	}
+	if clone.MaxZoom != nil {
+		maxZoom := int8(*clone.MaxZoom)
+		options.MaxZoom = &maxZoom
+	}
+
+	job := ac.startJob("clone", name)
+	var progress sfile.CloneProgress
+	options.Progress = func(copied sfile.CloneProgress) {
+		progress = copied
+		ac.updateJob(job.ID, copied)
+	}
+	go func() {
+		// the job outlives the request that started it
+		err := sfile.Clone(dir, dstName, options)
+		if err != nil {
+			logError("Clone job %s of %s into %s failed: %v", job.ID, name, dstName, err)
+		} else {
+			log.Printf("Clone job %s of %s into %s done: %d files, %d bytes", job.ID, name, dstName, progress.Files, progress.Bytes)
+		}
+		ac.catalog().Invalidate()
+		ac.finishJob(job.ID, progress, err)
+	}()
+
+	writer.Header().Set("Location", "/api/v1/jobs/"+job.ID)
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusAccepted)
+	result, _ := json.Marshal(Ok(job))
+	_, _ = writer.Write(result)
+}
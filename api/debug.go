@@ -0,0 +1,113 @@
+package api
+
+import (
+	"SirServer/canvas"
+	"SirServer/sfile"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"path/filepath"
+)
+
+// DebugInfo is the diagnostics report served by /debug
+type DebugInfo struct {
+	StaticFiles    []string               `json:"static_files"`
+	Config         map[string]interface{} `json:"config"`
+	RepositoryRoot RootResolution         `json:"repository_root"`
+	OpenHandles    int64                  `json:"open_handles"`
+	Caches         map[string]int         `json:"caches"`
+	RecentErrors   []sfile.ErrorRecord    `json:"recent_errors"`
+	Mismatches     int64                  `json:"checksum_mismatches"` // tiles read that did not match their checksum
+	Retries        int64                  `json:"retries"`             // shard reads and writes retried after a transient error
+	SQLite         sfile.SQLiteTuning     `json:"sqlite"`              // the settings the .s files are opened with
+	MessageTiles   canvas.ImageCacheStats `json:"message_tiles"`       // the cache of the images answering missing tiles
+}
+
+// RootResolution describes how the configured repository root resolves on disk
+type RootResolution struct {
+	Configured string `json:"configured"`
+	Absolute   string `json:"absolute"`
+	Resolved   string `json:"resolved"`
+	Exists     bool   `json:"exists"`
+	Error      string `json:"error,omitempty"`
+}
+
+// logError logs a failure and keeps it in the recent errors reported by /debug
+func logError(format string, args ...interface{}) {
+	err := fmt.Errorf(format, args...)
+	log.Print(err)
+	sfile.RecordError("api", err)
+}
+
+// redacted hides a secret while still telling whether it is set
+func redacted(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "<redacted>"
+}
+
+// debugHandler reports diagnostics for operators without shell access
+func (ac *ApiContext) debugHandler(writer http.ResponseWriter, request *http.Request) {
+	info := DebugInfo{
+		StaticFiles: make([]string, 0),
+		Config: map[string]interface{}{
+			"repository_root":  ac.RepositoryRoot,
+			"repository_depth": ac.RepositoryDepth,
+			"follow_symlinks":  ac.FollowSymlinks,
+			"max_archive_size": ac.MaxArchiveSize,
+			"admin_token":      redacted(ac.AdminToken),
+			"debug":            ac.Debug,
+			"write_enabled":    ac.WriteEnabled,
+		},
+		RepositoryRoot: resolveRoot(ac.RepositoryRoot),
+		OpenHandles:    sfile.OpenHandles(),
+		Caches: map[string]int{
+			"storage_usage":     ac.usageCache.Len(),
+			"repositories":      ac.catalog().Len(),
+			"sqlite_handles":    sfile.CachedHandles(),
+			"tiles":             ac.TileCache.Stats().Entries,
+			"jobs":              ac.jobCount(),
+			"event_subscribers": ac.events.Subscribers(),
+			"pending_analyses":  sfile.PendingAnalyses(),
+		},
+		RecentErrors: sfile.RecentErrors(),
+		Mismatches:   sfile.ChecksumMismatches(),
+		Retries:      sfile.Retries(),
+		SQLite:       sfile.EffectiveSQLiteTuning(),
+		MessageTiles: ac.CanvasContext.ImageCacheStats(),
+	}
+	err := fs.WalkDir(ac.StaticFiles, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			info.StaticFiles = append(info.StaticFiles, path)
+		}
+		return nil
+	})
+	if err != nil {
+		logError("Error listing embedded files: %v", err)
+	}
+	WriteOk(writer, info)
+}
+
+// resolveRoot follows the repository root to the directory actually served
+func resolveRoot(root string) RootResolution {
+	resolution := RootResolution{Configured: root}
+	absolute, err := filepath.Abs(root)
+	if err != nil {
+		resolution.Error = err.Error()
+		return resolution
+	}
+	resolution.Absolute = absolute
+	resolved, err := filepath.EvalSymlinks(absolute)
+	if err != nil {
+		resolution.Error = err.Error()
+		return resolution
+	}
+	resolution.Resolved = resolved
+	resolution.Exists = isDirectory(resolved)
+	return resolution
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Event is a server side notification delivered to /api/v1/events subscribers
+type Event struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// EventHub fans published events out to every subscriber. Slow subscribers
+// drop events instead of blocking the publisher.
+type EventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+// NewEventHub creates an empty EventHub
+func NewEventHub() *EventHub {
+	return &EventHub{subscribers: make(map[chan Event]struct{})}
+}
+
+// Publish sends event to all current subscribers
+func (h *EventHub) Publish(event Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Subscribers returns the number of current subscribers
+func (h *EventHub) Subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers)
+}
+
+// Subscribe registers a new subscriber. The returned function must be called
+// to unsubscribe, it closes the channel.
+func (h *EventHub) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 64)
+	h.mu.Lock()
+	h.subscribers[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subscribers, ch)
+		h.mu.Unlock()
+		close(ch)
+	}
+}
+
+// eventsHandler streams published events as server sent events until the client goes away
+func (ac *ApiContext) eventsHandler(writer http.ResponseWriter, request *http.Request) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		WriteError(writer, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+	events, unsubscribe := ac.events.Subscribe()
+	defer unsubscribe()
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Connection", "keep-alive")
+	writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case event := <-events:
+			data, err := json.Marshal(event.Data)
+			if err != nil {
+				logError("Error marshalling %s event: %v", event.Type, err)
+				continue
+			}
+			if _, err := fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-request.Context().Done():
+			return
+		}
+	}
+}
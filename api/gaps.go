@@ -0,0 +1,87 @@
+package api
+
+import (
+	"SirServer/sfile"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// gapsHandler reports the tiles missing at ?z= within ?bbox=minLng,minLat,maxLng,maxLat,
+// the repository extent when no bbox is given. The missing tiles are paged with
+// ?offset= and ?limit=; ?summary=true only counts them.
+func (ac *ApiContext) gapsHandler(writer http.ResponseWriter, request *http.Request) {
+	name, err := routeName(request, "name")
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	dir, err := ac.repositoryDir(name)
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	if sfile.IsArchive(dir) || sfile.IsS3Root(ac.RepositoryRoot) {
+		WriteError(writer, http.StatusNotImplemented, "Gap analysis is only available for local repositories of .s files")
+		return
+	}
+	if !isDirectory(dir) {
+		WriteError(writer, http.StatusNotFound, "Repository not found")
+		return
+	}
+	query := request.URL.Query()
+	z, err := strconv.Atoi(query.Get("z"))
+	if err != nil || z < 0 || z > maxTileZoom {
+		WriteError(writer, http.StatusBadRequest, fmt.Sprintf("z must be between 0 and %d", maxTileZoom))
+		return
+	}
+	var bbox *[4]float64
+	if value := query.Get("bbox"); value != "" {
+		bbox, err = sfile.ParseBBox(value)
+		if err != nil {
+			WriteError(writer, http.StatusBadRequest, err.Error())
+			return
+		}
+	} else if repo, ok := ac.catalog().Lookup(ac.repositoryKey(dir)); ok && repo.HasBounds() {
+		bbox = &repo.Bounds
+	} else {
+		WriteError(writer, http.StatusBadRequest, "bbox is required, the extent of the repository is not known yet")
+		return
+	}
+	options := sfile.GapOptions{Limit: sfile.DefaultGapLimit}
+	if query.Get("summary") == "true" {
+		options.Limit = 0
+	} else if value := query.Get("limit"); value != "" {
+		options.Limit, err = strconv.Atoi(value)
+		if err != nil || options.Limit < 1 || options.Limit > sfile.MaxGapLimit {
+			WriteError(writer, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", sfile.MaxGapLimit))
+			return
+		}
+	}
+	if value := query.Get("offset"); value != "" {
+		options.Offset, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || options.Offset < 0 {
+			WriteError(writer, http.StatusBadRequest, "offset must be a non-negative integer")
+			return
+		}
+	}
+
+	var box sfile.Box
+	box.Set(bbox[0], bbox[1], bbox[2], bbox[3])
+	report, err := sfile.FindGapsWithOptions(dir, int8(z), box, options)
+	if errors.Is(err, sfile.ErrGapRangeTooLarge) {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, sfile.ErrRepositoryNotFound) {
+		WriteError(writer, http.StatusNotFound, "Repository not found")
+		return
+	}
+	if err != nil {
+		logError("Error finding gaps of %s at zoom %d: %v", name, z, err)
+		WriteError(writer, http.StatusInternalServerError, "Failed to find gaps")
+		return
+	}
+	WriteOk(writer, report)
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"github.com/gorilla/mux"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Job states
+const (
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// Job is a long running background task started through the API
+type Job struct {
+	ID         string      `json:"id"`
+	Kind       string      `json:"kind"`
+	Repository string      `json:"repository"`
+	State      string      `json:"state"`
+	Progress   interface{} `json:"progress"`
+	Error      string      `json:"error,omitempty"`
+	StartedAt  time.Time   `json:"started_at"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+}
+
+// jobRegistry keeps every job started since the server came up
+type jobRegistry struct {
+	mu     sync.Mutex
+	nextID atomic.Int64
+	jobs   map[string]*Job
+}
+
+// startJob registers a running job and announces it
+func (ac *ApiContext) startJob(kind string, repository string) Job {
+	ac.jobs.mu.Lock()
+	defer ac.jobs.mu.Unlock()
+	if ac.jobs.jobs == nil {
+		ac.jobs.jobs = make(map[string]*Job)
+	}
+	job := &Job{
+		ID:         strconv.FormatInt(ac.jobs.nextID.Add(1), 10),
+		Kind:       kind,
+		Repository: repository,
+		State:      JobRunning,
+		StartedAt:  time.Now(),
+	}
+	ac.jobs.jobs[job.ID] = job
+	ac.events.Publish(Event{Type: "job", Data: *job})
+	return *job
+}
+
+// updateJob records the progress of a running job and announces it
+func (ac *ApiContext) updateJob(id string, progress interface{}) {
+	ac.jobs.mu.Lock()
+	defer ac.jobs.mu.Unlock()
+	job, ok := ac.jobs.jobs[id]
+	if !ok {
+		return
+	}
+	job.Progress = progress
+	ac.events.Publish(Event{Type: "job", Data: *job})
+}
+
+// finishJob marks a job done or failed and announces it
+func (ac *ApiContext) finishJob(id string, progress interface{}, err error) {
+	ac.jobs.mu.Lock()
+	defer ac.jobs.mu.Unlock()
+	job, ok := ac.jobs.jobs[id]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	job.Progress = progress
+	job.FinishedAt = &now
+	job.State = JobDone
+	if err != nil {
+		job.State = JobFailed
+		job.Error = err.Error()
+	}
+	ac.events.Publish(Event{Type: "job", Data: *job})
+}
+
+// jobCount returns the number of jobs known to the registry
+func (ac *ApiContext) jobCount() int {
+	ac.jobs.mu.Lock()
+	defer ac.jobs.mu.Unlock()
+	return len(ac.jobs.jobs)
+}
+
+// listJobsHandler returns every known job, most recent first
+func (ac *ApiContext) listJobsHandler(writer http.ResponseWriter, request *http.Request) {
+	ac.jobs.mu.Lock()
+	jobs := make([]Job, 0, len(ac.jobs.jobs))
+	for _, job := range ac.jobs.jobs {
+		jobs = append(jobs, *job)
+	}
+	ac.jobs.mu.Unlock()
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].StartedAt.After(jobs[j].StartedAt)
+	})
+	WriteOk(writer, jobs)
+}
+
+// jobHandler returns a single job
+func (ac *ApiContext) jobHandler(writer http.ResponseWriter, request *http.Request) {
+	ac.jobs.mu.Lock()
+	job, ok := ac.jobs.jobs[mux.Vars(request)["id"]]
+	var snapshot Job
+	if ok {
+		snapshot = *job
+	}
+	ac.jobs.mu.Unlock()
+	if !ok {
+		WriteError(writer, http.StatusNotFound, "Job not found")
+		return
+	}
+	WriteOk(writer, snapshot)
+}
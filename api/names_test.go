@@ -0,0 +1,148 @@
+package api
+
+import (
+	"SirServer/sfile"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestRepositoryNames lists repositories named in Chinese, with a space and
+// with an emoji, and fetches a tile of each through the percent-encoded name
+// the listing hands out
+func TestRepositoryNames(t *testing.T) {
+	root := t.TempDir()
+	names := []string{"北京影像", "my tiles", "🗺️ map"}
+	for _, name := range names {
+		dir := filepath.Join(root, name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		repo, err := sfile.NewRepository(dir, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.WriteXYZ(1, 1, 2, []byte("tile of "+name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() { sfile.FlushHandles(func(string) bool { return true }) })
+	router := newRootTestServer(t, root)
+	get := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder
+	}
+
+	response := get("/api/v1/repositories")
+	if response.Code != http.StatusOK {
+		t.Fatalf("listing status %d, want 200", response.Code)
+	}
+	var listing struct {
+		Data []sfile.Repository `json:"data"`
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &listing); err != nil {
+		t.Fatal(err)
+	}
+	listed := map[string]bool{}
+	for _, repository := range listing.Data {
+		listed[repository.Name] = true
+	}
+	for _, name := range names {
+		if !listed[name] {
+			t.Errorf("repository %q not listed in %s", name, response.Body.String())
+		}
+	}
+
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			for _, path := range []string{
+				"/api/v1/xyz/" + url.PathEscape(name) + "/2/1/1.png",
+				"/api/v1/raw/" + url.PathEscape(name) + "/2/1/1",
+			} {
+				response := get(path)
+				if response.Code != http.StatusOK || response.Body.String() != "tile of "+name {
+					t.Fatalf("%s: status %d body %q, want the stored tile", path, response.Code, response.Body.String())
+				}
+			}
+		})
+	}
+}
+
+// TestRepositoryNameSeparators checks nested repositories are addressed by
+// literal slashes only: a name element that decodes to a slash or a backslash
+// is refused rather than taken for the nested repository or a path of its own
+func TestRepositoryNameSeparators(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "a", "b")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := sfile.NewRepository(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.WriteXYZ(1, 1, 2, []byte("nested tile")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sfile.FlushHandles(func(string) bool { return true }) })
+	ac := newTestApiContext(t, root)
+	ac.RepositoryDepth = 2
+	router := newTestRouter(ac)
+	get := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder
+	}
+
+	if response := get("/api/v1/raw/a/b/2/1/1"); response.Code != http.StatusOK || response.Body.String() != "nested tile" {
+		t.Fatalf("raw tile of a/b: status %d body %q, want the stored tile", response.Code, response.Body.String())
+	}
+	for _, name := range []string{"a%2Fb", "a%2fb", "a%5Cb", "a/..%2Fa", "%2E%2E%2F%2E%2E%2Fetc"} {
+		if response := get("/api/v1/raw/" + name + "/2/1/1"); response.Code != http.StatusBadRequest {
+			t.Errorf("raw tile of %s: status %d, want 400", name, response.Code)
+		}
+		if code := get("/api/v1/xyz/" + name + "/2/1/1.png").Header().Get(tileErrorCodeHeader); code != "bad_request" {
+			t.Errorf("xyz tile of %s: error code %q, want bad_request", name, code)
+		}
+	}
+}
+
+// TestRepositorySymlinks serves a repository of the root that is a symlink to a
+// directory outside it: listed and served while symlinks are followed, which
+// is how a root is assembled from several disks, and neither listed nor served
+// with --no-follow-symlinks
+func TestRepositorySymlinks(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	repo, err := sfile.NewRepository(outside, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.WriteXYZ(1, 1, 2, []byte("linked tile")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sfile.FlushHandles(func(string) bool { return true }) })
+	if err := os.Symlink(outside, filepath.Join(root, "linked")); err != nil {
+		t.Skipf("symlinks unavailable: %v", err)
+	}
+
+	for _, follow := range []bool{true, false} {
+		ac := newTestApiContext(t, root)
+		ac.FollowSymlinks = follow
+		router := newTestRouter(ac)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/api/v1/repositories", nil))
+		listed := strings.Contains(response.Body.String(), `"linked"`)
+		response = httptest.NewRecorder()
+		router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/api/v1/raw/linked/2/1/1", nil))
+		served := response.Code == http.StatusOK && response.Body.String() == "linked tile"
+		if listed != follow || served != follow {
+			t.Errorf("following symlinks %v: listed %v, served %v (status %d)", follow, listed, served, response.Code)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package api
+
+import (
+	"SirServer/canvas"
+	"SirServer/sfile"
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+	"time"
+)
+
+// overlayJPEGQuality is the quality JPEG tiles are encoded again with once
+// drawn over, high so the imagery loses little over the stored tile
+const overlayJPEGQuality = 90
+
+// tileOverlay is something done to raster tiles before they are served, such
+// as drawing a watermark over them
+type tileOverlay struct {
+	key  string // tells tiles drawn with other settings apart in the tile cache
+	draw func(img image.Image) image.Image
+
+	// alpha is set when draw makes pixels transparent, the tile is then never
+	// encoded as JPEG
+	alpha bool
+	// optional is set when the overlay was asked for by the request; a tile
+	// that cannot be decoded is then served as stored rather than failing
+	optional bool
+}
+
+// tileOverlays returns what is done to tile of repo, in order: the transparent
+// color, the adjustment and the tone the request asks for, then the watermark
+// and the attribution of repo, which are drawn over the imagery as they are
+func (ac *ApiContext) tileOverlays(tile tileRequest, repo sfile.Repository) ([]tileOverlay, error) {
+	overlays := make([]tileOverlay, 0, 5)
+	// the color is made transparent first, as it is stored
+	if key, tolerance := tile.ColorKey, tile.Tolerance; key != nil {
+		k := color.NRGBAModel.Convert(key).(color.NRGBA)
+		overlays = append(overlays, tileOverlay{
+			key:      fmt.Sprintf("transparent:%02x%02x%02x,%d", k.R, k.G, k.B, tolerance),
+			draw:     func(img image.Image) image.Image { return canvas.MakeTransparent(img, key, tolerance) },
+			alpha:    true,
+			optional: true,
+		})
+	}
+	if adjustment := tile.Adjust; !adjustment.IsIdentity() {
+		overlays = append(overlays, tileOverlay{
+			key:      "adjust:" + adjustment.Key(),
+			draw:     func(img image.Image) image.Image { return canvas.Adjust(img, adjustment) },
+			optional: true,
+		})
+	}
+	if tone := tile.Tone; tone != canvas.ToneNone {
+		overlays = append(overlays, tileOverlay{
+			key:      "tone:" + string(tone),
+			draw:     func(img image.Image) image.Image { return tone.Apply(img) },
+			optional: true,
+		})
+	}
+	if repo.Watermark != nil {
+		options, err := ac.watermarkOptions(repo.Watermark)
+		if err != nil {
+			return nil, fmt.Errorf("invalid watermark of %s: %w", repo.Name, err)
+		}
+		text := repo.Watermark.Text
+		overlays = append(overlays, tileOverlay{
+			key:  "watermark:" + repo.Watermark.Key(),
+			draw: func(img image.Image) image.Image { return canvas.ApplyWatermark(img, text, options) },
+		})
+	}
+	if attribution := ac.attributionOverlay(repo); attribution != nil {
+		options, err := ac.attributionOptions(*attribution)
+		if err != nil {
+			return nil, fmt.Errorf("invalid attribution overlay of %s: %w", repo.Name, err)
+		}
+		text := attribution.Text
+		overlays = append(overlays, tileOverlay{
+			key:  "attribution:" + attribution.Key(),
+			draw: func(img image.Image) image.Image { return canvas.ApplyAttribution(img, text, options) },
+		})
+	}
+	return overlays, nil
+}
+
+// fetchOverlaidTile returns the tile fetchTile reads with the overlays of the
+// request and its repository, see tileOverlays, applied. Raster tiles are
+// decoded, drawn over and encoded again, JPEG as JPEG unless it was made
+// transparent, WebP as WebP when it is built in and the others as PNG, and
+// cached as a variant of the stored tile keyed by the settings of the
+// overlays, so changing them never serves a stale overlay. Tiles that are not
+// images, such as vector tiles, are returned as stored, and so are all tiles
+// without overlays and those that cannot be decoded for overlays the request
+// asked for.
+func (ac *ApiContext) fetchOverlaidTile(ctx context.Context, tile tileRequest, repo sfile.Repository) (sfile.CachedTile, error) {
+	overlays, err := ac.tileOverlays(tile, repo)
+	if err != nil {
+		return sfile.CachedTile{}, err
+	}
+	if len(overlays) == 0 {
+		return ac.fetchTile(ctx, tile)
+	}
+	keys := make([]string, len(overlays))
+	for i, overlay := range overlays {
+		keys[i] = overlay.key
+	}
+	// versions asked for by time are not cached, see fetchTileAt, and neither
+	// are tiles that expire, a variant would outlive its stored tile
+	cacheable := tile.Time.IsZero() && repo.TTL() == 0
+	cacheKey := sfile.TileKey{Repository: tile.Key, Z: tile.Z, X: tile.X, Y: tile.Y, Variant: strings.Join(keys, ";")}
+	if cacheable {
+		if cached, ok := ac.TileCache.Get(cacheKey); ok {
+			cached.Source = tileSourceCache
+			return cached, nil
+		}
+	}
+	stored, err := ac.fetchTile(ctx, tile)
+	if err != nil || !strings.HasPrefix(stored.ContentType, "image/") {
+		return stored, err
+	}
+	data := stored.Data
+	if stored.Encoding != "" {
+		if data, err = sfile.DecodeTile(stored.Data, stored.Encoding); err != nil {
+			return sfile.CachedTile{}, err
+		}
+	}
+	img, decodedFormat, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		if optionalOverlays(overlays) {
+			return stored, nil
+		}
+		return sfile.CachedTile{}, fmt.Errorf("failed to decode tile to draw over: %w", err)
+	}
+	alpha := false
+	for _, overlay := range overlays {
+		img = overlay.draw(img)
+		alpha = alpha || overlay.alpha
+	}
+	format := canvas.FormatPNG
+	switch {
+	case decodedFormat == "jpeg" && !alpha:
+		format = canvas.FormatJPEG
+	case decodedFormat == "webp" && canvas.WebPSupported():
+		format = canvas.FormatWebP
+	}
+	buffer, err := canvas.EncodeImage(img, format, overlayJPEGQuality)
+	if err != nil {
+		return sfile.CachedTile{}, err
+	}
+	drawn := sfile.CachedTile{Data: buffer.Bytes(), ContentType: format.ContentType(), Source: stored.Source, Modified: stored.Modified}
+	if cacheable {
+		ac.TileCache.PutUntil(cacheKey, drawn, time.Time{})
+	}
+	return drawn, nil
+}
+
+// optionalOverlays reports whether every overlay was asked for by the request
+func optionalOverlays(overlays []tileOverlay) bool {
+	for _, overlay := range overlays {
+		if !overlay.optional {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"SirServer/sfile"
+	"SirServer/sfile/sfiletest"
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestTransparentTile serves a JPEG tile with its white made transparent and
+// checks it comes as a PNG with alpha, that a tile that cannot be decoded is
+// served as stored, and that bad parameters are rejected
+func TestTransparentTile(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(96, 96, 160, 160), image.NewUniform(color.RGBA{R: 0x20, G: 0x30, B: 0x80, A: 0xff}), image.Point{}, draw.Src)
+	var stored bytes.Buffer
+	if err := jpeg.Encode(&stored, img, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	broken := append([]byte("\xff\xd8\xff\xe0"), make([]byte, 64)...)
+	source := sfiletest.NewMemSource(sfile.Repository{Name: "scan"})
+	source.Put(3, 0, 0, stored.Bytes())
+	source.Put(3, 1, 0, broken)
+	root := t.TempDir()
+	// a repository.json puts the repository in the catalog, whose
+	// repositories alone are drawn over
+	if err := os.MkdirAll(filepath.Join(root, "scan"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "scan", "repository.json"), []byte(`{"name":"scan"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sfiletest.Serve(root, "scan", source))
+	router := newRootTestServer(t, root)
+
+	for _, query := range []string{"transparent=%23ffffff", "transparent=white&tolerance=8"} {
+		response := getTile(router, "/api/v1/xyz/scan/3/0/0.png?"+query)
+		if response.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", query, response.Code, response.Body)
+		}
+		if contentType := response.Header().Get("Content-Type"); contentType != "image/png" {
+			t.Errorf("%s: served as %q, want image/png", query, contentType)
+		}
+		tile, err := png.Decode(response.Body)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		if _, _, _, a := tile.At(10, 10).RGBA(); a != 0 {
+			t.Errorf("%s: white corner has alpha %d", query, a)
+		}
+		if _, _, _, a := tile.At(128, 128).RGBA(); a != 0xffff {
+			t.Errorf("%s: drawing has alpha %d", query, a)
+		}
+	}
+
+	response := getTile(router, "/api/v1/xyz/scan/3/1/0.png?transparent=%23ffffff")
+	if response.Code != http.StatusOK || !bytes.Equal(response.Body.Bytes(), broken) {
+		t.Errorf("undecodable tile: status %d, %d bytes, want the stored tile", response.Code, response.Body.Len())
+	}
+	for _, query := range []string{"transparent=bad", "transparent=ffffff", "tolerance=8", "transparent=white&tolerance=300"} {
+		if response := getTile(router, "/api/v1/xyz/scan/3/0/0.png?"+query); response.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, response.Code)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package api
+
+import (
+	"SirServer/sfile"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PullRequest is the body of the pull endpoint
+type PullRequest struct {
+	Remote  string      `json:"remote"`
+	Name    string      `json:"name"`  // repository name on the remote, defaults to the local name
+	Token   string      `json:"token"` // bearer token for the remote, never logged
+	MinZoom *int        `json:"min_zoom"`
+	MaxZoom *int        `json:"max_zoom"`
+	BBox    *[4]float64 `json:"bbox"`  // minLng, minLat, maxLng, maxLat
+	Since   int64       `json:"since"` // Unix seconds, pull only the tiles the remote wrote since then
+	Workers int         `json:"workers"`
+}
+
+// maxPullWorkers bounds the download concurrency a caller may ask for
+const maxPullWorkers = 32
+
+// coverageHandler lists the tiles stored at ?z=, optionally limited to ?bbox=minLng,minLat,maxLng,maxLat
+// and to the tiles written since ?since= Unix seconds. The tiles are written as [x, y] pairs, streamed
+// so large zoom levels are never held in memory.
+func (ac *ApiContext) coverageHandler(writer http.ResponseWriter, request *http.Request) {
+	name, err := routeName(request, "name")
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	dir, err := ac.repositoryDir(name)
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	source, err := sfile.OpenTileSource(ac.RepositoryRoot, ac.repositoryKey(dir))
+	if errors.Is(err, sfile.ErrRepositoryNotFound) {
+		WriteError(writer, http.StatusNotFound, "Repository not found")
+		return
+	}
+	if err != nil {
+		logError("Error opening %s: %v", name, err)
+		WriteError(writer, http.StatusInternalServerError, "Failed to open repository")
+		return
+	}
+	defer source.Close()
+	lister, ok := source.(sfile.TileLister)
+	if !ok {
+		WriteError(writer, http.StatusNotImplemented, "Coverage is not available for this repository format")
+		return
+	}
+	query := request.URL.Query()
+	z, err := strconv.Atoi(query.Get("z"))
+	if err != nil || z < 0 || z > maxTileZoom {
+		WriteError(writer, http.StatusBadRequest, fmt.Sprintf("z must be between 0 and %d", maxTileZoom))
+		return
+	}
+	var bbox *[4]float64
+	if value := query.Get("bbox"); value != "" {
+		bbox, err = sfile.ParseBBox(value)
+		if err != nil {
+			WriteError(writer, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	list := lister.ListTiles
+	if value := query.Get("since"); value != "" {
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || seconds < 0 {
+			WriteError(writer, http.StatusBadRequest, "since must be a Unix time in seconds")
+			return
+		}
+		modified, ok := source.(sfile.ModifiedLister)
+		if !ok {
+			WriteError(writer, http.StatusNotImplemented, "Modification times are not available for this repository format")
+			return
+		}
+		list = func(z int8, fn func(x int64, y int64) error) error {
+			return modified.ListTilesModifiedSince(z, time.Unix(seconds, 0), fn)
+		}
+	}
+
+	var minX, minY, maxX, maxY int64
+	if bbox != nil {
+		minX, minY, maxX, maxY = ac.tileGrid(ac.repositoryKey(dir)).TileRange(*bbox, int8(z))
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprintf(writer, `{"code":0,"message":"success","data":{"zoom":%d,"tiles":[`, z)
+	first := true
+	err = list(int8(z), func(x int64, y int64) error {
+		if bbox != nil && (x < minX || x > maxX || y < minY || y > maxY) {
+			return nil
+		}
+		separator := ","
+		if first {
+			separator = ""
+			first = false
+		}
+		_, err := fmt.Fprintf(writer, "%s[%d,%d]", separator, x, y)
+		return err
+	})
+	// the status line is already sent, so a failure can only be logged
+	if err != nil {
+		logError("Error listing coverage of %s at zoom %d: %v", name, z, err)
+	}
+	_, _ = writer.Write([]byte("]}}"))
+}
+
+// pullHandler starts a background job copying the tiles another SirServer has
+// and this repository is missing. Progress is published as job events.
+func (ac *ApiContext) pullHandler(writer http.ResponseWriter, request *http.Request) {
+	name, err := routeName(request, "name")
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	dir, err := ac.repositoryDir(name)
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	if rejectReadOnly(writer, dir) {
+		return
+	}
+	var pull PullRequest
+	if err := json.NewDecoder(request.Body).Decode(&pull); err != nil {
+		WriteError(writer, http.StatusBadRequest, "Invalid pull request: "+err.Error())
+		return
+	}
+	if !strings.HasPrefix(pull.Remote, "http://") && !strings.HasPrefix(pull.Remote, "https://") {
+		WriteError(writer, http.StatusBadRequest, "remote must be an http or https URL")
+		return
+	}
+	if pull.BBox != nil && (pull.BBox[0] > pull.BBox[2] || pull.BBox[1] > pull.BBox[3]) {
+		WriteError(writer, http.StatusBadRequest, "bbox must be [minLng, minLat, maxLng, maxLat]")
+		return
+	}
+	if pull.Since < 0 {
+		WriteError(writer, http.StatusBadRequest, "since must be a Unix time in seconds")
+		return
+	}
+	minZoom, maxZoom := 0, maxTileZoom
+	if pull.MinZoom != nil {
+		minZoom = *pull.MinZoom
+	}
+	if pull.MaxZoom != nil {
+		maxZoom = *pull.MaxZoom
+	}
+	if minZoom < 0 || maxZoom > maxTileZoom || minZoom > maxZoom {
+		WriteError(writer, http.StatusBadRequest, fmt.Sprintf("zoom range must be within 0..%d", maxTileZoom))
+		return
+	}
+	if pull.Name == "" {
+		pull.Name = name
+	}
+
+	options := sfile.PullOptions{
+		Remote:  pull.Remote,
+		Name:    pull.Name,
+		Token:   pull.Token,
+		MinZoom: int8(minZoom),
+		MaxZoom: int8(maxZoom),
+		BBox:    pull.BBox,
+		Workers: min(pull.Workers, maxPullWorkers),
+	}
+	if pull.Since > 0 {
+		options.Since = time.Unix(pull.Since, 0)
+	}
+	job := ac.startJob("pull", name)
+	options.Progress = func(progress sfile.PullProgress) {
+		ac.updateJob(job.ID, progress)
+	}
+	go func() {
+		// the job outlives the request that started it
+		progress, err := sfile.Pull(context.Background(), dir, options)
+		if err != nil {
+			logError("Pull job %s into %s failed: %v", job.ID, name, err)
+		} else {
+			log.Printf("Pull job %s into %s done: %+v", job.ID, name, progress)
+		}
+		ac.usageCache.EvictIf(func(usage string) bool { return usage == name })
+		ac.TileCache.EvictRepository(ac.repositoryKey(dir))
+		ac.catalog().Invalidate()
+		ac.finishJob(job.ID, progress, err)
+	}()
+
+	writer.Header().Set("Location", "/api/v1/jobs/"+job.ID)
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusAccepted)
+	result, _ := json.Marshal(Ok(job))
+	_, _ = writer.Write(result)
+}
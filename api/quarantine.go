@@ -0,0 +1,95 @@
+package api
+
+import (
+	"SirServer/sfile"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// quarantineHandler lists the quarantined tiles of a repository
+func (ac *ApiContext) quarantineHandler(writer http.ResponseWriter, request *http.Request) {
+	dir, ok := ac.quarantineDir(writer, request)
+	if !ok {
+		return
+	}
+	tiles, err := sfile.ListQuarantined(dir)
+	if errors.Is(err, sfile.ErrRepositoryNotFound) {
+		WriteError(writer, http.StatusNotFound, "Repository not found")
+		return
+	}
+	if err != nil {
+		logError("Error listing the quarantine of %s: %v", dir, err)
+		WriteError(writer, http.StatusInternalServerError, "Failed to list the quarantined tiles")
+		return
+	}
+	WriteOk(writer, tiles)
+}
+
+// quarantineRestoreHandler puts the tile ?z=&x=&y= back from the quarantine of
+// a repository, for a tile quarantined by mistake
+func (ac *ApiContext) quarantineRestoreHandler(writer http.ResponseWriter, request *http.Request) {
+	dir, ok := ac.quarantineDir(writer, request)
+	if !ok {
+		return
+	}
+	query := request.URL.Query()
+	z, errZ := strconv.Atoi(query.Get("z"))
+	x, errX := strconv.ParseInt(query.Get("x"), 10, 64)
+	y, errY := strconv.ParseInt(query.Get("y"), 10, 64)
+	if errZ != nil || errX != nil || errY != nil || z < 0 || z > maxTileZoom {
+		WriteError(writer, http.StatusBadRequest, fmt.Sprintf("z, x and y are required, z between 0 and %d", maxTileZoom))
+		return
+	}
+	err := sfile.RestoreQuarantined(dir, x, y, int8(z))
+	if errors.Is(err, sfile.ErrTileNotFound) {
+		WriteError(writer, http.StatusNotFound, "Tile is not quarantined")
+		return
+	}
+	var coordinateErr *sfile.CoordinateError
+	if errors.As(err, &coordinateErr) {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errors.Is(err, sfile.ErrRepositoryLocked) {
+		WriteError(writer, http.StatusConflict, repositoryLockedMessage)
+		return
+	}
+	if err != nil {
+		logError("Error restoring tile %s/%d/%d/%d: %v", ac.repositoryKey(dir), z, x, y, err)
+		WriteError(writer, http.StatusInternalServerError, "Failed to restore tile")
+		return
+	}
+	key := ac.repositoryKey(dir)
+	ac.TileCache.EvictIf(func(cached sfile.TileKey) bool {
+		return cached.Stored() == sfile.TileKey{Repository: key, Z: int8(z), X: x, Y: y}
+	})
+	log.Printf("Tile %s/%d/%d/%d restored from the quarantine", key, z, x, y)
+	WriteOk(writer, sfile.TileCoord{Z: int8(z), X: x, Y: y})
+}
+
+// quarantineDir resolves the repository of a quarantine request, answering the
+// request itself and returning false when there is none with a quarantine
+func (ac *ApiContext) quarantineDir(writer http.ResponseWriter, request *http.Request) (string, bool) {
+	name, err := routeName(request, "name")
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return "", false
+	}
+	dir, err := ac.repositoryDir(name)
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return "", false
+	}
+	if sfile.IsArchive(dir) || sfile.IsS3Root(ac.RepositoryRoot) {
+		WriteError(writer, http.StatusNotImplemented, "Quarantine is only available for local repositories of .s files")
+		return "", false
+	}
+	if !isDirectory(dir) {
+		WriteError(writer, http.StatusNotFound, "Repository not found")
+		return "", false
+	}
+	return dir, true
+}
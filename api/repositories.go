@@ -0,0 +1,197 @@
+package api
+
+import (
+	"SirServer/sfile"
+	"encoding/csv"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// GeoJSON types for the repository catalog
+type geoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   *geoJSONGeometry       `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+// repositoryCSVHeader is the stable column order of the CSV catalog
+var repositoryCSVHeader = []string{"name", "url", "lng", "lat", "zoom", "size", "pared"}
+
+// setAttachment marks the response as a download with the given file name
+func setAttachment(writer http.ResponseWriter, filename string) {
+	writer.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": filename,
+	}))
+}
+
+// repositoryGeometry returns the footprint of a repository, or nil when it has
+// not been analysed and its location is only a default
+func repositoryGeometry(repo sfile.Repository) *geoJSONGeometry {
+	if !repo.Pared {
+		return nil
+	}
+	if !repo.HasBounds() {
+		return &geoJSONGeometry{Type: "Point", Coordinates: []float64{repo.Lng, repo.Lat}}
+	}
+	minLng, minLat, maxLng, maxLat := repo.Bounds[0], repo.Bounds[1], repo.Bounds[2], repo.Bounds[3]
+	return &geoJSONGeometry{Type: "Polygon", Coordinates: [][][]float64{{
+		{minLng, minLat}, {maxLng, minLat}, {maxLng, maxLat}, {minLng, maxLat}, {minLng, minLat},
+	}}}
+}
+
+// writeRepositoriesGeoJSON writes the catalog as a GeoJSON FeatureCollection
+func writeRepositoriesGeoJSON(writer http.ResponseWriter, repositories []sfile.Repository) {
+	collection := geoJSONFeatureCollection{Type: "FeatureCollection", Features: make([]geoJSONFeature, 0, len(repositories))}
+	for _, repo := range repositories {
+		collection.Features = append(collection.Features, geoJSONFeature{
+			Type:     "Feature",
+			Geometry: repositoryGeometry(repo),
+			Properties: map[string]interface{}{
+				"name":     repo.Name,
+				"url":      repo.Url,
+				"zoom":     repo.Zoom,
+				"size":     repo.Size,
+				"pared":    repo.Pared,
+				"min_zoom": repo.MinZoom,
+				"max_zoom": repo.MaxZoom,
+				"format":   repo.Format,
+			},
+		})
+	}
+	writer.Header().Set("Content-Type", "application/geo+json")
+	setAttachment(writer, "repositories.geojson")
+	if err := json.NewEncoder(writer).Encode(collection); err != nil {
+		logError("Error writing repositories GeoJSON: %v", err)
+	}
+}
+
+// writeRepositoriesCSV writes the catalog as RFC 4180 CSV with a header row
+func writeRepositoriesCSV(writer http.ResponseWriter, repositories []sfile.Repository) {
+	writer.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	setAttachment(writer, "repositories.csv")
+	w := csv.NewWriter(writer)
+	_ = w.Write(repositoryCSVHeader)
+	for _, repo := range repositories {
+		_ = w.Write([]string{
+			repo.Name,
+			repo.Url,
+			strconv.FormatFloat(repo.Lng, 'f', -1, 64),
+			strconv.FormatFloat(repo.Lat, 'f', -1, 64),
+			strconv.Itoa(repo.Zoom),
+			strconv.FormatFloat(repo.Size, 'f', -1, 64),
+			strconv.FormatBool(repo.Pared),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		logError("Error writing repositories CSV: %v", err)
+	}
+}
+
+// RepositoryDetail is a repository together with the statistics of its tiles
+type RepositoryDetail struct {
+	Repository sfile.Repository `json:"repository"`
+	Stats      *sfile.Stats     `json:"stats,omitempty"` // only computed for local repositories of .s files
+	Times      []time.Time      `json:"times,omitempty"` // the times tiles can be asked for with ?time=, for temporal repositories
+}
+
+// repositoryDetailHandler returns a single repository with its tile statistics,
+// or with format=text the tile size histograms as a plain text table
+func (ac *ApiContext) repositoryDetailHandler(writer http.ResponseWriter, request *http.Request) {
+	name, err := routeName(request, "name")
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	format := request.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "text" {
+		WriteError(writer, http.StatusBadRequest, "format must be json or text")
+		return
+	}
+	dir, err := ac.repositoryDir(name)
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	if sfile.IsArchive(dir) || sfile.IsS3Root(ac.RepositoryRoot) {
+		if format == "text" {
+			WriteError(writer, http.StatusNotImplemented, "Tile statistics are only available for local repositories of .s files")
+			return
+		}
+		WriteOk(writer, RepositoryDetail{Repository: sfile.LoadRepository(ac.RepositoryRoot, ac.repositoryKey(dir)).Public()})
+		return
+	}
+	if !isDirectory(dir) {
+		WriteError(writer, http.StatusNotFound, "Repository not found")
+		return
+	}
+	stats, err := sfile.RepositoryStats(dir)
+	if err != nil {
+		logError("Error computing stats of %s: %v", name, err)
+		WriteError(writer, http.StatusInternalServerError, "Failed to compute repository stats")
+		return
+	}
+	if format == "text" {
+		writer.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := stats.WriteSizeTable(writer); err != nil {
+			logError("Error writing the tile sizes of %s: %v", name, err)
+		}
+		return
+	}
+	detail := RepositoryDetail{
+		Repository: sfile.LoadRepository(ac.RepositoryRoot, ac.repositoryKey(dir)).Public(),
+		Stats:      &stats,
+	}
+	if detail.Repository.Temporal != nil {
+		if detail.Times, err = sfile.TileTimes(dir); err != nil {
+			logError("Error listing the tile times of %s: %v", name, err)
+			WriteError(writer, http.StatusInternalServerError, "Failed to list the tile times")
+			return
+		}
+	}
+	WriteOk(writer, detail)
+}
+
+// recomputeSizeHandler sums the size of the .s files of a repository again and
+// records it in its repository.json
+func (ac *ApiContext) recomputeSizeHandler(writer http.ResponseWriter, request *http.Request) {
+	name, err := routeName(request, "name")
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	dir, err := ac.repositoryDir(name)
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	if sfile.IsArchive(dir) || sfile.IsS3Root(ac.RepositoryRoot) {
+		WriteError(writer, http.StatusNotImplemented, "Size recomputation is only available for local repositories of .s files")
+		return
+	}
+	if !isDirectory(dir) {
+		WriteError(writer, http.StatusNotFound, "Repository not found")
+		return
+	}
+	size, err := sfile.RecomputeSize(dir)
+	if err != nil {
+		logError("Error recomputing the size of %s: %v", name, err)
+		WriteError(writer, http.StatusInternalServerError, "Failed to recompute repository size")
+		return
+	}
+	ac.catalog().Invalidate()
+	WriteOk(writer, map[string]interface{}{"repository": name, "size": size})
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"SirServer/sfile"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+// scrubLatencyWindow is how far back the tile latencies deciding whether the
+// scrubber pauses go, so an idle server is never considered slow
+const scrubLatencyWindow = time.Minute
+
+// scrubEvents publishes the findings of the scrubber to the event stream and
+// drops quarantined tiles from the tile cache
+type scrubEvents struct {
+	events *EventHub
+	cache  *sfile.TileCache
+}
+
+// ScrubFinding publishes finding as a "scrub" event
+func (s scrubEvents) ScrubFinding(finding sfile.ScrubFinding) {
+	if finding.Quarantined {
+		key := sfile.TileKey{Repository: finding.Repository, Z: finding.Tile.Z, X: finding.Tile.X, Y: finding.Tile.Y}
+		s.cache.EvictIf(func(cached sfile.TileKey) bool { return cached.Stored() == key })
+	}
+	s.events.Publish(Event{Type: "scrub", Data: finding})
+}
+
+// ScrubRepositories starts scrubbing the repositories every interval, keeping
+// its state in the repository root and pausing while the p95 of the tile
+// requests of the last minute is above pauseLatency. Repositories in S3 are not
+// scrubbed and return nil.
+func (ac *ApiContext) ScrubRepositories(opts sfile.ScrubOptions, pauseLatency time.Duration) *sfile.Scrubber {
+	if sfile.IsS3Root(ac.RepositoryRoot) {
+		return nil
+	}
+	opts.StatePath = filepath.Join(ac.RepositoryRoot, sfile.ScrubStateFileName)
+	opts.Busy = func() bool {
+		return ac.Shedder.recentP95(scrubLatencyWindow) > pauseLatency
+	}
+	opts.Observer = scrubEvents{events: ac.events, cache: ac.TileCache}
+	ac.scrubber = sfile.StartScrubber(ac.catalog(), opts)
+	return ac.scrubber
+}
+
+// scrubFindingsHandler returns the position of the scrubber and the tiles it
+// could not decode
+func (ac *ApiContext) scrubFindingsHandler(writer http.ResponseWriter, request *http.Request) {
+	if ac.scrubber == nil {
+		WriteError(writer, http.StatusNotFound, "Scrubbing is disabled, enable it with --scrub-interval")
+		return
+	}
+	WriteOk(writer, ac.scrubber.Status())
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// loadSamples is how many recent tile latencies the rolling p95 is computed over
+const loadSamples = 256
+
+// LoadShedder rejects part of the tile requests while the server is overloaded,
+// which is when both the number of tile requests in flight and the rolling p95
+// of tile latency exceed their thresholds. API routes are never shed.
+type LoadShedder struct {
+	MaxInFlight      int64         // in flight tile requests above which shedding may start, 0 disables shedding
+	LatencyThreshold time.Duration // p95 tile latency above which shedding may start
+	Fraction         float64       // share of new tile requests rejected while overloaded
+
+	inFlight atomic.Int64
+	shed     atomic.Int64
+	mu       sync.Mutex
+	samples  [loadSamples]time.Duration
+	finished [loadSamples]time.Time
+	next     int
+	count    int
+}
+
+// LoadState is the shedding state reported by the server info endpoint
+type LoadState struct {
+	InFlight     int64   `json:"in_flight"`
+	P95Ms        float64 `json:"p95_ms"`
+	Shedding     bool    `json:"shedding"`
+	ShedFraction float64 `json:"shed_fraction"`
+	ShedTotal    int64   `json:"shed_total"`
+}
+
+// record adds the latency of a finished tile request
+func (s *LoadShedder) record(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.samples[s.next] = latency
+	s.finished[s.next] = time.Now()
+	s.next = (s.next + 1) % loadSamples
+	s.count = min(s.count+1, loadSamples)
+}
+
+// p95 returns the 95th percentile of the recent tile latencies
+func (s *LoadShedder) p95() time.Duration {
+	s.mu.Lock()
+	samples := make([]time.Duration, s.count)
+	copy(samples, s.samples[:s.count])
+	s.mu.Unlock()
+	if len(samples) == 0 {
+		return 0
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return samples[int(math.Ceil(0.95*float64(len(samples))))-1]
+}
+
+// recentP95 returns the 95th percentile of the latencies of the tile requests
+// finished within window, 0 when none did
+func (s *LoadShedder) recentP95(window time.Duration) time.Duration {
+	since := time.Now().Add(-window)
+	s.mu.Lock()
+	samples := make([]time.Duration, 0, s.count)
+	for i := 0; i < s.count; i++ {
+		if s.finished[i].After(since) {
+			samples = append(samples, s.samples[i])
+		}
+	}
+	s.mu.Unlock()
+	if len(samples) == 0 {
+		return 0
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	return samples[int(math.Ceil(0.95*float64(len(samples))))-1]
+}
+
+// overloaded reports whether both thresholds are currently exceeded
+func (s *LoadShedder) overloaded() bool {
+	if s.MaxInFlight <= 0 || s.inFlight.Load() <= s.MaxInFlight {
+		return false
+	}
+	return s.p95() > s.LatencyThreshold
+}
+
+// State returns the current shedding state
+func (s *LoadShedder) State() LoadState {
+	return LoadState{
+		InFlight:     s.inFlight.Load(),
+		P95Ms:        float64(s.p95()) / float64(time.Millisecond),
+		Shedding:     s.overloaded(),
+		ShedFraction: s.Fraction,
+		ShedTotal:    s.shed.Load(),
+	}
+}
+
+// Wrap sheds requests to a tile handler with 503 and Retry-After while overloaded,
+// and records the latency of the requests it lets through
+func (s *LoadShedder) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if s.overloaded() && rand.Float64() < s.Fraction {
+			s.shed.Add(1)
+			// ask clients to come back once the slow requests have drained
+			retryAfter := max(1, int(math.Ceil(s.p95().Seconds())))
+			writer.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			WriteError(writer, http.StatusServiceUnavailable, "Server is overloaded, retry later")
+			return
+		}
+		s.inFlight.Add(1)
+		start := time.Now()
+		defer func() {
+			s.record(time.Since(start))
+			s.inFlight.Add(-1)
+		}()
+		next(writer, request)
+	}
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestLoadShedderCycle drives a shedder with slow handlers through the
+// shed/recover cycle: slow requests alone in flight are not shed, slow requests
+// piling up beyond MaxInFlight are, and shedding stops once the pile drains
+// and again once fast requests bring the p95 back under the threshold
+func TestLoadShedderCycle(t *testing.T) {
+	const threshold = 20 * time.Millisecond
+	shedder := &LoadShedder{MaxInFlight: 2, LatencyThreshold: threshold, Fraction: 1}
+	gate := make(chan struct{})
+	handler := shedder.Wrap(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Query().Get("speed") {
+		case "slow":
+			time.Sleep(2 * threshold)
+		case "blocked":
+			<-gate
+		}
+		writer.WriteHeader(http.StatusOK)
+	})
+	serve := func(speed string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		handler(response, httptest.NewRequest(http.MethodGet, "/tile?speed="+speed, nil))
+		return response
+	}
+	// block starts n requests that stay in flight until the returned function
+	// lets them finish
+	block := func(n int) func() {
+		gate = make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				serve("blocked")
+			}()
+		}
+		for shedder.State().InFlight != int64(n) {
+			time.Sleep(time.Millisecond)
+		}
+		return func() {
+			close(gate)
+			wg.Wait()
+		}
+	}
+	expect := func(phase string, status int, shedding bool) {
+		t.Helper()
+		response := serve("fast")
+		if response.Code != status {
+			t.Fatalf("%s: status %d, want %d", phase, response.Code, status)
+		}
+		if status == http.StatusServiceUnavailable && response.Header().Get("Retry-After") != "1" {
+			t.Fatalf("%s: Retry-After %q, want 1", phase, response.Header().Get("Retry-After"))
+		}
+		if state := shedder.State(); state.Shedding != shedding {
+			t.Fatalf("%s: state %+v, want shedding %v", phase, state, shedding)
+		}
+	}
+
+	// many requests in flight with fast latencies are not shed
+	release := block(3)
+	expect("in flight above the limit, fast", http.StatusOK, false)
+	release()
+
+	// slow requests raise the p95 over the threshold, but finished they are no
+	// longer in flight
+	var wg sync.WaitGroup
+	for i := 0; i < 2*loadSamples; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve("slow")
+		}()
+	}
+	wg.Wait()
+	if p95 := shedder.State().P95Ms; p95 < float64(threshold/time.Millisecond) {
+		t.Fatalf("p95 %.1fms after slow requests, want over %s", p95, threshold)
+	}
+	expect("slow, nothing in flight", http.StatusOK, false)
+
+	// slow and piling up: shed
+	release = block(3)
+	expect("slow, in flight above the limit", http.StatusServiceUnavailable, true)
+	expect("still overloaded", http.StatusServiceUnavailable, true)
+	if shed := shedder.State().ShedTotal; shed != 2 {
+		t.Fatalf("%d requests shed, want 2", shed)
+	}
+
+	// the pile drains: recovered, although the p95 is still high
+	release()
+	expect("drained", http.StatusOK, false)
+
+	// fast requests replace the slow latencies, then a pile alone is no longer shed
+	for i := 0; i < loadSamples; i++ {
+		serve("fast")
+	}
+	release = block(3)
+	defer release()
+	expect("fast again, in flight above the limit", http.StatusOK, false)
+	if shed := shedder.State().ShedTotal; shed != 2 {
+		t.Fatalf("%d requests shed, want still 2", shed)
+	}
+}
@@ -0,0 +1,261 @@
+package api
+
+import (
+	"SirServer/canvas"
+	"SirServer/sfile"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	_ "golang.org/x/image/webp" // register the webp decoder for stored tiles
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg" // register the jpeg decoder for stored tiles
+	_ "image/png"  // register the png decoder for stored tiles
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const (
+	staticMapMaxSize = 2048
+	staticMapMaxZoom = 25
+)
+
+// staticMapBackground is drawn wherever a tile is missing or cannot be decoded
+var staticMapBackground = color.RGBA{R: 0xee, G: 0xee, B: 0xee, A: 0xff}
+
+// staticMapTile is one tile covering part of a static map, together with the
+// position of its top left corner inside the output image
+type staticMapTile struct {
+	X       int64
+	Y       int64
+	OffsetX int
+	OffsetY int
+}
+
+// staticMapTileZoom returns the zoom of the tiles a static map at zoom is drawn
+// from and the size they are drawn at. Zoom counts 256 pixel tiles, so a
+// repository of 512 pixel tiles is drawn from the tiles one zoom lower; below
+// that zoom its tiles are drawn reduced.
+func staticMapTileZoom(zoom int, tileSize int) (int, int) {
+	shift := 0
+	for tileSize>>(shift+1) >= sfile.DefaultTileSize {
+		shift++
+	}
+	tileZoom := max(zoom-shift, 0)
+	return tileZoom, tileSize >> (shift - (zoom - tileZoom))
+}
+
+// staticMapTiles returns the tiles of tileSize pixels of grid covering a width x
+// height viewport centered on the global pixel (cx, cy) at zoom. The viewport origin is
+// floored to a whole pixel so every output pixel maps to exactly one source pixel,
+// offsets of the edge tiles are therefore negative or run past the image and get
+// clipped when drawn. Columns wrap around the antimeridian, rows outside the world
+// are skipped.
+func staticMapTiles(cx float64, cy float64, width int, height int, zoom int8, grid sfile.TileGrid, tileSize int) []staticMapTile {
+	originX := int64(math.Floor(cx - float64(width)/2))
+	originY := int64(math.Floor(cy - float64(height)/2))
+	columns, rows := grid.Matrix(int(zoom))
+
+	size := int64(tileSize)
+	minTileX := floorDiv(originX, size)
+	maxTileX := floorDiv(originX+int64(width)-1, size)
+	minTileY := floorDiv(originY, size)
+	maxTileY := floorDiv(originY+int64(height)-1, size)
+
+	tiles := make([]staticMapTile, 0)
+	for ty := minTileY; ty <= maxTileY; ty++ {
+		if ty < 0 || ty >= rows {
+			continue
+		}
+		for tx := minTileX; tx <= maxTileX; tx++ {
+			tiles = append(tiles, staticMapTile{
+				X:       ((tx % columns) + columns) % columns,
+				Y:       ty,
+				OffsetX: int(tx*size - originX),
+				OffsetY: int(ty*size - originY),
+			})
+		}
+	}
+	return tiles
+}
+
+// floorDiv divides rounding towards negative infinity
+func floorDiv(a int64, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// staticMapHandler renders a single image of the area around lng/lat at zoom
+func (ac *ApiContext) staticMapHandler(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	lng, errLng := strconv.ParseFloat(query.Get("lng"), 64)
+	lat, errLat := strconv.ParseFloat(query.Get("lat"), 64)
+	if errLng != nil || errLat != nil || lng < -180 || lng > 180 || lat < -90 || lat > 90 {
+		WriteError(writer, http.StatusBadRequest, "lng and lat must be valid WGS84 coordinates")
+		return
+	}
+	zoom, err := strconv.Atoi(query.Get("zoom"))
+	if err != nil || zoom < 0 || zoom > staticMapMaxZoom {
+		WriteError(writer, http.StatusBadRequest, fmt.Sprintf("zoom must be between 0 and %d", staticMapMaxZoom))
+		return
+	}
+	width, err := queryInt(query.Get("width"), 800)
+	if err != nil || width <= 0 {
+		WriteError(writer, http.StatusBadRequest, "width must be a positive integer")
+		return
+	}
+	height, err := queryInt(query.Get("height"), 600)
+	if err != nil || height <= 0 {
+		WriteError(writer, http.StatusBadRequest, "height must be a positive integer")
+		return
+	}
+	width = min(width, staticMapMaxSize)
+	height = min(height, staticMapMaxSize)
+	format, err := canvas.ParseFormat(query.Get("format"))
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	quality, err := queryInt(query.Get("quality"), 0)
+	if err != nil || quality < 0 || quality > 100 {
+		WriteError(writer, http.StatusBadRequest, "quality must be an integer from 1 to 100")
+		return
+	}
+	tone, err := canvas.ParseTone(query.Get("style"))
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	dir, err := ac.repositoryDir(query.Get("repo"))
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	source, err := sfile.OpenTileSource(ac.RepositoryRoot, ac.repositoryKey(dir))
+	if errors.Is(err, sfile.ErrRepositoryNotFound) {
+		WriteError(writer, http.StatusNotFound, "Repository not found")
+		return
+	}
+	if err != nil {
+		logError("Error opening %s: %v", query.Get("repo"), err)
+		WriteError(writer, http.StatusInternalServerError, "Failed to open repository")
+		return
+	}
+	defer source.Close()
+
+	ctx := request.Context()
+	img := canvas.NewFilledImage(width, height, staticMapBackground)
+	grid := ac.tileGrid(ac.repositoryKey(dir))
+	lat = math.Max(-grid.MaxLatitude(), math.Min(grid.MaxLatitude(), lat))
+	cx, cy := grid.LngLatToPixels(lng, lat, zoom)
+	tileZoom, drawSize := staticMapTileZoom(zoom, ac.tileSize(ac.repositoryKey(dir)))
+	tiles := staticMapTiles(cx, cy, width, height, int8(tileZoom), grid, drawSize)
+	blobs := readStaticMapTiles(ctx, source, int8(tileZoom), tiles)
+	for _, tile := range tiles {
+		data, ok := blobs[[2]int64{tile.X, tile.Y}]
+		if !ok {
+			continue
+		}
+		_, span := tracer.Start(ctx, "image.decode")
+		tileImage, decodedFormat, err := image.Decode(bytes.NewReader(data))
+		span.SetAttributes(attribute.String("sir.image.format", decodedFormat))
+		span.End()
+		if err != nil {
+			continue
+		}
+		for tileImage.Bounds().Dx() >= 2*drawSize {
+			tileImage = canvas.Downsample(tileImage)
+		}
+		canvas.DrawImageAt(img, tileImage, tile.OffsetX, tile.OffsetY)
+	}
+	var mapImage draw.Image = img
+	if tone != canvas.ToneNone {
+		mapImage = tone.Apply(img)
+	}
+	if repo, ok := ac.catalog().Lookup(ac.repositoryKey(dir)); ok {
+		if overlay := ac.attributionOverlay(repo); overlay != nil {
+			options, err := ac.attributionOptions(*overlay)
+			if err != nil {
+				logError("Invalid attribution overlay of %s: %v", repo.Name, err)
+				WriteError(writer, http.StatusInternalServerError, "Invalid attribution overlay")
+				return
+			}
+			canvas.DrawAttribution(mapImage, overlay.Text, options)
+		}
+	}
+
+	_, span := tracer.Start(ctx, "image.encode")
+	span.SetAttributes(attribute.String("sir.image.format", string(format)))
+	buffer, err := canvas.EncodeImage(mapImage, format, quality)
+	span.End()
+	if err != nil {
+		WriteError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+	WriteBlob(writer, format.ContentType(), buffer.Bytes())
+}
+
+// readStaticMapTiles reads the blobs of tiles with one range read per run of
+// adjacent columns; a map wrapping around the antimeridian needs two runs
+func readStaticMapTiles(ctx context.Context, source sfile.TileSource, zoom int8, tiles []staticMapTile) map[[2]int64][]byte {
+	blobs := make(map[[2]int64][]byte)
+	if len(tiles) == 0 {
+		return blobs
+	}
+	reader, ok := source.(sfile.TileRangeReader)
+	if !ok {
+		// sources without range reads are read one tile at a time
+		for _, tile := range tiles {
+			stored, err := source.GetTile(ctx, zoom, tile.X, tile.Y)
+			if err == nil {
+				blobs[[2]int64{tile.X, tile.Y}] = stored.Data
+			} else if !errors.Is(err, sfile.ErrTileNotFound) {
+				logError("Error reading static map tiles: %v", err)
+			}
+		}
+		return blobs
+	}
+	columns := make([]int64, 0)
+	seen := make(map[int64]bool)
+	minY, maxY := tiles[0].Y, tiles[0].Y
+	for _, tile := range tiles {
+		if !seen[tile.X] {
+			seen[tile.X] = true
+			columns = append(columns, tile.X)
+		}
+		minY, maxY = min(minY, tile.Y), max(maxY, tile.Y)
+	}
+	sort.Slice(columns, func(i, j int) bool { return columns[i] < columns[j] })
+	for start := 0; start < len(columns); {
+		end := start
+		for end+1 < len(columns) && columns[end+1] == columns[end]+1 {
+			end++
+		}
+		err := reader.GetXYZRange(zoom, columns[start], columns[end], minY, maxY, func(x int64, y int64, data []byte) error {
+			blobs[[2]int64{x, y}] = bytes.Clone(data)
+			return nil
+		})
+		if err != nil {
+			logError("Error reading static map tiles: %v", err)
+		}
+		start = end + 1
+	}
+	return blobs
+}
+
+// queryInt parses an integer query value, returning def when the value is empty
+func queryInt(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
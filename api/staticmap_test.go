@@ -0,0 +1,147 @@
+package api
+
+import (
+	"SirServer/sfile"
+	"SirServer/sfile/sfiletest"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestStaticMapTilesFractional places viewports on fractional centers, on tile
+// edges and across the edges of the world, and checks every output pixel is
+// covered by exactly one tile, the one holding the global pixel at the floored
+// viewport origin plus the output pixel
+func TestStaticMapTilesFractional(t *testing.T) {
+	const size = 256
+	for _, tc := range []struct {
+		name          string
+		cx, cy        float64
+		width, height int
+		zoom          int8
+		grid          sfile.TileGrid
+		wantTiles     int
+	}{
+		{"whole pixel inside a tile", 128, 128, 100, 100, 1, sfile.GridMercator, 1},
+		{"origin just below a tile edge", 256.49, 128, 1, 1, 1, sfile.GridMercator, 1},
+		{"origin on a tile edge", 256.5, 128, 1, 1, 1, sfile.GridMercator, 1},
+		{"half pixel center, origin on a tile edge", 306.5, 306.5, 101, 101, 1, sfile.GridMercator, 1},
+		{"half pixel center, origin a fraction before a tile edge", 306.4, 306.4, 101, 101, 1, sfile.GridMercator, 2 * 2},
+		{"edge pixel a fraction into the next tile", 305.999, 305.999, 100, 100, 1, sfile.GridMercator, 2 * 2},
+		{"edge pixel exactly at the tile edge", 306, 306, 100, 100, 1, sfile.GridMercator, 1},
+		{"odd size on a fractional center", 383.7, 129.2, 257, 3, 2, sfile.GridMercator, 2},
+		{"origin a fraction west of the antimeridian", 50.25, 200, 101, 11, 2, sfile.GridMercator, 2},
+		{"east edge a fraction past the antimeridian", 1023.75, 200, 11, 11, 2, sfile.GridMercator, 2},
+		{"top a fraction above the world", 300, 5.5, 20, 12, 2, sfile.GridMercator, 1},
+		{"bottom a fraction below the world", 300, 1018.5, 20, 12, 2, sfile.GridMercator, 1},
+		{"geodetic columns wrap at twice the rows", 2047.5, 100, 4, 4, 2, sfile.GridGeodetic, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tiles := staticMapTiles(tc.cx, tc.cy, tc.width, tc.height, tc.zoom, tc.grid, size)
+			if len(tiles) != tc.wantTiles {
+				t.Errorf("%d tiles %+v, want %d", len(tiles), tiles, tc.wantTiles)
+			}
+			originX := int64(math.Floor(tc.cx - float64(tc.width)/2))
+			originY := int64(math.Floor(tc.cy - float64(tc.height)/2))
+			columns, rows := tc.grid.Matrix(int(tc.zoom))
+			for py := 0; py < tc.height; py++ {
+				for px := 0; px < tc.width; px++ {
+					var covering []staticMapTile
+					for _, tile := range tiles {
+						if px >= tile.OffsetX && px < tile.OffsetX+size && py >= tile.OffsetY && py < tile.OffsetY+size {
+							covering = append(covering, tile)
+						}
+					}
+					globalX, globalY := originX+int64(px), originY+int64(py)
+					if globalY < 0 || globalY >= rows*size {
+						if len(covering) != 0 {
+							t.Fatalf("pixel %d,%d outside the world covered by %+v", px, py, covering)
+						}
+						continue
+					}
+					wantX := (floorDiv(globalX, size)%columns + columns) % columns
+					wantY := floorDiv(globalY, size)
+					if len(covering) != 1 || covering[0].X != wantX || covering[0].Y != wantY {
+						t.Fatalf("pixel %d,%d covered by %+v, want tile %d/%d only", px, py, covering, wantX, wantY)
+					}
+				}
+			}
+		})
+	}
+}
+
+// staticMapTileColor is the color filling tile x/y in TestStaticMapEdges
+func staticMapTileColor(x int64, y int64) color.NRGBA {
+	return color.NRGBA{R: uint8(40 + 60*x), G: uint8(40 + 60*y), B: 0x80, A: 0xff}
+}
+
+// TestStaticMapEdges renders static maps of tiles filled with a color each
+// around centers falling between pixels, at the antimeridian and at the top of
+// the world, and checks every pixel of the image is drawn from the tile the
+// floored viewport origin puts it in, or is background outside the world
+func TestStaticMapEdges(t *testing.T) {
+	const zoom = 2
+	source := sfiletest.NewMemSource(sfile.Repository{Name: "edges"})
+	for y := int64(0); y < 4; y++ {
+		for x := int64(0); x < 4; x++ {
+			source.Put(zoom, x, y, pngTile(t, staticMapTileColor(x, y)))
+		}
+	}
+	router := newTestServer(t, "edges", source)
+
+	for _, tc := range []struct {
+		lng, lat      float64
+		width, height int
+	}{
+		{0.1, 0, 101, 51},
+		{-0.1, 0.1, 100, 50},
+		{45.0001, -40.0001, 257, 129},
+		{179.95, 10, 64, 32},
+		{-179.95, -10, 63, 31},
+		{10, 85, 40, 41},
+		{-10, -85, 40, 41},
+	} {
+		t.Run(fmt.Sprintf("%g,%g %dx%d", tc.lng, tc.lat, tc.width, tc.height), func(t *testing.T) {
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, httptest.NewRequest(http.MethodGet,
+				fmt.Sprintf("/api/v1/staticmap?repo=edges&lng=%g&lat=%g&zoom=%d&width=%d&height=%d", tc.lng, tc.lat, zoom, tc.width, tc.height), nil))
+			if response.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", response.Code, response.Body)
+			}
+			img, err := png.Decode(response.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.Bounds() != image.Rect(0, 0, tc.width, tc.height) {
+				t.Fatalf("bounds %v, want %dx%d", img.Bounds(), tc.width, tc.height)
+			}
+			cx, cy := sfile.GridMercator.LngLatToPixels(tc.lng, tc.lat, zoom)
+			originX := int64(math.Floor(cx - float64(tc.width)/2))
+			originY := int64(math.Floor(cy - float64(tc.height)/2))
+			for py := 0; py < tc.height; py++ {
+				for px := 0; px < tc.width; px++ {
+					globalX, globalY := originX+int64(px), originY+int64(py)
+					var want color.Color = staticMapBackground
+					if globalY >= 0 && globalY < 4*256 {
+						want = staticMapTileColor((floorDiv(globalX, 256)%4+4)%4, floorDiv(globalY, 256))
+					}
+					if !sameColor(img.At(px, py), want) {
+						t.Fatalf("pixel %d,%d is %v, want %v", px, py, img.At(px, py), want)
+					}
+				}
+			}
+		})
+	}
+}
+
+// sameColor tells whether a and b are the same opaque color
+func sameColor(a color.Color, b color.Color) bool {
+	ar, ag, ab, aa := a.RGBA()
+	br, bg, bb, ba := b.RGBA()
+	return ar == br && ag == bg && ab == bb && aa == ba
+}
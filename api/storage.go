@@ -0,0 +1,75 @@
+package api
+
+import (
+	"SirServer/sfile"
+	"go.opentelemetry.io/otel/attribute"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StorageInfo describes how the disk space under the repository root is used
+type StorageInfo struct {
+	Root         string            `json:"root"`
+	Total        uint64            `json:"total"`
+	Free         uint64            `json:"free"`
+	ScannedAt    time.Time         `json:"scanned_at"`
+	Repositories []sfile.DiskUsage `json:"repositories"`
+	Caches       []sfile.DiskUsage `json:"caches"`
+}
+
+// storageHandler reports filesystem capacity plus per repository and cache usage
+func (ac *ApiContext) storageHandler(writer http.ResponseWriter, request *http.Request) {
+	refresh, _ := strconv.ParseBool(request.URL.Query().Get("refresh"))
+	info := StorageInfo{Root: ac.RepositoryRoot}
+
+	total, free, err := sfile.DiskSpace(ac.RepositoryRoot)
+	if err != nil {
+		logError("Error reading disk space of %s: %v", ac.RepositoryRoot, err)
+	}
+	info.Total = total
+	info.Free = free
+
+	_, span := tracer.Start(request.Context(), "storage.usage_cache")
+	span.SetAttributes(attribute.Bool("sir.cache.refresh", refresh))
+	usages, scannedAt, err := ac.usageCache.Get(refresh)
+	span.End()
+	if err != nil {
+		WriteError(writer, http.StatusInternalServerError, "Failed to scan repository root")
+		return
+	}
+	info.Repositories = usages
+	info.ScannedAt = scannedAt
+	info.Caches = ac.cacheUsage()
+	WriteOk(writer, info)
+}
+
+// cacheUsage returns the disk usage of data managed by the server itself
+// rather than by users, sorted by size descending
+func (ac *ApiContext) cacheUsage() []sfile.DiskUsage {
+	caches := make([]sfile.DiskUsage, 0)
+
+	// hidden directories left behind by archive restores in progress
+	staging := sfile.DiskUsage{Name: "restore-staging"}
+	entries, _ := os.ReadDir(ac.RepositoryRoot)
+	for _, entry := range entries {
+		if entry.IsDir() && strings.HasPrefix(entry.Name(), ".") && strings.Contains(entry.Name(), ".restore-") {
+			usage, err := sfile.DirectoryUsage(filepath.Join(ac.RepositoryRoot, entry.Name()))
+			if err != nil {
+				continue
+			}
+			staging.Size += usage.Size
+			staging.Files += usage.Files
+		}
+	}
+	caches = append(caches, staging)
+
+	sort.SliceStable(caches, func(i, j int) bool {
+		return caches[i].Size > caches[j].Size
+	})
+	return caches
+}
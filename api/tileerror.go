@@ -0,0 +1,117 @@
+package api
+
+import (
+	"SirServer/sfile"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Headers telling automated clients why a tile was answered with an error or
+// placeholder image, without reading the image
+const (
+	tileErrorCodeHeader   = "X-SirServer-Error-Code"
+	tileErrorDetailHeader = "X-SirServer-Error"
+)
+
+// maxTileErrorDetail bounds the length of the X-SirServer-Error header
+const maxTileErrorDetail = 200
+
+// errBadTileRequest is matched by the errors of tile requests that cannot be
+// parsed, see badTileRequest
+var errBadTileRequest = errors.New("bad tile request")
+
+// badTileRequest marks an error of parsing a tile request, keeping its message
+type badTileRequest struct{ error }
+
+func (e badTileRequest) Unwrap() error { return e.error }
+
+func (e badTileRequest) Is(target error) bool { return target == errBadTileRequest }
+
+// tileErrorKind is a kind of error a tile request is answered with an image
+// for, see tileErrorKinds
+type tileErrorKind struct {
+	err         error  // the kind is of the errors matching it with errors.Is
+	code        string // sent in X-SirServer-Error-Code
+	message     string // sent in X-SirServer-Error, the error itself stripped of paths when empty
+	status      int    // answered with when TileErrorStatus is on
+	placeholder bool   // answered with a placeholder rather than a message tile
+}
+
+// tileErrorKinds is the registry of the error codes of tile requests. The
+// first kind an error matches is taken, so the specific kinds come first.
+// Errors matching none are failures of the server, answered with 500.
+var tileErrorKinds = []tileErrorKind{
+	{err: sfile.ErrTileExpired, code: "tile_expired", message: "tile expired", status: http.StatusNotFound, placeholder: true},
+	{err: sfile.ErrTileQuarantined, code: "tile_quarantined", message: "tile quarantined", status: http.StatusNotFound, placeholder: true},
+	{err: sfile.ErrTileNotFound, code: "tile_not_found", message: "tile not found", status: http.StatusNotFound, placeholder: true},
+	{err: sfile.ErrRepositoryNotFound, code: "repository_not_found", message: "repository not found", status: http.StatusNotFound},
+	{err: sfile.ErrNotTemporal, code: "not_temporal", message: "repository keeps no tile history", status: http.StatusBadRequest},
+	{err: errBadTileRequest, code: "bad_request", status: http.StatusBadRequest},
+}
+
+// internalTileError is the kind of the errors matching no other
+var internalTileError = tileErrorKind{code: "internal", message: "failed to read tile", status: http.StatusInternalServerError}
+
+// tileErrorKindOf returns the kind of err
+func tileErrorKindOf(err error) tileErrorKind {
+	for _, kind := range tileErrorKinds {
+		if errors.Is(err, kind.err) {
+			return kind
+		}
+	}
+	return internalTileError
+}
+
+// writeTileError answers the request for tile of the repository named name with
+// err. The kind of err, see tileErrorKinds, is sent in the X-SirServer-Error-Code
+// and X-SirServer-Error headers, and picks the answer: a placeholder tile for a
+// tile the repository does not have, a message tile for the other known kinds,
+// both with their status when TileErrorStatus is on and 200 otherwise, and a
+// JSON 500 for failures of the server, which are logged. Only the sanitized
+// error reaches the headers and the image, see sanitizeTileError.
+func (ac *ApiContext) writeTileError(writer http.ResponseWriter, name string, tile tileRequest, err error) {
+	kind := tileErrorKindOf(err)
+	detail := ac.sanitizeTileError(err.Error())
+	message := kind.message
+	if message == "" {
+		message = detail
+	}
+	writer.Header().Set(tileErrorCodeHeader, kind.code)
+	writer.Header().Set(tileErrorDetailHeader, message)
+	if kind.code == internalTileError.code {
+		logError("Error reading tile %s/%d/%d/%d: %v", name, tile.Z, tile.X, tile.Y, err)
+		WriteError(writer, kind.status, "Failed to read tile")
+		return
+	}
+	status := http.StatusOK
+	if ac.TileErrorStatus {
+		status = kind.status
+	}
+	if kind.placeholder {
+		ac.writeTilePlaceholder(writer, status, tile, detail)
+		return
+	}
+	ac.writeTileMessage(writer, status, name, detail)
+}
+
+// sanitizeTileError returns message fit for a header sent to anyone: on one
+// line, without the repository root or any other absolute path, of which only
+// the file name is kept, and cut short when long
+func (ac *ApiContext) sanitizeTileError(message string) string {
+	if ac.RepositoryRoot != "" {
+		message = strings.ReplaceAll(message, ac.RepositoryRoot, "")
+	}
+	words := strings.Fields(message)
+	for i, word := range words {
+		if filepath.IsAbs(strings.Trim(word, `"'(),:`)) {
+			words[i] = filepath.Base(strings.Trim(word, `"'(),:`))
+		}
+	}
+	message = strings.Join(words, " ")
+	if len(message) > maxTileErrorDetail {
+		message = strings.ToValidUTF8(message[:maxTileErrorDetail], "") + "..."
+	}
+	return message
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"SirServer/sfile"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestTileErrorHeaders requests a missing tile and one of a corrupt shard of a
+// repository on disk and checks the error headers are set, and that none of
+// them names a path of the server
+func TestTileErrorHeaders(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "disk")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := sfile.NewRepository(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.WriteXYZ(7, 7, 3, []byte("tile")); err != nil {
+		t.Fatal(err)
+	}
+	sfile.FlushHandles(func(string) bool { return true })
+	var shard string
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && filepath.Ext(path) == ".s" {
+			shard = path
+		}
+		return err
+	})
+	if err != nil || shard == "" {
+		t.Fatalf("no shard written: %v", err)
+	}
+	router := newRootTestServer(t, root)
+	get := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder
+	}
+	checkHeaders := func(t *testing.T, response *httptest.ResponseRecorder, code string) {
+		t.Helper()
+		if got := response.Header().Get(tileErrorCodeHeader); got != code {
+			t.Errorf("%s %q, want %q", tileErrorCodeHeader, got, code)
+		}
+		if response.Header().Get(tileErrorDetailHeader) == "" {
+			t.Errorf("no %s header", tileErrorDetailHeader)
+		}
+		for header, values := range response.Header() {
+			for _, value := range values {
+				if strings.Contains(value, root) {
+					t.Errorf("header %s names the repository root: %q", header, value)
+				}
+			}
+		}
+	}
+
+	t.Run("missing tile", func(t *testing.T) {
+		// the error names the .s file that does not exist
+		response := get("/api/v1/xyz/disk/5/0/0.png")
+		if response.Code != http.StatusOK {
+			t.Errorf("status %d, want a 200 placeholder", response.Code)
+		}
+		checkHeaders(t, response, "tile_not_found")
+		if detail := response.Header().Get(tileErrorHeader); detail == "" {
+			t.Errorf("no %s header", tileErrorHeader)
+		}
+	})
+	t.Run("sqlite failure", func(t *testing.T) {
+		if err := os.WriteFile(shard, []byte(strings.Repeat("not a database ", 512)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		sfile.FlushHandles(func(string) bool { return true })
+		response := get("/api/v1/xyz/disk/3/7/7.png")
+		if response.Code != http.StatusInternalServerError {
+			t.Errorf("status %d, want 500", response.Code)
+		}
+		checkHeaders(t, response, "internal")
+	})
+}
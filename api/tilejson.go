@@ -0,0 +1,112 @@
+package api
+
+import (
+	"SirServer/sfile"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// tileJSON is a TileJSON 3.0.0 document describing a repository. TileSize is
+// not part of the specification but read by MapLibre and Mapbox GL, so clients
+// request the tiles of a 512 pixel repository at the zoom they are drawn at.
+type tileJSON struct {
+	TileJSON    string    `json:"tilejson"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Attribution string    `json:"attribution,omitempty"`
+	Scheme      string    `json:"scheme"`
+	Tiles       []string  `json:"tiles"`
+	Format      string    `json:"format,omitempty"`
+	TileSize    int       `json:"tileSize"`
+	MinZoom     *int      `json:"minzoom,omitempty"` // unknown until the repository is analysed
+	MaxZoom     *int      `json:"maxzoom,omitempty"`
+	Bounds      []float64 `json:"bounds,omitempty"`
+	Center      []float64 `json:"center,omitempty"`
+}
+
+// tileJSONHandler describes a repository as TileJSON, its tiles served by the
+// xyz route of this server as the client reached it
+func (ac *ApiContext) tileJSONHandler(writer http.ResponseWriter, request *http.Request) {
+	name, err := routeName(request, "name")
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	dir, err := ac.repositoryDir(name)
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !sfile.IsArchive(dir) && !sfile.IsS3Root(ac.RepositoryRoot) && !isDirectory(dir) {
+		WriteError(writer, http.StatusNotFound, "Repository not found")
+		return
+	}
+	key := ac.repositoryKey(dir)
+	repo := sfile.LoadRepository(ac.RepositoryRoot, key).Public()
+	if repo.Name == "" {
+		repo.Name = key
+	}
+	data, err := json.Marshal(newTileJSON(repo, requestBaseURL(request)+"/api/v1/xyz/"+escapeRepositoryName(key)))
+	if err != nil {
+		logError("Error marshalling the TileJSON of %s: %v", name, err)
+		WriteError(writer, http.StatusInternalServerError, "Failed to describe the repository")
+		return
+	}
+	WriteBlob(writer, "application/json", data)
+}
+
+// newTileJSON describes repo, whose tiles are served below tilesURL
+func newTileJSON(repo sfile.Repository, tilesURL string) tileJSON {
+	doc := tileJSON{
+		TileJSON:    "3.0.0",
+		Name:        repo.Name,
+		Description: repo.Description,
+		Attribution: repo.Attribution,
+		Scheme:      "xyz",
+		Tiles:       []string{tilesURL + "/{z}/{x}/{y}.png"},
+		Format:      repo.Format,
+		TileSize:    repo.TileSize,
+	}
+	if doc.TileSize <= 0 {
+		doc.TileSize = sfile.DefaultTileSize
+	}
+	if !repo.Pared {
+		return doc
+	}
+	minZoom, maxZoom := repo.MinZoom, repo.MaxZoom
+	doc.MinZoom, doc.MaxZoom = &minZoom, &maxZoom
+	if repo.HasBounds() {
+		doc.Bounds = repo.Bounds[:]
+	}
+	doc.Center = []float64{repo.Lng, repo.Lat, float64(min(max(repo.Zoom, minZoom), maxZoom))}
+	return doc
+}
+
+// escapeRepositoryName percent-encodes each element of a repository name for a
+// path, keeping the slashes of nested repositories, see routeName
+func escapeRepositoryName(name string) string {
+	elements := strings.Split(name, "/")
+	for i, element := range elements {
+		elements[i] = url.PathEscape(element)
+	}
+	return strings.Join(elements, "/")
+}
+
+// requestBaseURL returns the scheme and host the client reached the server at,
+// as told by a reverse proxy in X-Forwarded-Proto and X-Forwarded-Host
+func requestBaseURL(request *http.Request) string {
+	scheme := "http"
+	if request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := request.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	host := request.Host
+	if forwarded := request.Header.Get("X-Forwarded-Host"); forwarded != "" {
+		host = strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	return scheme + "://" + host
+}
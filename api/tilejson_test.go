@@ -0,0 +1,105 @@
+package api
+
+import (
+	"SirServer/sfile"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestTileJSON describes an analysed repository of 512 pixel tiles, one
+// written before tile sizes were recorded and a nested one with a Chinese
+// name, and checks the documents carry the tile size and the extent and that
+// their tile URLs, as reached through a reverse proxy, serve the tiles
+func TestTileJSON(t *testing.T) {
+	root := t.TempDir()
+	repositories := map[string]string{
+		"large": `{"name":"large","pared":true,"tile_size":512,"format":"png","attribution":"© Provider",
+			"min_zoom":1,"max_zoom":3,"zoom":14,"lng":67.5,"lat":22.0356,"bounds":[-45,-40.9799,180,85.0511]}`,
+		"old":       `{"name":"old"}`,
+		"2023/北京影像": `{"name":"2023/北京影像","pared":true,"min_zoom":2,"max_zoom":2,"zoom":1}`,
+	}
+	for name, info := range repositories {
+		dir := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "repository.json"), []byte(info), 0644); err != nil {
+			t.Fatal(err)
+		}
+		repo, err := sfile.NewRepository(dir, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.WriteXYZ(1, 0, 2, []byte("tile of "+name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() { sfile.FlushHandles(func(string) bool { return true }) })
+	ac := newTestApiContext(t, root)
+	ac.RepositoryDepth = 2
+	router := newTestRouter(ac)
+	get := func(path string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		request.Host = "internal:8080"
+		request.Header.Set("X-Forwarded-Proto", "https")
+		request.Header.Set("X-Forwarded-Host", "tiles.example.com")
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		return response
+	}
+	describe := func(name string) tileJSON {
+		t.Helper()
+		response := get("/api/v1/repositories/" + escapeRepositoryName(name) + "/tilejson.json")
+		if response.Code != http.StatusOK || response.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("TileJSON of %s: status %d, %s", name, response.Code, response.Body)
+		}
+		var doc tileJSON
+		if err := json.Unmarshal(response.Body.Bytes(), &doc); err != nil {
+			t.Fatal(err)
+		}
+		if doc.TileJSON != "3.0.0" || doc.Scheme != "xyz" || len(doc.Tiles) != 1 {
+			t.Fatalf("TileJSON of %s: %+v", name, doc)
+		}
+		// the template is fetched as a client would, through the proxy
+		tileURL, err := url.Parse(strings.NewReplacer("{z}", "2", "{x}", "1", "{y}", "0").Replace(doc.Tiles[0]))
+		if err != nil || tileURL.Scheme != "https" || tileURL.Host != "tiles.example.com" {
+			t.Fatalf("tile URL %s of %s, want it on https://tiles.example.com", doc.Tiles[0], name)
+		}
+		if tile := get(tileURL.RequestURI()); tile.Code != http.StatusOK || tile.Body.String() != "tile of "+name {
+			t.Fatalf("tile %s of %s: status %d body %q", tileURL.RequestURI(), name, tile.Code, tile.Body)
+		}
+		return doc
+	}
+
+	large := describe("large")
+	if large.TileSize != 512 || large.Name != "large" || large.Attribution != "© Provider" || large.Format != "png" {
+		t.Errorf("TileJSON of large: %+v", large)
+	}
+	if large.MinZoom == nil || *large.MinZoom != 1 || large.MaxZoom == nil || *large.MaxZoom != 3 {
+		t.Errorf("zooms %v..%v, want 1..3", large.MinZoom, large.MaxZoom)
+	}
+	if !slices.Equal(large.Bounds, []float64{-45, -40.9799, 180, 85.0511}) || !slices.Equal(large.Center, []float64{67.5, 22.0356, 3}) {
+		t.Errorf("bounds %v and center %v, want the extent and a center clamped to the zooms", large.Bounds, large.Center)
+	}
+
+	old := describe("old")
+	if old.TileSize != sfile.DefaultTileSize || old.MinZoom != nil || old.MaxZoom != nil || old.Bounds != nil || old.Center != nil {
+		t.Errorf("TileJSON of a repository not analysed: %+v, want 256 pixel tiles and no extent", old)
+	}
+
+	nested := describe("2023/北京影像")
+	if !strings.Contains(nested.Tiles[0], "/api/v1/xyz/2023/"+url.PathEscape("北京影像")+"/{z}/") || nested.Center[2] != 2 {
+		t.Errorf("TileJSON of a nested repository: %+v", nested)
+	}
+
+	if response := get("/api/v1/repositories/missing/tilejson.json"); response.Code != http.StatusNotFound {
+		t.Errorf("TileJSON of a missing repository: status %d, want 404", response.Code)
+	}
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// tracer creates the api spans. Until a tracer provider is installed it is a no-op.
+var tracer = otel.Tracer("SirServer/api")
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush lets streaming handlers such as the events endpoint keep working when traced
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// TracingMiddleware is a mux middleware starting a server span per request. It
+// continues incoming W3C traceparent headers and records the route template,
+// the repository and the tile coordinates of the request.
+func TracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(request.Context(), propagation.HeaderCarrier(request.Header))
+		route := request.URL.Path
+		if current := mux.CurrentRoute(request); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		ctx, span := tracer.Start(ctx, request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(request.Method),
+				semconv.HTTPRoute(route),
+			))
+		defer span.End()
+		span.SetAttributes(routeAttributes(mux.Vars(request))...)
+
+		recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+		next.ServeHTTP(recorder, request.WithContext(ctx))
+		span.SetAttributes(semconv.HTTPResponseStatusCode(recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+// routeAttributes turns the repository and tile route variables into span attributes
+func routeAttributes(vars map[string]string) []attribute.KeyValue {
+	attributes := make([]attribute.KeyValue, 0, 4)
+	for _, key := range []string{"dir", "name"} {
+		if raw, ok := vars[key]; ok {
+			if name, err := url.PathUnescape(raw); err == nil {
+				attributes = append(attributes, attribute.String("sir.repository", name))
+			}
+		}
+	}
+	for _, key := range []string{"z", "x", "y"} {
+		if v, err := strconv.ParseInt(vars[key], 10, 64); err == nil {
+			attributes = append(attributes, attribute.Int64("sir.tile."+key, v))
+		}
+	}
+	return attributes
+}
+
+// recordError marks span as failed with err
+func recordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
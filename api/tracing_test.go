@@ -0,0 +1,132 @@
+package api
+
+import (
+	"SirServer/sfile"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TestTracing serves a tile twice through the tracing middleware with spans
+// recorded in memory, and checks the request span continues the incoming
+// traceparent and carries the route, repository and tile, and that the cache
+// lookup and the sfile read are its descendants: a miss reads the repository,
+// the hit that follows does not.
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	// the global provider can only be set once, the tracers of the packages
+	// delegate to the first one
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator()) })
+
+	root := t.TempDir()
+	dir := filepath.Join(root, "traced")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := sfile.NewRepository(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.WriteXYZ(3, 2, 4, []byte("tile")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sfile.FlushHandles(func(string) bool { return true }) })
+	ac := newTestApiContext(t, root)
+	ac.TileCache = sfile.NewTileCache(1<<20, time.Minute)
+	router := newTestRouter(ac)
+	router.Use(TracingMiddleware)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	get := func() []sdktrace.ReadOnlySpan {
+		t.Helper()
+		request := httptest.NewRequest(http.MethodGet, "/api/v1/xyz/traced/4/3/2.png", nil)
+		request.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		if response.Code != http.StatusOK {
+			t.Fatalf("status %d, want 200", response.Code)
+		}
+		spans := recorder.Ended()
+		recorder.Reset()
+		return spans
+	}
+	byName := func(spans []sdktrace.ReadOnlySpan) map[string]sdktrace.ReadOnlySpan {
+		named := make(map[string]sdktrace.ReadOnlySpan)
+		for _, span := range spans {
+			named[span.Name()] = span
+		}
+		return named
+	}
+	attributes := func(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+		values := make(map[attribute.Key]attribute.Value)
+		for _, kv := range span.Attributes() {
+			values[kv.Key] = kv.Value
+		}
+		return values
+	}
+	childOf := func(child, parent sdktrace.ReadOnlySpan) bool {
+		return child.Parent().SpanID() == parent.SpanContext().SpanID()
+	}
+
+	spans := byName(get())
+	const route = "GET /api/v1/xyz/{dir:.+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png"
+	server, fetch, lookup, read := spans[route], spans["tile.fetch"], spans["tile.cache_lookup"], spans["sfile.GetXYZ"]
+	if server == nil || fetch == nil || lookup == nil || read == nil {
+		t.Fatalf("spans %v, want the request, tile.fetch, tile.cache_lookup and sfile.GetXYZ", spans)
+	}
+	if server.SpanKind() != trace.SpanKindServer || server.SpanContext().TraceID().String() != traceID || !server.Parent().IsRemote() {
+		t.Fatalf("request span of kind %s in trace %s, want a server span continuing %s",
+			server.SpanKind(), server.SpanContext().TraceID(), traceID)
+	}
+	for _, span := range []sdktrace.ReadOnlySpan{fetch, lookup, read} {
+		if span.SpanContext().TraceID() != server.SpanContext().TraceID() {
+			t.Fatalf("span %s in trace %s, want %s", span.Name(), span.SpanContext().TraceID(), traceID)
+		}
+	}
+	if !childOf(fetch, server) || !childOf(lookup, fetch) || !childOf(read, fetch) {
+		t.Fatal("want tile.fetch under the request span, and the cache lookup and sfile read under tile.fetch")
+	}
+	want := map[attribute.Key]attribute.Value{
+		"http.route":                attribute.StringValue("/api/v1/xyz/{dir:.+}/{z:[0-9]+}/{x:[0-9]+}/{y:[0-9]+}.png"),
+		"http.request.method":       attribute.StringValue("GET"),
+		"http.response.status_code": attribute.Int64Value(200),
+		"sir.repository":            attribute.StringValue("traced"),
+		"sir.tile.z":                attribute.Int64Value(4),
+		"sir.tile.x":                attribute.Int64Value(3),
+		"sir.tile.y":                attribute.Int64Value(2),
+	}
+	got := attributes(server)
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("request span %s = %v, want %v", key, got[key].Emit(), value.Emit())
+		}
+	}
+	if hit := attributes(lookup)["sir.tile.cache_hit"]; hit != attribute.BoolValue(false) {
+		t.Errorf("first lookup cache hit %v, want false", hit.Emit())
+	}
+	if got := attributes(read); got["sir.tile.bytes"] != attribute.IntValue(4) || got["sir.tile.x"] != attribute.Int64Value(3) {
+		t.Errorf("sfile span attributes %v, want the tile and its size", read.Attributes())
+	}
+
+	spans = byName(get())
+	if _, ok := spans["sfile.GetXYZ"]; ok {
+		t.Fatal("the cached tile was read from the repository again")
+	}
+	lookup = spans["tile.cache_lookup"]
+	if lookup == nil || !childOf(lookup, spans["tile.fetch"]) || attributes(lookup)["sir.tile.cache_hit"] != attribute.BoolValue(true) {
+		t.Fatalf("second request spans %v, want a cache hit under tile.fetch", spans)
+	}
+}
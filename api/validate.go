@@ -0,0 +1,75 @@
+package api
+
+import (
+	"SirServer/sfile"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// maxValidateSample bounds the tiles per file a caller may have decoded
+const maxValidateSample = 100
+
+// ValidateResult is the progress of a validate job, with the report once it is done
+type ValidateResult struct {
+	Progress sfile.ValidateProgress `json:"progress"`
+	Report   *sfile.Report          `json:"report,omitempty"`
+}
+
+// validateHandler starts a job checking the .s files of a repository for
+// corruption. ?sample=n also decodes up to n tiles of every file.
+func (ac *ApiContext) validateHandler(writer http.ResponseWriter, request *http.Request) {
+	name, err := routeName(request, "name")
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	dir, err := ac.repositoryDir(name)
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	if sfile.IsArchive(dir) || sfile.IsS3Root(ac.RepositoryRoot) {
+		WriteError(writer, http.StatusNotImplemented, "Validation is only available for local repositories of .s files")
+		return
+	}
+	if !isDirectory(dir) {
+		WriteError(writer, http.StatusNotFound, "Repository not found")
+		return
+	}
+	sample := 0
+	if value := request.URL.Query().Get("sample"); value != "" {
+		sample, err = strconv.Atoi(value)
+		if err != nil || sample < 0 || sample > maxValidateSample {
+			WriteError(writer, http.StatusBadRequest, "sample must be between 0 and "+strconv.Itoa(maxValidateSample))
+			return
+		}
+	}
+
+	job := ac.startJob("validate", name)
+	options := sfile.ValidateOptions{
+		Sample: sample,
+		Progress: func(progress sfile.ValidateProgress) {
+			ac.updateJob(job.ID, ValidateResult{Progress: progress})
+		},
+	}
+	go func() {
+		report, err := sfile.ValidateWithOptions(dir, options)
+		if err != nil {
+			logError("Validate job %s of %s failed: %v", job.ID, name, err)
+		} else {
+			log.Printf("Validate job %s of %s done: %d files, %d errors, %d warnings", job.ID, name, report.Files, report.Errors, report.Warnings)
+		}
+		ac.finishJob(job.ID, ValidateResult{
+			Progress: sfile.ValidateProgress{Files: report.Files, Checked: report.Files},
+			Report:   &report,
+		}, err)
+	}()
+
+	writer.Header().Set("Location", "/api/v1/jobs/"+job.ID)
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusAccepted)
+	result, _ := json.Marshal(Ok(job))
+	_, _ = writer.Write(result)
+}
@@ -0,0 +1,31 @@
+package api
+
+import (
+	"SirServer/canvas"
+	"SirServer/sfile"
+)
+
+// parsedWatermark is the outcome of turning WatermarkSettings into canvas
+// options, kept by ApiContext.watermarks so a logo is decoded once
+type parsedWatermark struct {
+	options canvas.WatermarkOptions
+	err     error
+}
+
+// watermarkOptions returns the canvas options of settings, drawn in the font of
+// the canvas context
+func (ac *ApiContext) watermarkOptions(settings *sfile.WatermarkSettings) (canvas.WatermarkOptions, error) {
+	key := settings.Key()
+	if parsed, ok := ac.watermarks.Load(key); ok {
+		return parsed.(parsedWatermark).options, parsed.(parsedWatermark).err
+	}
+	options, err := settings.Options()
+	if ac.CanvasContext != nil {
+		options.Font = ac.CanvasContext.TrueTypeFont()
+	}
+	if err != nil {
+		logError("Invalid watermark %s: %v", key, err)
+	}
+	ac.watermarks.Store(key, parsedWatermark{options: options, err: err})
+	return options, err
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"SirServer/sfile"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// requireWrite wraps a handler that modifies repositories so it is only reachable
+// when write mode is enabled, and then only by admin callers
+func (ac *ApiContext) requireWrite(next http.HandlerFunc) http.HandlerFunc {
+	admin := ac.requireAdmin(next)
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if !ac.WriteEnabled {
+			WriteError(writer, http.StatusForbidden, "Write mode is disabled, start the server with --allow-writes")
+			return
+		}
+		admin(writer, request)
+	}
+}
+
+// repositoryLockedMessage answers writes to a repository another process, such
+// as an import run from the command line, holds locked for longer than the lock timeout
+const repositoryLockedMessage = "Repository is locked by another process, try again later"
+
+// rejectReadOnly answers requests writing to a repository served by a read-only
+// backend, such as a .mbtiles file, and reports whether it did
+func rejectReadOnly(writer http.ResponseWriter, dir string) bool {
+	if !sfile.IsArchive(dir) {
+		return false
+	}
+	WriteError(writer, http.StatusMethodNotAllowed, "Repository is served by a read-only backend, its tiles cannot be written")
+	return true
+}
+
+// deleteTileHandler removes a single tile from a repository
+func (ac *ApiContext) deleteTileHandler(writer http.ResponseWriter, request *http.Request) {
+	tile, err := ac.parseTileRequest(request)
+	if err != nil {
+		WriteError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	if rejectReadOnly(writer, tile.Dir) {
+		return
+	}
+	repository, err := sfile.NewRepository(tile.Dir, false)
+	if err != nil {
+		WriteError(writer, http.StatusNotFound, "Repository not found")
+		return
+	}
+	err = repository.DeleteXYZ(tile.X, tile.Y, tile.Z)
+	ac.TileCache.EvictIf(func(key sfile.TileKey) bool {
+		return key.Stored() == sfile.TileKey{Repository: tile.Key, Z: tile.Z, X: tile.X, Y: tile.Y}
+	})
+	if errors.Is(err, sfile.ErrTileNotFound) {
+		WriteError(writer, http.StatusNotFound, "Tile not found")
+		return
+	}
+	if errors.Is(err, sfile.ErrRepositoryLocked) {
+		WriteError(writer, http.StatusConflict, repositoryLockedMessage)
+		return
+	}
+	if err != nil {
+		logError("Error deleting tile %s/%d/%d/%d: %v", tile.Name, tile.Z, tile.X, tile.Y, err)
+		WriteError(writer, http.StatusInternalServerError, "Failed to delete tile")
+		return
+	}
+	log.Printf("Tile %s/%d/%d/%d deleted", tile.Name, tile.Z, tile.X, tile.Y)
+	// the size and zoom range of the repository may have changed
+	ac.catalog().Invalidate()
+	WriteOk(writer, sfile.TileCoord{Z: tile.Z, X: tile.X, Y: tile.Y})
+}
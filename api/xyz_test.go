@@ -0,0 +1,275 @@
+package api
+
+import (
+	"SirServer/canvas"
+	"SirServer/sfile"
+	"SirServer/sfile/sfiletest"
+	"bytes"
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// newTestServer returns a router serving the api of an ApiContext whose
+// repository root holds the memory repository named name
+func newTestServer(t *testing.T, name string, source sfile.TileSource) *mux.Router {
+	t.Helper()
+	root := t.TempDir()
+	t.Cleanup(sfiletest.Serve(root, name, source))
+	return newRootTestServer(t, root)
+}
+
+// newRootTestServer returns a router serving the api of an ApiContext for the
+// repository root root
+func newRootTestServer(t *testing.T, root string) *mux.Router {
+	t.Helper()
+	return newTestRouter(newTestApiContext(t, root))
+}
+
+// newTestApiContext returns an ApiContext for the repository root root, to be
+// changed before newTestRouter serves it
+func newTestApiContext(t *testing.T, root string) *ApiContext {
+	t.Helper()
+	canvasContext, err := canvas.NewCanvasContext(embed.FS{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewApiContext(root, SirServer{Name: "SirServer"}, canvasContext, embed.FS{})
+}
+
+// newTestRouter returns a router serving the api of ac, matching on the
+// encoded path as the server does
+func newTestRouter(ac *ApiContext) *mux.Router {
+	router := mux.NewRouter().UseEncodedPath()
+	ac.RegisterRoutes(router)
+	return router
+}
+
+// pngTile returns a 256x256 PNG tile filled with c
+func pngTile(t *testing.T, c color.Color) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 256, 256))
+	for i := 0; i < len(img.Pix); i += 4 {
+		r, g, b, a := c.RGBA()
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = uint8(r>>8), uint8(g>>8), uint8(b>>8), uint8(a>>8)
+	}
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, img); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestXYZHandler(t *testing.T) {
+	source := sfiletest.NewMemSource(sfile.Repository{Name: "mem"})
+	stored := pngTile(t, color.NRGBA{R: 0x20, G: 0x80, B: 0x40, A: 0xff})
+	source.Put(3, 2, 1, stored)
+	source.FailTile(3, 4, 4, errors.New("disk on fire"))
+	router := newTestServer(t, "mem", source)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder
+	}
+
+	t.Run("stored", func(t *testing.T) {
+		response := get("/api/v1/xyz/mem/3/2/1.png")
+		if response.Code != http.StatusOK {
+			t.Fatalf("status %d, want 200", response.Code)
+		}
+		if !bytes.Equal(response.Body.Bytes(), stored) {
+			t.Error("body is not the stored tile")
+		}
+		if code := response.Header().Get(tileErrorCodeHeader); code != "" {
+			t.Errorf("error code %q on a stored tile", code)
+		}
+	})
+	t.Run("missing", func(t *testing.T) {
+		response := get("/api/v1/xyz/mem/3/0/0.png")
+		if response.Code != http.StatusOK {
+			t.Errorf("status %d, want a 200 placeholder", response.Code)
+		}
+		if code := response.Header().Get(tileErrorCodeHeader); code != "tile_not_found" {
+			t.Errorf("error code %q, want tile_not_found", code)
+		}
+		if _, err := png.Decode(response.Body); err != nil {
+			t.Errorf("placeholder is not a PNG: %v", err)
+		}
+	})
+	t.Run("failing", func(t *testing.T) {
+		response := get("/api/v1/xyz/mem/3/4/4.png")
+		if response.Code != http.StatusInternalServerError {
+			t.Errorf("status %d, want 500", response.Code)
+		}
+		if code := response.Header().Get(tileErrorCodeHeader); code != "internal" {
+			t.Errorf("error code %q, want internal", code)
+		}
+	})
+	if reads := source.Reads(); reads == 0 {
+		t.Error("the memory source was never read")
+	}
+}
+
+// TestXYZContentType checks tiles are served with the content type of their
+// format rather than as PNG
+func TestXYZContentType(t *testing.T) {
+	source := sfiletest.NewMemSource(sfile.Repository{Name: "formats"})
+	var jpegTile bytes.Buffer
+	if err := jpeg.Encode(&jpegTile, image.NewGray(image.Rect(0, 0, 256, 256)), nil); err != nil {
+		t.Fatal(err)
+	}
+	tiles := map[int64][]byte{
+		0: pngTile(t, color.White),
+		1: jpegTile.Bytes(),
+		2: append([]byte("RIFF\x00\x00\x00\x00WEBPVP8 "), make([]byte, 16)...),
+		3: {0x1a, 0x02, 0x78, 0x02},
+	}
+	want := map[int64]string{0: "image/png", 1: "image/jpeg", 2: "image/webp", 3: "application/octet-stream"}
+	for x, data := range tiles {
+		source.Put(2, x, 0, data)
+	}
+	router := newTestServer(t, "formats", source)
+	for x, contentType := range want {
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/v1/xyz/formats/2/%d/0.png", x), nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("tile %d: status %d", x, recorder.Code)
+		}
+		if got := recorder.Header().Get("Content-Type"); got != contentType {
+			t.Errorf("tile %d: Content-Type %q, want %q", x, got, contentType)
+		}
+		if !bytes.Equal(recorder.Body.Bytes(), tiles[x]) {
+			t.Errorf("tile %d: body is not the stored tile", x)
+		}
+	}
+}
+
+func TestServeStop(t *testing.T) {
+	root := t.TempDir()
+	source := sfiletest.NewMemSource(sfile.Repository{Name: "mem"})
+	stop := sfiletest.Serve(root, "mem", source)
+	if _, err := sfile.OpenTileSource(root, "mem"); err != nil {
+		t.Fatalf("served source: %v", err)
+	}
+	stop()
+	if _, err := sfile.OpenTileSource(root, "mem"); !errors.Is(err, sfile.ErrRepositoryNotFound) {
+		t.Errorf("stopped source: %v, want ErrRepositoryNotFound", err)
+	}
+	if sfile.IsArchive(filepath.Join(root, "mem")) {
+		t.Error("stopped source still registered")
+	}
+}
+
+// TestXYZGzipPassthrough serves a tile a compressing repository stores gzipped,
+// as stored to clients accepting gzip and decompressed to the others
+func TestXYZGzipPassthrough(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "vector")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "repository.json"), []byte(`{"name":"vector","compress":true}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := sfile.NewRepository(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tile := []byte(`{"features":[` + strings.Repeat(`{"name":"road"},`, 50) + `{}]}`)
+	if err := repo.WriteXYZ(1, 1, 2, tile); err != nil {
+		t.Fatal(err)
+	}
+	router := newRootTestServer(t, root)
+
+	for _, acceptGzip := range []bool{true, false} {
+		request := httptest.NewRequest(http.MethodGet, "/api/v1/xyz/vector/2/1/1.png", nil)
+		if acceptGzip {
+			request.Header.Set("Accept-Encoding", "gzip, deflate")
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("accepting gzip %v: status %d", acceptGzip, recorder.Code)
+		}
+		if got := recorder.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("accepting gzip %v: Content-Type %q, want application/json", acceptGzip, got)
+		}
+		body := recorder.Body.Bytes()
+		if acceptGzip {
+			if got := recorder.Header().Get("Content-Encoding"); got != "gzip" {
+				t.Fatalf("Content-Encoding %q, want the stored gzip passed through", got)
+			}
+			if body, err = sfile.DecodeTile(body, sfile.EncodingGzip); err != nil {
+				t.Fatal(err)
+			}
+		} else if got := recorder.Header().Get("Content-Encoding"); got != "" {
+			t.Fatalf("Content-Encoding %q to a client not accepting gzip", got)
+		}
+		if !bytes.Equal(body, tile) {
+			t.Errorf("accepting gzip %v: body is not the tile written", acceptGzip)
+		}
+	}
+}
+
+// TestFetchTileCoalesced asks for a tile that is not cached from many requests
+// at once, one of them giving up early, and checks the memory source is read
+// once and every other request is served the tile
+func TestFetchTileCoalesced(t *testing.T) {
+	const requests = 32
+	source := sfiletest.NewMemSource(sfile.Repository{Name: "mem"})
+	stored := pngTile(t, color.White)
+	source.Put(5, 3, 7, stored)
+	// long enough for every request to join the read in flight
+	source.SetLatency(300 * time.Millisecond)
+	// the tile cache is disabled, only the coalescing saves reads
+	router := newTestServer(t, "mem", source)
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	responses := make([]*httptest.ResponseRecorder, requests)
+	for i := range responses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request := httptest.NewRequest(http.MethodGet, "/api/v1/xyz/mem/5/3/7.png", nil)
+			if i == 0 {
+				ctx, cancel := context.WithTimeout(request.Context(), 50*time.Millisecond)
+				defer cancel()
+				request = request.WithContext(ctx)
+			}
+			<-start
+			responses[i] = httptest.NewRecorder()
+			router.ServeHTTP(responses[i], request)
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if reads := source.Reads(); reads != 1 {
+		t.Fatalf("%d concurrent requests read the source %d times, want once", requests, reads)
+	}
+	if bytes.Equal(responses[0].Body.Bytes(), stored) {
+		t.Error("the request that gave up was served the tile")
+	}
+	for i, response := range responses[1:] {
+		if response.Code != http.StatusOK || !bytes.Equal(response.Body.Bytes(), stored) {
+			t.Fatalf("request %d: status %d, want the stored tile", i+1, response.Code)
+		}
+	}
+}
@@ -32,7 +32,7 @@ for PLATFORM in "${PLATFORMS[@]}"; do
     OUTPUT_PATH="$OUTPUT_DIR/$APP_NAME-$GOOS-$GOARCH$EXT"
 
     echo "Building $APP_NAME for $GOOS/$GOARCH to $OUTPUT_PATH"
-    GOOS=$GOOS GOARCH=$GOARCH go build -o "$OUTPUT_PATH" ./main.go
+    GOOS=$GOOS GOARCH=$GOARCH go build -o "$OUTPUT_PATH" .
 
     if [ $? -ne 0 ]; then
         echo "Error building for $GOOS/$GOARCH. Aborting."
@@ -0,0 +1,146 @@
+package canvas
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"strconv"
+)
+
+// Ranges an Adjustment is validated against. Values beyond them turn a tile
+// white, black or noise and are taken for mistakes.
+const (
+	MinGamma      = 0.1
+	MaxGamma      = 10
+	MaxBrightness = 100 // in percent of full intensity, either way
+	MaxContrast   = 10
+	MaxSaturation = 10
+)
+
+// Adjustment is a change of the tone and colors of an image, see Adjust. Values
+// left at their default are best taken from DefaultAdjustment.
+type Adjustment struct {
+	Gamma      float64 // above 1 brightens the midtones, below 1 darkens them
+	Brightness float64 // added to every channel, in percent of full intensity
+	Contrast   float64 // scales the distance of every channel from mid gray
+	Saturation float64 // scales the distance of every color from its gray, 0 makes it gray
+}
+
+// DefaultAdjustment changes nothing. The zero Adjustment, standing for none
+// asked for, changes nothing either.
+var DefaultAdjustment = Adjustment{Gamma: 1, Contrast: 1, Saturation: 1}
+
+// IsIdentity reports whether a leaves images as they are
+func (a Adjustment) IsIdentity() bool {
+	return a == Adjustment{} || a == DefaultAdjustment
+}
+
+// Validate checks that every value of a is within its range
+func (a Adjustment) Validate() error {
+	if a.IsIdentity() {
+		return nil
+	}
+	checks := []struct {
+		name     string
+		value    float64
+		min, max float64
+	}{
+		{"gamma", a.Gamma, MinGamma, MaxGamma},
+		{"brightness", a.Brightness, -MaxBrightness, MaxBrightness},
+		{"contrast", a.Contrast, 0, MaxContrast},
+		{"saturation", a.Saturation, 0, MaxSaturation},
+	}
+	for _, check := range checks {
+		if math.IsNaN(check.value) || check.value < check.min || check.value > check.max {
+			return fmt.Errorf("%s %g is not within %g..%g", check.name, check.value, check.min, check.max)
+		}
+	}
+	return nil
+}
+
+// Key returns the values of a in a short form, telling images adjusted
+// otherwise apart in caches
+func (a Adjustment) Key() string {
+	format := func(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+	return "g" + format(a.Gamma) + ",b" + format(a.Brightness) + ",c" + format(a.Contrast) + ",s" + format(a.Saturation)
+}
+
+// lut returns the table mapping every value of a channel to its value with the
+// contrast, brightness and gamma of a applied, in that order
+func (a Adjustment) lut() [256]uint8 {
+	var table [256]uint8
+	for v := range table {
+		x := (float64(v)/0xff-0.5)*a.Contrast + 0.5 + a.Brightness/100
+		x = math.Pow(math.Max(0, math.Min(x, 1)), 1/a.Gamma)
+		table[v] = uint8(math.Round(x * 0xff))
+	}
+	return table
+}
+
+// Adjust returns a copy of img with the tone and colors changed as a says. The
+// channels go through a lookup table built once per call, and the saturation
+// is then scaled around the luma of every pixel, so an adjustment costs about
+// as much as copying the image. Colors are adjusted apart from their alpha,
+// transparent pixels stay transparent.
+func Adjust(img image.Image, a Adjustment) *image.NRGBA {
+	adjusted := toNRGBA(img)
+	if a.IsIdentity() {
+		return adjusted
+	}
+	table := a.lut()
+	// the saturation in 1/256, so pixels are scaled with integers
+	saturation := int32(math.Round(a.Saturation * 256))
+	for y := 0; y < adjusted.Rect.Dy(); y++ {
+		row := adjusted.Pix[y*adjusted.Stride : y*adjusted.Stride+4*adjusted.Rect.Dx()]
+		for i := 0; i < len(row); i += 4 {
+			r, g, b := int32(table[row[i]]), int32(table[row[i+1]]), int32(table[row[i+2]])
+			if saturation != 256 {
+				// Rec. 601 luma, as image/color converts to gray
+				luma := (19595*r + 38470*g + 7471*b + 1<<15) >> 16
+				r = luma + (saturation*(r-luma))>>8
+				g = luma + (saturation*(g-luma))>>8
+				b = luma + (saturation*(b-luma))>>8
+			}
+			row[i], row[i+1], row[i+2] = clampByte(r), clampByte(g), clampByte(b)
+		}
+	}
+	return adjusted
+}
+
+// clampByte returns v limited to 0..255
+func clampByte(v int32) uint8 {
+	return uint8(max(0, min(v, 0xff)))
+}
+
+// toNRGBA returns a copy of img as an NRGBA image with bounds starting at 0,0.
+// RGBA images, what most tiles decode or are drawn to, are converted without
+// the per pixel color conversions of image/draw.
+func toNRGBA(img image.Image) *image.NRGBA {
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		draw.Draw(nrgba, nrgba.Bounds(), img, bounds.Min, draw.Src)
+		return nrgba
+	}
+	for y := 0; y < bounds.Dy(); y++ {
+		src := rgba.Pix[rgba.PixOffset(bounds.Min.X, bounds.Min.Y+y):][:4*bounds.Dx()]
+		dst := nrgba.Pix[y*nrgba.Stride:][:4*bounds.Dx()]
+		for i := 0; i < len(src); i += 4 {
+			alpha := uint32(src[i+3])
+			switch alpha {
+			case 0xff:
+				copy(dst[i:i+4], src[i:i+4])
+			case 0:
+				// transparent pixels have no color to recover
+			default:
+				for c := 0; c < 3; c++ {
+					dst[i+c] = uint8((uint32(src[i+c])*0xff + alpha/2) / alpha)
+				}
+				dst[i+3] = uint8(alpha)
+			}
+		}
+	}
+	return nrgba
+}
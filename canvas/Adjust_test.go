@@ -0,0 +1,122 @@
+package canvas
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// TestAdjustKnownPixels adjusts single pixels and checks the exact values of
+// each kind of adjustment and of their combination
+func TestAdjustKnownPixels(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		a    Adjustment
+		in   color.NRGBA
+		want color.NRGBA
+	}{
+		{"none", Adjustment{}, color.NRGBA{R: 12, G: 34, B: 56, A: 0xff}, color.NRGBA{R: 12, G: 34, B: 56, A: 0xff}},
+		{"default", DefaultAdjustment, color.NRGBA{R: 12, G: 34, B: 56, A: 78}, color.NRGBA{R: 12, G: 34, B: 56, A: 78}},
+		// (64/255)^(1/2) and (16/255)^(1/2) of full intensity
+		{"gamma", Adjustment{Gamma: 2, Contrast: 1, Saturation: 1}, color.NRGBA{R: 64, G: 16, B: 0xff, A: 0xff}, color.NRGBA{R: 128, G: 64, B: 0xff, A: 0xff}},
+		{"darker gamma", Adjustment{Gamma: 0.5, Contrast: 1, Saturation: 1}, color.NRGBA{R: 128, G: 64, A: 0xff}, color.NRGBA{R: 64, G: 16, A: 0xff}},
+		// 20% is 51 either way, clamped at the ends
+		{"brightness", Adjustment{Gamma: 1, Brightness: 20, Contrast: 1, Saturation: 1}, color.NRGBA{R: 100, G: 220, A: 0xff}, color.NRGBA{R: 151, G: 0xff, B: 51, A: 0xff}},
+		{"darkness", Adjustment{Gamma: 1, Brightness: -20, Contrast: 1, Saturation: 1}, color.NRGBA{R: 100, G: 20, A: 0xff}, color.NRGBA{R: 49, A: 0xff}},
+		// 0.4 and 0.8 of full intensity move to 0.35 and 0.95
+		{"contrast", Adjustment{Gamma: 1, Contrast: 1.5, Saturation: 1}, color.NRGBA{R: 102, G: 204, B: 0xff, A: 0xff}, color.NRGBA{R: 89, G: 242, B: 0xff, A: 0xff}},
+		{"no contrast", Adjustment{Gamma: 1, Contrast: 0, Saturation: 1}, color.NRGBA{R: 0, G: 0xff, B: 30, A: 0xff}, color.NRGBA{R: 128, G: 128, B: 128, A: 0xff}},
+		// Rec. 601 luma of red is 76
+		{"gray", Adjustment{Gamma: 1, Contrast: 1, Saturation: 0}, color.NRGBA{R: 0xff, A: 0xff}, color.NRGBA{R: 76, G: 76, B: 76, A: 0xff}},
+		// around the luma of 141
+		{"saturation", Adjustment{Gamma: 1, Contrast: 1, Saturation: 2}, color.NRGBA{R: 100, G: 150, B: 200, A: 0xff}, color.NRGBA{R: 59, G: 159, B: 0xff, A: 0xff}},
+		// the color changes, the alpha does not
+		{"alpha", Adjustment{Gamma: 1, Brightness: 20, Contrast: 1, Saturation: 1}, color.NRGBA{R: 100, G: 100, B: 100, A: 0x80}, color.NRGBA{R: 151, G: 151, B: 151, A: 0x80}},
+		// contrast first, then brightness, then gamma: 0.8 to 0.95 to 1 and 0.4
+		// to 0.35 to 0.45
+		{"combined", Adjustment{Gamma: 2, Brightness: 10, Contrast: 1.5, Saturation: 1}, color.NRGBA{R: 204, G: 102, A: 0xff}, color.NRGBA{R: 0xff, G: 171, A: 0xff}},
+	} {
+		img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+		for i := 0; i < len(img.Pix); i += 4 {
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = tc.in.R, tc.in.G, tc.in.B, tc.in.A
+		}
+		adjusted := Adjust(img, tc.a)
+		if got := adjusted.NRGBAAt(2, 1); got != tc.want {
+			t.Errorf("%s: %v adjusted to %v, want %v", tc.name, tc.in, got, tc.want)
+		}
+		if img.NRGBAAt(2, 1) != tc.in {
+			t.Errorf("%s: the image adjusted was changed", tc.name)
+		}
+	}
+}
+
+// TestAdjustImageTypes checks premultiplied and offset images are adjusted as
+// their NRGBA equivalents and transparent pixels stay transparent
+func TestAdjustImageTypes(t *testing.T) {
+	a := Adjustment{Gamma: 1.4, Brightness: 10, Contrast: 1.1, Saturation: 0.9}
+	rgba := image.NewRGBA(image.Rect(10, 20, 14, 22))
+	// one third of full intensity at an alpha of 0x33, exactly 85 unpremultiplied
+	rgba.SetRGBA(10, 20, color.RGBA{R: 17, G: 17, B: 17, A: 0x33})
+	rgba.SetRGBA(13, 21, color.RGBA{R: 0xff, G: 0x80, A: 0xff})
+	adjusted := Adjust(rgba, a)
+	if adjusted.Rect != image.Rect(0, 0, 4, 2) {
+		t.Fatalf("adjusted to %v, want bounds at 0,0", adjusted.Rect)
+	}
+	for _, at := range [][2]image.Point{{{10, 20}, {0, 0}}, {{13, 21}, {3, 1}}} {
+		in := color.NRGBAModel.Convert(rgba.At(at[0].X, at[0].Y)).(color.NRGBA)
+		want := Adjust(&image.NRGBA{Pix: []uint8{in.R, in.G, in.B, in.A}, Stride: 4, Rect: image.Rect(0, 0, 1, 1)}, a).NRGBAAt(0, 0)
+		if got := adjusted.NRGBAAt(at[1].X, at[1].Y); got != want {
+			t.Errorf("pixel %v adjusted to %v, want %v as NRGBA", at[0], got, want)
+		}
+	}
+	if got := adjusted.NRGBAAt(1, 0); got.A != 0 {
+		t.Errorf("transparent pixel adjusted to %v", got)
+	}
+}
+
+// TestAdjustmentValidate checks values at the ends of their ranges pass and
+// values beyond them fail
+func TestAdjustmentValidate(t *testing.T) {
+	valid := []Adjustment{
+		{},
+		DefaultAdjustment,
+		{Gamma: MinGamma, Brightness: -MaxBrightness, Contrast: 0, Saturation: 0},
+		{Gamma: MaxGamma, Brightness: MaxBrightness, Contrast: MaxContrast, Saturation: MaxSaturation},
+	}
+	for _, a := range valid {
+		if err := a.Validate(); err != nil {
+			t.Errorf("%+v: %v", a, err)
+		}
+	}
+	for _, a := range []Adjustment{
+		{Gamma: 0, Contrast: 1, Saturation: 1, Brightness: 5},
+		{Gamma: 11, Contrast: 1, Saturation: 1},
+		{Gamma: 1, Brightness: 101, Contrast: 1, Saturation: 1},
+		{Gamma: 1, Contrast: -1, Saturation: 1},
+		{Gamma: 1, Contrast: 1, Saturation: 10.5},
+	} {
+		if err := a.Validate(); err == nil {
+			t.Errorf("%+v is valid", a)
+		}
+	}
+	if DefaultAdjustment.Key() == (Adjustment{Gamma: 1.4, Contrast: 1, Saturation: 1}).Key() {
+		t.Error("adjustments of different gamma have the same key")
+	}
+}
+
+// BenchmarkAdjust adjusts a 256 pixel tile, through the lookup table and the
+// saturation
+func BenchmarkAdjust(b *testing.B) {
+	tile := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for i := range tile.Pix {
+		tile.Pix[i] = uint8(i * 7)
+		if i%4 == 3 {
+			tile.Pix[i] = 0xff
+		}
+	}
+	a := Adjustment{Gamma: 1.4, Brightness: 10, Contrast: 1.1, Saturation: 0.9}
+	b.ResetTimer()
+	for range b.N {
+		Adjust(tile, a)
+	}
+}
@@ -0,0 +1,93 @@
+package canvas
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// DefaultAttributionFontSize is the size in points of attribution text when
+// AttributionOptions leave it at 0
+const DefaultAttributionFontSize = 9
+
+// attributionPadding is the space in pixels between the text of an attribution
+// and the edges of its strip
+const attributionPadding = 3
+
+// Colors of attributions whose options leave them unset: dark text on a light
+// strip, as web maps show their attribution
+var (
+	DefaultAttributionColor      = color.NRGBA{R: 0x33, G: 0x33, B: 0x33, A: 0xff}
+	DefaultAttributionBackground = color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xb0}
+)
+
+// AttributionOptions are how DrawAttribution draws an attribution
+type AttributionOptions struct {
+	Corner     string         // one of the Corner constants, CornerBottomRight when empty or unknown
+	FontSize   float64        // in points, DefaultAttributionFontSize when 0
+	Color      color.Color    // of the text, DefaultAttributionColor when nil
+	Background color.Color    // of the strip behind the text, DefaultAttributionBackground when nil
+	Font       *truetype.Font // the text is drawn in, Go Regular when nil
+}
+
+// ApplyAttribution returns a copy of tile with text drawn over it as
+// DrawAttribution does
+func ApplyAttribution(tile image.Image, text string, opts AttributionOptions) image.Image {
+	bounds := tile.Bounds()
+	attributed := image.NewRGBA(bounds)
+	draw.Draw(attributed, bounds, tile, bounds.Min, draw.Src)
+	DrawAttribution(attributed, text, opts)
+	return attributed
+}
+
+// DrawAttribution draws text on a semi-transparent strip in a corner of img,
+// flush with its edges, as web maps show the attribution of their data. Text
+// too wide for img is cut short with an ellipsis, and only its first line is
+// drawn.
+func DrawAttribution(img draw.Image, text string, opts AttributionOptions) {
+	if text == "" {
+		return
+	}
+	size := opts.FontSize
+	if size <= 0 {
+		size = DefaultAttributionFontSize
+	}
+	face := watermarkFace(opts.Font, size)
+	defer face.Close()
+	bounds := img.Bounds()
+	step := lineHeight(face)
+	lines := layoutBlock(face, text, bounds.Dx()-2*attributionPadding, step.Ceil(), step)
+	if len(lines) == 0 {
+		return
+	}
+	line := lines[0]
+
+	width := min(font.MeasureString(face, line).Ceil()+2*attributionPadding, bounds.Dx())
+	height := min(step.Ceil()+2*attributionPadding, bounds.Dy())
+	origin := image.Pt(bounds.Max.X-width, bounds.Max.Y-height)
+	switch opts.Corner {
+	case CornerTopLeft:
+		origin = bounds.Min
+	case CornerTopRight:
+		origin.Y = bounds.Min.Y
+	case CornerBottomLeft:
+		origin.X = bounds.Min.X
+	}
+	background := opts.Background
+	if background == nil {
+		background = DefaultAttributionBackground
+	}
+	textColor := opts.Color
+	if textColor == nil {
+		textColor = DefaultAttributionColor
+	}
+	strip := image.Rectangle{Min: origin, Max: origin.Add(image.Pt(width, height))}
+	draw.Draw(img, strip, image.NewUniform(background), image.Point{}, draw.Over)
+	dr := &font.Drawer{Dst: img, Src: image.NewUniform(textColor), Face: face}
+	dr.Dot = fixed.Point26_6{X: fixed.I(origin.X + attributionPadding), Y: fixed.I(origin.Y+attributionPadding) + face.Metrics().Ascent}
+	dr.DrawString(line)
+}
@@ -3,7 +3,7 @@ package canvas
 import (
 	"bytes"
 	"embed"
-	"fmt" // Import fmt for error messages
+	"fmt"
 	"github.com/golang/freetype/truetype"
 	"golang.org/x/image/font"
 	"golang.org/x/image/font/gofont/goregular"
@@ -11,102 +11,221 @@ import (
 	"image"
 	"image/color"
 	"image/draw"
-	"image/png" // For encoding PNG
-	"log"       // For logging fatal errors during font loading
+	"log" // For logging warnings during font loading
+	"slices"
+	"sync"
 )
 
 // CanvasContext holds resources needed for drawing operations, like the font.
+// Text is drawn with a chain of fonts, each character with the first that has
+// a glyph for it, see chainFace. It is safe for concurrent use: font faces
+// cache glyphs and are not, so every drawing takes faces of its own from a pool
+// per size.
 type CanvasContext struct {
-	Font font.Face // Exported field for the font face
+	// Font is a face of DefaultFontSize for callers drawing on their own. It is
+	// not safe for concurrent use and the context never draws with it.
+	Font font.Face
+
+	fonts  []*truetype.Font // the chain faces draw with, Go Regular alone when empty
+	mu     sync.Mutex
+	faces  map[float64]*sync.Pool // of font.Face by size in points
+	images *imageCache            // PNGs of CreateCachedImage
 }
 
-// NewCanvasContext initializes and returns a new CanvasContext.
-// It loads the default Go Regular font at a base size.
-func NewCanvasContext(fs embed.FS) *CanvasContext {
+// NewCanvasContext initializes and returns a new CanvasContext drawing with the
+// custom font of fs, or Go Regular when fs has none. A custom font that cannot
+// be parsed is an error rather than a crash, the caller decides what to do.
+func NewCanvasContext(fs embed.FS) (*CanvasContext, error) {
 	fontPath := "static/fonts/AlibabaPuHuiTi-3-65-Medium.ttf"
 	fontBytes, err := fs.ReadFile(fontPath) // Read the font file into a byte slice
 	if err != nil {
 		// Log a warning if the custom font cannot be loaded and fall back to GoRegular.
-		// This is a common point of failure for "index out of range" if the custom font is malformed.
 		log.Printf("Warning: Cannot load custom font from %s. Falling back to goregular.TTF. Error: %v", fontPath, err)
 		fontBytes = goregular.TTF // Use the embedded GoRegular font as a fallback
 	}
+	return NewCanvasContextFromFont(fontBytes)
+}
 
-	// Parse the font data
+// NewCanvasContextFromFont returns a CanvasContext drawing with the TrueType
+// font fontBytes, falling back to Go Regular for the characters it lacks. It
+// fails when the font cannot be parsed.
+func NewCanvasContextFromFont(fontBytes []byte) (*CanvasContext, error) {
 	parsedFont, err := truetype.Parse(fontBytes)
 	if err != nil {
-		// If parsing fails even for goregular.TTF (or a severely corrupted custom font),
-		// this indicates a critical issue with the font data itself.
-		// log.Fatalf will exit the program. Consider returning an error instead for a library.
-		log.Fatalf("Failed to parse font data: %v", err)
+		return nil, fmt.Errorf("failed to parse font data: %w", err)
 	}
-
-	// Create a font face (defines font size, DPI, etc.)
-	faceOptions := &truetype.Options{
-		Size:    10,               // Font size in points
+	// Font stays open for the lifetime of the context, faces of the pools are
+	// dropped by the garbage collector like any other value
+	fontFace := truetype.NewFace(parsedFont, &truetype.Options{
+		Size:    DefaultFontSize,  // Font size in points
 		DPI:     72,               // Dots per inch
 		Hinting: font.HintingNone, // No hinting for simplicity
+	})
+	fonts := []*truetype.Font{parsedFont}
+	if !bytes.Equal(fontBytes, goregular.TTF) {
+		fonts = append(fonts, goRegular())
 	}
-	fontFace := truetype.NewFace(parsedFont, faceOptions)
-	// IMPORTANT: Do NOT defer fontFace.Close() here.
-	// The fontFace needs to remain open for the lifetime of the CanvasContext
-	// as it will be used for multiple drawing operations.
-	// The caller of NewCanvasContext should manage closing the fontFace
-	// if explicit resource cleanup is required (e.g., in a long-running server
-	// where context might be destroyed). For most applications, it's fine
-	// to let it be garbage collected when the program exits.
-
 	return &CanvasContext{
-		Font: fontFace, // Assign to the exported field
+		Font:   fontFace,
+		fonts:  fonts,
+		faces:  make(map[float64]*sync.Pool),
+		images: newImageCache(DefaultImageCacheEntries),
+	}, nil
+}
+
+// CreateCachedImage returns the PNG CreateStyledImage draws, from the cache of
+// the context once it was drawn. The bytes are shared and must not be modified.
+// Images with text unique to each call would only churn the cache, they are
+// better drawn with CreateStyledImage.
+func (c *CanvasContext) CreateCachedImage(width int, height int, style TileStyle, text string) ([]byte, error) {
+	if c.images == nil {
+		buf, err := c.CreateStyledImage(width, height, style, text)
+		return buf.Bytes(), err
+	}
+	key := newImageKey(width, height, style, text)
+	if data, ok := c.images.get(key); ok {
+		return data, nil
+	}
+	buf, err := c.CreateStyledImage(width, height, style, text)
+	if err != nil {
+		return nil, err
+	}
+	c.images.put(key, buf.Bytes())
+	return buf.Bytes(), nil
+}
+
+// EvictCachedImages drops the PNGs of CreateCachedImage whose text matches from
+// its cache and returns how many were dropped
+func (c *CanvasContext) EvictCachedImages(match func(text string) bool) int {
+	if c.images == nil {
+		return 0
 	}
+	return c.images.evictIf(match)
 }
 
-// CreateImage creates an image with a specified background color and draws text on it.
+// ImageCacheStats returns the counters of the cache of CreateCachedImage
+func (c *CanvasContext) ImageCacheStats() ImageCacheStats {
+	if c.images == nil {
+		return ImageCacheStats{}
+	}
+	return c.images.stats()
+}
+
+// TrueTypeFont returns the first font of the context, for drawing outside of it
+// such as with ApplyWatermark. It is nil for a context made without one.
+func (c *CanvasContext) TrueTypeFont() *truetype.Font {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.fonts) == 0 {
+		return nil
+	}
+	return c.fonts[0]
+}
+
+// AddFont adds the TrueType font fontBytes to the fallback chain, after the
+// fonts added before and ahead of Go Regular, so the characters they lack are
+// drawn with it. It is meant for setting the context up: images cached before
+// keep the characters they were drawn with.
+func (c *CanvasContext) AddFont(fontBytes []byte) error {
+	parsedFont, err := truetype.Parse(fontBytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse font data: %w", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.fonts) == 0 {
+		c.fonts = []*truetype.Font{goRegular()}
+	}
+	at := len(c.fonts)
+	if at > 1 && c.fonts[at-1] == goRegular() {
+		at--
+	}
+	c.fonts = slices.Insert(slices.Clone(c.fonts), at, parsedFont)
+	// faces made from the old chain are dropped with their pools
+	c.faces = make(map[float64]*sync.Pool)
+	return nil
+}
+
+// face takes a face of the given size in points, DefaultFontSize when 0, from
+// the pool of that size. The face is the caller's alone until it calls release,
+// which hands it back to the pool.
+func (c *CanvasContext) face(size float64) (face font.Face, release func()) {
+	if size <= 0 {
+		size = DefaultFontSize
+	}
+	c.mu.Lock()
+	if c.faces == nil {
+		c.faces = make(map[float64]*sync.Pool)
+	}
+	pool, ok := c.faces[size]
+	if !ok {
+		fonts := c.fonts
+		if len(fonts) == 0 {
+			fonts = []*truetype.Font{goRegular()}
+		}
+		pool = &sync.Pool{New: func() any { return newChainFace(fonts, size) }}
+		c.faces[size] = pool
+	}
+	c.mu.Unlock()
+	face = pool.Get().(font.Face)
+	return face, func() { pool.Put(face) }
+}
+
+// CreateImage creates an image with a specified background color and draws text on it,
+// wrapped as CreateStyledImage does. It is CreateImageWithOpts with the default options.
 // It returns the image data as a bytes.Buffer (PNG format) and an error if any.
 func (c *CanvasContext) CreateImage(width int, height int, backgroundColor color.Color, textColor color.Color, text string) (bytes.Buffer, error) {
-	var buf bytes.Buffer // Buffer to store the PNG image data
+	return c.CreateImageWithOpts(width, height, backgroundColor, textColor, text, CreateImageOpts{})
+}
+
+// CreateStyledImage creates an image drawn in style with text centered on it,
+// wrapped to the width of the image and cut short with an ellipsis when it is
+// too long for its height. A style without colors draws black text on transparent.
+// It returns the image data as a bytes.Buffer (PNG format) and an error if any.
+func (c *CanvasContext) CreateStyledImage(width int, height int, style TileStyle, text string) (bytes.Buffer, error) {
+	return c.CreateEncodedImage(width, height, style, text, Encoding{})
+}
+
+// CreateEncodedImage draws the image CreateStyledImage does and encodes it with
+// encoding, flattening a transparent background onto its matte for JPEG.
+func (c *CanvasContext) CreateEncodedImage(width int, height int, style TileStyle, text string, encoding Encoding) (bytes.Buffer, error) {
+	if style.Background == nil {
+		style.Background = color.Transparent
+	}
+	if style.Text == nil {
+		style.Text = color.Black
+	}
 
 	imgRect := image.Rect(0, 0, width, height)
 	img := image.NewRGBA(imgRect) // Create an RGBA image (supports transparency)
 
 	// Fill the image with the specified background color
-	draw.Draw(img, img.Bounds(), &image.Uniform{backgroundColor}, image.Point{}, draw.Src)
+	draw.Draw(img, img.Bounds(), &image.Uniform{style.Background}, image.Point{}, draw.Src)
+	if style.Border > 0 {
+		borderColor := style.BorderColor
+		if borderColor == nil {
+			borderColor = style.Text
+		}
+		drawBorder(img, style.Border, borderColor)
+	}
 
 	// Create a font.Drawer to draw the text
+	face, release := c.face(style.FontSize)
+	defer release()
 	dr := &font.Drawer{
 		Dst:  img,
-		Src:  image.NewUniform(textColor),
-		Face: c.Font, // Use the font face from the CanvasContext
+		Src:  image.NewUniform(style.Text),
+		Face: face, // Use the font face of the size of the style
 	}
 
-	// Measure the text width to center it
-	// This operation can sometimes expose issues if the font data is inconsistent
-	// or if the text contains unsupported characters.
-	textWidth := dr.MeasureString(text)
-
-	// Calculate horizontal position for centering
-	x := (fixed.I(width) - textWidth) / 2
+	// Wrap the text to the width of the image, measuring it with the drawer's
+	// face so the lines respect the actual glyph widths, see layoutText
+	lines := layoutText(face, text, width, height)
 
-	// Calculate vertical position for centering (approximately)
-	// The `Dot` field represents the baseline of the text.
-	// `c.Font.Metrics().Ascent` gives the distance from the baseline to the top of the font.
-	// Issues here are less likely to cause "index out of range" directly, but
-	// incorrect positioning could lead to drawing off-screen.
-	y := (fixed.I(height) + c.Font.Metrics().Ascent) / 2
-
-	dr.Dot = fixed.Point26_6{X: x, Y: y} // Set the drawing origin
-
-	// This is the most likely place where "index out of range" errors occur,
-	// especially if the 'text' string contains characters that the loaded font
-	// (either custom or goregular) does not have glyph data for, or if the font
-	// itself has malformed glyph tables.
-	dr.DrawString(text) // Draw the text
-
-	// Encode the image to PNG format and write it to the buffer
-	err := png.Encode(&buf, img)
-	if err != nil {
-		return bytes.Buffer{}, fmt.Errorf("failed to encode image to PNG: %w", err)
-	}
+	// Center the block of lines vertically
+	step := lineHeight(face)
+	drawLines(dr, lines, width, (fixed.I(height)-step*fixed.Int26_6(len(lines)))/2)
 
-	return buf, nil // Return the buffer containing the PNG data
+	// Encode the image in the requested format, PNG unless it says otherwise
+	return encoding.Encode(img)
 }
@@ -0,0 +1,111 @@
+package canvas
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"sync"
+	"testing"
+
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+// newTestContext returns a context drawing with Go Regular alone, the same on
+// every platform
+func newTestContext(t testing.TB) *CanvasContext {
+	t.Helper()
+	c, err := NewCanvasContextFromFont(goregular.TTF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// TestConcurrentRendering draws hundreds of message tiles at once, in several
+// font sizes sharing the face pools, and checks each is identical to the same
+// tile drawn alone. Run with -race, a face used by two drawings at once shows
+// as a data race or as garbled glyphs.
+func TestConcurrentRendering(t *testing.T) {
+	c := newTestContext(t)
+	type job struct {
+		style TileStyle
+		text  string
+	}
+	var jobs []job
+	for i, size := range []float64{8, DefaultFontSize, 14, 20} {
+		for _, text := range []string{
+			"Tile not found",
+			fmt.Sprintf("repository %d has no tile 12/3391/1552 at /srv/repos/r%d/L/L12-3391-1552.s", i, i),
+			"北京 tiles drawn with a replacement character",
+			"",
+		} {
+			jobs = append(jobs, job{
+				style: TileStyle{Background: color.NRGBA{R: uint8(40 * i), A: 0xc0}, Text: color.White, FontSize: size, Border: i % 2},
+				text:  text,
+			})
+		}
+	}
+	want := make([][]byte, len(jobs))
+	for i, job := range jobs {
+		buf, err := c.CreateStyledImage(128, 96, job.style, job.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[i] = buf.Bytes()
+	}
+
+	const workers, renders = 16, 320
+	var wg sync.WaitGroup
+	errs := make(chan error, renders)
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := w; n < renders; n += workers {
+				i := n % len(jobs)
+				var data []byte
+				if n%5 == 0 {
+					// through the image cache, which is shared as well
+					cached, err := c.CreateCachedImage(128, 96, jobs[i].style, jobs[i].text)
+					if err != nil {
+						errs <- err
+						continue
+					}
+					data = cached
+				} else {
+					buf, err := c.CreateStyledImage(128, 96, jobs[i].style, jobs[i].text)
+					if err != nil {
+						errs <- err
+						continue
+					}
+					data = buf.Bytes()
+				}
+				if !bytes.Equal(data, want[i]) {
+					errs <- fmt.Errorf("render %d of %q at %gpt differs from the tile drawn alone", n, jobs[i].text, jobs[i].style.FontSize)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// TestNewCanvasContextFromFont checks a font that cannot be parsed is an error
+// rather than a crash, and that a context made without one still draws
+func TestNewCanvasContextFromFont(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("not a font"), goregular.TTF[:100]} {
+		if c, err := NewCanvasContextFromFont(data); err == nil || c != nil {
+			t.Errorf("NewCanvasContextFromFont(%d bytes) = %v, %v, want an error", len(data), c, err)
+		}
+	}
+	if err := newTestContext(t).AddFont([]byte("not a font")); err == nil {
+		t.Error("AddFont of a font that cannot be parsed succeeded")
+	}
+	var zero CanvasContext
+	if _, err := zero.CreateImage(64, 64, color.White, color.Black, "zero context"); err != nil {
+		t.Errorf("drawing with a zero context: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package canvas
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NamedColors are the color names ParseColor accepts, with their CSS values
+var NamedColors = map[string]color.NRGBA{
+	"transparent": {},
+	"black":       {A: 0xff},
+	"white":       {R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+	"gray":        {R: 0x80, G: 0x80, B: 0x80, A: 0xff},
+	"grey":        {R: 0x80, G: 0x80, B: 0x80, A: 0xff},
+	"silver":      {R: 0xc0, G: 0xc0, B: 0xc0, A: 0xff},
+	"red":         {R: 0xff, A: 0xff},
+	"green":       {G: 0x80, A: 0xff},
+	"blue":        {B: 0xff, A: 0xff},
+	"yellow":      {R: 0xff, G: 0xff, A: 0xff},
+	"orange":      {R: 0xff, G: 0xa5, A: 0xff},
+}
+
+// ParseColor parses a color written as #rgb, #rgba, #rrggbb or #rrggbbaa, see
+// ParseHexColor, as rgb(r,g,b) or rgba(r,g,b,a) with r, g and b from 0 to 255
+// and a from 0 to 1, or as one of NamedColors. Case and spaces do not matter.
+// Unlike for ParseHexColor the # is required, so that words such as "bad" or
+// "fed" are never taken for colors; in a URL it is written %23.
+func ParseColor(value string) (color.Color, error) {
+	s := strings.ToLower(strings.TrimSpace(value))
+	if named, ok := NamedColors[s]; ok {
+		return named, nil
+	}
+	var parsed color.NRGBA
+	var err error
+	if args, ok := strings.CutPrefix(s, "rgba("); ok {
+		parsed, err = parseRGBA(value, args, 4)
+	} else if args, ok := strings.CutPrefix(s, "rgb("); ok {
+		parsed, err = parseRGBA(value, args, 3)
+	} else if strings.HasPrefix(s, "#") {
+		parsed, err = ParseHexColor(value)
+	} else {
+		err = unknownColor(value)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+// unknownColor is the error of ParseColor for a value of no known syntax
+func unknownColor(value string) error {
+	names := make([]string, 0, len(NamedColors))
+	for name := range NamedColors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("invalid color %q, expected #rrggbb, #rrggbbaa, rgba(r,g,b,a) or one of %s", value, strings.Join(names, ", "))
+}
+
+// MustParseColor is ParseColor for colors known to be valid, such as defaults.
+// It panics when value is not a color.
+func MustParseColor(value string) color.Color {
+	c, err := ParseColor(value)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// parseRGBA parses args, what follows "rgb(" or "rgba(" in value, as n
+// components: three bytes and, when n is 4, an alpha from 0 to 1
+func parseRGBA(value string, args string, n int) (color.NRGBA, error) {
+	args, ok := strings.CutSuffix(args, ")")
+	parts := strings.Split(args, ",")
+	if !ok || len(parts) != n {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q, expected rgb(r,g,b) or rgba(r,g,b,a)", value)
+	}
+	var rgb [3]uint8
+	for i := range rgb {
+		component, err := strconv.Atoi(strings.TrimSpace(parts[i]))
+		if err != nil || component < 0 || component > 0xff {
+			return color.NRGBA{}, fmt.Errorf("invalid color %q, %q is not a component from 0 to 255", value, strings.TrimSpace(parts[i]))
+		}
+		rgb[i] = uint8(component)
+	}
+	c := color.NRGBA{R: rgb[0], G: rgb[1], B: rgb[2], A: 0xff}
+	if n == 4 {
+		alpha, err := strconv.ParseFloat(strings.TrimSpace(parts[3]), 64)
+		if err != nil || alpha < 0 || alpha > 1 || math.IsNaN(alpha) {
+			return color.NRGBA{}, fmt.Errorf("invalid color %q, %q is not an alpha from 0 to 1", value, strings.TrimSpace(parts[3]))
+		}
+		c.A = uint8(math.Round(alpha * 0xff))
+	}
+	return c, nil
+}
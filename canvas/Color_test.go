@@ -0,0 +1,69 @@
+package canvas
+
+import (
+	"image/color"
+	"strings"
+	"testing"
+)
+
+// TestParseColor parses a color of every accepted syntax and checks malformed
+// ones are errors naming the value
+func TestParseColor(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  color.NRGBA
+	}{
+		{"#f80", color.NRGBA{R: 0xff, G: 0x88, A: 0xff}},
+		{"#F808", color.NRGBA{R: 0xff, G: 0x88, A: 0x88}},
+		{"#00ff7f", color.NRGBA{G: 0xff, B: 0x7f, A: 0xff}},
+		{"#00000080", color.NRGBA{A: 0x80}},
+		{"  #AbCdEf ", color.NRGBA{R: 0xab, G: 0xcd, B: 0xef, A: 0xff}},
+		{"rgb(1,2,3)", color.NRGBA{R: 1, G: 2, B: 3, A: 0xff}},
+		{"RGB( 255 , 0 , 10 )", color.NRGBA{R: 0xff, B: 10, A: 0xff}},
+		{"rgba(0,0,0,0.5)", color.NRGBA{A: 0x80}},
+		{"rgba(10,20,30,1)", color.NRGBA{R: 10, G: 20, B: 30, A: 0xff}},
+		{"rgba(10,20,30,0)", color.NRGBA{R: 10, G: 20, B: 30}},
+		{"white", color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}},
+		{"Grey", color.NRGBA{R: 0x80, G: 0x80, B: 0x80, A: 0xff}},
+		{"transparent", color.NRGBA{}},
+	} {
+		if got, err := ParseColor(tc.value); err != nil || got != tc.want {
+			t.Errorf("ParseColor(%q) = %v, %v, want %v", tc.value, got, err, tc.want)
+		}
+	}
+	for name, want := range NamedColors {
+		if got, err := ParseColor(strings.ToUpper(name)); err != nil || got != want {
+			t.Errorf("ParseColor(%q) = %v, %v, want %v", name, got, err, want)
+		}
+	}
+
+	for _, value := range []string{
+		"", "#", "#ff", "#fffff", "#fffffffff", "#ggg", "# fff",
+		// hex without its # is no color, nor are words made of hex digits
+		"ffffff", "00000080", "bad", "fed",
+		"rgb(1,2)", "rgb(1,2,3", "rgb(1,2,256)", "rgb(-1,2,3)", "rgb(1.5,2,3)",
+		"rgba(1,2,3)", "rgba(1,2,3,1.5)", "rgba(1,2,3,NaN)", "rgba(1,2,3,4,5)",
+		"purple", "hsl(0,100%,50%)",
+	} {
+		got, err := ParseColor(value)
+		if err == nil {
+			t.Errorf("ParseColor(%q) = %v, want an error", value, got)
+		} else if !strings.Contains(err.Error(), value) {
+			t.Errorf("ParseColor(%q): error %q does not name the value", value, err)
+		}
+	}
+}
+
+// TestMustParseColor checks MustParseColor returns valid colors and panics on
+// others
+func TestMustParseColor(t *testing.T) {
+	if got := MustParseColor("#00000080"); got != (color.NRGBA{A: 0x80}) {
+		t.Errorf("MustParseColor(#00000080) = %v", got)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("MustParseColor(bad) did not panic")
+		}
+	}()
+	MustParseColor("bad")
+}
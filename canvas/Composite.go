@@ -0,0 +1,157 @@
+package canvas
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"strings"
+)
+
+// ErrLayerSize is returned by Composite for a layer not the size of the base
+var ErrLayerSize = errors.New("layer is not the size of the base")
+
+// BlendMode is how the colors of a layer combine with those below it
+type BlendMode string
+
+const (
+	BlendSourceOver BlendMode = "source-over" // the layer covers what is below as far as it is opaque
+	BlendMultiply   BlendMode = "multiply"    // the colors are multiplied, darkening what is below
+)
+
+// ParseBlendMode parses a blend mode name, an empty name selects source-over
+func ParseBlendMode(name string) (BlendMode, error) {
+	switch mode := BlendMode(strings.ToLower(name)); mode {
+	case "":
+		return BlendSourceOver, nil
+	case BlendSourceOver, BlendMultiply:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown blend mode %q, expected source-over or multiply", name)
+}
+
+// Layer is an image drawn over the base by Composite
+type Layer struct {
+	Image   image.Image
+	Opacity float64   // 0 to 1, scaling the alpha of every pixel of the image
+	Mode    BlendMode // BlendSourceOver when empty
+}
+
+// Composite draws layers over base in order and returns the result, leaving
+// base and the layers untouched. Every layer must be the size of the base.
+// Images of any type are converted to RGBA once, so the blending itself works
+// on premultiplied bytes. Layers with no opacity, or no opaque pixel, are
+// skipped.
+func Composite(base image.Image, layers []Layer) (*image.RGBA, error) {
+	size := base.Bounds().Size()
+	for i, layer := range layers {
+		if layer.Image == nil {
+			return nil, fmt.Errorf("layer %d has no image", i)
+		}
+		if layerSize := layer.Image.Bounds().Size(); layerSize != size {
+			return nil, fmt.Errorf("%w: layer %d is %dx%d, the base %dx%d", ErrLayerSize, i, layerSize.X, layerSize.Y, size.X, size.Y)
+		}
+		if layer.Opacity < 0 || layer.Opacity > 1 || math.IsNaN(layer.Opacity) {
+			return nil, fmt.Errorf("opacity %g of layer %d is not within 0..1", layer.Opacity, i)
+		}
+		if _, err := ParseBlendMode(string(layer.Mode)); err != nil {
+			return nil, fmt.Errorf("layer %d: %w", i, err)
+		}
+	}
+
+	dst := toRGBA(base, true)
+	for _, layer := range layers {
+		opacity := uint32(math.Round(layer.Opacity * 0xff))
+		if opacity == 0 {
+			continue
+		}
+		src := toRGBA(layer.Image, false)
+		if transparent(src) {
+			continue
+		}
+		if layer.Mode == BlendMultiply {
+			blendMultiply(dst, src, opacity)
+		} else {
+			blendOver(dst, src, opacity)
+		}
+	}
+	return dst, nil
+}
+
+// toRGBA returns img as an RGBA image with bounds starting at 0,0, img itself
+// when it already is one and clone is false
+func toRGBA(img image.Image, clone bool) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && !clone && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	return rgba
+}
+
+// transparent reports whether every pixel of img has zero alpha
+func transparent(img *image.RGBA) bool {
+	for y := 0; y < img.Rect.Dy(); y++ {
+		row := img.Pix[y*img.Stride : y*img.Stride+4*img.Rect.Dx()]
+		for i := 3; i < len(row); i += 4 {
+			if row[i] != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// div255 divides x by 255, rounding to the nearest integer
+func div255(x uint32) uint32 {
+	return (x + 0x80 + ((x + 0x80) >> 8)) >> 8
+}
+
+// blendOver draws src over dst at opacity, of 255, in premultiplied alpha:
+// out = src + dst*(1-src alpha). Both images have the same size.
+func blendOver(dst *image.RGBA, src *image.RGBA, opacity uint32) {
+	for y := 0; y < dst.Rect.Dy(); y++ {
+		d := dst.Pix[y*dst.Stride : y*dst.Stride+4*dst.Rect.Dx()]
+		s := src.Pix[y*src.Stride : y*src.Stride+4*src.Rect.Dx()]
+		for i := 0; i < len(d); i += 4 {
+			sa := div255(uint32(s[i+3]) * opacity)
+			if sa == 0 {
+				continue
+			}
+			keep := 0xff - sa
+			for c := 0; c < 4; c++ {
+				sc := sa
+				if c < 3 {
+					sc = div255(uint32(s[i+c]) * opacity)
+				}
+				d[i+c] = uint8(min(sc+div255(uint32(d[i+c])*keep), 0xff))
+			}
+		}
+	}
+}
+
+// blendMultiply draws src over dst at opacity, of 255, multiplying their
+// colors, with the separable blend of the W3C compositing spec in premultiplied
+// alpha: out = src*(1-dst alpha) + dst*(1-src alpha) + src*dst. Where either is
+// transparent the other shows as it is.
+func blendMultiply(dst *image.RGBA, src *image.RGBA, opacity uint32) {
+	for y := 0; y < dst.Rect.Dy(); y++ {
+		d := dst.Pix[y*dst.Stride : y*dst.Stride+4*dst.Rect.Dx()]
+		s := src.Pix[y*src.Stride : y*src.Stride+4*src.Rect.Dx()]
+		for i := 0; i < len(d); i += 4 {
+			sa := div255(uint32(s[i+3]) * opacity)
+			if sa == 0 {
+				continue
+			}
+			da := uint32(d[i+3])
+			for c := 0; c < 3; c++ {
+				sc := div255(uint32(s[i+c]) * opacity)
+				dc := uint32(d[i+c])
+				d[i+c] = uint8(min(div255(sc*(0xff-da)+dc*(0xff-sa)+sc*dc), 0xff))
+			}
+			d[i+3] = uint8(min(sa+div255(da*(0xff-sa)), 0xff))
+		}
+	}
+}
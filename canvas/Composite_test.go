@@ -0,0 +1,204 @@
+package canvas
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/jpeg"
+	"testing"
+)
+
+// compositeBase returns a 64 pixel JPEG decoded to YCbCr: a horizontal
+// gradient from blue to yellow
+func compositeBase(t testing.TB) image.Image {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(4 * x), G: uint8(4 * x), B: uint8(0xff - 4*x), A: 0xff})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := jpeg.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := decoded.(*image.YCbCr); !ok {
+		t.Fatalf("JPEG decoded to %T", decoded)
+	}
+	return decoded
+}
+
+// compositeLayers returns two layers of the base's size: an NRGBA disc fading
+// out towards its edge and a paletted grid of grey lines on transparency
+func compositeLayers() (*image.NRGBA, *image.Paletted) {
+	disc := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			if d := (x-32)*(x-32) + (y-32)*(y-32); d < 24*24 {
+				disc.SetNRGBA(x, y, color.NRGBA{R: 0xe0, G: 0x20, B: 0x40, A: uint8(0xff - d*0xff/(24*24))})
+			}
+		}
+	}
+	grid := image.NewPaletted(image.Rect(0, 0, 64, 64), append(color.Palette{color.Transparent}, palette.WebSafe...))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			if x%16 == 8 || y%16 == 8 {
+				grid.Set(x, y, color.Gray{Y: 0x66})
+			}
+		}
+	}
+	return disc, grid
+}
+
+// TestCompositeGolden composites the layers over a JPEG base in each blend
+// mode and compares the results with golden images
+func TestCompositeGolden(t *testing.T) {
+	base := compositeBase(t)
+	disc, grid := compositeLayers()
+	for name, layers := range map[string][]Layer{
+		"over":     {{Image: disc, Opacity: 0.8}, {Image: grid, Opacity: 1}},
+		"multiply": {{Image: disc, Opacity: 1, Mode: BlendMultiply}, {Image: grid, Opacity: 0.5, Mode: BlendMultiply}},
+	} {
+		img, err := Composite(base, layers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, "composite-"+name, img)
+	}
+}
+
+// TestCompositeReference composites source-over layers of each image type and
+// checks the result against the same layers drawn by image/draw through a
+// uniform mask, to within the rounding of the two layers to 8 bits
+func TestCompositeReference(t *testing.T) {
+	base := compositeBase(t)
+	disc, grid := compositeLayers()
+	for _, opacity := range []float64{1, 0.6, 0.25} {
+		got, err := Composite(base, []Layer{{Image: disc, Opacity: opacity}, {Image: grid, Opacity: opacity}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := image.NewRGBA(base.Bounds())
+		draw.Draw(want, want.Bounds(), base, image.Point{}, draw.Src)
+		mask := image.NewUniform(color.Alpha{A: uint8(opacity*0xff + 0.5)})
+		for _, layer := range []image.Image{disc, grid} {
+			draw.DrawMask(want, want.Bounds(), layer, image.Point{}, mask, image.Point{}, draw.Over)
+		}
+		for i := range want.Pix {
+			if d := absDiff(got.Pix[i], want.Pix[i]); d > 2 {
+				t.Fatalf("opacity %g: pixel %d,%d differs by %d from image/draw", opacity, i/4%64, i/4/64, d)
+			}
+		}
+	}
+}
+
+// TestCompositeKnownPixels blends single colors and checks the exact results
+// of both modes
+func TestCompositeKnownPixels(t *testing.T) {
+	white := color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	for _, test := range []struct {
+		name  string
+		base  color.Color
+		layer color.Color
+		Layer
+		want color.RGBA
+	}{
+		{"opaque over", white, color.RGBA{R: 0xff, A: 0xff}, Layer{Opacity: 1}, color.RGBA{R: 0xff, A: 0xff}},
+		{"half over", white, color.RGBA{R: 0xff, A: 0xff}, Layer{Opacity: 0.5}, color.RGBA{R: 0xff, G: 0x7f, B: 0x7f, A: 0xff}},
+		{"over clear", color.Transparent, color.NRGBA{G: 0xff, A: 0x80}, Layer{Opacity: 1}, color.RGBA{G: 0x80, A: 0x80}},
+		{"multiply grey", white, color.RGBA{R: 0x80, G: 0x80, B: 0x80, A: 0xff}, Layer{Opacity: 1, Mode: BlendMultiply}, color.RGBA{R: 0x80, G: 0x80, B: 0x80, A: 0xff}},
+		{"multiply red blue", color.RGBA{B: 0xff, A: 0xff}, color.RGBA{R: 0xff, A: 0xff}, Layer{Opacity: 1, Mode: BlendMultiply}, color.RGBA{A: 0xff}},
+		{"multiply clear", color.Transparent, color.RGBA{R: 0x40, G: 0x80, B: 0xc0, A: 0xff}, Layer{Opacity: 1, Mode: BlendMultiply}, color.RGBA{R: 0x40, G: 0x80, B: 0xc0, A: 0xff}},
+		{"no opacity", white, color.RGBA{A: 0xff}, Layer{Opacity: 0}, white},
+	} {
+		test.Layer.Image = NewFilledImage(4, 4, test.layer)
+		img, err := Composite(NewFilledImage(4, 4, test.base), []Layer{test.Layer})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := img.RGBAAt(2, 2); got != test.want {
+			t.Errorf("%s: %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// TestCompositeSkipsAndChecks checks transparent layers leave the base as it
+// was, the base is never written to, and layers that cannot be composited are
+// errors
+func TestCompositeSkipsAndChecks(t *testing.T) {
+	base := NewFilledImage(8, 8, color.RGBA{R: 0x10, G: 0x20, B: 0x30, A: 0xff})
+	before := bytes.Clone(base.Pix)
+	img, err := Composite(base, []Layer{
+		{Image: image.NewNRGBA(image.Rect(0, 0, 8, 8)), Opacity: 1},
+		{Image: NewFilledImage(8, 8, color.Black), Opacity: 0.001},
+		{Image: NewFilledImage(8, 8, color.White), Opacity: 1, Mode: BlendMultiply},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(img.Pix, before) || !bytes.Equal(base.Pix, before) {
+		t.Error("layers with nothing to draw changed the image")
+	}
+
+	// a layer offset from 0,0 but of the same size is fine
+	shifted := NewFilledImage(8, 8, color.Black).SubImage(image.Rect(0, 0, 8, 8))
+	if _, err := Composite(base, []Layer{{Image: shifted, Opacity: 1}}); err != nil {
+		t.Error(err)
+	}
+	for name, layer := range map[string]Layer{
+		"smaller": {Image: NewFilledImage(4, 8, color.Black), Opacity: 1},
+		"larger":  {Image: NewFilledImage(8, 9, color.Black), Opacity: 1},
+	} {
+		if _, err := Composite(base, []Layer{layer}); !errors.Is(err, ErrLayerSize) {
+			t.Errorf("%s layer: %v, want ErrLayerSize", name, err)
+		}
+	}
+	for name, layer := range map[string]Layer{
+		"no image":     {Opacity: 1},
+		"opacity 1.5":  {Image: base, Opacity: 1.5},
+		"opacity -0.1": {Image: base, Opacity: -0.1},
+		"mode":         {Image: base, Opacity: 1, Mode: "screen"},
+	} {
+		if _, err := Composite(base, []Layer{layer}); err == nil {
+			t.Errorf("layer with bad %s composited", name)
+		}
+	}
+}
+
+// TestParseBlendMode checks blend mode names, in any case, and unknown ones
+func TestParseBlendMode(t *testing.T) {
+	for name, want := range map[string]BlendMode{"": BlendSourceOver, "source-over": BlendSourceOver, "Multiply": BlendMultiply} {
+		if mode, err := ParseBlendMode(name); err != nil || mode != want {
+			t.Errorf("ParseBlendMode(%q) = %q, %v, want %q", name, mode, err, want)
+		}
+	}
+	if _, err := ParseBlendMode("overlay"); err == nil {
+		t.Error("ParseBlendMode(overlay) succeeded")
+	}
+}
+
+// BenchmarkComposite composites three 256 pixel layers of different image
+// types over a JPEG base
+func BenchmarkComposite(b *testing.B) {
+	base := Resize(compositeBase(b), 256, 256, FilterBilinear)
+	disc, grid := compositeLayers()
+	layers := []Layer{
+		{Image: Resize(disc, 256, 256, FilterBilinear), Opacity: 0.8},
+		{Image: image.NewPaletted(image.Rect(0, 0, 256, 256), grid.Palette), Opacity: 1},
+		{Image: NewFilledImage(256, 256, color.RGBA{R: 0x80, G: 0x80, B: 0x80, A: 0xff}), Opacity: 0.5, Mode: BlendMultiply},
+	}
+	copy(layers[1].Image.(*image.Paletted).Pix, bytes.Repeat(grid.Pix, 16))
+	b.ResetTimer()
+	for range b.N {
+		if _, err := Composite(base, layers); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package canvas
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// Colors of debug tiles. Neighbouring tiles alternate between the two shades.
+var (
+	debugShades    = [2]color.NRGBA{{R: 0xf4, G: 0xf4, B: 0xf4, A: 0xff}, {R: 0xe2, G: 0xe6, B: 0xea, A: 0xff}}
+	debugBorder    = color.NRGBA{R: 0x40, G: 0x40, B: 0x40, A: 0xff}
+	debugCrosshair = color.NRGBA{R: 0xc0, G: 0xc4, B: 0xc8, A: 0xff}
+	debugText      = color.NRGBA{R: 0x20, G: 0x20, B: 0x20, A: 0xff}
+)
+
+// debugTitleSize and debugDetailSize are the font sizes in points of the z/x/y
+// and of the bounds of a 256 pixel debug tile, scaled with the tile size
+const (
+	debugTitleSize  = 24
+	debugDetailSize = 10
+)
+
+// CreateDebugTile draws web mercator tile x/y/z as a size by size image showing
+// its identity, encoded with encoding: a 1px border, crosshairs through its
+// center, z/x/y in large text and its WGS84 bounds below in smaller text. Its
+// background shade alternates with (x+y)%2 so neighbouring tiles stand apart.
+// The drawing only depends on the font of the context, so a tile is the same on
+// every platform.
+func (c *CanvasContext) CreateDebugTile(z int, x int64, y int64, size int, encoding Encoding) (bytes.Buffer, error) {
+	if size <= 0 {
+		return bytes.Buffer{}, fmt.Errorf("invalid debug tile size %d", size)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), &image.Uniform{debugShades[(x+y)&1]}, image.Point{}, draw.Src)
+
+	// crosshairs first, the border and the text go over them
+	middle := size / 2
+	crosshair := &image.Uniform{debugCrosshair}
+	draw.Draw(img, image.Rect(0, middle, size, middle+1), crosshair, image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(middle, 0, middle+1, size), crosshair, image.Point{}, draw.Src)
+	drawBorder(img, 1, debugBorder)
+
+	scale := float64(size) / 256
+	title, releaseTitle := c.face(debugTitleSize * scale)
+	defer releaseTitle()
+	detail, releaseDetail := c.face(debugDetailSize * scale)
+	defer releaseDetail()
+	west, north := tileCorner(z, x, y)
+	east, south := tileCorner(z, x+1, y+1)
+	titleLines := layoutText(title, fmt.Sprintf("%d/%d/%d", z, x, y), size, size)
+	detailLines := layoutText(detail, fmt.Sprintf("lng %.6f .. %.6f\nlat %.6f .. %.6f", west, east, south, north), size, size)
+
+	// the two blocks are centered together, half a title line apart
+	gap := lineHeight(title) / 2
+	titleHeight := lineHeight(title) * fixed.Int26_6(len(titleLines))
+	detailHeight := lineHeight(detail) * fixed.Int26_6(len(detailLines))
+	top := (fixed.I(size) - titleHeight - gap - detailHeight) / 2
+	text := image.NewUniform(debugText)
+	drawLines(&font.Drawer{Dst: img, Src: text, Face: title}, titleLines, size, top)
+	drawLines(&font.Drawer{Dst: img, Src: text, Face: detail}, detailLines, size, top+titleHeight+gap)
+
+	return encoding.Encode(img)
+}
+
+// tileCorner returns the longitude and latitude of the north west corner of web
+// mercator tile x/y/z
+func tileCorner(z int, x int64, y int64) (float64, float64) {
+	n := math.Exp2(float64(z))
+	lng := float64(x)/n*360 - 180
+	lat := math.Atan(math.Sinh(math.Pi*(1-2*float64(y)/n))) * 180 / math.Pi
+	return lng, lat
+}
@@ -0,0 +1,78 @@
+package canvas
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// TestDebugTileGolden draws debug tiles of both shades, at 256 and 512
+// pixels, and compares them with golden images. It also checks their frame,
+// crosshairs and shade pixel by pixel, and that drawing is deterministic.
+func TestDebugTileGolden(t *testing.T) {
+	c := newTestContext(t)
+	for _, tc := range []struct {
+		z    int
+		x, y int64
+		size int
+	}{
+		{0, 0, 0, 256},
+		{12, 3391, 1552, 256},
+		{12, 3392, 1552, 256},
+		{12, 3391, 1552, 512},
+	} {
+		name := fmt.Sprintf("debug-%d-%d-%d-%d", tc.z, tc.x, tc.y, tc.size)
+		buf, err := c.CreateDebugTile(tc.z, tc.x, tc.y, tc.size, Encoding{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := c.CreateDebugTile(tc.z, tc.x, tc.y, tc.size, Encoding{})
+		if err != nil || !bytes.Equal(buf.Bytes(), again.Bytes()) {
+			t.Errorf("%s: drawn twice, the tiles differ", name)
+		}
+		img := decodePNG(t, buf.Bytes())
+		checkGolden(t, name, img)
+
+		middle := tc.size / 2
+		for _, pixel := range []struct {
+			x, y int
+			want color.NRGBA
+			what string
+		}{
+			{0, 0, debugBorder, "top left corner"},
+			{tc.size - 1, middle + 3, debugBorder, "right edge"},
+			{middle + 3, tc.size - 1, debugBorder, "bottom edge"},
+			{middle, 3, debugCrosshair, "vertical crosshair"},
+			{3, middle, debugCrosshair, "horizontal crosshair"},
+			{3, 3, debugShades[(tc.x+tc.y)%2], "background"},
+		} {
+			if got := color.NRGBAModel.Convert(img.At(pixel.x, pixel.y)); got != pixel.want {
+				t.Errorf("%s: %s at %d,%d is %v, want %v", name, pixel.what, pixel.x, pixel.y, got, pixel.want)
+			}
+		}
+	}
+	if _, err := c.CreateDebugTile(1, 0, 0, 0, Encoding{}); err == nil {
+		t.Error("debug tile of 0 pixels drawn")
+	}
+}
+
+// TestTileCorner checks tile corners against reference values
+func TestTileCorner(t *testing.T) {
+	for _, tc := range []struct {
+		z        int
+		x, y     int64
+		lng, lat float64
+	}{
+		{0, 0, 0, -180, 85.0511287798066},
+		{0, 1, 1, 180, -85.0511287798066},
+		{1, 1, 1, 0, 0},
+		{12, 3391, 1552, 118.037109375, 39.9097362345372},
+	} {
+		lng, lat := tileCorner(tc.z, tc.x, tc.y)
+		if math.Abs(lng-tc.lng) > 1e-9 || math.Abs(lat-tc.lat) > 1e-9 {
+			t.Errorf("tileCorner(%d/%d/%d) = %.10f, %.10f, want %.10f, %.10f", tc.z, tc.x, tc.y, lng, lat, tc.lng, tc.lat)
+		}
+	}
+}
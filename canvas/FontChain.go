@@ -0,0 +1,110 @@
+package canvas
+
+import (
+	"image"
+	"log"
+	"unicode"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// replacementRunes stand for a character no font of a chain has a glyph for,
+// the first the chain can draw is used
+var replacementRunes = []rune{'\uFFFD', '?'}
+
+// chainFace is a face drawing every character with the first font of a chain
+// that has a glyph for it, and with a replacement character when none has. Its
+// metrics are those of the first font, so lines keep their spacing whatever
+// they hold. Like the truetype faces it is made of, it is not safe for
+// concurrent use.
+type chainFace struct {
+	fonts []*truetype.Font
+	faces []font.Face // of fonts, at the same size
+}
+
+// newChainFace returns a face of size points drawing with fonts, in order
+func newChainFace(fonts []*truetype.Font, size float64) *chainFace {
+	faces := make([]font.Face, len(fonts))
+	for i, f := range fonts {
+		faces[i] = truetype.NewFace(f, &truetype.Options{Size: size, DPI: 72, Hinting: font.HintingNone})
+	}
+	return &chainFace{fonts: fonts, faces: faces}
+}
+
+// pick returns the face drawing r, together with the rune it draws in its place
+func (c *chainFace) pick(r rune) (font.Face, rune) {
+	if unicode.IsControl(r) {
+		// tabs and stray carriage returns are blanks, not missing glyphs
+		r = ' '
+	}
+	if face, ok := c.find(r); ok {
+		return face, r
+	}
+	for _, replacement := range replacementRunes {
+		if face, ok := c.find(replacement); ok {
+			return face, replacement
+		}
+	}
+	return c.faces[0], '?'
+}
+
+// find returns the face of the first font with a glyph for r
+func (c *chainFace) find(r rune) (font.Face, bool) {
+	for i, f := range c.fonts {
+		// index 0 is the glyph of missing characters
+		if f.Index(r) != 0 {
+			return c.faces[i], true
+		}
+	}
+	return nil, false
+}
+
+// guard recovers from a panic of a font loading the glyph of r, which malformed
+// glyph tables cause, logging it and calling substitute instead
+func guard(r rune, substitute func()) {
+	if err := recover(); err != nil {
+		log.Printf("Warning: the font failed to draw %q, drawn as a replacement character: %v", r, err)
+		substitute()
+	}
+}
+
+func (c *chainFace) Glyph(dot fixed.Point26_6, r rune) (dr image.Rectangle, mask image.Image, maskp image.Point, advance fixed.Int26_6, ok bool) {
+	face, drawn := c.pick(r)
+	defer guard(r, func() { dr, mask, maskp, advance, ok = c.faces[0].Glyph(dot, '?') })
+	return face.Glyph(dot, drawn)
+}
+
+func (c *chainFace) GlyphBounds(r rune) (bounds fixed.Rectangle26_6, advance fixed.Int26_6, ok bool) {
+	face, drawn := c.pick(r)
+	defer guard(r, func() { bounds, advance, ok = c.faces[0].GlyphBounds('?') })
+	return face.GlyphBounds(drawn)
+}
+
+func (c *chainFace) GlyphAdvance(r rune) (advance fixed.Int26_6, ok bool) {
+	face, drawn := c.pick(r)
+	defer guard(r, func() { advance, ok = c.faces[0].GlyphAdvance('?') })
+	return face.GlyphAdvance(drawn)
+}
+
+func (c *chainFace) Kern(r0 rune, r1 rune) fixed.Int26_6 {
+	face0, drawn0 := c.pick(r0)
+	face1, drawn1 := c.pick(r1)
+	if face0 != face1 {
+		// characters of two fonts are not kerned against each other
+		return 0
+	}
+	return face0.Kern(drawn0, drawn1)
+}
+
+func (c *chainFace) Metrics() font.Metrics {
+	return c.faces[0].Metrics()
+}
+
+func (c *chainFace) Close() error {
+	for _, face := range c.faces {
+		_ = face.Close()
+	}
+	return nil
+}
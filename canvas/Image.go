@@ -0,0 +1,160 @@
+package canvas
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"strings"
+)
+
+// Format is an output image encoding
+type Format string
+
+const (
+	FormatPNG  Format = "png"
+	FormatJPEG Format = "jpeg"
+	FormatWebP Format = "webp" // only when built with -tags webp, see WebPSupported
+)
+
+// DefaultWebPQuality is the quality of WebP images encoded without one, the
+// default of the cwebp tool
+const DefaultWebPQuality = 75
+
+// DefaultMatte is the color transparent pixels are flattened onto for formats
+// without alpha, such as JPEG
+var DefaultMatte color.Color = color.White
+
+// ParseFormat parses an image format name, accepting "jpg" as an alias of jpeg.
+// An empty name selects PNG. WebP is refused when it is not built in.
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "", "png":
+		return FormatPNG, nil
+	case "jpg", "jpeg":
+		return FormatJPEG, nil
+	case "webp":
+		if !WebPSupported() {
+			return "", fmt.Errorf("webp encoding is not built into this server, it needs the webp build tag")
+		}
+		return FormatWebP, nil
+	}
+	return "", fmt.Errorf("unsupported image format %q", name)
+}
+
+// ContentType returns the MIME type of the format
+func (f Format) ContentType() string {
+	switch f {
+	case FormatJPEG:
+		return "image/jpeg"
+	case FormatWebP:
+		return "image/webp"
+	default:
+		return "image/png"
+	}
+}
+
+// Encoding is how an image is encoded: its format, the quality of lossy formats
+// and the matte transparent pixels are flattened onto when the format has no
+// alpha. The zero Encoding is PNG.
+type Encoding struct {
+	Format  Format
+	Quality int         // see EncodeImage
+	Matte   color.Color // DefaultMatte when nil
+}
+
+// Encode encodes img as the encoding says
+func (e Encoding) Encode(img image.Image) (bytes.Buffer, error) {
+	if e.Format == FormatJPEG && e.Matte != nil {
+		img = Flatten(img, e.Matte)
+	}
+	return EncodeImage(img, e.Format, e.Quality)
+}
+
+// EncodeImage encodes img in the given format, PNG when it is empty. Quality
+// only applies to lossy formats and falls back to the encoder default when it
+// is not in 1..100. Images encoded as JPEG are flattened onto DefaultMatte
+// first, JPEG has no alpha and would show their transparent parts black.
+func EncodeImage(img image.Image, format Format, quality int) (bytes.Buffer, error) {
+	var buf bytes.Buffer
+	switch format {
+	case FormatPNG, "":
+		if err := png.Encode(&buf, img); err != nil {
+			return bytes.Buffer{}, fmt.Errorf("failed to encode image to PNG: %w", err)
+		}
+	case FormatJPEG:
+		if quality < 1 || quality > 100 {
+			quality = jpeg.DefaultQuality
+		}
+		if err := jpeg.Encode(&buf, Flatten(img, DefaultMatte), &jpeg.Options{Quality: quality}); err != nil {
+			return bytes.Buffer{}, fmt.Errorf("failed to encode image to JPEG: %w", err)
+		}
+	case FormatWebP:
+		if quality < 1 || quality > 100 {
+			quality = DefaultWebPQuality
+		}
+		if err := encodeWebP(&buf, img, quality); err != nil {
+			return bytes.Buffer{}, fmt.Errorf("failed to encode image to WebP: %w", err)
+		}
+	default:
+		return bytes.Buffer{}, fmt.Errorf("unsupported image format %q", format)
+	}
+	return buf, nil
+}
+
+// Flatten returns img drawn over matte, or img itself when it is opaque
+func Flatten(img image.Image, matte color.Color) image.Image {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return img
+	}
+	flat := NewFilledImage(img.Bounds().Dx(), img.Bounds().Dy(), matte)
+	draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+	return flat
+}
+
+// NewFilledImage creates an RGBA image of the given size filled with c
+func NewFilledImage(width int, height int, c color.Color) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{c}, image.Point{}, draw.Src)
+	return img
+}
+
+// DrawImageAt draws src over dst with its top left corner at (x, y).
+// Parts of src falling outside dst are clipped.
+func DrawImageAt(dst draw.Image, src image.Image, x int, y int) {
+	bounds := src.Bounds()
+	target := image.Rect(x, y, x+bounds.Dx(), y+bounds.Dy())
+	draw.Draw(dst, target, src, bounds.Min, draw.Over)
+}
+
+// Downsample halves img with a 2x2 box filter. Each output pixel is the average
+// of four source pixels in premultiplied alpha, so neighbouring tiles reduced
+// from one mosaic of their children meet without seams.
+func Downsample(img image.Image) *image.RGBA {
+	src, ok := img.(*image.RGBA)
+	if !ok {
+		src = image.NewRGBA(img.Bounds())
+		draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+	}
+	bounds := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx()/2, bounds.Dy()/2))
+	for y := 0; y < dst.Rect.Dy(); y++ {
+		for x := 0; x < dst.Rect.Dx(); x++ {
+			var sum [4]int
+			for _, offset := range [4][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+				i := src.PixOffset(bounds.Min.X+2*x+offset[0], bounds.Min.Y+2*y+offset[1])
+				for c := 0; c < 4; c++ {
+					sum[c] += int(src.Pix[i+c])
+				}
+			}
+			j := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[j+c] = uint8((sum[c] + 2) / 4)
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,151 @@
+package canvas
+
+import (
+	"container/list"
+	"image/color"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultImageCacheEntries is how many encoded message tiles a CanvasContext
+// keeps. Message tiles show few distinct texts, so a small cache answers a storm
+// of misses without drawing and encoding a PNG for each.
+const DefaultImageCacheEntries = 256
+
+// ImageCacheStats are the counters of the message tile cache of a CanvasContext
+type ImageCacheStats struct {
+	Entries   int   `json:"entries"`
+	Capacity  int   `json:"capacity"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+}
+
+// imageKey identifies a message tile by everything it is drawn from. Colors are
+// kept as their premultiplied RGBA values, any color.Color can be a key then.
+type imageKey struct {
+	width       int
+	height      int
+	background  [4]uint32
+	text        [4]uint32
+	fontSize    float64
+	border      int
+	borderColor [4]uint32
+	message     string
+}
+
+// imageCacheEntry is a cached PNG with its key
+type imageCacheEntry struct {
+	key  imageKey
+	data []byte
+}
+
+// imageCache is an LRU of encoded message tiles bounded by an entry count
+type imageCache struct {
+	capacity int
+
+	mu      sync.Mutex
+	order   *list.List // front is the most recently used entry
+	entries map[imageKey]*list.Element
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+// newImageCache creates an imageCache of at most capacity entries, disabled when 0
+func newImageCache(capacity int) *imageCache {
+	return &imageCache{capacity: max(capacity, 0), order: list.New(), entries: make(map[imageKey]*list.Element)}
+}
+
+// newImageKey returns the key of a message tile
+func newImageKey(width int, height int, style TileStyle, message string) imageKey {
+	return imageKey{
+		width:       width,
+		height:      height,
+		background:  colorKey(style.Background),
+		text:        colorKey(style.Text),
+		fontSize:    style.FontSize,
+		border:      style.Border,
+		borderColor: colorKey(style.BorderColor),
+		message:     message,
+	}
+}
+
+// colorKey returns the premultiplied RGBA values of c, all zero for nil
+func colorKey(c color.Color) [4]uint32 {
+	if c == nil {
+		return [4]uint32{}
+	}
+	r, g, b, a := c.RGBA()
+	return [4]uint32{r, g, b, a}
+}
+
+// get returns the PNG cached for key
+func (c *imageCache) get(key imageKey) ([]byte, bool) {
+	if c.capacity == 0 {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	c.hits.Add(1)
+	return element.Value.(*imageCacheEntry).data, true
+}
+
+// put caches data as the PNG of key, evicting the least recently used entries
+// beyond the capacity
+func (c *imageCache) put(key imageKey, data []byte) {
+	if c.capacity == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*imageCacheEntry).data = data
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&imageCacheEntry{key: key, data: data})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*imageCacheEntry).key)
+		c.evictions.Add(1)
+	}
+}
+
+// evictIf drops every cached PNG whose message matches and returns how many
+// were dropped
+func (c *imageCache) evictIf(match func(message string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	evicted := 0
+	for key, element := range c.entries {
+		if match(key.message) {
+			c.order.Remove(element)
+			delete(c.entries, key)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// stats returns the counters of the cache
+func (c *imageCache) stats() ImageCacheStats {
+	c.mu.Lock()
+	entries := c.order.Len()
+	c.mu.Unlock()
+	return ImageCacheStats{
+		Entries:   entries,
+		Capacity:  c.capacity,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+}
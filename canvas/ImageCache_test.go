@@ -0,0 +1,35 @@
+package canvas
+
+import (
+	"image/color"
+	"strings"
+	"testing"
+)
+
+// TestEvictCachedImages caches message tiles and checks an eviction drops the
+// ones whose text matches, which are then drawn again, and no other
+func TestEvictCachedImages(t *testing.T) {
+	c := newTestContext(t)
+	style := TileStyle{Background: color.White, Text: color.Black}
+	texts := []string{"Tile not found", "Repository cityA not found", "Repository cityB not found"}
+	for _, text := range texts {
+		if _, err := c.CreateCachedImage(64, 64, style, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if evicted := c.EvictCachedImages(func(text string) bool { return strings.Contains(text, "city") }); evicted != 2 {
+		t.Errorf("evicted %d images, want 2", evicted)
+	}
+	before := c.ImageCacheStats()
+	for _, text := range texts {
+		if _, err := c.CreateCachedImage(64, 64, style, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := c.ImageCacheStats(); stats.Entries != 3 || stats.Hits-before.Hits != 1 || stats.Misses-before.Misses != 2 {
+		t.Errorf("stats %+v after %+v, want the 2 evicted images drawn again", stats, before)
+	}
+	if evicted := c.EvictCachedImages(func(string) bool { return true }); evicted != 3 || c.ImageCacheStats().Entries != 0 {
+		t.Errorf("evicted %d images of 3, %d left", evicted, c.ImageCacheStats().Entries)
+	}
+}
@@ -0,0 +1,129 @@
+package canvas
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"testing"
+
+	"golang.org/x/image/math/fixed"
+)
+
+// alignText has three lines of different widths and no descenders, so its
+// ink ends on the last baseline
+const alignText = "Tile\nnot found\nhere"
+
+// TestCreateImageAlignment draws a block of lines in every alignment and
+// checks where its ink lands: against the padding for left, right, top and
+// bottom, halfway between them for center and middle, and moved by exactly
+// the free space between top and bottom
+func TestCreateImageAlignment(t *testing.T) {
+	const width, height, padding = 240, 200, 12
+	c := newTestContext(t)
+	face, release := c.face(16)
+	ascent, step := face.Metrics().Ascent, lineHeight(face)
+	release()
+	// three lines, a line height apart
+	block := 3 * step
+
+	ink := map[string]image.Rectangle{}
+	for _, align := range []Align{AlignLeft, AlignCenter, AlignRight} {
+		for _, valign := range []VAlign{VAlignTop, VAlignMiddle, VAlignBottom} {
+			buf, err := c.CreateImageWithOpts(width, height, color.White, color.Black, alignText,
+				CreateImageOpts{FontSize: 16, Align: align, VAlign: valign, Padding: padding})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ink[string(align)+" "+string(valign)] = inkBounds(decodePNG(t, buf.Bytes()), color.White)
+		}
+	}
+	for name, box := range ink {
+		if box.Empty() || !box.In(image.Rect(padding, padding, width-padding, height-padding)) {
+			t.Errorf("%s: ink %v outside the padding", name, box)
+		}
+	}
+	for _, valign := range []VAlign{VAlignTop, VAlignMiddle, VAlignBottom} {
+		left, center, right := ink["left "+string(valign)], ink["center "+string(valign)], ink["right "+string(valign)]
+		if left.Min.X > padding+2 {
+			t.Errorf("left %s: ink starts at x %d, want by the padding at %d", valign, left.Min.X, padding)
+		}
+		if right.Max.X < width-padding-2 {
+			t.Errorf("right %s: ink ends at x %d, want by the padding at %d", valign, right.Max.X, width-padding)
+		}
+		if middle := float64(center.Min.X+center.Max.X) / 2; math.Abs(middle-width/2) > 1.5 {
+			t.Errorf("center %s: ink centered at x %g, want %d", valign, middle, width/2)
+		}
+		if left.Dy() != center.Dy() || left.Dy() != right.Dy() || left.Min.Y != right.Min.Y {
+			t.Errorf("%s: ink %v, %v and %v not on the same rows", valign, left, center, right)
+		}
+	}
+	for _, align := range []Align{AlignLeft, AlignCenter, AlignRight} {
+		top, middle, bottom := ink[string(align)+" top"], ink[string(align)+" middle"], ink[string(align)+" bottom"]
+		// the last baseline sits a line height less the ascent above the padding
+		baseline := fixed.I(height-padding) - step + ascent
+		if bottom.Max.Y < baseline.Floor()-1 || bottom.Max.Y > baseline.Ceil() {
+			t.Errorf("%s bottom: ink ends at y %d, want on the baseline at %v", align, bottom.Max.Y, baseline)
+		}
+		free := fixed.I(height-2*padding) - block
+		if moved := bottom.Min.Y - top.Min.Y; abs(moved-free.Round()) > 1 {
+			t.Errorf("%s: bottom ink %d pixels below the top, want the %v left free", align, moved, free)
+		}
+		if halfway := top.Min.Y + bottom.Min.Y; abs(halfway-2*middle.Min.Y) > 1 {
+			t.Errorf("%s: middle ink at y %d, want halfway between %d and %d", align, middle.Min.Y, top.Min.Y, bottom.Min.Y)
+		}
+		if top.Dx() != bottom.Dx() || top.Min.X != middle.Min.X {
+			t.Errorf("%s: ink %v, %v and %v not in the same columns", align, top, middle, bottom)
+		}
+	}
+}
+
+// abs returns the absolute value of x
+func abs(x int) int {
+	return max(x, -x)
+}
+
+// TestCreateImageOpts checks the defaults of the zero options, that line
+// spacing spreads the lines by whole line heights, that DPI scales the font
+// size, and that negative padding lets text reach the edge
+func TestCreateImageOpts(t *testing.T) {
+	c := newTestContext(t)
+	draw := func(opts CreateImageOpts) []byte {
+		t.Helper()
+		buf, err := c.CreateImageWithOpts(200, 160, color.White, color.Black, alignText, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	defaults := CreateImageOpts{FontSize: DefaultFontSize, DPI: 72, Align: AlignCenter, VAlign: VAlignMiddle, Padding: textMargin, LineSpacing: 1}
+	if !bytes.Equal(draw(CreateImageOpts{}), draw(defaults)) {
+		t.Error("zero options draw unlike their defaults spelled out")
+	}
+	if !bytes.Equal(draw(CreateImageOpts{FontSize: 10, DPI: 144}), draw(CreateImageOpts{FontSize: 20})) {
+		t.Error("10pt at 144 DPI drawn unlike 20pt at 72 DPI")
+	}
+
+	face, release := c.face(DefaultFontSize)
+	step := lineHeight(face)
+	release()
+	for _, spacing := range []float64{1.5, 2} {
+		single := inkBounds(decodePNG(t, draw(CreateImageOpts{VAlign: VAlignTop})), color.White)
+		spread := inkBounds(decodePNG(t, draw(CreateImageOpts{VAlign: VAlignTop, LineSpacing: spacing})), color.White)
+		// the two gaps between three lines grow
+		want := 2 * (fixed.Int26_6(float64(step)*spacing) - step)
+		if grown := spread.Dy() - single.Dy(); abs(grown-want.Round()) > 1 {
+			t.Errorf("line spacing %g: ink %d pixels taller, want %v", spacing, grown, want)
+		}
+	}
+
+	for padding, edge := range map[int]int{-1: 0, 30: 30} {
+		ink := inkBounds(decodePNG(t, draw(CreateImageOpts{Align: AlignLeft, VAlign: VAlignTop, Padding: padding})), color.White)
+		if ink.Min.X < edge || ink.Min.X > edge+2 {
+			t.Errorf("padding %d: ink starts at x %d, want %d", padding, ink.Min.X, edge)
+		}
+	}
+	if _, err := c.CreateImageWithOpts(200, 160, nil, nil, "no colors", CreateImageOpts{}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,162 @@
+package canvas
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // register the gif decoder for sampled tiles
+	"math"
+	"sort"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+	_ "golang.org/x/image/webp" // register the webp decoder for sampled tiles
+)
+
+const (
+	DefaultMosaicTiles = 64  // tiles sampled for a mosaic by default
+	DefaultMosaicCell  = 128 // width and height of a mosaic thumbnail by default
+)
+
+// mosaicLabelSize is the size in points of the coordinates below each thumbnail
+const mosaicLabelSize = 9
+
+// ErrNoTiles is returned by BuildMosaic for a zoom without tiles
+var ErrNoTiles = errors.New("no tiles at this zoom")
+
+// errMosaicSampled stops the listing of tiles once the last sample was taken
+var errMosaicSampled = errors.New("mosaic sampled")
+
+var (
+	mosaicBackground = color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	mosaicSeparator  = color.NRGBA{R: 0xb0, G: 0xb0, B: 0xb0, A: 0xff}
+	mosaicLabel      = color.NRGBA{R: 0x40, G: 0x40, B: 0x40, A: 0xff}
+	mosaicBroken     = color.NRGBA{R: 0xe0, G: 0x20, B: 0x20, A: 0xff} // of tiles that cannot be read or decoded
+)
+
+// TileSourceLike is what BuildMosaic reads tiles from, a repository listing
+// the tiles of a zoom and reading them one at a time
+type TileSourceLike interface {
+	ListTiles(z int8, fn func(x int64, y int64) error) error
+	ReadTile(z int8, x int64, y int64) ([]byte, error)
+}
+
+// mosaicTile is a tile sampled for a mosaic
+type mosaicTile struct {
+	x, y int64
+}
+
+// BuildMosaic draws a contact sheet of the tiles of src at zoom z: up to
+// maxTiles of them, taken evenly from the order src lists them in, shrunk to
+// cell pixels and laid out row by row in a near square grid, north to south and
+// west to east, each above its coordinates. Thin lines separate the cells. A
+// tile that cannot be read or decoded is drawn as a red cell, so broken tiles
+// stand out. Tiles are decoded and shrunk one at a time, only the sheet is held
+// whole. A zoom without tiles is ErrNoTiles.
+func (c *CanvasContext) BuildMosaic(src TileSourceLike, z int8, maxTiles int, cell int) (image.Image, error) {
+	if maxTiles <= 0 {
+		return nil, fmt.Errorf("invalid mosaic tile count %d", maxTiles)
+	}
+	if cell <= 0 {
+		return nil, fmt.Errorf("invalid mosaic cell size %d", cell)
+	}
+	tiles, err := sampleTiles(src, z, maxTiles)
+	if err != nil {
+		return nil, err
+	}
+	if len(tiles) == 0 {
+		return nil, fmt.Errorf("%w: %d", ErrNoTiles, z)
+	}
+
+	face, release := c.face(mosaicLabelSize)
+	defer release()
+	label := lineHeight(face).Ceil() + 2
+	cols := int(math.Ceil(math.Sqrt(float64(len(tiles)))))
+	rows := (len(tiles) + cols - 1) / cols
+	// a separator of 1px runs around and between the cells
+	width, height := cols*(cell+1)+1, rows*(cell+label+1)+1
+	sheet := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(sheet, sheet.Bounds(), image.NewUniform(mosaicSeparator), image.Point{}, draw.Src)
+
+	dr := &font.Drawer{Dst: sheet, Src: image.NewUniform(mosaicLabel), Face: face}
+	for i, tile := range tiles {
+		at := image.Pt(i%cols*(cell+1)+1, i/cols*(cell+label+1)+1)
+		draw.Draw(sheet, image.Rectangle{Min: at, Max: at.Add(image.Pt(cell, cell+label))}, image.NewUniform(mosaicBackground), image.Point{}, draw.Src)
+		thumbnail := image.Rectangle{Min: at, Max: at.Add(image.Pt(cell, cell))}
+		if err := drawThumbnail(sheet, thumbnail, src, z, tile); err != nil {
+			draw.Draw(sheet, thumbnail, image.NewUniform(mosaicBroken), image.Point{}, draw.Src)
+		}
+		// the label is clipped to its cell when the cell is narrower than it
+		dr.Dst = sheet.SubImage(image.Rect(at.X, at.Y+cell, at.X+cell, at.Y+cell+label)).(*image.RGBA)
+		text := fmt.Sprintf("%d/%d/%d", z, tile.x, tile.y)
+		dr.Dot = fixed.Point26_6{
+			X: fixed.I(at.X) + (fixed.I(cell)-dr.MeasureString(text))/2,
+			Y: fixed.I(at.Y+cell+1) + face.Metrics().Ascent,
+		}
+		dr.DrawString(text)
+	}
+	return sheet, nil
+}
+
+// sampleTiles lists the tiles of src at zoom z twice, counting them and then
+// taking up to maxTiles evenly spaced among them, sorted north to south and
+// west to east. Only the samples are held, however many tiles the zoom has.
+func sampleTiles(src TileSourceLike, z int8, maxTiles int) ([]mosaicTile, error) {
+	count := 0
+	if err := src.ListTiles(z, func(x int64, y int64) error {
+		count++
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	samples := min(count, maxTiles)
+	tiles := make([]mosaicTile, 0, samples)
+	index := 0
+	err := src.ListTiles(z, func(x int64, y int64) error {
+		// the i-th sample is the tile at i*count/samples, so they spread evenly
+		if len(tiles) < samples && index == len(tiles)*count/samples {
+			tiles = append(tiles, mosaicTile{x: x, y: y})
+		}
+		index++
+		if len(tiles) == samples {
+			return errMosaicSampled
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errMosaicSampled) {
+		return nil, err
+	}
+	sort.Slice(tiles, func(i, j int) bool {
+		if tiles[i].y != tiles[j].y {
+			return tiles[i].y < tiles[j].y
+		}
+		return tiles[i].x < tiles[j].x
+	})
+	return tiles, nil
+}
+
+// drawThumbnail reads and decodes tile, shrinks it to fit r keeping its aspect
+// and draws it centered in r of sheet
+func drawThumbnail(sheet *image.RGBA, r image.Rectangle, src TileSourceLike, z int8, tile mosaicTile) error {
+	data, err := src.ReadTile(z, tile.x, tile.y)
+	if err != nil {
+		return err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	size := img.Bounds().Size()
+	if size.X <= 0 || size.Y <= 0 {
+		return fmt.Errorf("empty tile %d/%d/%d", z, tile.x, tile.y)
+	}
+	scale := min(float64(r.Dx())/float64(size.X), float64(r.Dy())/float64(size.Y))
+	w, h := max(int(float64(size.X)*scale), 1), max(int(float64(size.Y)*scale), 1)
+	thumbnail := Resize(img, w, h, FilterBilinear)
+	at := r.Min.Add(image.Pt((r.Dx()-w)/2, (r.Dy()-h)/2))
+	draw.Draw(sheet, image.Rectangle{Min: at, Max: at.Add(image.Pt(w, h))}, thumbnail, image.Point{}, draw.Over)
+	return nil
+}
@@ -0,0 +1,126 @@
+package canvas
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// DefaultHatchSpacing is the distance in pixels between the diagonal lines of a
+// placeholder tile
+const DefaultHatchSpacing = 12
+
+// placeholderNote is the line below the coordinates of a placeholder tile
+const placeholderNote = "no data"
+
+// PlaceholderStyle is how a placeholder tile, standing for a tile a repository
+// does not have, is drawn: a TileStyle with a hatch of diagonal lines over the
+// background, kept off the text
+type PlaceholderStyle struct {
+	TileStyle
+	Hatch        color.Color // of the diagonal lines, no hatch when nil
+	HatchSpacing int         // in pixels, DefaultHatchSpacing when 0
+}
+
+// PlaceholderStylePresets are the named styles of placeholder tiles. Both are
+// muted grays, telling missing tiles apart from the message tiles of errors.
+var PlaceholderStylePresets = map[string]PlaceholderStyle{
+	"default": {
+		TileStyle: TileStyle{
+			Background: color.NRGBA{R: 0xf4, G: 0xf4, B: 0xf4, A: 0x80},
+			Text:       color.NRGBA{R: 0x80, G: 0x80, B: 0x80, A: 0xff},
+			FontSize:   DefaultFontSize,
+		},
+		Hatch: color.NRGBA{R: 0xc8, G: 0xc8, B: 0xc8, A: 0x80},
+	},
+	"dark": {
+		TileStyle: TileStyle{
+			Background: color.NRGBA{R: 0x20, G: 0x20, B: 0x20, A: 0x80},
+			Text:       color.NRGBA{R: 0x90, G: 0x90, B: 0x90, A: 0xff},
+			FontSize:   DefaultFontSize,
+		},
+		Hatch: color.NRGBA{R: 0x48, G: 0x48, B: 0x48, A: 0x80},
+	},
+}
+
+// PlaceholderStylePreset returns the preset named name, see PlaceholderStylePresets
+func PlaceholderStylePreset(name string) (PlaceholderStyle, error) {
+	style, ok := PlaceholderStylePresets[strings.ToLower(name)]
+	if !ok {
+		names := make([]string, 0, len(PlaceholderStylePresets))
+		for preset := range PlaceholderStylePresets {
+			names = append(names, preset)
+		}
+		sort.Strings(names)
+		return PlaceholderStyle{}, fmt.Errorf("unknown placeholder style %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return style, nil
+}
+
+// CreatePlaceholderTile draws a size by size PNG standing for tile z/x/y, which
+// the repository named repo does not have: the hatch of style over its
+// background, and the repository, the coordinates and "no data" centered on a
+// band of plain background. It shows nothing of where the repository is stored.
+func (c *CanvasContext) CreatePlaceholderTile(repo string, z int, x int64, y int64, size int, style PlaceholderStyle) (bytes.Buffer, error) {
+	if size <= 0 {
+		return bytes.Buffer{}, fmt.Errorf("invalid placeholder tile size %d", size)
+	}
+	if style.Background == nil {
+		style.Background = color.Transparent
+	}
+	if style.Text == nil {
+		style.Text = color.Black
+	}
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	background := image.NewUniform(style.Background)
+	draw.Draw(img, img.Bounds(), background, image.Point{}, draw.Src)
+	if style.Hatch != nil {
+		drawHatch(img, style.Hatch, style.HatchSpacing, (x+y)*int64(size))
+	}
+
+	face, release := c.face(style.FontSize)
+	defer release()
+	lines := layoutText(face, fmt.Sprintf("%s\n%d/%d/%d\n%s", repo, z, x, y, placeholderNote), size, size)
+	step := lineHeight(face)
+	top := (fixed.I(size) - step*fixed.Int26_6(len(lines))) / 2
+	// the hatch is cleared behind the text so it stays legible
+	band := image.Rect(0, (top - step/2).Floor(), size, (top + step*fixed.Int26_6(len(lines)) + step/2).Ceil())
+	draw.Draw(img, band, background, image.Point{}, draw.Src)
+	if style.Border > 0 {
+		borderColor := style.BorderColor
+		if borderColor == nil {
+			borderColor = style.Text
+		}
+		drawBorder(img, style.Border, borderColor)
+	}
+	drawLines(&font.Drawer{Dst: img, Src: image.NewUniform(style.Text), Face: face}, lines, size, top)
+	return EncodeImage(img, FormatPNG, 0)
+}
+
+// drawHatch draws 1px diagonal lines spacing pixels apart over img, running
+// from its bottom left to its top right. offset is the sum of the global pixel
+// coordinates of the top left corner of img, the lines of neighbouring tiles
+// meet then.
+func drawHatch(img draw.Image, c color.Color, spacing int, offset int64) {
+	if spacing <= 0 {
+		spacing = DefaultHatchSpacing
+	}
+	shift := int(offset % int64(spacing))
+	bounds := img.Bounds()
+	mask := image.NewAlpha(bounds)
+	for py := bounds.Min.Y; py < bounds.Max.Y; py++ {
+		for px := bounds.Min.X; px < bounds.Max.X; px++ {
+			if (px+py+shift)%spacing == 0 {
+				mask.SetAlpha(px, py, color.Alpha{A: 0xff})
+			}
+		}
+	}
+	draw.DrawMask(img, bounds, image.NewUniform(c), image.Point{}, mask, bounds.Min, draw.Over)
+}
@@ -0,0 +1,94 @@
+package canvas
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// TestPlaceholderTileGolden draws placeholder tiles in each preset and in a
+// framed style of its own, compares them with golden images, and checks they
+// look nothing like the message tiles of errors in the same preset
+func TestPlaceholderTileGolden(t *testing.T) {
+	c := newTestContext(t)
+	styles := map[string]PlaceholderStyle{
+		"framed": {
+			TileStyle:    TileStyle{Background: color.White, Text: color.NRGBA{B: 0x80, A: 0xff}, FontSize: 14, Border: 2},
+			Hatch:        color.NRGBA{R: 0xa0, G: 0xc0, B: 0xff, A: 0xff},
+			HatchSpacing: 6,
+		},
+	}
+	for name := range PlaceholderStylePresets {
+		styles[name] = PlaceholderStylePresets[name]
+	}
+	for name, style := range styles {
+		buf, err := c.CreatePlaceholderTile("2023/cityA", 12, 3391, 1552, 256, style)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img := decodePNG(t, buf.Bytes())
+		checkGolden(t, "placeholder-"+name, img)
+
+		errorStyle, ok := TileStylePresets[name]
+		if !ok {
+			continue
+		}
+		message, err := c.CreateStyledImage(256, 256, errorStyle, "2023/cityA\n12/3391/1552\nno data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the hatch sets them apart even where the text is the same
+		if changed := diffBounds(img, decodePNG(t, message.Bytes())); changed.Dx() < 200 || changed.Dy() < 200 {
+			t.Errorf("%s: placeholder and error tiles only differ over %v", name, changed)
+		}
+	}
+	if _, err := c.CreatePlaceholderTile("r", 0, 0, 0, 0, PlaceholderStylePresets["default"]); err == nil {
+		t.Error("placeholder tile of 0 pixels drawn")
+	}
+	if _, err := PlaceholderStylePreset("Dark"); err != nil {
+		t.Error(err)
+	}
+	if _, err := PlaceholderStylePreset("neon"); err == nil {
+		t.Error("unknown placeholder style neon found")
+	}
+}
+
+// TestHatchContinuity hatches two neighbouring tiles and checks every pixel
+// is on a line exactly when its global coordinates are, so the lines run on
+// from one tile into the next
+func TestHatchContinuity(t *testing.T) {
+	const size, spacing = 64, 12
+	for _, tile := range []image.Point{{3, 5}, {4, 5}, {3, 6}, {0, 0}} {
+		img := image.NewNRGBA(image.Rect(0, 0, size, size))
+		drawHatch(img, color.Black, spacing, int64(tile.X+tile.Y)*size)
+		for py := 0; py < size; py++ {
+			for px := 0; px < size; px++ {
+				globalX, globalY := tile.X*size+px, tile.Y*size+py
+				if hatched := img.NRGBAAt(px, py).A != 0; hatched != ((globalX+globalY)%spacing == 0) {
+					t.Fatalf("tile %v: pixel %d,%d hatched %v", tile, px, py, hatched)
+				}
+			}
+		}
+	}
+}
+
+// TestPlaceholderTileDeterministic checks a placeholder tile drawn twice is
+// the same, and that neighbouring tiles differ in their text and hatch only
+func TestPlaceholderTileDeterministic(t *testing.T) {
+	c := newTestContext(t)
+	style := PlaceholderStylePresets["default"]
+	draw := func(x int64) []byte {
+		buf, err := c.CreatePlaceholderTile("repo", 3, x, 2, 128, style)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	if !bytes.Equal(draw(1), draw(1)) {
+		t.Error("a placeholder tile drawn twice differs")
+	}
+	if bytes.Equal(draw(1), draw(2)) {
+		t.Error("placeholder tiles 3/1/2 and 3/2/2 are the same")
+	}
+}
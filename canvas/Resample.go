@@ -0,0 +1,113 @@
+package canvas
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"strings"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// Filter is how images are resampled when they are scaled
+type Filter int
+
+const (
+	FilterNearest    Filter = iota // copies the nearest source pixel, sharp and blocky
+	FilterBilinear                 // weighs the source pixels around, smooth
+	FilterCatmullRom               // a cubic kernel, sharper than bilinear and slowest
+)
+
+// filterNames are the names ParseFilter accepts, by filter
+var filterNames = map[Filter]string{FilterNearest: "nearest", FilterBilinear: "bilinear", FilterCatmullRom: "catmullrom"}
+
+// ParseFilter parses a filter name: nearest, bilinear or catmullrom, with or
+// without a dash. An empty name selects bilinear.
+func ParseFilter(name string) (Filter, error) {
+	name = strings.ReplaceAll(strings.ToLower(name), "-", "")
+	if name == "" {
+		return FilterBilinear, nil
+	}
+	for filter, filterName := range filterNames {
+		if name == filterName {
+			return filter, nil
+		}
+	}
+	return FilterBilinear, fmt.Errorf("unknown filter %q, expected nearest, bilinear or catmullrom", name)
+}
+
+// String returns the name of the filter
+func (f Filter) String() string {
+	if name, ok := filterNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("Filter(%d)", int(f))
+}
+
+// interpolator returns the scaler of golang.org/x/image/draw implementing f
+func (f Filter) interpolator() xdraw.Interpolator {
+	switch f {
+	case FilterNearest:
+		return xdraw.NearestNeighbor
+	case FilterCatmullRom:
+		return xdraw.CatmullRom
+	default:
+		return xdraw.BiLinear
+	}
+}
+
+// Resize scales img to w by h pixels with filter. See CropScale.
+func Resize(img image.Image, w int, h int, filter Filter) image.Image {
+	return CropScale(img, img.Bounds(), w, h, filter)
+}
+
+// CropScale scales the part src of img to w by h pixels with filter, as when a
+// quadrant of a tile is enlarged to stand for a tile of the next zoom. Pixels
+// are weighed premultiplied by their alpha, so transparent pixels never bleed
+// their color into the opaque ones next to them. The result is a new RGBA image
+// whose bounds start at 0,0; it is empty when w, h or src is.
+func CropScale(img image.Image, src image.Rectangle, w int, h int, filter Filter) image.Image {
+	dst := image.NewRGBA(image.Rect(0, 0, max(w, 0), max(h, 0)))
+	src = src.Intersect(img.Bounds())
+	if dst.Bounds().Empty() || src.Empty() {
+		return dst
+	}
+	filter.interpolator().Scale(dst, dst.Bounds(), scalable(img), src, xdraw.Src, nil)
+	return dst
+}
+
+// Downsample2x2 builds the parent of four tiles, the top left, top right,
+// bottom left and bottom right children, by halving their mosaic with the box
+// filter of Downsample. Missing children are nil and leave their quarter of
+// the parent transparent. The parent is as large as the widest child, a child
+// smaller than that is drawn at the top left of its quarter.
+func Downsample2x2(a image.Image, b image.Image, c image.Image, d image.Image) image.Image {
+	children := [4]image.Image{a, b, c, d}
+	size := 0
+	for _, child := range children {
+		if child != nil {
+			size = max(size, child.Bounds().Dx())
+		}
+	}
+	mosaic := image.NewRGBA(image.Rect(0, 0, 2*size, 2*size))
+	for i, child := range children {
+		if child == nil {
+			continue
+		}
+		at := image.Pt(i%2*size, i/2*size)
+		draw.Draw(mosaic, image.Rectangle{Min: at, Max: at.Add(child.Bounds().Size())}, child, child.Bounds().Min, draw.Src)
+	}
+	return Downsample(mosaic)
+}
+
+// scalable returns img as a type the scalers of golang.org/x/image/draw read
+// without an interface call per pixel, converting it to RGBA when it is not
+func scalable(img image.Image) image.Image {
+	switch img.(type) {
+	case *image.RGBA, *image.NRGBA, *image.YCbCr, *image.Gray, *image.Uniform:
+		return img
+	}
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return rgba
+}
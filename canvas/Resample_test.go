@@ -0,0 +1,178 @@
+package canvas
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// resampleSource returns a small test card: four colored quarters, a black
+// diagonal, a half transparent band and a fully transparent corner whose
+// hidden color is green, which must never show when it is scaled
+func resampleSource() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	quarters := []color.NRGBA{{R: 0xff, A: 0xff}, {G: 0x80, B: 0xff, A: 0xff}, {R: 0xff, G: 0xd0, A: 0xff}, {R: 0xff, G: 0xff, B: 0xff, A: 0xff}}
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			c := quarters[y/16*2+x/16]
+			switch {
+			case x == y:
+				c = color.NRGBA{A: 0xff}
+			case y >= 12 && y < 14:
+				c.A = 0x80
+			case x >= 24 && y >= 24:
+				c = color.NRGBA{G: 0xff}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// TestResizeGolden enlarges the test card with each filter and compares the
+// results with golden images
+func TestResizeGolden(t *testing.T) {
+	for filter, name := range filterNames {
+		checkGolden(t, "resize-"+name, Resize(resampleSource(), 96, 96, filter))
+	}
+}
+
+// TestResizeKnownPixels checks each filter keeps a plain image plain, keeps
+// the color hidden under transparent pixels from bleeding, and that nearest
+// copies source pixels unchanged
+func TestResizeKnownPixels(t *testing.T) {
+	plain := image.NewUniform(color.NRGBA{R: 0x20, G: 0x40, B: 0x60, A: 0xff})
+	source := resampleSource()
+	for filter := range filterNames {
+		if empty := Resize(image.NewNRGBA(image.Rectangle{}), 8, 8, filter); empty.At(4, 4) != (color.RGBA{}) {
+			t.Errorf("%v: an empty image resized to something", filter)
+		}
+		uniform := Resize(NewFilledImage(16, 16, plain.C), 37, 23, filter).(*image.RGBA)
+		for y := 0; y < 23; y++ {
+			for x := 0; x < 37; x++ {
+				if got := uniform.RGBAAt(x, y); got != (color.RGBA{R: 0x20, G: 0x40, B: 0x60, A: 0xff}) {
+					t.Fatalf("%v: pixel %d,%d of a plain image resized is %v", filter, x, y, got)
+				}
+			}
+		}
+
+		scaled := Resize(source, 80, 80, filter).(*image.RGBA)
+		for y := 0; y < 80; y++ {
+			for x := 0; x < 80; x++ {
+				// away from its edges the bottom right quarter is white and
+				// black, so green above red or blue can only be bled from the
+				// transparent corner
+				if c := scaled.RGBAAt(x, y); x >= 48 && y >= 48 && (c.G > c.R || c.G > c.B) {
+					t.Fatalf("%v: pixel %d,%d is %v, the transparent corner bled", filter, x, y, c)
+				}
+			}
+		}
+	}
+
+	nearest := Resize(source, 64, 64, FilterNearest).(*image.RGBA)
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			want := color.RGBAModel.Convert(source.At(x/2, y/2))
+			if got := nearest.RGBAAt(x, y); got != want {
+				t.Fatalf("nearest pixel %d,%d is %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+// TestCropScale enlarges each quarter of the test card to a whole tile, as
+// overzoom does, and checks the part of the card it came from
+func TestCropScale(t *testing.T) {
+	source := resampleSource()
+	for i, at := range []image.Point{{0, 0}, {16, 0}, {0, 16}} {
+		quarter := CropScale(source, image.Rect(at.X, at.Y, at.X+16, at.Y+16), 64, 64, FilterNearest)
+		for y := 0; y < 64; y++ {
+			for x := 0; x < 64; x++ {
+				want := color.RGBAModel.Convert(source.At(at.X+x/4, at.Y+y/4))
+				if got := quarter.At(x, y); got != want {
+					t.Fatalf("quarter %d: pixel %d,%d is %v, want %v", i, x, y, got, want)
+				}
+			}
+		}
+	}
+	// a part reaching out of the image is clipped to it
+	if clipped := CropScale(source, image.Rect(16, 16, 64, 64), 8, 8, FilterBilinear); clipped.Bounds() != image.Rect(0, 0, 8, 8) {
+		t.Errorf("clipped part scaled to %v", clipped.Bounds())
+	}
+	for _, size := range [][2]int{{0, 8}, {8, -1}} {
+		if empty := CropScale(source, source.Bounds(), size[0], size[1], FilterBilinear); !empty.Bounds().Empty() {
+			t.Errorf("scaled to %v, %v", size, empty.Bounds())
+		}
+	}
+	if empty := CropScale(source, image.Rect(40, 40, 50, 50), 8, 8, FilterBilinear); empty.At(4, 4) != (color.RGBA{}) {
+		t.Error("a part outside the image scaled to something")
+	}
+}
+
+// TestDownsample2x2 builds a parent from plain children and checks each
+// quarter takes the color of its child and a missing child's stays clear
+func TestDownsample2x2(t *testing.T) {
+	colors := []color.RGBA{{R: 0xff, A: 0xff}, {G: 0xff, A: 0xff}, {B: 0xff, A: 0xff}}
+	var children [4]image.Image
+	for i, c := range colors {
+		children[i] = NewFilledImage(16, 16, c)
+	}
+	parent := Downsample2x2(children[0], children[1], children[2], children[3])
+	if parent.Bounds() != image.Rect(0, 0, 16, 16) {
+		t.Fatalf("parent of 16 pixel tiles is %v", parent.Bounds())
+	}
+	for i, want := range append(colors, color.RGBA{}) {
+		at := image.Pt(i%2*8, i/2*8)
+		for y := 0; y < 8; y++ {
+			for x := 0; x < 8; x++ {
+				if got := parent.At(at.X+x, at.Y+y); got != want {
+					t.Fatalf("quarter %d: pixel %d,%d is %v, want %v", i, x, y, got, want)
+				}
+			}
+		}
+	}
+	// a checkerboard averages to grey
+	board := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			if (x+y)%2 == 0 {
+				board.SetRGBA(x, y, color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff})
+			} else {
+				board.SetRGBA(x, y, color.RGBA{A: 0xff})
+			}
+		}
+	}
+	if got := Downsample2x2(board, board, board, board).At(1, 3); got != (color.RGBA{R: 0x80, G: 0x80, B: 0x80, A: 0xff}) {
+		t.Errorf("checkerboard averaged to %v", got)
+	}
+	if empty := Downsample2x2(nil, nil, nil, nil); !empty.Bounds().Empty() {
+		t.Errorf("parent of no children is %v", empty.Bounds())
+	}
+}
+
+// TestParseFilter checks filter names round trip and unknown ones are errors
+func TestParseFilter(t *testing.T) {
+	for filter, name := range filterNames {
+		if parsed, err := ParseFilter(name); err != nil || parsed != filter || filter.String() != name {
+			t.Errorf("ParseFilter(%q) = %v, %v", name, parsed, err)
+		}
+	}
+	for name, want := range map[string]Filter{"": FilterBilinear, "Catmull-Rom": FilterCatmullRom, "NEAREST": FilterNearest} {
+		if parsed, err := ParseFilter(name); err != nil || parsed != want {
+			t.Errorf("ParseFilter(%q) = %v, %v, want %v", name, parsed, err, want)
+		}
+	}
+	if _, err := ParseFilter("lanczos"); err == nil {
+		t.Error("ParseFilter(lanczos) succeeded")
+	}
+}
+
+// BenchmarkResizeBilinear enlarges a 256 pixel tile to 512 pixels, as an @2x
+// tile is made
+func BenchmarkResizeBilinear(b *testing.B) {
+	tile := Resize(resampleSource(), 256, 256, FilterNearest)
+	b.ResetTimer()
+	for range b.N {
+		Resize(tile, 512, 512, FilterBilinear)
+	}
+}
@@ -0,0 +1,145 @@
+package canvas
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// textMargin is the space in pixels kept free between text and the edges of an image
+const textMargin = 8
+
+// pathSeparators end the pieces a word too wide for a line is broken into, so
+// paths and URLs break between their elements
+const pathSeparators = "/\\_-.:?&="
+
+// layoutText wraps text into the lines drawn on an image width by height pixels
+// with face, within textMargin of the edges. Words go on the line as long as
+// they fit, a word wider than a line is broken after its separators, or between
+// any two characters when that is not enough. Lines that do not fit the height
+// are dropped and the last one kept ends in an ellipsis.
+func layoutText(face font.Face, text string, width int, height int) []string {
+	return layoutBlock(face, text, width-2*textMargin, height-2*textMargin, lineHeight(face))
+}
+
+// layoutBlock wraps text into the lines fitting a block width by height pixels
+// with face, the baselines step apart, as layoutText does
+func layoutBlock(face font.Face, text string, width int, height int, step fixed.Int26_6) []string {
+	maxWidth := fixed.I(max(width, 1))
+	lines := wrapText(face, text, maxWidth)
+	// the last line takes a line height, the others a step each
+	maxLines := max(int((fixed.I(height)-lineHeight(face))/max(step, 1))+1, 1)
+	if len(lines) <= maxLines {
+		return lines
+	}
+	lines = lines[:maxLines]
+	ellipsis := "…"
+	if _, ok := face.GlyphAdvance('…'); !ok {
+		ellipsis = "..."
+	}
+	last := lines[maxLines-1]
+	for last != "" && font.MeasureString(face, last+ellipsis) > maxWidth {
+		_, size := utf8.DecodeLastRuneInString(last)
+		last = last[:len(last)-size]
+	}
+	lines[maxLines-1] = strings.TrimRight(last, " ") + ellipsis
+	return lines
+}
+
+// lineHeight returns the distance between the baselines of two lines of face
+func lineHeight(face font.Face) fixed.Int26_6 {
+	metrics := face.Metrics()
+	if metrics.Height > 0 {
+		return metrics.Height
+	}
+	return max(metrics.Ascent+metrics.Descent, fixed.I(1))
+}
+
+// wrapText breaks text into lines no wider than maxWidth, keeping its line breaks
+func wrapText(face font.Face, text string, maxWidth fixed.Int26_6) []string {
+	lines := make([]string, 0)
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			candidate := word
+			if line != "" {
+				candidate = line + " " + word
+			}
+			if font.MeasureString(face, candidate) <= maxWidth {
+				line = candidate
+				continue
+			}
+			if line != "" {
+				lines = append(lines, line)
+			}
+			// the word starts a line of its own, broken when it is wider still
+			pieces := breakWord(face, word, maxWidth)
+			lines = append(lines, pieces[:len(pieces)-1]...)
+			line = pieces[len(pieces)-1]
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// breakWord breaks word into pieces no wider than maxWidth, after the path
+// separators it holds and between characters where that is not enough. A single
+// character wider than maxWidth is a piece of its own.
+func breakWord(face font.Face, word string, maxWidth fixed.Int26_6) []string {
+	segments := make([]string, 0)
+	start := 0
+	for i, r := range word {
+		if strings.ContainsRune(pathSeparators, r) {
+			end := i + utf8.RuneLen(r)
+			segments = appendSegment(segments, face, word[start:end], maxWidth)
+			start = end
+		}
+	}
+	if start < len(word) {
+		segments = appendSegment(segments, face, word[start:], maxWidth)
+	}
+	pieces := make([]string, 0)
+	piece := ""
+	for _, segment := range segments {
+		if piece != "" && font.MeasureString(face, piece+segment) > maxWidth {
+			pieces = append(pieces, piece)
+			piece = ""
+		}
+		piece += segment
+	}
+	return append(pieces, piece)
+}
+
+// appendSegment appends segment to segments, split into its characters when it
+// is wider than maxWidth
+func appendSegment(segments []string, face font.Face, segment string, maxWidth fixed.Int26_6) []string {
+	if font.MeasureString(face, segment) <= maxWidth {
+		return append(segments, segment)
+	}
+	for _, r := range segment {
+		segments = append(segments, string(r))
+	}
+	return segments
+}
+
+// drawLines draws lines with dr, each centered on an image width pixels wide,
+// the top of the first at top
+func drawLines(dr *font.Drawer, lines []string, width int, top fixed.Int26_6) {
+	step := lineHeight(dr.Face)
+	for i, line := range lines {
+		// Calculate horizontal position for centering each line
+		x := (fixed.I(width) - dr.MeasureString(line)) / 2
+		// The `Dot` field represents the baseline of the text, the ascent is the
+		// distance from the baseline to the top of the font
+		y := top + step*fixed.Int26_6(i) + dr.Face.Metrics().Ascent
+		dr.Dot = fixed.Point26_6{X: x, Y: y} // Set the drawing origin
+
+		// This is the most likely place where "index out of range" errors occur,
+		// especially if the text contains characters that the loaded font
+		// (either custom or goregular) does not have glyph data for, or if the font
+		// itself has malformed glyph tables.
+		dr.DrawString(line) // Draw the line
+	}
+}
@@ -0,0 +1,115 @@
+package canvas
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// wrapTexts are short, long and pathological messages laid out by the tests
+// of this file
+var wrapTexts = map[string]string{
+	"short": "Tile not found",
+	"long":  "Error reading tile 12/3391/1552 of repository 2023/cityA: database disk image is malformed, the shard may be damaged",
+	"path":  "open /srv/repositories/2023/imagery-cityA/L/L12-3391-1552.s: no such file or directory",
+	"token": strings.Repeat("W", 300),
+	"lines": "first line\n\nthird line after an empty one",
+	"tall":  strings.Repeat("the same words again and again ", 60),
+}
+
+// TestLayoutText wraps the texts to the width of a tile and checks every line
+// fits within the margins, no character is lost unless the text is cut short
+// with an ellipsis, and long words break after their path separators
+func TestLayoutText(t *testing.T) {
+	c := newTestContext(t)
+	face, release := c.face(DefaultFontSize)
+	defer release()
+	const size = 256
+	maxWidth := fixed.I(size - 2*textMargin)
+	maxLines := int((fixed.I(size-2*textMargin)-lineHeight(face))/lineHeight(face)) + 1
+	for name, text := range wrapTexts {
+		lines := layoutText(face, text, size, size)
+		if len(lines) == 0 || len(lines) > maxLines {
+			t.Errorf("%s: %d lines, want 1 to %d", name, len(lines), maxLines)
+		}
+		for i, line := range lines {
+			if width := font.MeasureString(face, line); width > maxWidth {
+				t.Errorf("%s: line %d %q is %d pixels wide, over %d", name, i, line, width.Ceil(), maxWidth.Ceil())
+			}
+		}
+		joined := strings.Join(lines, "")
+		if name == "tall" {
+			if !strings.HasSuffix(joined, "…") || len(lines) != maxLines {
+				t.Errorf("%s: %d lines ending %q, want %d ending in an ellipsis", name, len(lines), lines[len(lines)-1], maxLines)
+			}
+			continue
+		}
+		if strings.Join(strings.Fields(joined), "") != strings.Join(strings.Fields(text), "") {
+			t.Errorf("%s: lines %q lost characters of %q", name, lines, text)
+		}
+	}
+
+	if lines := layoutText(face, wrapTexts["lines"], size, size); len(lines) != 3 || lines[1] != "" {
+		t.Errorf("line breaks: %q, want the three lines kept", lines)
+	}
+	// the path is broken after its separators, never inside an element
+	lines := layoutText(face, "/srv/repositories/2023/imagery-cityA/L/L12-3391-1552.s", 96, 256)
+	if len(lines) < 2 {
+		t.Fatalf("path in 96 pixels: %q, want it broken", lines)
+	}
+	for _, line := range lines[:len(lines)-1] {
+		if !strings.ContainsAny(line[len(line)-1:], pathSeparators) {
+			t.Errorf("path line %q of %q does not end at a separator", line, lines)
+		}
+	}
+	// a tile too narrow for any character still gets one per line
+	if lines := layoutText(face, "WWW", 2*textMargin+1, size); len(lines) != 3 {
+		t.Errorf("text in 1 pixel: %q, want a character per line", lines)
+	}
+}
+
+// inkBounds returns the bounds of the pixels of img that differ from bg
+func inkBounds(img image.Image, bg color.Color) image.Rectangle {
+	background := color.NRGBAModel.Convert(bg)
+	ink := image.Rectangle{}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if color.NRGBAModel.Convert(img.At(x, y)) != background {
+				ink = ink.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return ink
+}
+
+// TestWrappedImageGolden draws the texts on tiles, compares them with golden
+// images and checks the text stays within the margins and the block of lines
+// is centered down the tile
+func TestWrappedImageGolden(t *testing.T) {
+	c := newTestContext(t)
+	style := TileStyle{Background: color.White, Text: color.Black}
+	for name, text := range wrapTexts {
+		buf, err := c.CreateStyledImage(256, 256, style, text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img := decodePNG(t, buf.Bytes())
+		checkGolden(t, "wrap-"+name, img)
+
+		// the margins keep the line boxes off the edges, the descenders of the
+		// last line may reach into the bottom one
+		ink := inkBounds(img, color.White)
+		if !ink.In(image.Rect(textMargin, textMargin, 256-textMargin, 256)) {
+			t.Errorf("%s: text drawn over %v, outside the margins", name, ink)
+		}
+		// glyphs sit within the line box, a few pixels off its center
+		if center := (ink.Min.Y + ink.Max.Y) / 2; center < 128-8 || center > 128+8 {
+			t.Errorf("%s: text drawn over rows %d..%d, not centered", name, ink.Min.Y, ink.Max.Y)
+		}
+	}
+}
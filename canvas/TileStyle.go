@@ -0,0 +1,95 @@
+package canvas
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultFontSize is the size in points of the text of CreateImage
+const DefaultFontSize = 10
+
+// TileStyle is how a tile showing a message, such as an error, is drawn
+type TileStyle struct {
+	Background  color.Color
+	Text        color.Color
+	FontSize    float64     // in points, DefaultFontSize when 0
+	Border      int         // width in pixels of a frame along the edges of the tile, none when 0
+	BorderColor color.Color // of the frame, Text when nil
+}
+
+// TileStylePresets are the named styles of message tiles. "default" is black
+// text on transparent, which disappears over dark basemaps; "dark" shows light
+// text on a dark framed tile that stands out on any map.
+var TileStylePresets = map[string]TileStyle{
+	"default": {Background: color.Transparent, Text: color.Black, FontSize: DefaultFontSize},
+	"dark": {
+		Background:  color.NRGBA{R: 0x20, G: 0x20, B: 0x20, A: 0xc0},
+		Text:        color.NRGBA{R: 0xf0, G: 0xf0, B: 0xf0, A: 0xff},
+		FontSize:    12,
+		Border:      1,
+		BorderColor: color.NRGBA{R: 0x80, G: 0x80, B: 0x80, A: 0xff},
+	},
+}
+
+// TileStylePreset returns the preset named name, see TileStylePresets
+func TileStylePreset(name string) (TileStyle, error) {
+	style, ok := TileStylePresets[strings.ToLower(name)]
+	if !ok {
+		names := make([]string, 0, len(TileStylePresets))
+		for preset := range TileStylePresets {
+			names = append(names, preset)
+		}
+		sort.Strings(names)
+		return TileStyle{}, fmt.Errorf("unknown tile style %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return style, nil
+}
+
+// ParseHexColor parses a color written as #rgb, #rgba, #rrggbb or #rrggbbaa,
+// the leading # being optional. Colors without alpha are opaque.
+func ParseHexColor(value string) (color.NRGBA, error) {
+	hex := strings.TrimPrefix(strings.TrimSpace(value), "#")
+	if len(hex) == 3 || len(hex) == 4 {
+		// each digit stands for a byte of two equal digits
+		long := make([]byte, 0, 2*len(hex))
+		for i := 0; i < len(hex); i++ {
+			long = append(long, hex[i], hex[i])
+		}
+		hex = string(long)
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	if len(hex) != 8 {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q, expected #rrggbb or #rrggbbaa", value)
+	}
+	n, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q, expected #rrggbb or #rrggbbaa", value)
+	}
+	return color.NRGBA{R: uint8(n >> 24), G: uint8(n >> 16), B: uint8(n >> 8), A: uint8(n)}, nil
+}
+
+// drawBorder draws a frame of the given width in pixels along the edges of img
+func drawBorder(img draw.Image, width int, c color.Color) {
+	bounds := img.Bounds()
+	width = min(width, bounds.Dx()/2, bounds.Dy()/2)
+	if width <= 0 {
+		return
+	}
+	src := &image.Uniform{c}
+	edges := []image.Rectangle{
+		image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Max.X, bounds.Min.Y+width),
+		image.Rect(bounds.Min.X, bounds.Max.Y-width, bounds.Max.X, bounds.Max.Y),
+		image.Rect(bounds.Min.X, bounds.Min.Y+width, bounds.Min.X+width, bounds.Max.Y-width),
+		image.Rect(bounds.Max.X-width, bounds.Min.Y+width, bounds.Max.X, bounds.Max.Y-width),
+	}
+	for _, edge := range edges {
+		draw.Draw(img, edge, src, image.Point{}, draw.Over)
+	}
+}
@@ -0,0 +1,66 @@
+package canvas
+
+import (
+	"image/color"
+	"testing"
+)
+
+// TestTileStyleGolden draws a message tile in each preset and in a style of
+// custom colors with a wide border, and compares them with golden images
+func TestTileStyleGolden(t *testing.T) {
+	c := newTestContext(t)
+	styles := map[string]TileStyle{
+		"custom": {
+			Background:  color.NRGBA{R: 0xff, G: 0xf4, B: 0xe0, A: 0xff},
+			Text:        color.NRGBA{R: 0xb0, G: 0x20, B: 0x20, A: 0xff},
+			FontSize:    16,
+			Border:      4,
+			BorderColor: color.NRGBA{R: 0xb0, G: 0x20, B: 0x20, A: 0x80},
+		},
+	}
+	for name := range TileStylePresets {
+		styles[name] = TileStylePresets[name]
+	}
+	for name, style := range styles {
+		buf, err := c.CreateStyledImage(256, 256, style, "Tile unavailable")
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, "style-"+name, decodePNG(t, buf.Bytes()))
+	}
+}
+
+// TestTileStylePreset checks presets are found whatever the case of their
+// name and that unknown names are an error listing the presets
+func TestTileStylePreset(t *testing.T) {
+	if style, err := TileStylePreset("Dark"); err != nil || style.Border != 1 || style.FontSize != 12 {
+		t.Errorf("TileStylePreset(Dark) = %+v, %v", style, err)
+	}
+	if _, err := TileStylePreset("neon"); err == nil || err.Error() != `unknown tile style "neon", expected one of dark, default` {
+		t.Errorf("TileStylePreset(neon) = %v, want an error listing the presets", err)
+	}
+}
+
+// TestParseHexColor checks the short and long forms with and without alpha,
+// and that malformed colors are refused
+func TestParseHexColor(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  color.NRGBA
+	}{
+		{"#fff", color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}},
+		{"#0008", color.NRGBA{A: 0x88}},
+		{"#1a2B3c", color.NRGBA{R: 0x1a, G: 0x2b, B: 0x3c, A: 0xff}},
+		{"#00000080", color.NRGBA{A: 0x80}},
+		{" #102030 ", color.NRGBA{R: 0x10, G: 0x20, B: 0x30, A: 0xff}},
+	} {
+		if got, err := ParseHexColor(tc.value); err != nil || got != tc.want {
+			t.Errorf("ParseHexColor(%q) = %v, %v, want %v", tc.value, got, err, tc.want)
+		}
+	}
+	for _, value := range []string{"", "#", "#ff", "#fffff", "#1234567", "#123456789", "#ggg", "#12 456", "#-12345"} {
+		if got, err := ParseHexColor(value); err == nil {
+			t.Errorf("ParseHexColor(%q) = %v, want an error", value, got)
+		}
+	}
+}
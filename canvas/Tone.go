@@ -0,0 +1,91 @@
+package canvas
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+// Tone is a rendering of imagery muted for printing, so what is drawn over it
+// stands out
+type Tone string
+
+const (
+	ToneNone  Tone = ""
+	ToneGray  Tone = "gray"
+	ToneSepia Tone = "sepia"
+)
+
+// DefaultSepiaIntensity is the intensity ToneSepia renders with
+const DefaultSepiaIntensity = 1
+
+// ParseTone parses a tone name, gray, grey or sepia; an empty name is ToneNone
+func ParseTone(name string) (Tone, error) {
+	switch tone := Tone(strings.ToLower(name)); tone {
+	case ToneNone, ToneGray, ToneSepia:
+		return tone, nil
+	case "grey":
+		return ToneGray, nil
+	}
+	return ToneNone, fmt.Errorf("unknown style %q, expected gray or sepia", name)
+}
+
+// Apply returns a copy of img rendered in the tone, the copy as it is for ToneNone
+func (t Tone) Apply(img image.Image) *image.NRGBA {
+	switch t {
+	case ToneGray:
+		return Grayscale(img)
+	case ToneSepia:
+		return Sepia(img, DefaultSepiaIntensity)
+	}
+	return toNRGBA(img)
+}
+
+// Grayscale returns a copy of img in shades of gray, each pixel taking the
+// luminance of its color with the Rec. 709 weights of sRGB, so green reads
+// lighter than blue as it does to the eye. Alpha is kept.
+func Grayscale(img image.Image) *image.NRGBA {
+	gray := toNRGBA(img)
+	for y := 0; y < gray.Rect.Dy(); y++ {
+		row := gray.Pix[y*gray.Stride : y*gray.Stride+4*gray.Rect.Dx()]
+		for i := 0; i < len(row); i += 4 {
+			l := luminance(row[i], row[i+1], row[i+2])
+			row[i], row[i+1], row[i+2] = l, l, l
+		}
+	}
+	return gray
+}
+
+// Sepia returns a copy of img toned in sepia, the brown of old photographs, as
+// the sepia filter of CSS does. intensity from 0 to 1 blends the sepia with
+// the colors of img, 1 leaves none of them. Alpha is kept.
+func Sepia(img image.Image, intensity float64) *image.NRGBA {
+	sepia := toNRGBA(img)
+	intensity = math.Max(0, math.Min(intensity, 1))
+	// the matrix of the CSS filter in 1/1024, blended with the identity
+	blend := func(weight float64, identity float64) int32 {
+		return int32(math.Round((identity*(1-intensity) + weight*intensity) * 1024))
+	}
+	m := [3][3]int32{
+		{blend(0.393, 1), blend(0.769, 0), blend(0.189, 0)},
+		{blend(0.349, 0), blend(0.686, 1), blend(0.168, 0)},
+		{blend(0.272, 0), blend(0.534, 0), blend(0.131, 1)},
+	}
+	for y := 0; y < sepia.Rect.Dy(); y++ {
+		row := sepia.Pix[y*sepia.Stride : y*sepia.Stride+4*sepia.Rect.Dx()]
+		for i := 0; i < len(row); i += 4 {
+			r, g, b := int32(row[i]), int32(row[i+1]), int32(row[i+2])
+			for c := 0; c < 3; c++ {
+				row[i+c] = clampByte((m[c][0]*r + m[c][1]*g + m[c][2]*b + 512) >> 10)
+			}
+		}
+	}
+	return sepia
+}
+
+// luminance returns the Rec. 709 luminance of an sRGB color, in 1/65536 so it
+// is computed with integers
+func luminance(r uint8, g uint8, b uint8) uint8 {
+	return uint8((13933*uint32(r) + 46871*uint32(g) + 4732*uint32(b) + 1<<15) >> 16)
+}
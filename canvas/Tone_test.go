@@ -0,0 +1,153 @@
+package canvas
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+// toneImage returns an NRGBA image of one pixel of each color
+func toneImage(colors ...color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, len(colors), 1))
+	for x, c := range colors {
+		img.SetNRGBA(x, 0, c)
+	}
+	return img
+}
+
+// TestGrayscale checks known pixels turn to their Rec. 709 luminance, every
+// color to within rounding of the weights, and alpha is kept
+func TestGrayscale(t *testing.T) {
+	in := []color.NRGBA{
+		{R: 0xff, A: 0xff}, {G: 0xff, A: 0xff}, {B: 0xff, A: 0xff},
+		{R: 0xff, G: 0xff, B: 0xff, A: 0xff}, {A: 0xff}, {R: 0x80, G: 0x40, B: 0x20, A: 0x80},
+	}
+	// green reads lighter than red, red lighter than blue, unlike in an average
+	want := []color.NRGBA{
+		{R: 54, G: 54, B: 54, A: 0xff}, {R: 182, G: 182, B: 182, A: 0xff}, {R: 18, G: 18, B: 18, A: 0xff},
+		{R: 0xff, G: 0xff, B: 0xff, A: 0xff}, {A: 0xff}, {R: 75, G: 75, B: 75, A: 0x80},
+	}
+	gray := Grayscale(toneImage(in...))
+	for x := range in {
+		if got := gray.NRGBAAt(x, 0); got != want[x] {
+			t.Errorf("%v in gray is %v, want %v", in[x], got, want[x])
+		}
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = uint8(i*37), uint8(i*11), uint8(i*5), 0xff
+	}
+	gray = Grayscale(img)
+	for i := 0; i < len(img.Pix); i += 4 {
+		r, g, b := float64(img.Pix[i]), float64(img.Pix[i+1]), float64(img.Pix[i+2])
+		l := 0.2126*r + 0.7152*g + 0.0722*b
+		if got := gray.Pix[i]; math.Abs(float64(got)-l) > 1 || gray.Pix[i+1] != got || gray.Pix[i+2] != got {
+			t.Fatalf("%v in gray is %v, want a luminance of %.1f", img.Pix[i:i+4], gray.Pix[i:i+4], l)
+		}
+	}
+}
+
+// TestSepia checks known pixels at full intensity, that no intensity keeps
+// the colors, and that partial intensities blend to within rounding of the
+// CSS sepia filter
+func TestSepia(t *testing.T) {
+	in := toneImage(
+		color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+		color.NRGBA{R: 0x80, G: 0x80, B: 0x80, A: 0xff},
+		color.NRGBA{A: 0xff},
+		color.NRGBA{R: 0x20, G: 0x60, B: 0xc0, A: 0x40},
+	)
+	for x, want := range []color.NRGBA{
+		{R: 0xff, G: 0xff, B: 239, A: 0xff},
+		{R: 173, G: 154, B: 120, A: 0xff},
+		{A: 0xff},
+	} {
+		if got := Sepia(in, 1).NRGBAAt(x, 0); got != want {
+			t.Errorf("%v in sepia is %v, want %v", in.NRGBAAt(x, 0), got, want)
+		}
+	}
+	for x := 0; x < 4; x++ {
+		if got := Sepia(in, 0).NRGBAAt(x, 0); got != in.NRGBAAt(x, 0) {
+			t.Errorf("%v in sepia of no intensity is %v", in.NRGBAAt(x, 0), got)
+		}
+		if got := Sepia(in, 2).NRGBAAt(x, 0); got != Sepia(in, 1).NRGBAAt(x, 0) {
+			t.Errorf("sepia of intensity 2 is %v, not as of 1", got)
+		}
+	}
+
+	matrix := [3][3]float64{{0.393, 0.769, 0.189}, {0.349, 0.686, 0.168}, {0.272, 0.534, 0.131}}
+	for _, intensity := range []float64{0.25, 0.5, 0.8} {
+		toned := Sepia(in, intensity)
+		for x := 0; x < 4; x++ {
+			c, got := in.NRGBAAt(x, 0), toned.NRGBAAt(x, 0)
+			rgb := [3]float64{float64(c.R), float64(c.G), float64(c.B)}
+			for i, channel := range []uint8{got.R, got.G, got.B} {
+				want := rgb[i] * (1 - intensity)
+				for j := range rgb {
+					want += matrix[i][j] * rgb[j] * intensity
+				}
+				if math.Abs(float64(channel)-math.Min(want, 0xff)) > 1 {
+					t.Errorf("intensity %g: %v in sepia is %v, want channel %d about %.1f", intensity, c, got, i, want)
+				}
+			}
+			if got.A != c.A {
+				t.Errorf("intensity %g: alpha of %v changed to %d", intensity, c, got.A)
+			}
+		}
+	}
+}
+
+// TestParseTone checks tone names, in any case and either spelling of gray,
+// and that Apply renders them
+func TestParseTone(t *testing.T) {
+	for name, want := range map[string]Tone{"": ToneNone, "gray": ToneGray, "Grey": ToneGray, "SEPIA": ToneSepia} {
+		if tone, err := ParseTone(name); err != nil || tone != want {
+			t.Errorf("ParseTone(%q) = %q, %v, want %q", name, tone, err, want)
+		}
+	}
+	if _, err := ParseTone("noir"); err == nil {
+		t.Error("ParseTone(noir) succeeded")
+	}
+	red := toneImage(color.NRGBA{R: 0xff, A: 0xff})
+	for tone, want := range map[Tone]color.NRGBA{
+		ToneNone:  {R: 0xff, A: 0xff},
+		ToneGray:  {R: 54, G: 54, B: 54, A: 0xff},
+		ToneSepia: {R: 100, G: 89, B: 69, A: 0xff},
+	} {
+		if got := tone.Apply(red).NRGBAAt(0, 0); got != want {
+			t.Errorf("red in tone %q is %v, want %v", tone, got, want)
+		}
+	}
+}
+
+// benchmarkTile returns an opaque 256 pixel tile of varied colors
+func benchmarkTile() *image.RGBA {
+	tile := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for i := range tile.Pix {
+		tile.Pix[i] = uint8(i * 7)
+		if i%4 == 3 {
+			tile.Pix[i] = 0xff
+		}
+	}
+	return tile
+}
+
+// BenchmarkGrayscale renders a 256 pixel tile in gray
+func BenchmarkGrayscale(b *testing.B) {
+	tile := benchmarkTile()
+	b.ResetTimer()
+	for range b.N {
+		Grayscale(tile)
+	}
+}
+
+// BenchmarkSepia renders a 256 pixel tile in sepia
+func BenchmarkSepia(b *testing.B) {
+	tile := benchmarkTile()
+	b.ResetTimer()
+	for range b.N {
+		Sepia(tile, DefaultSepiaIntensity)
+	}
+}
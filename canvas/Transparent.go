@@ -0,0 +1,36 @@
+package canvas
+
+import (
+	"image"
+	"image/color"
+)
+
+// MakeTransparent returns a copy of img in which the pixels of the color key,
+// such as the white or magenta scanned maps use for no data, are transparent.
+// With a tolerance, pixels whose channels all differ from key by at most that
+// much fade out too, the closer the more, so the edges of the cleared areas
+// stay smooth. The alpha of key itself is ignored.
+func MakeTransparent(img image.Image, key color.Color, tolerance uint8) *image.NRGBA {
+	transparent := toNRGBA(img)
+	k := color.NRGBAModel.Convert(key).(color.NRGBA)
+	for y := 0; y < transparent.Rect.Dy(); y++ {
+		row := transparent.Pix[y*transparent.Stride : y*transparent.Stride+4*transparent.Rect.Dx()]
+		for i := 0; i < len(row); i += 4 {
+			distance := max(absDiff(row[i], k.R), absDiff(row[i+1], k.G), absDiff(row[i+2], k.B))
+			if distance > int(tolerance) || row[i+3] == 0 {
+				continue
+			}
+			// distance 0 clears the pixel, one beyond the tolerance would keep it
+			row[i+3] = uint8(int(row[i+3]) * distance / (int(tolerance) + 1))
+		}
+	}
+	return transparent
+}
+
+// absDiff returns the absolute difference of a and b
+func absDiff(a uint8, b uint8) int {
+	if a > b {
+		return int(a - b)
+	}
+	return int(b - a)
+}
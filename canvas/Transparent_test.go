@@ -0,0 +1,121 @@
+package canvas
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// TestMakeTransparentExact checks that without a tolerance only pixels of the
+// key color itself are cleared, whatever the alpha of the key
+func TestMakeTransparentExact(t *testing.T) {
+	magenta := color.NRGBA{R: 0xff, B: 0xff, A: 0xff}
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 1))
+	for x, c := range []color.NRGBA{magenta, {R: 0xfe, B: 0xff, A: 0xff}, {R: 0xff, B: 0xff, A: 0x80}, {G: 0xff, A: 0xff}} {
+		img.SetNRGBA(x, 0, c)
+	}
+	for _, key := range []color.Color{magenta, color.NRGBA{R: 0xff, B: 0xff, A: 0x40}} {
+		transparent := MakeTransparent(img, key, 0)
+		for x, want := range []uint8{0, 0xff, 0, 0xff} {
+			if got := transparent.NRGBAAt(x, 0); got.A != want {
+				t.Errorf("key %v: pixel %d is %v, want alpha %d", key, x, got, want)
+			}
+		}
+		if got := transparent.NRGBAAt(1, 0); got != img.NRGBAAt(1, 0) {
+			t.Errorf("key %v: a kept pixel changed to %v", key, got)
+		}
+	}
+	if img.NRGBAAt(0, 0) != magenta {
+		t.Error("the image made transparent was changed")
+	}
+}
+
+// TestMakeTransparentTolerance checks pixels within the tolerance fade out in
+// proportion to their largest channel difference from the key, and pixels
+// beyond it are kept
+func TestMakeTransparentTolerance(t *testing.T) {
+	white := color.White
+	// distance 0 to 9 from white along the blue channel, then in one other
+	// channel only, then a half transparent pixel at distance 3
+	img := image.NewNRGBA(image.Rect(0, 0, 12, 1))
+	for x := 0; x < 10; x++ {
+		img.SetNRGBA(x, 0, color.NRGBA{R: 0xff, G: 0xff, B: uint8(0xff - x), A: 0xff})
+	}
+	img.SetNRGBA(10, 0, color.NRGBA{R: 0xfb, G: 0xff, B: 0xfd, A: 0xff})
+	img.SetNRGBA(11, 0, color.NRGBA{R: 0xfc, G: 0xfc, B: 0xfc, A: 0x80})
+
+	transparent := MakeTransparent(img, white, 8)
+	// alpha 255 * distance / 9
+	for x, want := range []uint8{0, 28, 56, 85, 113, 141, 170, 198, 226, 0xff, 113, 42} {
+		if got := transparent.NRGBAAt(x, 0); got.A != want {
+			t.Errorf("pixel %d: alpha %d, want %d", x, got.A, want)
+		}
+	}
+	// the color of a faded pixel is kept
+	if got := transparent.NRGBAAt(4, 0); got.R != 0xff || got.B != 0xfb {
+		t.Errorf("faded pixel changed color to %v", got)
+	}
+	// the alpha falls with the distance all through the band
+	wide := MakeTransparent(img, white, 40)
+	for x := 1; x < 10; x++ {
+		if wide.NRGBAAt(x, 0).A <= wide.NRGBAAt(x-1, 0).A {
+			t.Errorf("pixel %d no more opaque than pixel %d", x, x-1)
+		}
+	}
+}
+
+// TestMakeTransparentJPEG clears the white background of a JPEG, which is
+// decoded to YCbCr, and checks plain white areas clear entirely with no
+// tolerance while the noise of compression next to the drawing takes one to
+// fade
+func TestMakeTransparentJPEG(t *testing.T) {
+	img := NewFilledImage(64, 64, color.White)
+	for y := 20; y < 36; y++ {
+		for x := 20; x < 36; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: 0x20, G: 0x30, B: 0x80, A: 0xff})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := jpeg.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := decoded.(*image.YCbCr); !ok {
+		t.Fatalf("JPEG decoded to %T", decoded)
+	}
+
+	// count returns how many pixels of the area of img have an alpha below
+	// most
+	count := func(img *image.NRGBA, area image.Rectangle, most uint8) (n int) {
+		for y := area.Min.Y; y < area.Max.Y; y++ {
+			for x := area.Min.X; x < area.Max.X; x++ {
+				if img.NRGBAAt(x, y).A < most {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	// the 16 pixel blocks JPEG compresses apart, the drawing in none of them
+	plain := []image.Rectangle{image.Rect(0, 0, 64, 16), image.Rect(0, 48, 64, 64), image.Rect(48, 16, 64, 48)}
+	exact := MakeTransparent(decoded, color.White, 0)
+	for _, area := range plain {
+		if n := count(exact, area, 1); n != area.Dx()*area.Dy() {
+			t.Errorf("%d of %d white pixels in %v cleared", n, area.Dx()*area.Dy(), area)
+		}
+	}
+	drawing := image.Rect(22, 22, 34, 34)
+	around := image.Rect(16, 16, 40, 40)
+	tolerant := MakeTransparent(decoded, color.White, 24)
+	if n := count(tolerant, drawing, 0xff); n != 0 {
+		t.Errorf("%d pixels of the drawing faded", n)
+	}
+	if exactly, tolerantly := count(exact, around, 0xff), count(tolerant, around, 0xff); tolerantly <= exactly {
+		t.Errorf("a tolerance faded %d pixels around the drawing, no more than the %d without", tolerantly, exactly)
+	}
+}
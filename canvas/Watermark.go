@@ -0,0 +1,162 @@
+package canvas
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sync"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/math/fixed"
+)
+
+// Corners of a tile a watermark is placed in
+const (
+	CornerTopLeft     = "top-left"
+	CornerTopRight    = "top-right"
+	CornerBottomLeft  = "bottom-left"
+	CornerBottomRight = "bottom-right"
+)
+
+// Defaults of WatermarkOptions left at zero
+const (
+	DefaultWatermarkOpacity  = 0.6
+	DefaultWatermarkFontSize = 10
+	DefaultWatermarkMargin   = 4
+)
+
+// watermarkGap is the space in pixels between the logo and the text of a watermark
+const watermarkGap = 3
+
+// watermarkShadow is drawn one pixel below and right of the text, so it reads
+// over light and dark imagery alike
+var watermarkShadow = color.NRGBA{A: 0xc0}
+
+// WatermarkOptions are how ApplyWatermark draws a watermark
+type WatermarkOptions struct {
+	Corner   string         // one of the Corner constants, CornerBottomRight when empty or unknown
+	Opacity  float64        // of the whole watermark in 0..1, DefaultWatermarkOpacity when 0
+	FontSize float64        // in points, DefaultWatermarkFontSize when 0
+	Color    color.Color    // of the text, white when nil
+	Logo     image.Image    // drawn left of the text at its own size, none when nil
+	Margin   int            // pixels kept between the watermark and the edges, DefaultWatermarkMargin when 0
+	Font     *truetype.Font // the text is drawn in, Go Regular when nil
+}
+
+// IsCorner reports whether corner is one of the Corner constants
+func IsCorner(corner string) bool {
+	switch corner {
+	case CornerTopLeft, CornerTopRight, CornerBottomLeft, CornerBottomRight:
+		return true
+	}
+	return false
+}
+
+// ApplyWatermark returns a copy of tile with the logo and text of opts drawn in
+// one of its corners. The watermark is composed first and blended over the tile
+// at the opacity of opts as a whole, so the text shadow and logo never add up
+// to more than that. A watermark larger than the tile is clipped.
+func ApplyWatermark(tile image.Image, text string, opts WatermarkOptions) image.Image {
+	bounds := tile.Bounds()
+	marked := image.NewRGBA(bounds)
+	draw.Draw(marked, bounds, tile, bounds.Min, draw.Src)
+	overlay := drawWatermark(text, opts)
+	if overlay == nil {
+		return marked
+	}
+
+	margin := opts.Margin
+	if margin == 0 {
+		margin = DefaultWatermarkMargin
+	}
+	size := overlay.Bounds().Size()
+	origin := image.Pt(bounds.Max.X-margin-size.X, bounds.Max.Y-margin-size.Y)
+	switch opts.Corner {
+	case CornerTopLeft:
+		origin = image.Pt(bounds.Min.X+margin, bounds.Min.Y+margin)
+	case CornerTopRight:
+		origin.Y = bounds.Min.Y + margin
+	case CornerBottomLeft:
+		origin.X = bounds.Min.X + margin
+	}
+
+	opacity := opts.Opacity
+	if opacity == 0 {
+		opacity = DefaultWatermarkOpacity
+	}
+	mask := image.NewUniform(color.Alpha{A: uint8(math.Round(math.Max(0, math.Min(opacity, 1)) * 0xff))})
+	draw.DrawMask(marked, image.Rectangle{Min: origin, Max: origin.Add(size)}, overlay, image.Point{}, mask, image.Point{}, draw.Over)
+	return marked
+}
+
+// drawWatermark draws the logo and text of a watermark side by side, centered
+// on each other, on a transparent image just large enough. It returns nil when
+// there is nothing to draw.
+func drawWatermark(text string, opts WatermarkOptions) *image.RGBA {
+	if text == "" && opts.Logo == nil {
+		return nil
+	}
+	var logoSize image.Point
+	if opts.Logo != nil {
+		logoSize = opts.Logo.Bounds().Size()
+	}
+	width, height := logoSize.X, logoSize.Y
+	var face font.Face
+	var textHeight int
+	if text != "" {
+		face = watermarkFace(opts.Font, opts.FontSize)
+		if width > 0 {
+			width += watermarkGap
+		}
+		metrics := face.Metrics()
+		textHeight = (metrics.Ascent + metrics.Descent).Ceil()
+		// one more pixel each way for the shadow
+		width += font.MeasureString(face, text).Ceil() + 1
+		height = max(height, textHeight+1)
+	}
+
+	overlay := image.NewRGBA(image.Rect(0, 0, width, height))
+	x := 0
+	if opts.Logo != nil {
+		top := (height - logoSize.Y) / 2
+		draw.Draw(overlay, image.Rect(0, top, logoSize.X, top+logoSize.Y), opts.Logo, opts.Logo.Bounds().Min, draw.Over)
+		x = logoSize.X + watermarkGap
+	}
+	if text != "" {
+		textColor := opts.Color
+		if textColor == nil {
+			textColor = color.White
+		}
+		baseline := fixed.I((height-textHeight-1)/2) + face.Metrics().Ascent
+		dr := &font.Drawer{Dst: overlay, Src: image.NewUniform(watermarkShadow), Face: face}
+		dr.Dot = fixed.Point26_6{X: fixed.I(x + 1), Y: baseline + fixed.I(1)}
+		dr.DrawString(text)
+		dr.Src = image.NewUniform(textColor)
+		dr.Dot = fixed.Point26_6{X: fixed.I(x), Y: baseline}
+		dr.DrawString(text)
+	}
+	return overlay
+}
+
+// goRegular is the font of watermarks whose options name none, and of contexts
+// made without one
+var goRegular = sync.OnceValue(func() *truetype.Font {
+	parsed, _ := truetype.Parse(goregular.TTF)
+	return parsed
+})
+
+// watermarkFace returns a face of f, Go Regular when nil, at size points,
+// DefaultWatermarkFontSize when 0. Faces cache glyphs and are not safe for
+// concurrent use, tiles watermarked at once each get their own.
+func watermarkFace(f *truetype.Font, size float64) font.Face {
+	if f == nil {
+		f = goRegular()
+	}
+	if size <= 0 {
+		size = DefaultWatermarkFontSize
+	}
+	return truetype.NewFace(f, &truetype.Options{Size: size, DPI: 72, Hinting: font.HintingNone})
+}
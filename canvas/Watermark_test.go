@@ -0,0 +1,115 @@
+package canvas
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+// diffBounds returns the bounds of the pixels where a and b differ
+func diffBounds(a image.Image, b image.Image) image.Rectangle {
+	changed := image.Rectangle{}
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if color.NRGBAModel.Convert(a.At(x, y)) != color.NRGBAModel.Convert(b.At(x, y)) {
+				changed = changed.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return changed
+}
+
+// TestWatermarkPlacement watermarks a gray tile with an opaque logo in each
+// corner and checks exactly the logo's square, off the edges by the margin,
+// changed, and that the tile itself was left alone
+func TestWatermarkPlacement(t *testing.T) {
+	gray := color.NRGBA{R: 0x40, G: 0x40, B: 0x40, A: 0xff}
+	red := color.NRGBA{R: 0xff, A: 0xff}
+	tile := NewFilledImage(256, 256, gray)
+	logo := NewFilledImage(16, 16, red)
+	for _, tc := range []struct {
+		corner string
+		margin int
+		want   image.Rectangle
+	}{
+		{CornerTopLeft, 0, image.Rect(4, 4, 20, 20)},
+		{CornerTopRight, 0, image.Rect(236, 4, 252, 20)},
+		{CornerBottomLeft, 10, image.Rect(10, 230, 26, 246)},
+		{CornerBottomRight, 0, image.Rect(236, 236, 252, 252)},
+		{"", 0, image.Rect(236, 236, 252, 252)},
+		{"middle", 1, image.Rect(239, 239, 255, 255)},
+	} {
+		marked := ApplyWatermark(tile, "", WatermarkOptions{Corner: tc.corner, Logo: logo, Opacity: 1, Margin: tc.margin})
+		if changed := diffBounds(tile, marked); changed != tc.want {
+			t.Errorf("corner %q: changed %v, want %v", tc.corner, changed, tc.want)
+		}
+		if got := color.NRGBAModel.Convert(marked.At(tc.want.Min.X, tc.want.Min.Y)); got != red {
+			t.Errorf("corner %q: logo drawn as %v, want %v at full opacity", tc.corner, got, red)
+		}
+	}
+	if got := tile.RGBAAt(4, 4); got != (color.RGBA{R: 0x40, G: 0x40, B: 0x40, A: 0xff}) {
+		t.Errorf("the tile was changed to %v", got)
+	}
+
+	// a watermark larger than the tile is clipped to it
+	small := NewFilledImage(8, 8, gray)
+	if marked := ApplyWatermark(small, "", WatermarkOptions{Logo: logo, Opacity: 1}); marked.Bounds() != small.Bounds() ||
+		color.NRGBAModel.Convert(marked.At(0, 0)) != red {
+		t.Errorf("clipped watermark: bounds %v, corner %v", marked.Bounds(), marked.At(0, 0))
+	}
+	if marked := ApplyWatermark(tile, "", WatermarkOptions{}); diffBounds(tile, marked) != (image.Rectangle{}) {
+		t.Error("a watermark of nothing changed the tile")
+	}
+}
+
+// TestWatermarkOpacity blends an opaque logo at several opacities and checks
+// the pixels against the blend computed by hand
+func TestWatermarkOpacity(t *testing.T) {
+	tile := NewFilledImage(64, 64, color.NRGBA{R: 0x40, G: 0x80, B: 0xc0, A: 0xff})
+	logo := NewFilledImage(8, 8, color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff})
+	for _, tc := range []struct {
+		opacity float64
+		want    color.NRGBA
+	}{
+		{1, color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}},
+		{0.5, color.NRGBA{R: 0xa0, G: 0xc0, B: 0xe0, A: 0xff}},
+		{0, color.NRGBA{R: 0xb3, G: 0xcc, B: 0xe6, A: 0xff}}, // DefaultWatermarkOpacity
+		{0.25, color.NRGBA{R: 0x70, G: 0xa0, B: 0xd0, A: 0xff}},
+		{2, color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}},
+	} {
+		marked := ApplyWatermark(tile, "", WatermarkOptions{Corner: CornerTopLeft, Logo: logo, Opacity: tc.opacity})
+		got := color.NRGBAModel.Convert(marked.At(6, 6)).(color.NRGBA)
+		if absDiff(got.R, tc.want.R) > 1 || absDiff(got.G, tc.want.G) > 1 || absDiff(got.B, tc.want.B) > 1 || got.A != 0xff {
+			t.Errorf("opacity %g: %v, want %v", tc.opacity, got, tc.want)
+		}
+	}
+}
+
+// TestWatermarkGolden draws a logo and text watermark, with its shadow, on a
+// tile of a light and a dark half, and compares it with a golden image
+func TestWatermarkGolden(t *testing.T) {
+	tile := NewFilledImage(256, 256, color.NRGBA{R: 0xe8, G: 0xe4, B: 0xd8, A: 0xff})
+	draw.Draw(tile, image.Rect(128, 0, 256, 256), image.NewUniform(color.NRGBA{R: 0x30, G: 0x40, B: 0x30, A: 0xff}), image.Point{}, draw.Src)
+	logo := image.NewNRGBA(image.Rect(0, 0, 12, 12))
+	for y := 0; y < 12; y++ {
+		for x := 0; x < 12; x++ {
+			if (x-6)*(x-6)+(y-6)*(y-6) < 30 {
+				logo.SetNRGBA(x, y, color.NRGBA{R: 0xe0, G: 0x40, B: 0x20, A: 0xff})
+			}
+		}
+	}
+	for _, corner := range []string{CornerTopLeft, CornerBottomRight} {
+		marked := ApplyWatermark(tile, "© SirServer 2026", WatermarkOptions{Corner: corner, Logo: logo, FontSize: 12})
+		checkGolden(t, "watermark-"+corner, marked)
+		// the watermark stays within the margin of its corner
+		want := image.Rect(4, 4, 128, 32)
+		if corner == CornerBottomRight {
+			want = image.Rect(128, 224, 252, 252)
+		}
+		if changed := diffBounds(tile, marked); changed.Empty() || !changed.In(want) {
+			t.Errorf("%s: changed %v, want a box within %v", corner, changed, want)
+		}
+	}
+}
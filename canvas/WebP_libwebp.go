@@ -0,0 +1,46 @@
+//go:build webp && cgo
+
+package canvas
+
+/*
+#cgo LDFLAGS: -lwebp
+#include <stdlib.h>
+#include <webp/encode.h>
+*/
+import "C"
+
+import (
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+	"unsafe"
+)
+
+// WebPSupported reports whether images can be encoded as WebP, which takes a
+// build with the webp tag linking libwebp
+func WebPSupported() bool {
+	return true
+}
+
+// encodeWebP writes img to w as a lossy WebP of the given quality, with libwebp
+func encodeWebP(w io.Writer, img image.Image, quality int) error {
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return errors.New("cannot encode an empty image")
+	}
+	// libwebp takes RGBA that is not premultiplied
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok {
+		nrgba = image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(nrgba, nrgba.Bounds(), img, bounds.Min, draw.Src)
+	}
+	var output *C.uint8_t
+	size := C.WebPEncodeRGBA((*C.uint8_t)(unsafe.Pointer(&nrgba.Pix[0])), C.int(bounds.Dx()), C.int(bounds.Dy()), C.int(nrgba.Stride), C.float(quality), &output)
+	if size == 0 {
+		return errors.New("libwebp failed to encode the image")
+	}
+	defer C.WebPFree(unsafe.Pointer(output))
+	_, err := w.Write(C.GoBytes(unsafe.Pointer(output), C.int(size)))
+	return err
+}
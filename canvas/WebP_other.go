@@ -0,0 +1,20 @@
+//go:build !webp || !cgo
+
+package canvas
+
+import (
+	"errors"
+	"image"
+	"io"
+)
+
+// WebPSupported reports whether images can be encoded as WebP, which takes a
+// build with the webp tag linking libwebp
+func WebPSupported() bool {
+	return false
+}
+
+// encodeWebP fails, WebP encoding is not built in
+func encodeWebP(w io.Writer, img image.Image, quality int) error {
+	return errors.New("webp encoding is not built in, build with -tags webp")
+}
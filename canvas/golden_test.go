@@ -0,0 +1,71 @@
+package canvas
+
+import (
+	"bytes"
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// update rewrites the golden images of testdata with the images drawn. Run
+// go test ./canvas -update after a change meant to alter them, and look at the
+// images before committing them.
+var update = flag.Bool("update", false, "rewrite the golden images in testdata")
+
+// decodePNG decodes the PNG data
+func decodePNG(t testing.TB, data []byte) image.Image {
+	t.Helper()
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// checkGolden compares img pixel by pixel with the golden image
+// testdata/name.png. The drawn image is kept in the test's temporary
+// directory when they differ, for a look at what changed.
+func checkGolden(t *testing.T, name string, img image.Image) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".png")
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, img); err != nil {
+		t.Fatal(err)
+	}
+	if *update {
+		if err := os.WriteFile(path, encoded.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v, run the tests with -update to create it", err)
+	}
+	golden := decodePNG(t, data)
+	if golden.Bounds() != img.Bounds() {
+		t.Fatalf("%s: drawn %v, golden image %v", name, img.Bounds(), golden.Bounds())
+	}
+	differing, first := 0, image.Point{}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if color.NRGBAModel.Convert(img.At(x, y)) != color.NRGBAModel.Convert(golden.At(x, y)) {
+				if differing == 0 {
+					first = image.Pt(x, y)
+				}
+				differing++
+			}
+		}
+	}
+	if differing > 0 {
+		drawn := filepath.Join(t.TempDir(), name+".png")
+		_ = os.WriteFile(drawn, encoded.Bytes(), 0644)
+		t.Errorf("%s: %d pixels differ from the golden image, the first at %v: drawn %v, golden %v",
+			name, differing, first, img.At(first.X, first.Y), golden.At(first.X, first.Y))
+	}
+}
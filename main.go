@@ -3,18 +3,27 @@ package main
 import (
 	"SirServer/api" // Import the api package
 	"SirServer/canvas"
+	"SirServer/sfile"
 	"SirServer/updater" // Import the updater package
+	"context"
 	"embed"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/fatih/color" // For colored console output
 	"github.com/gorilla/mux" // Web router
 	"github.com/spf13/cobra" // Cobra for CLI
-	"log"                    // For logging errors
-	"net/http"               // Standard HTTP package
-	"os"                     // For exiting
+	imagecolor "image/color"
+	"log"      // For logging errors
+	"net/http" // Standard HTTP package
+	"os"       // For exiting
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 )
 
@@ -33,13 +42,99 @@ var sirServer = api.SirServer{ // Use api.SirServer from the api package
 	Email:   "zhangjianshe@gmail.com",
 }
 
-// canvasContext and REPOSITORY_ROOT are still in main as they are core to this main application's setup
-var canvasContext = canvas.NewCanvasContext(staticFiles)
-
 // Global variables for flags (will be populated by Cobra)
 var (
 	repositoryRoot string
 	port           int
+	adminToken     string
+	maxArchiveSize int64
+	repoDepth      int
+	noFollowLinks  bool
+	otelEndpoint   string
+	debug          bool
+	shedInFlight   int64
+	shedLatency    time.Duration
+	shedFraction   float64
+	handleCache    int
+	tileCacheSize  string
+	tileMissTTL    time.Duration
+	existenceSize  string
+	lockTimeout    time.Duration
+	catalogTTL     time.Duration
+	watchRoot      bool
+	immutableRead  bool
+	allowWrites    bool
+	dedupWrites    bool
+	skipExisting   bool
+	validateSample int
+	statsFormat    string
+	verifySample   float64
+	checksumWrites bool
+	verifyReads    bool
+	quarantine     bool
+	writeAnalysis  bool
+	writeMosaic    bool
+	burnAttrib     bool
+	tileErrStatus  bool
+	noChecksum     bool
+	assumeYes      bool
+	checkOnly      bool
+	updateChannel  string
+	allowDowngrade bool
+	updateCACert   string
+	skipVerify     bool
+	releaseKey     string
+	generateKey    bool
+	signedOutput   string
+	dryRun         bool
+	overwrite      bool
+	importSwapXY   bool
+	importTMS      bool
+	importCompress bool
+	shardFile      int64
+	shardTable     int64
+	importGrid     string
+	exportBBox     string
+	exportMinZoom  int
+	exportMaxZoom  int
+	exportTMS      bool
+	exportWorkers  int
+	analysisJobs   int
+	scanJobs       int
+	upstreamRate   float64
+	s3ScratchDir   string
+	s3ScratchSize  string
+	seedWorkers    int
+	seedRate       float64
+	seedRetries    int
+	seedSkip       bool
+	seedUserAgent  string
+	reencodeSample int
+	applyDelete    bool
+	sqliteCache    int
+	sqliteMmap     string
+	sqliteTemp     string
+	sqliteJournal  string
+	sqliteSync     string
+	quality        int
+	sweepInterval  time.Duration
+	sweepRate      float64
+	scrubInterval  time.Duration
+	scrubSample    float64
+	scrubRate      float64
+	scrubPause     time.Duration
+	tileStyle      string
+	tileBackground string
+	tileColor      string
+	tileFontSize   float64
+	tileBorder     int
+	tileBorderTint string
+	tileText       string
+	extraFonts     []string
+	placeholder    string
+	placeholderBg  string
+	placeholderFg  string
+	hatchColor     string
 )
 
 // Update URLs (passed to updater package)
@@ -78,6 +173,140 @@ var updateCmd = &cobra.Command{
 	Run:   runUpdate, // The function that handles the update process
 }
 
+// signReleaseCmd represents the 'sign-release' subcommand
+var signReleaseCmd = &cobra.Command{
+	Use:   "sign-release <artifact>...",
+	Short: "Sign release artifacts for the updater",
+	Long:  `Prints the update_info.json download entries of release artifacts, with their sha256 checksums and their Ed25519 signatures by the private key in --key. With --generate-key it writes a new private key to that file instead and prints the public key, which goes into updater/release.pub.`,
+	Run:   runSignRelease,
+}
+
+// statsCmd represents the 'stats' subcommand
+var statsCmd = &cobra.Command{
+	Use:   "stats <repository-dir>",
+	Short: "Print tile statistics of a repository",
+	Long:  `Counts the tiles of a repository per zoom level, with a histogram and percentiles of their sizes, and prints the result as JSON, or with --format text the size histograms as a table.`,
+	Args:  cobra.ExactArgs(1),
+	Run:   runStats,
+}
+
+// importCmd represents the 'import' subcommand
+var importCmd = &cobra.Command{
+	Use:   "import <source.mbtiles|tile-dir> <repository-dir>",
+	Short: "Import an MBTiles file or a z/x/y tile directory into a repository",
+	Long:  `Copies the tiles and metadata of an MBTiles file, or the tiles of a z/x/y directory tree, into a repository of .s files, creating it when needed.`,
+	Args:  cobra.ExactArgs(2),
+	Run:   runImport,
+}
+
+// exportCmd represents the 'export' subcommand
+var exportCmd = &cobra.Command{
+	Use:   "export <repository-dir> <dest.mbtiles|tile-dir>",
+	Short: "Export a repository to an MBTiles file or a z/x/y tile directory",
+	Long:  `Writes the tiles of a repository, optionally limited to a bbox and zoom range, to a new MBTiles file or, when the destination does not end in .mbtiles, to a z/x/y directory tree.`,
+	Args:  cobra.ExactArgs(2),
+	Run:   runExport,
+}
+
+// dedupCmd represents the 'dedup' subcommand
+var dedupCmd = &cobra.Command{
+	Use:   "dedup <repository-dir>",
+	Short: "Store identical tiles of a repository only once",
+	Long:  `Rewrites the .s files of a repository so each distinct tile blob is stored once per file, and prints the bytes saved as JSON. The server must not write to the repository meanwhile.`,
+	Args:  cobra.ExactArgs(1),
+	Run:   runDedup,
+}
+
+// overviewsCmd represents the 'overviews' subcommand
+var overviewsCmd = &cobra.Command{
+	Use:   "overviews <repository-dir> <down-to-zoom>",
+	Short: "Build the lower zooms of a repository from its highest zoom",
+	Long:  `Composes every tile below the highest zoom of a repository, down to the given zoom, from its four children reduced to half size, and stores it in the format of the repository.`,
+	Args:  cobra.ExactArgs(2),
+	Run:   runOverviews,
+}
+
+// validateCmd represents the 'validate' subcommand
+var validateCmd = &cobra.Command{
+	Use:   "validate <repository-dir>",
+	Short: "Check the .s files of a repository for corruption",
+	Long:  `Checks that every .s file of a repository is an intact sqlite database whose tables and rows match its name, for example after copying data, and prints the findings as JSON. Exits with status 1 when an error was found.`,
+	Args:  cobra.ExactArgs(1),
+	Run:   runValidate,
+}
+
+// compactCmd represents the 'compact' subcommand
+var compactCmd = &cobra.Command{
+	Use:   "compact <repository-dir>",
+	Short: "Give the free space of the .s files of a repository back to the file system",
+	Long:  `Vacuums every .s file of a repository holding free pages, left behind by deletions or re-imports, and prints the size of every file before and after as JSON. The repository can be served meanwhile.`,
+	Args:  cobra.ExactArgs(1),
+	Run:   runCompact,
+}
+
+// splitCmd represents the 'split' subcommand
+var splitCmd = &cobra.Command{
+	Use:   "split <repository-dir> <new-repository-dir>",
+	Short: "Copy the tiles of a repository inside a bbox into a new repository",
+	Long:  `Copies every tile of a repository intersecting --bbox, optionally limited to a zoom range, into a new repository whose repository.json is bounded by the bbox, and prints the tiles copied per zoom as JSON. Tiles crossing the edge of the bbox are copied whole.`,
+	Args:  cobra.ExactArgs(2),
+	Run:   runSplit,
+}
+
+// verifyCmd represents the 'verify' subcommand
+var verifyCmd = &cobra.Command{
+	Use:   "verify <repository-dir>",
+	Short: "Check the tiles of a repository against their checksums",
+	Long:  `Reads the tiles of a repository, or a random --sample of them, and checks every blob against the checksum recorded when it was written, printing the tiles that do not match as JSON. Tiles written without checksums are counted as unverifiable. Exits with status 1 when a tile does not match.`,
+	Args:  cobra.ExactArgs(1),
+	Run:   runVerify,
+}
+
+// seedCmd represents the 'seed' subcommand
+var seedCmd = &cobra.Command{
+	Use:   "seed <repository-dir> <url-template>",
+	Short: "Download the tiles of a bbox from an XYZ tile service into a repository",
+	Long:  `Downloads every tile within --bbox at the zooms --min-zoom to --max-zoom from an XYZ URL template with {z}, {x} and {y} into a repository, creating it when needed. Tiles already stored are skipped, so an interrupted seed resumes when run again. Requests are rate limited and retried; tiles the service does not have or that keep failing are counted and printed with the totals as JSON.`,
+	Args:  cobra.ExactArgs(2),
+	Run:   runSeed,
+}
+
+// reencodeCmd represents the 'reencode' subcommand
+var reencodeCmd = &cobra.Command{
+	Use:   "reencode <repository-dir> <png|jpeg|webp>",
+	Short: "Re-encode the raster tiles of a repository in another image format",
+	Long:  `Decodes every raster tile of a repository and stores it again in the given format, rewriting the rows in place, and prints the bytes of the tiles before and after per zoom as JSON. Tiles already in the format, vector tiles and, for JPEG, transparent tiles are left alone. With --dry-run a sample of every zoom is re-encoded to estimate the savings. Run compact afterwards to give the space back to the file system.`,
+	Args:  cobra.ExactArgs(2),
+	Run:   runReencode,
+}
+
+// diffCmd represents the 'diff' subcommand
+var diffCmd = &cobra.Command{
+	Use:   "diff <source-dir> <dest-dir>",
+	Short: "List the tiles by which a repository differs from another",
+	Long:  `Compares two repositories .s file by .s file and prints the tiles the destination lacks, holds differently or has on its own as JSON. Files of the same size and modification time are skipped without being opened; the tiles of the others are compared by checksum, write time or content. The output can be saved and given to apply-diff, on this machine or another.`,
+	Args:  cobra.ExactArgs(2),
+	Run:   runDiff,
+}
+
+// applyDiffCmd represents the 'apply-diff' subcommand
+var applyDiffCmd = &cobra.Command{
+	Use:   "apply-diff <source-dir> <dest-dir> <diff.json>",
+	Short: "Copy the tiles listed by a diff from one repository to another",
+	Long:  `Copies the added and modified tiles of a diff made by the diff command from the source repository to the destination, creating it when needed, and with --delete deletes the tiles the source does not have. Prints the tiles copied, deleted and failed as JSON.`,
+	Args:  cobra.ExactArgs(3),
+	Run:   runApplyDiff,
+}
+
+// quarantineCmd represents the 'quarantine' subcommand
+var quarantineCmd = &cobra.Command{
+	Use:   "quarantine <repository-dir> [z/x/y ...]",
+	Short: "List or restore the quarantined tiles of a repository",
+	Long:  `Prints the tiles of a repository quarantined as corrupt by verified reads or the scrubber as JSON. Given tiles as z/x/y, puts them back from the quarantine instead, for tiles quarantined by mistake.`,
+	Args:  cobra.MinimumNArgs(1),
+	Run:   runQuarantine,
+}
+
 // versionCmd represents the 'version' subcommand
 var versionCmd = &cobra.Command{
 	Use:   "version",
@@ -90,13 +319,138 @@ var versionCmd = &cobra.Command{
 
 func init() {
 	// Local flags for the 'serve' command
-	serveCmd.Flags().StringVarP(&repositoryRoot, "repo-root", "r", DefaultRepositoryRoot, "Root directory for image repositories")
+	serveCmd.Flags().StringVarP(&repositoryRoot, "repo-root", "r", DefaultRepositoryRoot, "Root directory for image repositories, or s3://bucket/prefix for repositories in S3-compatible storage")
 	serveCmd.Flags().IntVarP(&port, "port", "p", 8080, "Port to listen on")
+	serveCmd.Flags().StringVar(&adminToken, "admin-token", "", "Token required by admin endpoints (disabled when empty)")
+	serveCmd.Flags().IntVar(&repoDepth, "repo-depth", 1, "How many directory levels below the repository root are searched for repositories")
+	serveCmd.Flags().BoolVar(&noFollowLinks, "no-follow-symlinks", false, "Ignore symlinked directories in the repository root; by default they are served, links out of the root with a warning")
+	serveCmd.Flags().StringVar(&otelEndpoint, "otel-endpoint", "", "OTLP/gRPC endpoint receiving OpenTelemetry traces, e.g. localhost:4317 (tracing is disabled when empty)")
+	serveCmd.Flags().BoolVar(&debug, "debug", false, "Serve the /debug diagnostics endpoint")
+	serveCmd.Flags().Int64Var(&shedInFlight, "shed-max-inflight", 0, "In flight tile requests above which load shedding may start (0 disables shedding)")
+	serveCmd.Flags().DurationVar(&shedLatency, "shed-latency", 500*time.Millisecond, "p95 tile latency above which load shedding may start")
+	serveCmd.Flags().Float64Var(&shedFraction, "shed-fraction", 0.5, "Share of new tile requests rejected with 503 while overloaded")
+	serveCmd.Flags().IntVar(&handleCache, "handle-cache-size", sfile.DefaultHandleCacheSize, "How many .s sqlite files are kept open between requests (0 disables the cache)")
+	serveCmd.Flags().IntVar(&analysisJobs, "analysis-workers", sfile.DefaultAnalysisWorkers, "How many unanalysed repositories are scanned concurrently in the background")
+	serveCmd.Flags().BoolVar(&writeAnalysis, "write-analysis", false, "Write the analysis of repositories without a repository.json to their directory; otherwise it is kept in memory until a rescan")
+	serveCmd.Flags().BoolVar(&writeMosaic, "write-mosaic", false, "Also write mosaic.png, a contact sheet of sampled tiles, whenever the analysis of a repository is written")
+	serveCmd.Flags().IntVar(&scanJobs, "scan-workers", sfile.ScanWorkers(), "How many .s files of one repository are read concurrently during analysis")
+	serveCmd.Flags().StringVar(&s3ScratchDir, "s3-scratch-dir", os.TempDir(), "Directory for local copies of .s files when --repo-root is s3://bucket/prefix; its sirserver-s3 subdirectory is emptied on start")
+	serveCmd.Flags().StringVar(&s3ScratchSize, "s3-scratch-size", "4GB", "Disk budget of the local copies of .s files of an s3:// repository root")
+	serveCmd.Flags().Float64Var(&upstreamRate, "upstream-rate", sfile.DefaultUpstreamRate, "Requests per second all upstream repositories make together, 0 for no limit")
+	serveCmd.Flags().StringVar(&tileCacheSize, "tile-cache-size", "256MB", "Memory budget of the tile cache, e.g. 64MB or 1GB (0 disables the cache)")
+	serveCmd.Flags().DurationVar(&catalogTTL, "catalog-ttl", sfile.DefaultCatalogTTL, "How long the repository list is served before the root is scanned again; changes made through the API rescan it sooner")
+	serveCmd.Flags().BoolVar(&watchRoot, "watch", false, "Watch the repository root so repositories copied in or removed show up at once")
+	serveCmd.Flags().BoolVar(&immutableRead, "assume-immutable", false, "Open .s files immutable, skipping sqlite locking; only safe when nothing writes to the repositories while serving")
+	serveCmd.Flags().StringVar(&existenceSize, "existence-index-size", "64MB", "Memory budget of the index of present tiles answering misses without opening any file (0 disables it)")
+	serveCmd.Flags().DurationVar(&tileMissTTL, "tile-cache-miss-ttl", 0, "How long missing tiles are remembered by the tile cache (0 disables negative caching)")
+	serveCmd.Flags().DurationVar(&lockTimeout, "lock-timeout", sfile.DefaultRepositoryLockTimeout, "How long writes wait for a repository another process, such as an import, is writing to")
+	serveCmd.Flags().IntVar(&sqliteCache, "sqlite-cache-size", 0, "sqlite page cache of every .s file connection, in pages, or in KiB when negative (0 keeps the sqlite default)")
+	serveCmd.Flags().StringVar(&sqliteMmap, "sqlite-mmap-size", "0", "Bytes of every .s file sqlite memory maps, e.g. 256MB, which can speed up reads from spinning disks (0 disables mapping)")
+	serveCmd.Flags().StringVar(&sqliteTemp, "sqlite-temp-store", "", "Where sqlite keeps temporary tables and indices: default, file or memory")
+	serveCmd.Flags().StringVar(&sqliteJournal, "sqlite-journal-mode", "", "Journal mode of the .s files written: delete, truncate, persist, memory or wal (default creates files in wal and keeps the mode of existing ones)")
+	serveCmd.Flags().StringVar(&sqliteSync, "sqlite-synchronous", "", "sqlite synchronous setting of writes: off, normal, full or extra (default normal)")
+	serveCmd.Flags().BoolVar(&allowWrites, "allow-writes", false, "Enable the endpoints that modify tiles (they also require the admin token)")
+	serveCmd.Flags().BoolVar(&dedupWrites, "dedup-writes", false, "Store written tiles deduplicated, converting the .s files written to")
+	serveCmd.Flags().BoolVar(&checksumWrites, "checksum-writes", false, "Record a checksum of every tile written")
+	serveCmd.Flags().BoolVar(&verifyReads, "verify-reads", false, "Check every tile read against its checksum, logging and counting mismatches")
+	serveCmd.Flags().BoolVar(&quarantine, "quarantine", false, "Move tiles found corrupt by --verify-reads or the scrubber into the quarantine table of their file, so they are served as missing")
+	serveCmd.Flags().DurationVar(&sweepInterval, "sweep-interval", sfile.DefaultSweepInterval, "How often expired tiles of repositories with ttl_seconds are deleted, and tile versions of temporal repositories pruned (0 disables sweeping)")
+	serveCmd.Flags().Float64Var(&sweepRate, "sweep-rate", sfile.DefaultSweepRate, "Expired tiles deleted per second at most, so sweeping does not slow serving down (0 for no limit)")
+	serveCmd.Flags().DurationVar(&scrubInterval, "scrub-interval", 0, "How often a sample of the tiles of every repository is decoded in the background to find broken tiles, e.g. 24h (0 disables scrubbing)")
+	serveCmd.Flags().Float64Var(&scrubSample, "scrub-sample", sfile.DefaultScrubSample, "Share of the tiles of every .s file decoded by each scrub")
+	serveCmd.Flags().Float64Var(&scrubRate, "scrub-rate", sfile.DefaultScrubRate, "Tiles decoded per second at most while scrubbing (0 for no limit)")
+	serveCmd.Flags().DurationVar(&scrubPause, "scrub-pause-latency", sfile.DefaultScrubPauseLatency, "p95 tile latency above which scrubbing pauses until serving is faster again")
+	serveCmd.Flags().StringVar(&tileStyle, "error-tile-style", "default", "Look of the tiles answering missing or invalid tiles: default (black text on transparent) or dark")
+	serveCmd.Flags().StringVar(&tileBackground, "error-tile-background", "", "Background of error tiles as #rrggbb, #rrggbbaa, rgba(r,g,b,a) or a name, replacing that of --error-tile-style")
+	serveCmd.Flags().StringVar(&tileColor, "error-tile-color", "", "Text color of error tiles as #rrggbb, #rrggbbaa, rgba(r,g,b,a) or a name, replacing that of --error-tile-style")
+	serveCmd.Flags().Float64Var(&tileFontSize, "error-tile-font-size", 0, "Font size of error tiles in points, replacing that of --error-tile-style")
+	serveCmd.Flags().IntVar(&tileBorder, "error-tile-border", 0, "Width in pixels of a frame around error tiles, replacing that of --error-tile-style")
+	serveCmd.Flags().StringVar(&tileBorderTint, "error-tile-border-color", "", "Frame color of error tiles as #rrggbb, #rrggbbaa, rgba(r,g,b,a) or a name, the text color when unset")
+	serveCmd.Flags().StringVar(&placeholder, "placeholder-tile-style", "default", "Look of the hatched tiles answering tiles a repository does not have: default (light) or dark")
+	serveCmd.Flags().StringVar(&placeholderBg, "placeholder-tile-background", "", "Background of placeholder tiles as #rrggbb, #rrggbbaa, rgba(r,g,b,a) or a name, replacing that of --placeholder-tile-style")
+	serveCmd.Flags().StringVar(&placeholderFg, "placeholder-tile-color", "", "Text color of placeholder tiles as #rrggbb, #rrggbbaa, rgba(r,g,b,a) or a name, replacing that of --placeholder-tile-style")
+	serveCmd.Flags().StringVar(&hatchColor, "placeholder-tile-hatch-color", "", "Color of the diagonal lines of placeholder tiles as #rrggbb, #rrggbbaa, rgba(r,g,b,a) or a name, replacing that of --placeholder-tile-style")
+	serveCmd.Flags().BoolVar(&burnAttrib, "burn-attribution", false, "Draw the attribution of every repository onto its raster tiles and static maps; repositories can also ask for it with attribution_overlay in repository.json")
+	serveCmd.Flags().BoolVar(&tileErrStatus, "tile-error-status", false, "Answer error and placeholder tiles with their 4xx/5xx status rather than 200; the reason is sent in the X-SirServer-Error-Code and X-SirServer-Error headers either way")
+	serveCmd.Flags().StringArrayVar(&extraFonts, "extra-font", nil, "TrueType font file drawing the characters of error tiles the bundled font lacks, may be repeated; fonts are tried in the order given, before Go Regular")
+	serveCmd.Flags().StringVar(&tileText, "error-tile-text", "", "Text of error tiles, {error} standing for the error, e.g. \"tile unavailable\"; the error is always sent in the X-Tile-Error header (default the error itself)")
+	serveCmd.Flags().Int64Var(&maxArchiveSize, "max-archive-size", 10<<30, "Maximum size in bytes of an uploaded repository archive (0 for unlimited)")
+
+	importCmd.Flags().BoolVar(&overwrite, "overwrite", false, "Replace tiles already stored in the repository")
+	importCmd.Flags().BoolVar(&importSwapXY, "swap-xy", false, "Tile directories are laid out as {z}/{y}/{x}.ext")
+	importCmd.Flags().BoolVar(&dedupWrites, "dedup", false, "Store identical tiles only once per .s file")
+	importCmd.Flags().BoolVar(&checksumWrites, "checksum", false, "Record a checksum of every tile imported")
+	importCmd.Flags().BoolVar(&importTMS, "tms", false, "Tile directories count rows from the bottom (TMS), as gdal2tiles does by default")
+	importCmd.Flags().Int64Var(&shardFile, "shard-file", 0, "Tiles along each side of a .s file of a new repository (default 256)")
+	importCmd.Flags().Int64Var(&shardTable, "shard-table", 0, "Tiles along each side of a table of a new repository (default 64)")
+	importCmd.Flags().DurationVar(&lockTimeout, "lock-timeout", sfile.DefaultRepositoryLockTimeout, "How long to wait for a repository another process is writing to")
+	importCmd.Flags().BoolVar(&importCompress, "compress", false, "Store vector and JSON tiles gzipped, and keep doing so for the repository")
+	importCmd.Flags().StringVar(&importGrid, "grid", "", "Tile grid of a new repository, mercator or geodetic (default mercator)")
+	exportCmd.Flags().StringVar(&exportBBox, "bbox", "", "Only export tiles within minLng,minLat,maxLng,maxLat")
+	exportCmd.Flags().IntVar(&exportMinZoom, "min-zoom", -1, "Lowest zoom to export (-1 for no limit)")
+	exportCmd.Flags().IntVar(&exportMaxZoom, "max-zoom", -1, "Highest zoom to export (-1 for no limit)")
+	exportCmd.Flags().BoolVar(&exportTMS, "tms", false, "Tile directories count rows from the bottom (TMS)")
+	exportCmd.Flags().BoolVar(&overwrite, "overwrite", false, "Replace tile files already present in the tile directory")
+	exportCmd.Flags().IntVar(&exportWorkers, "workers", 0, "Concurrent file writers of a tile directory export (0 for one per CPU)")
+	overviewsCmd.Flags().IntVar(&exportWorkers, "workers", 0, "Tiles composed concurrently (0 for one per CPU)")
+	overviewsCmd.Flags().BoolVar(&skipExisting, "skip-existing", false, "Keep tiles already stored at the lower zooms instead of rebuilding them")
+	statsCmd.Flags().StringVar(&statsFormat, "format", "json", "Output format, json or text")
+	validateCmd.Flags().IntVar(&validateSample, "sample", 0, "Tiles per file decoded to check they are valid images")
+	compactCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only report the space that compacting would reclaim")
+	compactCmd.Flags().DurationVar(&lockTimeout, "lock-timeout", sfile.DefaultRepositoryLockTimeout, "How long to wait for a repository another process is writing to")
+	splitCmd.Flags().StringVar(&exportBBox, "bbox", "", "Copy the tiles within minLng,minLat,maxLng,maxLat (required)")
+	splitCmd.Flags().IntVar(&exportMinZoom, "min-zoom", -1, "Lowest zoom to copy (-1 for no limit)")
+	splitCmd.Flags().IntVar(&exportMaxZoom, "max-zoom", -1, "Highest zoom to copy (-1 for no limit)")
+	splitCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only count the tiles and bytes that would be copied")
+	_ = splitCmd.MarkFlagRequired("bbox")
+	verifyCmd.Flags().Float64Var(&verifySample, "sample", 1, "Fraction of the tiles checked, picked at random")
+	seedCmd.Flags().StringVar(&exportBBox, "bbox", "", "Download the tiles within minLng,minLat,maxLng,maxLat (required)")
+	seedCmd.Flags().IntVar(&exportMinZoom, "min-zoom", -1, "Lowest zoom to download (-1 for 0)")
+	seedCmd.Flags().IntVar(&exportMaxZoom, "max-zoom", -1, "Highest zoom to download (required)")
+	seedCmd.Flags().IntVar(&seedWorkers, "workers", sfile.DefaultSeedWorkers, "Concurrent downloads")
+	seedCmd.Flags().Float64Var(&seedRate, "rate", sfile.DefaultSeedRate, "Requests per second, 0 for no limit; keep it low for public tile services")
+	seedCmd.Flags().IntVar(&seedRetries, "retries", sfile.DefaultSeedRetries, "Further attempts of a failed download")
+	seedCmd.Flags().BoolVar(&seedSkip, "skip-existing", true, "Keep tiles already stored instead of downloading them again")
+	seedCmd.Flags().StringVar(&seedUserAgent, "user-agent", "", "User-Agent sent to the tile service (default SirServer/<version> tile seeder)")
+	_ = seedCmd.MarkFlagRequired("bbox")
+	_ = seedCmd.MarkFlagRequired("max-zoom")
+	reencodeCmd.Flags().IntVar(&quality, "quality", 85, "JPEG or WebP quality from 1 to 100")
+	reencodeCmd.Flags().IntVar(&exportWorkers, "workers", 0, ".s files re-encoded concurrently (0 for one per CPU)")
+	reencodeCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only estimate the savings from a sample of every zoom")
+	applyDiffCmd.Flags().BoolVar(&applyDelete, "delete", false, "Also delete the tiles the source does not have")
+	applyDiffCmd.Flags().DurationVar(&lockTimeout, "lock-timeout", sfile.DefaultRepositoryLockTimeout, "How long to wait for a repository another process is writing to")
+	reencodeCmd.Flags().IntVar(&reencodeSample, "sample", sfile.DefaultReencodeSample, "Tiles of every zoom re-encoded by a dry run")
+	signReleaseCmd.Flags().StringVar(&releaseKey, "key", "", "File holding the base64 Ed25519 private key releases are signed with")
+	signReleaseCmd.Flags().BoolVar(&generateKey, "generate-key", false, "Write a new private key to --key and print its public key")
+	signReleaseCmd.Flags().StringVarP(&signedOutput, "output", "o", "", "Write the download entries to this file rather than stdout")
+	_ = signReleaseCmd.MarkFlagRequired("key")
+	updateCmd.Flags().BoolVarP(&assumeYes, "yes", "y", false, "Update without asking for a confirmation, as needed when stdin is not a terminal")
+	updateCmd.Flags().StringVar(&updateChannel, "channel", "", "Release channel to update from, such as stable, beta or nightly; remembered for later updates (default the channel last updated from, or stable)")
+	updateCmd.Flags().BoolVar(&allowDowngrade, "allow-downgrade", false, "Install the latest version of the channel even when it is older than the running one")
+	updateCmd.Flags().StringVar(&updateCACert, "ca-cert", "", "PEM file of CA certificates trusted besides those of the system, such as the CA of an intercepting proxy")
+	updateCmd.Flags().BoolVar(&skipVerify, "insecure-skip-verify", false, "Do not verify the TLS certificate of the update server, a last resort")
+	updateCmd.Flags().BoolVar(&checkOnly, "check", false, "Only print whether an update is available, without downloading it")
+	updateCmd.Flags().BoolVar(&noChecksum, "insecure-no-checksum", false, "Apply an update the update info lists no sha256 checksum for, which cannot be verified")
 
 	// Add subcommands to the root command
 	rootCmd.AddCommand(serveCmd)
 	rootCmd.AddCommand(updateCmd)
+	rootCmd.AddCommand(signReleaseCmd)
 	rootCmd.AddCommand(versionCmd) // Add the new version command
+	rootCmd.AddCommand(statsCmd)
+	rootCmd.AddCommand(importCmd)
+	rootCmd.AddCommand(exportCmd)
+	rootCmd.AddCommand(dedupCmd)
+	rootCmd.AddCommand(overviewsCmd)
+	rootCmd.AddCommand(validateCmd)
+	rootCmd.AddCommand(compactCmd)
+	rootCmd.AddCommand(splitCmd)
+	rootCmd.AddCommand(verifyCmd)
+	rootCmd.AddCommand(seedCmd)
+	rootCmd.AddCommand(reencodeCmd)
+	rootCmd.AddCommand(diffCmd)
+	rootCmd.AddCommand(applyDiffCmd)
+	rootCmd.AddCommand(quarantineCmd)
 }
 
 func getCurrentDirectory() (string, error) {
@@ -140,6 +494,16 @@ func main() {
 func runServer(cmd *cobra.Command, args []string) {
 	listenAddr := fmt.Sprintf("0.0.0.0:%d", port)
 
+	// before anything opens a .s file, so every handle is tuned alike
+	mmapSize, err := parseByteSize(sqliteMmap)
+	if err != nil {
+		log.Fatalf("Invalid --sqlite-mmap-size: %v", err)
+	}
+	tuning := sfile.SQLiteTuning{CacheSize: sqliteCache, MmapSize: mmapSize, TempStore: sqliteTemp, JournalMode: sqliteJournal, Synchronous: sqliteSync}
+	if err := sfile.SetSQLiteTuning(tuning); err != nil {
+		log.Fatalf("Invalid sqlite tuning: %v", err)
+	}
+
 	if repositoryRoot == DefaultRepositoryRoot {
 		color.Red("Warning: Using default repository root: %s", DefaultRepositoryRoot)
 		color.Red("You can change this by using the --repo-root or -r flag: ")
@@ -147,39 +511,140 @@ func runServer(cmd *cobra.Command, args []string) {
 		color.Cyan("\r\n")
 	}
 
-	r := mux.NewRouter()
+	// match on the encoded path so escaped repository names reach the api handlers intact
+	r := mux.NewRouter().UseEncodedPath()
 
 	// --- Static File Serving for /static/ prefix ---
 	fs := http.FileServer(http.FS(staticFiles))
 	r.PathPrefix("/static/").Handler(http.StripPrefix("", fs))
 
-	// Debugging route
-	r.HandleFunc("/debug", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/plain")
-		entries, _ := staticFiles.ReadDir("static")
-		fmt.Fprintln(w, "Embedded Files:")
-		for _, entry := range entries {
-			fmt.Fprintf(w, "- %s\n", entry.Name())
+	canvasContext, err := canvas.NewCanvasContext(staticFiles)
+	if err != nil {
+		log.Fatalf("Failed to load the font of message tiles: %v", err)
+	}
+	for _, path := range extraFonts {
+		fontBytes, err := os.ReadFile(path)
+		if err == nil {
+			err = canvasContext.AddFont(fontBytes)
 		}
-	})
+		if err != nil {
+			log.Fatalf("Invalid --extra-font %s: %v", path, err)
+		}
+	}
 
 	// Initialize the API context with necessary dependencies
 	// Note: We use the global 'repositoryRoot' variable populated by Cobra
 	apiCtx := api.NewApiContext(repositoryRoot, sirServer, canvasContext, staticFiles)
+	apiCtx.AdminToken = adminToken
+	apiCtx.MaxArchiveSize = maxArchiveSize
+	apiCtx.RepositoryDepth = repoDepth
+	apiCtx.FollowSymlinks = !noFollowLinks
+	apiCtx.CatalogTTL = catalogTTL
+	apiCtx.Debug = debug
+	apiCtx.WriteEnabled = allowWrites
+	apiCtx.ErrorTileStyle, err = errorTileStyle(cmd)
+	if err != nil {
+		log.Fatalf("Invalid error tile style: %v", err)
+	}
+	apiCtx.ErrorTileText = tileText
+	apiCtx.PlaceholderTile, err = placeholderTileStyle()
+	if err != nil {
+		log.Fatalf("Invalid placeholder tile style: %v", err)
+	}
+	apiCtx.BurnAttribution = burnAttrib
+	apiCtx.TileErrorStatus = tileErrStatus
+	sfile.SetHandleCacheSize(handleCache)
+	sfile.SetAnalysisWorkers(analysisJobs)
+	sfile.SetScanWorkers(scanJobs)
+	sfile.SetWriteAnalysis(writeAnalysis)
+	if writeMosaic {
+		sfile.SetWriteMosaic(canvasContext)
+	}
+	sfile.SetUpstreamRate(upstreamRate)
+	sfile.SetDedupWrites(dedupWrites)
+	sfile.SetAssumeImmutable(immutableRead)
+	sfile.SetChecksumWrites(checksumWrites)
+	sfile.SetVerifyReads(verifyReads)
+	if quarantine && immutableRead {
+		log.Printf("Warning: --quarantine has no effect with --assume-immutable, corrupt tiles are only reported")
+	}
+	sfile.SetQuarantine(quarantine)
+	sfile.SetRepositoryLockTimeout(lockTimeout)
+	sfile.SetAnalysisObserver(apiCtx.AnalysisObserver())
+	if sfile.IsS3Root(repositoryRoot) {
+		scratchBudget, err := parseByteSize(s3ScratchSize)
+		if err != nil {
+			log.Fatalf("Invalid --s3-scratch-size: %v", err)
+		}
+		if err := sfile.OpenS3Root(repositoryRoot, s3ScratchDir, scratchBudget); err != nil {
+			log.Fatalf("Failed to open repository root %s: %v", repositoryRoot, err)
+		}
+	}
+	tileCacheBudget, err := parseByteSize(tileCacheSize)
+	if err != nil {
+		log.Fatalf("Invalid --tile-cache-size: %v", err)
+	}
+	apiCtx.TileCache = sfile.NewTileCache(tileCacheBudget, tileMissTTL)
+	existenceBudget, err := parseByteSize(existenceSize)
+	if err != nil {
+		log.Fatalf("Invalid --existence-index-size: %v", err)
+	}
+	sfile.SetExistenceBudget(existenceBudget)
+	apiCtx.Shedder.MaxInFlight = shedInFlight
+	apiCtx.Shedder.LatencyThreshold = shedLatency
+	apiCtx.Shedder.Fraction = max(0, min(shedFraction, 1))
 
 	// Register all API routes using the apiCtx
 	apiCtx.RegisterRoutes(r)
 
+	var watcher *sfile.RepositoryWatcher
+	if watchRoot {
+		watcher = apiCtx.WatchRepositories()
+	}
+	var sweeper *sfile.ExpirySweeper
+	if sweepInterval > 0 {
+		rate := sweepRate
+		if rate == 0 {
+			rate = -1
+		}
+		sweeper = apiCtx.SweepExpiredTiles(sweepInterval, rate)
+	}
+	var scrubber *sfile.Scrubber
+	if scrubInterval > 0 {
+		if scrubSample <= 0 || scrubSample > 1 {
+			log.Fatalf("Invalid --scrub-sample: must be above 0 and at most 1, got %g", scrubSample)
+		}
+		rate := scrubRate
+		if rate == 0 {
+			rate = -1
+		}
+		scrubber = apiCtx.ScrubRepositories(sfile.ScrubOptions{Interval: scrubInterval, Sample: scrubSample, Rate: rate}, scrubPause)
+	}
+
+	// Tracing is only wired in when an endpoint is configured, otherwise requests
+	// never touch the tracing code
+	shutdownTracing := func(context.Context) error { return nil }
+	if otelEndpoint != "" {
+		shutdown, err := setupTracing(context.Background(), otelEndpoint)
+		if err != nil {
+			log.Fatalf("Failed to set up tracing: %v", err)
+		}
+		shutdownTracing = shutdown
+		r.Use(api.TracingMiddleware)
+		log.Printf("Exporting traces to %s", otelEndpoint)
+	}
+
 	// Start the HTTP server
 	color.Blue("\nClick link to open browser: http://localhost:%d\n", port)
 	color.Cyan("\n")
 	log.Printf("SirServer listening on %s", listenAddr)
 
 	// Start the HTTP server in a goroutine so it doesn't block
+	server := &http.Server{Addr: listenAddr, Handler: r}
 	serverErrors := make(chan error, 1)
 	go func() {
 		log.Printf("SirServer listening on %s", listenAddr)
-		serverErrors <- http.ListenAndServe(listenAddr, r)
+		serverErrors <- server.ListenAndServe()
 	}()
 
 	// Give the server a moment to start up before trying to open the browser
@@ -198,15 +663,632 @@ func runServer(cmd *cobra.Command, args []string) {
 	}
 
 	// Wait for the server to exit (e.g., due to an error or signal)
-	if err := <-serverErrors; err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	select {
+	case err := <-serverErrors:
+		if watcher != nil {
+			_ = watcher.Close()
+		}
+		_ = shutdownTracing(context.Background())
 		log.Fatalf("Server failed: %v", err)
+	case <-ctx.Done():
+	}
+	log.Printf("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Warning: closing open connections: %v", err)
+	}
+	if watcher != nil {
+		_ = watcher.Close()
+	}
+	if sweeper != nil {
+		_ = sweeper.Close()
+	}
+	if scrubber != nil {
+		_ = scrubber.Close()
+	}
+	_ = shutdownTracing(shutdownCtx)
+}
+
+// runStats prints the tile statistics of the repository given as argument
+func runStats(cmd *cobra.Command, args []string) {
+	if statsFormat != "json" && statsFormat != "text" {
+		fmt.Fprintf(os.Stderr, "Error: --format must be json or text, got %q\n", statsFormat)
+		os.Exit(1)
+	}
+	stats, err := sfile.RepositoryStats(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if statsFormat == "text" {
+		_ = stats.WriteSizeTable(os.Stdout)
+		return
+	}
+	content, _ := json.MarshalIndent(stats, "", "  ")
+	fmt.Println(string(content))
+}
+
+func runDedup(cmd *cobra.Command, args []string) {
+	result, err := sfile.Deduplicate(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	content, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Println(string(content))
+}
+
+func runValidate(cmd *cobra.Command, args []string) {
+	report, err := sfile.ValidateWithOptions(args[0], sfile.ValidateOptions{Sample: validateSample})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	content, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(content))
+	if !report.Valid() {
+		os.Exit(1)
+	}
+}
+
+func runVerify(cmd *cobra.Command, args []string) {
+	if verifySample <= 0 || verifySample > 1 {
+		fmt.Fprintf(os.Stderr, "Error: --sample must be above 0 and at most 1\n")
+		os.Exit(1)
+	}
+	report, err := sfile.VerifyChecksums(args[0], verifySample)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	content, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(content))
+	if !report.Valid() {
+		os.Exit(1)
+	}
+}
+
+func runCompact(cmd *cobra.Command, args []string) {
+	sfile.SetRepositoryLockTimeout(lockTimeout)
+	report, err := sfile.Compact(args[0], sfile.CompactOptions{DryRun: dryRun})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	content, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(content))
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func runSplit(cmd *cobra.Command, args []string) {
+	checkZoomFlags()
+	bbox, err := sfile.ParseBBox(exportBBox)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	minZoom, maxZoom := int8(0), int8(sfile.MaxTileZoom)
+	if exportMinZoom >= 0 {
+		minZoom = int8(exportMinZoom)
+	}
+	if exportMaxZoom >= 0 {
+		maxZoom = int8(exportMaxZoom)
+	}
+	var box sfile.Box
+	box.Set(bbox[0], bbox[1], bbox[2], bbox[3])
+	options := sfile.SplitOptions{
+		DryRun: dryRun,
+		Progress: func(progress sfile.SplitProgress) {
+			fmt.Fprintf(os.Stderr, "\rCopied %d tiles, zoom %d", progress.Tiles, progress.Zoom)
+		},
+	}
+	report, err := sfile.Split(args[0], args[1], box, minZoom, maxZoom, options)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	content, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(content))
+}
+
+func runSeed(cmd *cobra.Command, args []string) {
+	checkZoomFlags()
+	bbox, err := sfile.ParseBBox(exportBBox)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	var box sfile.Box
+	box.Set(bbox[0], bbox[1], bbox[2], bbox[3])
+	source := sfile.HTTPSeedSource{Template: args[1], UserAgent: seedUserAgent}
+	if source.UserAgent == "" {
+		source.UserAgent = fmt.Sprintf("SirServer/%s tile seeder", AppVersion)
+	}
+	options := sfile.SeedOptions{
+		Workers:      seedWorkers,
+		Rate:         seedRate,
+		Retries:      seedRetries,
+		SkipExisting: seedSkip,
+	}
+	if seedRate == 0 {
+		options.Rate = -1
+	}
+	if seedRetries == 0 {
+		options.Retries = -1
+	}
+	var last sfile.SeedProgress
+	options.Progress = func(progress sfile.SeedProgress) {
+		last = progress
+		fmt.Fprintf(os.Stderr, "\rSeeded %d of %d tiles, zoom %d, %d failed", progress.Done, progress.Total, progress.Zoom, progress.Failed)
+	}
+	// stop cleanly on Ctrl-C, keeping the tiles downloaded so far
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	err = sfile.Seed(ctx, args[0], source, box, int8(max(exportMinZoom, 0)), int8(exportMaxZoom), options)
+	stop()
+	fmt.Fprintln(os.Stderr)
+	if errors.Is(err, context.Canceled) {
+		fmt.Fprintf(os.Stderr, "Seed interrupted after %d of %d tiles, run it again to resume\n", last.Done, last.Total)
+		os.Exit(130)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	content, _ := json.MarshalIndent(last, "", "  ")
+	fmt.Println(string(content))
+}
+
+func runReencode(cmd *cobra.Command, args []string) {
+	format, err := canvas.ParseFormat(args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	options := sfile.ReencodeOptions{
+		Workers: exportWorkers,
+		DryRun:  dryRun,
+		Sample:  reencodeSample,
+		Progress: func(progress sfile.ReencodeProgress) {
+			fmt.Fprintf(os.Stderr, "\rRe-encoded %d of %d files", progress.Done, progress.Files)
+		},
+	}
+	// stop cleanly on Ctrl-C, keeping the tables re-encoded so far
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	report, err := sfile.Reencode(ctx, args[0], format, quality, options)
+	stop()
+	if !dryRun {
+		fmt.Fprintln(os.Stderr)
+	}
+	if errors.Is(err, context.Canceled) {
+		fmt.Fprintf(os.Stderr, "Re-encoding interrupted, run it again to finish\n")
+		os.Exit(130)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	content, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(content))
+}
+
+func runDiff(cmd *cobra.Command, args []string) {
+	report, err := sfile.Diff(args[0], args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	content, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(content))
+}
+
+func runApplyDiff(cmd *cobra.Command, args []string) {
+	sfile.SetRepositoryLockTimeout(lockTimeout)
+	content, err := os.ReadFile(args[2])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	var report sfile.DiffReport
+	if err := json.Unmarshal(content, &report); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s is not a diff: %v\n", args[2], err)
+		os.Exit(1)
+	}
+	options := sfile.ApplyOptions{
+		Delete: applyDelete,
+		Progress: func(progress sfile.ApplyProgress) {
+			fmt.Fprintf(os.Stderr, "\rCopied %d of %d tiles", progress.Copied, report.Added+report.Modified)
+		},
+	}
+	// stop cleanly on Ctrl-C, the tiles copied so far stay copied
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	progress, err := sfile.ApplyDiff(ctx, args[0], args[1], report, options)
+	stop()
+	fmt.Fprintln(os.Stderr)
+	if errors.Is(err, context.Canceled) {
+		fmt.Fprintf(os.Stderr, "Interrupted, apply the diff again to finish\n")
+		os.Exit(130)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	content, _ = json.MarshalIndent(progress, "", "  ")
+	fmt.Println(string(content))
+	if progress.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// runQuarantine lists the quarantined tiles of a repository, or restores the
+// tiles given as z/x/y
+func runQuarantine(cmd *cobra.Command, args []string) {
+	if len(args) == 1 {
+		tiles, err := sfile.ListQuarantined(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		content, _ := json.MarshalIndent(tiles, "", "  ")
+		fmt.Println(string(content))
+		return
+	}
+	failed := false
+	for _, arg := range args[1:] {
+		var z int8
+		var x, y int64
+		if _, err := fmt.Sscanf(arg, "%d/%d/%d", &z, &x, &y); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %q is not a tile z/x/y\n", arg)
+			failed = true
+			continue
+		}
+		if err := sfile.RestoreQuarantined(args[0], x, y, z); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			failed = true
+			continue
+		}
+		fmt.Printf("Restored %d/%d/%d\n", z, x, y)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// importShardScheme is the shard scheme given with --shard-file and --shard-table,
+// the zero scheme to keep the one of the repository when neither is
+func importShardScheme() sfile.ShardScheme {
+	if shardFile == 0 && shardTable == 0 {
+		return sfile.ShardScheme{}
+	}
+	scheme := sfile.DefaultShardScheme
+	if shardFile != 0 {
+		scheme.File = shardFile
+	}
+	if shardTable != 0 {
+		scheme.Table = shardTable
+	}
+	return scheme
+}
+
+func runImport(cmd *cobra.Command, args []string) {
+	start := time.Now()
+	sfile.SetDedupWrites(dedupWrites)
+	sfile.SetChecksumWrites(checksumWrites)
+	sfile.SetRepositoryLockTimeout(lockTimeout)
+	var last sfile.ImportProgress
+	var warnings []string
+	options := sfile.ImportOptions{
+		Overwrite: overwrite,
+		SwapXY:    importSwapXY,
+		TMS:       importTMS,
+		Shard:     importShardScheme(),
+		Grid:      sfile.TileGrid(importGrid),
+		Compress:  importCompress,
+		Progress: func(progress sfile.ImportProgress) {
+			last = progress
+			fmt.Fprintf(os.Stderr, "\rImported %d tiles (%d skipped), %.0f tiles/s", progress.Written+progress.Skipped, progress.Skipped, progress.Rate)
+			if progress.Total >= 0 {
+				fmt.Fprintf(os.Stderr, " of %d", progress.Total)
+			}
+		},
+		Warn: func(path string, err error) {
+			warnings = append(warnings, fmt.Sprintf("%s: %v", path, err))
+		},
+	}
+	var err error
+	if info, statErr := os.Stat(args[0]); statErr == nil && info.IsDir() {
+		err = sfile.ImportXYZDir(args[0], args[1], options)
+	} else {
+		err = sfile.ImportMBTiles(args[0], args[1], options)
+	}
+	fmt.Fprintln(os.Stderr)
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "Skipped %s\n", warning)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Imported %d tiles into %s in %s, %d already present, %d files skipped\n", last.Written, args[1], time.Since(start).Round(time.Millisecond), last.Skipped, len(warnings))
+}
+
+// checkZoomFlags exits when --min-zoom or --max-zoom is beyond the highest zoom,
+// which would wrap around when narrowed to an int8
+func checkZoomFlags() {
+	for _, z := range []int{exportMinZoom, exportMaxZoom} {
+		if z > sfile.MaxTileZoom {
+			fmt.Fprintf(os.Stderr, "Error: zoom %d is beyond the highest zoom %d\n", z, sfile.MaxTileZoom)
+			os.Exit(1)
+		}
+	}
+}
+
+func runExport(cmd *cobra.Command, args []string) {
+	checkZoomFlags()
+	var options sfile.ExportOptions
+	if exportBBox != "" {
+		bbox, err := sfile.ParseBBox(exportBBox)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		options.BBox = bbox
+	}
+	if exportMinZoom >= 0 {
+		minZoom := int8(exportMinZoom)
+		options.MinZoom = &minZoom
+	}
+	if exportMaxZoom >= 0 {
+		maxZoom := int8(exportMaxZoom)
+		options.MaxZoom = &maxZoom
+	}
+	options.TMS, options.Overwrite, options.Workers = exportTMS, overwrite, exportWorkers
+	var last sfile.ExportProgress
+	options.Progress = func(progress sfile.ExportProgress) {
+		last = progress
+		fmt.Fprintf(os.Stderr, "\rExported %d tiles, zoom %d", progress.Tiles, progress.Zoom)
+	}
+	start := time.Now()
+	var err error
+	if strings.EqualFold(filepath.Ext(args[1]), ".mbtiles") {
+		err = sfile.ExportMBTiles(args[0], args[1], options)
+	} else {
+		// stop cleanly on Ctrl-C, keeping the tiles written so far
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		last, err = sfile.ExportXYZDir(ctx, args[0], args[1], options)
+		stop()
+	}
+	fmt.Fprintln(os.Stderr)
+	if errors.Is(err, context.Canceled) {
+		fmt.Fprintf(os.Stderr, "Export interrupted after %d tiles (%d bytes), %d already present\n", last.Tiles, last.Bytes, last.Skipped)
+		os.Exit(130)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Exported %d tiles (%d bytes) to %s in %s, %d already present\n", last.Tiles, last.Bytes, args[1], time.Since(start).Round(time.Millisecond), last.Skipped)
+}
+
+func runOverviews(cmd *cobra.Command, args []string) {
+	downToZoom, err := strconv.Atoi(args[1])
+	if err != nil || downToZoom < 0 || downToZoom > sfile.MaxTileZoom {
+		fmt.Fprintf(os.Stderr, "Error: zoom must be between 0 and %d\n", sfile.MaxTileZoom)
+		os.Exit(1)
+	}
+	start := time.Now()
+	options := sfile.OverviewOptions{
+		Workers:      exportWorkers,
+		SkipExisting: skipExisting,
+		Progress: func(progress sfile.OverviewProgress) {
+			fmt.Fprintf(os.Stderr, "\rZoom %d: built %d of %d tiles, %d already present", progress.Zoom, progress.Built, progress.Total, progress.Skipped)
+			if progress.Built+progress.Skipped == progress.Total {
+				fmt.Fprintln(os.Stderr)
+			}
+		},
+	}
+	if err := sfile.BuildOverviews(args[0], int8(downToZoom), options); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Built overviews of %s down to zoom %d in %s\n", args[0], downToZoom, time.Since(start).Round(time.Millisecond))
+}
+
+// errorTileStyle returns the preset of --error-tile-style with the settings of
+// the other --error-tile flags given to cmd applied
+func errorTileStyle(cmd *cobra.Command) (canvas.TileStyle, error) {
+	style, err := canvas.TileStylePreset(tileStyle)
+	if err != nil {
+		return style, err
+	}
+	err = applyColorFlags([]colorFlag{
+		{"error-tile-background", tileBackground, &style.Background},
+		{"error-tile-color", tileColor, &style.Text},
+		{"error-tile-border-color", tileBorderTint, &style.BorderColor},
+	})
+	if err != nil {
+		return style, err
 	}
+	if cmd.Flags().Changed("error-tile-font-size") {
+		if tileFontSize <= 0 {
+			return style, fmt.Errorf("--error-tile-font-size must be above 0, got %g", tileFontSize)
+		}
+		style.FontSize = tileFontSize
+	}
+	if cmd.Flags().Changed("error-tile-border") {
+		if tileBorder < 0 {
+			return style, fmt.Errorf("--error-tile-border must not be negative, got %d", tileBorder)
+		}
+		style.Border = tileBorder
+	}
+	return style, nil
+}
+
+// placeholderTileStyle returns the preset of --placeholder-tile-style with the
+// colors of the other --placeholder-tile flags applied
+func placeholderTileStyle() (canvas.PlaceholderStyle, error) {
+	style, err := canvas.PlaceholderStylePreset(placeholder)
+	if err != nil {
+		return style, err
+	}
+	err = applyColorFlags([]colorFlag{
+		{"placeholder-tile-background", placeholderBg, &style.Background},
+		{"placeholder-tile-color", placeholderFg, &style.Text},
+		{"placeholder-tile-hatch-color", hatchColor, &style.Hatch},
+	})
+	return style, err
+}
+
+// colorFlag is a flag holding a color, and the color it sets when given
+type colorFlag struct {
+	flag  string
+	value string
+	color *imagecolor.Color
+}
+
+// applyColorFlags parses the colors of the flags that were given into the
+// colors they set
+func applyColorFlags(flags []colorFlag) error {
+	for _, setting := range flags {
+		if setting.value == "" {
+			continue
+		}
+		parsed, err := canvas.ParseColor(setting.value)
+		if err != nil {
+			return fmt.Errorf("--%s: %w", setting.flag, err)
+		}
+		*setting.color = parsed
+	}
+	return nil
+}
+
+// parseByteSize parses sizes like 512, 64KB, 256MB or 1GB, using binary multiples
+func parseByteSize(value string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1}}
+	value = strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n * multiplier, nil
 }
 
 // runUpdate contains the logic to perform the application update
 func runUpdate(cmd *cobra.Command, args []string) {
 	appUpdater := updater.NewUpdater(sirServer.Version, versionInfoURL, downloadBaseURL)
-	appUpdater.PerformUpdate()
+	if updateCACert != "" || skipVerify {
+		client, err := updater.NewHTTPClient(updater.ClientOptions{CACertFile: updateCACert, InsecureSkipVerify: skipVerify})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		appUpdater.HTTPClient = client
+	}
+	appUpdater.AllowMissingChecksum = noChecksum
+	appUpdater.AssumeYes = assumeYes
+	appUpdater.AllowDowngrade = allowDowngrade
+	appUpdater.Channel = updateChannel
+	if stateFile, err := updater.DefaultStateFile(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: the release channel is not remembered: %v\n", err)
+	} else {
+		appUpdater.StateFile = stateFile
+		if updateChannel == "" {
+			if appUpdater.Channel, err = updater.LoadChannel(stateFile); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+	if appUpdater.Channel == "" {
+		appUpdater.Channel = updater.ChannelStable
+	}
+	if checkOnly {
+		updateInfo, available, err := appUpdater.Check()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if available {
+			fmt.Printf("Update available on the %s channel: %s -> %s\n", appUpdater.Channel, appUpdater.CurrentVersion, updateInfo.LatestVersion)
+		} else {
+			fmt.Printf("Up to date on the %s channel: %s (latest %s)\n", appUpdater.Channel, appUpdater.CurrentVersion, updateInfo.LatestVersion)
+		}
+		return
+	}
+	if err := appUpdater.PerformUpdate(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runSignRelease(cmd *cobra.Command, args []string) {
+	if generateKey {
+		publicKey, privateKey, err := updater.GenerateReleaseKey()
+		if err == nil {
+			// O_EXCL, a release key is never overwritten
+			var file *os.File
+			if file, err = os.OpenFile(releaseKey, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err == nil {
+				_, err = fmt.Fprintln(file, privateKey)
+				if closeErr := file.Close(); err == nil {
+					err = closeErr
+				}
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(publicKey)
+		return
+	}
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: no artifacts to sign\n")
+		os.Exit(1)
+	}
+	content, err := os.ReadFile(releaseKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	key, err := updater.ParsePrivateKey(string(content))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	downloads := make([]updater.Download, 0, len(args))
+	for _, path := range args {
+		download, err := updater.SignRelease(key, path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s: %v\n", path, err)
+			os.Exit(1)
+		}
+		downloads = append(downloads, download)
+	}
+	output, _ := json.MarshalIndent(downloads, "", "  ")
+	if signedOutput != "" {
+		if err := os.WriteFile(signedOutput, append(output, '\n'), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	fmt.Println(string(output))
 }
 
 // printBanner prints a simple and robust banner to the console
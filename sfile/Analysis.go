@@ -0,0 +1,292 @@
+package sfile
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultAnalysisWorkers is how many repositories are analysed concurrently by default
+const DefaultAnalysisWorkers = 2
+
+// analysisQueueSize bounds the repositories waiting for analysis. Repositories
+// that do not fit are queued again by a later listing.
+const analysisQueueSize = 1024
+
+// analysisProgressInterval is how many .s files are processed between progress reports
+const analysisProgressInterval = 256
+
+// AnalysisProgress reports the background analysis of a repository
+type AnalysisProgress struct {
+	Repository string  `json:"repository"`
+	Files      int     `json:"files"`       // .s files processed so far
+	TotalFiles int     `json:"total_files"` // .s files of the repository
+	Bytes      float64 `json:"bytes"`       // size of the files processed so far
+	Done       bool    `json:"done"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// AnalysisObserver receives the progress of background analyses. It is called
+// from the analysis workers and must not block for long.
+type AnalysisObserver interface {
+	AnalysisProgress(progress AnalysisProgress)
+}
+
+// analysisResult is a finished analysis kept in memory
+type analysisResult struct {
+	repo    Repository
+	written bool // repository.json was written, so the file is authoritative
+}
+
+// analysisQueue runs repository analyses on a pool of workers. Each repository
+// directory is queued at most once at a time.
+type analysisQueue struct {
+	mu       sync.Mutex
+	workers  int
+	started  int
+	observer AnalysisObserver
+	queue    chan analysisTask
+	pending  map[string]bool // queued repositories, true when repository.json must be written
+	results  map[string]analysisResult
+}
+
+// analysisTask is a repository waiting for analysis
+type analysisTask struct {
+	baseDir string
+	name    string
+	key     string
+	write   bool // write repository.json even when SetWriteAnalysis is off
+}
+
+// ErrAnalysisQueueFull is returned by RescanRepository when too many
+// repositories are waiting for analysis already
+var ErrAnalysisQueueFull = errors.New("too many repositories are waiting for analysis")
+
+var analyses = &analysisQueue{
+	workers: DefaultAnalysisWorkers,
+	queue:   make(chan analysisTask, analysisQueueSize),
+	pending: make(map[string]bool),
+	results: make(map[string]analysisResult),
+}
+
+// SetAnalysisWorkers changes how many repositories are analysed concurrently.
+// Workers already running are kept.
+func SetAnalysisWorkers(workers int) {
+	analyses.mu.Lock()
+	defer analyses.mu.Unlock()
+	analyses.workers = max(workers, 1)
+}
+
+// writeAnalysis makes analyses write repository.json, see SetWriteAnalysis
+var writeAnalysis atomic.Bool
+
+// SetWriteAnalysis makes repositories analysed because they were listed or read
+// write their result to repository.json. It is off by default: the result is
+// kept in memory so that reading a root never modifies it. RescanRepository
+// writes regardless.
+func SetWriteAnalysis(enabled bool) {
+	writeAnalysis.Store(enabled)
+}
+
+// scanWorkers is how many .s files of one repository are read concurrently
+var scanWorkers atomic.Int64
+
+func init() {
+	scanWorkers.Store(int64(runtime.NumCPU()))
+}
+
+// SetScanWorkers changes how many .s files of one repository are read
+// concurrently during analysis, the default is the number of CPUs
+func SetScanWorkers(workers int) {
+	scanWorkers.Store(int64(max(workers, 1)))
+}
+
+// ScanWorkers returns how many .s files of one repository are read concurrently
+func ScanWorkers() int {
+	return int(scanWorkers.Load())
+}
+
+// SetAnalysisObserver installs the observer receiving analysis progress, nil removes it
+func SetAnalysisObserver(observer AnalysisObserver) {
+	analyses.mu.Lock()
+	defer analyses.mu.Unlock()
+	analyses.observer = observer
+}
+
+// PendingAnalyses returns the number of repositories queued or being analysed
+func PendingAnalyses() int {
+	analyses.mu.Lock()
+	defer analyses.mu.Unlock()
+	return len(analyses.pending)
+}
+
+// listedRepository returns the metadata of a repository for a listing without
+// blocking on analysis: repositories without a repository.json are reported with
+// Pared false, or as analysed earlier, and queued for background analysis.
+func listedRepository(baseDir string, name string) Repository {
+	dir := filepath.Join(baseDir, filepath.FromSlash(name))
+	repo, err := readRepositoryInfo(baseDir, name)
+	if err == nil {
+		repo.Size = currentSize(dir, repo.Size)
+		return repo
+	}
+	key := analysisKey(baseDir, name)
+	analyses.mu.Lock()
+	repo, ok := analyses.result(key, err)
+	if !ok {
+		analyses.enqueue(analysisTask{baseDir: baseDir, name: name, key: key})
+	}
+	analyses.mu.Unlock()
+	if !ok {
+		return defaultRepository(name)
+	}
+	repo.Size = currentSize(dir, repo.Size)
+	return repo
+}
+
+// analysedRepository returns the metadata of a repository without a readable
+// repository.json, readErr telling why, analysing it now unless it was already.
+// The result is kept in memory and only written when SetWriteAnalysis is on.
+func analysedRepository(baseDir string, name string, readErr error) (Repository, error) {
+	key := analysisKey(baseDir, name)
+	analyses.mu.Lock()
+	repo, ok := analyses.result(key, readErr)
+	analyses.mu.Unlock()
+	if ok {
+		return repo, nil
+	}
+	repo, err := scanRepository(baseDir, name, nil)
+	if err != nil {
+		return Repository{}, err
+	}
+	analyses.keep(analysisTask{baseDir: baseDir, name: name, key: key}, repo, writeAnalysis.Load())
+	return repo, nil
+}
+
+// RescanRepository queues the repository named name under baseDir for analysis,
+// even when it has a repository.json, and writes the result to repository.json.
+// The progress is reported to the AnalysisObserver.
+func RescanRepository(baseDir string, name string) error {
+	key := analysisKey(baseDir, name)
+	analyses.mu.Lock()
+	defer analyses.mu.Unlock()
+	if !analyses.enqueue(analysisTask{baseDir: baseDir, name: name, key: key, write: true}) {
+		return ErrAnalysisQueueFull
+	}
+	forgetRepositoryExistence(key)
+	return nil
+}
+
+// result returns the analysis of the repository of key kept in memory, readErr
+// telling why its repository.json could not be read. The caller must hold q.mu.
+func (q *analysisQueue) result(key string, readErr error) (Repository, bool) {
+	result, ok := q.results[key]
+	if !ok {
+		return Repository{}, false
+	}
+	if result.written && errors.Is(readErr, os.ErrNotExist) {
+		// repository.json was removed after the analysis, analyse again
+		delete(q.results, key)
+		return Repository{}, false
+	}
+	return result.repo, true
+}
+
+// analysisKey identifies a repository directory independently of how it was named
+func analysisKey(baseDir string, name string) string {
+	dir := filepath.Join(baseDir, filepath.FromSlash(name))
+	if absolute, err := filepath.Abs(dir); err == nil {
+		return absolute
+	}
+	return dir
+}
+
+// enqueue queues task unless its repository is already pending, starting
+// workers as needed, and reports whether it is pending now. The caller must
+// hold q.mu.
+func (q *analysisQueue) enqueue(task analysisTask) bool {
+	if write, ok := q.pending[task.key]; ok {
+		q.pending[task.key] = write || task.write
+		return true
+	}
+	select {
+	case q.queue <- task:
+		q.pending[task.key] = task.write
+	default:
+		return false
+	}
+	for ; q.started < q.workers; q.started++ {
+		go q.work()
+	}
+	return true
+}
+
+// work analyses queued repositories until the process exits
+func (q *analysisQueue) work() {
+	for task := range q.queue {
+		q.analyse(task)
+	}
+}
+
+// analyse runs one analysis and records its result, writing repository.json
+// when the task asks for it or SetWriteAnalysis is on
+func (q *analysisQueue) analyse(task analysisTask) {
+	report := func(progress AnalysisProgress) {
+		q.mu.Lock()
+		observer := q.observer
+		q.mu.Unlock()
+		if observer != nil {
+			observer.AnalysisProgress(progress)
+		}
+	}
+	last := AnalysisProgress{Repository: task.name}
+	repo, err := scanRepository(task.baseDir, task.name, func(files int, totalFiles int, bytes float64) {
+		last.Files, last.TotalFiles, last.Bytes = files, totalFiles, bytes
+		report(last)
+	})
+	done := last
+	done.Done = true
+	q.mu.Lock()
+	write := q.pending[task.key] || writeAnalysis.Load()
+	q.mu.Unlock()
+	if err == nil {
+		q.keep(task, repo, write)
+	} else {
+		RecordError("sfile", fmt.Errorf("analysing repository %s: %w", task.name, err))
+		done.Error = err.Error()
+	}
+
+	q.mu.Lock()
+	delete(q.pending, task.key)
+	q.mu.Unlock()
+	report(done)
+}
+
+// keep records the analysis of a repository in memory, writing it to
+// repository.json first when write is set
+func (q *analysisQueue) keep(task analysisTask, repo Repository, write bool) {
+	result := analysisResult{repo: repo}
+	if write {
+		if err := writeRepositoryInfo(task.baseDir, repo); err != nil {
+			// the result is still served from memory, e.g. for a read-only root
+			log.Printf("Keeping analysis of %s in memory: %v", task.name, err)
+			RecordError("sfile", fmt.Errorf("analysing repository %s: %w", task.name, err))
+		} else {
+			result.written = true
+		}
+		if c := mosaicCanvas.Load(); c != nil && result.written {
+			if err := WriteMosaic(c, task.baseDir, repo); err != nil {
+				log.Printf("Skipping mosaic of %s: %v", task.name, err)
+				RecordError("sfile", fmt.Errorf("analysing repository %s: %w", task.name, err))
+			}
+		}
+	}
+	q.mu.Lock()
+	q.results[task.key] = result
+	q.mu.Unlock()
+}
@@ -0,0 +1,347 @@
+package sfile
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// ErrRepositoryExists is returned when restoring over an existing repository without overwrite
+	ErrRepositoryExists = errors.New("repository already exists")
+	// ErrArchiveTooLarge is returned when an archive extracts to more than the allowed size
+	ErrArchiveTooLarge = errors.New("archive exceeds the size limit")
+	// ErrUnsafeArchivePath is returned for archive entries that would escape the repository directory
+	ErrUnsafeArchivePath = errors.New("unsafe path in archive")
+	// ErrUnsupportedArchive is returned when the uploaded data is neither tar.gz nor zip
+	ErrUnsupportedArchive = errors.New("unsupported archive format, expected tar.gz or zip")
+	// ErrInvalidShard is returned when an extracted .s file does not open as sqlite
+	ErrInvalidShard = errors.New("invalid shard file")
+)
+
+// ArchiveSummary describes what an archive of a repository contains
+type ArchiveSummary struct {
+	Files int   `json:"files"`
+	Size  int64 `json:"size"`
+}
+
+// listArchiveFiles returns the files of a repository that belong in an archive,
+// as slash separated paths relative to dir: repository.json plus every .s file
+// inside the A..Z shard folders. Anything else (previews, quarantine folders,
+// temporary files) is skipped.
+func listArchiveFiles(dir string) ([]string, error) {
+	files := make([]string, 0)
+	if info, err := os.Stat(filepath.Join(dir, "repository.json")); err == nil && info.Mode().IsRegular() {
+		files = append(files, "repository.json")
+	}
+	subdirs, err := listSubDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range subdirs {
+		shards, err := listAllFile(sub)
+		if err != nil {
+			return nil, err
+		}
+		for _, shard := range shards {
+			rel, err := filepath.Rel(dir, shard)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, filepath.ToSlash(rel))
+		}
+	}
+	return files, nil
+}
+
+// SummarizeArchive returns the file count and total size of the archive
+// ArchiveRepository would produce for dir, without reading any file content
+func SummarizeArchive(dir string) (ArchiveSummary, error) {
+	summary := ArchiveSummary{}
+	files, err := listArchiveFiles(dir)
+	if err != nil {
+		return summary, err
+	}
+	for _, file := range files {
+		info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(file)))
+		if err != nil {
+			continue
+		}
+		summary.Files++
+		summary.Size += info.Size()
+	}
+	return summary, nil
+}
+
+// ArchiveRepository streams the repository in dir to w as a gzip'd tar.
+// Entries are written relative to dir, so the archive can be extracted
+// directly into a new repository directory.
+func ArchiveRepository(dir string, w io.Writer) error {
+	files, err := listArchiveFiles(dir)
+	if err != nil {
+		return err
+	}
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, file := range files {
+		if err := addArchiveFile(tw, dir, file); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to finish tar stream: %w", err)
+	}
+	if err := gw.Close(); err != nil {
+		return fmt.Errorf("failed to finish gzip stream: %w", err)
+	}
+	return nil
+}
+
+func addArchiveFile(tw *tar.Writer, dir string, name string) error {
+	fullPath := filepath.Join(dir, filepath.FromSlash(name))
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", name, err)
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return fmt.Errorf("failed to create tar header for %s: %w", name, err)
+	}
+	header.Name = name
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write tar header for %s: %w", name, err)
+	}
+	// copy exactly the size recorded in the header, the file may still be growing
+	if _, err := io.CopyN(tw, file, info.Size()); err != nil {
+		return fmt.Errorf("failed to write %s to archive: %w", name, err)
+	}
+	return nil
+}
+
+// RestoreOptions controls how RestoreArchive recreates a repository
+type RestoreOptions struct {
+	MaxSize   int64 // maximum number of extracted bytes, 0 means unlimited
+	Overwrite bool  // replace an existing repository instead of failing
+}
+
+// RestoreArchive recreates the repository destDir from a tar.gz or zip stream.
+// The archive is extracted next to destDir into a hidden directory and only moved
+// into place once every .s file in it has been verified to open as sqlite, so a
+// failed restore never leaves a half written repository behind.
+func RestoreArchive(r io.Reader, destDir string, opts RestoreOptions) error {
+	if _, err := os.Stat(destDir); err == nil && !opts.Overwrite {
+		return ErrRepositoryExists
+	}
+
+	if err := os.MkdirAll(filepath.Dir(destDir), 0755); err != nil {
+		return fmt.Errorf("failed to create parent directory: %w", err)
+	}
+	tmpDir, err := os.MkdirTemp(filepath.Dir(destDir), "."+filepath.Base(destDir)+".restore-")
+	if err != nil {
+		return fmt.Errorf("failed to create restore directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		return err
+	}
+
+	budget := opts.MaxSize
+	if budget <= 0 {
+		budget = -1
+	}
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		err = extractTarGz(br, tmpDir, &budget)
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		err = extractZip(br, tmpDir, &budget)
+	default:
+		err = ErrUnsupportedArchive
+	}
+	if err != nil {
+		return err
+	}
+	if err := validateRestoredShards(tmpDir); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(destDir); err == nil {
+		// writers of other processes must not be halfway through the repository replaced
+		unlock, err := lockRepository(destDir)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		oldDir := tmpDir + ".old"
+		if err := os.Rename(destDir, oldDir); err != nil {
+			return fmt.Errorf("failed to move existing repository aside: %w", err)
+		}
+		if err := os.Rename(tmpDir, destDir); err != nil {
+			_ = os.Rename(oldDir, destDir)
+			return fmt.Errorf("failed to move restored repository into place: %w", err)
+		}
+		forgetRepositoryExistence(destDir)
+		return os.RemoveAll(oldDir)
+	}
+	if err := os.Rename(tmpDir, destDir); err != nil {
+		return fmt.Errorf("failed to move restored repository into place: %w", err)
+	}
+	return nil
+}
+
+func extractTarGz(r io.Reader, destDir string, budget *int64) error {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	defer gzr.Close()
+
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar header: %w", err)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := extractDir(destDir, header.Name); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := extractFile(destDir, header.Name, tr, budget); err != nil {
+				return err
+			}
+		default:
+			// links and devices are never part of a repository
+			continue
+		}
+	}
+}
+
+func extractZip(r io.Reader, destDir string, budget *int64) error {
+	// zip needs random access, so stage the upload in a temporary file first
+	staged, err := os.CreateTemp("", "sirserver-restore-*.zip")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary archive file: %w", err)
+	}
+	defer os.Remove(staged.Name())
+	defer staged.Close()
+	size, err := io.Copy(staged, r)
+	if err != nil {
+		return fmt.Errorf("failed to stage zip archive: %w", err)
+	}
+
+	zr, err := zip.NewReader(staged, size)
+	if err != nil {
+		return fmt.Errorf("failed to open zip archive: %w", err)
+	}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			if err := extractDir(destDir, f.Name); err != nil {
+				return err
+			}
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("failed to open %s in zip: %w", f.Name, err)
+		}
+		err = extractFile(destDir, f.Name, rc, budget)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveEntryPath resolves an archive entry name to a path inside destDir,
+// rejecting absolute paths and anything climbing out with ".."
+func archiveEntryPath(destDir string, name string) (string, error) {
+	clean := filepath.FromSlash(strings.TrimSuffix(name, "/"))
+	if !filepath.IsLocal(clean) {
+		return "", fmt.Errorf("%w: %s", ErrUnsafeArchivePath, name)
+	}
+	return filepath.Join(destDir, clean), nil
+}
+
+func extractDir(destDir string, name string) error {
+	target, err := archiveEntryPath(destDir, name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(target, 0755)
+}
+
+func extractFile(destDir string, name string, r io.Reader, budget *int64) error {
+	target, err := archiveEntryPath(destDir, name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", name, err)
+	}
+	defer file.Close()
+
+	if *budget < 0 {
+		if _, err := io.Copy(file, r); err != nil {
+			return fmt.Errorf("failed to extract %s: %w", name, err)
+		}
+		return nil
+	}
+	// copy one byte more than allowed so an oversized entry is detected
+	written, err := io.CopyN(file, r, *budget+1)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to extract %s: %w", name, err)
+	}
+	if written > *budget {
+		return ErrArchiveTooLarge
+	}
+	*budget -= written
+	return nil
+}
+
+// validateRestoredShards makes sure every .s file below dir is a readable sqlite database
+func validateRestoredShards(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".s") {
+			return nil
+		}
+		db, err := openShard(path)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalidShard, d.Name(), err)
+		}
+		defer closeShard(db)
+		if _, err := listTables(db); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalidShard, d.Name(), err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,69 @@
+package sfile
+
+import (
+	"SirServer/canvas"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// AttributionOverlay burns an attribution onto the raster tiles served from a
+// repository, for data licenses requiring it on the imagery itself rather than
+// only in TileJSON, see canvas.DrawAttribution. Vector tiles are served as stored.
+type AttributionOverlay struct {
+	Text       string  `json:"text,omitempty"`       // the Attribution of the repository when empty
+	Corner     string  `json:"corner,omitempty"`     // top-left, top-right, bottom-left or bottom-right, the default
+	FontSize   float64 `json:"font_size,omitempty"`  // in points, canvas.DefaultAttributionFontSize when 0
+	Color      string  `json:"color,omitempty"`      // of the text, see canvas.ParseColor
+	Background string  `json:"background,omitempty"` // of the strip behind the text, see canvas.ParseColor
+}
+
+// htmlTags are removed from attributions drawn on tiles, which are often links
+var htmlTags = regexp.MustCompile(`<[^>]*>`)
+
+// Resolve returns the overlay with the text it draws for repo: its own, or the
+// attribution of the repository stripped of HTML markup and entities
+func (o AttributionOverlay) Resolve(repo Repository) AttributionOverlay {
+	if o.Text == "" {
+		o.Text = strings.Join(strings.Fields(html.UnescapeString(htmlTags.ReplaceAllString(repo.Attribution, ""))), " ")
+	}
+	return o
+}
+
+// Key returns a digest of the overlay, telling tiles drawn with another apart
+// in caches
+func (o AttributionOverlay) Key() string {
+	data, _ := json.Marshal(o)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Options returns the overlay as canvas options, decoding its colors
+func (o AttributionOverlay) Options() (canvas.AttributionOptions, error) {
+	options := canvas.AttributionOptions{Corner: o.Corner, FontSize: o.FontSize}
+	if o.Corner != "" && !canvas.IsCorner(o.Corner) {
+		return options, fmt.Errorf("invalid attribution corner %q", o.Corner)
+	}
+	if o.FontSize < 0 {
+		return options, fmt.Errorf("attribution font size %g is negative", o.FontSize)
+	}
+	if o.Color != "" {
+		textColor, err := canvas.ParseColor(o.Color)
+		if err != nil {
+			return options, fmt.Errorf("invalid attribution color: %w", err)
+		}
+		options.Color = textColor
+	}
+	if o.Background != "" {
+		background, err := canvas.ParseColor(o.Background)
+		if err != nil {
+			return options, fmt.Errorf("invalid attribution background: %w", err)
+		}
+		options.Background = background
+	}
+	return options, nil
+}
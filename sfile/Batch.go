@@ -0,0 +1,156 @@
+package sfile
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// BatchOptions tune WriteBatch
+type BatchOptions struct {
+	Overwrite bool // replace tiles already stored, otherwise they are kept
+}
+
+// BatchShard reports the tiles of a batch belonging to one .s file
+type BatchShard struct {
+	File    string `json:"file"` // relative to the repository, slash separated
+	Written int64  `json:"written"`
+	Skipped int64  `json:"skipped"` // already stored and kept
+	Failed  int64  `json:"failed"`
+	Error   string `json:"error,omitempty"` // why none of the tiles of the file were written
+}
+
+// BatchTileError tells why a tile of a batch was not written
+type BatchTileError struct {
+	TileCoord
+	Error string `json:"error"`
+}
+
+// BatchReport summarizes a WriteBatch. Every tile given is counted exactly once
+// as written, skipped or failed, unless the batch was cut short by its context.
+type BatchReport struct {
+	Written int64            `json:"written"`
+	Skipped int64            `json:"skipped"`
+	Failed  int64            `json:"failed"`
+	Shards  []BatchShard     `json:"shards"`
+	Errors  []BatchTileError `json:"errors,omitempty"` // the tiles that failed on their own
+}
+
+// WriteBatch stores tiles grouping them by .s file, one transaction per file
+// with its statements prepared once, which is far cheaper than a WriteXYZ per
+// tile. It keeps going past bad tiles: a tile outside the grid, without data or
+// whose row sqlite rejects is reported in Errors and the other tiles of its file
+// are committed without it, and a file that cannot be written at all has all of
+// its tiles failed and the other files still written. Files are written in the
+// order their first tile comes in tiles.
+//
+// The error is only set when the batch stops early: the repository stays locked
+// by another process, see lockRepository, or ctx ends before the next file. The
+// files written until then stay written and are in the report.
+func (f *SRepository) WriteBatch(ctx context.Context, tiles []TileData, opts BatchOptions) (BatchReport, error) {
+	report := BatchReport{Shards: make([]BatchShard, 0)}
+	byFile := make(map[string][]TileData)
+	files := make([]string, 0)
+	for _, tile := range tiles {
+		err := f.grid.checkTile(tile.X, tile.Y, tile.Z)
+		if err == nil && len(tile.Data) == 0 {
+			err = ErrEmptyTile
+		}
+		if err != nil {
+			report.Failed++
+			report.Errors = append(report.Errors, BatchTileError{TileCoord: tile.TileCoord, Error: err.Error()})
+			continue
+		}
+		filePath, _, _ := f.shardLocation(tile.X, tile.Y, tile.Z)
+		if _, ok := byFile[filePath]; !ok {
+			files = append(files, filePath)
+		}
+		byFile[filePath] = append(byFile[filePath], tile)
+	}
+	if len(files) == 0 {
+		return report, nil
+	}
+	// held for the whole batch, so its files do not each wait for another process
+	unlock, err := lockRepository(f.dir)
+	if err != nil {
+		return report, err
+	}
+	defer unlock()
+
+	for _, filePath := range files {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		tiles := byFile[filePath]
+		shard := BatchShard{File: filePath}
+		if rel, err := filepath.Rel(f.dir, filePath); err == nil {
+			shard.File = filepath.ToSlash(rel)
+		}
+		written, failed, err := f.writeShardTiles(filePath, tiles, opts.Overwrite)
+		if errors.Is(err, ErrRepositoryLocked) {
+			return report, err
+		}
+		if err != nil {
+			shard.Failed, shard.Error = int64(len(tiles)), err.Error()
+			RecordError("sfile", fmt.Errorf("batch write to %s: %w", filePath, err))
+		} else {
+			shard.Written, shard.Failed = written, int64(len(failed))
+			shard.Skipped = int64(len(tiles)) - written - shard.Failed
+			for i, tile := range tiles {
+				if err, ok := failed[i]; ok {
+					report.Errors = append(report.Errors, BatchTileError{TileCoord: tile.TileCoord, Error: err.Error()})
+				}
+			}
+		}
+		report.Written += shard.Written
+		report.Skipped += shard.Skipped
+		report.Failed += shard.Failed
+		report.Shards = append(report.Shards, shard)
+	}
+	return report, nil
+}
+
+// execer is a *sql.Tx or the txStatements of one
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// txStatements prepares each statement run in a transaction once, for writes
+// repeating the same statements tile after tile. The statements are closed with
+// the transaction.
+type txStatements struct {
+	tx         *sql.Tx
+	statements map[string]*sql.Stmt
+}
+
+func newTxStatements(tx *sql.Tx) *txStatements {
+	return &txStatements{tx: tx, statements: make(map[string]*sql.Stmt)}
+}
+
+// Exec runs query with args, preparing it the first time
+func (s *txStatements) Exec(query string, args ...interface{}) (sql.Result, error) {
+	stmt, ok := s.statements[query]
+	if !ok {
+		var err error
+		if stmt, err = s.tx.Prepare(query); err != nil {
+			return nil, err
+		}
+		s.statements[query] = stmt
+	}
+	return stmt.Exec(args...)
+}
+
+// isTileError reports whether sqlite rejected the row of a single tile, a blob
+// too big or a constraint or type the row does not meet, rather than failing to
+// write the file at all. sqlite errors go by the message, see isTransient.
+func isTileError(err error) bool {
+	if err == nil {
+		return false
+	}
+	message := err.Error()
+	return strings.Contains(message, "too big") || strings.Contains(message, "constraint failed") ||
+		strings.Contains(message, "datatype mismatch")
+}
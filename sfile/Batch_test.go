@@ -0,0 +1,182 @@
+package sfile
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// batchTile is a tile of a batch at zoom 10 with data naming it
+func batchTile(x int64, y int64, data string) TileData {
+	return TileData{TileCoord: TileCoord{Z: 10, X: x, Y: y}, Data: []byte(data)}
+}
+
+// TestWriteBatchPartialFailure writes a batch with tiles outside the grid, an
+// empty tile, a tile whose row sqlite rejects and a shard of garbage, and checks
+// every other tile is committed and every tile is counted once where it belongs
+func TestWriteBatchPartialFailure(t *testing.T) {
+	repo, _ := newTestRepository(t, "")
+	// the table of x 0..63 only takes rows of up to 16 bytes, standing in for
+	// the blobs over the sqlite size limit
+	good := filepath.Join(repo.dir, "K", "K_0_0.s")
+	if err := os.MkdirAll(filepath.Dir(good), 0755); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("create table K_0_0 (ID INTEGER PRIMARY KEY, X INTEGER, Y INTEGER, Data BLOB CHECK (length(Data) <= 16))")
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the tiles of x 512..767 lie in a shard of garbage
+	if err := os.WriteFile(filepath.Join(repo.dir, "K", "K_2_0.s"), bytes.Repeat([]byte("garbage "), 1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tiles := []TileData{
+		batchTile(0, 0, "tile 0/0"),
+		batchTile(1, 0, "a tile too big for its table"),
+		batchTile(2, 0, "tile 2/0"),
+		batchTile(-1, 0, "outside the world"),
+		batchTile(1024, 0, "outside the world"),
+		batchTile(3, 0, ""),
+		batchTile(300, 0, "tile 300/0"),
+		batchTile(600, 0, "tile 600/0"),
+		batchTile(601, 0, "tile 601/0"),
+		batchTile(301, 0, "tile 301/0"),
+	}
+	// sqlite quietly drops a row failing a CHECK under insert or ignore, so the
+	// tiles are replaced for the row to be rejected
+	report, err := repo.WriteBatch(context.Background(), tiles, BatchOptions{Overwrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Written != 4 || report.Skipped != 0 || report.Failed != 6 {
+		t.Fatalf("written %d, skipped %d, failed %d, want 4, 0 and 6", report.Written, report.Skipped, report.Failed)
+	}
+	failedTiles := make(map[TileCoord]bool)
+	for _, tileErr := range report.Errors {
+		failedTiles[tileErr.TileCoord] = true
+	}
+	for _, x := range []int64{1, -1, 1024, 3} {
+		if !failedTiles[TileCoord{Z: 10, X: x, Y: 0}] {
+			t.Errorf("tile %d/0 missing from the errors %+v", x, report.Errors)
+		}
+	}
+	if len(report.Errors) != 4 {
+		t.Errorf("errors %+v, want the 4 bad tiles only", report.Errors)
+	}
+
+	want := []BatchShard{
+		{File: "K/K_0_0.s", Written: 2, Failed: 1},
+		{File: "K/K_1_0.s", Written: 2},
+		{File: "K/K_2_0.s", Failed: 2},
+	}
+	if len(report.Shards) != len(want) {
+		t.Fatalf("shards %+v, want %+v", report.Shards, want)
+	}
+	for i, shard := range report.Shards {
+		if shard.Error != "" != (want[i].Failed == 2) {
+			t.Errorf("shard %s error %q", shard.File, shard.Error)
+		}
+		shard.Error = ""
+		if shard != want[i] {
+			t.Errorf("shard %+v, want %+v", shard, want[i])
+		}
+	}
+
+	for _, tile := range tiles {
+		got, err := repo.GetXYZ(tile.X, tile.Y, tile.Z)
+		stored := strings.HasPrefix(string(tile.Data), "tile") && tile.X < 512
+		if stored && (err != nil || got.String() != string(tile.Data)) {
+			t.Errorf("tile %d/%d: %v, %v, want %q", tile.X, tile.Y, got, err, tile.Data)
+		}
+		if !stored && err == nil {
+			t.Errorf("tile %d/%d stored, want it failed", tile.X, tile.Y)
+		}
+	}
+}
+
+// TestWriteBatchOverwrite checks stored tiles are skipped unless Overwrite is
+// set, and that a batch cut short by its context reports what it wrote
+func TestWriteBatchOverwrite(t *testing.T) {
+	repo, _ := newTestRepository(t, "")
+	first := []TileData{batchTile(0, 0, "first 0"), batchTile(300, 0, "first 300")}
+	if _, err := repo.WriteBatch(context.Background(), first, BatchOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	second := []TileData{batchTile(0, 0, "second 0"), batchTile(1, 0, "second 1"), batchTile(300, 0, "second 300")}
+	report, err := repo.WriteBatch(context.Background(), second, BatchOptions{})
+	if err != nil || report.Written != 1 || report.Skipped != 2 || report.Failed != 0 {
+		t.Fatalf("batch keeping stored tiles: %+v, %v, want 1 written and 2 skipped", report, err)
+	}
+	if got, _ := repo.GetXYZ(0, 0, 10); got.String() != "first 0" {
+		t.Fatalf("kept tile %q, want first 0", got.String())
+	}
+
+	report, err = repo.WriteBatch(context.Background(), second, BatchOptions{Overwrite: true})
+	if err != nil || report.Written != 3 || report.Skipped != 0 {
+		t.Fatalf("batch overwriting: %+v, %v, want 3 written", report, err)
+	}
+	if got, _ := repo.GetXYZ(300, 0, 10); got.String() != "second 300" {
+		t.Fatalf("overwritten tile %q, want second 300", got.String())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	report, err = repo.WriteBatch(ctx, []TileData{batchTile(5, 0, "late")}, BatchOptions{})
+	if !errors.Is(err, context.Canceled) || report.Written != 0 || len(report.Shards) != 0 {
+		t.Fatalf("cancelled batch: %+v, %v, want nothing written and context.Canceled", report, err)
+	}
+}
+
+// benchmarkTiles are the 10,000 tiles of a 100x100 block at zoom 12, spread
+// over four .s files
+func benchmarkTiles() []TileData {
+	tiles := make([]TileData, 0, 10000)
+	for y := int64(200); y < 300; y++ {
+		for x := int64(200); x < 300; x++ {
+			tiles = append(tiles, TileData{TileCoord: TileCoord{Z: 12, X: x, Y: y}, Data: []byte(fmt.Sprintf("tile %d/%d", x, y))})
+		}
+	}
+	return tiles
+}
+
+// BenchmarkWrite10kTiles writes 10,000 tiles to a new repository with one
+// WriteBatch and with a WriteXYZ per tile
+func BenchmarkWrite10kTiles(b *testing.B) {
+	tiles := benchmarkTiles()
+	b.Run("WriteBatch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			repo, _ := newTestRepository(b, "")
+			b.StartTimer()
+			report, err := repo.WriteBatch(context.Background(), tiles, BatchOptions{})
+			if err != nil || report.Written != int64(len(tiles)) {
+				b.Fatalf("%+v, %v", report, err)
+			}
+		}
+	})
+	b.Run("WriteXYZ", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			repo, _ := newTestRepository(b, "")
+			b.StartTimer()
+			for _, tile := range tiles {
+				if err := repo.WriteXYZ(tile.X, tile.Y, tile.Z, tile.Data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
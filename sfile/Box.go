@@ -0,0 +1,130 @@
+package sfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// Box is a lng/lat bounding box in WGS84 degrees. It marshals to JSON as
+// [minx, miny, maxx, maxy], and the empty box, which Extend grows from, as null.
+// Boxes crossing the antimeridian are not supported: a box always spans from
+// MinX eastwards to MaxX with MinX <= MaxX.
+type Box struct {
+	MinX float64
+	MinY float64
+	MaxX float64
+	MaxY float64
+}
+
+// NewBox returns the empty box
+func NewBox() Box {
+	return Box{math.MaxFloat64, math.MaxFloat64, -math.MaxFloat64, -math.MaxFloat64}
+}
+
+// Extend grows b to cover b2 as well, extending by the empty box changes nothing
+func (b *Box) Extend(b2 Box) {
+	b.MinX = min(b.MinX, b2.MinX)
+	b.MinY = min(b.MinY, b2.MinY)
+	b.MaxX = max(b.MaxX, b2.MaxX)
+	b.MaxY = max(b.MaxY, b2.MaxY)
+}
+
+func (b *Box) Set(minx float64, miny float64, maxx float64, maxy float64) {
+	b.MinX = minx
+	b.MinY = miny
+	b.MaxX = maxx
+	b.MaxY = maxy
+}
+
+func (b *Box) Empty() {
+	*b = NewBox()
+}
+
+// Bounds returns the box as minLng, minLat, maxLng, maxLat
+func (b Box) Bounds() [4]float64 {
+	return [4]float64{b.MinX, b.MinY, b.MaxX, b.MaxY}
+}
+
+func (b Box) IsEmpty() bool {
+	return b.MinX == math.MaxFloat64 && b.MinY == math.MaxFloat64 && b.MaxX == -math.MaxFloat64 && b.MaxY == -math.MaxFloat64
+}
+
+// IsValid reports whether b covers an area or a point, false for the empty box
+// and for boxes with a min above their max
+func (b Box) IsValid() bool {
+	return b.MinX <= b.MaxX && b.MinY <= b.MaxY
+}
+
+// Contains reports whether lng/lat lies within b, borders included
+func (b Box) Contains(lng float64, lat float64) bool {
+	return b.MinX <= lng && lng <= b.MaxX && b.MinY <= lat && lat <= b.MaxY
+}
+
+// Intersects reports whether b and other share a point, borders included. The
+// empty box intersects nothing.
+func (b Box) Intersects(other Box) bool {
+	return b.IsValid() && other.IsValid() &&
+		b.MinX <= other.MaxX && other.MinX <= b.MaxX && b.MinY <= other.MaxY && other.MinY <= b.MaxY
+}
+
+// Center returns the middle of b, 0/0 for the empty box
+func (b Box) Center() (lng float64, lat float64) {
+	if !b.IsValid() {
+		return 0, 0
+	}
+	return 0.5 * (b.MinX + b.MaxX), 0.5 * (b.MinY + b.MaxY)
+}
+
+// Width returns the extent of b in degrees of longitude, 0 for the empty box
+func (b Box) Width() float64 {
+	return max(b.MaxX-b.MinX, 0)
+}
+
+// Height returns the extent of b in degrees of latitude, 0 for the empty box
+func (b Box) Height() float64 {
+	return max(b.MaxY-b.MinY, 0)
+}
+
+// Clamp returns b limited to the WGS84 range of lng -180..180 and lat -90..90.
+// The empty box stays empty, so does a box entirely outside that range.
+func (b Box) Clamp() Box {
+	if !b.Intersects(Box{MinX: -180, MinY: -90, MaxX: 180, MaxY: 90}) {
+		return NewBox()
+	}
+	return Box{
+		MinX: max(b.MinX, -180),
+		MinY: max(b.MinY, -90),
+		MaxX: min(b.MaxX, 180),
+		MaxY: min(b.MaxY, 90),
+	}
+}
+
+// MarshalJSON writes b as [minx, miny, maxx, maxy], or null when it is empty
+func (b Box) MarshalJSON() ([]byte, error) {
+	if !b.IsValid() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(b.Bounds())
+}
+
+// UnmarshalJSON reads [minx, miny, maxx, maxy], null being the empty box
+func (b *Box) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*b = NewBox()
+		return nil
+	}
+	// decoded as a slice, an array would take too few or too many values quietly
+	var bounds []float64
+	if err := json.Unmarshal(data, &bounds); err != nil {
+		return fmt.Errorf("box must be [minx, miny, maxx, maxy]: %w", err)
+	}
+	if len(bounds) != 4 {
+		return fmt.Errorf("box must be [minx, miny, maxx, maxy], got %d values", len(bounds))
+	}
+	if bounds[0] > bounds[2] || bounds[1] > bounds[3] {
+		return fmt.Errorf("box [%g, %g, %g, %g] has a min above its max", bounds[0], bounds[1], bounds[2], bounds[3])
+	}
+	b.Set(bounds[0], bounds[1], bounds[2], bounds[3])
+	return nil
+}
@@ -0,0 +1,189 @@
+package sfile
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// TestBoxEmpty checks the empty box is neither valid nor has a size or a point,
+// and that Extend grows from it and by it as from and by nothing
+func TestBoxEmpty(t *testing.T) {
+	empty := NewBox()
+	if !empty.IsEmpty() || empty.IsValid() {
+		t.Fatalf("NewBox: empty %v, valid %v, want empty and not valid", empty.IsEmpty(), empty.IsValid())
+	}
+	if empty.Width() != 0 || empty.Height() != 0 {
+		t.Errorf("empty box of %g x %g, want 0 x 0", empty.Width(), empty.Height())
+	}
+	if lng, lat := empty.Center(); lng != 0 || lat != 0 {
+		t.Errorf("empty box centered on %g, %g, want 0, 0", lng, lat)
+	}
+	if empty.Contains(0, 0) {
+		t.Error("the empty box contains 0, 0")
+	}
+	if !empty.Clamp().IsEmpty() {
+		t.Errorf("clamped empty box %+v, want it empty", empty.Clamp())
+	}
+
+	box := Box{MinX: 10, MinY: 20, MaxX: 30, MaxY: 40}
+	grown := NewBox()
+	grown.Extend(box)
+	if grown != box {
+		t.Errorf("empty box extended by %+v = %+v, want the box", box, grown)
+	}
+	grown.Extend(NewBox())
+	if grown != box {
+		t.Errorf("box extended by the empty box = %+v, want it unchanged", grown)
+	}
+	nothing := NewBox()
+	nothing.Extend(NewBox())
+	if !nothing.IsEmpty() {
+		t.Errorf("empty box extended by the empty box = %+v, want it empty", nothing)
+	}
+
+	grown.Empty()
+	if !grown.IsEmpty() {
+		t.Errorf("emptied box %+v, want it empty", grown)
+	}
+	// a box with its min above its max is not empty, but not valid either
+	inverted := Box{MinX: 1, MinY: 1, MaxX: 0, MaxY: 0}
+	if inverted.IsEmpty() || inverted.IsValid() || inverted.Width() != 0 || inverted.Height() != 0 {
+		t.Errorf("inverted box: empty %v, valid %v, %g x %g, want neither and no size",
+			inverted.IsEmpty(), inverted.IsValid(), inverted.Width(), inverted.Height())
+	}
+}
+
+// TestBoxExtend grows a box point by point and by boxes overlapping it, inside
+// it and apart from it
+func TestBoxExtend(t *testing.T) {
+	box := NewBox()
+	box.Extend(Box{MinX: 5, MinY: 5, MaxX: 5, MaxY: 5})
+	if !box.IsValid() || box.Width() != 0 || box.Height() != 0 || !box.Contains(5, 5) {
+		t.Fatalf("box of a point %+v, want a valid box of no size holding it", box)
+	}
+	for _, step := range []struct {
+		other Box
+		want  Box
+	}{
+		{Box{MinX: -10, MinY: 0, MaxX: 0, MaxY: 10}, Box{MinX: -10, MinY: 0, MaxX: 5, MaxY: 10}},
+		{Box{MinX: -5, MinY: 2, MaxX: 1, MaxY: 3}, Box{MinX: -10, MinY: 0, MaxX: 5, MaxY: 10}},
+		{Box{MinX: 100, MinY: -50, MaxX: 120, MaxY: -40}, Box{MinX: -10, MinY: -50, MaxX: 120, MaxY: 10}},
+	} {
+		box.Extend(step.other)
+		if box != step.want {
+			t.Fatalf("extended by %+v = %+v, want %+v", step.other, box, step.want)
+		}
+	}
+	if box.Width() != 130 || box.Height() != 60 {
+		t.Errorf("box of %g x %g, want 130 x 60", box.Width(), box.Height())
+	}
+	if lng, lat := box.Center(); lng != 55 || lat != -20 {
+		t.Errorf("center %g, %g, want 55, -20", lng, lat)
+	}
+}
+
+// TestBoxContainsAndIntersects checks borders count as inside, and that boxes
+// touching at an edge or a corner intersect while the empty box meets nothing
+func TestBoxContainsAndIntersects(t *testing.T) {
+	box := Box{MinX: 0, MinY: 0, MaxX: 10, MaxY: 10}
+	for _, tc := range []struct {
+		lng, lat float64
+		want     bool
+	}{
+		{5, 5, true}, {0, 0, true}, {10, 10, true}, {0, 10, true},
+		{-0.000001, 5, false}, {5, 10.000001, false}, {20, 20, false},
+	} {
+		if got := box.Contains(tc.lng, tc.lat); got != tc.want {
+			t.Errorf("Contains(%g, %g) = %v, want %v", tc.lng, tc.lat, got, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		name  string
+		other Box
+		want  bool
+	}{
+		{"overlapping", Box{MinX: 5, MinY: 5, MaxX: 15, MaxY: 15}, true},
+		{"inside", Box{MinX: 2, MinY: 2, MaxX: 3, MaxY: 3}, true},
+		{"around", Box{MinX: -5, MinY: -5, MaxX: 15, MaxY: 15}, true},
+		{"sharing an edge", Box{MinX: 10, MinY: 0, MaxX: 20, MaxY: 10}, true},
+		{"sharing a corner", Box{MinX: 10, MinY: 10, MaxX: 20, MaxY: 20}, true},
+		{"a point on the border", Box{MinX: 10, MinY: 5, MaxX: 10, MaxY: 5}, true},
+		{"east of it", Box{MinX: 10.5, MinY: 0, MaxX: 20, MaxY: 10}, false},
+		{"north of it", Box{MinX: 0, MinY: 11, MaxX: 10, MaxY: 20}, false},
+		{"empty", NewBox(), false},
+		{"inverted", Box{MinX: 8, MinY: 8, MaxX: 2, MaxY: 2}, false},
+	} {
+		if got := box.Intersects(tc.other); got != tc.want {
+			t.Errorf("%s: Intersects = %v, want %v", tc.name, got, tc.want)
+		}
+		if got := tc.other.Intersects(box); got != tc.want {
+			t.Errorf("%s: reverse Intersects = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	if NewBox().Intersects(NewBox()) {
+		t.Error("the empty box intersects itself")
+	}
+}
+
+// TestBoxClamp checks boxes are cut to the WGS84 range, and ones entirely
+// outside it become empty
+func TestBoxClamp(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		box  Box
+		want Box
+	}{
+		{"inside", Box{MinX: -10, MinY: -10, MaxX: 10, MaxY: 10}, Box{MinX: -10, MinY: -10, MaxX: 10, MaxY: 10}},
+		{"whole world", Box{MinX: -180, MinY: -90, MaxX: 180, MaxY: 90}, Box{MinX: -180, MinY: -90, MaxX: 180, MaxY: 90}},
+		{"past every edge", Box{MinX: -200, MinY: -95, MaxX: 200, MaxY: 95}, Box{MinX: -180, MinY: -90, MaxX: 180, MaxY: 90}},
+		{"past the antimeridian", Box{MinX: 170, MinY: 0, MaxX: 190, MaxY: 10}, Box{MinX: 170, MinY: 0, MaxX: 180, MaxY: 10}},
+		{"touching the edge from outside", Box{MinX: 180, MinY: 0, MaxX: 190, MaxY: 10}, Box{MinX: 180, MinY: 0, MaxX: 180, MaxY: 10}},
+		{"outside", Box{MinX: 190, MinY: 0, MaxX: 200, MaxY: 10}, NewBox()},
+		{"above the pole", Box{MinX: 0, MinY: 91, MaxX: 10, MaxY: 95}, NewBox()},
+		{"empty", NewBox(), NewBox()},
+	} {
+		if got := tc.box.Clamp(); got != tc.want {
+			t.Errorf("%s: Clamp = %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// TestBoxJSON checks boxes marshal to [minx, miny, maxx, maxy] and back, the
+// empty box to null, and that malformed and inverted arrays are refused
+func TestBoxJSON(t *testing.T) {
+	for _, tc := range []struct {
+		box  Box
+		json string
+	}{
+		{Box{MinX: -180, MinY: -85.5, MaxX: 180, MaxY: 85.5}, `[-180,-85.5,180,85.5]`},
+		{Box{MinX: 1, MinY: 2, MaxX: 1, MaxY: 2}, `[1,2,1,2]`},
+		{NewBox(), `null`},
+	} {
+		data, err := json.Marshal(tc.box)
+		if err != nil || string(data) != tc.json {
+			t.Errorf("Marshal(%+v) = %s, %v, want %s", tc.box, data, err, tc.json)
+		}
+		var decoded Box
+		if err := json.Unmarshal([]byte(tc.json), &decoded); err != nil || decoded != tc.box {
+			t.Errorf("Unmarshal(%s) = %+v, %v, want %+v", tc.json, decoded, err, tc.box)
+		}
+	}
+	if data, _ := json.Marshal(Box{MinX: 1, MinY: 1, MaxX: 0, MaxY: 0}); string(data) != "null" {
+		t.Errorf("inverted box marshalled to %s, want null", data)
+	}
+	// null in a document empties the box decoded into
+	var doc struct {
+		Extent Box `json:"extent"`
+	}
+	doc.Extent.Set(1, 2, 3, 4)
+	if err := json.Unmarshal([]byte(`{"extent":null}`), &doc); err != nil || !doc.Extent.IsEmpty() {
+		t.Errorf("null extent: %+v, %v, want the empty box", doc.Extent, err)
+	}
+	for _, bad := range []string{`[1,2,3]`, `[-1,-2,3]`, `[1,2,3,4,5]`, `[]`, `{"minx":1}`, `"1,2,3,4"`, `[3,2,1,4]`, `[1,4,3,2]`} {
+		var box Box
+		if err := json.Unmarshal([]byte(bad), &box); err == nil {
+			t.Errorf("Unmarshal(%s) = %+v, want an error", bad, box)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package sfile
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultCatalogTTL is how long a RepositoryCatalog serves a scan before it rescans
+const DefaultCatalogTTL = 30 * time.Second
+
+// RepositoryCatalog keeps the repositories found by ScanRepositories so the root
+// is not walked and every repository.json parsed on each listing. A scan older
+// than the TTL, or one invalidated after a change, is still served while a single
+// rescan runs in the background; only the very first listing waits for a scan.
+type RepositoryCatalog struct {
+	root string
+
+	mu           sync.Mutex
+	options      ScanOptions
+	ttl          time.Duration
+	repositories []Repository
+	scannedAt    time.Time
+	generation   int64         // bumped by Invalidate, a scan started before is stale when done
+	scanned      int64         // generation the cached scan was started at
+	refreshing   chan struct{} // closed when the running scan ends, nil when none runs
+	rescanAfter  bool          // scan again once the running scan ends, it started before a change
+	err          error         // error of the last scan, kept until a scan succeeds
+}
+
+// NewRepositoryCatalog creates a catalog of the repositories under root, scanned
+// with DefaultScanOptions and kept for DefaultCatalogTTL
+func NewRepositoryCatalog(root string) *RepositoryCatalog {
+	return &RepositoryCatalog{root: root, options: DefaultScanOptions, ttl: DefaultCatalogTTL}
+}
+
+// SetScanOptions changes how repositories are discovered and invalidates the catalog
+func (c *RepositoryCatalog) SetScanOptions(opts ScanOptions) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.options = opts
+	c.generation++
+}
+
+// scanOptions returns how repositories are discovered
+func (c *RepositoryCatalog) scanOptions() ScanOptions {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.options
+}
+
+// SetTTL changes how long a scan is served before the root is scanned again,
+// 0 rescans on every listing while still serving the previous scan
+func (c *RepositoryCatalog) SetTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ttl = max(ttl, 0)
+}
+
+// Invalidate marks the cached scan as outdated, the next listing starts a rescan.
+// Operations creating, deleting or changing repositories call it.
+func (c *RepositoryCatalog) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+}
+
+// Lookup returns the repository named name from the catalog, refreshing it like List
+func (c *RepositoryCatalog) Lookup(name string) (Repository, bool) {
+	repositories, _, err := c.List()
+	if err != nil {
+		return Repository{}, false
+	}
+	for _, repo := range repositories {
+		if repo.Name == name {
+			return repo, true
+		}
+	}
+	return Repository{}, false
+}
+
+// rescan invalidates the cached scan and starts scanning at once, so the next
+// listing already holds the change
+func (c *RepositoryCatalog) rescan() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if c.refreshing != nil {
+		c.rescanAfter = true
+		return
+	}
+	c.refresh()
+}
+
+// Len returns the number of repositories held by the cached scan
+func (c *RepositoryCatalog) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.repositories)
+}
+
+// List returns a copy of the cached repositories and when they were scanned. An
+// outdated scan is returned at once while a rescan starts in the background;
+// only when nothing was scanned yet does List wait for the scan.
+func (c *RepositoryCatalog) List() ([]Repository, time.Time, error) {
+	c.mu.Lock()
+	if c.repositories == nil {
+		done := c.refresh()
+		c.mu.Unlock()
+		<-done
+		c.mu.Lock()
+		if c.repositories == nil {
+			err := c.err
+			c.mu.Unlock()
+			return nil, time.Time{}, err
+		}
+	} else if c.scanned != c.generation || time.Since(c.scannedAt) >= c.ttl {
+		c.refresh()
+	}
+	defer c.mu.Unlock()
+	return append(make([]Repository, 0, len(c.repositories)), c.repositories...), c.scannedAt, nil
+}
+
+// refresh starts a scan unless one is running and returns a channel closed when
+// it ends. The caller must hold c.mu.
+func (c *RepositoryCatalog) refresh() <-chan struct{} {
+	if c.refreshing != nil {
+		return c.refreshing
+	}
+	done := make(chan struct{})
+	c.refreshing = done
+	root, options, generation := c.root, c.options, c.generation
+	go func() {
+		defer close(done)
+		startedAt := time.Now()
+		repositories, err := ScanRepositories(root, options)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.refreshing = nil
+		if c.rescanAfter {
+			defer c.refresh()
+			c.rescanAfter = false
+		}
+		if err != nil {
+			c.err = err
+			RecordError("catalog", fmt.Errorf("scanning %s: %w", root, err))
+			if c.repositories != nil {
+				// keep serving the previous scan, retrying once the TTL has passed
+				c.scannedAt, c.scanned = startedAt, generation
+			}
+			return
+		}
+		if repositories == nil {
+			repositories = make([]Repository, 0)
+		}
+		c.repositories, c.scannedAt, c.scanned, c.err = repositories, startedAt, generation, nil
+	}()
+	return done
+}
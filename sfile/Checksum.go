@@ -0,0 +1,334 @@
+package sfile
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// checksumAlgorithm is recorded under the checksum key of the meta table of a
+// .s file once its tile tables may carry a Checksum column, the CRC-32C of the
+// blob of the row. A file without it, or with another algorithm, has no
+// checksum this version can verify; blobs of deduplicated rows are still
+// verified against the SHA-256 in their Hash column.
+const checksumAlgorithm = "crc32c"
+
+// maxChecksumMismatches bounds the mismatching tiles listed in a ChecksumReport
+const maxChecksumMismatches = 1000
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// checksumWrites makes the write path record checksums, see SetChecksumWrites
+	checksumWrites atomic.Bool
+	// verifyReads makes getXYZ check the blobs it reads, see SetVerifyReads
+	verifyReads atomic.Bool
+	// checksumMismatches counts the tiles read whose blob did not match its checksum
+	checksumMismatches atomic.Int64
+)
+
+// SetChecksumWrites makes WriteXYZ and imports record the CRC-32C of every blob
+// they store, adding a Checksum column to the tables written to. Tiles written
+// without it lose their checksum, so a replaced tile is never checked against
+// the checksum of the blob it replaced.
+func SetChecksumWrites(enabled bool) {
+	checksumWrites.Store(enabled)
+}
+
+// SetVerifyReads makes every tile read from a .s file be checked against its
+// checksum. A mismatch is logged and counted, see ChecksumMismatches, and the
+// tile is still served unless it is quarantined, see SetQuarantine.
+func SetVerifyReads(enabled bool) {
+	verifyReads.Store(enabled)
+}
+
+// ChecksumMismatches returns how many tiles read did not match their checksum
+func ChecksumMismatches() int64 {
+	return checksumMismatches.Load()
+}
+
+// tileChecksum is the checksum recorded for a blob
+func tileChecksum(data []byte) int64 {
+	return int64(crc32.Checksum(data, crc32c))
+}
+
+// shardChecksum returns the checksum algorithm recorded in the meta table of a .s file, "" for none
+func shardChecksum(db queryRower) (string, error) {
+	var algorithm string
+	err := db.QueryRow("select value from meta where key = 'checksum'").Scan(&algorithm)
+	if err != nil && (errors.Is(err, sql.ErrNoRows) || strings.Contains(err.Error(), "no such table")) {
+		return "", nil
+	}
+	return algorithm, err
+}
+
+// createShardTable creates the shard table tableName in the file written in tx
+// when it does not exist yet and, with checksum writes enabled, makes sure it has
+// a Checksum column and the file records the checksum algorithm
+func createShardTable(tx *sql.Tx, tableName string, dedup bool) error {
+	if _, err := tx.Exec(createTableSql(tableName, dedup)); err != nil {
+		return err
+	}
+	if !checksumWrites.Load() {
+		return nil
+	}
+	var hasChecksum int
+	if err := tx.QueryRow("select count(*) from pragma_table_info(?) where name = 'Checksum'", tableName).Scan(&hasChecksum); err != nil {
+		return err
+	}
+	if hasChecksum == 0 {
+		if _, err := tx.Exec("alter table " + tableName + " add column Checksum INTEGER"); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("create table if not exists meta (key TEXT PRIMARY KEY, value TEXT)"); err != nil {
+		return err
+	}
+	_, err := tx.Exec("insert or replace into meta (key, value) values ('checksum', ?)", checksumAlgorithm)
+	return err
+}
+
+// checksumColumns returns the expressions selecting the Checksum and the Hash of
+// the rows of tableName, NULL for a column the table does not have or whose
+// algorithm is unknown, or "" when no row of the table can be verified
+func checksumColumns(db *sql.DB, tableName string, algorithm string) (string, error) {
+	rows, err := db.Query("select name from pragma_table_info(?)", tableName)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	checksum, hash := "NULL", "NULL"
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return "", err
+		}
+		if name == "Checksum" && algorithm == checksumAlgorithm {
+			checksum = "Checksum"
+		} else if name == "Hash" {
+			hash = "Hash"
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	if checksum == "NULL" && hash == "NULL" {
+		return "", nil
+	}
+	return checksum + ", " + hash, nil
+}
+
+// matchChecksum reports whether data matches the checksum and the hash stored
+// with it, and whether either was stored at all
+func matchChecksum(data []byte, checksum sql.NullInt64, hash []byte) (match bool, verifiable bool) {
+	match = true
+	if checksum.Valid {
+		verifiable = true
+		match = tileChecksum(data) == checksum.Int64
+	}
+	if len(hash) == sha256.Size {
+		verifiable = true
+		sum := sha256.Sum256(data)
+		match = match && bytes.Equal(sum[:], hash)
+	}
+	return match, verifiable
+}
+
+// checksumQuery returns the query reading the checksums of a row of tableName,
+// "" when the table has none, looking at the columns of the table only once
+func (e *handleEntry) checksumQuery(tableName string) (string, error) {
+	e.stmtMu.Lock()
+	query, ok := e.checksumQueries[tableName]
+	e.stmtMu.Unlock()
+	if ok {
+		return query, nil
+	}
+	columns, err := checksumColumns(e.db, tableName, e.checksum)
+	if err != nil {
+		return "", err
+	}
+	if columns != "" {
+		query = "select " + columns + " from " + tableName + " where ID=?"
+	}
+	e.stmtMu.Lock()
+	if e.checksumQueries == nil {
+		e.checksumQueries = make(map[string]string)
+	}
+	e.checksumQueries[tableName] = query
+	e.stmtMu.Unlock()
+	return query, nil
+}
+
+// verifyTile checks data, just read from row id of tableName, against the
+// checksums stored with it, logging and counting a mismatch, and reports whether
+// it matched. Rows without a checksum and failures to read it are let through.
+func (e *handleEntry) verifyTile(ctx context.Context, tableName string, id int64, data []byte, tile TileCoord) bool {
+	query, err := e.checksumQuery(tableName)
+	if err != nil || query == "" {
+		return true
+	}
+	stmt, err := e.statement(ctx, query)
+	if err != nil {
+		return true
+	}
+	var checksum sql.NullInt64
+	var hash []byte
+	if err := stmt.QueryRowContext(ctx, id).Scan(&checksum, &hash); err != nil {
+		return true
+	}
+	match, _ := matchChecksum(data, checksum, hash)
+	if !match {
+		checksumMismatches.Add(1)
+		err := fmt.Errorf("tile %d/%d/%d in %s does not match its checksum", tile.Z, tile.X, tile.Y, e.path)
+		log.Print(err)
+		RecordError("sfile", err)
+	}
+	return match
+}
+
+// ChecksumMismatch is a tile whose blob does not match its checksum
+type ChecksumMismatch struct {
+	TileCoord
+	File string `json:"file"` // relative to the repository directory
+}
+
+// ChecksumReport is the result of VerifyChecksums
+type ChecksumReport struct {
+	Files        int                `json:"files"`
+	Tiles        int64              `json:"tiles"` // tiles read, the sampled ones only when sampling
+	Verified     int64              `json:"verified"`
+	Unverifiable int64              `json:"unverifiable"` // stored without a checksum, by older versions or with checksum writes off
+	Mismatched   int64              `json:"mismatched"`
+	Mismatches   []ChecksumMismatch `json:"mismatches"` // the first maxChecksumMismatches of them
+	Findings     []Finding          `json:"findings"`   // files that could not be read
+}
+
+// Valid reports whether every tile read matched its checksum and every file could be read
+func (r ChecksumReport) Valid() bool {
+	return r.Mismatched == 0 && len(r.Findings) == 0
+}
+
+// VerifyChecksums reads the tiles of every .s file of the repository in dir and
+// checks each blob against the checksum recorded when it was written, or the
+// SHA-256 of a deduplicated blob. With sample between 0 and 1 only that fraction
+// of the tiles, picked at random, is read. Tiles stored without a checksum are
+// counted as unverifiable. Files that cannot be read are reported as findings
+// and never stop the verification; an error is only returned when the repository
+// itself cannot be listed. The files are opened read only.
+func VerifyChecksums(dir string, sample float64) (ChecksumReport, error) {
+	report := ChecksumReport{Mismatches: make([]ChecksumMismatch, 0), Findings: make([]Finding, 0)}
+	subDirs, err := listSubDir(dir)
+	if err != nil {
+		return report, err
+	}
+	scheme, err := repositoryScheme(dir)
+	if err != nil {
+		return report, err
+	}
+	for _, sub := range subDirs {
+		files, err := listAllFile(sub)
+		if err != nil {
+			return report, err
+		}
+		for _, file := range files {
+			name, err := filepath.Rel(dir, file)
+			if err != nil {
+				name = file
+			}
+			report.Files++
+			if err := verifyShard(file, filepath.ToSlash(name), scheme, sample, &report); err != nil {
+				report.Findings = append(report.Findings, Finding{File: filepath.ToSlash(name), Severity: SeverityError, Message: err.Error()})
+			}
+		}
+	}
+	return report, nil
+}
+
+// verifyShard adds the tiles of one .s file to report
+func verifyShard(filePath string, name string, scheme ShardScheme, sample float64, report *ChecksumReport) error {
+	db, err := openShardForRead(filePath)
+	if err != nil {
+		return fmt.Errorf("cannot open: %w", err)
+	}
+	defer closeShard(db)
+	algorithm, err := shardChecksum(db)
+	if err != nil {
+		return err
+	}
+	tableNames, err := listTables(db)
+	if err != nil {
+		return err
+	}
+	where := ""
+	if sample > 0 && sample < 1 {
+		// random() is uniform over 64 bits, so are its low 20 bits
+		where = fmt.Sprintf(" where (random() & 1048575) < %d", int64(sample*1048576))
+	}
+	for _, tableName := range tableNames {
+		if !validTableName.MatchString(tableName) {
+			continue
+		}
+		z, tableX, tableY, ok := parseShardName(tableName)
+		if !ok {
+			continue
+		}
+		columns, err := checksumColumns(db, tableName, algorithm)
+		if err != nil {
+			return err
+		}
+		if columns == "" {
+			// nothing of the table can be verified, only count its tiles
+			var tiles int64
+			if err := db.QueryRow("select count(*) from " + tableName + where).Scan(&tiles); err != nil {
+				return err
+			}
+			report.Tiles += tiles
+			report.Unverifiable += tiles
+			continue
+		}
+		// only deduplicated files have a Hash column, and the blobs table with it
+		dedup := strings.HasSuffix(columns, ", Hash")
+		rows, err := db.Query("select ID, " + tileData(tableName, dedup) + ", " + columns + " from " + tableName + where)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id int64
+			var data []byte
+			var checksum sql.NullInt64
+			var hash []byte
+			if err := rows.Scan(&id, &data, &checksum, &hash); err != nil {
+				rows.Close()
+				return err
+			}
+			report.Tiles++
+			match, verifiable := matchChecksum(data, checksum, hash)
+			switch {
+			case !verifiable:
+				report.Unverifiable++
+			case match:
+				report.Verified++
+			default:
+				report.Mismatched++
+				if len(report.Mismatches) < maxChecksumMismatches {
+					x, y := scheme.tileOf(tableX, tableY, id)
+					tile := TileCoord{Z: z, X: x, Y: y}
+					report.Mismatches = append(report.Mismatches, ChecksumMismatch{TileCoord: tile, File: name})
+				}
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package sfile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// CloneOptions controls Clone
+type CloneOptions struct {
+	Context  context.Context // cancels the clone, which then leaves nothing behind; never cancelled when nil
+	Root     string          // directory the new repository is named in, the parent of srcDir when ""
+	MinZoom  *int8           // lowest zoom copied, no limit when nil
+	MaxZoom  *int8           // highest zoom copied, no limit when nil
+	Progress func(CloneProgress)
+}
+
+// CloneProgress counts the .s files copied so far
+type CloneProgress struct {
+	Files      int   `json:"files"`
+	TotalFiles int   `json:"total_files"`
+	Bytes      int64 `json:"bytes"`
+	TotalBytes int64 `json:"total_bytes"`
+}
+
+// includes reports whether zoom z is selected by opts
+func (opts CloneOptions) includes(z int8) bool {
+	return (opts.MinZoom == nil || z >= *opts.MinZoom) && (opts.MaxZoom == nil || z <= *opts.MaxZoom)
+}
+
+// Clone copies the repository at srcDir into a new repository named dstName,
+// file by file rather than tile by tile, in the layout of the source. Only the
+// zoom directories selected by opts are copied and the repository.json of the
+// source, when there is one, is written with the new name and zoom range. The
+// copy is made in a hidden directory next to the destination and moved into
+// place once complete, so a failed or cancelled clone leaves nothing behind. An
+// existing destination is ErrRepositoryExists.
+func Clone(srcDir string, dstName string, opts CloneOptions) error {
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if opts.MinZoom != nil && opts.MaxZoom != nil && *opts.MinZoom > *opts.MaxZoom {
+		return fmt.Errorf("%w: the lowest zoom is above the highest", ErrZoomOutOfRange)
+	}
+	root := opts.Root
+	if root == "" {
+		root = filepath.Dir(srcDir)
+	}
+	if dstName == "" || !filepath.IsLocal(filepath.FromSlash(dstName)) {
+		return fmt.Errorf("invalid repository name %q", dstName)
+	}
+	dstDir := filepath.Join(root, filepath.FromSlash(dstName))
+	if info, err := os.Stat(srcDir); err != nil || !info.IsDir() {
+		return fmt.Errorf("%w: %s", ErrRepositoryNotFound, srcDir)
+	}
+	if _, err := os.Stat(dstDir); err == nil {
+		return fmt.Errorf("%w: %s", ErrRepositoryExists, dstDir)
+	}
+	if rel, err := filepath.Rel(srcDir, dstDir); err == nil && filepath.IsLocal(rel) {
+		return fmt.Errorf("cannot clone %s into itself", srcDir)
+	}
+
+	subDirs, err := listSubDir(srcDir)
+	if err != nil {
+		return err
+	}
+	files := make([]string, 0)
+	zooms := make([]int, 0)
+	progress := CloneProgress{}
+	for _, sub := range subDirs {
+		if !opts.includes(subDirZoom(sub)) {
+			continue
+		}
+		subFiles, err := listAllFile(sub)
+		if err != nil {
+			return err
+		}
+		if len(subFiles) > 0 {
+			zooms = append(zooms, int(subDirZoom(sub)))
+		}
+		for _, file := range subFiles {
+			if info, err := os.Stat(file); err == nil {
+				progress.TotalBytes += info.Size()
+			}
+		}
+		files = append(files, subFiles...)
+	}
+	progress.TotalFiles = len(files)
+
+	if err := os.MkdirAll(filepath.Dir(dstDir), 0755); err != nil {
+		return fmt.Errorf("failed to create parent directory: %w", err)
+	}
+	tmpDir, err := os.MkdirTemp(filepath.Dir(dstDir), "."+filepath.Base(dstDir)+".clone-")
+	if err != nil {
+		return fmt.Errorf("failed to create clone directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		return err
+	}
+
+	if !readOnlyStorage(srcDir) {
+		// writers of other processes must not change the files halfway through their copy
+		unlock, err := lockRepository(srcDir)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(srcDir, file)
+		if err != nil {
+			return err
+		}
+		size, err := cloneShard(file, filepath.Join(tmpDir, rel))
+		if err != nil {
+			return fmt.Errorf("copy %s: %w", filepath.ToSlash(rel), err)
+		}
+		progress.Files++
+		progress.Bytes += size
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+	}
+	if err := cloneRepositoryInfo(srcDir, tmpDir, dstName, zooms, progress.Bytes); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpDir, dstDir); err != nil {
+		return fmt.Errorf("failed to move cloned repository into place: %w", err)
+	}
+	return nil
+}
+
+// cloneShard copies the .s file at filePath to target and returns the bytes
+// copied. Writers of this process are held off the file meanwhile. Its WAL goes
+// first, a checkpoint into the file during the copy is then still replayed
+// from it when the copy is opened.
+func cloneShard(filePath string, target string) (int64, error) {
+	absolute, err := filepath.Abs(filePath)
+	if err != nil {
+		return 0, err
+	}
+	value, _ := writeLocks.LoadOrStore(absolute, &sync.Mutex{})
+	lock := value.(*sync.Mutex)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return 0, err
+	}
+	if _, err := copyFile(absolute+"-wal", target+"-wal"); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	return copyFile(absolute, target)
+}
+
+// copyFile copies the file at src to the new file dst and returns its size
+func copyFile(src string, dst string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return size, err
+}
+
+// cloneRepositoryInfo writes the repository.json of the source, if it has one,
+// into dir with the new name and the zooms and size copied
+func cloneRepositoryInfo(srcDir string, dir string, dstName string, zooms []int, size int64) error {
+	repo, err := readRepositoryInfo(filepath.Dir(srcDir), filepath.Base(srcDir))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	repo.Name, repo.Url = dstName, dstName
+	repo.Size = float64(size)
+	repo.Layout = repositoryLayout(srcDir)
+	if len(zooms) > 0 {
+		repo.MinZoom, repo.MaxZoom = slices.Min(zooms), slices.Max(zooms)
+	}
+	data, err := json.MarshalIndent(repo, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal repository: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "repository.json"), data, 0644); err != nil {
+		return fmt.Errorf("failed to write repository.json: %w", err)
+	}
+	return nil
+}
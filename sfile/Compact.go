@@ -0,0 +1,211 @@
+package sfile
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// compactSuffix marks the copy a .s file is vacuumed into, listAllFile ignores it
+const compactSuffix = ".compact"
+
+// CompactOptions controls Compact
+type CompactOptions struct {
+	DryRun   bool // only report the space free pages take, without changing any file
+	Progress func(CompactProgress)
+}
+
+// CompactProgress counts the .s files compacted so far
+type CompactProgress struct {
+	Files   int `json:"files"`
+	Checked int `json:"checked"`
+}
+
+// CompactFile is what Compact found or did for one .s file
+type CompactFile struct {
+	File        string `json:"file"` // relative to the repository directory
+	FreePages   int64  `json:"free_pages"`
+	Reclaimable int64  `json:"reclaimable"` // bytes taken by free pages
+	Before      int64  `json:"before"`
+	After       int64  `json:"after"`
+	Error       string `json:"error,omitempty"`
+}
+
+// CompactReport is the result of Compact
+type CompactReport struct {
+	DryRun      bool          `json:"dry_run"`
+	Files       []CompactFile `json:"files"`
+	Compacted   int           `json:"compacted"`
+	Failed      int           `json:"failed"`
+	Reclaimable int64         `json:"reclaimable"`
+	BytesBefore int64         `json:"bytes_before"`
+	BytesAfter  int64         `json:"bytes_after"`
+	Saved       int64         `json:"saved"`
+}
+
+// Compact gives the free pages of the .s files of the repository in dir back to
+// the file system. Each file with free pages is vacuumed into a copy next to it
+// which then replaces it, so readers keep using the old file until the rename and
+// a failure never leaves a half written file behind. Writers of the file wait
+// meanwhile, and so do writers of other processes, see lockRepository. Files that
+// fail are reported and the others still compacted; an error is only returned
+// when the repository cannot be listed or stays locked by another process.
+func Compact(dir string, opts CompactOptions) (CompactReport, error) {
+	report := CompactReport{DryRun: opts.DryRun, Files: make([]CompactFile, 0)}
+	subDirs, err := listSubDir(dir)
+	if err != nil {
+		return report, err
+	}
+	if !opts.DryRun {
+		// held for the whole pass, so no other process writes in between files
+		unlock, err := lockRepository(dir)
+		if err != nil {
+			return report, err
+		}
+		defer unlock()
+	}
+	files := make([]string, 0)
+	for _, sub := range subDirs {
+		subFiles, err := listAllFile(sub)
+		if err != nil {
+			return report, err
+		}
+		files = append(files, subFiles...)
+	}
+	for i, file := range files {
+		name, err := filepath.Rel(dir, file)
+		if err != nil {
+			name = file
+		}
+		result := CompactFile{File: filepath.ToSlash(name)}
+		compacted, err := compactShard(file, opts.DryRun, &result)
+		if err != nil {
+			result.Error = err.Error()
+			report.Failed++
+			RecordError("sfile", fmt.Errorf("compacting %s: %w", file, err))
+		} else if compacted {
+			report.Compacted++
+		}
+		report.Files = append(report.Files, result)
+		report.Reclaimable += result.Reclaimable
+		report.BytesBefore += result.Before
+		report.BytesAfter += result.After
+		if opts.Progress != nil {
+			opts.Progress(CompactProgress{Files: len(files), Checked: i + 1})
+		}
+	}
+	report.Saved = report.BytesBefore - report.BytesAfter
+	if report.Compacted > 0 {
+		return report, recordRepositorySize(dir)
+	}
+	return report, nil
+}
+
+// compactShard fills result for one .s file and, unless dryRun, vacuums it when
+// it has free pages. It reports whether the file was replaced.
+func compactShard(filePath string, dryRun bool, result *CompactFile) (bool, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return false, err
+	}
+	result.Before, result.After = info.Size(), info.Size()
+	if dryRun {
+		db, err := openShardForRead(filePath)
+		if err != nil {
+			return false, err
+		}
+		defer closeShard(db)
+		return false, freePages(db, result)
+	}
+
+	absolute, err := filepath.Abs(filePath)
+	if err != nil {
+		return false, err
+	}
+	db, done, err := openShardForWrite(absolute)
+	if err != nil {
+		return false, err
+	}
+	defer done()
+	if err := freePages(db, result); err != nil || result.FreePages == 0 {
+		return false, err
+	}
+
+	// a WAL left behind would be replayed onto the compacted file, so it is
+	// emptied first; the write lock is held from here on, so no tile written
+	// meanwhile is lost
+	if err := truncateWAL(db); err != nil {
+		return false, err
+	}
+	tmp := absolute + compactSuffix
+	_ = os.Remove(tmp)
+	if _, err := db.Exec("vacuum into ?", tmp); err != nil {
+		_ = os.Remove(tmp)
+		return false, err
+	}
+	if err := os.Chmod(tmp, info.Mode().Perm()); err != nil {
+		_ = os.Remove(tmp)
+		return false, err
+	}
+	if err := os.Rename(tmp, absolute); err != nil {
+		_ = os.Remove(tmp)
+		return false, err
+	}
+	// readers that opened the old file keep it until they release their handle,
+	// new readers see a changed file and open the compacted one
+	handles.invalidate(absolute)
+	after, err := os.Stat(absolute)
+	if err != nil {
+		return true, err
+	}
+	result.After = after.Size()
+	return true, nil
+}
+
+// truncateWAL checkpoints every frame of the WAL of a shard in WAL mode into the
+// .s file and empties the WAL, failing when readers keep it from completing
+func truncateWAL(db *sql.DB) error {
+	var busy, frames, checkpointed int64
+	if err := db.QueryRow("pragma wal_checkpoint(truncate)").Scan(&busy, &frames, &checkpointed); err != nil {
+		return err
+	}
+	if busy != 0 {
+		return fmt.Errorf("the WAL could not be checkpointed, %d of %d frames are still in use", frames-checkpointed, frames)
+	}
+	return nil
+}
+
+// freePages records the free pages of the database and the bytes they take
+func freePages(db *sql.DB, result *CompactFile) error {
+	var count, pageSize int64
+	if err := db.QueryRow("pragma freelist_count").Scan(&count); err != nil {
+		return err
+	}
+	if err := db.QueryRow("pragma page_size").Scan(&pageSize); err != nil {
+		return err
+	}
+	result.FreePages = count
+	result.Reclaimable = count * pageSize
+	return nil
+}
+
+// recordRepositorySize updates the size recorded in repository.json after the .s
+// files changed size. Repositories without a repository.json only have their
+// tracked size updated.
+func recordRepositorySize(dir string) error {
+	_, size, err := shardZooms(dir)
+	if err != nil {
+		return err
+	}
+	trackSize(dir, size)
+	infoPath := filepath.Join(dir, "repository.json")
+	if _, err := os.Stat(infoPath); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return updateRepositoryInfo(dir, func(repo *Repository) error {
+		repo.Size = size
+		return nil
+	})
+}
@@ -0,0 +1,107 @@
+package sfile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"io"
+)
+
+// Text-like tiles, vector tiles, UTFGrids and JSON, of repositories with
+// Compress set are stored gzipped, with the encoding recorded in an Encoding
+// column added to a table the first time such a tile is written to it. Rows
+// without an encoding hold the tile as it was written, which is all older
+// files and readers know. Raster tiles are never recompressed, and neither are
+// tiles written gzipped already.
+
+// EncodingGzip is the Encoding of tiles stored gzipped, as sent in Content-Encoding
+const EncodingGzip = "gzip"
+
+// compressTile returns the blob to store for data in a repository compressing
+// its tiles and its encoding, data itself and "" when it is not worth compressing
+func compressTile(data []byte) ([]byte, string) {
+	switch tileFormat(data) {
+	case "pbf", "json":
+	default:
+		return data, ""
+	}
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		return data, ""
+	}
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		return data, ""
+	}
+	if err := writer.Close(); err != nil || buffer.Len() >= len(data) {
+		return data, ""
+	}
+	return buffer.Bytes(), EncodingGzip
+}
+
+// DecodeTile returns the tile stored as data with encoding, as it was written
+func DecodeTile(data []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "":
+		return data, nil
+	case EncodingGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return io.ReadAll(reader)
+	default:
+		return nil, fmt.Errorf("unknown tile encoding %q", encoding)
+	}
+}
+
+// encodeTile returns the blob to store for data and its encoding, compressing
+// it when the repository compresses its tiles
+func (f *SRepository) encodeTile(data []byte) ([]byte, string) {
+	if !f.compress {
+		return data, ""
+	}
+	return compressTile(data)
+}
+
+// addEncodingColumn adds the Encoding column to tableName of the file written in
+// tx unless it has one already
+func addEncodingColumn(tx *sql.Tx, tableName string) error {
+	var hasEncoding int
+	if err := tx.QueryRow("select count(*) from pragma_table_info(?) where name = 'Encoding'", tableName).Scan(&hasEncoding); err != nil {
+		return err
+	}
+	if hasEncoding > 0 {
+		return nil
+	}
+	_, err := tx.Exec("alter table " + tableName + " add column Encoding TEXT")
+	return err
+}
+
+// stampEncoding records encoding as the encoding of row id of tableName, adding
+// the Encoding column first when needed. Rows stored as written record nothing.
+func stampEncoding(tx *sql.Tx, tableName string, id int64, encoding string) error {
+	if encoding == "" {
+		return nil
+	}
+	if err := addEncodingColumn(tx, tableName); err != nil {
+		return err
+	}
+	_, err := tx.Exec("update "+tableName+" set Encoding = ? where ID = ?", encoding, id)
+	return err
+}
+
+// encodingColumn returns the expression reading the encoding of a row of
+// tableName, NULL when the table has no Encoding column
+func encodingColumn(db queryRower, tableName string) (string, error) {
+	var hasEncoding int
+	if err := db.QueryRow("select count(*) from pragma_table_info(?) where name = 'Encoding'", tableName).Scan(&hasEncoding); err != nil {
+		return "", err
+	}
+	if hasEncoding == 0 {
+		return "NULL", nil
+	}
+	return tableName + ".Encoding", nil
+}
@@ -0,0 +1,105 @@
+package sfile
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+// testVectorTile is a JSON tile, which compressing repositories store gzipped
+var testVectorTile = []byte(`{"type":"FeatureCollection","features":[` + strings.Repeat(`{"type":"Feature","properties":{"name":"road"}},`, 40) + `{}]}`)
+
+// testRasterTile is the start of a PNG, which is never recompressed
+var testRasterTile = append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 512)...)
+
+// TestCompressRoundTrip writes tiles to a compressing repository and reads them
+// back decompressed with GetXYZ and GetTile, and as stored with their encoding
+// with GetEncodedTile, which the HTTP layer passes through
+func TestCompressRoundTrip(t *testing.T) {
+	repo, _ := newTestRepository(t, `{"name":"repo","compress":true}`)
+	if err := repo.WriteXYZ(1, 1, 4, testVectorTile); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.WriteXYZ(2, 1, 4, testRasterTile); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("transparent", func(t *testing.T) {
+		for x, want := range map[int64][]byte{1: testVectorTile, 2: testRasterTile} {
+			got, err := repo.GetXYZ(x, 1, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("GetXYZ of tile %d read back %d bytes, want the %d written", x, got.Len(), len(want))
+			}
+			tile, err := repo.GetTile(context.Background(), 4, x, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tile.Encoding != "" || !bytes.Equal(tile.Data, want) {
+				t.Errorf("GetTile of tile %d read back %d bytes with encoding %q, want the %d written", x, len(tile.Data), tile.Encoding, len(want))
+			}
+		}
+	})
+	t.Run("passthrough", func(t *testing.T) {
+		vector, err := repo.GetEncodedTile(context.Background(), 4, 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vector.Encoding != EncodingGzip || len(vector.Data) >= len(testVectorTile) {
+			t.Fatalf("vector tile of %d bytes with encoding %q, want it gzipped", len(vector.Data), vector.Encoding)
+		}
+		if vector.ContentType != "application/json" {
+			t.Errorf("vector tile content type %q, want that of the tile rather than gzip", vector.ContentType)
+		}
+		decoded, err := DecodeTile(vector.Data, vector.Encoding)
+		if err != nil || !bytes.Equal(decoded, testVectorTile) {
+			t.Fatalf("decoding the stored vector tile: %v", err)
+		}
+		raster, err := repo.GetEncodedTile(context.Background(), 4, 2, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raster.Encoding != "" || !bytes.Equal(raster.Data, testRasterTile) {
+			t.Errorf("raster tile stored with encoding %q, want it as written", raster.Encoding)
+		}
+	})
+}
+
+// TestEncodingColumnAddedLater reads a table before it has an Encoding column,
+// then writes a compressed tile to it, which adds the column: the handle that
+// read the table must not serve the gzipped tile as written
+func TestEncodingColumnAddedLater(t *testing.T) {
+	repo, _ := newTestRepository(t, `{"name":"repo","compress":true}`)
+	if err := repo.WriteXYZ(0, 0, 3, testRasterTile); err != nil {
+		t.Fatal(err)
+	}
+	filePath, tableName, _ := repo.shardLocation(0, 0, 3)
+	shard, release, err := acquireShardRetrying(context.Background(), filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if _, err := shard.readTile(context.Background(), tableName, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.WriteXYZ(1, 0, 3, testVectorTile); err != nil {
+		t.Fatal(err)
+	}
+	row, err := shard.readTile(context.Background(), tableName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row.encoding.String != EncodingGzip {
+		t.Errorf("row written after the column was added read with encoding %q by the handle that read the table before", row.encoding.String)
+	}
+	got, err := repo.GetXYZ(1, 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), testVectorTile) {
+		t.Errorf("tile written after the column was added read back as %q", got.Bytes()[:min(got.Len(), 16)])
+	}
+}
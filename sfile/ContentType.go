@@ -0,0 +1,26 @@
+package sfile
+
+import "bytes"
+
+// DetectContentType guesses the MIME type of a stored tile from its leading bytes.
+// Tiles are mostly images, but repositories may also hold vector tiles, JSON
+// documents or arbitrary binary payloads, which end up as application/octet-stream.
+func DetectContentType(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "image/png"
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8, 0xff}):
+		return "image/jpeg"
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return "image/gif"
+	case len(data) >= 12 && bytes.Equal(data[0:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")):
+		return "image/webp"
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		return "application/gzip"
+	}
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		return "application/json"
+	}
+	return "application/octet-stream"
+}
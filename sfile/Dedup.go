@@ -0,0 +1,301 @@
+package sfile
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Versions of the layout of a .s file, recorded in its meta table. Files without
+// a meta table are version 1.
+const (
+	// shardSchemaPlain stores the blob of every tile in the Data column of its row
+	shardSchemaPlain = 1
+	// shardSchemaDedup adds a blobs table holding each distinct blob once. Tile rows
+	// reference it by the SHA-256 in their Hash column and leave Data NULL, rows
+	// written without deduplication still carry their own Data.
+	shardSchemaDedup = 2
+)
+
+// dedupWrites makes the write path store tiles deduplicated, see SetDedupWrites
+var dedupWrites atomic.Bool
+
+// SetDedupWrites makes WriteXYZ and imports store blobs once per .s file. Files
+// written to are converted to the deduplicated layout first; files that are not
+// written to are left as they are.
+func SetDedupWrites(enabled bool) {
+	dedupWrites.Store(enabled)
+}
+
+// queryRower is a *sql.DB or a *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// shardSchema returns the layout version of a .s file
+func shardSchema(db queryRower) (int, error) {
+	var value string
+	err := db.QueryRow("select value from meta where key = 'schema_version'").Scan(&value)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) || strings.Contains(err.Error(), "no such table") {
+			return shardSchemaPlain, nil
+		}
+		return 0, err
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema_version %q", value)
+	}
+	return version, nil
+}
+
+// tileData is the SQL expression reading the blob of a row of tableName, which in
+// a deduplicated file is either in the row or referenced from the blobs table
+func tileData(tableName string, dedup bool) string {
+	if !dedup {
+		return "Data"
+	}
+	return "coalesce(" + tableName + ".Data, (select blobs.Data from blobs where blobs.Hash = " + tableName + ".Hash))"
+}
+
+// createTableSql creates the shard table tableName in a file of the given layout
+func createTableSql(tableName string, dedup bool) string {
+	if dedup {
+		return "create table if not exists " + tableName + " (ID INTEGER PRIMARY KEY, X INTEGER, Y INTEGER, Data BLOB, Hash BLOB)"
+	}
+	return "create table if not exists " + tableName + " (ID INTEGER PRIMARY KEY, X INTEGER, Y INTEGER, Data BLOB)"
+}
+
+// prepareShardWrite returns whether the file written in tx is deduplicated,
+// converting it first when deduplicated writes are enabled
+func prepareShardWrite(tx *sql.Tx) (bool, error) {
+	if dedupWrites.Load() {
+		return true, upgradeShard(tx)
+	}
+	version, err := shardSchema(tx)
+	return version >= shardSchemaDedup, err
+}
+
+// insertTile writes a tile row with verb, "insert or replace" or "insert or
+// ignore", storing the blob in the blobs table when deduplicated writes are on
+// and its checksum when checksum writes are, see createShardTable. It returns
+// the number of tile rows written.
+func insertTile(tx execer, verb string, tableName string, id int64, x int64, y int64, data []byte, dedup bool) (int64, error) {
+	var result sql.Result
+	var err error
+	if dedup && dedupWrites.Load() {
+		hash := sha256.Sum256(data)
+		if _, err := tx.Exec("insert or ignore into blobs (Hash, Data) values (?, ?)", hash[:], data); err != nil {
+			return 0, err
+		}
+		result, err = tx.Exec(verb+" into "+tableName+" (ID, X, Y, Data, Hash) values (?, ?, ?, NULL, ?)", id, x, y, hash[:])
+	} else if checksumWrites.Load() {
+		result, err = tx.Exec(verb+" into "+tableName+" (ID, X, Y, Data, Checksum) values (?, ?, ?, ?, ?)", id, x, y, data, tileChecksum(data))
+	} else {
+		result, err = tx.Exec(verb+" into "+tableName+" (ID, X, Y, Data) values (?, ?, ?, ?)", id, x, y, data)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// upgradeShard converts the file of tx to the deduplicated layout without moving
+// any blob: it adds the meta and blobs tables and a Hash column to every table
+func upgradeShard(tx *sql.Tx) error {
+	version, err := shardSchema(tx)
+	if err != nil || version >= shardSchemaDedup {
+		return err
+	}
+	statements := []string{
+		"create table if not exists meta (key TEXT PRIMARY KEY, value TEXT)",
+		"create table if not exists blobs (Hash BLOB PRIMARY KEY, Data BLOB)",
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	tableNames, err := listTileTables(tx)
+	if err != nil {
+		return err
+	}
+	for _, tableName := range tableNames {
+		var hasHash int
+		if err := tx.QueryRow("select count(*) from pragma_table_info(?) where name = 'Hash'", tableName).Scan(&hasHash); err != nil {
+			return err
+		}
+		if hasHash == 0 {
+			if _, err := tx.Exec("alter table " + tableName + " add column Hash BLOB"); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = tx.Exec("insert or replace into meta (key, value) values ('schema_version', ?)", strconv.Itoa(shardSchemaDedup))
+	return err
+}
+
+// listTileTables returns the shard tables of the file of tx
+func listTileTables(tx *sql.Tx) ([]string, error) {
+	rows, err := tx.Query("select name from sqlite_master where type = 'table' order by name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tableNames := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if validTableName.MatchString(name) {
+			tableNames = append(tableNames, name)
+		}
+	}
+	return tableNames, rows.Err()
+}
+
+// DedupResult reports what Deduplicate did to a repository
+type DedupResult struct {
+	Files       int   `json:"files"`
+	Tiles       int64 `json:"tiles"` // tiles moved to the blobs table
+	Blobs       int64 `json:"blobs"` // distinct blobs stored over all files
+	BytesBefore int64 `json:"bytes_before"`
+	BytesAfter  int64 `json:"bytes_after"`
+	Saved       int64 `json:"saved"`
+}
+
+// Deduplicate rewrites every .s file of the repository in dir into the
+// deduplicated layout, storing each distinct blob once per file, drops blobs no
+// tile references any more and compacts the files. Files already deduplicated
+// are processed again, which picks up tiles written since without deduplication.
+func Deduplicate(dir string) (DedupResult, error) {
+	var result DedupResult
+	subDirs, err := listSubDir(dir)
+	if err != nil {
+		return result, err
+	}
+	for _, sub := range subDirs {
+		files, err := listAllFile(sub)
+		if err != nil {
+			return result, err
+		}
+		for _, file := range files {
+			if err := dedupShard(file, &result); err != nil {
+				return result, fmt.Errorf("deduplicating %s: %w", file, err)
+			}
+		}
+	}
+	result.Saved = result.BytesBefore - result.BytesAfter
+	return result, nil
+}
+
+// dedupShard rewrites one .s file and adds its numbers to result
+func dedupShard(filePath string, result *DedupResult) error {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	db, done, err := openShardForWrite(filePath)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	moved, err := dedupTables(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	// only a vacuum gives the space of the duplicates back to the file system
+	if _, err := db.Exec("vacuum"); err != nil {
+		return err
+	}
+	var blobs int64
+	if err := db.QueryRow("select count(*) from blobs").Scan(&blobs); err != nil {
+		return err
+	}
+	after, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	result.Files++
+	result.Tiles += moved
+	result.Blobs += blobs
+	result.BytesBefore += info.Size()
+	result.BytesAfter += after.Size()
+	return nil
+}
+
+// dedupTables moves the blobs of every tile row into the blobs table and deletes
+// the blobs no row references, returning how many rows were moved
+func dedupTables(tx *sql.Tx) (int64, error) {
+	if err := upgradeShard(tx); err != nil {
+		return 0, err
+	}
+	tableNames, err := listTileTables(tx)
+	if err != nil {
+		return 0, err
+	}
+	var moved int64
+	for _, tableName := range tableNames {
+		rows, err := tx.Query("select ID, Data from " + tableName + " where Data is not null")
+		if err != nil {
+			return moved, err
+		}
+		type tileRow struct {
+			id   int64
+			data []byte
+		}
+		tiles := make([]tileRow, 0)
+		for rows.Next() {
+			var tile tileRow
+			if err := rows.Scan(&tile.id, &tile.data); err != nil {
+				rows.Close()
+				return moved, err
+			}
+			tiles = append(tiles, tile)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return moved, err
+		}
+		for _, tile := range tiles {
+			hash := sha256.Sum256(tile.data)
+			if _, err := tx.Exec("insert or ignore into blobs (Hash, Data) values (?, ?)", hash[:], tile.data); err != nil {
+				return moved, err
+			}
+			if _, err := tx.Exec("update "+tableName+" set Data = NULL, Hash = ? where ID = ?", hash[:], tile.id); err != nil {
+				return moved, err
+			}
+			moved++
+		}
+	}
+	return moved, deleteUnreferencedBlobs(tx, tableNames)
+}
+
+// deleteUnreferencedBlobs deletes the blobs no row of the tables references
+func deleteUnreferencedBlobs(tx *sql.Tx, tableNames []string) error {
+	referenced := "select Hash from blobs where 0"
+	if len(tableNames) > 0 {
+		selects := make([]string, 0, len(tableNames))
+		for _, tableName := range tableNames {
+			selects = append(selects, "select Hash from "+tableName+" where Hash is not null")
+		}
+		referenced = strings.Join(selects, " union ")
+	}
+	_, err := tx.Exec("delete from blobs where Hash not in (" + referenced + ")")
+	return err
+}
@@ -0,0 +1,73 @@
+package sfile
+
+import (
+	"database/sql"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// openHandles counts the shard databases currently opened through openShard
+var openHandles atomic.Int64
+
+// openShard opens a .s file with the SQLiteTuning, it must be released with closeShard
+func openShard(filePath string) (*sql.DB, error) {
+	db, err := sql.Open(shardDriver, filePath)
+	if err != nil {
+		return nil, err
+	}
+	openHandles.Add(1)
+	return db, nil
+}
+
+// closeShard closes a database opened by openShard
+func closeShard(db *sql.DB) error {
+	openHandles.Add(-1)
+	return db.Close()
+}
+
+// OpenHandles returns the number of shard databases currently open
+func OpenHandles() int64 {
+	return openHandles.Load()
+}
+
+// ErrorRecord is a failure kept in the recent errors ring buffer
+type ErrorRecord struct {
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`
+	Message string    `json:"message"`
+}
+
+// recentErrorsSize is how many failures RecentErrors remembers
+const recentErrorsSize = 100
+
+var (
+	recentErrorsMu   sync.Mutex
+	recentErrors     [recentErrorsSize]ErrorRecord
+	recentErrorsNext int
+	recentErrorsLen  int
+)
+
+// RecordError remembers err in the recent errors ring buffer, overwriting the
+// oldest entry once it is full. Source names the layer reporting the failure.
+func RecordError(source string, err error) {
+	if err == nil {
+		return
+	}
+	recentErrorsMu.Lock()
+	defer recentErrorsMu.Unlock()
+	recentErrors[recentErrorsNext] = ErrorRecord{Time: time.Now(), Source: source, Message: err.Error()}
+	recentErrorsNext = (recentErrorsNext + 1) % recentErrorsSize
+	recentErrorsLen = min(recentErrorsLen+1, recentErrorsSize)
+}
+
+// RecentErrors returns the remembered failures, most recent first
+func RecentErrors() []ErrorRecord {
+	recentErrorsMu.Lock()
+	defer recentErrorsMu.Unlock()
+	records := make([]ErrorRecord, 0, recentErrorsLen)
+	for i := 1; i <= recentErrorsLen; i++ {
+		records = append(records, recentErrors[(recentErrorsNext-i+recentErrorsSize)%recentErrorsSize])
+	}
+	return records
+}
@@ -0,0 +1,512 @@
+package sfile
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ShardDiff lists the tiles of one .s file that differ between two repositories,
+// as x, y pairs
+type ShardDiff struct {
+	File     string     `json:"file"` // relative to the repositories, slash separated
+	Zoom     int8       `json:"zoom"`
+	Added    [][2]int64 `json:"added,omitempty"`    // only in the source
+	Modified [][2]int64 `json:"modified,omitempty"` // in both, changed in the source
+	Deleted  [][2]int64 `json:"deleted,omitempty"`  // only in the destination
+}
+
+// DiffReport is the result of Diff. It is plain JSON, so a diff computed on one
+// machine can be applied with ApplyDiff on another.
+type DiffReport struct {
+	Source      string      `json:"source"`
+	Destination string      `json:"destination"`
+	Files       int         `json:"files"`     // .s files compared
+	Unchanged   int         `json:"unchanged"` // files of the same size and modification time on both sides, never opened
+	Added       int64       `json:"added"`
+	Modified    int64       `json:"modified"`
+	Deleted     int64       `json:"deleted"`
+	Shards      []ShardDiff `json:"shards"` // the files with differences
+}
+
+// Diff compares the repository at dstDir with the one at srcDir .s file by .s
+// file and lists the tiles the destination lacks, holds differently or has on
+// its own. Files of the same size and modification time on both sides, which is
+// what a previous copy preserving times leaves, are taken as equal without being
+// opened. The tiles of the other files are compared by their checksums when both
+// sides recorded one, else by their write times, a tile being modified when the
+// source wrote it after the destination did, and only else by their contents.
+// A missing destination is empty. Both repositories must use the same shard
+// scheme and grid unless one of them has no tiles.
+func Diff(srcDir string, dstDir string) (DiffReport, error) {
+	report := DiffReport{Source: srcDir, Destination: dstDir, Shards: make([]ShardDiff, 0)}
+	if info, err := os.Stat(srcDir); err != nil || !info.IsDir() {
+		return report, fmt.Errorf("%w: %s", ErrRepositoryNotFound, srcDir)
+	}
+	source, err := openRepository(srcDir)
+	if err != nil {
+		return report, err
+	}
+	srcFiles, err := repositoryShardFiles(srcDir)
+	if err != nil {
+		return report, err
+	}
+	dstFiles := make(map[string]string)
+	if _, err := os.Stat(dstDir); err == nil {
+		dest, err := openRepository(dstDir)
+		if err != nil {
+			return report, err
+		}
+		if dstFiles, err = repositoryShardFiles(dstDir); err != nil {
+			return report, err
+		}
+		if len(srcFiles) > 0 && len(dstFiles) > 0 {
+			if source.shards() != dest.shards() {
+				return report, fmt.Errorf("%w: %s is stored with %s, %s with %s", ErrShardSchemeMismatch, srcDir, source.shards(), dstDir, dest.shards())
+			}
+			if source.grid != dest.grid {
+				return report, fmt.Errorf("%w: %s is cut in the %s grid, %s in %s", ErrTileGridMismatch, srcDir, source.grid, dstDir, dest.grid)
+			}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return report, err
+	}
+
+	names := make([]string, 0, len(srcFiles)+len(dstFiles))
+	for name := range srcFiles {
+		names = append(names, name)
+	}
+	for name := range dstFiles {
+		if _, ok := srcFiles[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		report.Files++
+		srcFile, dstFile := srcFiles[name], dstFiles[name]
+		if srcFile != "" && dstFile != "" && sameShardFile(srcFile, dstFile) {
+			report.Unchanged++
+			continue
+		}
+		zoom, _ := shardZoom(name)
+		diff := ShardDiff{File: name, Zoom: zoom}
+		if err := diffShard(srcFile, dstFile, source.shards(), &diff); err != nil {
+			return report, fmt.Errorf("compare %s: %w", name, err)
+		}
+		if len(diff.Added)+len(diff.Modified)+len(diff.Deleted) == 0 {
+			continue
+		}
+		report.Added += int64(len(diff.Added))
+		report.Modified += int64(len(diff.Modified))
+		report.Deleted += int64(len(diff.Deleted))
+		report.Shards = append(report.Shards, diff)
+	}
+	return report, nil
+}
+
+// repositoryShardFiles returns the .s files of the repository in dir by their
+// path relative to it, slash separated
+func repositoryShardFiles(dir string) (map[string]string, error) {
+	subDirs, err := listSubDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]string)
+	for _, sub := range subDirs {
+		subFiles, err := listAllFile(sub)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range subFiles {
+			files[path.Base(sub)+"/"+path.Base(file)] = file
+		}
+	}
+	return files, nil
+}
+
+// sameShardFile reports whether two .s files, with their write-ahead logs, have
+// the same size and modification time
+func sameShardFile(a string, b string) bool {
+	size := func(filePath string) int64 {
+		var total int64
+		for _, file := range []string{filePath, filePath + "-wal"} {
+			if info, err := os.Stat(file); err == nil {
+				total += info.Size()
+			}
+		}
+		return total
+	}
+	return shardStamp(a).Equal(shardStamp(b)) && size(a) == size(b)
+}
+
+// diffRow is what tells the tile of a row apart without reading its blob
+type diffRow struct {
+	checksum sql.NullInt64
+	hash     []byte
+	written  sql.NullInt64
+	encoding string
+}
+
+// sameTile reports whether two rows hold the same tile and whether that could be
+// told from their checksums or write times. Checksums are of the stored blobs,
+// so they only compare rows of the same encoding.
+func sameTile(src diffRow, dst diffRow) (same bool, known bool) {
+	if src.encoding == dst.encoding {
+		if len(src.hash) > 0 && len(dst.hash) > 0 {
+			return bytes.Equal(src.hash, dst.hash), true
+		}
+		if src.checksum.Valid && dst.checksum.Valid {
+			return src.checksum.Int64 == dst.checksum.Int64, true
+		}
+	}
+	// written times are in seconds, within the same second there is no telling
+	if src.written.Valid && dst.written.Valid && src.written.Int64 != dst.written.Int64 {
+		return src.written.Int64 < dst.written.Int64, true
+	}
+	return false, false
+}
+
+// diffTable holds the rows of a table of a .s file and how to read their blobs
+type diffTable struct {
+	rows map[int64]diffRow
+	data string // expression reading the blob of a row, see tileData
+}
+
+// shardDiffTables reads the rows of every table of the .s file opened as shard
+func shardDiffTables(shard *handleEntry) (map[string]diffTable, error) {
+	algorithm, err := shardChecksum(shard.db)
+	if err != nil {
+		return nil, err
+	}
+	tableNames, err := listTables(shard.db)
+	if err != nil {
+		return nil, err
+	}
+	tables := make(map[string]diffTable)
+	for _, tableName := range tableNames {
+		if !validTableName.MatchString(tableName) {
+			continue
+		}
+		if _, _, _, ok := parseShardName(tableName); !ok {
+			continue
+		}
+		checksums, err := checksumColumns(shard.db, tableName, algorithm)
+		if err != nil {
+			return nil, err
+		}
+		if checksums == "" {
+			checksums = "NULL, NULL"
+		}
+		written, err := shard.writtenQuery(tableName)
+		if err != nil {
+			return nil, err
+		}
+		writtenColumn := "NULL"
+		if written != "" {
+			writtenColumn = "Written"
+		}
+		encoding, err := encodingColumn(shard.db, tableName)
+		if err != nil {
+			return nil, err
+		}
+		// only deduplicated files have a Hash column, see verifyShard
+		table := diffTable{rows: make(map[int64]diffRow), data: tileData(tableName, strings.HasSuffix(checksums, ", Hash"))}
+		rows, err := shard.db.Query("select ID, " + checksums + ", " + writtenColumn + ", " + encoding + " from " + tableName)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id int64
+			var row diffRow
+			var rowEncoding sql.NullString
+			if err := rows.Scan(&id, &row.checksum, &row.hash, &row.written, &rowEncoding); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			row.encoding = rowEncoding.String
+			table.rows[id] = row
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		tables[tableName] = table
+	}
+	return tables, nil
+}
+
+// readDiffTile returns the tile of row id of tableName as it was written
+func readDiffTile(shard *handleEntry, tableName string, table diffTable, id int64) ([]byte, error) {
+	var data []byte
+	if err := shard.db.QueryRow("select "+table.data+" from "+tableName+" where ID=?", id).Scan(&data); err != nil {
+		return nil, err
+	}
+	return DecodeTile(data, table.rows[id].encoding)
+}
+
+// diffShard adds to diff the tiles that differ between the .s files srcFile and
+// dstFile, either of which may be "" when the repository has no such file
+func diffShard(srcFile string, dstFile string, scheme ShardScheme, diff *ShardDiff) error {
+	open := func(filePath string) (*handleEntry, map[string]diffTable, func(), error) {
+		if filePath == "" {
+			return nil, nil, func() {}, nil
+		}
+		shard, release, err := acquireShardRetrying(context.Background(), filePath)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		tables, err := shardDiffTables(shard)
+		if err != nil {
+			release()
+			return nil, nil, nil, err
+		}
+		return shard, tables, release, nil
+	}
+	srcShard, srcTables, releaseSrc, err := open(srcFile)
+	if err != nil {
+		return err
+	}
+	defer releaseSrc()
+	dstShard, dstTables, releaseDst, err := open(dstFile)
+	if err != nil {
+		return err
+	}
+	defer releaseDst()
+
+	tableNames := make([]string, 0, len(srcTables)+len(dstTables))
+	for tableName := range srcTables {
+		tableNames = append(tableNames, tableName)
+	}
+	for tableName := range dstTables {
+		if _, ok := srcTables[tableName]; !ok {
+			tableNames = append(tableNames, tableName)
+		}
+	}
+	slices.Sort(tableNames)
+	for _, tableName := range tableNames {
+		_, tableX, tableY, _ := parseShardName(tableName)
+		tile := func(id int64) [2]int64 {
+			x, y := scheme.tileOf(tableX, tableY, id)
+			return [2]int64{x, y}
+		}
+		src, dst := srcTables[tableName], dstTables[tableName]
+		ids := make([]int64, 0, len(src.rows))
+		for id := range src.rows {
+			ids = append(ids, id)
+		}
+		slices.Sort(ids)
+		for _, id := range ids {
+			dstRow, ok := dst.rows[id]
+			if !ok {
+				diff.Added = append(diff.Added, tile(id))
+				continue
+			}
+			same, known := sameTile(src.rows[id], dstRow)
+			if !known {
+				srcData, err := readDiffTile(srcShard, tableName, src, id)
+				if err != nil {
+					return err
+				}
+				dstData, err := readDiffTile(dstShard, tableName, dst, id)
+				if err != nil {
+					return err
+				}
+				same = bytes.Equal(srcData, dstData)
+			}
+			if !same {
+				diff.Modified = append(diff.Modified, tile(id))
+			}
+		}
+		ids = ids[:0]
+		for id := range dst.rows {
+			if _, ok := src.rows[id]; !ok {
+				ids = append(ids, id)
+			}
+		}
+		slices.Sort(ids)
+		for _, id := range ids {
+			diff.Deleted = append(diff.Deleted, tile(id))
+		}
+	}
+	return nil
+}
+
+// ApplyOptions controls ApplyDiff
+type ApplyOptions struct {
+	Delete    bool // also delete the tiles the source does not have
+	BatchSize int  // tiles written per batch, DefaultImportBatchSize when 0
+	Progress  func(ApplyProgress)
+}
+
+// ApplyProgress counts the tiles handled by ApplyDiff so far
+type ApplyProgress struct {
+	Copied   int64            `json:"copied"`
+	Deleted  int64            `json:"deleted"`
+	Vanished int64            `json:"vanished"` // gone from the source since the diff was computed
+	Failed   int64            `json:"failed"`
+	Errors   []BatchTileError `json:"errors,omitempty"`
+}
+
+// ApplyDiff makes the repository at dstDir hold the tiles of the repository at
+// srcDir that report lists as added or modified, copying only those through
+// WriteBatch, and with opts.Delete deletes the tiles it lists as deleted. A
+// missing destination is created with the shard scheme, grid and compression of
+// the source, and its repository.json is updated like after an import. Tiles
+// that cannot be read or written are counted as failed without stopping the
+// copy; the error is only set when the destination cannot be written at all or
+// ctx ends. The destination stays locked against other processes throughout.
+func ApplyDiff(ctx context.Context, srcDir string, dstDir string, report DiffReport, opts ApplyOptions) (ApplyProgress, error) {
+	var progress ApplyProgress
+	if info, err := os.Stat(srcDir); err != nil || !info.IsDir() {
+		return progress, fmt.Errorf("%w: %s", ErrRepositoryNotFound, srcDir)
+	}
+	source, err := openRepository(srcDir)
+	if err != nil {
+		return progress, err
+	}
+	im, err := newImporter(dstDir, ImportOptions{Overwrite: true, BatchSize: opts.BatchSize, Shard: source.shards(), Grid: source.grid, Compress: source.compress})
+	if err != nil {
+		return progress, err
+	}
+	defer im.unlock()
+	dest := im.repository
+
+	// the batch goes through WriteBatch rather than the importer, which would
+	// stop at the first tile sqlite rejects
+	flush := func() error {
+		if len(im.batch) == 0 {
+			return nil
+		}
+		batch, err := dest.WriteBatch(ctx, im.batch, BatchOptions{Overwrite: true})
+		progress.Copied += batch.Written
+		progress.Failed += batch.Failed
+		progress.Errors = append(progress.Errors, batch.Errors...)
+		if err != nil {
+			return err
+		}
+		for _, tile := range im.batch {
+			im.summary.add(tile)
+		}
+		im.batch = im.batch[:0]
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+		return nil
+	}
+	deletedZooms := make(map[int8]bool)
+	for _, shard := range report.Shards {
+		for _, list := range [][][2]int64{shard.Added, shard.Modified} {
+			for _, xy := range list {
+				tile := TileCoord{Z: shard.Zoom, X: xy[0], Y: xy[1]}
+				data, err := source.GetXYZ(tile.X, tile.Y, tile.Z)
+				if errors.Is(err, ErrTileNotFound) {
+					progress.Vanished++
+					continue
+				}
+				if err != nil {
+					progress.Failed++
+					progress.Errors = append(progress.Errors, BatchTileError{TileCoord: tile, Error: err.Error()})
+					continue
+				}
+				im.batch = append(im.batch, TileData{TileCoord: tile, Data: data.Bytes()})
+				if len(im.batch) >= im.batchSize {
+					if err := flush(); err != nil {
+						return progress, err
+					}
+				}
+			}
+		}
+		if !opts.Delete || len(shard.Deleted) == 0 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return progress, err
+		}
+		deleted, err := dest.deleteTiles(shard.Zoom, shard.Deleted)
+		progress.Deleted += deleted
+		if errors.Is(err, ErrRepositoryLocked) {
+			return progress, err
+		}
+		if err != nil {
+			progress.Failed += int64(len(shard.Deleted)) - deleted
+			RecordError("sfile", fmt.Errorf("delete tiles of %s from %s: %w", shard.File, dstDir, err))
+		}
+		if deleted > 0 {
+			deletedZooms[shard.Zoom] = true
+		}
+	}
+	if err := flush(); err != nil {
+		return progress, err
+	}
+	if err := im.finish(nil); err != nil {
+		return progress, err
+	}
+	for z := range deletedZooms {
+		if err := dest.refreshRepositoryInfo(z); err != nil {
+			return progress, err
+		}
+	}
+	return progress, nil
+}
+
+// deleteTiles deletes the tiles at x, y of zoom z, which all belong to the same
+// .s file, in one transaction and returns how many were stored. Tiles already
+// missing are skipped.
+func (f *SRepository) deleteTiles(z int8, tiles [][2]int64) (int64, error) {
+	if len(tiles) == 0 {
+		return 0, nil
+	}
+	for _, xy := range tiles {
+		if err := f.grid.checkTile(xy[0], xy[1], z); err != nil {
+			return 0, err
+		}
+	}
+	filePath, _, _ := f.shardLocation(tiles[0][0], tiles[0][1], z)
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		return 0, nil
+	}
+	db, done, err := openShardForWriteRetrying(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	statements := newTxStatements(tx)
+	coords := make([]TileCoord, 0, len(tiles))
+	var deleted int64
+	for _, xy := range tiles {
+		tileFile, tableName, id := f.shardLocation(xy[0], xy[1], z)
+		if tileFile != filePath {
+			_ = tx.Rollback()
+			return 0, fmt.Errorf("tile %d/%d/%d is not in %s", z, xy[0], xy[1], filepath.Base(filePath))
+		}
+		result, err := statements.Exec("delete from "+tableName+" where ID=?", id)
+		if err != nil && strings.Contains(err.Error(), "no such table") {
+			continue
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		if n, err := result.RowsAffected(); err == nil && n > 0 {
+			deleted += n
+			coords = append(coords, TileCoord{Z: z, X: xy[0], Y: xy[1]})
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	noteTiles(f.dir, f.shards(), filePath, coords, false)
+	return deleted, nil
+}
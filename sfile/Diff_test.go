@@ -0,0 +1,163 @@
+package sfile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// diffTiles returns the added, modified and deleted tiles of report by zoom
+// and x/y, sorted
+func diffTiles(report DiffReport) (added, modified, deleted []TileCoord) {
+	collect := func(list *[]TileCoord, z int8, tiles [][2]int64) {
+		for _, tile := range tiles {
+			*list = append(*list, TileCoord{Z: z, X: tile[0], Y: tile[1]})
+		}
+	}
+	for _, shard := range report.Shards {
+		collect(&added, shard.Zoom, shard.Added)
+		collect(&modified, shard.Zoom, shard.Modified)
+		collect(&deleted, shard.Zoom, shard.Deleted)
+	}
+	compare := func(a, b TileCoord) int {
+		if a.Z != b.Z {
+			return int(a.Z) - int(b.Z)
+		}
+		if a.X != b.X {
+			return int(a.X - b.X)
+		}
+		return int(a.Y - b.Y)
+	}
+	slices.SortFunc(added, compare)
+	slices.SortFunc(modified, compare)
+	slices.SortFunc(deleted, compare)
+	return added, modified, deleted
+}
+
+// TestDiff copies a repository, then adds, modifies and deletes tiles of the
+// source and adds one to the destination only, and checks Diff lists each
+// change, that the report survives JSON and that ApplyDiff brings the
+// destination in line with the source
+func TestDiff(t *testing.T) {
+	root := t.TempDir()
+	t.Cleanup(func() { FlushHandles(func(path string) bool { return strings.HasPrefix(path, root) }) })
+	srcDir, dstDir := filepath.Join(root, "src"), filepath.Join(root, "dst")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	src, err := NewRepository(srcDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(repo *SRepository, z int8, x, y int64, data string) {
+		t.Helper()
+		if err := repo.WriteXYZ(x, y, z, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(src, 5, 1, 1, "unchanged")
+	write(src, 5, 2, 1, "original")
+	write(src, 10, 0, 0, "unchanged")
+	write(src, 10, 1, 0, "to delete")
+
+	// a missing destination is empty, every tile is added
+	report, err := Diff(srcDir, dstDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Added != 4 || report.Modified != 0 || report.Deleted != 0 {
+		t.Fatalf("diff to a missing destination: added %d, modified %d, deleted %d, want 4 added",
+			report.Added, report.Modified, report.Deleted)
+	}
+	if _, err := ApplyDiff(context.Background(), srcDir, dstDir, report, ApplyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if report, err := Diff(srcDir, dstDir); err != nil || len(report.Shards) != 0 {
+		t.Fatalf("diff of the copy: %+v, %v, want no differences", report, err)
+	}
+
+	dst, err := NewRepository(dstDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(src, 5, 3, 1, "added next to others")
+	write(src, 10, 300, 0, "added in a new shard")
+	write(src, 5, 2, 1, "modified")
+	if err := src.DeleteXYZ(1, 0, 10); err != nil {
+		t.Fatal(err)
+	}
+	write(dst, 10, 2, 0, "destination only")
+	// file times are coarse, the shards of both sides just written may have
+	// the same size and time and pass for unchanged; the destination one was
+	// written later
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(dstDir, "K", "K_0_0.s"), later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err = Diff(srcDir, dstDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, modified, deleted := diffTiles(report)
+	wantAdded := []TileCoord{{Z: 5, X: 3, Y: 1}, {Z: 10, X: 300, Y: 0}}
+	wantModified := []TileCoord{{Z: 5, X: 2, Y: 1}}
+	wantDeleted := []TileCoord{{Z: 10, X: 1, Y: 0}, {Z: 10, X: 2, Y: 0}}
+	if !slices.Equal(added, wantAdded) || !slices.Equal(modified, wantModified) || !slices.Equal(deleted, wantDeleted) {
+		t.Fatalf("added %v, modified %v, deleted %v, want %v, %v, %v", added, modified, deleted, wantAdded, wantModified, wantDeleted)
+	}
+	if report.Added != 2 || report.Modified != 1 || report.Deleted != 2 {
+		t.Fatalf("totals added %d, modified %d, deleted %d, want 2, 1 and 2", report.Added, report.Modified, report.Deleted)
+	}
+
+	// computed on one machine, applied on another
+	encoded, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded DiffReport
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	progress, err := ApplyDiff(context.Background(), srcDir, dstDir, decoded, ApplyOptions{})
+	if err != nil || progress.Copied != 3 || progress.Deleted != 0 || progress.Failed != 0 {
+		t.Fatalf("ApplyDiff keeping deleted tiles: %+v, %v, want 3 copied", progress, err)
+	}
+	if got, err := dst.GetXYZ(2, 0, 10); err != nil || got.String() != "destination only" {
+		t.Fatalf("tile of the destination only: %v, %v, want it kept", got, err)
+	}
+	progress, err = ApplyDiff(context.Background(), srcDir, dstDir, decoded, ApplyOptions{Delete: true})
+	if err != nil || progress.Deleted != 2 || progress.Failed != 0 {
+		t.Fatalf("ApplyDiff deleting: %+v, %v, want 2 deleted", progress, err)
+	}
+	for _, tile := range []struct {
+		z    int8
+		x, y int64
+		want string
+	}{
+		{5, 1, 1, "unchanged"}, {5, 2, 1, "modified"}, {5, 3, 1, "added next to others"},
+		{10, 0, 0, "unchanged"}, {10, 300, 0, "added in a new shard"},
+		{10, 1, 0, ""}, {10, 2, 0, ""},
+	} {
+		got, err := dst.GetXYZ(tile.x, tile.y, tile.z)
+		if tile.want == "" {
+			if !errors.Is(err, ErrTileNotFound) {
+				t.Errorf("tile %d/%d/%d: %v, want it deleted", tile.z, tile.x, tile.y, err)
+			}
+			continue
+		}
+		if err != nil || got.String() != tile.want {
+			t.Errorf("tile %d/%d/%d: %v, %v, want %q", tile.z, tile.x, tile.y, got, err, tile.want)
+		}
+	}
+	if report, err := Diff(srcDir, dstDir); err != nil || report.Added+report.Modified+report.Deleted != 0 {
+		t.Fatalf("diff after applying: %+v, %v, want no differences", report, err)
+	}
+}
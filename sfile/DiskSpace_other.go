@@ -0,0 +1,24 @@
+//go:build !linux && !darwin && !windows
+
+package sfile
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// DiskSpace is not supported on this platform
+func DiskSpace(path string) (total uint64, free uint64, err error) {
+	return 0, 0, fmt.Errorf("disk space is not supported on %s", runtime.GOOS)
+}
+
+// readOnlyStorage cannot tell read-only storage apart on this platform
+func readOnlyStorage(path string) bool {
+	return false
+}
+
+// writableDir cannot tell directories this process may not write to apart on
+// this platform
+func writableDir(dir string) bool {
+	return true
+}
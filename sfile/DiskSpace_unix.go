@@ -0,0 +1,34 @@
+//go:build linux || darwin
+
+package sfile
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// DiskSpace returns the total and free bytes of the filesystem containing path
+func DiskSpace(path string) (total uint64, free uint64, err error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	blockSize := uint64(stat.Bsize)
+	return stat.Blocks * blockSize, stat.Bavail * blockSize, nil
+}
+
+// readOnlyStorage reports whether the filesystem containing path is mounted read-only
+func readOnlyStorage(path string) bool {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return false
+	}
+	// ST_RDONLY on linux and MNT_RDONLY on darwin are both bit 0
+	return stat.Flags&1 != 0
+}
+
+// writableDir reports whether this process may create files in the directory dir
+func writableDir(dir string) bool {
+	return unix.Access(dir, unix.W_OK) == nil
+}
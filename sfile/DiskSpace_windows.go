@@ -0,0 +1,41 @@
+//go:build windows
+
+package sfile
+
+import (
+	"path/filepath"
+
+	"golang.org/x/sys/windows"
+)
+
+// DiskSpace returns the total and free bytes of the filesystem containing path
+func DiskSpace(path string) (total uint64, free uint64, err error) {
+	pathPtr, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	var freeToCaller, totalBytes, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(pathPtr, &freeToCaller, &totalBytes, &totalFree); err != nil {
+		return 0, 0, err
+	}
+	return totalBytes, freeToCaller, nil
+}
+
+// readOnlyStorage reports whether the volume containing path is read-only
+func readOnlyStorage(path string) bool {
+	pathPtr, err := windows.UTF16PtrFromString(filepath.VolumeName(path) + `\`)
+	if err != nil {
+		return false
+	}
+	var flags uint32
+	if err := windows.GetVolumeInformation(pathPtr, nil, 0, nil, nil, &flags, nil, 0); err != nil {
+		return false
+	}
+	return flags&windows.FILE_READ_ONLY_VOLUME != 0
+}
+
+// writableDir reports whether this process may create files in the directory
+// dir. Windows decides by ACLs that are not checked here, so it always may.
+func writableDir(dir string) bool {
+	return true
+}
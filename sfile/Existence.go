@@ -0,0 +1,414 @@
+package sfile
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Most requests to a sparse repository are for tiles it does not hold, and each
+// of them costs a stat, an open and a query before it is known to be a miss. The
+// existence index keeps, per zoom directory of the repositories served, a bitset
+// of the IDs present in each table, built in the background the first time the
+// zoom is read and kept in sync by the writes of this process. A tile the index
+// does not hold is answered as missing without touching the disk; one it holds,
+// or one of a zoom not indexed yet, is read as before, so a stale bit only costs
+// the read it saves otherwise.
+//
+// Writes of other processes show in the modification times of the .s files and
+// their write-ahead logs, compared at most every existenceCheckInterval: a zoom
+// with a file changed behind the index's back is dropped and built again.
+
+// existenceCheckInterval is how often the files of an indexed zoom are looked at
+// for changes made by other processes
+const existenceCheckInterval = 10 * time.Second
+
+// existenceTableOverhead and existenceFileOverhead approximate the memory used by
+// the bookkeeping of a table bitset and of a file besides the bits and the path
+const (
+	existenceTableOverhead = 64
+	existenceFileOverhead  = 64
+)
+
+// ExistenceStats are the counters of the existence index
+type ExistenceStats struct {
+	Zooms     int   `json:"zooms"`     // zoom directories indexed or being indexed
+	Bytes     int64 `json:"bytes"`     // memory used by the indexes
+	Budget    int64 `json:"budget"`    // 0 when the index is disabled
+	Absent    int64 `json:"absent"`    // lookups answered as missing without any file access
+	Present   int64 `json:"present"`   // lookups of tiles the index holds, read from their file
+	Unindexed int64 `json:"unindexed"` // lookups of zooms not indexed yet, or too large to be
+	Builds    int64 `json:"builds"`    // zoom indexes built
+	Evictions int64 `json:"evictions"` // zoom indexes dropped for the budget or after a change
+}
+
+// zoomIndex holds the tiles present in one zoom directory
+type zoomIndex struct {
+	dir      string
+	scheme   ShardScheme
+	ready    bool                  // the scan is done, before it every lookup is unindexed
+	tooLarge bool                  // the scan outgrew the budget, the zoom is not indexed until invalidated
+	failedAt time.Time             // when the scan failed, it is tried again after existenceCheckInterval
+	checking bool                  // a check of the files is running
+	checked  time.Time             // when the files were last found unchanged
+	tables   map[[2]int64][]uint64 // bits of the IDs present, by table column and row
+	files    map[string]time.Time  // last modification of each .s file and its log as last seen
+	cost     int64                 // memory accounted to the index
+	element  *list.Element         // in existence.order
+}
+
+// existence holds the zoom indexes by absolute zoom directory, least recently
+// used last
+var existence = struct {
+	sync.Mutex
+	budget int64
+	size   int64
+	order  *list.List
+	zooms  map[string]*zoomIndex
+
+	absent    atomic.Int64
+	present   atomic.Int64
+	unindexed atomic.Int64
+	builds    atomic.Int64
+	evictions atomic.Int64
+}{order: list.New(), zooms: make(map[string]*zoomIndex)}
+
+// SetExistenceBudget changes the memory budget of the existence index, 0
+// disables it. Indexes beyond a smaller budget are dropped.
+func SetExistenceBudget(budget int64) {
+	existence.Lock()
+	defer existence.Unlock()
+	existence.budget = max(budget, 0)
+	for _, index := range existence.zooms {
+		// a zoom too large for the former budget may fit the new one
+		if index.tooLarge {
+			dropZoomIndex(index)
+		}
+	}
+	trimExistence(nil)
+}
+
+// ExistenceIndexStats returns the current counters of the existence index
+func ExistenceIndexStats() ExistenceStats {
+	existence.Lock()
+	defer existence.Unlock()
+	return ExistenceStats{
+		Zooms:     len(existence.zooms),
+		Bytes:     existence.size,
+		Budget:    existence.budget,
+		Absent:    existence.absent.Load(),
+		Present:   existence.present.Load(),
+		Unindexed: existence.unindexed.Load(),
+		Builds:    existence.builds.Load(),
+		Evictions: existence.evictions.Load(),
+	}
+}
+
+// ForgetExistence drops the index of every zoom directory match accepts and
+// returns how many were dropped; they are built again when next read
+func ForgetExistence(match func(path string) bool) int {
+	existence.Lock()
+	defer existence.Unlock()
+	dropped := 0
+	for dir, index := range existence.zooms {
+		if match(dir) {
+			dropZoomIndex(index)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// forgetRepositoryExistence drops the indexes of the zooms of the repository in
+// dir, after its files were replaced or rescanned
+func forgetRepositoryExistence(dir string) {
+	prefix := sizeKey(dir) + string(filepath.Separator)
+	ForgetExistence(func(path string) bool {
+		return len(path) > len(prefix) && path[:len(prefix)] == prefix
+	})
+}
+
+// knownAbsent reports whether the existence index tells tile x/y/z is not stored.
+// A zoom read for the first time starts being indexed and is read as before.
+func (f *SRepository) knownAbsent(x int64, y int64, z int8) bool {
+	scheme := f.shards()
+	dir := filepath.Join(sizeKey(f.dir), zoomName(z))
+	existence.Lock()
+	if existence.budget == 0 {
+		existence.Unlock()
+		return false
+	}
+	index, ok := existence.zooms[dir]
+	if ok && index.scheme != scheme {
+		dropZoomIndex(index)
+		ok = false
+	}
+	if !ok || (!index.ready && !index.tooLarge && !index.failedAt.IsZero() && time.Since(index.failedAt) >= existenceCheckInterval) {
+		if ok {
+			dropZoomIndex(index)
+		}
+		index = &zoomIndex{dir: dir, scheme: scheme, tables: make(map[[2]int64][]uint64), files: make(map[string]time.Time)}
+		index.element = existence.order.PushFront(index)
+		existence.zooms[dir] = index
+		existence.Unlock()
+		existence.unindexed.Add(1)
+		go index.build()
+		return false
+	}
+	existence.order.MoveToFront(index.element)
+	if !index.ready {
+		existence.Unlock()
+		existence.unindexed.Add(1)
+		return false
+	}
+	if !index.checking && time.Since(index.checked) >= existenceCheckInterval {
+		index.checking = true
+		go index.check()
+	}
+	present := index.has(scheme, x, y)
+	existence.Unlock()
+	if present {
+		existence.present.Add(1)
+		return false
+	}
+	existence.absent.Add(1)
+	return true
+}
+
+// has reports whether the bit of tile x, y is set. The caller must hold existence.
+func (ix *zoomIndex) has(scheme ShardScheme, x int64, y int64) bool {
+	bits, ok := ix.tables[[2]int64{x / scheme.Table, y / scheme.Table}]
+	if !ok {
+		return false
+	}
+	id := x%scheme.Table + scheme.Table*(y%scheme.Table)
+	return bits[id/64]&(1<<(id%64)) != 0
+}
+
+// set sets or clears the bit of row id of table tableX, tableY and accounts the
+// memory of a new table. The caller must hold existence.
+func (ix *zoomIndex) set(tableX int64, tableY int64, id int64, present bool) {
+	if id < 0 || id >= ix.scheme.tableIDs() {
+		return
+	}
+	key := [2]int64{tableX, tableY}
+	bits, ok := ix.tables[key]
+	if !ok {
+		if !present {
+			return
+		}
+		bits = make([]uint64, (ix.scheme.tableIDs()+63)/64)
+		ix.tables[key] = bits
+		ix.grow(int64(len(bits))*8 + existenceTableOverhead)
+	}
+	if present {
+		bits[id/64] |= 1 << (id % 64)
+	} else {
+		bits[id/64] &^= 1 << (id % 64)
+	}
+}
+
+// stamp records the modification time of the .s file at filePath as seen by the
+// index. The caller must hold existence.
+func (ix *zoomIndex) stamp(filePath string, modified time.Time) {
+	if _, ok := ix.files[filePath]; !ok {
+		ix.grow(int64(len(filePath)) + existenceFileOverhead)
+	}
+	ix.files[filePath] = modified
+}
+
+// grow accounts delta more bytes to the index. The caller must hold existence.
+func (ix *zoomIndex) grow(delta int64) {
+	ix.cost += delta
+	if existence.zooms[ix.dir] == ix {
+		existence.size += delta
+	}
+}
+
+// shardStamp returns the last modification of the .s file at filePath or of its
+// write-ahead log, zero when the file does not exist
+func shardStamp(filePath string) time.Time {
+	var stamp time.Time
+	for _, path := range []string{filePath, filePath + "-wal"} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(stamp) {
+			stamp = info.ModTime()
+		}
+	}
+	return stamp
+}
+
+// build scans the IDs of every table of the zoom directory into the index
+func (ix *zoomIndex) build() {
+	err := ix.scan()
+	existence.Lock()
+	defer existence.Unlock()
+	if existence.zooms[ix.dir] != ix {
+		// dropped while it was built
+		return
+	}
+	if err != nil {
+		if !ix.tooLarge {
+			ix.failedAt = time.Now()
+			RecordError("existence", fmt.Errorf("index %s: %w", ix.dir, err))
+		}
+		return
+	}
+	ix.ready, ix.checked = true, time.Now()
+	existence.builds.Add(1)
+}
+
+// errExistenceBudget stops the scan of a zoom that does not fit the budget
+var errExistenceBudget = errors.New("zoom does not fit the existence index budget")
+
+// scan sets the bits of the tiles stored in the zoom directory, file by file.
+// Each file is stamped before it is read, a write made during the read changes
+// its stamp and gets the zoom checked again.
+func (ix *zoomIndex) scan() error {
+	files, err := listAllFile(ix.dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		stamp := shardStamp(file)
+		tables := make(map[[2]int64][]int64)
+		err := listShardTiles(file, ix.scheme, func(x int64, y int64) error {
+			key := [2]int64{x / ix.scheme.Table, y / ix.scheme.Table}
+			tables[key] = append(tables[key], x%ix.scheme.Table+ix.scheme.Table*(y%ix.scheme.Table))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		existence.Lock()
+		if existence.zooms[ix.dir] != ix {
+			existence.Unlock()
+			return nil
+		}
+		for key, ids := range tables {
+			for _, id := range ids {
+				ix.set(key[0], key[1], id, true)
+			}
+		}
+		ix.stamp(file, stamp)
+		if !trimExistence(ix) {
+			ix.tooLarge = true
+			ix.free()
+			existence.Unlock()
+			log.Printf("Not indexing the tiles of %s, they need more than the %d bytes of the existence index", ix.dir, existence.budget)
+			return errExistenceBudget
+		}
+		existence.Unlock()
+	}
+	return nil
+}
+
+// check drops the index when a file of the zoom was created, changed or removed
+// by another process since it was last seen
+func (ix *zoomIndex) check() {
+	existence.Lock()
+	seen := make(map[string]time.Time, len(ix.files))
+	for file, stamp := range ix.files {
+		seen[file] = stamp
+	}
+	existence.Unlock()
+
+	changed := false
+	files, err := listAllFile(ix.dir)
+	if err != nil && !os.IsNotExist(err) {
+		changed = true
+	}
+	if len(files) != len(seen) {
+		changed = true
+	}
+	for _, file := range files {
+		if stamp, ok := seen[file]; !ok || !shardStamp(file).Equal(stamp) {
+			changed = true
+			break
+		}
+	}
+
+	existence.Lock()
+	defer existence.Unlock()
+	ix.checking = false
+	if existence.zooms[ix.dir] != ix {
+		return
+	}
+	if changed {
+		dropZoomIndex(ix)
+		existence.evictions.Add(1)
+		return
+	}
+	ix.checked = time.Now()
+}
+
+// noteTiles keeps the index of the zoom directory of the .s file at filePath in
+// sync with tiles just written to it or deleted from it. The caller must still
+// hold the write lock of the file, so the stamp taken is that of its own write.
+func noteTiles(dir string, scheme ShardScheme, filePath string, tiles []TileCoord, present bool) {
+	z, _ := shardZoom(filePath)
+	zoomDir := filepath.Join(sizeKey(dir), zoomName(z))
+	existence.Lock()
+	index, ok := existence.zooms[zoomDir]
+	existence.Unlock()
+	if !ok {
+		return
+	}
+	stamp := shardStamp(filePath)
+	existence.Lock()
+	defer existence.Unlock()
+	if existence.zooms[zoomDir] != index || index.scheme != scheme || index.tooLarge {
+		return
+	}
+	for _, tile := range tiles {
+		index.set(tile.X/scheme.Table, tile.Y/scheme.Table, tile.X%scheme.Table+scheme.Table*(tile.Y%scheme.Table), present)
+	}
+	if _, seen := index.files[filePath]; seen || index.ready {
+		index.stamp(filePath, stamp)
+	}
+	trimExistence(index)
+}
+
+// trimExistence drops the least recently used indexes other than keep until the
+// indexes fit the budget, and reports whether they do. The caller must hold existence.
+func trimExistence(keep *zoomIndex) bool {
+	for existence.size > existence.budget {
+		element := existence.order.Back()
+		// markers of zooms too large to index cost nothing and keep them from being scanned again
+		for element != nil && (element.Value.(*zoomIndex) == keep || element.Value.(*zoomIndex).cost == 0) {
+			element = element.Prev()
+		}
+		if element == nil {
+			return false
+		}
+		dropZoomIndex(element.Value.(*zoomIndex))
+		existence.evictions.Add(1)
+	}
+	return true
+}
+
+// dropZoomIndex removes an index. The caller must hold existence.
+func dropZoomIndex(ix *zoomIndex) {
+	if existence.zooms[ix.dir] != ix {
+		return
+	}
+	existence.size -= ix.cost
+	existence.order.Remove(ix.element)
+	delete(existence.zooms, ix.dir)
+}
+
+// free releases the bits of an index too large to be kept, which stays as a
+// marker so the zoom is not scanned again. The caller must hold existence.
+func (ix *zoomIndex) free() {
+	existence.size -= ix.cost
+	ix.cost = 0
+	ix.tables, ix.files = nil, nil
+}
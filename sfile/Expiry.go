@@ -0,0 +1,317 @@
+package sfile
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Tiles record when they were written in a Written column, in Unix seconds,
+// added to a table the first time a tile is written to it. The column is all a
+// file needs to record times, older readers ignore it. Rows without a time,
+// written before tiles recorded it, never expire.
+
+const (
+	// DefaultSweepInterval is how often the server deletes expired tiles
+	DefaultSweepInterval = 10 * time.Minute
+	// DefaultSweepRate is how many expired tiles are deleted per second, so
+	// sweeping does not starve the reads of the tiles being served
+	DefaultSweepRate = 1000
+	// sweepBatch is how many tiles are deleted in one transaction
+	sweepBatch = 100
+)
+
+// ErrTileExpired is returned, together with ErrTileNotFound, for a tile written
+// longer ago than the TTL of its repository
+var ErrTileExpired = errors.New("tile expired")
+
+// addWrittenColumn adds the Written column to tableName in the file written in
+// tx when it does not have one yet
+func addWrittenColumn(tx *sql.Tx, tableName string) error {
+	var hasWritten int
+	if err := tx.QueryRow("select count(*) from pragma_table_info(?) where name = 'Written'", tableName).Scan(&hasWritten); err != nil {
+		return err
+	}
+	if hasWritten > 0 {
+		return nil
+	}
+	_, err := tx.Exec("alter table " + tableName + " add column Written INTEGER")
+	return err
+}
+
+// stampTile records written as the write time of row id of tableName, which
+// must have the Written column
+func stampTile(tx execer, tableName string, id int64, written time.Time) error {
+	_, err := tx.Exec("update "+tableName+" set Written = ? where ID = ?", written.Unix(), id)
+	return err
+}
+
+// writtenQuery returns the query reading the write time of a row of tableName,
+// "" when the table has no Written column, looking at the columns only once
+func (e *handleEntry) writtenQuery(tableName string) (string, error) {
+	e.stmtMu.Lock()
+	query, ok := e.writtenQueries[tableName]
+	e.stmtMu.Unlock()
+	if ok {
+		return query, nil
+	}
+	var hasWritten int
+	if err := e.db.QueryRow("select count(*) from pragma_table_info(?) where name = 'Written'", tableName).Scan(&hasWritten); err != nil {
+		return "", err
+	}
+	if hasWritten > 0 {
+		query = "select Written from " + tableName + " where ID=?"
+	}
+	e.stmtMu.Lock()
+	if e.writtenQueries == nil {
+		e.writtenQueries = make(map[string]string)
+	}
+	e.writtenQueries[tableName] = query
+	e.stmtMu.Unlock()
+	return query, nil
+}
+
+// SweepOptions controls SweepExpired
+type SweepOptions struct {
+	Rate float64 // tiles deleted per second, DefaultSweepRate when 0, no limit when negative
+}
+
+// SweepReport is the result of SweepExpired
+type SweepReport struct {
+	Files   int   `json:"files"` // .s files expired tiles were deleted from
+	Deleted int64 `json:"deleted"`
+}
+
+// SweepExpired deletes the expired tiles of the repository in dir, whose
+// repository.json sets a TTL, in small transactions spaced out to the rate of
+// opts. The space of the deleted rows is reused by the tiles written next. A
+// repository without a TTL is left alone.
+func SweepExpired(ctx context.Context, dir string, opts SweepOptions) (SweepReport, error) {
+	var report SweepReport
+	recorded, err := recordedLayout(dir)
+	if err != nil || recorded.ttl <= 0 {
+		return report, err
+	}
+	if opts.Rate == 0 {
+		opts.Rate = DefaultSweepRate
+	}
+	var limiter rateLimiter
+	limiter.setRate(opts.Rate / sweepBatch)
+	cutoff := time.Now().Add(-recorded.ttl).Unix()
+	subDirs, err := listSubDir(dir)
+	if err != nil {
+		return report, err
+	}
+	for _, sub := range subDirs {
+		files, err := listAllFile(sub)
+		if err != nil {
+			return report, err
+		}
+		for _, file := range files {
+			deleted, err := sweepShard(ctx, file, cutoff, &limiter)
+			if deleted > 0 {
+				report.Files++
+				report.Deleted += deleted
+			}
+			if err != nil {
+				return report, fmt.Errorf("sweeping %s: %w", file, err)
+			}
+		}
+	}
+	return report, nil
+}
+
+// sweepShard deletes the tiles of one .s file written before cutoff, a batch at
+// a time. The file is only locked for writing while a batch is deleted.
+func sweepShard(ctx context.Context, filePath string, cutoff int64, limiter *rateLimiter) (int64, error) {
+	tableNames, err := expiredTables(filePath, cutoff)
+	if err != nil || len(tableNames) == 0 {
+		return 0, err
+	}
+	var deleted int64
+	for {
+		if err := limiter.wait(ctx); err != nil {
+			return deleted, err
+		}
+		n, more, err := deleteExpired(filePath, tableNames, cutoff)
+		deleted += n
+		if err != nil || !more {
+			return deleted, err
+		}
+	}
+}
+
+// expiredTables returns the tables of a .s file holding tiles written before cutoff
+func expiredTables(filePath string, cutoff int64) ([]string, error) {
+	shard, release, err := acquireShard(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	tableNames, err := listTables(shard.db)
+	if err != nil {
+		return nil, err
+	}
+	expired := make([]string, 0)
+	for _, tableName := range tableNames {
+		if !validTableName.MatchString(tableName) {
+			continue
+		}
+		query, err := shard.writtenQuery(tableName)
+		if err != nil {
+			return nil, err
+		}
+		if query == "" {
+			continue
+		}
+		var found int
+		if err := shard.db.QueryRow("select exists(select 1 from "+tableName+" where Written < ?)", cutoff).Scan(&found); err != nil {
+			return nil, err
+		}
+		if found > 0 {
+			expired = append(expired, tableName)
+		}
+	}
+	return expired, nil
+}
+
+// deleteExpired deletes up to sweepBatch tiles of the tables written before
+// cutoff in one transaction and reports whether any may be left. Blobs of a
+// deduplicated file are dropped with the last tile referencing them.
+func deleteExpired(filePath string, tableNames []string, cutoff int64) (int64, bool, error) {
+	db, done, err := openShardForWrite(filePath)
+	if err != nil {
+		return 0, false, err
+	}
+	defer done()
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	var deleted int64
+	for _, tableName := range tableNames {
+		result, err := tx.Exec("delete from "+tableName+" where ID in (select ID from "+tableName+" where Written < ? limit ?)", cutoff, sweepBatch-deleted)
+		if err != nil {
+			_ = tx.Rollback()
+			return deleted, false, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			_ = tx.Rollback()
+			return deleted, false, err
+		}
+		if deleted += n; deleted >= sweepBatch {
+			break
+		}
+	}
+	more := deleted >= sweepBatch
+	if !more {
+		version, err := shardSchema(tx)
+		if err == nil && version >= shardSchemaDedup {
+			var allTables []string
+			if allTables, err = listTileTables(tx); err == nil {
+				err = deleteUnreferencedBlobs(tx, allTables)
+			}
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, false, err
+	}
+	return deleted, more, nil
+}
+
+// ExpirySweeper periodically deletes the expired tiles of every repository of a
+// catalog that sets a TTL, and the tile versions temporal repositories no
+// longer keep, see PruneVersions
+type ExpirySweeper struct {
+	catalog  *RepositoryCatalog
+	interval time.Duration
+	rate     float64
+
+	cancel    context.CancelFunc
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// StartExpirySweeper sweeps the repositories of catalog every interval, deleting
+// rate tiles per second at most. Close stops it.
+func StartExpirySweeper(catalog *RepositoryCatalog, interval time.Duration, rate float64) *ExpirySweeper {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &ExpirySweeper{catalog: catalog, interval: interval, rate: rate, cancel: cancel, done: make(chan struct{})}
+	go s.run(ctx)
+	return s
+}
+
+// Close stops the sweeper, interrupting a running sweep, and waits until it has
+func (s *ExpirySweeper) Close() error {
+	s.closeOnce.Do(func() {
+		s.cancel()
+		<-s.done
+	})
+	return nil
+}
+
+func (s *ExpirySweeper) run(ctx context.Context) {
+	defer close(s.done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.sweep(ctx)
+		}
+	}
+}
+
+// sweep deletes the expired tiles of every repository with a TTL and prunes the
+// versions of every temporal repository once
+func (s *ExpirySweeper) sweep(ctx context.Context) {
+	repositories, _, err := s.catalog.List()
+	if err != nil {
+		return
+	}
+	for _, repo := range repositories {
+		dir := filepath.Join(s.catalog.root, filepath.FromSlash(repo.Name))
+		if IsArchive(dir) {
+			continue
+		}
+		if repo.Temporal != nil && repo.Temporal.prunes() {
+			report, err := PruneVersions(ctx, dir)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Printf("Pruning tile versions of %s failed: %v", repo.Name, err)
+				RecordError("sweep", err)
+			}
+			if report.Deleted > 0 {
+				log.Printf("Deleted %d tile versions from %d files of %s", report.Deleted, report.Files, repo.Name)
+			}
+		}
+		if repo.TTLSeconds <= 0 {
+			continue
+		}
+		report, err := SweepExpired(ctx, dir, SweepOptions{Rate: s.rate})
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Sweeping expired tiles of %s failed: %v", repo.Name, err)
+			RecordError("sweep", err)
+		}
+		if report.Deleted > 0 {
+			log.Printf("Deleted %d expired tiles from %d files of %s", report.Deleted, report.Files, repo.Name)
+		}
+	}
+}
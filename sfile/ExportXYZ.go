@@ -0,0 +1,111 @@
+package sfile
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// formatExtensions maps tile formats to the file extension used for loose tiles
+var formatExtensions = map[string]string{"png": ".png", "jpg": ".jpg", "webp": ".webp", "gif": ".gif", "pbf": ".pbf", "json": ".json"}
+
+// ExportXYZDir writes the tiles of the repository at srcDir selected by opts to
+// destDir/z/x/y.ext, with the extension sniffed from each tile. Files already
+// present are skipped unless opts.Overwrite is set. Files are written by a pool
+// of opts.Workers goroutines. When ctx ends the export stops after the files in
+// progress and returns the summary so far together with ctx.Err().
+func ExportXYZDir(ctx context.Context, srcDir string, destDir string, opts ExportOptions) (ExportProgress, error) {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = ScanWorkers()
+	}
+	var tiles, skipped, bytes atomic.Int64
+	var zoom atomic.Int32
+	summary := func() ExportProgress {
+		return ExportProgress{Zoom: int8(zoom.Load()), Tiles: tiles.Load(), Skipped: skipped.Load(), Bytes: bytes.Load()}
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithCancelCause(parent)
+	defer cancel(nil)
+	queue := make(chan TileData, workers*4)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tile := range queue {
+				written, err := writeTileFile(destDir, tile, opts.TMS, opts.Overwrite)
+				if err != nil {
+					cancel(err)
+					continue
+				}
+				if written {
+					tiles.Add(1)
+					bytes.Add(int64(len(tile.Data)))
+				} else {
+					skipped.Add(1)
+				}
+			}
+		}()
+	}
+
+	err := exportTiles(srcDir, opts, DefaultImportBatchSize, func(batch []TileData) error {
+		for _, tile := range batch {
+			select {
+			case queue <- tile:
+			case <-ctx.Done():
+				return context.Cause(ctx)
+			}
+		}
+		zoom.Store(int32(batch[len(batch)-1].Z))
+		if opts.Progress != nil {
+			opts.Progress(summary())
+		}
+		return nil
+	})
+	close(queue)
+	wg.Wait()
+	if err == nil {
+		// a writer may have failed after the last batch was queued
+		err = context.Cause(ctx)
+	}
+	if err != nil && parent.Err() != nil {
+		err = parent.Err()
+	}
+	return summary(), err
+}
+
+// writeTileFile stores a tile below destDir, through a temporary file so an
+// interrupted export never leaves a truncated tile behind. It reports false when
+// the file exists and overwrite is not set.
+func writeTileFile(destDir string, tile TileData, tms bool, overwrite bool) (bool, error) {
+	y := tile.Y
+	if tms {
+		y = FlipY(y, int(tile.Z))
+	}
+	ext := formatExtensions[tileFormat(tile.Data)]
+	path := filepath.Join(destDir, strconv.Itoa(int(tile.Z)), strconv.FormatInt(tile.X, 10), strconv.FormatInt(y, 10)+ext)
+	if !overwrite {
+		if _, err := os.Stat(path); err == nil {
+			return false, nil
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, err
+	}
+	partial := fmt.Sprintf("%s.%d.partial", path, os.Getpid())
+	if err := os.WriteFile(partial, tile.Data, 0644); err != nil {
+		_ = os.Remove(partial)
+		return false, err
+	}
+	if err := os.Rename(partial, path); err != nil {
+		_ = os.Remove(partial)
+		return false, err
+	}
+	return true, nil
+}
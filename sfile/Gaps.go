@@ -0,0 +1,208 @@
+package sfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Pages of missing tiles returned by FindGapsWithOptions
+const (
+	DefaultGapLimit = 1000
+	MaxGapLimit     = 100000
+)
+
+// maxGapTiles bounds the tiles of a range checked for gaps, a quarter million tables
+const maxGapTiles = 1 << 30
+
+// ErrGapRangeTooLarge is returned for a bbox covering more than maxGapTiles tiles
+var ErrGapRangeTooLarge = errors.New("the bbox covers too many tiles at this zoom")
+
+// GapOptions selects the page of missing tiles FindGapsWithOptions returns
+type GapOptions struct {
+	Offset int64 // missing tiles skipped before the page
+	Limit  int   // missing tiles returned at most, none when not positive
+}
+
+// GapReport is the result of FindGapsWithOptions
+type GapReport struct {
+	Zoom       int8        `json:"zoom"`
+	Range      [4]int64    `json:"range"` // minX, minY, maxX, maxY of the tiles checked
+	Expected   int64       `json:"expected"`
+	Present    int64       `json:"present"`
+	Missing    int64       `json:"missing"`
+	Offset     int64       `json:"offset"`
+	Gaps       []TileCoord `json:"gaps,omitempty"`
+	NextOffset int64       `json:"next_offset,omitempty"` // offset of the next page, 0 when this is the last
+}
+
+// FindGaps returns up to DefaultGapLimit tiles missing at zoom z within bbox,
+// given in lng/lat, see FindGapsWithOptions
+func FindGaps(dir string, z int8, bbox Box) ([]TileCoord, error) {
+	report, err := FindGapsWithOptions(dir, z, bbox, GapOptions{Limit: DefaultGapLimit})
+	return report.Gaps, err
+}
+
+// FindGapsWithOptions counts the tiles missing at zoom z within bbox in the
+// repository in dir and returns the page of them selected by opts. Each .s file
+// covering the range is opened once and each of its tables read for its row IDs
+// only, one table at a time, so memory does not grow with the range; files and
+// tables that do not exist are counted as missing without being enumerated.
+// Missing tiles are ordered by file, then table, then row and column.
+func FindGapsWithOptions(dir string, z int8, bbox Box, opts GapOptions) (GapReport, error) {
+	minX, minY, maxX, maxY := repositoryGrid(dir).TileRange(bbox.Bounds(), z)
+	report := GapReport{
+		Zoom:     z,
+		Range:    [4]int64{minX, minY, maxX, maxY},
+		Expected: (maxX - minX + 1) * (maxY - minY + 1),
+		Offset:   max(opts.Offset, 0),
+		Gaps:     make([]TileCoord, 0),
+	}
+	if report.Expected > maxGapTiles {
+		return report, fmt.Errorf("%w: %d tiles", ErrGapRangeTooLarge, report.Expected)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return report, fmt.Errorf("%w: %s", ErrRepositoryNotFound, dir)
+	}
+	repository, err := openRepository(dir)
+	if err != nil {
+		return report, err
+	}
+	gaps := gapCollector{report: &report, limit: max(opts.Limit, 0), scheme: repository.shards()}
+	err = repository.rangeTables(z, report.Range, func(x0 int64, y0 int64, x1 int64, y1 int64, present []bool) error {
+		gaps.block(z, x0, y0, x1, y1, present)
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	report.Missing = report.Expected - report.Present
+	if report.Offset+int64(len(report.Gaps)) < report.Missing && len(report.Gaps) > 0 {
+		report.NextOffset = report.Offset + int64(len(report.Gaps))
+	}
+	return report, nil
+}
+
+// rangeTables calls fn for every table of zoom z intersecting the tile range r,
+// minX, minY, maxX, maxY, with the tiles x0..x1, y0..y1 of the table within r and
+// present marking the row IDs stored in it, nil when the table does not exist.
+// Each .s file is opened once and its tables are read one at a time, for their
+// row IDs only.
+func (f *SRepository) rangeTables(z int8, r [4]int64, fn func(x0 int64, y0 int64, x1 int64, y1 int64, present []bool) error) error {
+	file := f.shards().File
+	for shardY := r[1] / file; shardY <= r[3]/file; shardY++ {
+		for shardX := r[0] / file; shardX <= r[2]/file; shardX++ {
+			if err := f.shardTables(z, r, shardX, shardY, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// shardTables calls fn for the tables of the .s file shardX, shardY intersecting
+// the tile range r, see rangeTables
+func (f *SRepository) shardTables(z int8, r [4]int64, shardX int64, shardY int64, fn func(x0 int64, y0 int64, x1 int64, y1 int64, present []bool) error) error {
+	scheme := f.shards()
+	file, side := scheme.File, scheme.Table
+	filePath, _, _ := f.shardLocation(shardX*file, shardY*file, z)
+	shard, release, err := acquireShard(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		shard = nil
+	} else if err != nil {
+		return fmt.Errorf("open %s: %w", filePath, err)
+	} else {
+		defer release()
+	}
+	tables := file / side
+	for tableY := max(shardY*tables, r[1]/side); tableY <= min(shardY*tables+tables-1, r[3]/side); tableY++ {
+		for tableX := max(shardX*tables, r[0]/side); tableX <= min(shardX*tables+tables-1, r[2]/side); tableX++ {
+			// the tiles of this table within the range
+			x0, x1 := max(tableX*side, r[0]), min(tableX*side+side-1, r[2])
+			y0, y1 := max(tableY*side, r[1]), min(tableY*side+side-1, r[3])
+			var present []bool
+			if shard != nil {
+				present, err = tableIDs(shard, shardName(z, tableX, tableY), scheme)
+				if err != nil {
+					return fmt.Errorf("read %s: %w", filePath, err)
+				}
+			}
+			if err := fn(x0, y0, x1, y1, present); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// gapCollector counts the tiles present and collects the page of missing tiles
+type gapCollector struct {
+	report *GapReport
+	limit  int
+	seen   int64 // missing tiles met so far, in order
+	scheme ShardScheme
+}
+
+// block counts the tiles x0..x1, y0..y1 of one table, present marking its row
+// IDs or nil when the table does not exist
+func (g *gapCollector) block(z int8, x0 int64, y0 int64, x1 int64, y1 int64, present []bool) {
+	side := g.scheme.Table
+	tiles := (x1 - x0 + 1) * (y1 - y0 + 1)
+	found := int64(0)
+	if present == nil {
+		present = make([]bool, g.scheme.tableIDs())
+	} else {
+		for y := y0; y <= y1; y++ {
+			for x := x0; x <= x1; x++ {
+				if present[x%side+side*(y%side)] {
+					found++
+				}
+			}
+		}
+	}
+	g.report.Present += found
+	missing := tiles - found
+	if missing == 0 {
+		return
+	}
+	if len(g.report.Gaps) >= g.limit || g.seen+missing <= g.report.Offset {
+		// nothing of this table is on the page
+		g.seen += missing
+		return
+	}
+	for y := y0; y <= y1; y++ {
+		for x := x0; x <= x1; x++ {
+			if present[x%side+side*(y%side)] {
+				continue
+			}
+			if g.seen >= g.report.Offset && len(g.report.Gaps) < g.limit {
+				g.report.Gaps = append(g.report.Gaps, TileCoord{Z: z, X: x, Y: y})
+			}
+			g.seen++
+		}
+	}
+}
+
+// tableIDs marks the row IDs stored in a table, nil when the table does not exist
+func tableIDs(shard *handleEntry, tableName string, scheme ShardScheme) ([]bool, error) {
+	rows, err := shard.db.Query("select ID from " + tableName)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such table") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	present := make([]bool, scheme.tableIDs())
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		if id >= 0 && id < int64(len(present)) {
+			present[id] = true
+		}
+	}
+	return present, rows.Err()
+}
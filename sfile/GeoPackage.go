@@ -0,0 +1,321 @@
+package sfile
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GeoPackage SRS ids whose bounds can be converted to lng/lat
+const (
+	srsWebMercator = 3857
+	srsWGS84       = 4326
+)
+
+// gpkgMatrix maps one zoom level of a GeoPackage tile matrix onto the XYZ grid
+type gpkgMatrix struct {
+	zoomLevel int64 // zoom_level of the tiles table
+	colOffset int64 // XYZ column of tile_column 0
+	rowOffset int64 // XYZ row of tile_row 0
+}
+
+// GeoPackageLayer is a tile pyramid of a GeoPackage, served as a repository.
+// Only matrices aligned with the web mercator XYZ grid can be served, other
+// layers are listed with their bounds but have no tiles.
+type GeoPackageLayer struct {
+	pkg         *GeoPackage
+	table       string
+	identifier  string
+	description string
+	srsID       int64
+	bounds      [4]float64 // lng/lat, all zero when the SRS is not supported
+	matrices    map[int8]gpkgMatrix
+	tileSize    int // tile_width of the aligned matrices, 0 when none is aligned
+}
+
+// GeoPackage is an OGC GeoPackage file holding one or more tile pyramids
+type GeoPackage struct {
+	path    string
+	db      *sql.DB
+	modTime time.Time
+	size    int64
+	layers  map[string]*GeoPackageLayer // by table name
+}
+
+// OpenGeoPackage opens the GeoPackage at path read only and discovers its tile layers
+func OpenGeoPackage(path string) (*GeoPackage, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openShard("file:" + path + "?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	pkg := &GeoPackage{path: path, db: db, modTime: info.ModTime(), size: info.Size(), layers: make(map[string]*GeoPackageLayer)}
+	if err := pkg.readLayers(); err != nil {
+		_ = closeShard(db)
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return pkg, nil
+}
+
+// readLayers reads gpkg_contents, gpkg_tile_matrix_set and gpkg_tile_matrix
+func (g *GeoPackage) readLayers() error {
+	rows, err := g.db.Query(`select c.table_name, coalesce(c.identifier, ''), coalesce(c.description, ''), s.srs_id, s.min_x, s.min_y, s.max_x, s.max_y,
+		c.min_x, c.min_y, c.max_x, c.max_y
+		from gpkg_contents c join gpkg_tile_matrix_set s on s.table_name = c.table_name
+		where c.data_type = 'tiles'`)
+	if err != nil {
+		return err
+	}
+	type matrixSet struct {
+		layer                  *GeoPackageLayer
+		minX, minY, maxX, maxY float64
+	}
+	sets := make([]matrixSet, 0)
+	for rows.Next() {
+		var set matrixSet
+		layer := &GeoPackageLayer{pkg: g, matrices: make(map[int8]gpkgMatrix)}
+		var contentMinX, contentMinY, contentMaxX, contentMaxY sql.NullFloat64
+		if err := rows.Scan(&layer.table, &layer.identifier, &layer.description, &layer.srsID, &set.minX, &set.minY, &set.maxX, &set.maxY,
+			&contentMinX, &contentMinY, &contentMaxX, &contentMaxY); err != nil {
+			rows.Close()
+			return err
+		}
+		// the contents extent is optional and tighter than the matrix set extent
+		extent := [4]float64{set.minX, set.minY, set.maxX, set.maxY}
+		if contentMinX.Valid && contentMinY.Valid && contentMaxX.Valid && contentMaxY.Valid {
+			extent = [4]float64{contentMinX.Float64, contentMinY.Float64, contentMaxX.Float64, contentMaxY.Float64}
+		}
+		layer.bounds = srsBounds(layer.srsID, extent)
+		set.layer = layer
+		sets = append(sets, set)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, set := range sets {
+		if set.layer.srsID == srsWebMercator {
+			if err := g.readMatrices(set.layer, set.minX, set.maxY, set.maxX-set.minX, set.maxY-set.minY); err != nil {
+				return err
+			}
+		}
+		g.layers[set.layer.table] = set.layer
+	}
+	return nil
+}
+
+// readMatrices maps the zoom levels of a web mercator layer whose matrix set has
+// its top left corner at minX/maxY onto XYZ zooms. Levels not aligned with the
+// XYZ grid are left out.
+func (g *GeoPackage) readMatrices(layer *GeoPackageLayer, minX float64, maxY float64, width float64, height float64) error {
+	rows, err := g.db.Query("select zoom_level, matrix_width, matrix_height, tile_width from gpkg_tile_matrix where table_name = ?", layer.table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	world := 2 * ORIGIN_SHIFT
+	for rows.Next() {
+		var zoomLevel, matrixWidth, matrixHeight, tileWidth int64
+		if err := rows.Scan(&zoomLevel, &matrixWidth, &matrixHeight, &tileWidth); err != nil {
+			return err
+		}
+		if matrixWidth <= 0 || matrixHeight <= 0 {
+			continue
+		}
+		span := width / float64(matrixWidth)
+		zoom := math.Log2(world / span)
+		colOffset := (minX + ORIGIN_SHIFT) / span
+		rowOffset := (ORIGIN_SHIFT - maxY) / span
+		if !nearInteger(zoom) || !nearInteger(colOffset) || !nearInteger(rowOffset) || !nearInteger(height/span) || math.Round(zoom) < 0 || math.Round(zoom) > MaxTileZoom {
+			continue
+		}
+		layer.matrices[int8(math.Round(zoom))] = gpkgMatrix{zoomLevel: zoomLevel, colOffset: int64(math.Round(colOffset)), rowOffset: int64(math.Round(rowOffset))}
+		layer.tileSize = max(layer.tileSize, int(tileWidth))
+	}
+	return rows.Err()
+}
+
+// nearInteger reports whether v is an integer up to floating point noise
+func nearInteger(v float64) bool {
+	return math.Abs(v-math.Round(v)) < 1e-6
+}
+
+// srsBounds converts an extent in the given SRS to lng/lat, returning zeros for
+// SRS ids that are not supported
+func srsBounds(srsID int64, extent [4]float64) [4]float64 {
+	switch srsID {
+	case srsWGS84:
+		return extent
+	case srsWebMercator:
+		minLng, minLat := MetersToLngLat(extent[0], extent[1])
+		maxLng, maxLat := MetersToLngLat(extent[2], extent[3])
+		return [4]float64{minLng, minLat, maxLng, maxLat}
+	default:
+		return [4]float64{}
+	}
+}
+
+// Layers returns the table names of the tile layers, sorted
+func (g *GeoPackage) Layers() []string {
+	names := make([]string, 0, len(g.layers))
+	for name := range g.layers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Layer returns the tile layer stored in table
+func (g *GeoPackage) Layer(table string) (*GeoPackageLayer, bool) {
+	layer, ok := g.layers[table]
+	return layer, ok
+}
+
+// Close closes the GeoPackage
+func (g *GeoPackage) Close() error {
+	return closeShard(g.db)
+}
+
+// quoteIdentifier quotes a table name read from the GeoPackage for use in SQL
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// GetXYZContext returns tile x/y/z of the layer
+func (l *GeoPackageLayer) GetXYZContext(ctx context.Context, x int64, y int64, z int8) (*bytes.Buffer, error) {
+	if err := checkTile(x, y, z); err != nil {
+		return nil, err
+	}
+	matrix, ok := l.matrices[z]
+	if !ok {
+		return nil, fmt.Errorf("%w: zoom %d not in %s of %s", ErrTileNotFound, z, l.table, l.pkg.path)
+	}
+	var data []byte
+	err := l.pkg.db.QueryRowContext(ctx, "select tile_data from "+quoteIdentifier(l.table)+" where zoom_level = ? and tile_column = ? and tile_row = ?",
+		matrix.zoomLevel, x-matrix.colOffset, y-matrix.rowOffset).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %d/%d/%d not exist in %s of %s", ErrTileNotFound, z, x, y, l.table, l.pkg.path)
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			RecordError("gpkg", fmt.Errorf("read %s: %w", l.pkg.path, err))
+		}
+		return nil, err
+	}
+	return bytes.NewBuffer(data), nil
+}
+
+// Repository describes the layer as the repository name
+func (l *GeoPackageLayer) Repository(name string) Repository {
+	repo := defaultRepository(name)
+	repo.Size = float64(l.pkg.size)
+	repo.Title, repo.Description = l.identifier, l.description
+	if l.bounds != [4]float64{} {
+		repo.Pared = true
+		repo.Bounds = l.bounds
+		repo.Lng, repo.Lat = 0.5*(l.bounds[0]+l.bounds[2]), 0.5*(l.bounds[1]+l.bounds[3])
+	}
+	if len(l.matrices) > 0 {
+		repo.MinZoom, repo.MaxZoom = 25, 0
+		for zoom := range l.matrices {
+			repo.MinZoom, repo.MaxZoom = min(repo.MinZoom, int(zoom)), max(repo.MaxZoom, int(zoom))
+		}
+		repo.Zoom = repo.MaxZoom
+	}
+	if l.tileSize > 0 {
+		repo.TileSize = l.tileSize
+	}
+	var sample []byte
+	if err := l.pkg.db.QueryRow("select tile_data from " + quoteIdentifier(l.table) + " limit 1").Scan(&sample); err == nil && len(sample) > 0 {
+		repo.Format = tileFormat(sample)
+	}
+	return repo
+}
+
+// IsGeoPackage reports whether path is a .gpkg file
+func IsGeoPackage(path string) bool {
+	if !strings.EqualFold(filepath.Ext(path), ".gpkg") {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// geoPackages keeps GeoPackages open between requests, by absolute path
+var geoPackages = struct {
+	sync.Mutex
+	open map[string]*GeoPackage
+}{open: make(map[string]*GeoPackage)}
+
+// openCachedGeoPackage returns the open GeoPackage of path, reopening it when the
+// file changed on disk. Replaced GeoPackages are closed, queries already running on
+// them still finish.
+func openCachedGeoPackage(path string) (*GeoPackage, error) {
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(absolute)
+	if err != nil {
+		return nil, err
+	}
+	geoPackages.Lock()
+	defer geoPackages.Unlock()
+	if pkg, ok := geoPackages.open[absolute]; ok {
+		if pkg.modTime.Equal(info.ModTime()) && pkg.size == info.Size() {
+			return pkg, nil
+		}
+		_ = pkg.Close()
+	}
+	pkg, err := OpenGeoPackage(absolute)
+	if err != nil {
+		return nil, err
+	}
+	geoPackages.open[absolute] = pkg
+	return pkg, nil
+}
+
+func init() {
+	RegisterTileSource(TileBackend{
+		Name: "gpkg",
+		Match: func(path string) bool {
+			return IsGeoPackage(filepath.Dir(path))
+		},
+		Open: func(root string, name string) (TileSource, error) {
+			layer, err := openGeoPackageLayer(filepath.Join(root, filepath.FromSlash(name)))
+			if err != nil {
+				return nil, err
+			}
+			return archiveSource{
+				read:     layer.GetXYZContext,
+				metadata: func() Repository { return layer.Repository(name) },
+			}, nil
+		},
+	})
+}
+
+// openGeoPackageLayer returns the layer addressed by path, which is the path of a
+// .gpkg file followed by the layer table name
+func openGeoPackageLayer(path string) (*GeoPackageLayer, error) {
+	pkg, err := openCachedGeoPackage(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+	layer, ok := pkg.Layer(filepath.Base(path))
+	if !ok {
+		return nil, fmt.Errorf("%s has no tile layer %q", filepath.Dir(path), filepath.Base(path))
+	}
+	return layer, nil
+}
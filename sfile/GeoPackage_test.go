@@ -0,0 +1,231 @@
+package sfile
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// gpkgFixtureTile is the content of tile zoom_level/tile_column/tile_row of a
+// table of writeGeoPackageFixture, a PNG signature followed by its address
+func gpkgFixtureTile(table string, zoomLevel int64, column int64, row int64) []byte {
+	return fmt.Appendf([]byte("\x89PNG\r\n\x1a\n"), "%s %d/%d/%d", table, zoomLevel, column, row)
+}
+
+// writeGeoPackageFixture writes a GeoPackage of four tile layers and a feature
+// table:
+//   - world, the whole web mercator world at zoom levels 0 and 1, 512 pixels
+//   - quadrant, the north east quadrant from XYZ zoom 1, its zoom levels
+//     numbered from 5, with a contents extent tighter than its matrix set and a
+//     level of 3x3 tiles that is not on the XYZ grid
+//   - wgs84, in EPSG:4326, and custom, in an SRS that is not supported
+func writeGeoPackageFixture(t *testing.T, path string) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(`
+		create table gpkg_spatial_ref_sys (srs_name text not null, srs_id integer primary key, organization text not null,
+			organization_coordsys_id integer not null, definition text not null, description text);
+		insert into gpkg_spatial_ref_sys values ('WGS 84', 4326, 'EPSG', 4326, 'undefined', null),
+			('WGS 84 / Pseudo-Mercator', 3857, 'EPSG', 3857, 'undefined', null), ('local grid', 2000, 'NONE', 2000, 'undefined', null);
+		create table gpkg_contents (table_name text not null primary key, data_type text not null, identifier text unique,
+			description text default '', last_change datetime not null default (strftime('%Y-%m-%dT%H:%M:%fZ','now')),
+			min_x double, min_y double, max_x double, max_y double, srs_id integer);
+		create table gpkg_tile_matrix_set (table_name text not null primary key, srs_id integer not null,
+			min_x double not null, min_y double not null, max_x double not null, max_y double not null);
+		create table gpkg_tile_matrix (table_name text not null, zoom_level integer not null, matrix_width integer not null,
+			matrix_height integer not null, tile_width integer not null, tile_height integer not null,
+			pixel_x_size double not null, pixel_y_size double not null, primary key (table_name, zoom_level));
+		create table roads (fid integer primary key, geom blob);
+		insert into gpkg_contents (table_name, data_type, identifier, srs_id) values ('roads', 'features', 'Roads', 4326);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type level struct{ zoomLevel, matrixWidth, tileWidth int64 }
+	layers := []struct {
+		table, identifier string
+		srsID             int64
+		set               [4]float64
+		contents          []any // min_x, min_y, max_x, max_y, or nil for none
+		levels            []level
+		tiles             [][3]int64
+	}{
+		{"world", "World", srsWebMercator, [4]float64{-ORIGIN_SHIFT, -ORIGIN_SHIFT, ORIGIN_SHIFT, ORIGIN_SHIFT}, nil,
+			[]level{{0, 1, 512}, {1, 2, 512}}, [][3]int64{{0, 0, 0}, {1, 1, 0}, {1, 0, 1}}},
+		{"quadrant", "North east", srsWebMercator, [4]float64{0, 0, ORIGIN_SHIFT, ORIGIN_SHIFT}, []any{0, 0, ORIGIN_SHIFT / 2, ORIGIN_SHIFT / 2},
+			[]level{{5, 1, 256}, {6, 2, 256}, {7, 3, 256}}, [][3]int64{{5, 0, 0}, {6, 1, 1}, {6, 0, 0}, {7, 0, 0}}},
+		{"wgs84", "Geographic", srsWGS84, [4]float64{-180, -90, 180, 90}, []any{100, 20, 120, 40},
+			[]level{{0, 2, 256}}, [][3]int64{{0, 1, 0}}},
+		{"custom", "Local grid", 2000, [4]float64{0, 0, 1000, 1000}, nil,
+			[]level{{0, 1, 256}}, [][3]int64{{0, 0, 0}}},
+	}
+	for _, layer := range layers {
+		contents := layer.contents
+		if contents == nil {
+			contents = []any{nil, nil, nil, nil}
+		}
+		_, err := db.Exec("insert into gpkg_contents (table_name, data_type, identifier, description, min_x, min_y, max_x, max_y, srs_id) values (?, 'tiles', ?, ?, ?, ?, ?, ?, ?)",
+			layer.table, layer.identifier, "the "+layer.table+" layer", contents[0], contents[1], contents[2], contents[3], layer.srsID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("insert into gpkg_tile_matrix_set values (?, ?, ?, ?, ?, ?)",
+			layer.table, layer.srsID, layer.set[0], layer.set[1], layer.set[2], layer.set[3]); err != nil {
+			t.Fatal(err)
+		}
+		for _, level := range layer.levels {
+			pixel := (layer.set[2] - layer.set[0]) / float64(level.matrixWidth*level.tileWidth)
+			if _, err := db.Exec("insert into gpkg_tile_matrix values (?, ?, ?, ?, ?, ?, ?, ?)",
+				layer.table, level.zoomLevel, level.matrixWidth, level.matrixWidth, level.tileWidth, level.tileWidth, pixel, pixel); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := db.Exec("create table " + quoteIdentifier(layer.table) + ` (id integer primary key autoincrement, zoom_level integer not null,
+			tile_column integer not null, tile_row integer not null, tile_data blob not null, unique (zoom_level, tile_column, tile_row))`); err != nil {
+			t.Fatal(err)
+		}
+		for _, tile := range layer.tiles {
+			if _, err := db.Exec("insert into "+quoteIdentifier(layer.table)+" (zoom_level, tile_column, tile_row, tile_data) values (?, ?, ?, ?)",
+				tile[0], tile[1], tile[2], gpkgFixtureTile(layer.table, tile[0], tile[1], tile[2])); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// TestGeoPackage opens the fixture GeoPackage and checks its tile layers are
+// found, XYZ tiles are read from the matrix each zoom is aligned with at its
+// offset, and the layers are described with bounds converted to lng/lat
+func TestGeoPackage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fixture.gpkg")
+	writeGeoPackageFixture(t, path)
+	pkg, err := OpenGeoPackage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pkg.Close()
+	if got, want := pkg.Layers(), []string{"custom", "quadrant", "wgs84", "world"}; !slices.Equal(got, want) {
+		t.Fatalf("layers %v, want %v", got, want)
+	}
+
+	for _, tc := range []struct {
+		table string
+		tiles map[TileCoord]string // XYZ tile to the table content, empty when missing
+	}{
+		{"world", map[TileCoord]string{
+			{Z: 0, X: 0, Y: 0}: "0/0/0", {Z: 1, X: 1, Y: 0}: "1/1/0", {Z: 1, X: 0, Y: 1}: "1/0/1",
+			{Z: 1, X: 0, Y: 0}: "", {Z: 1, X: 1, Y: 1}: "", {Z: 2, X: 0, Y: 0}: "",
+		}},
+		{"quadrant", map[TileCoord]string{
+			{Z: 1, X: 1, Y: 0}: "5/0/0", {Z: 2, X: 2, Y: 0}: "6/0/0", {Z: 2, X: 3, Y: 1}: "6/1/1",
+			{Z: 0, X: 0, Y: 0}: "", {Z: 1, X: 0, Y: 0}: "", {Z: 2, X: 0, Y: 0}: "", {Z: 2, X: 3, Y: 2}: "", {Z: 3, X: 4, Y: 0}: "",
+		}},
+		{"wgs84", map[TileCoord]string{{Z: 0, X: 0, Y: 0}: "", {Z: 1, X: 1, Y: 0}: ""}},
+		{"custom", map[TileCoord]string{{Z: 0, X: 0, Y: 0}: ""}},
+	} {
+		layer, ok := pkg.Layer(tc.table)
+		if !ok {
+			t.Fatalf("no layer %s", tc.table)
+		}
+		for tile, address := range tc.tiles {
+			data, err := layer.GetXYZContext(context.Background(), tile.X, tile.Y, tile.Z)
+			if address == "" {
+				if !errors.Is(err, ErrTileNotFound) {
+					t.Errorf("%s: %d/%d/%d = %v, want not found", tc.table, tile.Z, tile.X, tile.Y, err)
+				}
+				continue
+			}
+			want := fmt.Sprintf("\x89PNG\r\n\x1a\n%s %s", tc.table, address)
+			if err != nil || data.String() != want {
+				t.Errorf("%s: %d/%d/%d = %q, %v, want %q", tc.table, tile.Z, tile.X, tile.Y, data, err, want)
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		table            string
+		pared            bool
+		bounds           [4]float64
+		minZoom, maxZoom int
+		tileSize         int
+	}{
+		{"world", true, [4]float64{-180, -MaxLatitude, 180, MaxLatitude}, 0, 1, 512},
+		{"quadrant", true, [4]float64{0, 0, 90, 66.51326044311186}, 1, 2, 256},
+		{"wgs84", true, [4]float64{100, 20, 120, 40}, 0, 0, 256},
+		{"custom", false, [4]float64{}, 0, 0, 256},
+	} {
+		layer, _ := pkg.Layer(tc.table)
+		repo := layer.Repository("fixture.gpkg/" + tc.table)
+		if repo.Name != "fixture.gpkg/"+tc.table || repo.Title == "" || repo.Description != "the "+tc.table+" layer" || repo.Format != "png" {
+			t.Errorf("%s: repository %+v", tc.table, repo)
+		}
+		if repo.Pared != tc.pared || !closeBox(Box{MinX: repo.Bounds[0], MinY: repo.Bounds[1], MaxX: repo.Bounds[2], MaxY: repo.Bounds[3]},
+			Box{MinX: tc.bounds[0], MinY: tc.bounds[1], MaxX: tc.bounds[2], MaxY: tc.bounds[3]}) {
+			t.Errorf("%s: pared %v, bounds %v, want %v, %v", tc.table, repo.Pared, repo.Bounds, tc.pared, tc.bounds)
+		}
+		if repo.MinZoom != tc.minZoom || repo.MaxZoom != tc.maxZoom || repo.TileSize != tc.tileSize {
+			t.Errorf("%s: zooms %d..%d of %d pixels, want %d..%d of %d", tc.table, repo.MinZoom, repo.MaxZoom, repo.TileSize, tc.minZoom, tc.maxZoom, tc.tileSize)
+		}
+	}
+}
+
+// TestGeoPackageRepositories lists a GeoPackage in a repository root and checks
+// each tile layer, and no feature table, is served as file.gpkg/layer
+func TestGeoPackageRepositories(t *testing.T) {
+	root := t.TempDir()
+	writeGeoPackageFixture(t, filepath.Join(root, "fixture.gpkg"))
+	t.Cleanup(func() {
+		geoPackages.Lock()
+		defer geoPackages.Unlock()
+		for path, pkg := range geoPackages.open {
+			if strings.HasPrefix(path, root) {
+				_ = pkg.Close()
+				delete(geoPackages.open, path)
+			}
+		}
+	})
+
+	repositories, err := ScanRepositories(root, ScanOptions{Depth: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	titles := make(map[string]string)
+	for _, repo := range repositories {
+		titles[repo.Name] = repo.Title
+	}
+	want := map[string]string{
+		"fixture.gpkg/custom":   "Local grid",
+		"fixture.gpkg/quadrant": "North east",
+		"fixture.gpkg/wgs84":    "Geographic",
+		"fixture.gpkg/world":    "World",
+	}
+	if len(titles) != len(want) {
+		t.Fatalf("repositories %v, want %v", titles, want)
+	}
+	for name, title := range want {
+		if titles[name] != title {
+			t.Errorf("repository %s titled %q, want %q", name, titles[name], title)
+		}
+	}
+
+	source, err := OpenTileSource(root, "fixture.gpkg/quadrant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	tile, err := source.GetTile(context.Background(), 2, 3, 1)
+	if want := string(gpkgFixtureTile("quadrant", 6, 1, 1)); err != nil || string(tile.Data) != want {
+		t.Errorf("tile 2/3/1 of the quadrant layer = %q, %v, want %q", tile.Data, err, want)
+	}
+	if _, err := OpenTileSource(root, "fixture.gpkg/roads"); err == nil {
+		t.Error("the feature table roads opened as a tile source")
+	}
+}
@@ -0,0 +1,336 @@
+package sfile
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultHandleCacheSize is how many shard databases are kept open by default
+const DefaultHandleCacheSize = 64
+
+// handleEntry is an open shard database kept by the handle cache
+type handleEntry struct {
+	path     string
+	db       *sql.DB
+	modTime  time.Time
+	size     int64
+	refs     int    // callers currently using db
+	evicted  bool   // db is closed as soon as refs drops to zero
+	dedup    bool   // the file has the deduplicated layout, see shardSchemaDedup
+	format   string // format recorded in the meta table of the file, see recordShardFormat
+	checksum string // checksum algorithm recorded in the meta table of the file, see createShardTable
+
+	stmtMu sync.Mutex
+	stmts  map[string]*sql.Stmt // prepared statements by query
+
+	checksumQueries map[string]string   // by table, see checksumQuery; guarded by stmtMu
+	writtenQueries  map[string]string   // by table, see writtenQuery; guarded by stmtMu
+	readQueries     map[string]tileRead // by table, see tileReadQuery; guarded by stmtMu
+}
+
+// statement returns query prepared on the entry's database, preparing it only once
+func (e *handleEntry) statement(ctx context.Context, query string) (*sql.Stmt, error) {
+	e.stmtMu.Lock()
+	defer e.stmtMu.Unlock()
+	if stmt, ok := e.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := e.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	if e.stmts == nil {
+		e.stmts = make(map[string]*sql.Stmt)
+	}
+	e.stmts[query] = stmt
+	return stmt, nil
+}
+
+// close closes the prepared statements and the database of the entry
+func (e *handleEntry) close() {
+	e.stmtMu.Lock()
+	for _, stmt := range e.stmts {
+		_ = stmt.Close()
+	}
+	e.stmts = nil
+	e.stmtMu.Unlock()
+	_ = closeShard(e.db)
+}
+
+// handleCache is an LRU of open shard databases keyed by absolute path. Entries
+// are invalidated when the file changes on disk or disappears, and a handle still
+// in use by a reader is only closed once that reader releases it.
+type handleCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List // front is the most recently used entry
+	entries  map[string]*list.Element
+}
+
+var handles = &handleCache{
+	capacity: DefaultHandleCacheSize,
+	order:    list.New(),
+	entries:  make(map[string]*list.Element),
+}
+
+// SetHandleCacheSize changes how many shard databases are kept open, 0 disables caching
+func SetHandleCacheSize(size int) {
+	handles.mu.Lock()
+	defer handles.mu.Unlock()
+	handles.capacity = max(size, 0)
+	handles.trim()
+}
+
+// CachedHandles returns the number of shard databases held by the handle cache
+func CachedHandles() int {
+	handles.mu.Lock()
+	defer handles.mu.Unlock()
+	return handles.order.Len()
+}
+
+// FlushHandles closes the cached handles whose file path matches and returns how many were dropped
+func FlushHandles(match func(path string) bool) int {
+	handles.mu.Lock()
+	defer handles.mu.Unlock()
+	flushed := 0
+	for _, element := range handles.entries {
+		entry := element.Value.(*handleEntry)
+		if match(entry.path) {
+			handles.remove(element)
+			flushed++
+		}
+	}
+	return flushed
+}
+
+// acquireShard returns an open database for the .s file at filePath, reusing a
+// cached handle when the file has not changed since it was opened. The returned
+// function must be called once the caller is done with the database.
+func acquireShard(filePath string) (*handleEntry, func(), error) {
+	absolute, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := os.Stat(absolute)
+	if err != nil {
+		handles.invalidate(absolute)
+		return nil, nil, err
+	}
+
+	handles.mu.Lock()
+	if element, ok := handles.entries[absolute]; ok {
+		entry := element.Value.(*handleEntry)
+		if entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+			entry.refs++
+			handles.order.MoveToFront(element)
+			handles.mu.Unlock()
+			return entry, func() { handles.release(entry) }, nil
+		}
+		handles.remove(element)
+	}
+	capacity := handles.capacity
+	handles.mu.Unlock()
+
+	db, err := openShardForRead(absolute)
+	if err != nil {
+		return nil, nil, err
+	}
+	entry, err := newHandleEntry(absolute, info, db)
+	if err != nil {
+		return nil, nil, err
+	}
+	if capacity == 0 {
+		return entry, entry.close, nil
+	}
+	db.SetMaxOpenConns(4)
+	db.SetMaxIdleConns(4)
+
+	handles.mu.Lock()
+	defer handles.mu.Unlock()
+	if element, ok := handles.entries[absolute]; ok {
+		// another reader cached the same file meanwhile, keep the newest handle
+		handles.remove(element)
+	}
+	handles.entries[absolute] = handles.order.PushFront(entry)
+	handles.trim()
+	return entry, func() { handles.release(entry) }, nil
+}
+
+// openShardMetadata returns a handle of the .s file at filePath opened with
+// openShardForMetadata, for reads of the extent, formats and sizes of a
+// repository. It is not cached, the returned function closes it.
+func openShardMetadata(filePath string) (*handleEntry, func(), error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := openShardForMetadata(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	entry, err := newHandleEntry(filePath, info, db)
+	if err != nil {
+		return nil, nil, err
+	}
+	return entry, entry.close, nil
+}
+
+// newHandleEntry returns a handle of db, the .s file at path, holding one
+// reference. db is closed when the layout of the file cannot be read.
+func newHandleEntry(path string, info os.FileInfo, db *sql.DB) (*handleEntry, error) {
+	version, err := shardSchema(db)
+	if err != nil {
+		_ = closeShard(db)
+		return nil, err
+	}
+	format, err := shardFormat(db)
+	if err != nil {
+		_ = closeShard(db)
+		return nil, err
+	}
+	checksum, err := shardChecksum(db)
+	if err != nil {
+		_ = closeShard(db)
+		return nil, err
+	}
+	return &handleEntry{path: path, db: db, modTime: info.ModTime(), size: info.Size(), refs: 1, dedup: version >= shardSchemaDedup, format: format, checksum: checksum}, nil
+}
+
+// assumeImmutable makes readers open every .s file immutable, see SetAssumeImmutable
+var assumeImmutable atomic.Bool
+
+// SetAssumeImmutable promises that no .s file changes while it is served, so
+// readers open every file immutable and sqlite skips its locks and journal
+// checks. Files on read-only storage are opened immutable regardless.
+func SetAssumeImmutable(enabled bool) {
+	assumeImmutable.Store(enabled)
+}
+
+// uriEscaper escapes the characters of a path that a sqlite URI would misread
+var uriEscaper = strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23")
+
+// readOnlyDSN opens the .s file at filePath read-only, and immutable when
+// nothing can change it while it is open
+func readOnlyDSN(filePath string, immutable bool) string {
+	dsn := fmt.Sprintf("file:%s?mode=ro&_query_only=1&_busy_timeout=%d", uriEscaper.Replace(filepath.ToSlash(filePath)), shardBusyTimeout.Milliseconds())
+	if immutable {
+		dsn += "&immutable=1"
+	}
+	return dsn
+}
+
+// queryOnlyDSN opens the .s file at filePath read-write, with every statement
+// that would write refused
+func queryOnlyDSN(filePath string) string {
+	return fmt.Sprintf("file:%s?mode=rw&_query_only=1&_busy_timeout=%d", uriEscaper.Replace(filepath.ToSlash(filePath)), shardBusyTimeout.Milliseconds())
+}
+
+// walMode reports whether the sqlite file at filePath is in WAL mode, which its
+// header records as file format version 2
+func walMode(filePath string) bool {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	header := make([]byte, 20)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return false
+	}
+	return string(header[:16]) == "SQLite format 3\x00" && header[18] == 2 && header[19] == 2
+}
+
+// openShardForRead opens the .s file at filePath for serving tiles, taking no
+// write locks and leaving the files of the repository as they were once the
+// handle is closed:
+//   - immutable, so sqlite neither locks nor reads a journal, on read-only
+//     storage, in a directory this process may not write to, where a read-only
+//     connection to a file in WAL mode could not create the -shm file it needs,
+//     and with SetAssumeImmutable
+//   - read-write but query only for files in WAL mode, whose readers need -wal
+//     and -shm files next to them. A read-only connection cannot checkpoint and
+//     would leave them behind, the last connection closing removes them. They
+//     are there while the handle is cached.
+//   - read-only otherwise, readers of rollback journal files create nothing
+//
+// When the driver rejects the URI the file is opened the default way instead.
+func openShardForRead(filePath string) (*sql.DB, error) {
+	dsn := readOnlyDSN(filePath, false)
+	switch {
+	case assumeImmutable.Load() || readOnlyStorage(filePath) || !writableDir(filepath.Dir(filePath)):
+		dsn = readOnlyDSN(filePath, true)
+	case walMode(filePath):
+		dsn = queryOnlyDSN(filePath)
+	}
+	return openShardDSN(filePath, dsn)
+}
+
+// openShardForMetadata opens the .s file at filePath immutable, for reads of
+// the extent, formats and sizes of a repository that must neither lock the
+// file nor create anything next to it, as listing repositories does. Tiles a
+// writer added to the -wal file of the shard but not checkpointed into it yet
+// are not seen, which such estimates can afford.
+func openShardForMetadata(filePath string) (*sql.DB, error) {
+	return openShardDSN(filePath, readOnlyDSN(filePath, true))
+}
+
+// openShardDSN opens the .s file at filePath with dsn, or the default way when
+// the driver rejects it
+func openShardDSN(filePath string, dsn string) (*sql.DB, error) {
+	db, err := openShard(dsn)
+	if err == nil {
+		if err = db.Ping(); err == nil {
+			return db, nil
+		}
+		_ = closeShard(db)
+	}
+	return openShard(fmt.Sprintf("%s?_busy_timeout=%d", filePath, shardBusyTimeout.Milliseconds()))
+}
+
+// invalidate drops the cached handle of path, if any
+func (c *handleCache) invalidate(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[path]; ok {
+		c.remove(element)
+	}
+}
+
+// release gives back a handle obtained from acquireShard
+func (c *handleCache) release(entry *handleEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.refs--
+	if entry.evicted && entry.refs == 0 {
+		entry.close()
+	}
+}
+
+// remove takes an entry out of the cache, closing its database unless it is in use.
+// The caller must hold c.mu.
+func (c *handleCache) remove(element *list.Element) {
+	entry := element.Value.(*handleEntry)
+	c.order.Remove(element)
+	delete(c.entries, entry.path)
+	entry.evicted = true
+	if entry.refs == 0 {
+		entry.close()
+	}
+}
+
+// trim evicts least recently used entries until the cache fits its capacity.
+// The caller must hold c.mu.
+func (c *handleCache) trim() {
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+	}
+}
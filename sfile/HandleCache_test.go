@@ -0,0 +1,109 @@
+package sfile
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// snapshotTree returns the SHA-256 of every file under dir by relative path
+func snapshotTree(t testing.TB, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		rel, _ := filepath.Rel(dir, path)
+		files[rel] = hex.EncodeToString(sum[:])
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// TestReadsLeaveRepositoryUntouched analyses, counts and serves the tiles of a
+// repository of WAL mode shards and checks that no file was created or changed
+func TestReadsLeaveRepositoryUntouched(t *testing.T) {
+	base := t.TempDir()
+	dir := filepath.Join(base, "repo")
+	if _, err := NewRepository(dir, true); !errors.Is(err, ErrRepositoryNotFound) {
+		t.Fatalf("creating the repository: %v", err)
+	}
+	repo, err := NewRepository(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x := int64(0); x < 4; x++ {
+		if err := repo.WriteXYZ(x, 1, 3, []byte{0x89, 'P', 'N', 'G', byte(x)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	FlushHandles(func(string) bool { return true })
+	before := snapshotTree(t, dir)
+
+	if _, err := analysedRepository(base, "repo", os.ErrNotExist); err != nil {
+		t.Fatalf("analysing: %v", err)
+	}
+	if _, err := ComputeStats(dir); err != nil {
+		t.Fatalf("counting: %v", err)
+	}
+	if _, err := repo.GetXYZ(2, 1, 3); err != nil {
+		t.Fatalf("serving: %v", err)
+	}
+	FlushHandles(func(string) bool { return true })
+
+	after := snapshotTree(t, dir)
+	for path, sum := range after {
+		if before[path] == "" {
+			t.Errorf("%s was created", path)
+		} else if before[path] != sum {
+			t.Errorf("%s was changed", path)
+		}
+	}
+	for path := range before {
+		if after[path] == "" {
+			t.Errorf("%s was removed", path)
+		}
+	}
+}
+
+// TestReadOnlyDirectory serves a tile of a WAL mode shard in a directory this
+// process may not write to, where sqlite could not create the -shm file
+func TestReadOnlyDirectory(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root may write to any directory")
+	}
+	dir := filepath.Join(t.TempDir(), "repo")
+	if _, err := NewRepository(dir, true); !errors.Is(err, ErrRepositoryNotFound) {
+		t.Fatalf("creating the repository: %v", err)
+	}
+	repo, err := NewRepository(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.WriteXYZ(0, 0, 3, []byte("tile")); err != nil {
+		t.Fatal(err)
+	}
+	FlushHandles(func(string) bool { return true })
+	zoomDir := filepath.Join(dir, zoomName(3))
+	if err := os.Chmod(zoomDir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(zoomDir, 0755)
+	defer FlushHandles(func(string) bool { return true })
+	if _, err := repo.GetXYZ(0, 0, 3); err != nil {
+		t.Fatalf("serving from a read-only directory: %v", err)
+	}
+}
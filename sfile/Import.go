@@ -0,0 +1,383 @@
+package sfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultImportBatchSize is how many tiles are written per batch by default
+const DefaultImportBatchSize = 1000
+
+// ImportOptions controls how tiles are imported into a repository
+type ImportOptions struct {
+	Overwrite bool                         // replace tiles already stored, otherwise they are kept
+	BatchSize int                          // tiles written per batch, DefaultImportBatchSize when 0
+	Progress  func(ImportProgress)         // called after every batch, may be nil
+	SwapXY    bool                         // directory imports: paths are {z}/{y}/{x}.ext instead of {z}/{x}/{y}.ext
+	TMS       bool                         // directory imports: rows count from the bottom as in TMS
+	Warn      func(path string, err error) // directory imports: called for every file skipped as not a tile
+	Shard     ShardScheme                  // scheme of a new repository, the one recorded when zero; see importDestination
+	Grid      TileGrid                     // grid of a new repository, the one recorded when ""; see importDestination
+	Compress  bool                         // store text-like tiles gzipped and record it, see Repository.Compress
+}
+
+// ImportProgress reports the progress of an import
+type ImportProgress struct {
+	Total   int64   `json:"total"`   // tiles to import, -1 when unknown
+	Written int64   `json:"written"` // tiles stored
+	Skipped int64   `json:"skipped"` // tiles already present and kept
+	Rate    float64 `json:"rate"`    // tiles handled per second
+}
+
+// importer writes imported tiles to a repository in batches and summarizes them
+// for its repository.json
+type importer struct {
+	repository *SRepository
+	opts       ImportOptions
+	batchSize  int
+	batch      []TileData
+	progress   ImportProgress
+	summary    *tileSummary
+	start      time.Time
+	created    bool   // repository.json was written by importDestination
+	unlock     func() // releases the lock of the repository held for the whole import
+}
+
+func newImporter(destDir string, opts ImportOptions) (*importer, error) {
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return nil, err
+	}
+	// writers of other processes wait until the import is done, see lockRepository
+	unlock, err := lockRepository(destDir)
+	if err != nil {
+		return nil, err
+	}
+	repository, created, err := importDestination(destDir, opts.Shard, opts.Grid)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	if opts.Compress {
+		repository.compress = true
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultImportBatchSize
+	}
+	return &importer{
+		repository: repository,
+		created:    created,
+		opts:       opts,
+		batchSize:  batchSize,
+		batch:      make([]TileData, 0, batchSize),
+		progress:   ImportProgress{Total: -1},
+		summary:    newTileSummary(repository.grid),
+		start:      time.Now(),
+		unlock:     unlock,
+	}, nil
+}
+
+// add queues a tile, writing the batch once it is full
+func (im *importer) add(tile TileData) error {
+	im.batch = append(im.batch, tile)
+	if len(im.batch) < im.batchSize {
+		return nil
+	}
+	return im.flush()
+}
+
+// flush writes the queued tiles and reports progress
+func (im *importer) flush() error {
+	written, skipped, err := im.repository.writeTiles(im.batch, im.opts.Overwrite)
+	im.progress.Written += written
+	im.progress.Skipped += skipped
+	if err != nil {
+		return err
+	}
+	for _, tile := range im.batch {
+		im.summary.add(tile)
+	}
+	im.batch = im.batch[:0]
+	if elapsed := time.Since(im.start).Seconds(); elapsed > 0 {
+		im.progress.Rate = float64(im.progress.Written+im.progress.Skipped) / elapsed
+	}
+	if im.opts.Progress != nil {
+		im.opts.Progress(im.progress)
+	}
+	return nil
+}
+
+// finish writes the last batch and the repository.json of the imported
+// repository, letting apply adjust it before it is written
+func (im *importer) finish(apply func(repo *Repository)) error {
+	if err := im.flush(); err != nil {
+		return err
+	}
+	// the writes kept the index in sync, but a rescan after an import is cheap
+	forgetRepositoryExistence(im.repository.dir)
+	return writeImportedRepositoryInfo(im.repository.dir, im.summary, func(repo *Repository) {
+		if im.created {
+			// written before any tile was seen
+			repo.TileSize = im.summary.sizes.dominant()
+		}
+		if im.opts.Compress {
+			repo.Compress = true
+		}
+		if apply != nil {
+			apply(repo)
+		}
+	})
+}
+
+// importDestination opens the repository at destDir for an import storing its
+// tiles with scheme in grid, or with the scheme and grid recorded for the
+// repository when they are zero. Only a repository without tiles can take
+// another scheme or grid; they are recorded in repository.json at once, so the
+// repository is never read with the wrong ones, and created is set when that
+// wrote the first repository.json. Asking for another scheme or grid once tiles
+// are stored is ErrShardSchemeMismatch or ErrTileGridMismatch.
+func importDestination(destDir string, scheme ShardScheme, grid TileGrid) (repository *SRepository, created bool, err error) {
+	repository, err = openRepository(destDir)
+	if err != nil {
+		return nil, false, err
+	}
+	sameScheme := scheme == (ShardScheme{}) || scheme == repository.shards()
+	sameGrid := grid == "" || grid == repository.grid
+	if sameScheme && sameGrid {
+		return repository, false, nil
+	}
+	if sameScheme {
+		scheme = repository.shards()
+	} else if err := scheme.Validate(); err != nil {
+		return nil, false, err
+	}
+	if sameGrid {
+		grid = repository.grid
+	} else if grid, err = ParseTileGrid(string(grid)); err != nil {
+		return nil, false, err
+	}
+	zooms, _, err := shardZooms(destDir)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(zooms) > 0 && !sameScheme {
+		return nil, false, fmt.Errorf("%w: %s is stored with %s, not %s", ErrShardSchemeMismatch, destDir, repository.shards(), scheme)
+	}
+	if len(zooms) > 0 && !sameGrid {
+		return nil, false, fmt.Errorf("%w: %s is cut in the %s grid, not %s", ErrTileGridMismatch, destDir, repository.grid, grid)
+	}
+	baseDir, name := filepath.Dir(destDir), filepath.Base(destDir)
+	repo, err := readRepositoryInfo(baseDir, name)
+	if errors.Is(err, os.ErrNotExist) {
+		repo = defaultRepository(name)
+		repo.Zoom = 14
+		created = true
+	} else if err != nil {
+		return nil, false, err
+	}
+	repo.Name, repo.Url = name, name
+	repo.Shard = &scheme
+	if scheme == DefaultShardScheme {
+		repo.Shard = nil
+	}
+	repo.Grid = grid
+	if grid == GridMercator {
+		repo.Grid = ""
+	}
+	if err := writeRepositoryInfo(baseDir, repo); err != nil {
+		return nil, false, err
+	}
+	return &SRepository{dir: destDir, scheme: scheme, grid: grid}, created, nil
+}
+
+// tileSummary accumulates the extent, zoom range, format and tile size of a set of tiles
+type tileSummary struct {
+	tiles, bytes     int64
+	minZoom, maxZoom int8
+	box              Box
+	grid             TileGrid // the box is computed in
+	formats          formatCounts
+	sizes            tileSizes // of the first tiles only, decoding every header is not worth it
+}
+
+func newTileSummary(grid TileGrid) *tileSummary {
+	return &tileSummary{minZoom: -1, maxZoom: -1, box: NewBox(), grid: grid, formats: make(formatCounts), sizes: make(tileSizes)}
+}
+
+func (s *tileSummary) add(tile TileData) {
+	s.tiles++
+	s.bytes += int64(len(tile.Data))
+	if s.minZoom < 0 || tile.Z < s.minZoom {
+		s.minZoom = tile.Z
+	}
+	s.maxZoom = max(s.maxZoom, tile.Z)
+	format := tileFormat(tile.Data)
+	if s.tiles <= formatSampleFiles*formatSampleTiles {
+		s.sizes.add(format, tile.Data)
+	}
+	s.box.Extend(s.grid.TileToBounds(tile.X, tile.Y, int(tile.Z)))
+	s.formats.add(int(tile.Z), format, 1)
+}
+
+// writeImportedRepositoryInfo writes the repository.json of an imported repository
+// from the summary of the imported tiles, without a second pass over the .s files.
+// An existing repository.json is merged: its extent and zoom range grow to
+// include the imported tiles and its other values, including unknown keys, are kept.
+func writeImportedRepositoryInfo(destDir string, summary *tileSummary, apply func(repo *Repository)) error {
+	baseDir, name := filepath.Dir(destDir), filepath.Base(destDir)
+	repo, err := readRepositoryInfo(baseDir, name)
+	if errors.Is(err, os.ErrNotExist) {
+		repo = defaultRepository(name)
+		repo.Zoom = 14
+		repo.TileSize = summary.sizes.dominant()
+	} else if err != nil {
+		return err
+	}
+	repo.Name, repo.Url = name, name
+
+	if summary.tiles > 0 {
+		box := summary.box
+		minZoom, maxZoom := int(summary.minZoom), int(summary.maxZoom)
+		if repo.Pared && repo.HasBounds() {
+			box.Extend(Box{repo.Bounds[0], repo.Bounds[1], repo.Bounds[2], repo.Bounds[3]})
+			minZoom, maxZoom = min(minZoom, repo.MinZoom), max(maxZoom, repo.MaxZoom)
+		}
+		repo.Bounds = box.Bounds()
+		repo.Lng, repo.Lat = box.Center()
+		repo.MinZoom, repo.MaxZoom = minZoom, maxZoom
+		repo.Pared = true
+		mergeImportedFormats(&repo, summary.formats)
+	}
+	repo.Size = 0
+	subdirs, err := listSubDir(destDir)
+	if err != nil {
+		return err
+	}
+	for _, sub := range subdirs {
+		files, err := listAllFile(sub)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if info, err := os.Stat(file); err == nil {
+				repo.Size += float64(info.Size())
+			}
+		}
+	}
+	if apply != nil {
+		apply(&repo)
+	}
+	return writeRepositoryInfo(baseDir, repo)
+}
+
+// tileExtensions are the file extensions ImportXYZDir accepts as tiles
+var tileExtensions = map[string]bool{".png": true, ".jpg": true, ".jpeg": true, ".webp": true, ".gif": true, ".pbf": true, ".mvt": true}
+
+// ImportXYZDir copies a directory tree of loose {z}/{x}/{y}.ext tiles, as written
+// by gdal2tiles, into the repository at destDir. opts.SwapXY and opts.TMS select
+// other layouts. Files that are not tiles are skipped and reported to opts.Warn.
+// Tiles already stored are kept unless opts.Overwrite is set, so an interrupted
+// import resumes when run again.
+func ImportXYZDir(src string, destDir string, opts ImportOptions) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", src)
+	}
+	importer, err := newImporter(destDir, opts)
+	if err != nil {
+		return err
+	}
+	defer importer.unlock()
+	grid := importer.repository.grid
+	warn := func(path string, err error) {
+		if opts.Warn != nil {
+			opts.Warn(path, err)
+		}
+	}
+	err = filepath.WalkDir(src, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		coord, err := parseTilePath(filepath.ToSlash(rel), grid, opts.SwapXY, opts.TMS)
+		if err != nil {
+			warn(path, err)
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			warn(path, ErrEmptyTile)
+			return nil
+		}
+		return importer.add(TileData{TileCoord: coord, Data: data})
+	})
+	if err != nil {
+		return err
+	}
+	return importer.finish(nil)
+}
+
+// parseTilePath reads the tile coordinates from a z/x/y.ext path relative to the
+// root of a tile tree cut in grid
+func parseTilePath(rel string, grid TileGrid, swapXY bool, tms bool) (TileCoord, error) {
+	parts := strings.Split(rel, "/")
+	if len(parts) != 3 {
+		return TileCoord{}, errors.New("not a z/x/y tile path")
+	}
+	ext := strings.ToLower(filepath.Ext(parts[2]))
+	if !tileExtensions[ext] {
+		return TileCoord{}, fmt.Errorf("unsupported tile extension %q", ext)
+	}
+	z, errZ := strconv.ParseInt(parts[0], 10, 8)
+	x, errX := strconv.ParseInt(parts[1], 10, 64)
+	y, errY := strconv.ParseInt(strings.TrimSuffix(parts[2], filepath.Ext(parts[2])), 10, 64)
+	if errZ != nil || errX != nil || errY != nil {
+		return TileCoord{}, errors.New("not a z/x/y tile path")
+	}
+	if swapXY {
+		x, y = y, x
+	}
+	if err := grid.checkTile(x, y, int8(z)); err != nil {
+		return TileCoord{}, err
+	}
+	if tms {
+		y = FlipY(y, int(z))
+	}
+	return TileCoord{Z: int8(z), X: x, Y: y}, nil
+}
+
+// mergeImportedFormats adds the formats of imported tiles to those of repo. The
+// repository becomes mixed when the imported tiles differ from the tiles it held.
+func mergeImportedFormats(repo *Repository, formats formatCounts) {
+	zoomFormats, format, mixed := formats.summarize()
+	if repo.Format == "" {
+		repo.Format = format
+	}
+	if repo.ZoomFormats == nil {
+		repo.ZoomFormats = make(map[int]string, len(zoomFormats))
+	}
+	for zoom, zoomFormat := range zoomFormats {
+		repo.ZoomFormats[zoom] = zoomFormat
+	}
+	for _, zoomFormat := range repo.ZoomFormats {
+		mixed = mixed || zoomFormat != repo.Format
+	}
+	repo.MixedFormats = repo.MixedFormats || mixed
+}
@@ -0,0 +1,169 @@
+package sfile
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// The .s files of a repository are nested in a directory per zoom, see zoomName,
+// unless it is flat: some older archives keep every file in the repository
+// directory itself. The layout is recorded in repository.json, and detected from
+// the directory when it is not. The zoom directories of a flat repository are
+// virtual: listSubDir returns dir/A for every zoom A with files in dir, and
+// listAllFile lists the A_x_y.s files of dir for it, so code walking the zoom
+// directories reads both layouts alike. New repositories are nested.
+
+// Layouts of the .s files of a repository
+const (
+	LayoutNested = "nested" // in a directory per zoom, the default
+	LayoutFlat   = "flat"   // all in the repository directory
+)
+
+// detectedLayout is what the entries of a repository directory hold
+type detectedLayout struct {
+	modTime   time.Time
+	zoomDirs  bool // zoom directories
+	flatFiles bool // .s files
+}
+
+// layout returns the layout the entries tell: flat when .s files lie in the
+// directory and no zoom directory does, nested otherwise
+func (d detectedLayout) layout() string {
+	if d.flatFiles && !d.zoomDirs {
+		return LayoutFlat
+	}
+	return LayoutNested
+}
+
+var (
+	detectedLayoutsMu sync.Mutex
+	detectedLayouts   = make(map[string]detectedLayout)
+)
+
+// repositoryLayout returns the layout of the repository in dir, the one
+// recorded in its repository.json or else the one its entries tell
+func repositoryLayout(dir string) string {
+	if recorded, err := recordedLayout(dir); err == nil && recorded.layout != "" {
+		return recorded.layout
+	}
+	return detectLayout(dir).layout()
+}
+
+// detectLayout reads what the entries of the repository directory dir hold,
+// nothing when it cannot be read. The result is kept until the directory changes.
+func detectLayout(dir string) detectedLayout {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return detectedLayout{}
+	}
+	detectedLayoutsMu.Lock()
+	cached, ok := detectedLayouts[dir]
+	detectedLayoutsMu.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) {
+		return cached
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return detectedLayout{}
+	}
+	cached = detectedLayout{modTime: info.ModTime()}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			if _, ok := nameZoom(entry.Name()); ok {
+				cached.zoomDirs = true
+			}
+		} else if validFileName.MatchString(entry.Name()) {
+			cached.flatFiles = true
+		}
+	}
+	detectedLayoutsMu.Lock()
+	detectedLayouts[dir] = cached
+	detectedLayoutsMu.Unlock()
+	return cached
+}
+
+// layoutWarning describes the .s files of the repository in dir, of the given
+// layout, that lie outside it and are not served, "" when there are none
+func layoutWarning(dir string, layout string) string {
+	detected := detectLayout(dir)
+	switch {
+	case detected.zoomDirs && detected.flatFiles:
+		return fmt.Sprintf("the repository mixes .s files in zoom directories and in its own directory, only the %s ones are served", layout)
+	case layout == LayoutFlat && detected.zoomDirs:
+		return "the repository is flat but has zoom directories, their .s files are not served"
+	case layout == LayoutNested && detected.flatFiles:
+		return "the repository is nested but has .s files in its own directory, they are not served"
+	}
+	return ""
+}
+
+// flatZoomDirs returns the virtual zoom directories of the flat repository in
+// dir, one per zoom with files among entries, in zoom order
+func flatZoomDirs(dir string, entries []os.DirEntry) []string {
+	zooms := make([]int8, 0)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		if z, ok := shardZoom(entry.Name()); ok && !slices.Contains(zooms, z) {
+			zooms = append(zooms, z)
+		}
+	}
+	slices.Sort(zooms)
+	subDirs := make([]string, 0, len(zooms))
+	for _, z := range zooms {
+		subDirs = append(subDirs, path.Join(dir, zoomName(z)))
+	}
+	return subDirs
+}
+
+// listFlatZoom lists the .s files of the virtual zoom directory sub, those of
+// its zoom in the flat repository holding it. ok is false when sub is not the
+// zoom directory of a flat repository.
+func listFlatZoom(sub string) (files []string, ok bool, err error) {
+	z, isZoom := nameZoom(filepath.Base(sub))
+	dir := filepath.Dir(sub)
+	if !isZoom || repositoryLayout(dir) != LayoutFlat {
+		return nil, false, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, true, err
+	}
+	files = make([]string, 0)
+	for _, entry := range entries {
+		if fileZoom, isShard := shardZoom(entry.Name()); isShard && fileZoom == z && !entry.IsDir() {
+			files = append(files, path.Join(dir, entry.Name()))
+		}
+	}
+	return files, true, nil
+}
+
+// statZoomDir returns the FileInfo of the zoom directory sub, that of the
+// repository directory for the virtual zoom directory of a flat repository
+func statZoomDir(sub string) (os.FileInfo, error) {
+	info, err := os.Stat(sub)
+	if os.IsNotExist(err) {
+		if files, ok, _ := listFlatZoom(sub); ok && len(files) > 0 {
+			return os.Stat(filepath.Dir(sub))
+		}
+	}
+	return info, err
+}
+
+// shardRepository returns the repository directory of the .s file at filePath:
+// the parent of its zoom directory, or its own directory when that is not named
+// after the zoom of the file, as in a flat repository. A flat repository itself
+// named like the zoom of its files is mistaken for a zoom directory.
+func shardRepository(filePath string) string {
+	dir := filepath.Dir(filePath)
+	if z, ok := shardZoom(filePath); ok && filepath.Base(dir) == zoomName(z) {
+		return filepath.Dir(dir)
+	}
+	return dir
+}
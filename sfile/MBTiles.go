@@ -0,0 +1,391 @@
+package sfile
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ImportMBTiles copies the tiles of the MBTiles file src into the repository at
+// destDir, flipping the TMS rows to XYZ, and records the MBTiles metadata in its
+// repository.json. Raster and vector (gzipped pbf) blobs are stored unchanged.
+func ImportMBTiles(src string, destDir string, opts ImportOptions) error {
+	if _, err := os.Stat(src); err != nil {
+		return err
+	}
+	db, err := openShard("file:" + src + "?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer closeShard(db)
+	metadata, err := readMBTilesMetadata(db)
+	if err != nil {
+		return err
+	}
+	importer, err := newImporter(destDir, opts)
+	if err != nil {
+		return err
+	}
+	defer importer.unlock()
+	if err := db.QueryRow("select count(*) from tiles").Scan(&importer.progress.Total); err != nil {
+		return fmt.Errorf("%s is not an MBTiles file: %w", src, err)
+	}
+	// rows come ordered so each batch touches as few .s files as possible
+	rows, err := db.Query("select zoom_level, tile_column, tile_row, tile_data from tiles order by zoom_level, tile_column / 256, tile_row / 256")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tile TileData
+		var row int64
+		if err := rows.Scan(&tile.Z, &tile.X, &row, &tile.Data); err != nil {
+			return err
+		}
+		if err := checkZoom(int(tile.Z)); err != nil {
+			return fmt.Errorf("tile %d/%d/%d: %w", tile.Z, tile.X, row, err)
+		}
+		tile.Y = FlipY(row, int(tile.Z))
+		if err := importer.add(tile); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return importer.finish(func(repo *Repository) {
+		applyMBTilesMetadata(repo, metadata)
+	})
+}
+
+// readMBTilesMetadata returns the name/value pairs of the metadata table, which is
+// optional in practice
+func readMBTilesMetadata(db *sql.DB) (map[string]string, error) {
+	metadata := make(map[string]string)
+	rows, err := db.Query("select name, value from metadata")
+	if err != nil {
+		if strings.Contains(err.Error(), "no such table") {
+			return metadata, nil
+		}
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		metadata[name] = value
+	}
+	return metadata, rows.Err()
+}
+
+// applyMBTilesMetadata copies the MBTiles metadata keys onto repo
+func applyMBTilesMetadata(repo *Repository, metadata map[string]string) {
+	if value := metadata["name"]; value != "" {
+		repo.Title = value
+	}
+	if value := metadata["description"]; value != "" {
+		repo.Description = value
+	}
+	if value := metadata["attribution"]; value != "" {
+		repo.Attribution = value
+	}
+	if value := metadata["format"]; value != "" {
+		repo.Format = strings.ToLower(value)
+		if repo.Format == "jpeg" {
+			repo.Format = "jpg"
+		}
+	}
+	if bounds, ok := parseFloats(metadata["bounds"], 4); ok {
+		repo.Bounds = [4]float64{bounds[0], bounds[1], bounds[2], bounds[3]}
+		repo.Lng, repo.Lat = 0.5*(bounds[0]+bounds[2]), 0.5*(bounds[1]+bounds[3])
+	}
+	if center, ok := parseFloats(metadata["center"], 3); ok {
+		repo.Lng, repo.Lat, repo.Zoom = center[0], center[1], int(center[2])
+	}
+	if zoom, err := strconv.Atoi(metadata["minzoom"]); err == nil {
+		repo.MinZoom = zoom
+	}
+	if zoom, err := strconv.Atoi(metadata["maxzoom"]); err == nil {
+		repo.MaxZoom = zoom
+	}
+}
+
+// parseFloats parses a comma separated list of exactly n numbers
+func parseFloats(value string, n int) ([]float64, bool) {
+	parts := strings.Split(value, ",")
+	if len(parts) != n {
+		return nil, false
+	}
+	numbers := make([]float64, n)
+	for i, part := range parts {
+		number, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, false
+		}
+		numbers[i] = number
+	}
+	return numbers, true
+}
+
+// ParseBBox parses minLng,minLat,maxLng,maxLat
+func ParseBBox(value string) (*[4]float64, error) {
+	bbox, ok := parseFloats(value, 4)
+	if !ok || bbox[0] > bbox[2] || bbox[1] > bbox[3] {
+		return nil, fmt.Errorf("bbox must be minLng,minLat,maxLng,maxLat")
+	}
+	return &[4]float64{bbox[0], bbox[1], bbox[2], bbox[3]}, nil
+}
+
+// ExportOptions selects the tiles written by an export
+type ExportOptions struct {
+	MinZoom   *int8       // lowest zoom exported, no limit when nil
+	MaxZoom   *int8       // highest zoom exported, no limit when nil
+	BBox      *[4]float64 // optional lng/lat bounds minX, minY, maxX, maxY
+	BatchSize int         // tiles written per transaction, DefaultImportBatchSize when 0
+	Progress  func(ExportProgress)
+	TMS       bool // directory exports: count rows from the bottom as in TMS
+	Overwrite bool // directory exports: replace existing files, otherwise they are skipped
+	Workers   int  // directory exports: concurrent file writers, ScanWorkers when 0
+}
+
+// ExportProgress counts the tiles exported so far
+type ExportProgress struct {
+	Zoom    int8  `json:"zoom"`
+	Tiles   int64 `json:"tiles"`
+	Skipped int64 `json:"skipped"` // directory exports: existing files kept
+	Bytes   int64 `json:"bytes"`
+}
+
+// includes reports whether zoom z is selected by opts
+func (opts ExportOptions) includes(z int8) bool {
+	return (opts.MinZoom == nil || z >= *opts.MinZoom) && (opts.MaxZoom == nil || z <= *opts.MaxZoom)
+}
+
+// mbtilesSchema creates the tables and indexes of the MBTiles 1.3 specification
+const mbtilesSchema = `
+create table metadata (name text, value text);
+create unique index name on metadata (name);
+create table tiles (zoom_level integer, tile_column integer, tile_row integer, tile_data blob);
+create unique index tile_index on tiles (zoom_level, tile_column, tile_row);`
+
+// ExportMBTiles writes the tiles of the repository at srcDir selected by opts to
+// the new MBTiles file destFile, flipping XYZ rows to TMS, with metadata taken
+// from repository.json and the exported tiles. Tiles are streamed one shard
+// table at a time, so memory use does not grow with the repository.
+func ExportMBTiles(srcDir string, destFile string, opts ExportOptions) error {
+	if _, err := os.Stat(destFile); err == nil {
+		return fmt.Errorf("%s already exists", destFile)
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultImportBatchSize
+	}
+	// the file only appears under its name once it is complete
+	partial := destFile + ".partial"
+	_ = os.Remove(partial)
+	dest, err := openShard(partial)
+	if err != nil {
+		return err
+	}
+	exported := false
+	defer func() {
+		if !exported {
+			_ = os.Remove(partial)
+		}
+	}()
+	if _, err := dest.Exec(mbtilesSchema); err != nil {
+		_ = closeShard(dest)
+		return err
+	}
+
+	summary := newTileSummary(repositoryGrid(srcDir))
+	err = exportTiles(srcDir, opts, batchSize, func(tiles []TileData) error {
+		tx, err := dest.Begin()
+		if err != nil {
+			return err
+		}
+		for _, tile := range tiles {
+			row := FlipY(tile.Y, int(tile.Z))
+			if _, err := tx.Exec("insert into tiles (zoom_level, tile_column, tile_row, tile_data) values (?, ?, ?, ?)", tile.Z, tile.X, row, tile.Data); err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+			summary.add(tile)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		if opts.Progress != nil {
+			opts.Progress(ExportProgress{Zoom: tiles[len(tiles)-1].Z, Tiles: summary.tiles, Bytes: summary.bytes})
+		}
+		return nil
+	})
+	if err == nil {
+		err = writeMBTilesMetadata(dest, srcDir, summary)
+	}
+	if closeErr := closeShard(dest); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(partial, destFile); err != nil {
+		return err
+	}
+	exported = true
+	return nil
+}
+
+// writeMBTilesMetadata fills the metadata table from repository.json and summary
+func writeMBTilesMetadata(dest *sql.DB, srcDir string, summary *tileSummary) error {
+	repo, err := readRepositoryInfo(filepath.Dir(srcDir), filepath.Base(srcDir))
+	if err != nil {
+		repo = defaultRepository(filepath.Base(srcDir))
+	}
+	metadata := map[string]string{"name": repo.Name, "format": repo.Format, "type": "baselayer", "version": "1.0"}
+	if repo.Title != "" {
+		metadata["name"] = repo.Title
+	}
+	if metadata["format"] == "" {
+		_, metadata["format"], _ = summary.formats.summarize()
+	}
+	if repo.Attribution != "" {
+		metadata["attribution"] = repo.Attribution
+	}
+	if repo.Description != "" {
+		metadata["description"] = repo.Description
+	}
+	if summary.tiles > 0 {
+		box := summary.box
+		metadata["bounds"] = fmt.Sprintf("%f,%f,%f,%f", box.MinX, box.MinY, box.MaxX, box.MaxY)
+		zoom := min(max(int8(repo.Zoom), summary.minZoom), summary.maxZoom)
+		lng, lat := box.Center()
+		metadata["center"] = fmt.Sprintf("%f,%f,%d", lng, lat, zoom)
+		metadata["minzoom"] = strconv.Itoa(int(summary.minZoom))
+		metadata["maxzoom"] = strconv.Itoa(int(summary.maxZoom))
+	}
+	tx, err := dest.Begin()
+	if err != nil {
+		return err
+	}
+	for name, value := range metadata {
+		if _, err := tx.Exec("insert into metadata (name, value) values (?, ?)", name, value); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// exportTiles streams the tiles of the repository at srcDir selected by opts to
+// write in batches of at most batchSize tiles, zoom by zoom and shard by shard
+func exportTiles(srcDir string, opts ExportOptions, batchSize int, write func([]TileData) error) error {
+	scheme, err := repositoryScheme(srcDir)
+	if err != nil {
+		return err
+	}
+	grid := repositoryGrid(srcDir)
+	batch := make([]TileData, 0, batchSize)
+	for z := int8(0); z <= MaxTileZoom; z++ {
+		if !opts.includes(z) {
+			continue
+		}
+		files, err := listAllFile(filepath.Join(srcDir, zoomName(z)))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		columns, rows := grid.Matrix(int(z))
+		minX, minY, maxX, maxY := int64(0), int64(0), columns-1, rows-1
+		if opts.BBox != nil {
+			minX, minY, maxX, maxY = grid.TileRange(*opts.BBox, z)
+		}
+		for _, file := range files {
+			err := exportShardTiles(file, scheme, z, minX, minY, maxX, maxY, func(tile TileData) error {
+				batch = append(batch, tile)
+				if len(batch) < batchSize {
+					return nil
+				}
+				err := write(batch)
+				batch = batch[:0]
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("export %s: %w", file, err)
+			}
+		}
+	}
+	if len(batch) > 0 {
+		return write(batch)
+	}
+	return nil
+}
+
+// exportShardTiles calls fn for every tile of the .s file at filePath within the tile range
+func exportShardTiles(filePath string, scheme ShardScheme, z int8, minX, minY, maxX, maxY int64, fn func(TileData) error) error {
+	shard, release, err := acquireShard(filePath)
+	if err != nil {
+		return err
+	}
+	defer release()
+	tableNames, err := listTables(shard.db)
+	if err != nil {
+		return err
+	}
+	for _, tableName := range tableNames {
+		if !validTableName.MatchString(tableName) {
+			continue
+		}
+		_, tableX, tableY, ok := parseShardName(tableName)
+		if !ok {
+			continue
+		}
+		side := scheme.Table
+		if tableX*side > maxX || tableX*side+side-1 < minX || tableY*side > maxY || tableY*side+side-1 < minY {
+			continue
+		}
+		if err := exportTableTiles(shard.db, shard.dedup, scheme, tableName, tableX, tableY, z, minX, minY, maxX, maxY, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exportTableTiles(db *sql.DB, dedup bool, scheme ShardScheme, tableName string, tableX, tableY int64, z int8, minX, minY, maxX, maxY int64, fn func(TileData) error) error {
+	encoding, err := encodingColumn(db, tableName)
+	if err != nil {
+		return err
+	}
+	rows, err := db.Query("select ID, " + tileData(tableName, dedup) + ", " + encoding + " from " + tableName)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var data []byte
+		var encoding sql.NullString
+		if err := rows.Scan(&id, &data, &encoding); err != nil {
+			return err
+		}
+		x, y := scheme.tileOf(tableX, tableY, id)
+		if x < minX || x > maxX || y < minY || y > maxY || len(data) == 0 {
+			continue
+		}
+		if data, err = DecodeTile(data, encoding.String); err != nil {
+			return fmt.Errorf("decode %d/%d/%d: %w", z, x, y, err)
+		}
+		if err := fn(TileData{TileCoord: TileCoord{Z: z, X: x, Y: y}, Data: data}); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,119 @@
+package sfile
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrReadOnlyBackend is returned when tiles are written to a repository served
+// by a backend that cannot store them, such as a .mbtiles file
+var ErrReadOnlyBackend = errors.New("read-only backend")
+
+// mbtilesExt is the extension of MBTiles files served from the repository root
+const mbtilesExt = ".mbtiles"
+
+// IsMBTiles reports whether path is an .mbtiles file
+func IsMBTiles(path string) bool {
+	if !strings.EqualFold(filepath.Ext(path), mbtilesExt) {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+// mbtilesFile returns the .mbtiles file serving the repository at path, which is
+// named after the file without its extension. A directory of the same name
+// takes precedence over the file.
+func mbtilesFile(path string) (string, bool) {
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		return "", false
+	}
+	file := path + mbtilesExt
+	return file, IsMBTiles(file)
+}
+
+func init() {
+	RegisterTileSource(TileBackend{
+		Name: "mbtiles",
+		Match: func(path string) bool {
+			_, ok := mbtilesFile(path)
+			return ok
+		},
+		Open: func(root string, name string) (TileSource, error) {
+			file, ok := mbtilesFile(filepath.Join(root, filepath.FromSlash(name)))
+			if !ok {
+				return nil, fmt.Errorf("%s%s: %w", name, mbtilesExt, os.ErrNotExist)
+			}
+			return archiveSource{
+				read: func(ctx context.Context, x int64, y int64, z int8) (*bytes.Buffer, error) {
+					return readMBTilesTile(ctx, file, x, y, z)
+				},
+				metadata: func() Repository { return mbtilesRepository(file, name) },
+			}, nil
+		},
+	})
+}
+
+// readMBTilesTile returns tile x/y/z of the MBTiles file, flipping the row to
+// TMS. The file is opened read-only and kept open by the handle cache like the
+// .s files.
+func readMBTilesTile(ctx context.Context, file string, x int64, y int64, z int8) (*bytes.Buffer, error) {
+	if err := checkTile(x, y, z); err != nil {
+		return nil, err
+	}
+	shard, release, err := acquireShardRetrying(ctx, file)
+	if err != nil {
+		err = fmt.Errorf("open %s: %w", file, err)
+		RecordError("mbtiles", err)
+		return nil, err
+	}
+	defer release()
+	var data []byte
+	err = retryTransient(ctx, func() error {
+		stmt, err := shard.statement(ctx, "select tile_data from tiles where zoom_level = ? and tile_column = ? and tile_row = ?")
+		if err != nil {
+			return err
+		}
+		return stmt.QueryRowContext(ctx, z, x, FlipY(y, int(z))).Scan(&data)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %d/%d/%d not exist in %s", ErrTileNotFound, z, x, y, file)
+	}
+	if err != nil {
+		err = fmt.Errorf("read %d/%d/%d from %s: %w", z, x, y, file, err)
+		if ctx.Err() == nil {
+			RecordError("mbtiles", err)
+		}
+		return nil, err
+	}
+	return bytes.NewBuffer(data), nil
+}
+
+// mbtilesRepository describes the MBTiles file as the repository name, from the
+// keys of its metadata table
+func mbtilesRepository(file string, name string) Repository {
+	repo := defaultRepository(name)
+	repo.Pared = true
+	if info, err := os.Stat(file); err == nil {
+		repo.Size = float64(info.Size())
+	}
+	shard, release, err := acquireShard(file)
+	if err != nil {
+		RecordError("mbtiles", fmt.Errorf("open %s: %w", file, err))
+		return repo
+	}
+	defer release()
+	metadata, err := readMBTilesMetadata(shard.db)
+	if err != nil {
+		RecordError("mbtiles", fmt.Errorf("metadata of %s: %w", file, err))
+		return repo
+	}
+	applyMBTilesMetadata(&repo, metadata)
+	return repo
+}
@@ -0,0 +1,314 @@
+package sfile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// mbtilesFixtureTiles are the tiles of writeMBTilesFixture by zoom, column and
+// TMS row: random blobs, a gzipped vector tile, a tile of zero bytes only, and
+// tiles spread over several .s files and tables at zoom 12
+func mbtilesFixtureTiles(t *testing.T) map[TileCoord][]byte {
+	t.Helper()
+	random := rand.New(rand.NewSource(3097))
+	blob := func(size int) []byte {
+		data := make([]byte, size)
+		random.Read(data)
+		return data
+	}
+	var pbf bytes.Buffer
+	writer := gzip.NewWriter(&pbf)
+	_, _ = writer.Write([]byte("\x1a\x10\x0a\x05roads\x28\x80\x20\x78\x02"))
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tiles := map[TileCoord][]byte{
+		{Z: 0, X: 0, Y: 0}:       blob(1),
+		{Z: 1, X: 1, Y: 0}:       blob(300),
+		{Z: 3, X: 7, Y: 7}:       pbf.Bytes(),
+		{Z: 5, X: 4, Y: 9}:       {0, 0, 0, 0},
+		{Z: 12, X: 0, Y: 4095}:   blob(4096),
+		{Z: 12, X: 255, Y: 3000}: blob(17),
+		{Z: 12, X: 256, Y: 3000}: blob(70000),
+		{Z: 12, X: 4095, Y: 0}:   blob(2),
+	}
+	for x := int64(60); x < 70; x++ {
+		tiles[TileCoord{Z: 12, X: x, Y: 1234}] = blob(int(x))
+	}
+	return tiles
+}
+
+// writeMBTilesFixture writes an MBTiles file holding tiles, keyed by TMS rows,
+// and metadata, as other tools write them: the tiles table is a view over a
+// deduplicated map and images pair, like mbutil and tippecanoe do
+func writeMBTilesFixture(t *testing.T, path string, metadata map[string]string, tiles map[TileCoord][]byte) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(`
+create table metadata (name text, value text);
+create table map (zoom_level integer, tile_column integer, tile_row integer, tile_id text);
+create table images (tile_data blob, tile_id text);
+create view tiles as select map.zoom_level as zoom_level, map.tile_column as tile_column,
+	map.tile_row as tile_row, images.tile_data as tile_data from map join images on images.tile_id = map.tile_id;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range metadata {
+		if _, err := db.Exec("insert into metadata (name, value) values (?, ?)", name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for tile, data := range tiles {
+		id := fmt.Sprintf("%d/%d/%d", tile.Z, tile.X, tile.Y)
+		if _, err := db.Exec("insert into map values (?, ?, ?, ?)", tile.Z, tile.X, tile.Y, id); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("insert into images values (?, ?)", data, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readMBTiles returns the tiles of an MBTiles file keyed by TMS rows
+func readMBTiles(t *testing.T, path string) map[TileCoord][]byte {
+	t.Helper()
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query("select zoom_level, tile_column, tile_row, tile_data from tiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	tiles := make(map[TileCoord][]byte)
+	for rows.Next() {
+		var tile TileCoord
+		var data []byte
+		if err := rows.Scan(&tile.Z, &tile.X, &tile.Y, &data); err != nil {
+			t.Fatal(err)
+		}
+		tiles[tile] = data
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return tiles
+}
+
+// TestMBTilesRoundTrip imports an MBTiles file written the way other tools do,
+// reads every tile back at its XYZ row, exports the repository again and checks
+// the tiles come out byte for byte at the rows they went in at, with the
+// metadata carried through
+func TestMBTilesRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	t.Cleanup(func() { FlushHandles(func(path string) bool { return strings.HasPrefix(path, dir) }) })
+	source := filepath.Join(dir, "source.mbtiles")
+	tiles := mbtilesFixtureTiles(t)
+	writeMBTilesFixture(t, source, map[string]string{
+		"name": "Fixture", "format": "jpeg", "attribution": "© Fixture contributors", "description": "round trip",
+		"bounds": "-180,-85.05,180,85.05", "center": "13.4,52.5,5", "minzoom": "0", "maxzoom": "12",
+	}, tiles)
+
+	repoDir := filepath.Join(dir, "repo")
+	var progress ImportProgress
+	if err := ImportMBTiles(source, repoDir, ImportOptions{BatchSize: 7, Progress: func(p ImportProgress) { progress = p }}); err != nil {
+		t.Fatal(err)
+	}
+	if progress.Total != int64(len(tiles)) || progress.Written != int64(len(tiles)) {
+		t.Fatalf("import progress %+v, want %d tiles written", progress, len(tiles))
+	}
+	repo, err := NewRepository(repoDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tile, data := range tiles {
+		y := FlipY(tile.Y, int(tile.Z))
+		got, err := repo.GetXYZ(tile.X, y, tile.Z)
+		if err != nil || !bytes.Equal(got.Bytes(), data) {
+			t.Fatalf("tile %d/%d/%d (TMS row %d): %v, want the %d bytes imported", tile.Z, tile.X, y, tile.Y, err, len(data))
+		}
+	}
+	info, err := readRepositoryInfo(dir, "repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Title != "Fixture" || info.Format != "jpg" || info.Attribution != "© Fixture contributors" || info.Description != "round trip" {
+		t.Errorf("imported metadata %+v", info)
+	}
+	if info.Bounds != [4]float64{-180, -85.05, 180, 85.05} || info.Lng != 13.4 || info.Lat != 52.5 || info.Zoom != 5 || info.MinZoom != 0 || info.MaxZoom != 12 {
+		t.Errorf("imported extent %v, center %g,%g,%d, zooms %d..%d", info.Bounds, info.Lng, info.Lat, info.Zoom, info.MinZoom, info.MaxZoom)
+	}
+
+	// imported again, every tile is already there
+	if err := ImportMBTiles(source, repoDir, ImportOptions{Progress: func(p ImportProgress) { progress = p }}); err != nil {
+		t.Fatal(err)
+	}
+	if progress.Written != 0 || progress.Skipped != int64(len(tiles)) {
+		t.Errorf("second import %+v, want every tile skipped", progress)
+	}
+
+	exported := filepath.Join(dir, "exported.mbtiles")
+	if err := ExportMBTiles(repoDir, exported, ExportOptions{BatchSize: 5}); err != nil {
+		t.Fatal(err)
+	}
+	roundTripped := readMBTiles(t, exported)
+	if len(roundTripped) != len(tiles) {
+		t.Errorf("%d tiles exported, want %d", len(roundTripped), len(tiles))
+	}
+	for tile, data := range tiles {
+		if !bytes.Equal(roundTripped[tile], data) {
+			t.Errorf("tile %d/%d/%d (TMS) exported as %d bytes, want the %d imported", tile.Z, tile.X, tile.Y, len(roundTripped[tile]), len(data))
+		}
+	}
+	metadata := mbtilesMetadata(t, exported)
+	if metadata["name"] != "Fixture" || metadata["format"] != "jpg" || metadata["attribution"] != "© Fixture contributors" {
+		t.Errorf("exported metadata %v", metadata)
+	}
+}
+
+// mbtilesMetadata returns the metadata table of an MBTiles file
+func mbtilesMetadata(t *testing.T, path string) map[string]string {
+	t.Helper()
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	metadata, err := readMBTilesMetadata(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return metadata
+}
+
+// TestExportMBTilesSchema exports a repository and checks the file against the
+// MBTiles 1.3 specification: the column types of the metadata and tiles
+// tables, their unique indexes, the required metadata and the values of the
+// optional keys, and that the zoom and bbox filters select the tiles written
+func TestExportMBTilesSchema(t *testing.T) {
+	repo, root := newTestRepository(t, `{"name":"repo","title":"Schema","zoom":9}`)
+	var png bytes.Buffer
+	png.WriteString("\x89PNG\r\n\x1a\n")
+	for _, tile := range []TileCoord{{Z: 2, X: 1, Y: 1}, {Z: 3, X: 2, Y: 2}, {Z: 3, X: 5, Y: 2}, {Z: 4, X: 4, Y: 5}} {
+		if err := repo.WriteXYZ(tile.X, tile.Y, tile.Z, png.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exported := filepath.Join(root, "export.mbtiles")
+	if err := ExportMBTiles(repo.dir, exported, ExportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(exported + ".partial"); !os.IsNotExist(err) {
+		t.Errorf("partial file left behind: %v", err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+exported+"?mode=ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	columns := func(table string) []string {
+		t.Helper()
+		rows, err := db.Query("select name, type from pragma_table_info(?)", table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var columns []string
+		for rows.Next() {
+			var name, kind string
+			if err := rows.Scan(&name, &kind); err != nil {
+				t.Fatal(err)
+			}
+			columns = append(columns, name+" "+strings.ToLower(kind))
+		}
+		return columns
+	}
+	if got, want := columns("metadata"), []string{"name text", "value text"}; !slices.Equal(got, want) {
+		t.Errorf("metadata columns %v, want %v", got, want)
+	}
+	if got, want := columns("tiles"), []string{"zoom_level integer", "tile_column integer", "tile_row integer", "tile_data blob"}; !slices.Equal(got, want) {
+		t.Errorf("tiles columns %v, want %v", got, want)
+	}
+	uniqueIndex := func(table string) []string {
+		t.Helper()
+		var name string
+		err := db.QueryRow("select name from pragma_index_list(?) where \"unique\" = 1", table).Scan(&name)
+		if err != nil {
+			t.Fatalf("unique index of %s: %v", table, err)
+		}
+		rows, err := db.Query("select name from pragma_index_info(?) order by seqno", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var indexed []string
+		for rows.Next() {
+			var column string
+			if err := rows.Scan(&column); err != nil {
+				t.Fatal(err)
+			}
+			indexed = append(indexed, column)
+		}
+		return indexed
+	}
+	if got, want := uniqueIndex("metadata"), []string{"name"}; !slices.Equal(got, want) {
+		t.Errorf("metadata unique on %v, want %v", got, want)
+	}
+	if got, want := uniqueIndex("tiles"), []string{"zoom_level", "tile_column", "tile_row"}; !slices.Equal(got, want) {
+		t.Errorf("tiles unique on %v, want %v", got, want)
+	}
+
+	metadata := mbtilesMetadata(t, exported)
+	want := map[string]string{
+		"name": "Schema", "format": "png", "type": "baselayer", "version": "1.0", "minzoom": "2", "maxzoom": "4",
+	}
+	for key, value := range want {
+		if metadata[key] != value {
+			t.Errorf("metadata %s = %q, want %q", key, metadata[key], value)
+		}
+	}
+	// the tiles span from 2/1/1 in the north west to 3/5/2 in the east
+	if metadata["bounds"] != "-90.000000,0.000000,90.000000,66.513260" {
+		t.Errorf("metadata bounds %q, want the extent of the tiles", metadata["bounds"])
+	}
+	if center, ok := parseFloats(metadata["center"], 3); !ok || math.Abs(center[0]) > 1e-6 || center[1] != 33.25663 || center[2] != 4 {
+		t.Errorf("metadata center %q, want the middle of the bounds at zoom 9 clamped to 4", metadata["center"])
+	}
+	rows := readMBTiles(t, exported)
+	if len(rows) != 4 || rows[TileCoord{Z: 2, X: 1, Y: 2}] == nil || rows[TileCoord{Z: 4, X: 4, Y: 10}] == nil {
+		t.Errorf("%d tiles exported, want the 4 tiles at their TMS rows", len(rows))
+	}
+
+	if err := ExportMBTiles(repo.dir, exported, ExportOptions{}); err == nil {
+		t.Error("export over an existing file succeeded")
+	}
+	minZoom, maxZoom := int8(3), int8(3)
+	filtered := filepath.Join(root, "filtered.mbtiles")
+	err = ExportMBTiles(repo.dir, filtered, ExportOptions{MinZoom: &minZoom, MaxZoom: &maxZoom, BBox: &[4]float64{-80, 45, -50, 60}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows = readMBTiles(t, filtered)
+	if len(rows) != 1 || rows[TileCoord{Z: 3, X: 2, Y: 5}] == nil {
+		t.Errorf("filtered export of %d tiles, want tile 3/2/2 only", len(rows))
+	}
+	if metadata := mbtilesMetadata(t, filtered); metadata["minzoom"] != "3" || metadata["maxzoom"] != "3" {
+		t.Errorf("filtered export zooms %s..%s, want 3..3", metadata["minzoom"], metadata["maxzoom"])
+	}
+}
@@ -0,0 +1,132 @@
+package sfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// TilesModifiedSince calls fn for every tile of the repository in dir written at
+// or after since, to the second. .s files not modified since, nor their
+// write-ahead log, are skipped without being opened. Rows without a write time,
+// written before tiles recorded one, are reported whenever their file was
+// modified since, as there is no telling whether they changed.
+func TilesModifiedSince(dir string, since time.Time, fn func(TileCoord)) error {
+	scheme, err := repositoryScheme(dir)
+	if err != nil {
+		return err
+	}
+	subDirs, err := listSubDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, sub := range subDirs {
+		err := zoomModifiedSince(sub, scheme, subDirZoom(sub), since, func(tile TileCoord) error {
+			fn(tile)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListTilesModifiedSince calls fn for every tile stored at zoom z written at or
+// after since, like TilesModifiedSince does for every zoom
+func (f SRepository) ListTilesModifiedSince(z int8, since time.Time, fn func(x int64, y int64) error) error {
+	if err := checkZoom(int(z)); err != nil {
+		return err
+	}
+	if _, err := os.Stat(f.dir); os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s", ErrRepositoryNotFound, f.dir)
+	}
+	return zoomModifiedSince(filepath.Join(f.dir, zoomName(z)), f.shards(), z, since, func(tile TileCoord) error {
+		return fn(tile.X, tile.Y)
+	})
+}
+
+// zoomModifiedSince calls fn for the tiles of the zoom z directory sub written
+// at or after since, a missing directory holds none
+func zoomModifiedSince(sub string, scheme ShardScheme, z int8, since time.Time, fn func(TileCoord) error) error {
+	files, err := listAllFile(sub)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !shardModifiedSince(file, since) {
+			continue
+		}
+		if err := modifiedShardTiles(file, scheme, z, since, fn); err != nil {
+			return fmt.Errorf("read %s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// shardModifiedSince reports whether the .s file at filePath, or its write-ahead
+// log holding the writes not checkpointed yet, was modified at or after since
+func shardModifiedSince(filePath string, since time.Time) bool {
+	for _, path := range []string{filePath, filePath + "-wal"} {
+		if info, err := os.Stat(path); err == nil && !info.ModTime().Before(since.Truncate(time.Second)) {
+			return true
+		}
+	}
+	return false
+}
+
+// modifiedShardTiles calls fn for the tiles of zoom z of one .s file written at
+// or after since, or without a write time
+func modifiedShardTiles(filePath string, scheme ShardScheme, z int8, since time.Time, fn func(TileCoord) error) error {
+	shard, release, err := acquireShard(filePath)
+	if err != nil {
+		return err
+	}
+	defer release()
+	tableNames, err := listTables(shard.db)
+	if err != nil {
+		return err
+	}
+	for _, tableName := range tableNames {
+		if !validTableName.MatchString(tableName) {
+			continue
+		}
+		_, tableX, tableY, ok := parseShardName(tableName)
+		if !ok {
+			continue
+		}
+		written, err := shard.writtenQuery(tableName)
+		if err != nil {
+			return err
+		}
+		query, args := "select ID from "+tableName, []interface{}{}
+		if written != "" {
+			query, args = query+" where Written is null or Written >= ?", []interface{}{since.Unix()}
+		}
+		rows, err := shard.db.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			x, y := scheme.tileOf(tableX, tableY, id)
+			if err := fn(TileCoord{Z: z, X: x, Y: y}); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
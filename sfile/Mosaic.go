@@ -0,0 +1,103 @@
+package sfile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image/png"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"SirServer/canvas"
+)
+
+// MosaicFile is the contact sheet of a repository, written next to its
+// repository.json when SetWriteMosaic is on
+const MosaicFile = "mosaic.png"
+
+// mosaicCanvas draws the contact sheets of analyses, none when nil
+var mosaicCanvas atomic.Pointer[canvas.CanvasContext]
+
+// SetWriteMosaic makes analyses writing repository.json also write MosaicFile,
+// a contact sheet of the tiles of the highest zoom drawn with c, for telling at
+// a glance whether a repository holds what it should. It is off by default and
+// nil turns it off again.
+func SetWriteMosaic(c *canvas.CanvasContext) {
+	mosaicCanvas.Store(c)
+}
+
+// mosaicSource reads the tiles of a TileSource for canvas.BuildMosaic
+type mosaicSource struct {
+	TileLister
+	source TileSource
+}
+
+func (m mosaicSource) ReadTile(z int8, x int64, y int64) ([]byte, error) {
+	tile, err := m.source.GetTile(context.Background(), z, x, y)
+	return tile.Data, err
+}
+
+// WriteMosaic draws the contact sheet of repo, of the root baseDir, with c and
+// writes it as MosaicFile in the directory of the repository, replacing the one
+// there. Only directories of .s files are drawn; archives, repositories of
+// vector tiles and zooms without tiles write nothing.
+func WriteMosaic(c *canvas.CanvasContext, baseDir string, repo Repository) error {
+	dir := filepath.Join(baseDir, filepath.FromSlash(repo.Name))
+	if _, ok := s3RootFor(baseDir); ok || IsArchive(dir) {
+		return nil
+	}
+	switch repo.Format {
+	case "pbf", "json":
+		return nil
+	}
+	source, err := OpenTileSource(baseDir, repo.Name)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	lister, ok := source.(TileLister)
+	if !ok {
+		return nil
+	}
+	sheet, err := c.BuildMosaic(mosaicSource{TileLister: lister, source: source}, int8(repo.MaxZoom), canvas.DefaultMosaicTiles, canvas.DefaultMosaicCell)
+	if errors.Is(err, canvas.ErrNoTiles) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to draw the mosaic of %s: %w", repo.Name, err)
+	}
+
+	path := filepath.Join(dir, MosaicFile)
+	partial := fmt.Sprintf("%s.%d.partial", path, os.Getpid())
+	file, err := os.Create(partial)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", MosaicFile, err)
+	}
+	err = png.Encode(file, sheet)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(partial, path)
+	}
+	if err != nil {
+		_ = os.Remove(partial)
+		return fmt.Errorf("failed to write %s: %w", MosaicFile, err)
+	}
+	return nil
+}
+
+// RemoveMosaic deletes the MosaicFile of the repository in dir, so a purge
+// leaves no stale contact sheet, and reports whether there was one
+func RemoveMosaic(dir string) (bool, error) {
+	if IsArchive(dir) {
+		return false, nil
+	}
+	err := os.Remove(filepath.Join(dir, MosaicFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
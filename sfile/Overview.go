@@ -0,0 +1,217 @@
+package sfile
+
+import (
+	"SirServer/canvas"
+	"bytes"
+	"errors"
+	"fmt"
+	_ "golang.org/x/image/webp" // register the webp decoder for child tiles
+	"image"
+	_ "image/jpeg" // register the jpeg decoder for child tiles
+	_ "image/png"  // register the png decoder for child tiles
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// OverviewOptions controls BuildOverviews
+type OverviewOptions struct {
+	Workers      int  // tiles composed concurrently, one per CPU when not positive
+	SkipExisting bool // keep parent tiles already stored instead of rebuilding them
+	Quality      int  // JPEG quality, the encoder default when not in 1..100
+	Progress     func(OverviewProgress)
+}
+
+// OverviewProgress counts the parent tiles handled at the zoom being built
+type OverviewProgress struct {
+	Zoom    int8  `json:"zoom"`
+	Total   int64 `json:"total"` // parents with at least one child
+	Built   int64 `json:"built"`
+	Skipped int64 `json:"skipped"` // already stored, with SkipExisting
+}
+
+// overviewProgressInterval is how many tiles are handled between progress callbacks
+const overviewProgressInterval = 256
+
+// BuildOverviews fills the zooms below the highest zoom of the repository in dir
+// down to downToZoom. Each parent tile is composed from its four children, reduced
+// 2x2 and encoded in the format of the repository; parents without any child are
+// not created. Zooms are built from the top, so every level is made from the one
+// just built. The zoom range of repository.json is updated when done.
+func BuildOverviews(dir string, downToZoom int8, opts OverviewOptions) error {
+	if err := checkZoom(int(downToZoom)); err != nil {
+		return err
+	}
+	repository, err := NewRepository(dir, false)
+	if err != nil {
+		return err
+	}
+	zooms, _, err := shardZooms(dir)
+	if err != nil {
+		return err
+	}
+	if len(zooms) == 0 {
+		return fmt.Errorf("%s holds no tiles", dir)
+	}
+	maxZoom := int8(slices.Max(zooms))
+	format, err := overviewFormat(dir, maxZoom)
+	if err != nil {
+		return err
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+	for z := maxZoom - 1; z >= downToZoom; z-- {
+		if err := repository.buildOverviewZoom(z, format, opts); err != nil {
+			return err
+		}
+	}
+	return repository.recordOverviews()
+}
+
+// overviewFormat returns the image format parent tiles are encoded in: the
+// format of repository.json or else that of a tile at maxZoom
+func overviewFormat(dir string, maxZoom int8) (canvas.Format, error) {
+	name := ""
+	if repo, err := readRepositoryInfo(filepath.Dir(dir), filepath.Base(dir)); err == nil {
+		name = repo.Format
+	}
+	if name == "" {
+		files, err := listAllFile(filepath.Join(dir, zoomName(int8(maxZoom))))
+		if err != nil {
+			return "", err
+		}
+		for _, file := range files {
+			if name = sampleTileFormat(file); name != "" {
+				break
+			}
+		}
+	}
+	switch name {
+	case "png":
+		return canvas.FormatPNG, nil
+	case "jpg":
+		return canvas.FormatJPEG, nil
+	}
+	return "", fmt.Errorf("overviews cannot be built for %q tiles", name)
+}
+
+// buildOverviewZoom builds every parent tile at zoom z from the tiles at z+1
+func (f *SRepository) buildOverviewZoom(z int8, format canvas.Format, opts OverviewOptions) error {
+	parentSet := make(map[[2]int64]bool)
+	err := f.ListTiles(z+1, func(x int64, y int64) error {
+		parentSet[[2]int64{x / 2, y / 2}] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	parents := make([][2]int64, 0, len(parentSet))
+	for parent := range parentSet {
+		parents = append(parents, parent)
+	}
+	// parents of the same .s file are handed out together, so writers of one file
+	// rarely wait for each other
+	side := f.shards().File
+	sort.Slice(parents, func(i, j int) bool {
+		a, b := parents[i], parents[j]
+		if a[0]/side != b[0]/side || a[1]/side != b[1]/side {
+			return a[0]/side < b[0]/side || a[0]/side == b[0]/side && a[1]/side < b[1]/side
+		}
+		return a[0] < b[0] || a[0] == b[0] && a[1] < b[1]
+	})
+
+	progress := OverviewProgress{Zoom: z, Total: int64(len(parents))}
+	var mu sync.Mutex
+	var firstErr error
+	report := func(built bool, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			firstErr = errors.Join(firstErr, err)
+			return
+		}
+		if built {
+			progress.Built++
+		} else {
+			progress.Skipped++
+		}
+		if opts.Progress != nil && (progress.Built+progress.Skipped)%overviewProgressInterval == 0 {
+			opts.Progress(progress)
+		}
+	}
+
+	jobs := make(chan [2]int64)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for parent := range jobs {
+				report(f.buildOverviewTile(z, parent[0], parent[1], format, opts))
+			}
+		}()
+	}
+	for _, parent := range parents {
+		jobs <- parent
+	}
+	close(jobs)
+	wg.Wait()
+	if opts.Progress != nil {
+		opts.Progress(progress)
+	}
+	if firstErr != nil {
+		return fmt.Errorf("building zoom %d: %w", z, firstErr)
+	}
+	return nil
+}
+
+// buildOverviewTile composes tile x/y/z from its children and stores it. It
+// reports false when the tile was kept because it already exists.
+func (f *SRepository) buildOverviewTile(z int8, x int64, y int64, format canvas.Format, opts OverviewOptions) (bool, error) {
+	if opts.SkipExisting {
+		if _, err := f.GetXYZ(x, y, z); err == nil {
+			return false, nil
+		} else if !errors.Is(err, ErrTileNotFound) {
+			return false, err
+		}
+	}
+	children := make(map[[2]int64]image.Image)
+	err := f.GetXYZRange(z+1, 2*x, 2*x+1, 2*y, 2*y+1, func(cx int64, cy int64, data []byte) error {
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("decoding %d/%d/%d: %w", z+1, cx, cy, err)
+		}
+		children[[2]int64{cx - 2*x, cy - 2*y}] = img
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if len(children) == 0 {
+		return false, fmt.Errorf("%d/%d/%d has no children", z, x, y)
+	}
+
+	parent := canvas.Downsample2x2(children[[2]int64{0, 0}], children[[2]int64{1, 0}], children[[2]int64{0, 1}], children[[2]int64{1, 1}])
+	buffer, err := canvas.EncodeImage(parent, format, opts.Quality)
+	if err != nil {
+		return false, err
+	}
+	return true, f.WriteXYZ(x, y, z, buffer.Bytes())
+}
+
+// recordOverviews updates the size and zoom range of repository.json after
+// overviews were added. Repositories without a repository.json are left alone.
+func (f *SRepository) recordOverviews() error {
+	return updateRepositoryInfo(f.dir, func(repo *Repository) error {
+		zooms, size, err := shardZooms(f.dir)
+		if err != nil {
+			return err
+		}
+		repo.Size = size
+		repo.MinZoom, repo.MaxZoom = slices.Min(zooms), slices.Max(zooms)
+		return nil
+	})
+}
@@ -0,0 +1,423 @@
+package sfile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PMTiles v3 constants, see https://github.com/protomaps/PMTiles/blob/main/spec/v3/spec.md
+const (
+	pmtilesHeaderSize = 127
+	pmtilesMaxDepth   = 4 // the root directory and up to three levels of leaves
+
+	pmtilesCompressionNone = 1
+	pmtilesCompressionGzip = 2
+
+	// pmtilesLeafCacheSize is how many leaf directories an archive keeps decoded
+	pmtilesLeafCacheSize = 64
+)
+
+// pmtilesTileTypes maps the tile type of the header to the Repository format
+var pmtilesTileTypes = map[byte]string{1: "pbf", 2: "png", 3: "jpg", 4: "webp", 5: "avif"}
+
+// pmtilesHeader is the fixed size header at the start of a PMTiles v3 archive
+type pmtilesHeader struct {
+	rootOffset, rootLength         uint64
+	metadataOffset, metadataLength uint64
+	leafOffset, leafLength         uint64
+	tileDataOffset, tileDataLength uint64
+	internalCompression            byte
+	tileCompression                byte
+	tileType                       byte
+	minZoom, maxZoom               byte
+	minLng, minLat, maxLng, maxLat float64
+	centerZoom                     byte
+	centerLng, centerLat           float64
+}
+
+// pmtilesEntry is a directory entry: a run of tiles, or a leaf directory when runLength is 0
+type pmtilesEntry struct {
+	tileID    uint64
+	offset    uint64
+	length    uint32
+	runLength uint32
+}
+
+// PMTilesArchive reads tiles from a PMTiles v3 archive with ranged reads, so only
+// the header, the root directory and a few recently used leaf directories are
+// kept in memory whatever the size of the archive.
+type PMTilesArchive struct {
+	path    string
+	file    *os.File
+	header  pmtilesHeader
+	root    []pmtilesEntry
+	modTime time.Time
+	size    int64
+
+	leafMu sync.Mutex
+	leaves map[uint64][]pmtilesEntry // decoded leaf directories by offset
+	order  []uint64                  // leaf offsets, oldest first
+}
+
+// OpenPMTiles opens the PMTiles archive at path and reads its header and root directory
+func OpenPMTiles(path string) (*PMTilesArchive, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	archive := &PMTilesArchive{path: path, file: file, modTime: info.ModTime(), size: info.Size(), leaves: make(map[uint64][]pmtilesEntry)}
+	buffer := make([]byte, pmtilesHeaderSize)
+	if _, err := file.ReadAt(buffer, 0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if archive.header, err = parsePMTilesHeader(buffer); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if archive.root, err = archive.readDirectory(archive.header.rootOffset, archive.header.rootLength); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: root directory: %w", path, err)
+	}
+	return archive, nil
+}
+
+// parsePMTilesHeader decodes the header of a PMTiles v3 archive
+func parsePMTilesHeader(buffer []byte) (pmtilesHeader, error) {
+	if len(buffer) < pmtilesHeaderSize || string(buffer[0:7]) != "PMTiles" {
+		return pmtilesHeader{}, errors.New("not a PMTiles archive")
+	}
+	if buffer[7] != 3 {
+		return pmtilesHeader{}, fmt.Errorf("unsupported PMTiles version %d", buffer[7])
+	}
+	u64 := func(at int) uint64 { return binary.LittleEndian.Uint64(buffer[at:]) }
+	e7 := func(at int) float64 { return float64(int32(binary.LittleEndian.Uint32(buffer[at:]))) / 1e7 }
+	header := pmtilesHeader{
+		rootOffset: u64(8), rootLength: u64(16),
+		metadataOffset: u64(24), metadataLength: u64(32),
+		leafOffset: u64(40), leafLength: u64(48),
+		tileDataOffset: u64(56), tileDataLength: u64(64),
+		internalCompression: buffer[97],
+		tileCompression:     buffer[98],
+		tileType:            buffer[99],
+		minZoom:             buffer[100],
+		maxZoom:             buffer[101],
+		minLng:              e7(102), minLat: e7(106), maxLng: e7(110), maxLat: e7(114),
+		centerZoom: buffer[118],
+		centerLng:  e7(119), centerLat: e7(123),
+	}
+	if header.internalCompression != pmtilesCompressionNone && header.internalCompression != pmtilesCompressionGzip {
+		return pmtilesHeader{}, fmt.Errorf("unsupported PMTiles internal compression %d", header.internalCompression)
+	}
+	return header, nil
+}
+
+// readSection reads and decompresses length bytes at offset
+func (a *PMTilesArchive) readSection(offset uint64, length uint64) ([]byte, error) {
+	if offset+length > uint64(a.size) {
+		return nil, fmt.Errorf("section %d+%d is beyond the end of the archive", offset, length)
+	}
+	data := make([]byte, length)
+	if _, err := a.file.ReadAt(data, int64(offset)); err != nil {
+		return nil, err
+	}
+	if a.header.internalCompression != pmtilesCompressionGzip {
+		return data, nil
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// readDirectory reads and decodes the directory stored at offset
+func (a *PMTilesArchive) readDirectory(offset uint64, length uint64) ([]pmtilesEntry, error) {
+	data, err := a.readSection(offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return parsePMTilesDirectory(data)
+}
+
+// parsePMTilesDirectory decodes a directory: the entry count followed by the
+// delta encoded tile IDs, the run lengths, the lengths and the offsets
+func parsePMTilesDirectory(data []byte) ([]pmtilesEntry, error) {
+	reader := bytes.NewReader(data)
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(len(data)) {
+		return nil, fmt.Errorf("directory claims %d entries in %d bytes", count, len(data))
+	}
+	entries := make([]pmtilesEntry, count)
+	var tileID uint64
+	for i := range entries {
+		delta, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		tileID += delta
+		entries[i].tileID = tileID
+	}
+	for i := range entries {
+		runLength, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].runLength = uint32(runLength)
+	}
+	for i := range entries {
+		length, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		entries[i].length = uint32(length)
+	}
+	for i := range entries {
+		offset, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return nil, err
+		}
+		if offset == 0 && i > 0 {
+			// 0 means the data directly follows the previous entry
+			entries[i].offset = entries[i-1].offset + uint64(entries[i-1].length)
+		} else {
+			entries[i].offset = offset - 1
+		}
+	}
+	return entries, nil
+}
+
+// leaf returns the leaf directory at offset, decoding it at most once while cached
+func (a *PMTilesArchive) leaf(offset uint64, length uint64) ([]pmtilesEntry, error) {
+	a.leafMu.Lock()
+	entries, ok := a.leaves[offset]
+	a.leafMu.Unlock()
+	if ok {
+		return entries, nil
+	}
+	entries, err := a.readDirectory(a.header.leafOffset+offset, length)
+	if err != nil {
+		return nil, err
+	}
+	a.leafMu.Lock()
+	defer a.leafMu.Unlock()
+	if _, ok := a.leaves[offset]; !ok {
+		a.leaves[offset] = entries
+		a.order = append(a.order, offset)
+		if len(a.order) > pmtilesLeafCacheSize {
+			delete(a.leaves, a.order[0])
+			a.order = a.order[1:]
+		}
+	}
+	return entries, nil
+}
+
+// findEntry returns the entry with the greatest tile ID not above tileID
+func findEntry(entries []pmtilesEntry, tileID uint64) (pmtilesEntry, bool) {
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].tileID > tileID })
+	if i == 0 {
+		return pmtilesEntry{}, false
+	}
+	return entries[i-1], true
+}
+
+// GetXYZContext returns the tile x/y/z as stored in the archive, which for vector
+// tiles is usually gzip compressed
+func (a *PMTilesArchive) GetXYZContext(ctx context.Context, x int64, y int64, z int8) (*bytes.Buffer, error) {
+	if err := checkTile(x, y, z); err != nil {
+		return nil, err
+	}
+	tileID := pmtilesTileID(z, x, y)
+	entries := a.root
+	for depth := 0; depth < pmtilesMaxDepth; depth++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		entry, ok := findEntry(entries, tileID)
+		if !ok {
+			break
+		}
+		if entry.runLength > 0 {
+			if tileID >= entry.tileID+uint64(entry.runLength) {
+				break
+			}
+			data := make([]byte, entry.length)
+			if _, err := a.file.ReadAt(data, int64(a.header.tileDataOffset+entry.offset)); err != nil {
+				RecordError("pmtiles", fmt.Errorf("read %s: %w", a.path, err))
+				return nil, err
+			}
+			return bytes.NewBuffer(data), nil
+		}
+		leaf, err := a.leaf(entry.offset, uint64(entry.length))
+		if err != nil {
+			RecordError("pmtiles", fmt.Errorf("leaf directory of %s: %w", a.path, err))
+			return nil, err
+		}
+		entries = leaf
+	}
+	return nil, fmt.Errorf("%w: %d/%d/%d not exist in %s", ErrTileNotFound, z, x, y, a.path)
+}
+
+// GetXYZ returns the tile x/y/z as stored in the archive
+func (a *PMTilesArchive) GetXYZ(x int64, y int64, z int8) (*bytes.Buffer, error) {
+	return a.GetXYZContext(context.Background(), x, y, z)
+}
+
+// Metadata returns the JSON metadata of the archive
+func (a *PMTilesArchive) Metadata() (map[string]interface{}, error) {
+	metadata := make(map[string]interface{})
+	if a.header.metadataLength == 0 {
+		return metadata, nil
+	}
+	data, err := a.readSection(a.header.metadataOffset, a.header.metadataLength)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("metadata of %s: %w", a.path, err)
+	}
+	return metadata, nil
+}
+
+// Repository describes the archive as the repository name
+func (a *PMTilesArchive) Repository(name string) Repository {
+	header := a.header
+	repo := Repository{
+		Name:     name,
+		Url:      name,
+		Pared:    true,
+		Lng:      header.centerLng,
+		Lat:      header.centerLat,
+		Zoom:     int(header.centerZoom),
+		Size:     float64(a.size),
+		Bounds:   [4]float64{header.minLng, header.minLat, header.maxLng, header.maxLat},
+		MinZoom:  int(header.minZoom),
+		MaxZoom:  int(header.maxZoom),
+		Format:   pmtilesTileTypes[header.tileType],
+		TileSize: DefaultTileSize,
+	}
+	metadata, err := a.Metadata()
+	if err != nil {
+		RecordError("pmtiles", err)
+		return repo
+	}
+	text := func(key string) string {
+		value, _ := metadata[key].(string)
+		return value
+	}
+	repo.Title, repo.Attribution, repo.Description = text("name"), text("attribution"), text("description")
+	return repo
+}
+
+// Close closes the archive file
+func (a *PMTilesArchive) Close() error {
+	return a.file.Close()
+}
+
+// pmtilesTileID returns the position of tile z/x/y on the Hilbert curves of all
+// zoom levels up to z, which is how PMTiles orders tiles
+func pmtilesTileID(z int8, x int64, y int64) uint64 {
+	var id uint64
+	for level := int8(0); level < z; level++ {
+		id += uint64(1) << (2 * uint(level))
+	}
+	n := int64(1) << z
+	var d uint64
+	for s := n / 2; s > 0; s /= 2 {
+		var rx, ry int64
+		if x&s > 0 {
+			rx = 1
+		}
+		if y&s > 0 {
+			ry = 1
+		}
+		d += uint64(s) * uint64(s) * uint64((3*rx)^ry)
+		// rotate the quadrant so the curve stays continuous
+		if ry == 0 {
+			if rx == 1 {
+				x = s - 1 - x&(s-1)
+				y = s - 1 - y&(s-1)
+			}
+			x, y = y, x
+		}
+	}
+	return id + d
+}
+
+// IsPMTiles reports whether path is a .pmtiles archive
+func IsPMTiles(path string) bool {
+	if !strings.EqualFold(filepath.Ext(path), ".pmtiles") {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
+
+func init() {
+	RegisterTileSource(TileBackend{
+		Name:  "pmtiles",
+		Match: IsPMTiles,
+		Open: func(root string, name string) (TileSource, error) {
+			archive, err := openCachedPMTiles(filepath.Join(root, filepath.FromSlash(name)))
+			if err != nil {
+				return nil, err
+			}
+			return archiveSource{
+				read:     archive.GetXYZContext,
+				metadata: func() Repository { return archive.Repository(name) },
+			}, nil
+		},
+	})
+}
+
+// pmtilesArchives keeps PMTiles archives open between requests, by absolute path
+var pmtilesArchives = struct {
+	sync.Mutex
+	open map[string]*PMTilesArchive
+}{open: make(map[string]*PMTilesArchive)}
+
+// openCachedPMTiles returns the open archive of path, reopening it when the file
+// changed on disk. Replaced archives are not closed, readers may still use them,
+// and are left to the garbage collector.
+func openCachedPMTiles(path string) (*PMTilesArchive, error) {
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(absolute)
+	if err != nil {
+		return nil, err
+	}
+	pmtilesArchives.Lock()
+	defer pmtilesArchives.Unlock()
+	if archive, ok := pmtilesArchives.open[absolute]; ok && archive.modTime.Equal(info.ModTime()) && archive.size == info.Size() {
+		return archive, nil
+	}
+	archive, err := OpenPMTiles(absolute)
+	if err != nil {
+		return nil, err
+	}
+	pmtilesArchives.open[absolute] = archive
+	return archive, nil
+}
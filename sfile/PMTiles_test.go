@@ -0,0 +1,318 @@
+package sfile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestPMTilesTileID checks tile IDs against the values of the PMTiles
+// specification and that each zoom level is one continuous Hilbert curve: its
+// IDs follow those of the levels above and each tile neighbours the next one
+func TestPMTilesTileID(t *testing.T) {
+	for _, tc := range []struct {
+		z    int8
+		x, y int64
+		want uint64
+	}{
+		{0, 0, 0, 0},
+		{1, 0, 0, 1}, {1, 0, 1, 2}, {1, 1, 1, 3}, {1, 1, 0, 4},
+		{2, 0, 0, 5}, {2, 1, 0, 6}, {2, 1, 1, 7}, {2, 0, 1, 8},
+		{2, 0, 2, 9}, {2, 0, 3, 10}, {2, 1, 3, 11}, {2, 1, 2, 12},
+		{2, 2, 2, 13}, {2, 2, 3, 14}, {2, 3, 3, 15}, {2, 3, 2, 16},
+		{2, 3, 1, 17}, {2, 2, 1, 18}, {2, 2, 0, 19}, {2, 3, 0, 20},
+		{3, 0, 0, 21},
+		{12, 0, 0, 5592405},
+		{20, 0, 0, 366503875925},
+	} {
+		if got := pmtilesTileID(tc.z, tc.x, tc.y); got != tc.want {
+			t.Errorf("pmtilesTileID(%d/%d/%d) = %d, want %d", tc.z, tc.x, tc.y, got, tc.want)
+		}
+	}
+
+	for z := int8(1); z <= 6; z++ {
+		n := int64(1) << z
+		first := pmtilesTileID(z, 0, 0)
+		tiles := make([]TileCoord, n*n)
+		for x := int64(0); x < n; x++ {
+			for y := int64(0); y < n; y++ {
+				id := pmtilesTileID(z, x, y)
+				if id < first || id >= first+uint64(n*n) {
+					t.Fatalf("pmtilesTileID(%d/%d/%d) = %d, outside %d..%d", z, x, y, id, first, first+uint64(n*n)-1)
+				}
+				if tiles[id-first] != (TileCoord{}) {
+					t.Fatalf("%d/%d/%d and %d/%d/%d share the ID %d", z, x, y, z, tiles[id-first].X, tiles[id-first].Y, id)
+				}
+				tiles[id-first] = TileCoord{Z: z, X: x, Y: y}
+			}
+		}
+		for i := 1; i < len(tiles); i++ {
+			dx, dy := tiles[i].X-tiles[i-1].X, tiles[i].Y-tiles[i-1].Y
+			if dx*dx+dy*dy != 1 {
+				t.Fatalf("zoom %d: ID %d at %d/%d does not neighbour ID %d at %d/%d",
+					z, first+uint64(i), tiles[i].X, tiles[i].Y, first+uint64(i)-1, tiles[i-1].X, tiles[i-1].Y)
+			}
+		}
+	}
+}
+
+// TestParsePMTilesDirectory decodes a directory whose fields need one, two and
+// three byte varints, with offsets stored explicitly and as following the
+// previous entry, and checks truncated and oversized directories are refused
+func TestParsePMTilesDirectory(t *testing.T) {
+	data := []byte{
+		4,                // entries
+		0, 0xac, 0x02, 1, // tile IDs 0, 300, 301
+		0x90, 0x4e, //        and 10301
+		1, 0, 2, 1, // run lengths, the second entry a leaf directory
+		5, 0x80, 0x01, 7, 9, // lengths 5, 128, 7 and 9
+		1, 0x81, 0x80, 0x01, 0, 6, // offsets 0, 16384, after the previous and 5
+	}
+	entries, err := parsePMTilesDirectory(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []pmtilesEntry{
+		{tileID: 0, offset: 0, length: 5, runLength: 1},
+		{tileID: 300, offset: 16384, length: 128, runLength: 0},
+		{tileID: 301, offset: 16512, length: 7, runLength: 2},
+		{tileID: 10301, offset: 5, length: 9, runLength: 1},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("%d entries %+v, want %+v", len(entries), entries, want)
+	}
+	for i := range want {
+		if entries[i] != want[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, entries[i], want[i])
+		}
+	}
+
+	if entries, err := parsePMTilesDirectory([]byte{0}); err != nil || len(entries) != 0 {
+		t.Errorf("empty directory = %+v, %v, want no entries", entries, err)
+	}
+	for _, bad := range [][]byte{
+		{},
+		{0x80},
+		data[:len(data)-1],
+		data[:9],
+		{0xff, 0xff, 0x03, 0, 0, 0, 0},
+	} {
+		if entries, err := parsePMTilesDirectory(bad); err == nil {
+			t.Errorf("parsePMTilesDirectory(% x) = %+v, want an error", bad, entries)
+		}
+	}
+}
+
+// pmtilesFixtureEntry is a tile run of writePMTilesFixture, given by tile ID
+// so the fixture does not depend on pmtilesTileID
+type pmtilesFixtureEntry struct {
+	tileID    uint64
+	runLength uint32
+	data      string
+}
+
+// encodePMTilesDirectory encodes entries as a PMTiles v3 directory, storing
+// the offset of an entry following the previous one as 0
+func encodePMTilesDirectory(entries []pmtilesEntry) []byte {
+	data := binary.AppendUvarint(nil, uint64(len(entries)))
+	var last uint64
+	for _, entry := range entries {
+		data = binary.AppendUvarint(data, entry.tileID-last)
+		last = entry.tileID
+	}
+	for _, entry := range entries {
+		data = binary.AppendUvarint(data, uint64(entry.runLength))
+	}
+	for _, entry := range entries {
+		data = binary.AppendUvarint(data, uint64(entry.length))
+	}
+	for i, entry := range entries {
+		if i > 0 && entry.offset == entries[i-1].offset+uint64(entries[i-1].length) {
+			data = binary.AppendUvarint(data, 0)
+		} else {
+			data = binary.AppendUvarint(data, entry.offset+1)
+		}
+	}
+	return data
+}
+
+// writePMTilesFixture writes a PMTiles v3 archive of 256 pixel PNG tiles, the
+// root entries in the root directory and the leaf entries in a single leaf
+// directory the root points to, with identical tile data stored once
+func writePMTilesFixture(t *testing.T, path string, compression byte, root []pmtilesFixtureEntry, leaf []pmtilesFixtureEntry, metadata string) {
+	t.Helper()
+	compress := func(data []byte) []byte {
+		if compression != pmtilesCompressionGzip {
+			return data
+		}
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		_, _ = writer.Write(data)
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return compressed.Bytes()
+	}
+	var tileData []byte
+	stored := make(map[string]uint64)
+	entries := func(fixture []pmtilesFixtureEntry) []pmtilesEntry {
+		var entries []pmtilesEntry
+		for _, tile := range fixture {
+			offset, ok := stored[tile.data]
+			if !ok {
+				offset = uint64(len(tileData))
+				stored[tile.data] = offset
+				tileData = append(tileData, tile.data...)
+			}
+			entries = append(entries, pmtilesEntry{tileID: tile.tileID, offset: offset, length: uint32(len(tile.data)), runLength: tile.runLength})
+		}
+		return entries
+	}
+	rootEntries := entries(root)
+	leafDirectory := compress(encodePMTilesDirectory(entries(leaf)))
+	if len(leaf) > 0 {
+		rootEntries = append(rootEntries, pmtilesEntry{tileID: leaf[0].tileID, offset: 0, length: uint32(len(leafDirectory))})
+	}
+	rootDirectory := compress(encodePMTilesDirectory(rootEntries))
+	metadataSection := compress([]byte(metadata))
+
+	header := make([]byte, pmtilesHeaderSize)
+	copy(header, "PMTiles")
+	header[7] = 3
+	offset := uint64(pmtilesHeaderSize)
+	for i, section := range [][]byte{rootDirectory, metadataSection, leafDirectory, tileData} {
+		binary.LittleEndian.PutUint64(header[8+16*i:], offset)
+		binary.LittleEndian.PutUint64(header[16+16*i:], uint64(len(section)))
+		offset += uint64(len(section))
+	}
+	header[96] = 1 // clustered
+	header[97] = compression
+	header[98] = pmtilesCompressionNone
+	header[99] = 2 // png
+	header[100], header[101] = 0, 3
+	for i, value := range []float64{-180, -85.0511287, 180, 85.0511287} {
+		binary.LittleEndian.PutUint32(header[102+4*i:], uint32(int32(value*1e7)))
+	}
+	header[118] = 2
+	binary.LittleEndian.PutUint32(header[119:], uint32(int32(116.3912757*1e7)))
+	binary.LittleEndian.PutUint32(header[123:], uint32(int32(39.906217*1e7)))
+
+	archive := bytes.Join([][]byte{header, rootDirectory, metadataSection, leafDirectory, tileData}, nil)
+	if err := os.WriteFile(path, archive, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestPMTilesArchive writes a small archive with plain and with gzipped
+// directories, its tiles in runs, in a leaf directory and shared between
+// tiles, and looks up every tile of zooms 0 to 3 by XYZ
+func TestPMTilesArchive(t *testing.T) {
+	root := []pmtilesFixtureEntry{
+		{0, 1, "world"},
+		{1, 2, "west"}, // 1/0/0 and 1/0/1
+		{4, 1, "north east"},
+	}
+	leaf := []pmtilesFixtureEntry{
+		{5, 1, "2/0/0"},
+		{13, 1, "world"}, // 2/2/2 shares the tile of 0/0/0
+		{17, 4, "2/3/1 to 2/3/0"},
+		{21, 1, "3/0/0"},
+	}
+	want := map[TileCoord]string{
+		{Z: 0, X: 0, Y: 0}: "world",
+		{Z: 1, X: 0, Y: 0}: "west",
+		{Z: 1, X: 0, Y: 1}: "west",
+		{Z: 1, X: 1, Y: 0}: "north east",
+		{Z: 2, X: 0, Y: 0}: "2/0/0",
+		{Z: 2, X: 2, Y: 2}: "world",
+		{Z: 2, X: 3, Y: 1}: "2/3/1 to 2/3/0",
+		{Z: 2, X: 2, Y: 1}: "2/3/1 to 2/3/0",
+		{Z: 2, X: 2, Y: 0}: "2/3/1 to 2/3/0",
+		{Z: 2, X: 3, Y: 0}: "2/3/1 to 2/3/0",
+		{Z: 3, X: 0, Y: 0}: "3/0/0",
+	}
+	for _, compression := range []byte{pmtilesCompressionNone, pmtilesCompressionGzip} {
+		path := filepath.Join(t.TempDir(), "fixture.pmtiles")
+		writePMTilesFixture(t, path, compression, root, leaf, `{"name":"Fixture","attribution":"© Fixture","description":"tiles by ID"}`)
+		if !IsPMTiles(path) {
+			t.Fatalf("IsPMTiles(%s) = false", path)
+		}
+		archive, err := OpenPMTiles(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer archive.Close()
+
+		for z := int8(0); z <= 3; z++ {
+			for x := int64(0); x < 1<<z; x++ {
+				for y := int64(0); y < 1<<z; y++ {
+					tile, err := archive.GetXYZ(x, y, z)
+					data, ok := want[TileCoord{Z: z, X: x, Y: y}]
+					if !ok {
+						if !errors.Is(err, ErrTileNotFound) {
+							t.Errorf("compression %d: %d/%d/%d = %v, %v, want not found", compression, z, x, y, tile, err)
+						}
+						continue
+					}
+					if err != nil || tile.String() != data {
+						t.Errorf("compression %d: %d/%d/%d = %v, %v, want %q", compression, z, x, y, tile, err, data)
+					}
+				}
+			}
+		}
+		if _, err := archive.GetXYZ(0, 0, 4); !errors.Is(err, ErrTileNotFound) {
+			t.Errorf("compression %d: a tile below the leaf directory: %v, want not found", compression, err)
+		}
+
+		repo := archive.Repository("fixture.pmtiles")
+		if repo.Title != "Fixture" || repo.Attribution != "© Fixture" || repo.Description != "tiles by ID" || repo.Format != "png" {
+			t.Errorf("compression %d: repository %+v", compression, repo)
+		}
+		// coordinates are stored in 1e-7 degrees
+		e7 := func(got float64, want float64) bool { return math.Abs(got-want) < 1e-7 }
+		if repo.MinZoom != 0 || repo.MaxZoom != 3 || repo.Zoom != 2 || !e7(repo.Lng, 116.3912757) || !e7(repo.Lat, 39.906217) {
+			t.Errorf("compression %d: zooms %d..%d, center %g, %g at %d", compression, repo.MinZoom, repo.MaxZoom, repo.Lng, repo.Lat, repo.Zoom)
+		}
+		if !e7(repo.Bounds[0], -180) || !e7(repo.Bounds[1], -85.0511287) || !e7(repo.Bounds[2], 180) || !e7(repo.Bounds[3], 85.0511287) {
+			t.Errorf("compression %d: bounds %v", compression, repo.Bounds)
+		}
+	}
+}
+
+// TestOpenPMTilesInvalid checks files which are not version 3 archives, or
+// whose root directory lies past their end, are refused
+func TestOpenPMTilesInvalid(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "valid.pmtiles")
+	writePMTilesFixture(t, path, pmtilesCompressionGzip, []pmtilesFixtureEntry{{0, 1, "world"}}, nil, `{}`)
+	valid, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version2 := bytes.Clone(valid)
+	version2[7] = 2
+	truncated := valid[:pmtilesHeaderSize+2]
+	brotli := bytes.Clone(valid)
+	brotli[97] = 3
+	for name, data := range map[string][]byte{
+		"not a PMTiles archive": []byte("SQLite format 3\x00"),
+		"short header":          valid[:100],
+		"version 2":             version2,
+		"brotli directories":    brotli,
+		"truncated":             truncated,
+	} {
+		path := filepath.Join(dir, "invalid.pmtiles")
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if archive, err := OpenPMTiles(path); err == nil {
+			archive.Close()
+			t.Errorf("%s: opened", name)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package sfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// DeleteXYZ removes tile x/y/z. Deleting a tile that is not stored returns ErrTileNotFound.
+func (f *SRepository) DeleteXYZ(x int64, y int64, z int8) error {
+	if err := f.grid.checkTile(x, y, z); err != nil {
+		return err
+	}
+	filePath, tableName, id := f.shardLocation(x, y, z)
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		return fmt.Errorf("%w: %w: %s", ErrTileNotFound, ErrShardNotFound, filePath)
+	}
+	db, done, err := openShardForWrite(filePath)
+	if err != nil {
+		return err
+	}
+	result, err := db.Exec("delete from "+tableName+" where ID=?", id)
+	if err == nil {
+		noteTiles(f.dir, f.shards(), filePath, []TileCoord{{Z: z, X: x, Y: y}}, false)
+	}
+	done()
+	if err != nil {
+		if strings.Contains(err.Error(), "no such table") {
+			return fmt.Errorf("%w: %s not exist in %s", ErrTileNotFound, tableName, filePath)
+		}
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return fmt.Errorf("%w: %d/%d/%d not exist in %s", ErrTileNotFound, z, x, y, filePath)
+	}
+	return f.refreshRepositoryInfo(z)
+}
+
+// PruneZoom removes every tile of zoom z and returns how many were removed. The
+// .s files of the zoom are deleted and so is the zoom directory once it is empty.
+func (f *SRepository) PruneZoom(z int8) (int64, error) {
+	if err := checkZoom(int(z)); err != nil {
+		return 0, err
+	}
+	zoomDir := filepath.Join(f.dir, zoomName(z))
+	files, err := listAllFile(zoomDir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var pruned int64
+	for _, file := range files {
+		count, err := pruneShard(file)
+		pruned += count
+		if err != nil {
+			return pruned, err
+		}
+	}
+	if entries, err := os.ReadDir(zoomDir); err == nil && len(entries) == 0 {
+		if err := os.Remove(zoomDir); err != nil {
+			return pruned, err
+		}
+	}
+	return pruned, f.refreshRepositoryInfo(z)
+}
+
+// pruneShard drops every table of a .s file, removes the file and returns the number of tiles it held
+func pruneShard(filePath string) (int64, error) {
+	db, done, err := openShardForWrite(filePath)
+	if err != nil {
+		return 0, err
+	}
+	tableNames, err := listTables(db)
+	if err != nil {
+		done()
+		return 0, err
+	}
+	var count int64
+	for _, tableName := range tableNames {
+		if !validTableName.MatchString(tableName) {
+			continue
+		}
+		var rows int64
+		if err := db.QueryRow("select count(*) from " + tableName).Scan(&rows); err != nil {
+			done()
+			return count, err
+		}
+		if _, err := db.Exec("drop table " + tableName); err != nil {
+			done()
+			return count, err
+		}
+		count += rows
+	}
+	remaining, err := listTables(db)
+	done()
+	if err != nil {
+		return count, err
+	}
+	// the meta and blobs tables of a deduplicated file hold no tiles of their own
+	remaining = slices.DeleteFunc(remaining, func(tableName string) bool {
+		return !validTableName.MatchString(tableName)
+	})
+	if len(remaining) == 0 {
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// refreshRepositoryInfo updates the size and zoom range recorded in repository.json
+// after tiles of zoom z were removed, and moves the recorded zoom when it was z and
+// z is now empty. Repositories without a repository.json are left alone.
+func (f *SRepository) refreshRepositoryInfo(z int8) error {
+	return updateRepositoryInfo(f.dir, func(repo *Repository) error {
+		zooms, size, err := shardZooms(f.dir)
+		if err != nil {
+			return err
+		}
+		repo.Size = size
+		if repo.Zoom == int(z) && len(zooms) > 0 && !containsZoom(zooms, repo.Zoom) {
+			// the recorded zoom is gone, open the repository at the closest zoom left
+			closest := zooms[0]
+			for _, zoom := range zooms {
+				if abs(zoom-repo.Zoom) < abs(closest-repo.Zoom) {
+					closest = zoom
+				}
+			}
+			repo.Zoom = closest
+		}
+		if len(zooms) > 0 && repo.MaxZoom > 0 {
+			// only keep a zoom range up to date that analysis recorded before
+			repo.MinZoom, repo.MaxZoom = slices.Min(zooms), slices.Max(zooms)
+		}
+		return nil
+	})
+}
+
+// shardZooms returns the zooms that have .s files in dir and the total size of those files
+func shardZooms(dir string) ([]int, float64, error) {
+	var size float64
+	zooms := make([]int, 0)
+	subDirs, err := listSubDir(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, sub := range subDirs {
+		files, err := listAllFile(sub)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(files) > 0 {
+			zooms = append(zooms, int(subDirZoom(sub)))
+		}
+		for _, file := range files {
+			if info, err := os.Stat(file); err == nil {
+				size += float64(info.Size())
+			}
+		}
+	}
+	return zooms, size, nil
+}
+
+func containsZoom(zooms []int, zoom int) bool {
+	for _, z := range zooms {
+		if z == zoom {
+			return true
+		}
+	}
+	return false
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
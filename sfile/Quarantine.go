@@ -0,0 +1,256 @@
+package sfile
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A corrupt tile, found by a verified read or by the scrubber, is moved out of
+// its table into the quarantine table of its .s file, original bytes, encoding
+// and write time included, so it is read as missing and the fallbacks of the
+// server take over instead of serving garbage. Quarantined tiles stay in the
+// file until restored, see RestoreQuarantined, or the file is rewritten.
+
+// quarantineTable is the table of a .s file holding its quarantined tiles
+const quarantineTable = "quarantine"
+
+// ErrTileQuarantined is returned, together with ErrTileNotFound, for a tile
+// found corrupt and quarantined
+var ErrTileQuarantined = errors.New("tile quarantined")
+
+// quarantineCorrupt makes corrupt tiles be quarantined, see SetQuarantine
+var quarantineCorrupt atomic.Bool
+
+// SetQuarantine makes the corrupt tiles found by verified reads, see
+// SetVerifyReads, and by the scrubber be quarantined. Files opened immutable,
+// with SetAssumeImmutable or on read-only storage, are never written, their
+// corrupt tiles are only reported.
+func SetQuarantine(enabled bool) {
+	quarantineCorrupt.Store(enabled)
+}
+
+// QuarantinedTile is a tile held in the quarantine table of a .s file
+type QuarantinedTile struct {
+	TileCoord
+	File        string    `json:"file"` // relative to the repository, slash separated
+	Size        int       `json:"size"` // of the blob as stored
+	Reason      string    `json:"reason"`
+	Quarantined time.Time `json:"quarantined"`
+}
+
+// canQuarantine reports whether a corrupt tile of the .s file at filePath is
+// quarantined rather than only reported
+func canQuarantine(filePath string) bool {
+	return quarantineCorrupt.Load() && !assumeImmutable.Load() && !readOnlyStorage(filePath)
+}
+
+// quarantineTile moves row id of tableName, tile of the repository in dir with
+// the given scheme, into the quarantine table of the .s file at filePath
+func quarantineTile(dir string, scheme ShardScheme, filePath string, tableName string, id int64, tile TileCoord, reason string) error {
+	db, done, err := openShardForWrite(filePath)
+	if err != nil {
+		return err
+	}
+	defer done()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := moveToQuarantine(tx, tableName, id, reason); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	noteTiles(dir, scheme, filePath, []TileCoord{tile}, false)
+	return nil
+}
+
+// moveToQuarantine copies row id of tableName into the quarantine table and
+// deletes it. The blob of a deduplicated row is copied, the blobs table is left
+// alone as other rows may share it.
+func moveToQuarantine(tx *sql.Tx, tableName string, id int64, reason string) error {
+	if _, err := tx.Exec("create table if not exists " + quarantineTable + " (TableName TEXT, ID INTEGER, X INTEGER, Y INTEGER," +
+		" Data BLOB, Encoding TEXT, Written INTEGER, Reason TEXT, Quarantined INTEGER, PRIMARY KEY (TableName, ID))"); err != nil {
+		return err
+	}
+	version, err := shardSchema(tx)
+	if err != nil {
+		return err
+	}
+	encoding, err := encodingColumn(tx, tableName)
+	if err != nil {
+		return err
+	}
+	written, err := optionalColumn(tx, tableName, "Written")
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec("insert or replace into "+quarantineTable+" (TableName, ID, X, Y, Data, Encoding, Written, Reason, Quarantined)"+
+		" select ?, ID, X, Y, "+tileData(tableName, version >= shardSchemaDedup)+", "+encoding+", "+written+", ?, ? from "+tableName+" where ID = ?",
+		tableName, reason, time.Now().Unix(), id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("%w: row %d of %s", ErrTileNotFound, id, tableName)
+	}
+	_, err = tx.Exec("delete from "+tableName+" where ID = ?", id)
+	return err
+}
+
+// optionalColumn returns column qualified by tableName when the table has it,
+// NULL otherwise
+func optionalColumn(db queryRower, tableName string, column string) (string, error) {
+	var has int
+	if err := db.QueryRow("select count(*) from pragma_table_info(?) where name = ?", tableName, column).Scan(&has); err != nil {
+		return "", err
+	}
+	if has == 0 {
+		return "NULL", nil
+	}
+	return tableName + "." + column, nil
+}
+
+// ListQuarantined returns the quarantined tiles of every .s file of the
+// repository in dir, in file order. The files are opened read only.
+func ListQuarantined(dir string) ([]QuarantinedTile, error) {
+	subDirs, err := listSubDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	tiles := make([]QuarantinedTile, 0)
+	for _, sub := range subDirs {
+		files, err := listAllFile(sub)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			name, err := filepath.Rel(dir, file)
+			if err != nil {
+				name = file
+			}
+			if tiles, err = listShardQuarantine(file, filepath.ToSlash(name), tiles); err != nil {
+				return nil, fmt.Errorf("list the quarantine of %s: %w", file, err)
+			}
+		}
+	}
+	return tiles, nil
+}
+
+// listShardQuarantine appends the quarantined tiles of one .s file to tiles
+func listShardQuarantine(filePath string, name string, tiles []QuarantinedTile) ([]QuarantinedTile, error) {
+	db, err := openShardForRead(filePath)
+	if err != nil {
+		return tiles, err
+	}
+	defer closeShard(db)
+	rows, err := db.Query("select TableName, X, Y, length(Data), Reason, Quarantined from " + quarantineTable + " order by TableName, ID")
+	if err != nil {
+		if strings.Contains(err.Error(), "no such table") {
+			return tiles, nil
+		}
+		return tiles, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tableName string
+		var tile QuarantinedTile
+		var size sql.NullInt64
+		var quarantined int64
+		if err := rows.Scan(&tableName, &tile.X, &tile.Y, &size, &tile.Reason, &quarantined); err != nil {
+			return tiles, err
+		}
+		z, _, _, ok := parseShardName(tableName)
+		if !ok {
+			continue
+		}
+		tile.Z, tile.File, tile.Size = z, name, int(size.Int64)
+		tile.Quarantined = time.Unix(quarantined, 0)
+		tiles = append(tiles, tile)
+	}
+	return tiles, rows.Err()
+}
+
+// RestoreQuarantined puts tile x/y/z of the repository in dir back from the
+// quarantine, for a tile quarantined by mistake, replacing any tile written to
+// its place since. The tile keeps the bytes, encoding and write time it was
+// quarantined with. A tile that is not quarantined returns ErrTileNotFound.
+func RestoreQuarantined(dir string, x int64, y int64, z int8) error {
+	repository, err := NewRepository(dir, false)
+	if err != nil {
+		return err
+	}
+	if err := repository.grid.checkTile(x, y, z); err != nil {
+		return err
+	}
+	filePath, tableName, id := repository.shardLocation(x, y, z)
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		return fmt.Errorf("%w: %w: %s", ErrTileNotFound, ErrShardNotFound, filePath)
+	}
+	db, done, err := openShardForWrite(filePath)
+	if err != nil {
+		return err
+	}
+	defer done()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := restoreFromQuarantine(tx, tableName, id, x, y); err != nil {
+		_ = tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) || strings.Contains(err.Error(), "no such table") {
+			return fmt.Errorf("%w: %d/%d/%d is not quarantined in %s", ErrTileNotFound, z, x, y, filePath)
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	noteTiles(repository.dir, repository.shards(), filePath, []TileCoord{{Z: z, X: x, Y: y}}, true)
+	return nil
+}
+
+// restoreFromQuarantine writes row id of tableName back from the quarantine
+// table and removes it from there
+func restoreFromQuarantine(tx *sql.Tx, tableName string, id int64, x int64, y int64) error {
+	var data []byte
+	var encoding sql.NullString
+	var written sql.NullInt64
+	err := tx.QueryRow("select Data, Encoding, Written from "+quarantineTable+" where TableName = ? and ID = ?", tableName, id).Scan(&data, &encoding, &written)
+	if err != nil {
+		return err
+	}
+	dedup, err := prepareShardWrite(tx)
+	if err != nil {
+		return err
+	}
+	if err := createShardTable(tx, tableName, dedup); err != nil {
+		return err
+	}
+	if _, err := insertTile(tx, "insert or replace", tableName, id, x, y, data, dedup); err != nil {
+		return err
+	}
+	if written.Valid {
+		if err := addWrittenColumn(tx, tableName); err != nil {
+			return err
+		}
+		if err := stampTile(tx, tableName, id, time.Unix(written.Int64, 0)); err != nil {
+			return err
+		}
+	}
+	if err := stampEncoding(tx, tableName, id, encoding.String); err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from "+quarantineTable+" where TableName = ? and ID = ?", tableName, id)
+	return err
+}
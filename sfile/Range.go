@@ -0,0 +1,145 @@
+package sfile
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// rangeScanThreshold is the share of the tiles of a table above which
+// GetXYZRange reads the whole table instead of listing the requested IDs
+const rangeScanThreshold = 0.5
+
+// rangeChunkSize bounds the number of IDs bound to a single IN (...) query
+const rangeChunkSize = 500
+
+// GetXYZRange calls fn for every stored tile of zoom z with xMin <= x <= xMax and
+// yMin <= y <= yMax. Each .s file is opened once and each table queried once or
+// a few times, so reading a block of adjacent tiles is far cheaper than calling
+// GetXYZ per tile. Missing tiles are skipped, the order of the calls is unspecified
+// and data must not be retained after fn returns.
+func (f *SRepository) GetXYZRange(z int8, xMin int64, xMax int64, yMin int64, yMax int64, fn func(x int64, y int64, data []byte) error) error {
+	if err := checkZoom(int(z)); err != nil {
+		return &CoordinateError{Z: int(z), X: xMin, Y: yMin, Err: err}
+	}
+	columns, rows := f.grid.Matrix(int(z))
+	xMin, yMin = max(xMin, 0), max(yMin, 0)
+	xMax, yMax = min(xMax, columns-1), min(yMax, rows-1)
+	if xMin > xMax || yMin > yMax {
+		return nil
+	}
+	side := f.shards().File
+	for fileY := yMin / side; fileY <= yMax/side; fileY++ {
+		for fileX := xMin / side; fileX <= xMax/side; fileX++ {
+			err := f.rangeInFile(z, fileX, fileY,
+				max(xMin, fileX*side), min(xMax, fileX*side+side-1),
+				max(yMin, fileY*side), min(yMax, fileY*side+side-1), fn)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rangeInFile reads the requested tiles held by a single .s file
+func (f *SRepository) rangeInFile(z int8, fileX int64, fileY int64, xMin int64, xMax int64, yMin int64, yMax int64, fn func(x int64, y int64, data []byte) error) error {
+	scheme := f.shards()
+	filePath, _, _ := f.shardLocation(fileX*scheme.File, fileY*scheme.File, z)
+	shard, release, err := acquireShardRetrying(context.Background(), filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open %s: %w", filePath, err)
+	}
+	defer release()
+	side := scheme.Table
+	for tableY := yMin / side; tableY <= yMax/side; tableY++ {
+		for tableX := xMin / side; tableX <= xMax/side; tableX++ {
+			_, tableName, _ := f.shardLocation(tableX*side, tableY*side, z)
+			err := rangeInTable(shard.db, shard.dedup, scheme, tableName, tableX, tableY,
+				max(xMin, tableX*side), min(xMax, tableX*side+side-1),
+				max(yMin, tableY*side), min(yMax, tableY*side+side-1), fn)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rangeInTable reads the requested tiles held by a single table
+func rangeInTable(db *sql.DB, dedup bool, scheme ShardScheme, tableName string, tableX int64, tableY int64, xMin int64, xMax int64, yMin int64, yMax int64, fn func(x int64, y int64, data []byte) error) error {
+	if !validTableName.MatchString(tableName) {
+		return fmt.Errorf("invalid shard table %q", tableName)
+	}
+	inRange := func(id int64) (int64, int64, bool) {
+		x, y := scheme.tileOf(tableX, tableY, id)
+		return x, y, x >= xMin && x <= xMax && y >= yMin && y <= yMax
+	}
+	emit := func(rows *sql.Rows) error {
+		defer rows.Close()
+		for rows.Next() {
+			var id int64
+			var data []byte
+			var encoding sql.NullString
+			if err := rows.Scan(&id, &data, &encoding); err != nil {
+				return err
+			}
+			if x, y, ok := inRange(id); ok {
+				data, err := DecodeTile(data, encoding.String)
+				if err != nil {
+					return fmt.Errorf("decode row %d of %s: %w", id, tableName, err)
+				}
+				if err := fn(x, y, data); err != nil {
+					return err
+				}
+			}
+		}
+		return rows.Err()
+	}
+
+	encoding, err := encodingColumn(db, tableName)
+	if err != nil {
+		return err
+	}
+	columns := "ID, " + tileData(tableName, dedup) + ", " + encoding
+	count := (xMax - xMin + 1) * (yMax - yMin + 1)
+	if float64(count) > rangeScanThreshold*float64(scheme.tableIDs()) {
+		rows, err := db.Query("select " + columns + " from " + tableName)
+		if err != nil {
+			return ignoreMissingTable(err)
+		}
+		return emit(rows)
+	}
+
+	ids := make([]interface{}, 0, count)
+	for y := yMin; y <= yMax; y++ {
+		for x := xMin; x <= xMax; x++ {
+			ids = append(ids, x%scheme.Table+scheme.Table*(y%scheme.Table))
+		}
+	}
+	for start := 0; start < len(ids); start += rangeChunkSize {
+		chunk := ids[start:min(start+rangeChunkSize, len(ids))]
+		query := "select " + columns + " from " + tableName + " where ID in (?" + strings.Repeat(",?", len(chunk)-1) + ")"
+		rows, err := db.Query(query, chunk...)
+		if err != nil {
+			return ignoreMissingTable(err)
+		}
+		if err := emit(rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ignoreMissingTable treats a table that was never created as holding no tiles
+func ignoreMissingTable(err error) error {
+	if strings.Contains(err.Error(), "no such table") {
+		return nil
+	}
+	return err
+}
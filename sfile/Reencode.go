@@ -0,0 +1,498 @@
+package sfile
+
+import (
+	"SirServer/canvas"
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // register the gif decoder for stored tiles
+	"math"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// DefaultReencodeSample is how many tiles of each zoom a dry run of Reencode re-encodes
+const DefaultReencodeSample = 64
+
+// reencodeBatch is how many rows of a table are held in memory at once
+const reencodeBatch = 256
+
+// rasterFormats are the tile formats Reencode decodes, every other tile is kept as it is
+var rasterFormats = map[string]bool{"png": true, "jpg": true, "webp": true, "gif": true}
+
+// ReencodeOptions controls Reencode
+type ReencodeOptions struct {
+	Workers  int  // .s files re-encoded concurrently, one per CPU when not positive
+	DryRun   bool // only estimate the savings from a sample, without changing any file
+	Sample   int  // tiles of each zoom re-encoded by a dry run, DefaultReencodeSample when not positive
+	Progress func(ReencodeProgress)
+}
+
+// ReencodeProgress counts the .s files re-encoded so far
+type ReencodeProgress struct {
+	Files int `json:"files"`
+	Done  int `json:"done"`
+}
+
+// ReencodeCounts counts the tiles Reencode handled and their bytes
+type ReencodeCounts struct {
+	Tiles       int64 `json:"tiles"`
+	Reencoded   int64 `json:"reencoded"`
+	Skipped     int64 `json:"skipped"` // already in the target format
+	Kept        int64 `json:"kept"`    // not raster images, or transparent while the target has no alpha
+	Failed      int64 `json:"failed"`  // could not be decoded or encoded, kept as they are
+	BytesBefore int64 `json:"bytes_before"`
+	BytesAfter  int64 `json:"bytes_after"`
+	Saved       int64 `json:"saved"`
+}
+
+func (c *ReencodeCounts) add(other ReencodeCounts) {
+	c.Tiles += other.Tiles
+	c.Reencoded += other.Reencoded
+	c.Skipped += other.Skipped
+	c.Kept += other.Kept
+	c.Failed += other.Failed
+	c.BytesBefore += other.BytesBefore
+	c.BytesAfter += other.BytesAfter
+	c.Saved = c.BytesBefore - c.BytesAfter
+}
+
+// ReencodeZoom is what Reencode did, or estimates, for one zoom
+type ReencodeZoom struct {
+	Zoom int8 `json:"zoom"`
+	ReencodeCounts
+}
+
+// ReencodeReport is the result of Reencode. The bytes are those of the tiles,
+// the .s files only shrink once compacted.
+type ReencodeReport struct {
+	Format  string `json:"format"`
+	DryRun  bool   `json:"dry_run"`
+	Sampled int64  `json:"sampled,omitempty"` // tiles a dry run re-encoded, the counts are extrapolated from them
+	ReencodeCounts
+	Zooms []ReencodeZoom `json:"zooms"`
+}
+
+// Reencode re-encodes every raster tile of the repository in dir in the target
+// format, at quality when the format is lossy, and rewrites its row in place
+// with one transaction per table. Tiles already in the target format and tiles
+// that are not raster images, such as pbf, are left alone, as are transparent
+// tiles when the target has no alpha channel. Checksums recorded for the tiles
+// are recomputed and the format of repository.json is updated at the end. Files are re-encoded concurrently; when ctx ends the
+// tables re-encoded so far are kept and running it again picks up the rest.
+//
+// With DryRun nothing is written: a sample of the tiles of every zoom is
+// re-encoded and the savings of the whole repository are extrapolated from it.
+//
+// WebP is not a target, the image libraries SirServer builds with only decode it.
+func Reencode(ctx context.Context, dir string, target canvas.Format, quality int, opts ReencodeOptions) (ReencodeReport, error) {
+	encoder, err := newReencoder(target, quality)
+	if err != nil {
+		return ReencodeReport{}, err
+	}
+	report := ReencodeReport{Format: encoder.format, DryRun: opts.DryRun, Zooms: make([]ReencodeZoom, 0)}
+	subDirs, err := listSubDir(dir)
+	if err != nil {
+		return report, err
+	}
+	zoomFiles := make(map[int8][]string)
+	zooms := make([]int8, 0, len(subDirs))
+	totalFiles := 0
+	for _, sub := range subDirs {
+		files, err := listAllFile(sub)
+		if err != nil {
+			return report, err
+		}
+		if len(files) == 0 {
+			continue
+		}
+		zoom := subDirZoom(sub)
+		zooms = append(zooms, zoom)
+		zoomFiles[zoom] = files
+		totalFiles += len(files)
+	}
+
+	if opts.DryRun {
+		if opts.Sample <= 0 {
+			opts.Sample = DefaultReencodeSample
+		}
+		for _, zoom := range zooms {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+			estimate, sampled, err := encoder.estimateZoom(zoomFiles[zoom], opts.Sample)
+			if err != nil {
+				return report, err
+			}
+			report.Sampled += sampled
+			report.add(estimate)
+			report.Zooms = append(report.Zooms, ReencodeZoom{Zoom: zoom, ReencodeCounts: estimate})
+		}
+		return report, nil
+	}
+
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+	type shardJob struct {
+		zoom int8
+		file string
+	}
+	jobs := make(chan shardJob)
+	var mu sync.Mutex
+	var errs []error
+	zoomCounts := make(map[int8]*ReencodeCounts, len(zooms))
+	for _, zoom := range zooms {
+		zoomCounts[zoom] = &ReencodeCounts{}
+	}
+	progress := ReencodeProgress{Files: totalFiles}
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				counts, err := encoder.reencodeShard(ctx, job.file)
+				mu.Lock()
+				zoomCounts[job.zoom].add(counts)
+				if err != nil && ctx.Err() == nil {
+					errs = append(errs, fmt.Errorf("re-encoding %s: %w", job.file, err))
+				}
+				progress.Done++
+				if opts.Progress != nil {
+					opts.Progress(progress)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, zoom := range zooms {
+		for _, file := range zoomFiles[zoom] {
+			select {
+			case jobs <- shardJob{zoom: zoom, file: file}:
+			case <-ctx.Done():
+				break feed
+			}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, zoom := range zooms {
+		report.add(*zoomCounts[zoom])
+		report.Zooms = append(report.Zooms, ReencodeZoom{Zoom: zoom, ReencodeCounts: *zoomCounts[zoom]})
+	}
+	if report.Reencoded > 0 {
+		errs = append(errs, recordRepositoryFormats(dir))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return report, err
+	}
+	return report, ctx.Err()
+}
+
+// reencoder converts tiles to one format
+type reencoder struct {
+	target  canvas.Format
+	format  string // the tile format name of target, as tileFormat returns it
+	quality int
+}
+
+func newReencoder(target canvas.Format, quality int) (reencoder, error) {
+	switch target {
+	case canvas.FormatPNG:
+		return reencoder{target: target, format: "png", quality: quality}, nil
+	case canvas.FormatJPEG:
+		return reencoder{target: target, format: "jpg", quality: quality}, nil
+	case canvas.FormatWebP:
+		return reencoder{target: target, format: "webp", quality: quality}, nil
+	}
+	return reencoder{}, fmt.Errorf("tiles cannot be re-encoded to %q, only to png, jpeg or webp", target)
+}
+
+// convert re-encodes one tile and adds it to counts, returning the blob to store
+// and whether it differs from data
+func (r reencoder) convert(data []byte, counts *ReencodeCounts) ([]byte, bool) {
+	counts.Tiles++
+	counts.BytesBefore += int64(len(data))
+	out, changed := data, false
+	switch format := tileFormat(data); {
+	case format == r.format:
+		counts.Skipped++
+	case !rasterFormats[format]:
+		counts.Kept++
+	default:
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			counts.Failed++
+			break
+		}
+		if opaque, ok := img.(interface{ Opaque() bool }); r.target == canvas.FormatJPEG && (!ok || !opaque.Opaque()) {
+			// JPEG would turn the transparent parts black
+			counts.Kept++
+			break
+		}
+		buf, err := canvas.EncodeImage(img, r.target, r.quality)
+		if err != nil {
+			counts.Failed++
+			break
+		}
+		out, changed = buf.Bytes(), true
+		counts.Reencoded++
+	}
+	counts.BytesAfter += int64(len(out))
+	counts.Saved = counts.BytesBefore - counts.BytesAfter
+	return out, changed
+}
+
+// reencodeShard re-encodes the tiles of one .s file, one transaction per table
+func (r reencoder) reencodeShard(ctx context.Context, filePath string) (ReencodeCounts, error) {
+	var counts ReencodeCounts
+	db, done, err := openShardForWrite(filePath)
+	if err != nil {
+		return counts, err
+	}
+	defer done()
+	tableNames, err := listTables(db)
+	if err != nil {
+		return counts, err
+	}
+	for _, tableName := range tableNames {
+		if err := ctx.Err(); err != nil {
+			return counts, err
+		}
+		if !validTableName.MatchString(tableName) {
+			continue
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return counts, err
+		}
+		tableCounts, err := r.reencodeTable(tx, tableName)
+		if err != nil {
+			_ = tx.Rollback()
+			return counts, fmt.Errorf("table %s: %w", tableName, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return counts, err
+		}
+		counts.add(tableCounts)
+	}
+	return counts, nil
+}
+
+// reencodeTable rewrites the re-encoded tiles of a table in tx, batch by batch so
+// only a part of the table is held in memory, and records the format of the file
+func (r reencoder) reencodeTable(tx *sql.Tx, tableName string) (ReencodeCounts, error) {
+	var counts ReencodeCounts
+	dedup, err := prepareShardWrite(tx)
+	if err != nil {
+		return counts, err
+	}
+	if err := createShardTable(tx, tableName, dedup); err != nil {
+		return counts, err
+	}
+	// a table recording checksums keeps them for the rewritten tiles even when
+	// checksum writes are off, and rewritten tiles keep their write time
+	var hasChecksum, hasWritten int
+	err = tx.QueryRow("select count(*) filter (where name = 'Checksum'), count(*) filter (where name = 'Written') from pragma_table_info(?)", tableName).Scan(&hasChecksum, &hasWritten)
+	if err != nil {
+		return counts, err
+	}
+	keepChecksum := hasChecksum > 0 && !checksumWrites.Load()
+	written := "NULL"
+	if hasWritten > 0 {
+		written = "Written"
+	}
+	encoding, err := encodingColumn(tx, tableName)
+	if err != nil {
+		return counts, err
+	}
+	type tileRow struct {
+		id       int64
+		x        int64
+		y        int64
+		data     []byte
+		written  sql.NullInt64
+		encoding sql.NullString
+	}
+	// the formats of every tile of the table, those of the other tables are sampled
+	formats := make(map[string]bool)
+	lastID := int64(math.MinInt64)
+	for {
+		rows, err := tx.Query("select ID, X, Y, "+tileData(tableName, dedup)+", "+written+", "+encoding+" from "+tableName+" where ID > ? order by ID limit ?", lastID, reencodeBatch)
+		if err != nil {
+			return counts, err
+		}
+		batch := make([]tileRow, 0, reencodeBatch)
+		for rows.Next() {
+			var row tileRow
+			if err := rows.Scan(&row.id, &row.x, &row.y, &row.data, &row.written, &row.encoding); err != nil {
+				rows.Close()
+				return counts, err
+			}
+			batch = append(batch, row)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return counts, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+		for _, row := range batch {
+			if len(row.data) == 0 {
+				continue
+			}
+			if row.encoding.String != "" {
+				// only text-like tiles are stored compressed, there is no raster to reencode
+				if data, err := DecodeTile(row.data, row.encoding.String); err == nil {
+					formats[tileFormat(data)] = true
+				}
+				continue
+			}
+			data, changed := r.convert(row.data, &counts)
+			formats[tileFormat(data)] = true
+			if !changed {
+				continue
+			}
+			if _, err := insertTile(tx, "insert or replace", tableName, row.id, row.x, row.y, data, dedup); err != nil {
+				return counts, err
+			}
+			if keepChecksum {
+				if _, err := tx.Exec("update "+tableName+" set Checksum = ? where ID = ?", tileChecksum(data), row.id); err != nil {
+					return counts, err
+				}
+			}
+			if row.written.Valid {
+				if err := stampTile(tx, tableName, row.id, time.Unix(row.written.Int64, 0)); err != nil {
+					return counts, err
+				}
+			}
+		}
+		lastID = batch[len(batch)-1].id
+	}
+	if counts.Reencoded == 0 {
+		return counts, nil
+	}
+	if dedup {
+		tableNames, err := listTileTables(tx)
+		if err != nil {
+			return counts, err
+		}
+		if err := deleteUnreferencedBlobs(tx, tableNames); err != nil {
+			return counts, err
+		}
+	}
+	// the format recorded for the file is found again, it is mixed until the
+	// last table holding tiles of the old format is re-encoded
+	current, err := shardFormat(tx)
+	if err != nil || current == "" {
+		return counts, err
+	}
+	if _, err := tx.Exec("delete from meta where key = 'format'"); err != nil {
+		return counts, err
+	}
+	return counts, recordShardFormat(tx, dedup, formats)
+}
+
+// estimateZoom re-encodes up to sample tiles spread over the files of one zoom
+// and extrapolates the counts of every tile of the zoom from them. It returns the
+// estimate and how many tiles were sampled.
+func (r reencoder) estimateZoom(files []string, sample int) (ReencodeCounts, int64, error) {
+	var total, sampled ReencodeCounts
+	// the sample is spread over a few files so one odd file does not decide it,
+	// the totals are counted over all of them
+	picked := min(len(files), formatSampleFiles)
+	perFile := max(1, (sample+picked-1)/picked)
+	sampleFiles := make(map[int]bool, picked)
+	for i := 0; i < picked; i++ {
+		sampleFiles[i*len(files)/picked] = true
+	}
+	for i, file := range files {
+		shard, release, err := acquireShard(file)
+		if err != nil {
+			return total, 0, fmt.Errorf("reading %s: %w", file, err)
+		}
+		tableNames, err := listTables(shard.db)
+		if err != nil {
+			release()
+			return total, 0, fmt.Errorf("reading %s: %w", file, err)
+		}
+		remaining := 0
+		if sampleFiles[i] {
+			remaining = min(perFile, sample-int(sampled.Tiles))
+		}
+		for _, tableName := range tableNames {
+			if !validTableName.MatchString(tableName) {
+				continue
+			}
+			var tiles, size int64
+			err := shard.db.QueryRow("select count(*), coalesce(sum(length("+tileData(tableName, shard.dedup)+")), 0) from "+tableName).Scan(&tiles, &size)
+			if err != nil {
+				release()
+				return total, 0, fmt.Errorf("reading %s: %w", file, err)
+			}
+			total.Tiles += tiles
+			total.BytesBefore += size
+			if remaining > 0 {
+				n, err := sampleTableFormats(shard.db, tableName, shard.dedup, remaining, func(format string, data []byte) {
+					r.convert(data, &sampled)
+				})
+				if err != nil {
+					release()
+					return total, 0, fmt.Errorf("reading %s: %w", file, err)
+				}
+				remaining -= n
+			}
+		}
+		release()
+	}
+	if sampled.Tiles == 0 {
+		total.BytesAfter = total.BytesBefore
+		total.Kept = total.Tiles
+		return total, 0, nil
+	}
+	scale := func(n int64) int64 {
+		return int64(math.Round(float64(n) * float64(total.Tiles) / float64(sampled.Tiles)))
+	}
+	total.Reencoded = scale(sampled.Reencoded)
+	total.Skipped = scale(sampled.Skipped)
+	total.Kept = scale(sampled.Kept)
+	total.Failed = scale(sampled.Failed)
+	total.BytesAfter = total.BytesBefore
+	if sampled.BytesBefore > 0 {
+		total.BytesAfter = int64(math.Round(float64(total.BytesBefore) * float64(sampled.BytesAfter) / float64(sampled.BytesBefore)))
+	}
+	total.Saved = total.BytesBefore - total.BytesAfter
+	return total, sampled.Tiles, nil
+}
+
+// recordRepositoryFormats updates the formats and the size recorded in
+// repository.json after the tiles changed format. Repositories without a
+// repository.json are left alone.
+func recordRepositoryFormats(dir string) error {
+	return updateRepositoryInfo(dir, func(repo *Repository) error {
+		subDirs, err := listSubDir(dir)
+		if err != nil {
+			return err
+		}
+		counts := make(formatCounts)
+		sizes := make(tileSizes)
+		for _, sub := range subDirs {
+			files, err := listAllFile(sub)
+			if err != nil {
+				return err
+			}
+			sampleZoomFormats(int(subDirZoom(sub)), files, counts, sizes)
+		}
+		repo.ZoomFormats, repo.Format, repo.MixedFormats = counts.summarize()
+		_, repo.Size, err = shardZooms(dir)
+		return err
+	})
+}
@@ -0,0 +1,274 @@
+package sfile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PullOptions describes which tiles of a remote SirServer repository are replicated
+type PullOptions struct {
+	Remote   string      // base URL of the remote SirServer, e.g. http://office:8080
+	Name     string      // repository name on the remote
+	Token    string      // optional bearer token sent to the remote, never logged
+	MinZoom  int8        // lowest zoom to pull
+	MaxZoom  int8        // highest zoom to pull
+	BBox     *[4]float64 // optional lng/lat bounds minX, minY, maxX, maxY
+	Since    time.Time   // when not zero, only the tiles the remote wrote since then, replacing local ones
+	Workers  int         // number of concurrent downloads, 4 when not positive
+	Progress func(PullProgress)
+	Client   *http.Client // http.DefaultClient with a timeout when nil
+}
+
+// PullProgress counts the tiles handled by a pull so far
+type PullProgress struct {
+	Zoom       int8  `json:"zoom"`
+	Listed     int64 `json:"listed"`
+	Skipped    int64 `json:"skipped"`
+	Downloaded int64 `json:"downloaded"`
+	Failed     int64 `json:"failed"`
+}
+
+// remoteCoverage is the envelope returned by the coverage endpoint of a SirServer
+type remoteCoverage struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    struct {
+		Zoom  int8       `json:"zoom"`
+		Tiles [][2]int64 `json:"tiles"`
+	} `json:"data"`
+}
+
+// Pull copies tiles the remote repository has and dir is missing. Tiles already
+// stored locally are skipped, so an interrupted pull resumes where it stopped
+// when run again. With opts.Since the remote lists only the tiles it wrote since
+// then and those are copied whether stored locally or not. Individual download
+// failures are counted, not fatal.
+func Pull(ctx context.Context, dir string, opts PullOptions) (PullProgress, error) {
+	if opts.Remote == "" || opts.Name == "" {
+		return PullProgress{}, errors.New("remote and name are required")
+	}
+	if opts.MinZoom < 0 || opts.MaxZoom > MaxTileZoom || opts.MinZoom > opts.MaxZoom {
+		return PullProgress{}, fmt.Errorf("invalid zoom range %d..%d", opts.MinZoom, opts.MaxZoom)
+	}
+	if IsArchive(dir) {
+		return PullProgress{}, fmt.Errorf("%w: %s", ErrReadOnlyBackend, dir)
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 4
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 60 * time.Second}
+	}
+	repo, err := openRepository(dir)
+	if err != nil {
+		return PullProgress{}, err
+	}
+	local := *repo
+
+	var total PullProgress
+	for z := opts.MinZoom; z <= opts.MaxZoom; z++ {
+		progress, err := pullZoom(ctx, local, z, opts)
+		total.Zoom = z
+		total.Listed += progress.Listed
+		total.Skipped += progress.Skipped
+		total.Downloaded += progress.Downloaded
+		total.Failed += progress.Failed
+		if opts.Progress != nil {
+			opts.Progress(total)
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// pullZoom replicates the missing tiles of a single zoom level
+func pullZoom(ctx context.Context, local SRepository, z int8, opts PullOptions) (PullProgress, error) {
+	progress := PullProgress{Zoom: z}
+	tiles, err := fetchCoverage(ctx, z, opts)
+	if err != nil {
+		return progress, err
+	}
+	progress.Listed = int64(len(tiles))
+
+	// tiles changed since opts.Since replace the local ones, nothing is skipped
+	present := make(map[[2]int64]bool)
+	if opts.Since.IsZero() {
+		err = local.ListTiles(z, func(x int64, y int64) error {
+			present[[2]int64{x, y}] = true
+			return nil
+		})
+		if err != nil {
+			return progress, err
+		}
+	}
+
+	jobs := make(chan [2]int64)
+	var downloaded, failed int64
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tile := range jobs {
+				data, err := fetchRemoteTile(ctx, z, tile[0], tile[1], opts)
+				if err == nil {
+					err = local.WriteXYZ(tile[0], tile[1], z, data)
+				}
+				if err != nil {
+					if ctx.Err() == nil {
+						log.Printf("Pull of %d/%d/%d from %s failed: %v", z, tile[0], tile[1], redactURL(opts.Remote), err)
+						RecordError("pull", fmt.Errorf("tile %d/%d/%d from %s: %w", z, tile[0], tile[1], redactURL(opts.Remote), err))
+					}
+					atomic.AddInt64(&failed, 1)
+					continue
+				}
+				atomic.AddInt64(&downloaded, 1)
+			}
+		}()
+	}
+
+	for _, tile := range tiles {
+		if present[tile] {
+			progress.Skipped++
+			continue
+		}
+		select {
+		case jobs <- tile:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	progress.Downloaded = downloaded
+	progress.Failed = failed
+	return progress, ctx.Err()
+}
+
+// remoteURL joins the remote base URL, a path below it and a query
+func remoteURL(base string, path string, query url.Values) (string, error) {
+	u, err := url.Parse(strings.TrimRight(base, "/") + path)
+	if err != nil {
+		return "", fmt.Errorf("invalid remote %q", redactURL(base))
+	}
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+	return u.String(), nil
+}
+
+// remoteGet performs an authenticated GET against the remote
+func remoteGet(ctx context.Context, target string, opts PullOptions) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Token != "" {
+		request.Header.Set("Authorization", "Bearer "+opts.Token)
+	}
+	response, err := opts.Client.Do(request)
+	if err != nil {
+		// url errors carry the full URL, which may contain credentials
+		var urlError *url.Error
+		if errors.As(err, &urlError) {
+			return nil, fmt.Errorf("%s %s: %w", urlError.Op, redactURL(urlError.URL), urlError.Err)
+		}
+		return nil, err
+	}
+	return response, nil
+}
+
+// fetchCoverage lists the tiles the remote repository holds at zoom z, those
+// written since opts.Since when it is not zero
+func fetchCoverage(ctx context.Context, z int8, opts PullOptions) ([][2]int64, error) {
+	query := url.Values{"z": {strconv.Itoa(int(z))}}
+	if opts.BBox != nil {
+		bbox := make([]string, 0, 4)
+		for _, v := range opts.BBox {
+			bbox = append(bbox, strconv.FormatFloat(v, 'f', -1, 64))
+		}
+		query.Set("bbox", strings.Join(bbox, ","))
+	}
+	if !opts.Since.IsZero() {
+		query.Set("since", strconv.FormatInt(opts.Since.Unix(), 10))
+	}
+	target, err := remoteURL(opts.Remote, "/api/v1/repositories/"+escapeName(opts.Name)+"/coverage", query)
+	if err != nil {
+		return nil, err
+	}
+	response, err := remoteGet(ctx, target, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("coverage of %s at zoom %d: remote returned %s", opts.Name, z, response.Status)
+	}
+	var coverage remoteCoverage
+	if err := json.NewDecoder(response.Body).Decode(&coverage); err != nil {
+		return nil, fmt.Errorf("coverage of %s at zoom %d: %w", opts.Name, z, err)
+	}
+	if coverage.Code != 0 {
+		return nil, fmt.Errorf("coverage of %s at zoom %d: %s", opts.Name, z, coverage.Message)
+	}
+	return coverage.Data.Tiles, nil
+}
+
+// fetchRemoteTile downloads the raw blob of a single tile
+func fetchRemoteTile(ctx context.Context, z int8, x int64, y int64, opts PullOptions) ([]byte, error) {
+	target, err := remoteURL(opts.Remote, fmt.Sprintf("/api/v1/raw/%s/%d/%d/%d", escapeName(opts.Name), z, x, y), nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := remoteGet(ctx, target, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("remote returned %s", response.Status)
+	}
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("remote returned an empty tile")
+	}
+	return data, nil
+}
+
+// escapeName percent-encodes every element of a slash separated repository name
+func escapeName(name string) string {
+	elements := strings.Split(name, "/")
+	for i, element := range elements {
+		elements[i] = url.PathEscape(element)
+	}
+	return strings.Join(elements, "/")
+}
+
+// redactURL strips user info and the query from a URL so it can be logged
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "<invalid url>"
+	}
+	u.User = nil
+	u.RawQuery = ""
+	return u.String()
+}
@@ -1,99 +1,418 @@
 package sfile
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"math"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
-	"regexp"
+	"reflect"
 	"strings"
+	"sync"
+	"time"
 )
 
-type Box struct {
-	minx float64
-	miny float64
-	maxx float64
-	maxy float64
-}
+type Repository struct {
+	Name        string     `json:"name"`
+	Lng         float64    `json:"lng"`
+	Lat         float64    `json:"lat"`
+	Zoom        int        `json:"zoom"`
+	Size        float64    `json:"size"`
+	Url         string     `json:"url"`
+	Pared       bool       `json:"pared"`
+	Bounds      [4]float64 `json:"bounds"` // minLng, minLat, maxLng, maxLat, all zero when unknown
+	MinZoom     int        `json:"min_zoom"`
+	MaxZoom     int        `json:"max_zoom"`
+	Format      string     `json:"format,omitempty"` // png, jpg, webp, gif, pbf or json
+	Title       string     `json:"title,omitempty"`  // human readable name, e.g. from MBTiles metadata
+	Attribution string     `json:"attribution,omitempty"`
+	Description string     `json:"description,omitempty"`
+	TileSize    int        `json:"tile_size"` // width and height of the tiles in pixels, DefaultTileSize unless detected or set
+
+	// ZoomFormats is the format of most tiles of each zoom. MixedFormats is set when
+	// the repository holds tiles of more than one format, such as JPEG imagery with
+	// PNG overlays, so clients cannot rely on Format for every tile.
+	ZoomFormats  map[int]string `json:"zoom_formats,omitempty"`
+	MixedFormats bool           `json:"mixed_formats,omitempty"`
+
+	// Upstream is an XYZ URL template with {z}, {x} and {y}; tiles missing locally
+	// are fetched from it and stored, see OpenTileSource
+	Upstream        string            `json:"upstream,omitempty"`
+	UpstreamHeaders map[string]string `json:"upstream_headers,omitempty"`  // sent with every upstream request
+	UpstreamMaxZoom *int              `json:"upstream_max_zoom,omitempty"` // highest zoom fetched, no limit when unset
+
+	// Shard is how the tiles are spread over .s files and tables, DefaultShardScheme
+	// when unset. It is chosen when the repository is created and never changes.
+	Shard *ShardScheme `json:"shard,omitempty"`
+
+	// Grid is the tiling scheme the tiles are cut in, GridMercator when unset
+	Grid TileGrid `json:"grid,omitempty"`
+
+	// Layout is where the .s files lie, LayoutNested or LayoutFlat, see Layout.go.
+	// The layout of the directory is detected when unset.
+	Layout string `json:"layout,omitempty"`
+
+	// TTLSeconds is how long a tile is served after it was written, for
+	// repositories caching live data such as weather radar. Expired tiles are
+	// misses, refetched from the upstream when there is one, and swept away in
+	// the background. Tiles never expire when unset.
+	TTLSeconds int `json:"ttl_seconds,omitempty"`
+
+	// Compress stores the text-like tiles written from now on gzipped, vector
+	// tiles, UTFGrids and JSON, see compressTile. Tiles stored before are kept as
+	// they are, and raster tiles are never compressed.
+	Compress bool `json:"compress,omitempty"`
+
+	// Temporal keeps the earlier versions of the tiles written instead of
+	// overwriting them, served for a time with GetXYZAt and pruned as it says,
+	// see Temporal.go. Tiles are simply overwritten when unset.
+	Temporal *TemporalSettings `json:"temporal,omitempty"`
+
+	// Watermark is drawn over the raster tiles served from the repository, see
+	// Watermark.go. Tiles are served as stored when unset.
+	Watermark *WatermarkSettings `json:"watermark,omitempty"`
+
+	// AttributionOverlay burns the attribution onto the raster tiles served from
+	// the repository, see AttributionOverlay.go. Tiles are served as stored when
+	// unset, unless the server burns attributions into every repository.
+	AttributionOverlay *AttributionOverlay `json:"attribution_overlay,omitempty"`
 
-func NewBox() Box {
-	return Box{math.MaxFloat64, math.MaxFloat64, -math.MaxFloat64, -math.MaxFloat64}
+	// extra holds keys of repository.json this version does not know about, so
+	// they survive when the file is written back
+	extra map[string]json.RawMessage
 }
-func (b *Box) extend(b2 Box) {
-	b.minx = min(b.minx, b2.minx)
-	b.miny = min(b.miny, b2.miny)
-	b.maxx = max(b.maxx, b2.maxx)
-	b.maxy = max(b.maxy, b2.maxy)
+
+// repositoryFields is Repository without its JSON methods
+type repositoryFields Repository
+
+// HasBounds reports whether the repository extent is known
+func (r Repository) HasBounds() bool {
+	return r.Bounds != [4]float64{}
 }
-func (b *Box) Set(minx float64, miny float64, maxx float64, maxy float64) {
-	b.minx = minx
-	b.miny = miny
-	b.maxx = maxx
-	b.maxy = maxy
+
+// UnmarshalJSON decodes a repository, keeping unknown keys aside
+func (r *Repository) UnmarshalJSON(data []byte) error {
+	var fields repositoryFields
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	for _, key := range repositoryKeys() {
+		delete(all, key)
+	}
+	*r = Repository(fields)
+	if r.TileSize <= 0 {
+		// written before tile sizes were recorded
+		r.TileSize = DefaultTileSize
+	}
+	if len(all) > 0 {
+		r.extra = all
+	}
+	return nil
 }
-func (b *Box) Empty() {
-	b.minx = math.MaxFloat64
-	b.miny = math.MaxFloat64
-	b.maxx = -math.MaxFloat64
-	b.maxy = -math.MaxFloat64
+
+// MarshalJSON encodes a repository together with the unknown keys it was read with
+func (r Repository) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(repositoryFields(r))
+	if err != nil || len(r.extra) == 0 {
+		return data, err
+	}
+	all := make(map[string]json.RawMessage, len(r.extra)+16)
+	for key, value := range r.extra {
+		all[key] = value
+	}
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	return json.Marshal(all)
 }
-func (b *Box) IsEmpty() bool {
-	return b.minx == math.MaxFloat64 && b.miny == math.MaxFloat64 && b.maxx == -math.MaxFloat64 && b.maxy == -math.MaxFloat64
+
+// repositoryKeys returns the JSON keys of the known Repository fields
+func repositoryKeys() []string {
+	keys := make([]string, 0)
+	fields := reflect.TypeOf(repositoryFields{})
+	for i := 0; i < fields.NumField(); i++ {
+		if tag := fields.Field(i).Tag.Get("json"); tag != "" && tag != "-" {
+			keys = append(keys, strings.Split(tag, ",")[0])
+		}
+	}
+	return keys
 }
 
-type Repository struct {
-	Name  string  `json:"name"`
-	Lng   float64 `json:"lng"`
-	Lat   float64 `json:"lat"`
-	Zoom  int     `json:"zoom"`
-	Size  float64 `json:"size"`
-	Url   string  `json:"url"`
-	Pared bool    `json:"pared"`
+// ScanOptions controls how repositories are discovered below the repository root
+type ScanOptions struct {
+	// Depth is how many directory levels are searched. With a depth of 1 every
+	// directory of the root is a repository. With a larger depth only directories
+	// that look like repositories (holding repository.json or A..Z shard folders)
+	// are returned, named by their slash joined path relative to the root such as
+	// "2023/cityA"; other directories are descended into until Depth is reached.
+	Depth int
+	// FollowSymlinks makes symlinked directories count as repositories or be
+	// descended into. Links pointing outside the root are followed with a warning.
+	FollowSymlinks bool
 }
 
+// DefaultScanOptions lists the directories directly below the root, following symlinks
+var DefaultScanOptions = ScanOptions{Depth: 1, FollowSymlinks: true}
+
 // ListRepositories returns a list of available repositories
 func ListRepositories(baseDir string) ([]Repository, error) {
+	return ScanRepositories(baseDir, DefaultScanOptions)
+}
+
+// ScanRepositories returns the repositories found below baseDir according to opts.
+// The walk never descends into a directory already identified as a repository.
+// Repositories without a repository.json are returned unanalysed and queued for
+// background analysis.
+func ScanRepositories(baseDir string, opts ScanOptions) ([]Repository, error) {
+	if root, ok := s3RootFor(baseDir); ok {
+		return root.repositories(context.Background())
+	}
 	repositories := make([]Repository, 0)
 	dirs, error := os.ReadDir(baseDir)
 	if error != nil {
 		return make([]Repository, 0), error
 	}
+	rootReal, err := filepath.EvalSymlinks(baseDir)
+	if err != nil {
+		rootReal = baseDir
+	}
 
 	for _, dir := range dirs {
-		if dir.IsDir() {
-			repo, err := readRepositoryInfo(baseDir, dir)
-			if err != nil {
-				repo, err = analysisRepository(baseDir, dir)
-				if err != nil {
-					repositories = append(repositories, Repository{
-						Name:  dir.Name(),
-						Lng:   113.,
-						Lat:   40.,
-						Size:  0,
-						Url:   dir.Name(),
-						Pared: false,
-						Zoom:  10,
-					})
-				} else {
-					repositories = append(repositories, repo)
-				}
-			} else {
-				repositories = append(repositories, repo)
-			}
+		if archived, ok := archiveRepositories(baseDir, dir.Name(), dir, opts); ok {
+			repositories = append(repositories, archived...)
+			continue
+		}
+		realPath, ok := resolveDirEntry(baseDir, rootReal, dir, opts, []string{rootReal})
+		if !ok {
+			continue
 		}
+		if opts.Depth <= 1 {
+			repositories = append(repositories, listedRepository(baseDir, dir.Name()))
+			continue
+		}
+		repositories = append(repositories, findRepositories(baseDir, rootReal, dir.Name(), opts, opts.Depth-1, []string{rootReal, realPath})...)
 	}
 	return repositories, nil
 }
 
-func readRepositoryInfo(baseDir string, entry os.DirEntry) (Repository, error) {
+// findRepositories returns name itself when it is a repository, otherwise the
+// repositories found below it within depth more levels. ancestors holds the real
+// paths of the directories walked so far, so a symlink pointing back up is skipped.
+func findRepositories(baseDir string, rootReal string, name string, opts ScanOptions, depth int, ancestors []string) []Repository {
+	fullPath := filepath.Join(baseDir, filepath.FromSlash(name))
+	if IsRepositoryDir(fullPath) {
+		return []Repository{listedRepository(baseDir, name)}
+	}
+	if depth <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(fullPath)
+	if err != nil {
+		return nil
+	}
+	repositories := make([]Repository, 0)
+	for _, entry := range entries {
+		if archived, ok := archiveRepositories(baseDir, name+"/"+entry.Name(), entry, opts); ok {
+			repositories = append(repositories, archived...)
+			continue
+		}
+		realPath, ok := resolveDirEntry(fullPath, rootReal, entry, opts, ancestors)
+		if !ok {
+			continue
+		}
+		repositories = append(repositories, findRepositories(baseDir, rootReal, name+"/"+entry.Name(), opts, depth-1, append(ancestors, realPath))...)
+	}
+	return repositories
+}
+
+// resolveDirEntry decides whether a directory entry takes part in the scan and returns
+// its real path. Hidden entries hold in-progress restores and other server internals
+// and are always skipped, symlinks are resolved according to opts.
+func resolveDirEntry(parent string, rootReal string, entry os.DirEntry, opts ScanOptions, ancestors []string) (string, bool) {
+	if strings.HasPrefix(entry.Name(), ".") {
+		return "", false
+	}
+	fullPath := filepath.Join(parent, entry.Name())
+	if entry.IsDir() {
+		return fullPath, true
+	}
+	if entry.Type()&os.ModeSymlink == 0 || !opts.FollowSymlinks {
+		return "", false
+	}
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		warnOnce(fullPath, "Skipping broken symlink %s: %v", fullPath, err)
+		return "", false
+	}
+	if !info.IsDir() {
+		return "", false
+	}
+	realPath, err := filepath.EvalSymlinks(fullPath)
+	if err != nil {
+		warnOnce(fullPath, "Skipping unresolvable symlink %s: %v", fullPath, err)
+		return "", false
+	}
+	for _, ancestor := range ancestors {
+		if realPath == ancestor {
+			warnOnce(fullPath, "Skipping symlink loop %s -> %s", fullPath, realPath)
+			return "", false
+		}
+	}
+	if rel, err := filepath.Rel(rootReal, realPath); err != nil || !filepath.IsLocal(rel) {
+		warnOnce(fullPath, "Warning: symlink %s points outside the repository root to %s", fullPath, realPath)
+	}
+	return realPath, true
+}
+
+// archiveRepositories returns the repositories served from the single file entry
+// named name: a .pmtiles archive, each tile layer of a .gpkg file as name/layer,
+// or an .mbtiles file of the root as name without its extension. ok is false when
+// entry is not such a file.
+func archiveRepositories(baseDir string, name string, entry os.DirEntry, opts ScanOptions) ([]Repository, bool) {
+	if strings.HasPrefix(entry.Name(), ".") || entry.IsDir() {
+		return nil, false
+	}
+	if entry.Type()&os.ModeSymlink != 0 && !opts.FollowSymlinks {
+		return nil, false
+	}
+	fullPath := filepath.Join(baseDir, filepath.FromSlash(name))
+	if IsPMTiles(fullPath) {
+		return []Repository{LoadRepository(baseDir, name)}, true
+	}
+	if !strings.Contains(name, "/") && strings.HasSuffix(name, mbtilesExt) && IsMBTiles(fullPath) {
+		trimmed := strings.TrimSuffix(name, mbtilesExt)
+		if _, ok := mbtilesFile(filepath.Join(baseDir, trimmed)); !ok {
+			warnOnce(fullPath, "Skipping MBTiles %s, %s is taken by another entry", fullPath, trimmed)
+			return nil, true
+		}
+		return []Repository{LoadRepository(baseDir, trimmed)}, true
+	}
+	if !IsGeoPackage(fullPath) {
+		return nil, false
+	}
+	pkg, err := openCachedGeoPackage(fullPath)
+	if err != nil {
+		warnOnce(fullPath, "Skipping GeoPackage %s: %v", fullPath, err)
+		return nil, true
+	}
+	repositories := make([]Repository, 0)
+	for _, layer := range pkg.Layers() {
+		repositories = append(repositories, LoadRepository(baseDir, name+"/"+layer))
+	}
+	return repositories, true
+}
+
+// warned remembers which paths were already reported by warnOnce
+var warned sync.Map
+
+// warnOnce logs a message the first time it is raised for key, so repeated
+// listings do not flood the log with the same warning
+func warnOnce(key string, format string, args ...interface{}) {
+	if _, loaded := warned.LoadOrStore(key, true); !loaded {
+		log.Printf(format, args...)
+	}
+}
+
+// IsRepositoryDir reports whether dir holds a repository.json or zoom directories
+func IsRepositoryDir(dir string) bool {
+	if info, err := os.Stat(filepath.Join(dir, "repository.json")); err == nil && info.Mode().IsRegular() {
+		return true
+	}
+	subdirs, err := listSubDir(dir)
+	return err == nil && len(subdirs) > 0
+}
+
+// LoadRepository returns the metadata of the repository named name under baseDir,
+// analysing it when there is no repository.json yet. The analysis is kept in
+// memory and only written to repository.json when SetWriteAnalysis is on. Repositories of a registered
+// backend, such as .pmtiles archives, describe themselves. Repositories that cannot
+// be analysed are returned with default values and Pared set to false.
+func LoadRepository(baseDir string, name string) Repository {
+	if root, ok := s3RootFor(baseDir); ok {
+		return root.metadata(context.Background(), name)
+	}
+	if backend, ok := tileBackendFor(filepath.Join(baseDir, filepath.FromSlash(name))); ok {
+		source, err := backend.Open(baseDir, name)
+		if err != nil {
+			RecordError(backend.Name, err)
+			return defaultRepository(name)
+		}
+		defer source.Close()
+		return source.Metadata()
+	}
+	dir := filepath.Join(baseDir, filepath.FromSlash(name))
+	repo, err := readRepositoryInfo(baseDir, name)
+	if err == nil {
+		repo.Size = currentSize(dir, repo.Size)
+		return repo
+	}
+	repo, err = analysedRepository(baseDir, name, err)
+	if err == nil {
+		repo.Size = currentSize(dir, repo.Size)
+		return repo
+	}
+	RecordError("sfile", fmt.Errorf("analysing repository %s: %w", name, err))
+	return defaultRepository(name)
+}
+
+// Public returns the repository as shown to clients. Upstream headers usually
+// carry credentials and are dropped, and so are the user info and query of the
+// upstream URL.
+func (r Repository) Public() Repository {
+	if u, err := url.Parse(r.Upstream); err == nil && r.Upstream != "" {
+		r.Upstream = u.Scheme + "://" + u.Host + u.Path
+	}
+	r.UpstreamHeaders = nil
+	r.Grid = r.TileGrid()
+	return r
+}
+
+// TileGrid returns the grid of the repository, GridMercator when it declares
+// none or one this version does not know
+func (r Repository) TileGrid() TileGrid {
+	grid, err := ParseTileGrid(string(r.Grid))
+	if err != nil {
+		return GridMercator
+	}
+	return grid
+}
+
+// TTL returns how long the tiles of the repository are served after they were
+// written, 0 when they never expire
+func (r Repository) TTL() time.Duration {
+	return time.Duration(max(r.TTLSeconds, 0)) * time.Second
+}
+
+// defaultRepository is the metadata reported for a repository that has not been analysed
+func defaultRepository(name string) Repository {
+	return Repository{
+		Name:     name,
+		Lng:      113.,
+		Lat:      40.,
+		Size:     0,
+		Url:      name,
+		Pared:    false,
+		Zoom:     10,
+		TileSize: DefaultTileSize,
+	}
+}
+
+func readRepositoryInfo(baseDir string, name string) (Repository, error) {
 	var repo Repository
 
 	// Construct full path correctly
-	fullPath := filepath.Join(baseDir, entry.Name(), "repository.json")
+	fullPath := filepath.Join(baseDir, filepath.FromSlash(name), "repository.json")
 
 	// Open the file
 	file, err := os.Open(fullPath)
@@ -110,74 +429,161 @@ func readRepositoryInfo(baseDir string, entry os.DirEntry) (Repository, error) {
 
 	return repo, nil
 }
-func analysisRepository(baseDir string, entry os.DirEntry) (Repository, error) {
+
+// scanRepository reads every .s file of a repository for its extent, size, zoom
+// range and tile format. progress, when not nil, is called as files are processed.
+func scanRepository(baseDir string, name string, progress func(files int, totalFiles int, bytes float64)) (Repository, error) {
 	// Create a default repository with the directory name
-	repo := Repository{
-		Name:  entry.Name(),
-		Lng:   113.0,
-		Lat:   40.0,
-		Size:  0,
-		Url:   entry.Name(),
-		Pared: false,
-		Zoom:  10,
+	repo := defaultRepository(name)
+	if previous, err := readRepositoryInfo(baseDir, name); err == nil {
+		// the layout of the .s files cannot be told from the files themselves
+		repo.Shard = previous.Shard
+		repo.Grid = previous.Grid
+		repo.TTLSeconds = previous.TTLSeconds
+		repo.Watermark = previous.Watermark
+		repo.AttributionOverlay = previous.AttributionOverlay
 	}
 
-	box := NewBox()
-	subdirs, err := listSubDir(filepath.Join(baseDir, entry.Name()))
+	dir := filepath.Join(baseDir, filepath.FromSlash(name))
+	repo.Layout = repositoryLayout(dir)
+	if warning := layoutWarning(dir, repo.Layout); warning != "" {
+		warnOnce("layout:"+dir, "Repository %s: %s", name, warning)
+	}
+	subdirs, err := listSubDir(dir)
 	if err != nil {
 		return Repository{}, err
 	}
-	var fileSize float64 = 0
+	// list every file first so progress can be reported against a total
+	zoomFiles := make([][]string, 0, len(subdirs))
+	totalFiles := 0
 	for _, sub := range subdirs {
 		files, err := listAllFile(sub)
 		if err != nil {
 			return Repository{}, err
 		}
-		for _, file := range files {
-			box1, err := calExtend(file)
-			if err != nil {
-				continue
-			}
-			box.extend(box1)
-			info, error := os.Stat(file)
-			if error != nil {
-				continue
+		zoomFiles = append(zoomFiles, files)
+		totalFiles += len(files)
+	}
+	minZoom, maxZoom := -1, -1
+	allFiles := make([]string, 0, totalFiles)
+	for i, sub := range subdirs {
+		files := zoomFiles[i]
+		if len(files) > 0 {
+			zoom := int(subDirZoom(sub))
+			if minZoom < 0 || zoom < minZoom {
+				minZoom = zoom
 			}
-			fileSize += float64(info.Size())
+			maxZoom = max(maxZoom, zoom)
 		}
+		allFiles = append(allFiles, files...)
+	}
+	counts := make(formatCounts)
+	sizes := make(tileSizes)
+	for i, sub := range subdirs {
+		sampleZoomFormats(int(subDirZoom(sub)), zoomFiles[i], counts, sizes)
+	}
+	repo.ZoomFormats, repo.Format, repo.MixedFormats = counts.summarize()
+	repo.TileSize = sizes.dominant()
+	box, fileSize, errs := scanExtents(allFiles, repo.TileGrid(), progress)
+	if len(errs) > 0 {
+		// the repository is still described by the files that could be read
+		log.Printf("Skipped %d of %d files analysing %s: %v", len(errs), totalFiles, name, errs[0])
+		RecordError("sfile", fmt.Errorf("analysing repository %s: %d files skipped: %w", name, len(errs), errors.Join(errs...)))
 	}
-	// Construct full path correctly
-	fullPath := filepath.Join(baseDir, entry.Name(), "repository.json")
-
 	repo.Pared = true
 	repo.Zoom = 14
-	repo.Lat = 0.5 * (box.miny + box.maxy)
-	repo.Lng = 0.5 * (box.minx + box.maxx)
+	repo.Lng, repo.Lat = box.Center()
 	repo.Size = fileSize
-	// Marshal the repository to JSON
-	jsonData, err := json.MarshalIndent(repo, "", "  ")
+	if box.IsValid() {
+		repo.Bounds = box.Bounds()
+	}
+	if minZoom >= 0 {
+		repo.MinZoom = minZoom
+		repo.MaxZoom = maxZoom
+	}
+	return repo, nil
+}
+
+// writeRepositoryInfo stores repo as the repository.json of the repository
+func writeRepositoryInfo(baseDir string, repo Repository) error {
+	// Construct full path correctly
+	fullPath := filepath.Join(baseDir, filepath.FromSlash(repo.Name), "repository.json")
+
+	// writers of other processes rewrite it too
+	unlock, err := lockRepository(filepath.Dir(fullPath))
 	if err != nil {
-		return Repository{}, fmt.Errorf("failed to marshal repository: %w", err)
+		return err
 	}
+	defer unlock()
 
-	// Create the file
-	file, err := os.Create(fullPath)
+	return replaceRepositoryInfo(fullPath, repo)
+}
+
+// updateRepositoryInfo changes the repository.json of the repository in dir
+// with update, under the repository lock, and replaces the file only once it is
+// written in full. Repositories without a repository.json are left alone.
+func updateRepositoryInfo(dir string, update func(repo *Repository) error) error {
+	unlock, err := lockRepository(dir)
 	if err != nil {
-		return Repository{}, fmt.Errorf("failed to create repository.json: %w", err)
+		return err
 	}
-	defer file.Close()
+	defer unlock()
+	infoPath := filepath.Join(dir, "repository.json")
+	content, err := os.ReadFile(infoPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var repo Repository
+	if err := json.Unmarshal(content, &repo); err != nil {
+		return fmt.Errorf("failed to parse repository.json: %w", err)
+	}
+	if err := update(&repo); err != nil {
+		return err
+	}
+	return replaceRepositoryInfo(infoPath, repo)
+}
 
-	// Write JSON data to file
+// replaceRepositoryInfo writes repo to a partial file and renames it over the
+// repository.json at infoPath, so a crash leaves either the old or the new
+// file and never a truncated one. The caller holds the repository lock.
+func replaceRepositoryInfo(infoPath string, repo Repository) error {
+	jsonData, err := json.MarshalIndent(repo, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal repository: %w", err)
+	}
+	partial := fmt.Sprintf("%s.%d.partial", infoPath, os.Getpid())
+	file, err := os.Create(partial)
+	if err != nil {
+		return fmt.Errorf("failed to create repository.json: %w", err)
+	}
 	_, err = file.Write(jsonData)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(partial, infoPath)
+	}
 	if err != nil {
-		return Repository{}, fmt.Errorf("failed to write repository.json: %w", err)
+		_ = os.Remove(partial)
+		return fmt.Errorf("failed to write repository.json: %w", err)
 	}
-
-	return repo, nil
+	return nil
 }
 
+// listAllFile returns the .s files of the zoom directory dir, see listSubDir
 func listAllFile(dir string) ([]string, error) {
 	dirs, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		if files, ok, flatErr := listFlatZoom(dir); ok {
+			return files, flatErr
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -190,111 +596,176 @@ func listAllFile(dir string) ([]string, error) {
 	return files, nil
 }
 
+// listSubDir returns the zoom directories of the repository in dir, see
+// zoomName, the virtual ones of a flat repository, see Layout.go
 func listSubDir(dir string) ([]string, error) {
 	dirs, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrRepositoryNotFound, dir)
+	}
 	if err != nil {
 		return nil, err
 	}
+	if repositoryLayout(dir) == LayoutFlat {
+		return flatZoomDirs(dir, dirs), nil
+	}
 	subDirs := make([]string, 0)
 	for _, d := range dirs {
-		if d.IsDir() {
-			match, err := regexp.MatchString("^[A-Z]$", d.Name())
-			if err != nil {
-				continue
-			}
-			if !match {
-				continue
-			}
+		if _, ok := nameZoom(d.Name()); d.IsDir() && ok {
 			subDirs = append(subDirs, path.Join(dir, d.Name()))
 		}
 	}
 	return subDirs, nil
 }
 
-func calExtend(sFilePath string) (Box, error) {
-	db, err := sql.Open("sqlite3", sFilePath)
+// scanExtents computes the extent and total size of files on a pool of
+// ScanWorkers goroutines. Files that cannot be read are left out of the result
+// and their errors returned. progress, when not nil, is called every
+// analysisProgressInterval files and once at the end.
+func scanExtents(files []string, grid TileGrid, progress func(files int, totalFiles int, bytes float64)) (Box, float64, []error) {
+	box := NewBox()
+	var fileSize float64
+	var errs []error
+	var mu sync.Mutex
+	processed := 0
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < min(ScanWorkers(), max(len(files), 1)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range jobs {
+				// a file with unreadable tables still contributes its other tables
+				box1, extentErr := calExtend(file, grid)
+				info, statErr := os.Stat(file)
+				mu.Lock()
+				processed++
+				if extentErr != nil {
+					errs = append(errs, extentErr)
+				}
+				if statErr != nil {
+					errs = append(errs, statErr)
+				} else {
+					box.Extend(box1)
+					fileSize += float64(info.Size())
+				}
+				if progress != nil && processed%analysisProgressInterval == 0 {
+					progress(processed, len(files), fileSize)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, file := range files {
+		jobs <- file
+	}
+	close(jobs)
+	wg.Wait()
+	if progress != nil {
+		progress(processed, len(files), fileSize)
+	}
+	return box, fileSize, errs
+}
+
+// calExtend returns the extent of the tiles stored in the .s file at sFilePath,
+// whose tiles are cut in grid.
+// Tables that cannot be read are skipped and reported in the returned error
+// together with the extent of the other tables.
+func calExtend(sFilePath string, grid TileGrid) (Box, error) {
+	db, err := openShardForMetadata(sFilePath)
 	if err != nil {
-		return Box{}, err
+		return NewBox(), err
 	}
+	defer closeShard(db)
 	tableNames, err := listTables(db)
 	if err != nil {
-		return Box{}, err
+		return NewBox(), err
 	}
 	box := NewBox()
+	var errs []error
 	for _, tableName := range tableNames {
+		if !validTableName.MatchString(tableName) {
+			continue
+		}
 		var tileXMin int64
 		var tileXMax int64
 		var tileYMin int64
 		var tileYMax int64
 		err = db.QueryRow("select min(X), max(X), min(Y), max(Y) from "+tableName).Scan(&tileXMin, &tileXMax, &tileYMin, &tileYMax)
 		if err != nil {
-			log.Println(err)
-			return Box{}, err
+			errs = append(errs, fmt.Errorf("extent of %s table %s: %w", sFilePath, tableName, err))
+			continue
 		}
 
 		//extend是tile编号的范围，我们需要将其转化为经纬度
 		// 编号坐标原点为 左上角 向下 向右生长
 		// GlobalMercator 计算方式是 右下角为坐标原点 所以 做个转换
-		zoom := int32(tableName[0]) - int32("A"[0])
-		minTile := tileBound(tileXMin, tileYMin, zoom)
-		maxTile := tileBound(tileXMax, tileYMax, zoom)
-		box.extend(minTile)
-		box.extend(maxTile)
+		z, _, _, _ := parseShardName(tableName)
+		zoom := int(z)
+		minTile := grid.TileToBounds(tileXMin, tileYMin, zoom)
+		maxTile := grid.TileToBounds(tileXMax, tileYMax, zoom)
+		box.Extend(minTile)
+		box.Extend(maxTile)
 	}
-	return box, nil
+	return box, errors.Join(errs...)
 }
 
-// 计算tile编号的范围
-// xMin: tileX的最小值
-// yMin: tileY的最小值
-// zoom: 缩放级别
-// this method calculate the tile bound based on web mercator tile system
-// return tile's bound with wgs84 coordinate
-func tileBound(tx int64, ty int64, zoom int32) Box {
-	tileSize := 256.
-	x, y := pixelsToMeters(float64(tx)*tileSize, float64(ty)*tileSize, zoom)
-	x0, y0 := meterToLngLat(x, y)
-
-	x_, y_ := pixelsToMeters(float64(tx+1)*tileSize, float64(ty+1)*tileSize, zoom)
-	x1, y1 := meterToLngLat(x_, y_)
-
-	return Box{
-		minx: x0,
-		miny: y1,
-		maxx: x1,
-		maxy: y0,
+// sampleTileFormat guesses the tile format of a repository from the first tile
+// stored in the .s file at sFilePath, returning "" when it holds no tile
+func sampleTileFormat(sFilePath string) string {
+	shard, release, err := openShardMetadata(sFilePath)
+	if err != nil {
+		return ""
+	}
+	defer release()
+	tableNames, err := listTables(shard.db)
+	if err != nil {
+		return ""
+	}
+	for _, tableName := range tableNames {
+		if !validTableName.MatchString(tableName) {
+			continue
+		}
+		encoding, err := encodingColumn(shard.db, tableName)
+		if err != nil {
+			continue
+		}
+		var data []byte
+		var stored sql.NullString
+		if err := shard.db.QueryRow("select "+tileData(tableName, shard.dedup)+", "+encoding+" from "+tableName+" limit 1").Scan(&data, &stored); err != nil || len(data) == 0 {
+			continue
+		}
+		if data, err = DecodeTile(data, stored.String); err != nil {
+			continue
+		}
+		return tileFormat(data)
 	}
+	return ""
 }
 
-var INITIALIZE_RESOLUTION = 2. * math.Pi * 6378137 / 256.
-
-var ORIGIN_SHIFT = 2 * math.Pi * 6378137 / 2.0
-
-func pixelsToMeters(px float64, py float64, zoom int32) (float64, float64) {
-	//zoom级别 每个像素对应的地面米数 该值只在赤道上是准确的 其他地方都有偏差，但是这个偏差只是为了对位置的一个描述
-	res := INITIALIZE_RESOLUTION / math.Pow(2, float64(zoom))
-	//    墨卡托 米     离左上角的米数       墨卡托的坐标原点X
-	mx := px*res - ORIGIN_SHIFT
-	//     墨卡托 米       离左上角的米数 Y方向      墨卡托的坐标原点Y
-	my := -(py*res - ORIGIN_SHIFT)
-	return mx, my
+// tileFormat maps the sniffed content type of a tile to its format name.
+// Vector tiles have no signature, they are stored gzipped or as raw protobuf.
+func tileFormat(data []byte) string {
+	switch contentType := http.DetectContentType(data); {
+	case contentType == "image/png":
+		return "png"
+	case contentType == "image/jpeg":
+		return "jpg"
+	case contentType == "image/webp":
+		return "webp"
+	case contentType == "image/gif":
+		return "gif"
+	case strings.HasPrefix(contentType, "application/json"), strings.HasPrefix(contentType, "text/plain") && bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")):
+		return "json"
+	default:
+		return "pbf"
+	}
 }
 
-/**
- * "Maximal scaledown zoom of the pyramid closest to the pixelSize."
- * 墨卡托 以米为单位的坐标 转化为WGS84经纬度坐标
- *
- * @param mx
- * @param my
- * @return
- */
-func meterToLngLat(mx float64, my float64) (float64, float64) {
-	lon := (mx / ORIGIN_SHIFT) * 180.0
-	lat := (my / ORIGIN_SHIFT) * 180.0
-
-	lat = 180 / math.Pi * (2*math.Atan(math.Exp(lat*math.Pi/180.0)) - math.Pi/2.0)
-	return lon, lat
-}
+// DefaultTileSize is the width and height in pixels of the tiles of a repository
+// that does not record its tile size
+const DefaultTileSize = 256
 
 func listTables(sqlDb *sql.DB) ([]string, error) {
 	tableNames := make([]string, 0)
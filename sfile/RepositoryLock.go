@@ -0,0 +1,134 @@
+package sfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sqlite keeps two processes from corrupting a .s file they both write, but not
+// from both rewriting repository.json, so every process writing a repository
+// also holds an advisory lock on the .lock file in its directory. The goroutines
+// of one process share the lock, the writers of a .s file within a process are
+// serialized by writeLocks. Readers never take it.
+
+// lockFileName is the file in a repository directory locked by its writers
+const lockFileName = ".lock"
+
+// DefaultRepositoryLockTimeout is how long a writer waits for a repository
+// locked by another process before giving up
+const DefaultRepositoryLockTimeout = 10 * time.Second
+
+// lockPollInterval is how often a locked repository is tried again
+const lockPollInterval = 50 * time.Millisecond
+
+// repositoryLockTimeout is the wait of writers in nanoseconds, see SetRepositoryLockTimeout
+var repositoryLockTimeout atomic.Int64
+
+func init() {
+	repositoryLockTimeout.Store(int64(DefaultRepositoryLockTimeout))
+}
+
+// SetRepositoryLockTimeout changes how long writers wait for a repository locked
+// by another process, 0 gives up at once
+func SetRepositoryLockTimeout(timeout time.Duration) {
+	repositoryLockTimeout.Store(int64(max(timeout, 0)))
+}
+
+// ErrRepositoryLocked is returned when a repository stays locked by another
+// process for longer than the lock timeout
+var ErrRepositoryLocked = errors.New("repository is locked by another process")
+
+// RepositoryLockError tells which repository could not be locked and for how
+// long it was waited for
+type RepositoryLockError struct {
+	Dir    string
+	Waited time.Duration
+}
+
+func (e *RepositoryLockError) Error() string {
+	return fmt.Sprintf("%s: %v: gave up after %s", e.Dir, ErrRepositoryLocked, e.Waited.Round(time.Millisecond))
+}
+
+// Is matches ErrRepositoryLocked
+func (e *RepositoryLockError) Is(target error) bool {
+	return target == ErrRepositoryLocked
+}
+
+// repositoryLock is the lock of one repository held by this process
+type repositoryLock struct {
+	mu      sync.Mutex // held while the lock file is locked or unlocked
+	holders int
+	file    *os.File
+}
+
+// repositoryLocks are the locks of the repositories written by this process, by
+// absolute directory
+var repositoryLocks = struct {
+	sync.Mutex
+	locks map[string]*repositoryLock
+}{locks: make(map[string]*repositoryLock)}
+
+// lockRepository locks the repository in dir against writers of other
+// processes, waiting for them up to the lock timeout. It is shared with the
+// holders of this process, the returned function releases this hold.
+func lockRepository(dir string) (func(), error) {
+	key := sizeKey(dir)
+	repositoryLocks.Lock()
+	lock, ok := repositoryLocks.locks[key]
+	if !ok {
+		lock = &repositoryLock{}
+		repositoryLocks.locks[key] = lock
+	}
+	repositoryLocks.Unlock()
+
+	lock.mu.Lock()
+	defer lock.mu.Unlock()
+	if lock.holders == 0 {
+		file, err := waitLockFile(key, time.Duration(repositoryLockTimeout.Load()))
+		if err != nil {
+			return nil, err
+		}
+		lock.file = file
+	}
+	lock.holders++
+	return sync.OnceFunc(func() {
+		lock.mu.Lock()
+		defer lock.mu.Unlock()
+		lock.holders--
+		if lock.holders == 0 {
+			_ = unlockFile(lock.file)
+			_ = lock.file.Close()
+			lock.file = nil
+		}
+	}), nil
+}
+
+// waitLockFile opens the lock file of the repository in dir and locks it,
+// trying again until timeout passes
+func waitLockFile(dir string, timeout time.Duration) (*os.File, error) {
+	file, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open lock of %s: %w", dir, err)
+	}
+	start := time.Now()
+	for {
+		locked, err := tryLockFile(file)
+		if err != nil {
+			_ = file.Close()
+			return nil, fmt.Errorf("lock %s: %w", dir, err)
+		}
+		if locked {
+			return file, nil
+		}
+		if time.Since(start)+lockPollInterval > timeout {
+			_ = file.Close()
+			return nil, &RepositoryLockError{Dir: dir, Waited: time.Since(start)}
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
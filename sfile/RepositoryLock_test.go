@@ -0,0 +1,132 @@
+//go:build linux || darwin || windows
+
+package sfile
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockHelperEnv names the repository the helper process locks
+const lockHelperEnv = "SIRSERVER_TEST_LOCK_REPOSITORY"
+
+// TestRepositoryLockHelper is not a test: run by lockInOtherProcess, it locks a
+// repository, says so on stdout and holds the lock until stdin is closed
+func TestRepositoryLockHelper(t *testing.T) {
+	dir := os.Getenv(lockHelperEnv)
+	if dir == "" {
+		t.Skip("helper of TestRepositoryLockContention")
+	}
+	unlock, err := lockRepository(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout.WriteString("locked\n")
+	_, _ = io.Copy(io.Discard, os.Stdin)
+	unlock()
+}
+
+// lockInOtherProcess locks the repository in dir from another process and
+// returns the function releasing it
+func lockInOtherProcess(t *testing.T, dir string) func() {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRepositoryLockHelper$")
+	cmd.Env = append(os.Environ(), lockHelperEnv+"="+dir)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "locked\n" {
+		_ = cmd.Process.Kill()
+		t.Fatalf("helper process: %q, %v", line, err)
+	}
+	release := sync.OnceFunc(func() {
+		stdin.Close()
+		if err := cmd.Wait(); err != nil {
+			t.Errorf("helper process: %v", err)
+		}
+	})
+	t.Cleanup(release)
+	return release
+}
+
+// TestRepositoryLockContention locks a repository from another process and
+// checks writers of this one give up with ErrRepositoryLocked after the lock
+// timeout, and that a writer waiting when the other process lets go gets the
+// lock. The goroutines of this process share the lock once it is held.
+func TestRepositoryLockContention(t *testing.T) {
+	defer SetRepositoryLockTimeout(time.Duration(repositoryLockTimeout.Load()))
+	repo, _ := newTestRepository(t, "")
+	release := lockInOtherProcess(t, repo.dir)
+
+	const timeout = 300 * time.Millisecond
+	SetRepositoryLockTimeout(timeout)
+	start := time.Now()
+	_, err := lockRepository(repo.dir)
+	var lockErr *RepositoryLockError
+	if !errors.Is(err, ErrRepositoryLocked) || !errors.As(err, &lockErr) {
+		t.Fatalf("lock held by another process: %v, want a RepositoryLockError", err)
+	}
+	if waited := time.Since(start); waited < timeout-lockPollInterval || lockErr.Waited > waited {
+		t.Fatalf("gave up after %s, reported %s, want about %s", waited, lockErr.Waited, timeout)
+	}
+	if err := repo.WriteXYZ(0, 0, 1, []byte("tile")); !errors.Is(err, ErrRepositoryLocked) {
+		t.Fatalf("WriteXYZ to a repository locked by another process: %v, want ErrRepositoryLocked", err)
+	}
+
+	// two writers wait, the other process lets go before the timeout
+	SetRepositoryLockTimeout(10 * time.Second)
+	var wg sync.WaitGroup
+	unlocks := make(chan func(), 2)
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, err := lockRepository(repo.dir)
+			if err != nil {
+				errs <- err
+				return
+			}
+			unlocks <- unlock
+		}()
+	}
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case <-unlocks:
+		t.Fatal("locked while the other process holds the lock")
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+	release()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("waiting for the lock: %v", err)
+	}
+	close(unlocks)
+	for unlock := range unlocks {
+		unlock()
+	}
+
+	if err := repo.WriteXYZ(0, 0, 1, []byte("tile")); err != nil {
+		t.Fatalf("WriteXYZ once the other process let go: %v", err)
+	}
+	// released by every holder, the other process can lock it again
+	lockInOtherProcess(t, repo.dir)()
+}
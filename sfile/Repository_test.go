@@ -0,0 +1,166 @@
+package sfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestUpdateRepositoryInfo(t *testing.T) {
+	dir := t.TempDir()
+	infoPath := filepath.Join(dir, "repository.json")
+
+	// without a repository.json there is nothing to update
+	called := false
+	if err := updateRepositoryInfo(dir, func(repo *Repository) error { called = true; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if called {
+		t.Error("update called without a repository.json")
+	}
+	if _, err := os.Stat(infoPath); !os.IsNotExist(err) {
+		t.Errorf("repository.json created: %v", err)
+	}
+
+	if err := os.WriteFile(infoPath, []byte(`{"name":"repo","size":1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateRepositoryInfo(dir, func(repo *Repository) error { repo.Size = 42; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(infoPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var repo Repository
+	if err := json.Unmarshal(content, &repo); err != nil {
+		t.Fatal(err)
+	}
+	if repo.Name != "repo" || repo.Size != 42 {
+		t.Errorf("got name %q size %g, want repo 42", repo.Name, repo.Size)
+	}
+	partials, _ := filepath.Glob(infoPath + ".*.partial")
+	if len(partials) != 0 {
+		t.Errorf("partial files left: %v", partials)
+	}
+}
+
+// TestScanSymlinks scans a root holding a symlink to a repository outside it, a
+// broken symlink and, one level down, a symlink back to the root. Links out of
+// the root are followed with a single warning however often the root is
+// scanned; the loop and the broken link are skipped; nothing symlinked is
+// listed when symlinks are not followed.
+func TestScanSymlinks(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	// repositories are told by their shard folders, listed under the path they
+	// are found at; nested is a plain directory grouping repositories at depth 2
+	for _, dir := range []string{filepath.Join(root, "local", "K"), filepath.Join(root, "nested"), filepath.Join(outside, "K")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"outside":        outside,
+		"broken":         filepath.Join(root, "missing"),
+		"nested/loop":    root,
+		"nested/outside": outside,
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, filepath.FromSlash(link))); err != nil {
+			t.Skipf("symlinks unavailable: %v", err)
+		}
+	}
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	scan := func(opts ScanOptions) []string {
+		t.Helper()
+		repositories, err := ScanRepositories(root, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, 0, len(repositories))
+		for _, repository := range repositories {
+			names = append(names, repository.Name)
+		}
+		slices.Sort(names)
+		return names
+	}
+	for _, tc := range []struct {
+		opts ScanOptions
+		want []string
+	}{
+		{ScanOptions{Depth: 1, FollowSymlinks: true}, []string{"local", "nested", "outside"}},
+		{ScanOptions{Depth: 2, FollowSymlinks: true}, []string{"local", "nested/outside", "outside"}},
+		{ScanOptions{Depth: 1}, []string{"local", "nested"}},
+		{ScanOptions{Depth: 2}, []string{"local"}},
+	} {
+		for i := 0; i < 2; i++ {
+			if got := scan(tc.opts); !slices.Equal(got, tc.want) {
+				t.Fatalf("scan %+v: %v, want %v", tc.opts, got, tc.want)
+			}
+		}
+	}
+
+	// the analyses queued in the background log too, the log is read once they
+	// no longer can write to it
+	log.SetOutput(os.Stderr)
+	for _, warning := range []string{
+		"symlink " + filepath.Join(root, "outside") + " points outside the repository root",
+		"symlink " + filepath.Join(root, "nested", "outside") + " points outside the repository root",
+		"Skipping broken symlink " + filepath.Join(root, "broken"),
+		"Skipping symlink loop " + filepath.Join(root, "nested", "loop"),
+	} {
+		if count := strings.Count(logged.String(), warning); count != 1 {
+			t.Errorf("%q logged %d times, want once in:\n%s", warning, count, logged.String())
+		}
+	}
+}
+
+// TestScanRepositoryTileSize analyses repositories of 256 and 512 pixel PNG
+// tiles and checks the tile size is detected and that the extent, which tile
+// numbers decide whatever their pixel size, is the known extent of the tiles
+func TestScanRepositoryTileSize(t *testing.T) {
+	for _, size := range []int{256, 512} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			repo, root := newTestRepository(t, "")
+			var tile bytes.Buffer
+			if err := png.Encode(&tile, image.NewGray(image.Rect(0, 0, size, size))); err != nil {
+				t.Fatal(err)
+			}
+			// the north east quarter of the world at zoom 1, and the tile south
+			// west of the center at zoom 3
+			for _, coord := range []TileCoord{{Z: 1, X: 1, Y: 0}, {Z: 3, X: 3, Y: 4}} {
+				if err := repo.WriteXYZ(coord.X, coord.Y, coord.Z, tile.Bytes()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			analysed, err := scanRepository(root, filepath.Base(repo.dir), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if analysed.TileSize != size {
+				t.Errorf("tile size %d, want %d", analysed.TileSize, size)
+			}
+			want := [4]float64{-45, -40.97989806962013, 180, MaxLatitude}
+			for i := range want {
+				if math.Abs(analysed.Bounds[i]-want[i]) > 1e-9 {
+					t.Fatalf("bounds %v, want %v", analysed.Bounds, want)
+				}
+			}
+			if analysed.MinZoom != 1 || analysed.MaxZoom != 3 {
+				t.Errorf("zooms %d..%d, want 1..3", analysed.MinZoom, analysed.MaxZoom)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package sfile
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// transientRetries is how many times an operation failing with a transient error
+// is retried, waiting about transientBackoff, then four times as long each time
+const (
+	transientRetries = 3
+	transientBackoff = 20 * time.Millisecond
+)
+
+// retries counts the retries of operations that failed with a transient error
+var retries atomic.Int64
+
+// Retries returns how many times reads and writes of shards were retried after a
+// transient error since the process started, a measure of how sick the storage is
+func Retries() int64 {
+	return retries.Load()
+}
+
+// isTransient reports whether err is worth retrying: sqlite giving up on a shard
+// locked by another connection, SQLITE_BUSY or SQLITE_LOCKED, or a system call
+// interrupted or asked to try again, EINTR or EAGAIN. sqlite errors go by the
+// message, the error type of the driver only exists in cgo builds.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) {
+		return true
+	}
+	message := err.Error()
+	return strings.Contains(message, "database is locked") || strings.Contains(message, "database table is locked") ||
+		strings.Contains(message, "interrupted system call") || strings.Contains(message, "resource temporarily unavailable")
+}
+
+// retryTransient runs fn again with a growing, jittered pause while it fails with
+// a transient error, so a lock outliving the busy timeout or a hiccup of network
+// storage only surfaces once the retries are used up, ctx ends or its deadline
+// would pass before the next attempt
+func retryTransient(ctx context.Context, fn func() error) error {
+	delay := transientBackoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if attempt == transientRetries || !isTransient(err) {
+			return err
+		}
+		// up to half the delay again, so contending writers do not retry in step
+		pause := delay + time.Duration(rand.Int63n(int64(delay/2)+1))
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < pause {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(pause):
+		}
+		retries.Add(1)
+		delay *= 4
+	}
+}
+
+// acquireShardRetrying is acquireShard retried while it fails with a transient error
+func acquireShardRetrying(ctx context.Context, filePath string) (shard *handleEntry, release func(), err error) {
+	err = retryTransient(ctx, func() (err error) {
+		shard, release, err = acquireShard(filePath)
+		return err
+	})
+	return shard, release, err
+}
+
+// openShardForWriteRetrying is openShardForWrite retried while it fails with a
+// transient error
+func openShardForWriteRetrying(filePath string) (db *sql.DB, done func(), err error) {
+	err = retryTransient(context.Background(), func() (err error) {
+		db, done, err = openShardForWrite(filePath)
+		return err
+	})
+	return db, done, err
+}
@@ -0,0 +1,290 @@
+package sfile
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3EmptyPayloadHash is the SHA-256 of an empty body, the payload of every request made
+const s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// errS3NotModified is returned by getObject when the object still has the given ETag
+var errS3NotModified = errors.New("object not modified")
+
+// s3Credentials are the keys requests are signed with
+type s3Credentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	expires      time.Time // zero when they do not expire
+}
+
+// s3Client is a minimal S3 API client for reading objects and listing prefixes,
+// signing requests with AWS Signature Version 4
+type s3Client struct {
+	endpoint    *url.URL // custom endpoint of S3-compatible storage, nil for AWS
+	region      string
+	credentials *s3CredentialCache
+	client      *http.Client
+}
+
+// newS3Client configures a client the way the AWS tools do: credentials from
+// the standard chain, see s3CredentialChain, the region from AWS_REGION,
+// AWS_DEFAULT_REGION or the shared config file of AWS_PROFILE, and
+// S3-compatible storage from AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL
+func newS3Client() (*s3Client, error) {
+	profile := firstNonEmpty(os.Getenv("AWS_PROFILE"), "default")
+	home, _ := os.UserHomeDir()
+	credentialsFile := firstNonEmpty(os.Getenv("AWS_SHARED_CREDENTIALS_FILE"), filepath.Join(home, ".aws", "credentials"))
+	configFile := firstNonEmpty(os.Getenv("AWS_CONFIG_FILE"), filepath.Join(home, ".aws", "config"))
+
+	configProfile := profile
+	if profile != "default" {
+		configProfile = "profile " + profile
+	}
+	config := readAWSProfile(configFile, configProfile)
+	region := firstNonEmpty(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), config["region"], "us-east-1")
+	credentials, err := resolveS3Credentials(context.Background(), s3CredentialChain(credentialsFile, profile, region))
+	if err != nil {
+		return nil, fmt.Errorf("no AWS credentials in the environment, web identity, profile %q of %s, container or instance metadata: %w", profile, credentialsFile, err)
+	}
+	client := &s3Client{
+		region:      region,
+		credentials: credentials,
+		client:      &http.Client{Timeout: 5 * time.Minute},
+	}
+	if endpoint := firstNonEmpty(os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL")); endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+		}
+		client.endpoint = u
+	}
+	return client, nil
+}
+
+// readAWSProfile returns the keys of a section of an AWS ini file, nothing when
+// the file or section does not exist
+func readAWSProfile(path string, section string) map[string]string {
+	values := make(map[string]string)
+	file, err := os.Open(path)
+	if err != nil {
+		return values
+	}
+	defer file.Close()
+	current := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			current = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok && current == section {
+			values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return values
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// s3Escape percent-encodes s as required by Signature Version 4, leaving slashes
+// alone when path is set
+func s3Escape(s string, path bool) string {
+	var builder strings.Builder
+	for _, b := range []byte(s) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' || b == '-' || b == '_' || b == '.' || b == '~' || path && b == '/' {
+			builder.WriteByte(b)
+		} else {
+			fmt.Fprintf(&builder, "%%%02X", b)
+		}
+	}
+	return builder.String()
+}
+
+// request sends a signed request for key of bucket. Custom endpoints are
+// addressed path style, AWS virtual-hosted style.
+func (c *s3Client) request(ctx context.Context, method string, bucket string, key string, query url.Values, header http.Header) (*http.Response, error) {
+	scheme, host, path := "https", bucket+".s3."+c.region+".amazonaws.com", "/"+s3Escape(key, true)
+	if c.endpoint != nil {
+		scheme, host = c.endpoint.Scheme, c.endpoint.Host
+		path = strings.TrimRight(c.endpoint.Path, "/") + "/" + s3Escape(bucket, false) + path
+	}
+	keys := make([]string, 0, len(query))
+	for name := range query {
+		keys = append(keys, name)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, name := range keys {
+		pairs = append(pairs, s3Escape(name, false)+"="+s3Escape(query.Get(name), false))
+	}
+	rawQuery := strings.Join(pairs, "&")
+
+	request, err := http.NewRequestWithContext(ctx, method, scheme+"://"+host+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+	// Opaque keeps the path exactly as it was signed
+	request.URL.Opaque = "//" + host + path
+	request.URL.RawQuery = rawQuery
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	credentials, err := c.credentials.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.sign(request, path, rawQuery, credentials, time.Now())
+	return c.client.Do(request)
+}
+
+// sign adds the Signature Version 4 headers of credentials to request
+func (c *s3Client) sign(request *http.Request, path string, rawQuery string, credentials s3Credentials, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", s3EmptyPayloadHash)
+	if credentials.sessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", credentials.sessionToken)
+	}
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{request.Method, path, rawQuery, canonicalHeaders.String(), signedHeaders, s3EmptyPayloadHash}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+credentials.secretKey), date)
+	for _, part := range []string{c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		credentials.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Error reads the error of a failed response
+func s3Error(response *http.Response, bucket string, key string) error {
+	var body struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	_ = xml.NewDecoder(io.LimitReader(response.Body, 64<<10)).Decode(&body)
+	if response.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("s3://%s/%s: %w", bucket, key, os.ErrNotExist)
+	}
+	if body.Code != "" {
+		return fmt.Errorf("s3://%s/%s: %s: %s", bucket, key, body.Code, body.Message)
+	}
+	return fmt.Errorf("s3://%s/%s: %s", bucket, key, response.Status)
+}
+
+// getObject returns the body and ETag of an object. When etag is set and the
+// object still has it, errS3NotModified is returned. A missing object is
+// reported as os.ErrNotExist.
+func (c *s3Client) getObject(ctx context.Context, bucket string, key string, etag string) (io.ReadCloser, string, error) {
+	header := http.Header{}
+	if etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+	response, err := c.request(ctx, http.MethodGet, bucket, key, nil, header)
+	if err != nil {
+		return nil, "", err
+	}
+	switch response.StatusCode {
+	case http.StatusOK:
+		return response.Body, response.Header.Get("ETag"), nil
+	case http.StatusNotModified:
+		response.Body.Close()
+		return nil, etag, errS3NotModified
+	default:
+		defer response.Body.Close()
+		return nil, "", s3Error(response, bucket, key)
+	}
+}
+
+// listPrefixes returns the common prefixes directly below prefix, the "directories" of a bucket
+func (c *s3Client) listPrefixes(ctx context.Context, bucket string, prefix string) ([]string, error) {
+	prefixes := make([]string, 0)
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "delimiter": {"/"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		response, err := c.request(ctx, http.MethodGet, bucket, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode != http.StatusOK {
+			err := s3Error(response, bucket, prefix)
+			response.Body.Close()
+			return nil, err
+		}
+		var result struct {
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+			CommonPrefixes        []struct {
+				Prefix string `xml:"Prefix"`
+			} `xml:"CommonPrefixes"`
+		}
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("listing s3://%s/%s: %w", bucket, prefix, err)
+		}
+		for _, common := range result.CommonPrefixes {
+			prefixes = append(prefixes, common.Prefix)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return prefixes, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
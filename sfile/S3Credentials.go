@@ -0,0 +1,358 @@
+package sfile
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credentials are looked up in the order of the AWS SDKs, the first source
+// configured wins: the environment, a web identity token (IRSA on EKS), the
+// shared credentials file, the container credentials endpoint (ECS task roles
+// and EKS Pod Identity), then the instance metadata service of EC2. Those of
+// the last three sources but the file expire and are fetched again before.
+
+// s3CredentialRefreshWindow is how long before they expire credentials are
+// fetched again, so no request is signed with credentials about to expire
+const s3CredentialRefreshWindow = 5 * time.Minute
+
+// Endpoints of the credential sources inside AWS, see the AWS SDKs
+const (
+	s3ContainerCredentialsHost = "http://169.254.170.2"
+	s3InstanceMetadataEndpoint = "http://169.254.169.254"
+)
+
+// s3InstanceMetadataTimeout bounds every request to the instance metadata
+// service, which outside EC2 does not answer at all
+const s3InstanceMetadataTimeout = 2 * time.Second
+
+// s3CredentialProvider fetches credentials from one source
+type s3CredentialProvider interface {
+	name() string
+	retrieve(ctx context.Context) (s3Credentials, error)
+}
+
+// s3CredentialCache hands out the credentials of a provider, fetching them
+// again when they are about to expire. It is safe for concurrent use.
+type s3CredentialCache struct {
+	provider s3CredentialProvider
+	now      func() time.Time
+
+	mu          sync.Mutex
+	credentials s3Credentials
+	fetched     bool
+}
+
+// newS3CredentialCache returns a cache of the credentials of provider
+func newS3CredentialCache(provider s3CredentialProvider) *s3CredentialCache {
+	return &s3CredentialCache{provider: provider, now: time.Now}
+}
+
+// get returns credentials valid for at least s3CredentialRefreshWindow, or the
+// current ones while they are still valid when fetching new ones fails
+func (c *s3CredentialCache) get(ctx context.Context) (s3Credentials, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	if c.fetched && (c.credentials.expires.IsZero() || c.credentials.expires.Sub(now) > s3CredentialRefreshWindow) {
+		return c.credentials, nil
+	}
+	credentials, err := c.provider.retrieve(ctx)
+	if err != nil {
+		if c.fetched && c.credentials.expires.After(now) {
+			return c.credentials, nil
+		}
+		return s3Credentials{}, fmt.Errorf("AWS credentials from %s: %w", c.provider.name(), err)
+	}
+	c.credentials, c.fetched = credentials, true
+	return credentials, nil
+}
+
+// s3CredentialChain returns the provider of the first configured credential
+// source, see the order above. The shared credentials file is read from
+// credentialsFile with profile. IMDS is tried last unless disabled with
+// AWS_EC2_METADATA_DISABLED.
+func s3CredentialChain(credentialsFile string, profile string, region string) []s3CredentialProvider {
+	if os.Getenv("AWS_ACCESS_KEY_ID") != "" && os.Getenv("AWS_SECRET_ACCESS_KEY") != "" {
+		return []s3CredentialProvider{staticS3Credentials{source: "the environment", credentials: s3Credentials{
+			accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}}}
+	}
+	if tokenFile, role := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN"); tokenFile != "" && role != "" {
+		return []s3CredentialProvider{webIdentityS3Credentials{
+			tokenFile: tokenFile,
+			roleARN:   role,
+			session:   firstNonEmpty(os.Getenv("AWS_ROLE_SESSION_NAME"), "sirserver-"+strconv.FormatInt(time.Now().Unix(), 10)),
+			endpoint:  firstNonEmpty(os.Getenv("AWS_ENDPOINT_URL_STS"), "https://sts."+region+".amazonaws.com"),
+			client:    &http.Client{Timeout: 30 * time.Second},
+		}}
+	}
+	chain := make([]s3CredentialProvider, 0, 3)
+	values := readAWSProfile(credentialsFile, profile)
+	if values["aws_access_key_id"] != "" && values["aws_secret_access_key"] != "" {
+		chain = append(chain, staticS3Credentials{source: fmt.Sprintf("profile %q of %s", profile, credentialsFile), credentials: s3Credentials{
+			accessKey:    values["aws_access_key_id"],
+			secretKey:    values["aws_secret_access_key"],
+			sessionToken: values["aws_session_token"],
+		}})
+	}
+	if relative, full := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"), os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); relative != "" || full != "" {
+		endpoint := full
+		if relative != "" {
+			endpoint = s3ContainerCredentialsHost + relative
+		}
+		chain = append(chain, containerS3Credentials{
+			endpoint:  endpoint,
+			token:     os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"),
+			tokenFile: os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"),
+			client:    &http.Client{Timeout: 30 * time.Second},
+		})
+	}
+	if !strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		chain = append(chain, instanceS3Credentials{
+			endpoint: strings.TrimRight(firstNonEmpty(os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT"), s3InstanceMetadataEndpoint), "/"),
+			client:   &http.Client{Timeout: s3InstanceMetadataTimeout},
+		})
+	}
+	return chain
+}
+
+// resolveS3Credentials returns a cache of the credentials of the first
+// provider of chain that has credentials
+func resolveS3Credentials(ctx context.Context, chain []s3CredentialProvider) (*s3CredentialCache, error) {
+	errs := make([]error, 0, len(chain))
+	for _, provider := range chain {
+		cache := newS3CredentialCache(provider)
+		if _, err := cache.get(ctx); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return cache, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// staticS3Credentials are credentials that never expire, of the environment or
+// the shared credentials file
+type staticS3Credentials struct {
+	source      string
+	credentials s3Credentials
+}
+
+func (p staticS3Credentials) name() string { return p.source }
+
+func (p staticS3Credentials) retrieve(context.Context) (s3Credentials, error) {
+	return p.credentials, nil
+}
+
+// webIdentityS3Credentials exchanges the web identity token of a Kubernetes
+// service account for the credentials of a role with STS AssumeRoleWithWebIdentity.
+// The token file is read again every time, it is rotated.
+type webIdentityS3Credentials struct {
+	tokenFile string
+	roleARN   string
+	session   string
+	endpoint  string
+	client    *http.Client
+}
+
+func (p webIdentityS3Credentials) name() string { return "web identity role " + p.roleARN }
+
+func (p webIdentityS3Credentials) retrieve(ctx context.Context) (s3Credentials, error) {
+	token, err := os.ReadFile(p.tokenFile)
+	if err != nil {
+		return s3Credentials{}, fmt.Errorf("failed to read web identity token: %w", err)
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {p.roleARN},
+		"RoleSessionName":  {p.session},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return s3Credentials{}, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response, err := p.client.Do(request)
+	if err != nil {
+		return s3Credentials{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return s3Credentials{}, credentialEndpointError(response)
+	}
+	var result struct {
+		Credentials struct {
+			AccessKeyId     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.NewDecoder(response.Body).Decode(&result); err != nil {
+		return s3Credentials{}, fmt.Errorf("failed to parse the STS response: %w", err)
+	}
+	c := result.Credentials
+	return checkS3Credentials(s3Credentials{accessKey: c.AccessKeyId, secretKey: c.SecretAccessKey, sessionToken: c.SessionToken, expires: c.Expiration})
+}
+
+// containerS3Credentials fetches the credentials of an ECS task role or an EKS
+// Pod Identity association from the credentials endpoint of the container
+type containerS3Credentials struct {
+	endpoint  string
+	token     string // sent as Authorization
+	tokenFile string // read again every time, Pod Identity rotates it
+	client    *http.Client
+}
+
+func (p containerS3Credentials) name() string { return "the container credentials endpoint" }
+
+func (p containerS3Credentials) retrieve(ctx context.Context) (s3Credentials, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, p.endpoint, nil)
+	if err != nil {
+		return s3Credentials{}, err
+	}
+	token := p.token
+	if p.tokenFile != "" {
+		content, err := os.ReadFile(p.tokenFile)
+		if err != nil {
+			return s3Credentials{}, fmt.Errorf("failed to read container authorization token: %w", err)
+		}
+		token = strings.TrimSpace(string(content))
+	}
+	if token != "" {
+		request.Header.Set("Authorization", token)
+	}
+	return fetchJSONCredentials(p.client, request)
+}
+
+// instanceS3Credentials fetches the credentials of the instance profile of an
+// EC2 instance from its metadata service, with an IMDSv2 session token when
+// the service hands one out
+type instanceS3Credentials struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (p instanceS3Credentials) name() string { return "the EC2 instance metadata service" }
+
+func (p instanceS3Credentials) retrieve(ctx context.Context) (s3Credentials, error) {
+	token, err := p.sessionToken(ctx)
+	if err != nil {
+		return s3Credentials{}, err
+	}
+	get := func(path string) (*http.Request, error) {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, p.endpoint+path, nil)
+		if err == nil && token != "" {
+			request.Header.Set("X-aws-ec2-metadata-token", token)
+		}
+		return request, err
+	}
+	const credentialsPath = "/latest/meta-data/iam/security-credentials/"
+	request, err := get(credentialsPath)
+	if err != nil {
+		return s3Credentials{}, err
+	}
+	response, err := p.client.Do(request)
+	if err != nil {
+		return s3Credentials{}, err
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, 64<<10))
+	response.Body.Close()
+	if err != nil {
+		return s3Credentials{}, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return s3Credentials{}, fmt.Errorf("no instance profile: %s", response.Status)
+	}
+	role, _, _ := strings.Cut(strings.TrimSpace(string(body)), "\n")
+	if role == "" {
+		return s3Credentials{}, fmt.Errorf("no instance profile")
+	}
+	if request, err = get(credentialsPath + url.PathEscape(role)); err != nil {
+		return s3Credentials{}, err
+	}
+	return fetchJSONCredentials(p.client, request)
+}
+
+// sessionToken returns an IMDSv2 session token, "" when the service only
+// speaks IMDSv1
+func (p instanceS3Credentials) sessionToken(ctx context.Context) (string, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, p.endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	response, err := p.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK:
+		token, err := io.ReadAll(io.LimitReader(response.Body, 4<<10))
+		return strings.TrimSpace(string(token)), err
+	case http.StatusForbidden, http.StatusNotFound, http.StatusMethodNotAllowed:
+		return "", nil
+	}
+	return "", credentialEndpointError(response)
+}
+
+// fetchJSONCredentials sends request to a credentials endpoint answering with
+// the JSON of the container and instance metadata endpoints
+func fetchJSONCredentials(client *http.Client, request *http.Request) (s3Credentials, error) {
+	response, err := client.Do(request)
+	if err != nil {
+		return s3Credentials{}, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return s3Credentials{}, credentialEndpointError(response)
+	}
+	var result struct {
+		Code            string    `json:"Code"`
+		Message         string    `json:"Message"`
+		AccessKeyId     string    `json:"AccessKeyId"`
+		SecretAccessKey string    `json:"SecretAccessKey"`
+		Token           string    `json:"Token"`
+		Expiration      time.Time `json:"Expiration"`
+	}
+	if err := json.NewDecoder(io.LimitReader(response.Body, 64<<10)).Decode(&result); err != nil {
+		return s3Credentials{}, fmt.Errorf("failed to parse credentials: %w", err)
+	}
+	if result.Code != "" && result.Code != "Success" {
+		return s3Credentials{}, fmt.Errorf("%s: %s", result.Code, result.Message)
+	}
+	return checkS3Credentials(s3Credentials{accessKey: result.AccessKeyId, secretKey: result.SecretAccessKey, sessionToken: result.Token, expires: result.Expiration})
+}
+
+// checkS3Credentials rejects credentials a source answered without keys
+func checkS3Credentials(credentials s3Credentials) (s3Credentials, error) {
+	if credentials.accessKey == "" || credentials.secretKey == "" {
+		return s3Credentials{}, fmt.Errorf("answer holds no access key")
+	}
+	return credentials, nil
+}
+
+// credentialEndpointError describes a failed response of a credential source
+func credentialEndpointError(response *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 1<<10))
+	if message := strings.TrimSpace(string(body)); message != "" {
+		return fmt.Errorf("%s: %s", response.Status, message)
+	}
+	return errors.New(response.Status)
+}
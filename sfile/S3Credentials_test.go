@@ -0,0 +1,224 @@
+package sfile
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// credentialsJSON is the answer of the container and instance metadata
+// endpoints for key expiring at expires
+func credentialsJSON(key string, expires time.Time) []byte {
+	content, _ := json.Marshal(map[string]any{
+		"Code":            "Success",
+		"AccessKeyId":     key,
+		"SecretAccessKey": "secret-" + key,
+		"Token":           "token-" + key,
+		"Expiration":      expires.UTC().Format(time.RFC3339),
+	})
+	return content
+}
+
+// TestContainerCredentials fetches credentials from a container endpoint that
+// requires the authorization token of a token file, as EKS Pod Identity does
+func TestContainerCredentials(t *testing.T) {
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/credentials" || r.Header.Get("Authorization") != "pod-token" {
+			http.Error(w, "denied", http.StatusForbidden)
+			return
+		}
+		w.Write(credentialsJSON("AKIACONTAINER", expires))
+	}))
+	defer server.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("pod-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	clearAWSEnvironment(t)
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", server.URL+"/v1/credentials")
+	t.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE", tokenFile)
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	cache, err := resolveS3Credentials(context.Background(), s3CredentialChain(filepath.Join(t.TempDir(), "missing"), "default", "us-east-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials, err := cache.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := s3Credentials{accessKey: "AKIACONTAINER", secretKey: "secret-AKIACONTAINER", sessionToken: "token-AKIACONTAINER", expires: expires}
+	if credentials.accessKey != want.accessKey || credentials.secretKey != want.secretKey ||
+		credentials.sessionToken != want.sessionToken || !credentials.expires.Equal(want.expires) {
+		t.Fatalf("credentials %+v, want %+v", credentials, want)
+	}
+}
+
+// TestInstanceCredentials fetches the credentials of the instance profile with
+// an IMDSv2 session token
+func TestInstanceCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			if r.Method != http.MethodPut || r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+				http.Error(w, "bad token request", http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, "session")
+			return
+		}
+		if r.Header.Get("X-aws-ec2-metadata-token") != "session" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/latest/meta-data/iam/security-credentials/":
+			fmt.Fprint(w, "tiles-role")
+		case "/latest/meta-data/iam/security-credentials/tiles-role":
+			w.Write(credentialsJSON("AKIAINSTANCE", time.Now().Add(6*time.Hour)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	clearAWSEnvironment(t)
+	t.Setenv("AWS_EC2_METADATA_SERVICE_ENDPOINT", server.URL)
+	cache, err := resolveS3Credentials(context.Background(), s3CredentialChain(filepath.Join(t.TempDir(), "missing"), "default", "us-east-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials, err := cache.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credentials.accessKey != "AKIAINSTANCE" || credentials.sessionToken != "token-AKIAINSTANCE" {
+		t.Fatalf("credentials %+v, want those of tiles-role", credentials)
+	}
+}
+
+// TestWebIdentityCredentials exchanges the token of a service account for the
+// credentials of a role with STS
+func TestWebIdentityCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("Action") != "AssumeRoleWithWebIdentity" || r.FormValue("WebIdentityToken") != "jwt" ||
+			r.FormValue("RoleArn") != "arn:aws:iam::123456789012:role/tiles" {
+			http.Error(w, "denied", http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>AKIAWEB</AccessKeyId>
+      <SecretAccessKey>secret-AKIAWEB</SecretAccessKey>
+      <SessionToken>token-AKIAWEB</SessionToken>
+      <Expiration>2099-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`)
+	}))
+	defer server.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("jwt"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	clearAWSEnvironment(t)
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile)
+	t.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/tiles")
+	t.Setenv("AWS_ENDPOINT_URL_STS", server.URL)
+	cache, err := resolveS3Credentials(context.Background(), s3CredentialChain(filepath.Join(t.TempDir(), "missing"), "default", "us-east-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials, _ := cache.get(context.Background())
+	if credentials.accessKey != "AKIAWEB" || credentials.sessionToken != "token-AKIAWEB" || credentials.expires.Year() != 2099 {
+		t.Fatalf("credentials %+v, want those of the role", credentials)
+	}
+}
+
+// TestCredentialsRefresh checks credentials are fetched again shortly before
+// they expire, and that expiring ones are kept while the source fails
+func TestCredentialsRefresh(t *testing.T) {
+	var fetches atomic.Int32
+	var failing atomic.Bool
+	start := time.Now()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		n := fetches.Add(1)
+		w.Write(credentialsJSON(fmt.Sprintf("AKIA%d", n), start.Add(time.Hour)))
+	}))
+	defer server.Close()
+
+	now := start
+	cache := newS3CredentialCache(containerS3Credentials{endpoint: server.URL, client: server.Client()})
+	cache.now = func() time.Time { return now }
+	get := func() string {
+		t.Helper()
+		credentials, err := cache.get(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return credentials.accessKey
+	}
+
+	if key := get(); key != "AKIA1" {
+		t.Fatalf("first credentials %s, want AKIA1", key)
+	}
+	now = start.Add(50 * time.Minute)
+	if key := get(); key != "AKIA1" || fetches.Load() != 1 {
+		t.Fatalf("credentials %s after %d fetches, want cached AKIA1", key, fetches.Load())
+	}
+	now = start.Add(56 * time.Minute)
+	if key := get(); key != "AKIA2" {
+		t.Fatalf("credentials %s within the refresh window, want AKIA2", key)
+	}
+
+	failing.Store(true)
+	now = start.Add(58 * time.Minute)
+	if key := get(); key != "AKIA2" {
+		t.Fatalf("credentials %s while the source fails, want the still valid AKIA2", key)
+	}
+	now = start.Add(61 * time.Minute)
+	if _, err := cache.get(context.Background()); err == nil {
+		t.Fatal("expired credentials handed out while the source fails")
+	}
+}
+
+// TestNoCredentials checks the chain reports every source it tried
+func TestNoCredentials(t *testing.T) {
+	clearAWSEnvironment(t)
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", "http://127.0.0.1:1/credentials")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	_, err := resolveS3Credentials(context.Background(), s3CredentialChain(filepath.Join(t.TempDir(), "missing"), "default", "us-east-1"))
+	var opErr interface{ Unwrap() []error }
+	if !errors.As(err, &opErr) || len(opErr.Unwrap()) != 1 {
+		t.Fatalf("error %v, want the failure of the container endpoint", err)
+	}
+}
+
+// clearAWSEnvironment unsets the variables of the credential chain for the
+// duration of the test
+func clearAWSEnvironment(t *testing.T) {
+	for _, name := range []string{
+		"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN",
+		"AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_ROLE_ARN", "AWS_ROLE_SESSION_NAME", "AWS_ENDPOINT_URL_STS",
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI",
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN", "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE",
+		"AWS_EC2_METADATA_DISABLED", "AWS_EC2_METADATA_SERVICE_ENDPOINT",
+	} {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+}
@@ -0,0 +1,329 @@
+package sfile
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/sync/singleflight"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// s3RevalidateInterval is how long a local copy is used before its ETag is checked again
+const s3RevalidateInterval = time.Minute
+
+// s3Roots are the s3:// repository roots configured with OpenS3Root, by URI
+var s3Roots = struct {
+	sync.RWMutex
+	roots map[string]*s3Root
+}{roots: make(map[string]*s3Root)}
+
+// s3Root serves the repositories stored below a prefix of an S3 bucket. The .s
+// files are copied to a local scratch directory before sqlite opens them.
+type s3Root struct {
+	bucket  string
+	prefix  string // ends with a slash unless empty
+	client  *s3Client
+	scratch *s3Scratch
+}
+
+// IsS3Root reports whether root is an s3://bucket/prefix URI rather than a local directory
+func IsS3Root(root string) bool {
+	return strings.HasPrefix(root, "s3://")
+}
+
+// OpenS3Root makes the repositories below uri, s3://bucket/prefix, available to
+// ScanRepositories, LoadRepository and OpenTileSource under that root. Local copies
+// of .s files are kept in the sirserver-s3 directory of scratchDir, which is
+// emptied first, and the least recently used are removed beyond scratchBytes.
+func OpenS3Root(uri string, scratchDir string, scratchBytes int64) error {
+	location, err := parseS3URI(uri)
+	if err != nil {
+		return err
+	}
+	client, err := newS3Client()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(scratchDir, "sirserver-s3")
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	location.client = client
+	location.scratch = newS3Scratch(dir, scratchBytes)
+	s3Roots.Lock()
+	defer s3Roots.Unlock()
+	s3Roots.roots[uri] = location
+	return nil
+}
+
+// parseS3URI splits s3://bucket/prefix
+func parseS3URI(uri string) (*s3Root, error) {
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(uri, "s3://"), "/")
+	if !IsS3Root(uri) || bucket == "" {
+		return nil, fmt.Errorf("invalid S3 root %q, expected s3://bucket/prefix", uri)
+	}
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3Root{bucket: bucket, prefix: prefix}, nil
+}
+
+// s3RootFor returns the opened S3 root of root
+func s3RootFor(root string) (*s3Root, bool) {
+	if !IsS3Root(root) {
+		return nil, false
+	}
+	s3Roots.RLock()
+	defer s3Roots.RUnlock()
+	location, ok := s3Roots.roots[root]
+	return location, ok
+}
+
+// key returns the object key of a path below the repository name
+func (r *s3Root) key(name string, elements ...string) string {
+	return r.prefix + path.Join(append([]string{name}, elements...)...)
+}
+
+// repositories lists a repository for every common prefix directly below the root
+func (r *s3Root) repositories(ctx context.Context) ([]Repository, error) {
+	prefixes, err := r.client.listPrefixes(ctx, r.bucket, r.prefix)
+	if err != nil {
+		return make([]Repository, 0), err
+	}
+	repositories := make([]Repository, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		name := strings.TrimSuffix(strings.TrimPrefix(prefix, r.prefix), "/")
+		if name == "" || strings.HasPrefix(name, ".") {
+			continue
+		}
+		repositories = append(repositories, r.metadata(ctx, name))
+	}
+	return repositories, nil
+}
+
+// metadata streams the repository.json object of the repository. Repositories
+// in S3 are not analysed, so one without repository.json gets default values.
+func (r *s3Root) metadata(ctx context.Context, name string) Repository {
+	body, _, err := r.client.getObject(ctx, r.bucket, r.key(name, "repository.json"), "")
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			RecordError("s3", err)
+		}
+		return defaultRepository(name)
+	}
+	defer body.Close()
+	var repo Repository
+	if err := json.NewDecoder(body).Decode(&repo); err != nil {
+		RecordError("s3", fmt.Errorf("parse s3://%s/%s: %w", r.bucket, r.key(name, "repository.json"), err))
+		return defaultRepository(name)
+	}
+	return repo
+}
+
+// s3Source reads the tiles of a repository of an S3 root
+type s3Source struct {
+	root *s3Root
+	name string
+}
+
+// GetTile copies the .s file holding the tile to the scratch directory, unless a
+// copy with the current ETag is there already, and reads the tile from it
+func (s s3Source) GetTile(ctx context.Context, z int8, x int64, y int64) (Tile, error) {
+	if err := checkTile(x, y, z); err != nil {
+		return Tile{}, err
+	}
+	local := &SRepository{dir: s.root.scratch.path(s.root.bucket, s.root.key(s.name))}
+	filePath, _, _ := local.shardLocation(x, y, z)
+	rel, err := filepath.Rel(local.dir, filePath)
+	if err != nil {
+		return Tile{}, err
+	}
+	key := s.root.key(s.name, filepath.ToSlash(rel))
+	for attempt := 0; ; attempt++ {
+		err := s.root.scratch.fetch(ctx, s.root, key)
+		if errors.Is(err, os.ErrNotExist) {
+			return Tile{}, fmt.Errorf("%w: s3://%s/%s not exist", ErrTileNotFound, s.root.bucket, key)
+		}
+		if err != nil {
+			return Tile{}, err
+		}
+		tile, err := local.GetTile(ctx, z, x, y)
+		if attempt == 0 && errors.Is(err, ErrTileNotFound) {
+			// the copy may have been evicted between the fetch and the read
+			if _, statErr := os.Stat(filePath); os.IsNotExist(statErr) {
+				continue
+			}
+		}
+		return tile, err
+	}
+}
+
+func (s s3Source) Metadata() Repository {
+	return s.root.metadata(context.Background(), s.name)
+}
+
+func (s s3Source) Close() error {
+	return nil
+}
+
+// s3Scratch is the LRU bounded directory of local copies of .s objects
+type s3Scratch struct {
+	dir    string
+	budget int64
+	flight singleflight.Group
+
+	mu      sync.Mutex
+	entries map[string]*list.Element // object key -> *s3ScratchEntry
+	order   *list.List               // most recently used first
+	used    int64
+}
+
+type s3ScratchEntry struct {
+	key     string
+	path    string
+	etag    string
+	size    int64
+	checked time.Time // when the ETag was last confirmed
+}
+
+func newS3Scratch(dir string, budget int64) *s3Scratch {
+	return &s3Scratch{dir: dir, budget: budget, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// path returns the local path of an object key
+func (s *s3Scratch) path(bucket string, key string) string {
+	return filepath.Join(s.dir, bucket, filepath.FromSlash(key))
+}
+
+// fetch makes sure an up to date copy of key is in the scratch directory. A
+// missing object is reported as os.ErrNotExist.
+func (s *s3Scratch) fetch(ctx context.Context, root *s3Root, key string) error {
+	s.mu.Lock()
+	if element, ok := s.entries[key]; ok {
+		entry := element.Value.(*s3ScratchEntry)
+		if time.Since(entry.checked) < s3RevalidateInterval {
+			s.order.MoveToFront(element)
+			s.mu.Unlock()
+			return nil
+		}
+	}
+	s.mu.Unlock()
+	// concurrent readers of the same file share one download, which must not end
+	// with the request that started it
+	_, err, _ := s.flight.Do(key, func() (interface{}, error) {
+		return nil, s.download(context.WithoutCancel(ctx), root, key)
+	})
+	return err
+}
+
+// download revalidates or copies the object key
+func (s *s3Scratch) download(ctx context.Context, root *s3Root, key string) error {
+	localPath := s.path(root.bucket, key)
+	etag := ""
+	s.mu.Lock()
+	if element, ok := s.entries[key]; ok {
+		etag = element.Value.(*s3ScratchEntry).etag
+	}
+	s.mu.Unlock()
+
+	body, newETag, err := root.client.getObject(ctx, root.bucket, key, etag)
+	if errors.Is(err, errS3NotModified) {
+		s.mu.Lock()
+		if element, ok := s.entries[key]; ok {
+			element.Value.(*s3ScratchEntry).checked = time.Now()
+			s.order.MoveToFront(element)
+		}
+		s.mu.Unlock()
+		return nil
+	}
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			s.remove(key)
+		} else {
+			RecordError("s3", err)
+		}
+		return err
+	}
+	defer body.Close()
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(localPath), ".download-*")
+	if err != nil {
+		return err
+	}
+	size, err := io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), localPath)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		RecordError("s3", fmt.Errorf("copy s3://%s/%s: %w", root.bucket, key, err))
+		return err
+	}
+	if absolute, err := filepath.Abs(localPath); err == nil {
+		handles.invalidate(absolute)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := &s3ScratchEntry{key: key, path: localPath, etag: newETag, size: size, checked: time.Now()}
+	if element, ok := s.entries[key]; ok {
+		s.used -= element.Value.(*s3ScratchEntry).size
+		element.Value = entry
+		s.order.MoveToFront(element)
+	} else {
+		s.entries[key] = s.order.PushFront(entry)
+	}
+	s.used += size
+	s.evict()
+	return nil
+}
+
+// remove forgets key and deletes its local copy
+func (s *s3Scratch) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if element, ok := s.entries[key]; ok {
+		s.drop(element)
+	}
+}
+
+// evict removes the least recently used copies until the budget is met, always
+// keeping the most recent one. The caller must hold s.mu.
+func (s *s3Scratch) evict() {
+	for s.used > s.budget && s.order.Len() > 1 {
+		s.drop(s.order.Back())
+	}
+}
+
+// drop deletes the copy of element. The caller must hold s.mu.
+func (s *s3Scratch) drop(element *list.Element) {
+	entry := element.Value.(*s3ScratchEntry)
+	s.order.Remove(element)
+	delete(s.entries, entry.key)
+	s.used -= entry.size
+	if absolute, err := filepath.Abs(entry.path); err == nil {
+		handles.invalidate(absolute)
+	}
+	if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+		log.Printf("Removing scratch copy %s failed: %v", entry.path, err)
+	}
+}
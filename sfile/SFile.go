@@ -2,54 +2,216 @@ package sfile
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	_ "github.com/mattn/go-sqlite3"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
 )
 
 type SRepository struct {
-	dir string
+	dir      string
+	root     string // set by OpenTileSource, with name, to find the repository.json
+	name     string
+	scheme   ShardScheme       // recorded in repository.json, see shards
+	grid     TileGrid          // declared in repository.json, mercator when ""
+	ttl      time.Duration     // how long tiles are served after they were written, 0 for ever
+	compress bool              // text-like tiles are stored gzipped, see compressTile
+	indexed  bool              // misses are answered from the existence index, see knownAbsent
+	temporal *TemporalSettings // earlier versions of tiles are kept, see Temporal.go
+	flat     bool              // the .s files lie in dir itself, see Layout.go
 }
 
-// GetXYZ returns the content of the XYZ file
+// Errors telling a missing tile or repository apart from failures reading it.
+// A tile whose .s file does not exist matches both ErrTileNotFound and
+// ErrShardNotFound; I/O and sqlite failures wrap their cause and match neither.
+var (
+	// ErrTileNotFound is returned when a repository does not hold the requested tile
+	ErrTileNotFound = errors.New("tile not found")
+	// ErrShardNotFound is returned when the .s file that would hold a tile does not exist
+	ErrShardNotFound = errors.New("shard not found")
+	// ErrRepositoryNotFound is returned when a repository directory does not exist
+	ErrRepositoryNotFound = errors.New("repository not found")
+)
+
+// validTableName matches the shard table names produced by shardLocation
+var validTableName = regexp.MustCompile(`^[A-Z]{1,2}_\d+_\d+$`)
+
+// checkTile rejects zooms the shard naming cannot address and coordinates
+// outside the web mercator world
+func checkTile(x int64, y int64, z int8) error {
+	return GridMercator.checkTile(x, y, z)
+}
+
+// GetXYZ returns the content of the XYZ file, decompressed when it is stored compressed
 func (f SRepository) GetXYZ(x int64, y int64, z int8) (*bytes.Buffer, error) {
-	vz := max(z, 9)
-	subDir := fmt.Sprintf("%c", 'A'+vz)
-	dbFile := fmt.Sprintf("%c_%d_%d.s", 'A'+vz, x/256, y/256)
-	filePath := filepath.Join(f.dir, subDir, dbFile)
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		log.Print(err)
-		return nil, fmt.Errorf("%s not exist", filePath)
+	tile, err := f.getXYZ(context.Background(), x, y, z)
+	if err != nil {
+		return nil, err
 	}
-	db, err := sql.Open("sqlite3", filePath)
+	data, err := DecodeTile(tile.data.Bytes(), tile.encoding)
 	if err != nil {
+		return nil, fmt.Errorf("decode %d/%d/%d: %w", z, x, y, err)
+	}
+	return bytes.NewBuffer(data), nil
+}
+
+// storedTile is a tile as read from its .s file
+type storedTile struct {
+	data     *bytes.Buffer
+	format   string    // recorded by the .s file, see recordShardFormat
+	written  time.Time // recorded with the row, zero for rows written before write times were
+	encoding string    // EncodingGzip when the row is stored compressed, see Compress.go
+}
+
+// getXYZ reads a tile, stopping the query when ctx ends. Coordinates outside the
+// world are rejected before anything reaches sqlite. In a repository with a TTL
+// an expired tile is reported as missing, see ErrTileExpired.
+func (f SRepository) getXYZ(ctx context.Context, x int64, y int64, z int8) (storedTile, error) {
+	if err := f.grid.checkTile(x, y, z); err != nil {
+		return storedTile{}, err
+	}
+	filePath, tableName, index := f.shardLocation(x, y, z)
+	if !validTableName.MatchString(tableName) {
+		return storedTile{}, fmt.Errorf("invalid shard table %q", tableName)
+	}
+	if f.indexed && f.knownAbsent(x, y, z) {
+		return storedTile{}, fmt.Errorf("%w: %d/%d/%d not in the existence index of %s", ErrTileNotFound, z, x, y, f.dir)
+	}
+	shard, release, err := acquireShardRetrying(ctx, filePath)
+	if os.IsNotExist(err) {
+		return storedTile{}, fmt.Errorf("%w: %w: %s", ErrTileNotFound, ErrShardNotFound, filePath)
+	}
+	if err != nil {
+		err = fmt.Errorf("open %s: %w", filePath, err)
 		log.Print(err)
-		return nil, err
+		RecordError("sfile", err)
+		return storedTile{}, err
+	}
+	defer release()
+	var row tileRow
+	err = retryTransient(ctx, func() (err error) {
+		row, err = shard.readTile(ctx, tableName, index)
+		return err
+	})
+	// a missing table only means the tile was never stored
+	if err != nil && strings.Contains(err.Error(), "no such table") {
+		return storedTile{}, fmt.Errorf("%w: %s not exist in %s", ErrTileNotFound, tableName, filePath)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return storedTile{}, fmt.Errorf("%w: %d/%d/%d not exist in %s", ErrTileNotFound, z, x, y, filePath)
 	}
-	defer db.Close()
-	tableName := fmt.Sprintf("%c_%d_%d", 'A'+vz, x/64, y/64)
-	index := x%64 + 64*(y%64)
-	selectSql := fmt.Sprintf("select Data from %s where ID=%d", tableName, index)
-	rows, err := db.Query(selectSql)
 	if err != nil {
-		return nil, err
+		err = fmt.Errorf("read %d/%d/%d from %s: %w", z, x, y, filePath, err)
+		if ctx.Err() == nil {
+			RecordError("sfile", err)
+		}
+		return storedTile{}, err
 	}
-	defer rows.Close()
-	if rows.Next() {
-		var data []byte
-		err = rows.Scan(&data)
+	data := row.data
+	// rows written before tiles recorded their write time carry none and never expire
+	tile := storedTile{data: bytes.NewBuffer(data), format: shard.format, encoding: row.encoding.String}
+	if row.written.Valid {
+		tile.written = time.Unix(row.written.Int64, 0)
+	}
+	if f.ttl > 0 && !tile.written.IsZero() && time.Since(tile.written) >= f.ttl {
+		return storedTile{}, fmt.Errorf("%w: %w: %d/%d/%d in %s was written %s ago", ErrTileNotFound, ErrTileExpired, z, x, y, filePath, time.Since(tile.written).Round(time.Second))
+	}
+	if verifyReads.Load() && !shard.verifyTile(ctx, tableName, index, data, TileCoord{Z: z, X: x, Y: y}) && canQuarantine(filePath) {
+		err := quarantineTile(f.dir, f.shards(), filePath, tableName, index, TileCoord{Z: z, X: x, Y: y}, "does not match its checksum")
+		if err == nil {
+			return storedTile{}, fmt.Errorf("%w: %w: %d/%d/%d in %s does not match its checksum", ErrTileNotFound, ErrTileQuarantined, z, x, y, filePath)
+		}
+		RecordError("sfile", fmt.Errorf("quarantine %d/%d/%d in %s: %w", z, x, y, filePath, err))
+	}
+	return tile, nil
+}
+
+// tileRow is a row of a shard table as read by readTile
+type tileRow struct {
+	data     []byte
+	written  sql.NullInt64  // NULL when the table or the row records no write time
+	encoding sql.NullString // NULL when the table or the row records no encoding
+}
+
+// tileRead is the query of readTile for one table, with the schema version of
+// the file it was built for
+type tileRead struct {
+	query  string
+	schema int64
+}
+
+// tileReadQuery returns the query reading the blob, write time and encoding of
+// a row of tableName, NULL for the columns the table lacks. The columns are
+// looked at only once per table and schema version.
+func (e *handleEntry) tileReadQuery(tableName string) (tileRead, error) {
+	e.stmtMu.Lock()
+	read, ok := e.readQueries[tableName]
+	e.stmtMu.Unlock()
+	if ok {
+		return read, nil
+	}
+	if err := e.db.QueryRow("pragma schema_version").Scan(&read.schema); err != nil {
+		return tileRead{}, err
+	}
+	written, err := optionalColumn(e.db, tableName, "Written")
+	if err != nil {
+		return tileRead{}, err
+	}
+	encoding, err := encodingColumn(e.db, tableName)
+	if err != nil {
+		return tileRead{}, err
+	}
+	read.query = "select " + tileData(tableName, e.dedup) + ", " + written + ", " + encoding +
+		", (select schema_version from pragma_schema_version) from " + tableName + " where ID=?"
+	e.stmtMu.Lock()
+	if e.readQueries == nil {
+		e.readQueries = make(map[string]tileRead)
+	}
+	e.readQueries[tableName] = read
+	e.stmtMu.Unlock()
+	return read, nil
+}
+
+// readTile reads row id of tableName in a single statement, so the blob, its
+// write time and its encoding are of the same version of the row even while
+// writers replace it: a compressed blob is never paired with the encoding of a
+// plain one, or the other way round. When a writer added a column since the
+// query was built, it is built again and the row read again.
+func (e *handleEntry) readTile(ctx context.Context, tableName string, id int64) (tileRow, error) {
+	for attempt := 0; ; attempt++ {
+		read, err := e.tileReadQuery(tableName)
+		if err != nil {
+			return tileRow{}, err
+		}
+		stmt, err := e.statement(ctx, read.query)
 		if err != nil {
-			return nil, err
+			return tileRow{}, err
 		}
-		return bytes.NewBuffer(data), nil
+		var row tileRow
+		var schema int64
+		if err := stmt.QueryRowContext(ctx, id).Scan(&row.data, &row.written, &row.encoding, &schema); err != nil {
+			return tileRow{}, err
+		}
+		if schema == read.schema || attempt > 0 {
+			return row, nil
+		}
+		e.stmtMu.Lock()
+		delete(e.readQueries, tableName)
+		e.stmtMu.Unlock()
 	}
-	return nil, fmt.Errorf("%s not exist", filePath)
 }
 
-// NewRepository creates a new SRepository
+// NewRepository creates a new SRepository using the shard scheme recorded in its
+// repository.json. A missing directory is reported as ErrRepositoryNotFound,
+// even when created makes it.
 func NewRepository(dir string, created bool) (*SRepository, error) {
 	info, err := os.Stat(dir)
 	if os.IsNotExist(err) {
@@ -59,10 +221,405 @@ func NewRepository(dir string, created bool) (*SRepository, error) {
 				return nil, err
 			}
 		}
-		return &SRepository{dir: dir}, fmt.Errorf("%s not exist", dir)
+		return &SRepository{dir: dir}, fmt.Errorf("%w: %s", ErrRepositoryNotFound, dir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open repository %s: %w", dir, err)
 	}
 	if info.IsDir() {
-		return &SRepository{dir: dir}, nil
+		return openRepository(dir)
+	}
+	return nil, fmt.Errorf("%w: %s is not a directory", ErrRepositoryNotFound, dir)
+}
+
+// TileCoord identifies a tile in the XYZ scheme
+type TileCoord struct {
+	Z int8  `json:"z"`
+	X int64 `json:"x"`
+	Y int64 `json:"y"`
+}
+
+// shardLocation returns the .s file, the table inside it and the row ID holding
+// tile x/y/z under the shard scheme and in the layout of the repository
+func (f SRepository) shardLocation(x int64, y int64, z int8) (string, string, int64) {
+	scheme := f.shards()
+	filePath := filepath.Join(f.dir, zoomName(z), shardName(z, x/scheme.File, y/scheme.File)+".s")
+	if f.flat {
+		filePath = filepath.Join(f.dir, shardName(z, x/scheme.File, y/scheme.File)+".s")
+	}
+	tableName := shardName(z, x/scheme.Table, y/scheme.Table)
+	return filePath, tableName, x%scheme.Table + scheme.Table*(y%scheme.Table)
+}
+
+// ListTiles calls fn for every tile stored at zoom z, reading only row IDs. A
+// zoom without tiles lists nothing, a missing repository is ErrRepositoryNotFound.
+func (f SRepository) ListTiles(z int8, fn func(x int64, y int64) error) error {
+	if err := checkZoom(int(z)); err != nil {
+		return err
+	}
+	files, err := listAllFile(filepath.Join(f.dir, zoomName(z)))
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(f.dir); os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s", ErrRepositoryNotFound, f.dir)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := listShardTiles(file, f.shards(), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func listShardTiles(filePath string, scheme ShardScheme, fn func(x int64, y int64) error) error {
+	shard, release, err := acquireShardRetrying(context.Background(), filePath)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", filePath, err)
+	}
+	defer release()
+	db := shard.db
+	tableNames, err := listTables(db)
+	if err != nil {
+		return err
+	}
+	for _, tableName := range tableNames {
+		if !validTableName.MatchString(tableName) {
+			continue
+		}
+		_, tableX, tableY, ok := parseShardName(tableName)
+		if !ok {
+			continue
+		}
+		rows, err := db.Query("select ID from " + tableName)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id int64
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			if err := fn(scheme.tileOf(tableX, tableY, id)); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrEmptyTile is returned when a tile without data is written
+var ErrEmptyTile = errors.New("tile data is empty")
+
+// shardBusyTimeout is how long a connection waits for a shard locked by another
+// connection before sqlite reports it busy
+const shardBusyTimeout = 5 * time.Second
+
+// writeLocks serializes writers of the same .s file within this process
+var writeLocks sync.Map
+
+// openShardForWrite locks the repository of the .s file at filePath against
+// writers of other processes, see lockRepository, and the file against other
+// writers of this process, and opens it with a busy timeout for the connections
+// of other processes. A file created here is switched to WAL journaling, so
+// readers are not locked out while it is written, unless the SQLiteTuning sets
+// another journal mode for all files written. The returned function drops
+// any cached read handle of the file, closes the database and releases the locks.
+func openShardForWrite(filePath string) (*sql.DB, func(), error) {
+	absolute, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	unlockRepository, err := lockRepository(shardRepository(absolute))
+	if err != nil {
+		return nil, nil, err
+	}
+	value, _ := writeLocks.LoadOrStore(absolute, &sync.Mutex{})
+	lock := value.(*sync.Mutex)
+	lock.Lock()
+	unlock := func() {
+		lock.Unlock()
+		unlockRepository()
+	}
+	_, statErr := os.Stat(absolute)
+	dsn := fmt.Sprintf("%s?_busy_timeout=%d&_synchronous=%s&_txlock=immediate", absolute, shardBusyTimeout.Milliseconds(), writeSynchronous())
+	journal := writeJournalMode()
+	if journal != "" {
+		dsn += "&_journal_mode=" + journal
+		// leaving WAL mode needs the file to itself, idle cached readers included
+		handles.invalidate(absolute)
+	}
+	db, err := openShard(dsn)
+	if err != nil {
+		unlock()
+		return nil, nil, err
+	}
+	if journal == "" && errors.Is(statErr, os.ErrNotExist) {
+		// the journal mode is stored in the file, so it outlives this connection
+		if _, err := db.Exec("pragma journal_mode=wal"); err != nil {
+			_ = closeShard(db)
+			unlock()
+			return nil, nil, err
+		}
+	}
+	return db, func() {
+		// closing the last connection of the file checkpoints its WAL back into
+		// the .s file, so the cached readers go first
+		handles.invalidate(absolute)
+		_ = closeShard(db)
+		unlock()
+	}, nil
+}
+
+// WriteXYZ stores data as tile x/y/z, creating the zoom directory, the .s file
+// and its 64x64 table when they do not exist yet, and replacing any tile already
+// stored there. Writers of the same file are serialized. The time of the write
+// is recorded with the tile, and so is its encoding when the repository
+// compresses it. A temporal repository keeps the tile replaced as an earlier
+// version, see WriteXYZAt.
+func (f *SRepository) WriteXYZ(x int64, y int64, z int8, data []byte) error {
+	if err := f.grid.checkTile(x, y, z); err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return ErrEmptyTile
+	}
+	filePath, tableName, id := f.shardLocation(x, y, z)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	db, done, err := openShardForWriteRetrying(filePath)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	stored, encoding := f.encodeTile(data)
+	err = retryTransient(context.Background(), func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		dedup, err := prepareShardWrite(tx)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if err := createShardTable(tx, tableName, dedup); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if _, err := insertTile(tx, "insert or replace", tableName, id, x, y, stored, dedup); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if err := stampEncoding(tx, tableName, id, encoding); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if err := addWrittenColumn(tx, tableName); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		now := time.Now()
+		if err := stampTile(tx, tableName, id, now); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if err := f.keepVersion(tx, tableName, id, now, stored, encoding); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if err := recordShardFormat(tx, dedup, map[string]bool{tileFormat(data): true}); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+	if err == nil {
+		addSize(f.dir, float64(len(stored)))
+		noteTiles(f.dir, f.shards(), filePath, []TileCoord{{Z: z, X: x, Y: y}}, true)
+	}
+	return err
+}
+
+// TileData is a tile and its blob, as written in batches
+type TileData struct {
+	TileCoord
+	Data []byte
+}
+
+// writeTiles stores tiles grouping them by .s file, one transaction per file.
+// Tiles already stored are replaced when overwrite is set and kept otherwise.
+// It returns how many tiles were written and how many were skipped.
+func (f *SRepository) writeTiles(tiles []TileData, overwrite bool) (int64, int64, error) {
+	byFile := make(map[string][]TileData)
+	files := make([]string, 0)
+	for _, tile := range tiles {
+		if err := f.grid.checkTile(tile.X, tile.Y, tile.Z); err != nil {
+			return 0, 0, err
+		}
+		if len(tile.Data) == 0 {
+			return 0, 0, fmt.Errorf("tile %d/%d/%d: %w", tile.Z, tile.X, tile.Y, ErrEmptyTile)
+		}
+		filePath, _, _ := f.shardLocation(tile.X, tile.Y, tile.Z)
+		if _, ok := byFile[filePath]; !ok {
+			files = append(files, filePath)
+		}
+		byFile[filePath] = append(byFile[filePath], tile)
+	}
+	var written, skipped int64
+	for _, filePath := range files {
+		tiles := byFile[filePath]
+		n, failed, err := f.writeShardTiles(filePath, tiles, overwrite)
+		if err != nil {
+			return written, skipped, err
+		}
+		written += n
+		skipped += int64(len(tiles)-len(failed)) - n
+		for i, tile := range tiles {
+			// the other tiles of the file are written, the first failure ends the batches
+			if err, ok := failed[i]; ok {
+				return written, skipped, fmt.Errorf("tile %d/%d/%d: %w", tile.Z, tile.X, tile.Y, err)
+			}
+		}
+	}
+	return written, skipped, nil
+}
+
+// writeShardTiles stores tiles that all belong to the .s file at filePath in one
+// transaction. A tile whose row cannot be written is left out and the others
+// written without it; failed holds the error of each tile left out by its index
+// in tiles. An error is returned when the file cannot be written at all.
+func (f *SRepository) writeShardTiles(filePath string, tiles []TileData, overwrite bool) (written int64, failed map[int]error, err error) {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return 0, nil, err
+	}
+	db, done, err := openShardForWriteRetrying(filePath)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer done()
+
+	failed = make(map[int]error)
+	err = retryTransient(context.Background(), func() (err error) {
+		written, err = f.insertShardTiles(db, tiles, overwrite, failed)
+		return err
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	// tiles skipped as already stored are present too
+	coords := make([]TileCoord, 0, len(tiles))
+	for i, tile := range tiles {
+		if _, ok := failed[i]; !ok {
+			coords = append(coords, tile.TileCoord)
+		}
+	}
+	noteTiles(f.dir, f.shards(), filePath, coords, true)
+	return written, failed, nil
+}
+
+// insertShardTiles writes the tiles not in failed to the open .s file db in one
+// transaction, each statement prepared once. A tile whose row sqlite rejects,
+// see isTileError, is added to failed and the transaction written again without
+// it; any other failure rolls the transaction back and is returned.
+func (f *SRepository) insertShardTiles(db *sql.DB, tiles []TileData, overwrite bool, failed map[int]error) (int64, error) {
+	for {
+		written, bytesWritten, bad, err := f.insertShardTx(db, tiles, overwrite, failed)
+		if bad >= 0 {
+			failed[bad] = err
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		addSize(f.dir, float64(bytesWritten))
+		return written, nil
+	}
+}
+
+// insertShardTx runs one transaction of insertShardTiles. When the row of a tile
+// is rejected the transaction is rolled back and bad is its index, -1 otherwise.
+func (f *SRepository) insertShardTx(db *sql.DB, tiles []TileData, overwrite bool, failed map[int]error) (written int64, bytesWritten int64, bad int, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, -1, err
+	}
+	verb := "insert or ignore"
+	if overwrite {
+		verb = "insert or replace"
+	}
+	dedup, err := prepareShardWrite(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, 0, -1, err
+	}
+	statements := newTxStatements(tx)
+	created := make(map[string]bool)
+	formats := make(map[string]bool)
+	now := time.Now()
+	for i, tile := range tiles {
+		if _, ok := failed[i]; ok {
+			continue
+		}
+		_, tableName, id := f.shardLocation(tile.X, tile.Y, tile.Z)
+		if !created[tableName] {
+			if err := createShardTable(tx, tableName, dedup); err != nil {
+				_ = tx.Rollback()
+				return 0, 0, -1, err
+			}
+			if err := addWrittenColumn(tx, tableName); err != nil {
+				_ = tx.Rollback()
+				return 0, 0, -1, err
+			}
+			if f.temporal != nil {
+				if err := createVersionsTable(tx, tableName); err != nil {
+					_ = tx.Rollback()
+					return 0, 0, -1, err
+				}
+			}
+			created[tableName] = true
+		}
+		stored, encoding := f.encodeTile(tile.Data)
+		n, err := insertTile(statements, verb, tableName, id, tile.X, tile.Y, stored, dedup)
+		if err == nil && n > 0 {
+			err = stampTile(statements, tableName, id, now)
+			if err == nil {
+				err = stampEncoding(tx, tableName, id, encoding)
+			}
+			if err == nil && f.temporal != nil {
+				err = recordVersion(statements, tableName, id, now, stored, encoding)
+			}
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			if isTileError(err) {
+				return 0, 0, i, err
+			}
+			return 0, 0, -1, err
+		}
+		if n > 0 {
+			bytesWritten += int64(len(stored))
+			formats[tileFormat(tile.Data)] = true
+		}
+		written += n
+	}
+	if err := recordShardFormat(tx, dedup, formats); err != nil {
+		_ = tx.Rollback()
+		return 0, 0, -1, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, -1, err
 	}
-	return nil, fmt.Errorf("%s is not a directory", dir)
+	return written, bytesWritten, -1, nil
 }
@@ -0,0 +1,412 @@
+package sfile
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentReadWriteShard reads and writes tiles of one shard from many
+// goroutines at once; busy shards must be waited out, never surfaced. Run it
+// with -race.
+func TestConcurrentReadWriteShard(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "repo")
+	if _, err := NewRepository(dir, true); !errors.Is(err, ErrRepositoryNotFound) {
+		t.Fatalf("creating the repository: %v", err)
+	}
+	repo, err := NewRepository(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const (
+		z       = 10
+		workers = 8
+		rounds  = 50
+	)
+	// the tiles x, y of 0..3 share a shard under every scheme
+	if err := repo.WriteXYZ(0, 0, z, []byte("seed")); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*workers*rounds)
+	for w := 0; w < workers; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				x, y := int64(i%4), int64(w%4)
+				if err := repo.WriteXYZ(x, y, z, []byte(fmt.Sprintf("tile %d %d", w, i))); err != nil {
+					errs <- fmt.Errorf("write %d/%d/%d: %w", z, x, y, err)
+				}
+			}
+		}(w)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				x, y := int64(i%4), int64((w+1)%4)
+				if _, err := repo.GetXYZ(x, y, z); err != nil && !errors.Is(err, ErrTileNotFound) {
+					errs <- fmt.Errorf("read %d/%d/%d: %w", z, x, y, err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if _, err := repo.GetXYZ(0, 0, z); err != nil {
+		t.Errorf("reading the seeded tile: %v", err)
+	}
+}
+
+// newTestRepository creates the repository "repo" under a new repository root
+// and returns it with the root, with a repository.json holding info unless info
+// is empty
+func newTestRepository(t testing.TB, info string) (*SRepository, string) {
+	t.Helper()
+	root := t.TempDir()
+	dir := filepath.Join(root, "repo")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if info != "" {
+		if err := os.WriteFile(filepath.Join(dir, "repository.json"), []byte(info), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	repo, err := NewRepository(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { FlushHandles(func(path string) bool { return strings.HasPrefix(path, root) }) })
+	return repo, root
+}
+
+// writeFixtureShard writes the tiles of one zoom straight into .s files laid out
+// as the original tooling does, without going through WriteXYZ: a letter
+// directory per zoom, 256x256 tiles per file and 64x64 per table, rows keyed
+// by x%64 + 64*(y%64)
+func writeFixtureShard(t *testing.T, dir string, z int, tiles map[[2]int64]string) {
+	t.Helper()
+	letter := string(rune('A' + z))
+	for xy, data := range tiles {
+		x, y := xy[0], xy[1]
+		file := filepath.Join(dir, letter, fmt.Sprintf("%s_%d_%d.s", letter, x/256, y/256))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		db, err := sql.Open("sqlite3", file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		table := fmt.Sprintf("%s_%d_%d", letter, x/64, y/64)
+		_, err = db.Exec("create table if not exists " + table + " (ID INTEGER PRIMARY KEY, X INTEGER, Y INTEGER, Data BLOB)")
+		if err == nil {
+			_, err = db.Exec("insert into "+table+" (ID, X, Y, Data) values (?, ?, ?, ?)", x%64+64*(y%64), x, y, []byte(data))
+		}
+		db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestGetXYZZooms reads tiles of zooms 0 to 12 from a fixture repository. Zoom 9
+// holds tiles at the same x/y as the lower zooms, so a read clamped to zoom 9
+// returns the wrong tile rather than passing by accident.
+func TestGetXYZZooms(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "fixture")
+	tests := []struct {
+		z    int
+		x, y int64
+	}{
+		{0, 0, 0},
+		{1, 1, 0},
+		{2, 3, 2},
+		{3, 5, 7},
+		{4, 15, 0},
+		{5, 17, 30},
+		{6, 63, 1},
+		{7, 64, 65},
+		{8, 255, 128},
+		{9, 300, 257},
+		{10, 1023, 512},
+		{11, 1500, 2047},
+		{12, 4095, 4000},
+	}
+	clash := make(map[[2]int64]string)
+	for _, test := range tests {
+		tile := fmt.Sprintf("tile %d/%d/%d", test.z, test.x, test.y)
+		writeFixtureShard(t, dir, test.z, map[[2]int64]string{{test.x, test.y}: tile})
+		if test.z < 9 {
+			clash[[2]int64{test.x, test.y}] = "zoom 9 " + tile
+		}
+	}
+	writeFixtureShard(t, dir, 9, clash)
+	repo, err := NewRepository(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { FlushHandles(func(path string) bool { return strings.HasPrefix(path, dir) }) })
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("zoom %d", test.z), func(t *testing.T) {
+			want := fmt.Sprintf("tile %d/%d/%d", test.z, test.x, test.y)
+			xyz, err := repo.GetXYZ(test.x, test.y, int8(test.z))
+			if err != nil {
+				t.Fatalf("GetXYZ(%d, %d, %d): %v", test.x, test.y, test.z, err)
+			}
+			if xyz.String() != want {
+				t.Fatalf("GetXYZ(%d, %d, %d) = %q, want %q", test.x, test.y, test.z, xyz.String(), want)
+			}
+			// the neighbouring tile of the same zoom is not stored
+			if _, err := repo.GetXYZ(test.x^1, test.y, int8(test.z)); test.z > 0 && !errors.Is(err, ErrTileNotFound) {
+				t.Fatalf("GetXYZ(%d, %d, %d) of a missing tile: %v, want ErrTileNotFound", test.x^1, test.y, test.z, err)
+			}
+		})
+	}
+	// a zoom without a letter directory is a clean not found
+	if _, err := repo.GetXYZ(0, 0, 13); !errors.Is(err, ErrTileNotFound) {
+		t.Fatalf("GetXYZ at zoom 13 without a directory: %v, want ErrTileNotFound", err)
+	}
+}
+
+// TestValidTableName checks only the names shardLocation produces pass as
+// shard tables, so no other text is ever spliced into a query
+func TestValidTableName(t *testing.T) {
+	for _, name := range []string{"A_0_0", "J_3_7", "AB_12_4095", "Z_0_0"} {
+		if !validTableName.MatchString(name) {
+			t.Errorf("%q rejected", name)
+		}
+	}
+	for _, name := range []string{
+		"", "A", "A_0", "A_0_0_0", "ABC_0_0", "a_0_0", "A_-1_0", "A_0_+1", "A_0x1_0",
+		"A_0_0 ", " A_0_0", "A_0_0\n", "A_0_0\x00", "A_0_0;", "A_0_0; drop table A_0_0",
+		"A_0_0 where 1=1 --", "A_0_0/*", "(select 1)", "meta", "blobs", "sqlite_master",
+		"A_１_0", "Ａ_0_0",
+	} {
+		if validTableName.MatchString(name) {
+			t.Errorf("%q accepted", name)
+		}
+	}
+}
+
+// TestHostileTileRequests reads tiles at coordinates no shard can hold and
+// checks they are refused before anything reaches sqlite: no shard is opened
+// and the repository is left as it was. The queries prepared for the valid
+// reads take the row ID as a parameter, one statement serving every tile.
+func TestHostileTileRequests(t *testing.T) {
+	repo, root := newTestRepository(t, "")
+	if err := repo.WriteXYZ(3, 5, 4, []byte("tile")); err != nil {
+		t.Fatal(err)
+	}
+	FlushHandles(func(path string) bool { return strings.HasPrefix(path, root) })
+	before := snapshotTree(t, root)
+
+	for _, tile := range []struct {
+		x, y int64
+		z    int8
+	}{
+		{-1, 0, 4}, {0, -1, 4}, {16, 0, 4}, {0, 16, 4},
+		{math.MinInt64, 0, 4}, {math.MaxInt64, math.MaxInt64, 4},
+		{0, 0, -1}, {0, 0, MaxTileZoom + 1}, {0, 0, math.MaxInt8}, {0, 0, math.MinInt8},
+		{1 << 40, 1 << 40, 20},
+	} {
+		if _, err := repo.GetXYZ(tile.x, tile.y, tile.z); err == nil || errors.Is(err, ErrTileNotFound) {
+			t.Errorf("GetXYZ(%d, %d, %d): %v, want the coordinates refused", tile.x, tile.y, tile.z, err)
+		}
+	}
+	if n := FlushHandles(func(path string) bool { return strings.HasPrefix(path, root) }); n != 0 {
+		t.Fatalf("%d shards opened for refused coordinates", n)
+	}
+	if after := snapshotTree(t, root); !maps.Equal(before, after) {
+		t.Fatalf("repository changed from %v to %v", before, after)
+	}
+
+	for x := int64(0); x < 4; x++ {
+		if _, err := repo.GetXYZ(x, 5, 4); err != nil && !errors.Is(err, ErrTileNotFound) {
+			t.Fatal(err)
+		}
+	}
+	handles.mu.Lock()
+	defer handles.mu.Unlock()
+	query := regexp.MustCompile(`^select .* from [A-Z]{1,2}_\d+_\d+ where ID=\?$`)
+	for element := handles.order.Front(); element != nil; element = element.Next() {
+		entry := element.Value.(*handleEntry)
+		if !strings.HasPrefix(entry.path, root) {
+			continue
+		}
+		entry.stmtMu.Lock()
+		for prepared := range entry.stmts {
+			if !query.MatchString(prepared) {
+				t.Errorf("statement %q prepared, want a read by ID", prepared)
+			}
+		}
+		if len(entry.stmts) != 1 {
+			t.Errorf("%d statements prepared for four tiles of one table, want 1", len(entry.stmts))
+		}
+		entry.stmtMu.Unlock()
+	}
+}
+
+// TestWriteXYZRoundTrip writes tiles on both sides of the table and file
+// boundaries of the default and a custom shard scheme, reads each back and
+// checks it landed in the .s file and table GetXYZ expects
+func TestWriteXYZRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		info   string
+		scheme ShardScheme
+	}{
+		{"default scheme", "", DefaultShardScheme},
+		{"16 by 4 scheme", `{"shard":{"file":16,"table":4}}`, ShardScheme{File: 16, Table: 4}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			repo, _ := newTestRepository(t, test.info)
+			const z = 12
+			file, table := test.scheme.File, test.scheme.Table
+			var tiles [][2]int64
+			for _, edge := range []int64{table, file, 3 * file} {
+				for _, x := range []int64{edge - 1, edge} {
+					for _, y := range []int64{edge - 1, edge} {
+						tiles = append(tiles, [2]int64{x, y})
+					}
+				}
+			}
+			// the last tile of the world
+			tiles = append(tiles, [2]int64{1<<z - 1, 1<<z - 1})
+			for _, tile := range tiles {
+				if err := repo.WriteXYZ(tile[0], tile[1], z, []byte(fmt.Sprintf("tile %d/%d", tile[0], tile[1]))); err != nil {
+					t.Fatalf("WriteXYZ(%d, %d, %d): %v", tile[0], tile[1], z, err)
+				}
+			}
+			for _, tile := range tiles {
+				x, y := tile[0], tile[1]
+				got, err := repo.GetXYZ(x, y, z)
+				if err != nil {
+					t.Fatalf("GetXYZ(%d, %d, %d): %v", x, y, z, err)
+				}
+				if want := fmt.Sprintf("tile %d/%d", x, y); got.String() != want {
+					t.Fatalf("GetXYZ(%d, %d, %d) = %q, want %q", x, y, z, got.String(), want)
+				}
+				shard := filepath.Join(repo.dir, "M", fmt.Sprintf("M_%d_%d.s", x/file, y/file))
+				db, err := sql.Open("sqlite3", shard+"?mode=ro")
+				if err != nil {
+					t.Fatal(err)
+				}
+				var data []byte
+				err = db.QueryRow(fmt.Sprintf("select Data from M_%d_%d where ID=?", x/table, y/table), x%table+table*(y%table)).Scan(&data)
+				db.Close()
+				if err != nil || string(data) != fmt.Sprintf("tile %d/%d", x, y) {
+					t.Fatalf("tile %d/%d in %s: %q, %v", x, y, shard, data, err)
+				}
+			}
+
+			// replacing a tile leaves its neighbours across the boundary alone
+			if err := repo.WriteXYZ(table, table, z, []byte("replaced")); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := repo.GetXYZ(table, table, z); err != nil || got.String() != "replaced" {
+				t.Fatalf("replaced tile: %v, %v", got, err)
+			}
+			if got, err := repo.GetXYZ(table-1, table-1, z); err != nil || got.String() != fmt.Sprintf("tile %d/%d", table-1, table-1) {
+				t.Fatalf("neighbour of the replaced tile: %v, %v", got, err)
+			}
+			if _, err := repo.GetXYZ(table+1, table, z); !errors.Is(err, ErrTileNotFound) {
+				t.Fatalf("tile never written: %v, want ErrTileNotFound", err)
+			}
+			if err := repo.WriteXYZ(0, 0, z, nil); !errors.Is(err, ErrEmptyTile) {
+				t.Fatalf("WriteXYZ of no data: %v, want ErrEmptyTile", err)
+			}
+		})
+	}
+}
+
+// TestErrorClassification checks each way a tile read can fail is told apart
+// with errors.Is: a missing repository, a missing shard, a missing table or
+// row, and a shard that cannot be read, which is none of the not found errors
+func TestErrorClassification(t *testing.T) {
+	repo, root := newTestRepository(t, "")
+	const z = 10
+	if err := repo.WriteXYZ(0, 0, z, []byte("tile")); err != nil {
+		t.Fatal(err)
+	}
+	// the tiles of x 512..767 lie in a shard of garbage
+	if err := os.WriteFile(filepath.Join(repo.dir, "K", "K_2_0.s"), bytes.Repeat([]byte("garbage "), 1024), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name                    string
+		x, y                    int64
+		tile, shard, repository bool // whether the error is each not found error
+	}{
+		{"stored", 0, 0, false, false, false},
+		{"missing row", 1, 0, true, false, false},
+		{"missing table", 100, 0, true, false, false},
+		{"missing shard", 300, 0, true, true, false},
+		{"unreadable shard", 600, 0, false, false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := repo.GetXYZ(test.x, test.y, z)
+			if test.name == "stored" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if errors.Is(err, ErrTileNotFound) != test.tile || errors.Is(err, ErrShardNotFound) != test.shard ||
+				errors.Is(err, ErrRepositoryNotFound) != test.repository {
+				t.Fatalf("%v: tile not found %v, shard not found %v, repository not found %v, want %v, %v, %v", err,
+					errors.Is(err, ErrTileNotFound), errors.Is(err, ErrShardNotFound), errors.Is(err, ErrRepositoryNotFound),
+					test.tile, test.shard, test.repository)
+			}
+		})
+	}
+
+	t.Run("missing repository", func(t *testing.T) {
+		missing := filepath.Join(root, "missing")
+		if _, err := NewRepository(missing, false); !errors.Is(err, ErrRepositoryNotFound) {
+			t.Fatalf("NewRepository of a missing directory: %v, want ErrRepositoryNotFound", err)
+		}
+		file := filepath.Join(root, "file")
+		if err := os.WriteFile(file, []byte("not a directory"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewRepository(file, false); !errors.Is(err, ErrRepositoryNotFound) {
+			t.Fatalf("NewRepository of a file: %v, want ErrRepositoryNotFound", err)
+		}
+		gone, err := NewRepository(filepath.Join(root, "gone"), true)
+		if !errors.Is(err, ErrRepositoryNotFound) {
+			t.Fatalf("NewRepository creating the directory: %v, want ErrRepositoryNotFound", err)
+		}
+		if err := os.Remove(filepath.Join(root, "gone")); err != nil {
+			t.Fatal(err)
+		}
+		if err := gone.ListTiles(z, func(int64, int64) error { return nil }); !errors.Is(err, ErrRepositoryNotFound) {
+			t.Fatalf("ListTiles of a removed repository: %v, want ErrRepositoryNotFound", err)
+		}
+	})
+
+	t.Run("listing", func(t *testing.T) {
+		if err := repo.ListTiles(z+1, func(int64, int64) error { return nil }); err != nil {
+			t.Fatalf("ListTiles of a zoom without tiles: %v", err)
+		}
+		if err := repo.ListTiles(z, func(int64, int64) error { return nil }); err == nil || errors.Is(err, ErrTileNotFound) {
+			t.Fatalf("ListTiles of a zoom with an unreadable shard: %v, want the read failure", err)
+		}
+	})
+}
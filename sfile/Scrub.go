@@ -0,0 +1,468 @@
+package sfile
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The scrubber decodes a random sample of the tiles of every .s file in the
+// background, so tiles rotting on disk are found before users find them. It
+// walks the repositories and their files in name order and records after every
+// file where it got to, together with its findings, in a state file; a restart
+// resumes the pass after the last file scrubbed.
+
+const (
+	// DefaultScrubSample is the share of the tiles of every .s file decoded
+	DefaultScrubSample = 0.01
+	// DefaultScrubRate is how many tiles are decoded per second
+	DefaultScrubRate = 50
+	// DefaultScrubPauseLatency is the p95 tile latency above which scrubbing pauses
+	DefaultScrubPauseLatency = 250 * time.Millisecond
+	// scrubPausePoll is how often a paused scrubber checks whether serving calmed down
+	scrubPausePoll = 10 * time.Second
+	// maxScrubFindings is how many findings are kept, the oldest are dropped first
+	maxScrubFindings = 1000
+	// ScrubStateFileName is the state file of the scrubber in the repository root
+	ScrubStateFileName = ".scrub.json"
+)
+
+// ScrubFinding is a tile that could not be decoded, or a .s file whose tiles
+// could not be read
+type ScrubFinding struct {
+	Time        time.Time  `json:"time"`
+	Repository  string     `json:"repository"`
+	File        string     `json:"file,omitempty"` // relative to the repository, slash separated
+	Tile        *TileCoord `json:"tile,omitempty"` // unset when the file could not be read
+	Error       string     `json:"error"`
+	Quarantined bool       `json:"quarantined,omitempty"` // the tile was moved to the quarantine of its file, see SetQuarantine
+}
+
+// ScrubObserver receives the findings of the scrubber as they are found
+type ScrubObserver interface {
+	ScrubFinding(finding ScrubFinding)
+}
+
+// ScrubOptions control StartScrubber
+type ScrubOptions struct {
+	Interval  time.Duration // between the end of a pass over every repository and the start of the next
+	Sample    float64       // share of the tiles of every .s file decoded, DefaultScrubSample when 0
+	Rate      float64       // tiles decoded per second, DefaultScrubRate when 0, no limit when negative
+	StatePath string        // file the position and findings are kept in, nothing is kept when ""
+	Busy      func() bool   // scrubbing pauses while it returns true, e.g. while serving is slow
+	Observer  ScrubObserver // may be nil
+}
+
+// ScrubStatus is the state of a scrubber
+type ScrubStatus struct {
+	Paused     bool           `json:"paused"`
+	Repository string         `json:"repository,omitempty"` // of the file the running pass got to
+	File       string         `json:"file,omitempty"`       // last file of Repository scrubbed
+	LastPass   time.Time      `json:"last_pass"`            // when the last complete pass ended, zero before the first
+	Scrubbed   int64          `json:"scrubbed"`             // tiles decoded since the running pass started or resumed
+	Findings   []ScrubFinding `json:"findings"`             // oldest first
+}
+
+// Scrubber periodically decodes a sample of the tiles of every repository of a
+// catalog, see StartScrubber
+type Scrubber struct {
+	catalog *RepositoryCatalog
+	opts    ScrubOptions
+	limiter rateLimiter
+
+	mu     sync.Mutex
+	status ScrubStatus
+
+	cancel    context.CancelFunc
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// StartScrubber scrubs the repositories of catalog in the background, resuming
+// the pass recorded in the state file of opts. Close stops it.
+func StartScrubber(catalog *RepositoryCatalog, opts ScrubOptions) *Scrubber {
+	if opts.Sample <= 0 {
+		opts.Sample = DefaultScrubSample
+	}
+	if opts.Rate == 0 {
+		opts.Rate = DefaultScrubRate
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Scrubber{catalog: catalog, opts: opts, cancel: cancel, done: make(chan struct{})}
+	s.limiter.setRate(opts.Rate)
+	s.status.Findings = make([]ScrubFinding, 0)
+	if opts.StatePath != "" {
+		if err := s.load(); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: ignoring the scrub state %s: %v", opts.StatePath, err)
+		}
+	}
+	go s.run(ctx)
+	return s
+}
+
+// Close stops the scrubber, interrupting a running pass, and waits until it has
+func (s *Scrubber) Close() error {
+	s.closeOnce.Do(func() {
+		s.cancel()
+		<-s.done
+	})
+	return nil
+}
+
+// Status returns the position and the findings of the scrubber
+func (s *Scrubber) Status() ScrubStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.status
+	status.Findings = append(make([]ScrubFinding, 0, len(s.status.Findings)), s.status.Findings...)
+	return status
+}
+
+func (s *Scrubber) run(ctx context.Context) {
+	defer close(s.done)
+	s.mu.Lock()
+	resuming := s.status.Repository != ""
+	next := s.status.LastPass.Add(s.opts.Interval)
+	s.mu.Unlock()
+	for {
+		if !resuming {
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+		resuming = false
+		if err := s.pass(ctx); err != nil {
+			return
+		}
+		next = time.Now().Add(s.opts.Interval)
+	}
+}
+
+// pass scrubs every repository after the recorded position, returning an error
+// only when ctx ended
+func (s *Scrubber) pass(ctx context.Context) error {
+	repositories, _, err := s.catalog.List()
+	if err != nil {
+		log.Printf("Scrubbing skipped, the repositories cannot be listed: %v", err)
+		return nil
+	}
+	sort.Slice(repositories, func(i, j int) bool { return repositories[i].Name < repositories[j].Name })
+	s.mu.Lock()
+	fromRepository, fromFile := s.status.Repository, s.status.File
+	s.mu.Unlock()
+	for _, repo := range repositories {
+		if repo.Name < fromRepository {
+			continue
+		}
+		dir := filepath.Join(s.catalog.root, filepath.FromSlash(repo.Name))
+		if IsArchive(dir) {
+			continue
+		}
+		after := ""
+		if repo.Name == fromRepository {
+			after = fromFile
+		}
+		if err := s.scrubRepository(ctx, repo.Name, dir, after); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	s.status.Repository, s.status.File = "", ""
+	s.status.LastPass = time.Now()
+	s.status.Scrubbed = 0
+	s.mu.Unlock()
+	s.save()
+	return nil
+}
+
+// scrubRepository scrubs the files of the repository in dir whose relative name
+// sorts after after
+func (s *Scrubber) scrubRepository(ctx context.Context, name string, dir string, after string) error {
+	scheme, err := repositoryScheme(dir)
+	if err != nil {
+		s.addFinding(ScrubFinding{Repository: name, Error: err.Error()})
+		return nil
+	}
+	subDirs, err := listSubDir(dir)
+	if err != nil {
+		s.addFinding(ScrubFinding{Repository: name, Error: err.Error()})
+		return nil
+	}
+	files := make([]string, 0)
+	for _, sub := range subDirs {
+		subFiles, err := listAllFile(sub)
+		if err != nil {
+			s.addFinding(ScrubFinding{Repository: name, Error: err.Error()})
+			continue
+		}
+		files = append(files, subFiles...)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		if rel <= after {
+			continue
+		}
+		if err := s.scrubShard(ctx, name, dir, file, rel, scheme); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			s.addFinding(ScrubFinding{Repository: name, File: rel, Error: err.Error()})
+		}
+		s.mu.Lock()
+		s.status.Repository, s.status.File = name, rel
+		s.mu.Unlock()
+		s.save()
+	}
+	return nil
+}
+
+// scrubShard decodes the sampled tiles of one .s file of the repository in dir,
+// quarantining those that fail when SetQuarantine is on. The sampled IDs are
+// listed first and every tile is read on its own, so no read stays open while
+// the scrubber waits for its rate or for serving to calm down.
+func (s *Scrubber) scrubShard(ctx context.Context, repository string, dir string, filePath string, name string, scheme ShardScheme) error {
+	db, err := openShardForRead(filePath)
+	if err != nil {
+		return fmt.Errorf("cannot open: %w", err)
+	}
+	defer closeShard(db)
+	version, err := shardSchema(db)
+	if err != nil {
+		return err
+	}
+	dedup := version >= shardSchemaDedup
+	tableNames, err := listTables(db)
+	if err != nil {
+		return err
+	}
+	// random() is uniform over 64 bits, so are its low 20 bits
+	where := fmt.Sprintf(" where (random() & 1048575) < %d", int64(min(s.opts.Sample, 1)*1048576))
+	for _, tableName := range tableNames {
+		if !validTableName.MatchString(tableName) {
+			continue
+		}
+		z, tableX, tableY, ok := parseShardName(tableName)
+		if !ok {
+			continue
+		}
+		ids, err := sampleIDs(db, "select ID from "+tableName+where)
+		if err != nil {
+			return err
+		}
+		encoding, err := encodingColumn(db, tableName)
+		if err != nil {
+			return err
+		}
+		query := "select " + tileData(tableName, dedup) + ", " + encoding + " from " + tableName + " where ID = ?"
+		for _, id := range ids {
+			if err := s.waitTurn(ctx); err != nil {
+				return err
+			}
+			var data []byte
+			var stored sql.NullString
+			err := db.QueryRowContext(ctx, query, id).Scan(&data, &stored)
+			if err == sql.ErrNoRows {
+				// deleted since it was sampled
+				continue
+			}
+			if err == nil {
+				err = scrubTile(data, stored.String)
+			}
+			s.mu.Lock()
+			s.status.Scrubbed++
+			s.mu.Unlock()
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				x, y := scheme.tileOf(tableX, tableY, id)
+				tile := TileCoord{Z: z, X: x, Y: y}
+				finding := ScrubFinding{Repository: repository, File: name, Tile: &tile, Error: err.Error()}
+				if canQuarantine(filePath) {
+					if err := quarantineTile(dir, scheme, filePath, tableName, id, tile, finding.Error); err != nil {
+						log.Printf("Quarantining %s/%s tile %d/%d/%d failed: %v", repository, name, z, x, y, err)
+					} else {
+						finding.Quarantined = true
+					}
+				}
+				s.addFinding(finding)
+			}
+		}
+	}
+	return nil
+}
+
+// sampleIDs returns the IDs query selects
+func sampleIDs(db *sql.DB, query string) ([]int64, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// scrubTile decodes a tile stored as data with encoding: raster tiles as
+// images, gzipped vector tiles by gunzipping them. Raw protobuf and JSON have
+// nothing to check.
+func scrubTile(data []byte, encoding string) error {
+	if len(data) == 0 {
+		return ErrEmptyTile
+	}
+	decoded, err := DecodeTile(data, encoding)
+	if err != nil {
+		return fmt.Errorf("cannot decode the %s encoding: %w", encoding, err)
+	}
+	switch format := tileFormat(decoded); format {
+	case "png", "jpg", "webp", "gif":
+		if _, _, err := image.Decode(bytes.NewReader(decoded)); err != nil {
+			return fmt.Errorf("not a valid %s image: %w", format, err)
+		}
+	case "pbf":
+		if bytes.HasPrefix(decoded, []byte{0x1f, 0x8b}) {
+			if _, err := DecodeTile(decoded, EncodingGzip); err != nil {
+				return fmt.Errorf("not a valid gzipped vector tile: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// waitTurn waits for the rate of the scrubber, and for as long as serving is
+// busy, until ctx ends
+func (s *Scrubber) waitTurn(ctx context.Context) error {
+	if err := s.limiter.wait(ctx); err != nil {
+		return err
+	}
+	if s.opts.Busy == nil || !s.opts.Busy() {
+		return nil
+	}
+	s.setPaused(true)
+	defer s.setPaused(false)
+	for s.opts.Busy() {
+		timer := time.NewTimer(scrubPausePoll)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil
+}
+
+func (s *Scrubber) setPaused(paused bool) {
+	s.mu.Lock()
+	s.status.Paused = paused
+	s.mu.Unlock()
+	if paused {
+		log.Printf("Scrubbing paused while serving is slow")
+	} else {
+		log.Printf("Scrubbing resumed")
+	}
+}
+
+// addFinding records finding, dropping the oldest beyond maxScrubFindings, and
+// passes it to the observer
+func (s *Scrubber) addFinding(finding ScrubFinding) {
+	finding.Time = time.Now()
+	location := finding.Repository
+	if finding.File != "" {
+		location += "/" + finding.File
+	}
+	if finding.Tile != nil {
+		location += fmt.Sprintf(" tile %d/%d/%d", finding.Tile.Z, finding.Tile.X, finding.Tile.Y)
+	}
+	if finding.Quarantined {
+		log.Printf("Scrubbing %s: %s, quarantined", location, finding.Error)
+	} else {
+		log.Printf("Scrubbing %s: %s", location, finding.Error)
+	}
+	s.mu.Lock()
+	s.status.Findings = append(s.status.Findings, finding)
+	if excess := len(s.status.Findings) - maxScrubFindings; excess > 0 {
+		s.status.Findings = append(s.status.Findings[:0], s.status.Findings[excess:]...)
+	}
+	s.mu.Unlock()
+	if s.opts.Observer != nil {
+		s.opts.Observer.ScrubFinding(finding)
+	}
+}
+
+// scrubState is what the state file holds
+type scrubState struct {
+	Repository string         `json:"repository,omitempty"`
+	File       string         `json:"file,omitempty"`
+	LastPass   time.Time      `json:"last_pass"`
+	Findings   []ScrubFinding `json:"findings"`
+}
+
+// load restores the position and findings from the state file
+func (s *Scrubber) load() error {
+	content, err := os.ReadFile(s.opts.StatePath)
+	if err != nil {
+		return err
+	}
+	var state scrubState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return err
+	}
+	s.status.Repository, s.status.File, s.status.LastPass = state.Repository, state.File, state.LastPass
+	if state.Findings != nil {
+		s.status.Findings = state.Findings
+	}
+	return nil
+}
+
+// save writes the position and findings to the state file, replacing it at once
+// so a crash never leaves half of it behind
+func (s *Scrubber) save() {
+	if s.opts.StatePath == "" {
+		return
+	}
+	s.mu.Lock()
+	content, err := json.MarshalIndent(scrubState{
+		Repository: s.status.Repository,
+		File:       s.status.File,
+		LastPass:   s.status.LastPass,
+		Findings:   s.status.Findings,
+	}, "", "  ")
+	s.mu.Unlock()
+	if err != nil {
+		return
+	}
+	partial := fmt.Sprintf("%s.%d.partial", s.opts.StatePath, os.Getpid())
+	if err = os.WriteFile(partial, content, 0644); err == nil {
+		err = os.Rename(partial, s.opts.StatePath)
+	}
+	if err != nil {
+		_ = os.Remove(partial)
+		log.Printf("Warning: cannot save the scrub state: %v", err)
+	}
+}
@@ -0,0 +1,260 @@
+package sfile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultSeedWorkers is how many tiles Seed downloads at once
+	DefaultSeedWorkers = 2
+	// DefaultSeedRate is how many requests per second Seed makes, polite enough
+	// for public OSM style tile servers
+	DefaultSeedRate = 2
+	// DefaultSeedRetries is how many times a failed download is tried again
+	DefaultSeedRetries = 3
+	// DefaultSeedRetryDelay is the wait before the first retry, doubled for every next one
+	DefaultSeedRetryDelay = time.Second
+	// DefaultSeedUserAgent identifies Seed to upstreams when no other is set
+	DefaultSeedUserAgent = "SirServer tile seeder"
+)
+
+// SeedSource provides the tiles Seed stores
+type SeedSource interface {
+	// FetchTile returns the blob of tile x/y/z, an error wrapping ErrTileNotFound
+	// when the source does not have it
+	FetchTile(ctx context.Context, z int8, x int64, y int64) ([]byte, error)
+}
+
+// HTTPSeedSource fetches tiles from an XYZ URL template with {z}, {x} and {y}
+type HTTPSeedSource struct {
+	Template  string
+	Headers   map[string]string // sent with every request
+	UserAgent string            // DefaultSeedUserAgent when empty, unless Headers sets one
+	Client    *http.Client      // a client with a 30s timeout when nil
+}
+
+// FetchTile downloads tile x/y/z, a 404 or an empty body is ErrTileNotFound
+func (s HTTPSeedSource) FetchTile(ctx context.Context, z int8, x int64, y int64) ([]byte, error) {
+	client := s.Client
+	if client == nil {
+		client = upstream.client
+	}
+	headers := map[string]string{"User-Agent": s.UserAgent}
+	if s.UserAgent == "" {
+		headers["User-Agent"] = DefaultSeedUserAgent
+	}
+	for key, value := range s.Headers {
+		headers[key] = value
+	}
+	return fetchTile(ctx, client, upstreamURL(s.Template, z, x, y), headers)
+}
+
+// SeedOptions controls how Seed downloads
+type SeedOptions struct {
+	Workers      int           // concurrent downloads, DefaultSeedWorkers when not positive
+	Rate         float64       // requests per second over all workers, DefaultSeedRate when 0, no limit when negative
+	Retries      int           // further attempts of a failed download, DefaultSeedRetries when 0, none when negative
+	RetryDelay   time.Duration // wait before the first retry, DefaultSeedRetryDelay when not positive
+	SkipExisting bool          // keep the tiles stored already instead of downloading them again
+	BatchSize    int           // tiles written per transaction, DefaultImportBatchSize when 0
+	Progress     func(SeedProgress)
+}
+
+// SeedProgress counts the tiles handled by Seed so far
+type SeedProgress struct {
+	Zoom       int8  `json:"zoom"`  // zoom being seeded
+	Total      int64 `json:"total"` // tiles within the bbox over all zooms
+	Done       int64 `json:"done"`  // tiles skipped, downloaded, missing or failed
+	Skipped    int64 `json:"skipped"`
+	Downloaded int64 `json:"downloaded"`
+	Missing    int64 `json:"missing"` // tiles the source does not have
+	Failed     int64 `json:"failed"`
+}
+
+// seedResult is a tile handled by a worker, or skipped tiles when skipped is set
+type seedResult struct {
+	tile    TileCoord
+	data    []byte
+	err     error
+	skipped int64
+}
+
+// Seed downloads the tiles of src within bbox at zooms minZoom..maxZoom into the
+// repository in destDir, creating it when needed. Tiles are written in batches of
+// one transaction per .s file and repository.json is updated at the end. With
+// SkipExisting the tiles stored already are not downloaded, so an interrupted
+// seed resumes where it stopped when run again. Tiles the source does not have
+// and downloads failing after the retries are counted, not fatal; an error is
+// returned when ctx ends or a tile cannot be written, after the tiles downloaded
+// so far are stored.
+func Seed(ctx context.Context, destDir string, src SeedSource, bbox Box, minZoom int8, maxZoom int8, opts SeedOptions) error {
+	if minZoom < 0 || maxZoom > MaxTileZoom || minZoom > maxZoom {
+		return fmt.Errorf("invalid zoom range %d..%d", minZoom, maxZoom)
+	}
+	if !bbox.IsValid() {
+		return errors.New("the bbox is empty")
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultSeedWorkers
+	}
+	if opts.Rate == 0 {
+		opts.Rate = DefaultSeedRate
+	}
+	if opts.Retries == 0 {
+		opts.Retries = DefaultSeedRetries
+	}
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = DefaultSeedRetryDelay
+	}
+	// tiles kept by SkipExisting are never handed to the importer
+	im, err := newImporter(destDir, ImportOptions{Overwrite: true, BatchSize: opts.BatchSize})
+	if err != nil {
+		return err
+	}
+	defer im.unlock()
+	repository := im.repository
+	progress := SeedProgress{Zoom: minZoom}
+	ranges := make(map[int8][4]int64)
+	for z := minZoom; z <= maxZoom; z++ {
+		minX, minY, maxX, maxY := repository.grid.TileRange(bbox.Bounds(), z)
+		ranges[z] = [4]int64{minX, minY, maxX, maxY}
+		progress.Total += (maxX - minX + 1) * (maxY - minY + 1)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var limiter rateLimiter
+	limiter.setRate(opts.Rate)
+	jobs := make(chan TileCoord, opts.Workers)
+	results := make(chan seedResult, opts.Workers)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tile := range jobs {
+				data, err := seedTile(ctx, src, &limiter, tile, opts)
+				results <- seedResult{tile: tile, data: data, err: err}
+			}
+		}()
+	}
+	listErr := make(chan error, 1)
+	go func() {
+		listErr <- seedJobs(ctx, repository, ranges, minZoom, maxZoom, opts.SkipExisting, jobs, results)
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	var writeErr error
+	for result := range results {
+		switch {
+		case result.skipped > 0:
+			progress.Skipped += result.skipped
+			progress.Done += result.skipped
+			continue
+		case errors.Is(result.err, ErrTileNotFound):
+			progress.Missing++
+		case result.err != nil:
+			if ctx.Err() != nil {
+				// not handled, it is downloaded when the seed runs again
+				continue
+			}
+			progress.Failed++
+			log.Printf("Seeding %d/%d/%d failed: %v", result.tile.Z, result.tile.X, result.tile.Y, result.err)
+			RecordError("seed", fmt.Errorf("tile %d/%d/%d: %w", result.tile.Z, result.tile.X, result.tile.Y, result.err))
+		case writeErr == nil:
+			progress.Downloaded++
+			if err := im.add(TileData{TileCoord: result.tile, Data: result.data}); err != nil {
+				writeErr = err
+				cancel()
+			}
+		}
+		progress.Done++
+		progress.Zoom = result.tile.Z
+		if opts.Progress != nil {
+			opts.Progress(progress)
+		}
+	}
+	if opts.Progress != nil {
+		opts.Progress(progress)
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	if err := im.finish(nil); err != nil {
+		return err
+	}
+	if err := <-listErr; err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// seedJobs queues the tiles of every zoom range, table by table. With
+// skipExisting the tiles stored already are counted as skipped instead.
+func seedJobs(ctx context.Context, repository *SRepository, ranges map[int8][4]int64, minZoom int8, maxZoom int8, skipExisting bool, jobs chan<- TileCoord, results chan<- seedResult) error {
+	side := repository.shards().Table
+	for z := minZoom; z <= maxZoom; z++ {
+		err := repository.rangeTables(z, ranges[z], func(x0 int64, y0 int64, x1 int64, y1 int64, present []bool) error {
+			if !skipExisting {
+				present = nil
+			}
+			skipped := int64(0)
+			for y := y0; y <= y1; y++ {
+				for x := x0; x <= x1; x++ {
+					if present != nil && present[x%side+side*(y%side)] {
+						skipped++
+						continue
+					}
+					select {
+					case jobs <- TileCoord{Z: z, X: x, Y: y}:
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				}
+			}
+			if skipped > 0 {
+				select {
+				case results <- seedResult{skipped: skipped}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seedTile downloads a tile within the rate limit, retrying failures other than
+// a missing tile with a doubling delay
+func seedTile(ctx context.Context, src SeedSource, limiter *rateLimiter, tile TileCoord, opts SeedOptions) ([]byte, error) {
+	delay := opts.RetryDelay
+	for attempt := 0; ; attempt++ {
+		if err := limiter.wait(ctx); err != nil {
+			return nil, err
+		}
+		data, err := src.FetchTile(ctx, tile.Z, tile.X, tile.Y)
+		if err == nil || errors.Is(err, ErrTileNotFound) || attempt >= opts.Retries || ctx.Err() != nil {
+			return data, err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
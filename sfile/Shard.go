@@ -0,0 +1,161 @@
+package sfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ShardScheme is how the tiles of a zoom are spread over .s files and over the
+// tables in them. Tile x/y/z is stored in the file ZOOM_(x/File)_(y/File).s,
+// the table ZOOM_(x/Table)_(y/Table) and the row x%Table + Table*(y%Table),
+// ZOOM being the zoomName of z.
+type ShardScheme struct {
+	File  int64 `json:"file"`  // tiles along each side of a .s file
+	Table int64 `json:"table"` // tiles along each side of a table, File is a multiple of it
+}
+
+// DefaultShardScheme is the layout of repositories whose repository.json records
+// no shard scheme, 256x256 tiles per file in tables of 64x64
+var DefaultShardScheme = ShardScheme{File: 256, Table: 64}
+
+// maxShardTable bounds the side of a table, whose rows are addressed by an ID
+const maxShardTable = 1024
+
+// ErrShardSchemeMismatch is returned when tiles would be written to a repository
+// with a shard scheme other than the one its tiles are stored with
+var ErrShardSchemeMismatch = errors.New("shard scheme does not match the repository")
+
+// Validate checks that the scheme can address tiles
+func (s ShardScheme) Validate() error {
+	if s.Table < 1 || s.Table > maxShardTable {
+		return fmt.Errorf("shard table size %d is outside 1..%d", s.Table, maxShardTable)
+	}
+	if s.File < s.Table || s.File%s.Table != 0 {
+		return fmt.Errorf("shard file size %d is not a multiple of the table size %d", s.File, s.Table)
+	}
+	return nil
+}
+
+// String formats the scheme as file/table
+func (s ShardScheme) String() string {
+	return fmt.Sprintf("%d/%d", s.File, s.Table)
+}
+
+// tableIDs is the number of rows a table of the scheme can hold
+func (s ShardScheme) tableIDs() int64 {
+	return s.Table * s.Table
+}
+
+// tileOf returns the tile held by row id of table tableX, tableY
+func (s ShardScheme) tileOf(tableX int64, tableY int64, id int64) (int64, int64) {
+	return tableX*s.Table + id%s.Table, tableY*s.Table + id/s.Table
+}
+
+// recordedScheme is the shard scheme, grid and tile TTL of a repository as last
+// read from its repository.json
+type recordedScheme struct {
+	modTime  time.Time
+	scheme   ShardScheme
+	grid     TileGrid
+	ttl      time.Duration
+	compress bool
+	temporal *TemporalSettings
+	layout   string
+	err      error
+}
+
+var (
+	recordedSchemesMu sync.Mutex
+	recordedSchemes   = make(map[string]recordedScheme)
+)
+
+// repositoryScheme returns the shard scheme recorded in the repository.json of
+// the repository in dir, DefaultShardScheme when it records none or there is no
+// repository.json. The file is only read again once it changed.
+func repositoryScheme(dir string) (ShardScheme, error) {
+	recorded, err := recordedLayout(dir)
+	if err != nil {
+		return DefaultShardScheme, err
+	}
+	return recorded.scheme, recorded.err
+}
+
+// repositoryGrid returns the grid declared in the repository.json of the
+// repository in dir, GridMercator when it declares none or cannot be read
+func repositoryGrid(dir string) TileGrid {
+	recorded, err := recordedLayout(dir)
+	if err != nil {
+		return GridMercator
+	}
+	return recorded.grid
+}
+
+// recordedLayout returns the shard scheme, grid, tile TTL, compression, temporal
+// settings and layout of the repository in dir, the defaults when there is no
+// repository.json
+func recordedLayout(dir string) (recordedScheme, error) {
+	infoPath := filepath.Join(dir, "repository.json")
+	info, err := os.Stat(infoPath)
+	if err != nil {
+		return recordedScheme{scheme: DefaultShardScheme, grid: GridMercator}, nil
+	}
+	recordedSchemesMu.Lock()
+	cached, ok := recordedSchemes[infoPath]
+	recordedSchemesMu.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) {
+		return cached, nil
+	}
+	cached = recordedScheme{modTime: info.ModTime(), scheme: DefaultShardScheme, grid: GridMercator}
+	repo, err := readRepositoryInfo(filepath.Dir(dir), filepath.Base(dir))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return cached, err
+	}
+	if err == nil {
+		cached.grid = repo.TileGrid()
+		cached.ttl = repo.TTL()
+		cached.compress = repo.Compress
+		cached.temporal = repo.Temporal
+		cached.layout = repo.Layout
+	}
+	if err == nil && repo.Shard != nil {
+		cached.scheme = *repo.Shard
+		if err := cached.scheme.Validate(); err != nil {
+			cached.err = fmt.Errorf("repository.json of %s: %w", dir, err)
+		}
+	}
+	recordedSchemesMu.Lock()
+	recordedSchemes[infoPath] = cached
+	recordedSchemesMu.Unlock()
+	return cached, nil
+}
+
+// openRepository returns the repository in dir with the shard scheme, grid, tile
+// TTL, compression and temporal settings recorded in its repository.json, and
+// its layout, see repositoryLayout
+func openRepository(dir string) (*SRepository, error) {
+	recorded, err := recordedLayout(dir)
+	if err == nil {
+		err = recorded.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	layout := recorded.layout
+	if layout == "" {
+		layout = detectLayout(dir).layout()
+	}
+	return &SRepository{dir: dir, scheme: recorded.scheme, grid: recorded.grid, ttl: recorded.ttl, compress: recorded.compress,
+		temporal: recorded.temporal, flat: layout == LayoutFlat}, nil
+}
+
+// shards returns the shard scheme of the repository, DefaultShardScheme when it was not read
+func (f SRepository) shards() ShardScheme {
+	if f.scheme == (ShardScheme{}) {
+		return DefaultShardScheme
+	}
+	return f.scheme
+}
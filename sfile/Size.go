@@ -0,0 +1,133 @@
+package sfile
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// sizeCheckInterval is how long a tracked size is trusted before the .s files
+// of its repository are looked at again
+const sizeCheckInterval = 30 * time.Second
+
+// trackedSize is the size of the .s files of a repository as last computed,
+// adjusted by the tiles written since
+type trackedSize struct {
+	size    float64
+	at      time.Time // when size was computed from the files, or recorded in repository.json
+	checked time.Time // when the files were last looked at
+}
+
+// sizes tracks the size of repositories by absolute directory
+var sizes = struct {
+	sync.Mutex
+	entries map[string]*trackedSize
+}{entries: make(map[string]*trackedSize)}
+
+// sizeKey identifies the repository in dir independently of how dir was given
+func sizeKey(dir string) string {
+	if absolute, err := filepath.Abs(dir); err == nil {
+		return absolute
+	}
+	return dir
+}
+
+// currentSize returns the size of the .s files of the repository in dir, which
+// records recorded as its size. A stat pass over the files, at most every
+// sizeCheckInterval, sums their size again once any of them or a zoom
+// directory changed after the size was computed. Nothing is written.
+func currentSize(dir string, recorded float64) float64 {
+	var recordedAt time.Time
+	if info, err := os.Stat(filepath.Join(dir, "repository.json")); err == nil {
+		recordedAt = info.ModTime()
+	}
+	key := sizeKey(dir)
+	sizes.Lock()
+	entry, ok := sizes.entries[key]
+	if !ok || recordedAt.After(entry.at) {
+		// repository.json was written since, e.g. by an import or a prune
+		entry = &trackedSize{size: recorded, at: recordedAt}
+		sizes.entries[key] = entry
+	}
+	if time.Since(entry.checked) < sizeCheckInterval {
+		size := entry.size
+		sizes.Unlock()
+		return size
+	}
+	since := entry.at
+	sizes.Unlock()
+
+	start := time.Now()
+	changed, size, err := shardsChangedSince(dir, since)
+	sizes.Lock()
+	defer sizes.Unlock()
+	entry.checked = start
+	if err == nil && changed {
+		entry.size, entry.at = size, start
+	}
+	return entry.size
+}
+
+// shardsChangedSince reports whether a .s file or a zoom directory of the
+// repository in dir was modified after since, and returns the total size of
+// its .s files
+func shardsChangedSince(dir string, since time.Time) (bool, float64, error) {
+	subDirs, err := listSubDir(dir)
+	if err != nil {
+		return false, 0, err
+	}
+	changed := false
+	var size float64
+	for _, sub := range subDirs {
+		// a removed file only shows in the modification time of its directory
+		if info, err := os.Stat(sub); err == nil && info.ModTime().After(since) {
+			changed = true
+		}
+		files, err := listAllFile(sub)
+		if err != nil {
+			return false, 0, err
+		}
+		for _, file := range files {
+			info, err := os.Stat(file)
+			if err != nil {
+				continue
+			}
+			size += float64(info.Size())
+			if info.ModTime().After(since) {
+				changed = true
+			}
+		}
+	}
+	return changed, size, nil
+}
+
+// addSize adjusts the tracked size of the repository in dir by delta bytes
+// written, so it stays close between stat passes. Deleted tiles are not
+// subtracted: sqlite reuses their pages and the files do not shrink.
+func addSize(dir string, delta float64) {
+	sizes.Lock()
+	defer sizes.Unlock()
+	if entry, ok := sizes.entries[sizeKey(dir)]; ok {
+		entry.size += delta
+	}
+}
+
+// trackSize records size as the size of the repository in dir, just computed
+func trackSize(dir string, size float64) {
+	now := time.Now()
+	sizes.Lock()
+	defer sizes.Unlock()
+	sizes.entries[sizeKey(dir)] = &trackedSize{size: size, at: now, checked: now}
+}
+
+// RecomputeSize sums the size of the .s files of the repository in dir again,
+// records it in repository.json when there is one and returns it
+func RecomputeSize(dir string) (float64, error) {
+	if err := recordRepositorySize(dir); err != nil {
+		return 0, err
+	}
+	sizes.Lock()
+	defer sizes.Unlock()
+	return sizes.entries[sizeKey(dir)].size, nil
+}
@@ -0,0 +1,140 @@
+package sfile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// SplitOptions controls Split
+type SplitOptions struct {
+	DryRun    bool // only count the tiles and bytes that would be copied
+	BatchSize int  // tiles written per batch, DefaultImportBatchSize when 0
+	Progress  func(SplitProgress)
+}
+
+// SplitProgress counts the tiles copied so far
+type SplitProgress struct {
+	Zoom  int8  `json:"zoom"`
+	Tiles int64 `json:"tiles"`
+	Bytes int64 `json:"bytes"`
+}
+
+// SplitReport is the result of Split
+type SplitReport struct {
+	DryRun bool          `json:"dry_run"`
+	Tiles  int64         `json:"tiles"`
+	Bytes  int64         `json:"bytes"`  // size of the tile blobs, not of the .s files written
+	Zooms  map[int]int64 `json:"zooms"`  // tiles per zoom
+	Bounds [4]float64    `json:"bounds"` // minLng, minLat, maxLng, maxLat of the new repository, zero for a dry run
+}
+
+// Split copies the tiles of the repository at srcDir from minZoom to maxZoom
+// that intersect bbox, given in lng/lat, into a new repository at dstDir. Tiles
+// straddling the edge of bbox are copied whole. Only the .s files overlapping the
+// tile range of each zoom are opened. The new repository keeps the title,
+// attribution, tile size and shard scheme of the source and is bounded by bbox
+// clipped to the copied tiles. dstDir must not exist or be empty; with
+// opts.DryRun nothing is written and the report only counts what would be copied.
+func Split(srcDir string, dstDir string, bbox Box, minZoom int8, maxZoom int8, opts SplitOptions) (SplitReport, error) {
+	report := SplitReport{DryRun: opts.DryRun, Zooms: make(map[int]int64)}
+	if !bbox.IsValid() {
+		return report, fmt.Errorf("bbox must be minLng,minLat,maxLng,maxLat")
+	}
+	if minZoom < 0 || maxZoom > MaxTileZoom || minZoom > maxZoom {
+		return report, fmt.Errorf("%w: zoom range must be within 0..%d", ErrZoomOutOfRange, MaxTileZoom)
+	}
+	if info, err := os.Stat(srcDir); err != nil || !info.IsDir() {
+		return report, fmt.Errorf("%w: %s", ErrRepositoryNotFound, srcDir)
+	}
+	source, err := openRepository(srcDir)
+	if err != nil {
+		return report, err
+	}
+	var im *importer
+	if !opts.DryRun {
+		entries, err := os.ReadDir(dstDir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return report, err
+		}
+		if len(entries) > 0 {
+			return report, fmt.Errorf("%s is not empty", dstDir)
+		}
+		im, err = newImporter(dstDir, ImportOptions{BatchSize: opts.BatchSize, Shard: source.shards(), Grid: source.grid})
+		if err != nil {
+			return report, err
+		}
+		defer im.unlock()
+	}
+
+	side := source.shards().File
+	area := bbox.Bounds()
+	for z := minZoom; z <= maxZoom; z++ {
+		xMin, yMin, xMax, yMax := source.grid.TileRange(area, z)
+		files, err := listAllFile(filepath.Join(srcDir, zoomName(z)))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+		for _, file := range files {
+			parts := validFileName.FindStringSubmatch(filepath.Base(file))
+			if parts == nil {
+				continue
+			}
+			fileX, _ := strconv.ParseInt(parts[2], 10, 64)
+			fileY, _ := strconv.ParseInt(parts[3], 10, 64)
+			if fileX*side > xMax || fileX*side+side-1 < xMin || fileY*side > yMax || fileY*side+side-1 < yMin {
+				continue
+			}
+			err := source.rangeInFile(z, fileX, fileY,
+				max(xMin, fileX*side), min(xMax, fileX*side+side-1),
+				max(yMin, fileY*side), min(yMax, fileY*side+side-1),
+				func(x int64, y int64, data []byte) error {
+					report.Tiles++
+					report.Bytes += int64(len(data))
+					report.Zooms[int(z)]++
+					if im != nil {
+						if err := im.add(TileData{TileCoord: TileCoord{Z: z, X: x, Y: y}, Data: bytes.Clone(data)}); err != nil {
+							return err
+						}
+					}
+					if opts.Progress != nil && report.Tiles%int64(DefaultImportBatchSize) == 0 {
+						opts.Progress(SplitProgress{Zoom: z, Tiles: report.Tiles, Bytes: report.Bytes})
+					}
+					return nil
+				})
+			if err != nil {
+				return report, err
+			}
+		}
+		if opts.Progress != nil {
+			opts.Progress(SplitProgress{Zoom: z, Tiles: report.Tiles, Bytes: report.Bytes})
+		}
+	}
+	if im == nil {
+		return report, nil
+	}
+
+	sourceInfo, _ := readRepositoryInfo(filepath.Dir(srcDir), filepath.Base(srcDir))
+	err = im.finish(func(repo *Repository) {
+		repo.Title, repo.Attribution, repo.Description = sourceInfo.Title, sourceInfo.Attribution, sourceInfo.Description
+		if sourceInfo.TileSize > 0 {
+			repo.TileSize = sourceInfo.TileSize
+		}
+		if repo.HasBounds() {
+			// the copied tiles reach past bbox where they straddle its edge
+			repo.Bounds = [4]float64{
+				max(repo.Bounds[0], bbox.MinX), max(repo.Bounds[1], bbox.MinY),
+				min(repo.Bounds[2], bbox.MaxX), min(repo.Bounds[3], bbox.MaxY),
+			}
+			repo.Lng, repo.Lat = 0.5*(repo.Bounds[0]+repo.Bounds[2]), 0.5*(repo.Bounds[1]+repo.Bounds[3])
+		}
+		report.Bounds = repo.Bounds
+	})
+	return report, err
+}
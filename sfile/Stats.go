@@ -0,0 +1,328 @@
+package sfile
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// ZoomStats counts the tiles stored at one zoom level
+type ZoomStats struct {
+	Zoom  int8           `json:"zoom"`
+	Tiles int64          `json:"tiles"`
+	Bytes int64          `json:"bytes"`
+	Files int            `json:"files"`
+	Sizes *SizeHistogram `json:"sizes"` // unset in stats cached before sizes were counted
+}
+
+// SizeBucket counts the tiles whose blob size is below Below bytes and not
+// below the Below of the bucket before it
+type SizeBucket struct {
+	Label string `json:"label"`
+	Below int64  `json:"below,omitempty"` // unset for the last bucket, which has no upper bound
+	Tiles int64  `json:"tiles"`
+}
+
+// SizeHistogram is the distribution of the blob sizes of tiles, in the fixed
+// buckets of sizeBuckets, with percentiles in bytes
+type SizeHistogram struct {
+	Buckets []SizeBucket `json:"buckets"`
+	P50     int64        `json:"p50"`
+	P90     int64        `json:"p90"`
+	P99     int64        `json:"p99"`
+}
+
+// sizeBuckets are the buckets of every SizeHistogram
+var sizeBuckets = []SizeBucket{
+	{Label: "<1KB", Below: 1 << 10},
+	{Label: "1-4KB", Below: 4 << 10},
+	{Label: "4-16KB", Below: 16 << 10},
+	{Label: "16-64KB", Below: 64 << 10},
+	{Label: ">=64KB"},
+}
+
+// sizeCounts counts tiles by their exact blob size, from which the histogram
+// and exact percentiles are built. There are no more sizes than bytes in the
+// largest tile, however many tiles there are.
+type sizeCounts map[int64]int64
+
+// add counts the tiles of other
+func (c sizeCounts) add(other sizeCounts) {
+	for size, tiles := range other {
+		c[size] += tiles
+	}
+}
+
+// histogram buckets the counted tiles and computes their percentiles
+func (c sizeCounts) histogram() *SizeHistogram {
+	histogram := &SizeHistogram{Buckets: append([]SizeBucket(nil), sizeBuckets...)}
+	sizes := make([]int64, 0, len(c))
+	var total int64
+	for size, tiles := range c {
+		sizes = append(sizes, size)
+		total += tiles
+		bucket := len(sizeBuckets) - 1
+		for i, b := range sizeBuckets[:bucket] {
+			if size < b.Below {
+				bucket = i
+				break
+			}
+		}
+		histogram.Buckets[bucket].Tiles += tiles
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	percentiles := []struct {
+		share float64
+		value *int64
+	}{{0.5, &histogram.P50}, {0.9, &histogram.P90}, {0.99, &histogram.P99}}
+	var seen int64
+	next := 0
+	for _, size := range sizes {
+		seen += c[size]
+		for next < len(percentiles) && float64(seen) >= percentiles[next].share*float64(total) {
+			*percentiles[next].value = size
+			next++
+		}
+	}
+	return histogram
+}
+
+// Stats summarizes the tiles stored in a repository. MinZoom and MaxZoom are -1
+// when the repository holds no tiles.
+type Stats struct {
+	Zooms           []ZoomStats    `json:"zooms"`
+	Tiles           int64          `json:"tiles"`
+	TileBytes       int64          `json:"tile_bytes"`
+	AverageTileSize float64        `json:"average_tile_size"`
+	MinZoom         int8           `json:"min_zoom"`
+	MaxZoom         int8           `json:"max_zoom"`
+	Files           int            `json:"files"`
+	DiskUsage       int64          `json:"disk_usage"`
+	Sizes           *SizeHistogram `json:"sizes"` // of the tiles of every zoom
+	ComputedAt      time.Time      `json:"computed_at"`
+}
+
+// statsFileName is where RepositoryStats caches its result inside a repository
+const statsFileName = "stats.json"
+
+// memoryStats holds the stats of repositories, by directory, computed while
+// SetWriteAnalysis was off and so not cached in stats.json
+var memoryStats sync.Map
+
+// RepositoryStats returns the tile statistics of the repository in dir. The result
+// is cached and reused as long as no .s file or zoom directory changed after it
+// was computed, in stats.json when SetWriteAnalysis is on and in memory otherwise.
+func RepositoryStats(dir string) (Stats, error) {
+	if stats, ok := cachedStats(dir); ok {
+		return stats, nil
+	}
+	stats, err := ComputeStats(dir)
+	if err != nil {
+		return Stats{}, err
+	}
+	if !writeAnalysis.Load() {
+		memoryStats.Store(dir, stats)
+		return stats, nil
+	}
+	if content, err := json.MarshalIndent(stats, "", "  "); err == nil {
+		// the cache is an optimisation, read only repositories simply recompute
+		_ = os.WriteFile(filepath.Join(dir, statsFileName), content, 0644)
+	}
+	return stats, nil
+}
+
+// ComputeStats counts the tiles of the repository in dir, and their sizes, with
+// one aggregate query per table, without reading any tile data
+func ComputeStats(dir string) (Stats, error) {
+	stats := Stats{Zooms: make([]ZoomStats, 0), MinZoom: -1, MaxZoom: -1, ComputedAt: time.Now()}
+	allSizes := make(sizeCounts)
+	subDirs, err := listSubDir(dir)
+	if err != nil {
+		return Stats{}, err
+	}
+	for _, sub := range subDirs {
+		zoom := subDirZoom(sub)
+		files, err := listAllFile(sub)
+		if err != nil {
+			return Stats{}, err
+		}
+		zoomStats := ZoomStats{Zoom: zoom, Files: len(files)}
+		zoomSizes := make(sizeCounts)
+		for _, file := range files {
+			if info, err := os.Stat(file); err == nil {
+				stats.DiskUsage += info.Size()
+			}
+			sizes, err := shardStats(file)
+			if err != nil {
+				RecordError("sfile", err)
+				continue
+			}
+			zoomSizes.add(sizes)
+		}
+		stats.Files += len(files)
+		for size, tiles := range zoomSizes {
+			zoomStats.Tiles += tiles
+			zoomStats.Bytes += size * tiles
+		}
+		if zoomStats.Tiles == 0 {
+			continue
+		}
+		zoomStats.Sizes = zoomSizes.histogram()
+		allSizes.add(zoomSizes)
+		stats.Zooms = append(stats.Zooms, zoomStats)
+		stats.Tiles += zoomStats.Tiles
+		stats.TileBytes += zoomStats.Bytes
+		if stats.MinZoom < 0 || zoom < stats.MinZoom {
+			stats.MinZoom = zoom
+		}
+		stats.MaxZoom = max(stats.MaxZoom, zoom)
+	}
+	if stats.Tiles > 0 {
+		stats.AverageTileSize = float64(stats.TileBytes) / float64(stats.Tiles)
+	}
+	stats.Sizes = allSizes.histogram()
+	return stats, nil
+}
+
+// shardStats counts the tiles of a .s file by blob size. sqlite takes the
+// length of a blob from its record header, so no tile is read.
+func shardStats(filePath string) (sizeCounts, error) {
+	shard, release, err := openShardMetadata(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	tableNames, err := listTables(shard.db)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(sizeCounts)
+	for _, tableName := range tableNames {
+		if !validTableName.MatchString(tableName) {
+			continue
+		}
+		if err := tableSizes(shard.db, "select coalesce(length("+tileData(tableName, shard.dedup)+"), 0), count(*) from "+tableName+" group by 1", sizes); err != nil {
+			return nil, err
+		}
+	}
+	return sizes, nil
+}
+
+// tableSizes adds the sizes and tile counts query returns to sizes
+func tableSizes(db *sql.DB, query string, sizes sizeCounts) error {
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var size, tiles int64
+		if err := rows.Scan(&size, &tiles); err != nil {
+			return err
+		}
+		sizes[size] += tiles
+	}
+	return rows.Err()
+}
+
+// WriteSizeTable writes the size histogram of every zoom, and of all of them,
+// as a table with aligned columns
+func (s Stats) WriteSizeTable(w io.Writer) error {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	header := "zoom\ttiles\t"
+	for _, bucket := range sizeBuckets {
+		header += bucket.Label + "\t"
+	}
+	fmt.Fprintln(table, header+"p50\tp90\tp99\t")
+	row := func(label string, tiles int64, sizes *SizeHistogram) {
+		line := label + "\t" + strconv.FormatInt(tiles, 10) + "\t"
+		if sizes == nil {
+			fmt.Fprintln(table, line)
+			return
+		}
+		for _, bucket := range sizes.Buckets {
+			line += strconv.FormatInt(bucket.Tiles, 10) + "\t"
+		}
+		fmt.Fprintln(table, line+formatSize(sizes.P50)+"\t"+formatSize(sizes.P90)+"\t"+formatSize(sizes.P99)+"\t")
+	}
+	for _, zoom := range s.Zooms {
+		row(strconv.Itoa(int(zoom.Zoom)), zoom.Tiles, zoom.Sizes)
+	}
+	row("all", s.Tiles, s.Sizes)
+	return table.Flush()
+}
+
+// formatSize formats a size in bytes with a binary unit
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(size)/(1<<10))
+	default:
+		return fmt.Sprintf("%dB", size)
+	}
+}
+
+// cachedStats returns the content of stats.json, or the stats kept in memory,
+// when it is newer than the zoom directories and every .s file of dir
+func cachedStats(dir string) (Stats, bool) {
+	statsPath := filepath.Join(dir, statsFileName)
+	info, err := os.Stat(statsPath)
+	if err != nil {
+		kept, ok := memoryStats.Load(dir)
+		if !ok {
+			return Stats{}, false
+		}
+		stats := kept.(Stats)
+		return stats, statsCurrent(dir, stats.ComputedAt, stats)
+	}
+	content, err := os.ReadFile(statsPath)
+	if err != nil {
+		return Stats{}, false
+	}
+	var stats Stats
+	if err := json.Unmarshal(content, &stats); err != nil || stats.Sizes == nil {
+		// stats.json written before sizes were counted is outdated too
+		return Stats{}, false
+	}
+	return stats, statsCurrent(dir, info.ModTime(), stats)
+}
+
+// statsCurrent reports whether stats, computed at written, still describe the
+// repository in dir
+func statsCurrent(dir string, written time.Time, stats Stats) bool {
+	subDirs, err := listSubDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, sub := range subDirs {
+		if subInfo, err := statZoomDir(sub); err != nil || subInfo.ModTime().After(written) {
+			return false
+		}
+		files, err := listAllFile(sub)
+		if err != nil {
+			return false
+		}
+		for _, file := range files {
+			if fileInfo, err := os.Stat(file); err != nil || fileInfo.ModTime().After(written) {
+				return false
+			}
+		}
+	}
+	// a pruned zoom leaves no newer file behind, only a missing zoom directory
+	for _, zoom := range stats.Zooms {
+		if info, err := statZoomDir(filepath.Join(dir, zoomName(zoom.Zoom))); err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,122 @@
+package sfile
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DiskUsage is the number of bytes and files below a directory
+type DiskUsage struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	Files int    `json:"files"`
+}
+
+// DirectoryUsage walks dir and sums the size of every regular file in it
+func DirectoryUsage(dir string) (DiskUsage, error) {
+	usage := DiskUsage{Name: filepath.Base(dir)}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// unreadable entries are skipped rather than failing the whole walk
+			if d != nil && d.IsDir() && path != dir {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		usage.Size += info.Size()
+		usage.Files++
+		return nil
+	})
+	return usage, err
+}
+
+// RepositoriesUsage returns the disk usage of every repository under baseDir,
+// sorted by size descending
+func RepositoriesUsage(baseDir string) ([]DiskUsage, error) {
+	dirs, err := os.ReadDir(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	usages := make([]DiskUsage, 0)
+	for _, dir := range dirs {
+		if !dir.IsDir() || strings.HasPrefix(dir.Name(), ".") {
+			continue
+		}
+		usage, err := DirectoryUsage(filepath.Join(baseDir, dir.Name()))
+		if err != nil {
+			continue
+		}
+		usages = append(usages, usage)
+	}
+	sort.SliceStable(usages, func(i, j int) bool {
+		return usages[i].Size > usages[j].Size
+	})
+	return usages, nil
+}
+
+// UsageCache keeps the result of RepositoriesUsage so the repository root
+// is not walked on every request
+type UsageCache struct {
+	baseDir   string
+	mu        sync.Mutex
+	usages    []DiskUsage
+	scannedAt time.Time
+}
+
+// NewUsageCache creates a UsageCache for the repositories under baseDir
+func NewUsageCache(baseDir string) *UsageCache {
+	return &UsageCache{baseDir: baseDir}
+}
+
+// Get returns the cached repository usage, walking the root first when nothing
+// has been scanned yet or refresh is requested
+func (c *UsageCache) Get(refresh bool) ([]DiskUsage, time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.usages == nil || refresh {
+		usages, err := RepositoriesUsage(c.baseDir)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		c.usages = usages
+		c.scannedAt = time.Now()
+	}
+	return c.usages, c.scannedAt, nil
+}
+
+// Len returns the number of repositories held by the cached scan
+func (c *UsageCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.usages)
+}
+
+// EvictIf drops the cached scan when it holds a repository matching match and
+// returns the number of matching entries. The next Get walks the root again.
+func (c *UsageCache) EvictIf(match func(name string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	evicted := 0
+	for _, usage := range c.usages {
+		if match(usage.Name) {
+			evicted++
+		}
+	}
+	if evicted > 0 {
+		c.usages = nil
+		c.scannedAt = time.Time{}
+	}
+	return evicted
+}
@@ -0,0 +1,467 @@
+package sfile
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A temporal repository, whose repository.json has a temporal section, keeps the
+// earlier versions of its tiles. Every tile written is also stored in the
+// versions table of its shard table, K_1_2_versions for K_1_2, keyed by row ID
+// and the Unix second the version is for. The shard table keeps holding the
+// newest version, so everything reading tiles without a time, older versions of
+// SirServer included, is unaffected; listTables and validTableName leave the
+// versions tables out. Versions are stored as written, never deduplicated, with
+// their encoding. Files holding versions record temporal_version in their meta
+// table.
+
+// temporalSchemaVersion is the layout of the versions tables
+const temporalSchemaVersion = "1"
+
+// versionsSuffix turns the name of a shard table into that of its versions table
+const versionsSuffix = "_versions"
+
+// temporalTimesTTL is how long the times listed by TileTimes are reused
+const temporalTimesTTL = time.Minute
+
+// ErrNotTemporal is returned when a tile is asked for at a time from a
+// repository that keeps no earlier versions of its tiles
+var ErrNotTemporal = errors.New("repository keeps no tile history")
+
+// TemporalSettings make a repository keep the earlier versions of its tiles and
+// say how long. The newest version of a tile is always kept.
+type TemporalSettings struct {
+	KeepVersions int `json:"keep_versions,omitempty"` // versions kept per tile, all when 0
+	KeepDays     int `json:"keep_days,omitempty"`     // days versions are kept, for ever when 0
+}
+
+// prunes reports whether the settings ever let go of a version
+func (s TemporalSettings) prunes() bool {
+	return s.KeepVersions > 0 || s.KeepDays > 0
+}
+
+// versionsTable returns the versions table of the shard table tableName
+func versionsTable(tableName string) string {
+	return tableName + versionsSuffix
+}
+
+// createVersionsTable creates the versions table of tableName in the file
+// written in tx unless it has one already
+func createVersionsTable(tx *sql.Tx, tableName string) error {
+	statements := []string{
+		"create table if not exists " + versionsTable(tableName) + " (ID INTEGER, Time INTEGER, Data BLOB, Encoding TEXT, PRIMARY KEY (ID, Time))",
+		"create table if not exists meta (key TEXT PRIMARY KEY, value TEXT)",
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec("insert or replace into meta (key, value) values ('temporal_version', ?)", temporalSchemaVersion)
+	return err
+}
+
+// recordVersion stores stored, as encoded with encoding, as the version of row id
+// of tableName for time at, replacing one for the same second. The versions
+// table must exist.
+func recordVersion(tx execer, tableName string, id int64, at time.Time, stored []byte, encoding string) error {
+	_, err := tx.Exec("insert or replace into "+versionsTable(tableName)+" (ID, Time, Data, Encoding) values (?, ?, ?, ?)",
+		id, at.Unix(), stored, sql.NullString{String: encoding, Valid: encoding != ""})
+	return err
+}
+
+// keepVersion records the tile just written to row id of tableName as a version
+// when the repository is temporal, creating the versions table first
+func (f *SRepository) keepVersion(tx *sql.Tx, tableName string, id int64, at time.Time, stored []byte, encoding string) error {
+	if f.temporal == nil {
+		return nil
+	}
+	if err := createVersionsTable(tx, tableName); err != nil {
+		return err
+	}
+	return recordVersion(tx, tableName, id, at, stored, encoding)
+}
+
+// WriteXYZAt stores data as the version of tile x/y/z for time at, to the
+// second, in a temporal repository. It also becomes the tile served without a
+// time unless a later version is stored already, so versions can be written
+// in any order, late ones included. Repositories that are not temporal return
+// ErrNotTemporal.
+func (f *SRepository) WriteXYZAt(x int64, y int64, z int8, at time.Time, data []byte) error {
+	if f.temporal == nil {
+		return fmt.Errorf("%w: %s", ErrNotTemporal, f.dir)
+	}
+	if err := f.grid.checkTile(x, y, z); err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return ErrEmptyTile
+	}
+	filePath, tableName, id := f.shardLocation(x, y, z)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	db, done, err := openShardForWriteRetrying(filePath)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	stored, encoding := f.encodeTile(data)
+	var current bool
+	err = retryTransient(context.Background(), func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		dedup, err := prepareShardWrite(tx)
+		if err == nil {
+			err = createShardTable(tx, tableName, dedup)
+		}
+		if err == nil {
+			err = createVersionsTable(tx, tableName)
+		}
+		var newest sql.NullInt64
+		if err == nil {
+			err = tx.QueryRow("select max(Time) from "+versionsTable(tableName)+" where ID = ?", id).Scan(&newest)
+		}
+		if err == nil {
+			err = recordVersion(tx, tableName, id, at, stored, encoding)
+		}
+		current = !newest.Valid || at.Unix() >= newest.Int64
+		if err == nil && current {
+			err = writeCurrentTile(tx, tableName, id, x, y, data, stored, encoding, dedup)
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+	if err != nil {
+		return err
+	}
+	written := len(stored)
+	if current {
+		written += len(stored)
+		noteTiles(f.dir, f.shards(), filePath, []TileCoord{{Z: z, X: x, Y: y}}, true)
+	}
+	addSize(f.dir, float64(written))
+	return nil
+}
+
+// writeCurrentTile replaces row id of tableName with the tile data, stored as
+// stored with encoding, the way WriteXYZ does
+func writeCurrentTile(tx *sql.Tx, tableName string, id int64, x int64, y int64, data []byte, stored []byte, encoding string, dedup bool) error {
+	if _, err := insertTile(tx, "insert or replace", tableName, id, x, y, stored, dedup); err != nil {
+		return err
+	}
+	if err := stampEncoding(tx, tableName, id, encoding); err != nil {
+		return err
+	}
+	if err := addWrittenColumn(tx, tableName); err != nil {
+		return err
+	}
+	if err := stampTile(tx, tableName, id, time.Now()); err != nil {
+		return err
+	}
+	return recordShardFormat(tx, dedup, map[string]bool{tileFormat(data): true})
+}
+
+// GetXYZAt returns the version of tile x/y/z current at time at, the newest one
+// stored for at or before it, decompressed, together with the time of that
+// version. A tile written before the repository became temporal has no version
+// and is returned when it was written at or before at. Repositories that are
+// not temporal return ErrNotTemporal.
+func (f SRepository) GetXYZAt(x int64, y int64, z int8, at time.Time) (*bytes.Buffer, time.Time, error) {
+	tile, versionTime, err := f.getXYZAt(context.Background(), x, y, z, at)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	data, err := DecodeTile(tile.data.Bytes(), tile.encoding)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("decode %d/%d/%d: %w", z, x, y, err)
+	}
+	return bytes.NewBuffer(data), versionTime, nil
+}
+
+// GetTileAt returns the version of tile x/y/z current at time at as stored, like
+// GetEncodedTile does for the newest version; Modified is the time of the version
+func (f *SRepository) GetTileAt(ctx context.Context, z int8, x int64, y int64, at time.Time) (Tile, error) {
+	stored, versionTime, err := f.getXYZAt(ctx, x, y, z, at)
+	if err != nil {
+		return Tile{}, err
+	}
+	data := stored.data.Bytes()
+	tile := Tile{Data: data, ContentType: DetectContentType(data), Source: TileSourceLocal, Modified: versionTime, Encoding: stored.encoding}
+	if stored.encoding != "" {
+		if decoded, err := DecodeTile(data, stored.encoding); err == nil {
+			tile.ContentType = DetectContentType(decoded)
+		}
+	}
+	return tile, nil
+}
+
+// getXYZAt reads the version of a tile current at time at and its time
+func (f SRepository) getXYZAt(ctx context.Context, x int64, y int64, z int8, at time.Time) (storedTile, time.Time, error) {
+	if f.temporal == nil {
+		return storedTile{}, time.Time{}, fmt.Errorf("%w: %s", ErrNotTemporal, f.dir)
+	}
+	if err := f.grid.checkTile(x, y, z); err != nil {
+		return storedTile{}, time.Time{}, err
+	}
+	filePath, tableName, id := f.shardLocation(x, y, z)
+	shard, release, err := acquireShardRetrying(ctx, filePath)
+	if os.IsNotExist(err) {
+		return storedTile{}, time.Time{}, fmt.Errorf("%w: %w: %s", ErrTileNotFound, ErrShardNotFound, filePath)
+	}
+	if err != nil {
+		err = fmt.Errorf("open %s: %w", filePath, err)
+		RecordError("sfile", err)
+		return storedTile{}, time.Time{}, err
+	}
+	defer release()
+	var data []byte
+	var encoding sql.NullString
+	var versionTime, versions int64
+	err = retryTransient(ctx, func() error {
+		stmt, err := shard.statement(ctx, "select Data, Encoding, Time from "+versionsTable(tableName)+" where ID = ? and Time <= ? order by Time desc limit 1")
+		if err != nil {
+			return err
+		}
+		err = stmt.QueryRowContext(ctx, id, at.Unix()).Scan(&data, &encoding, &versionTime)
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		// all versions are later, or the tile was written before it kept any
+		stmt, err = shard.statement(ctx, "select count(*) from "+versionsTable(tableName)+" where ID = ?")
+		if err != nil {
+			return err
+		}
+		return stmt.QueryRowContext(ctx, id).Scan(&versions)
+	})
+	if err != nil && !strings.Contains(err.Error(), "no such table") {
+		err = fmt.Errorf("read %d/%d/%d at %s from %s: %w", z, x, y, at.Format(time.RFC3339), filePath, err)
+		if ctx.Err() == nil {
+			RecordError("sfile", err)
+		}
+		return storedTile{}, time.Time{}, err
+	}
+	if err == nil && data != nil {
+		return storedTile{data: bytes.NewBuffer(data), encoding: encoding.String}, time.Unix(versionTime, 0), nil
+	}
+	if versions == 0 {
+		tile, err := f.getXYZ(ctx, x, y, z)
+		if err != nil {
+			return storedTile{}, time.Time{}, err
+		}
+		if !tile.written.After(at) {
+			return tile, tile.written, nil
+		}
+	}
+	return storedTile{}, time.Time{}, fmt.Errorf("%w: no version of %d/%d/%d at or before %s in %s", ErrTileNotFound, z, x, y, at.Format(time.RFC3339), filePath)
+}
+
+// temporalTimes caches the result of TileTimes by repository directory
+var temporalTimes = struct {
+	sync.Mutex
+	times map[string]cachedTimes
+}{times: make(map[string]cachedTimes)}
+
+type cachedTimes struct {
+	listed time.Time
+	times  []time.Time
+}
+
+// TileTimes returns the distinct times the tiles of the repository in dir have
+// versions for, oldest first, reusing the last listing for up to a minute. A
+// repository without versions has none.
+func TileTimes(dir string) ([]time.Time, error) {
+	key := sizeKey(dir)
+	temporalTimes.Lock()
+	cached, ok := temporalTimes.times[key]
+	temporalTimes.Unlock()
+	if ok && time.Since(cached.listed) < temporalTimesTTL {
+		return cached.times, nil
+	}
+	subDirs, err := listSubDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[int64]bool)
+	for _, sub := range subDirs {
+		files, err := listAllFile(sub)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if err := shardVersionTimes(file, seen); err != nil {
+				return nil, fmt.Errorf("read %s: %w", file, err)
+			}
+		}
+	}
+	times := make([]time.Time, 0, len(seen))
+	for unix := range seen {
+		times = append(times, time.Unix(unix, 0).UTC())
+	}
+	slices.SortFunc(times, func(a, b time.Time) int { return a.Compare(b) })
+	temporalTimes.Lock()
+	temporalTimes.times[key] = cachedTimes{listed: time.Now(), times: times}
+	temporalTimes.Unlock()
+	return times, nil
+}
+
+// shardVersionTimes adds the times of the versions stored in the .s file at filePath to seen
+func shardVersionTimes(filePath string, seen map[int64]bool) error {
+	shard, release, err := acquireShardRetrying(context.Background(), filePath)
+	if err != nil {
+		return err
+	}
+	defer release()
+	tableNames, err := listVersionsTables(shard.db)
+	if err != nil {
+		return err
+	}
+	for _, tableName := range tableNames {
+		rows, err := shard.db.Query("select distinct Time from " + tableName)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var unix int64
+			if err := rows.Scan(&unix); err != nil {
+				rows.Close()
+				return err
+			}
+			seen[unix] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listVersionsTables returns the versions tables of a .s file
+func listVersionsTables(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("select name from sqlite_master where type = 'table' order by name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tableNames := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		if shardTable, ok := strings.CutSuffix(name, versionsSuffix); ok && validTableName.MatchString(shardTable) {
+			tableNames = append(tableNames, name)
+		}
+	}
+	return tableNames, rows.Err()
+}
+
+// PruneVersions deletes the versions of the tiles of the repository in dir that
+// the temporal settings of its repository.json no longer keep: all but the
+// newest KeepVersions of a tile and those older than KeepDays, but never the
+// newest version of a tile. A repository keeping every version is left alone.
+// Each .s file is pruned in one transaction, ctx is checked between files.
+func PruneVersions(ctx context.Context, dir string) (SweepReport, error) {
+	var report SweepReport
+	recorded, err := recordedLayout(dir)
+	if err != nil || recorded.temporal == nil || !recorded.temporal.prunes() {
+		return report, err
+	}
+	settings := *recorded.temporal
+	subDirs, err := listSubDir(dir)
+	if err != nil {
+		return report, err
+	}
+	for _, sub := range subDirs {
+		files, err := listAllFile(sub)
+		if err != nil {
+			return report, err
+		}
+		for _, file := range files {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+			deleted, err := pruneShardVersions(file, settings)
+			if deleted > 0 {
+				report.Files++
+				report.Deleted += deleted
+			}
+			if err != nil {
+				return report, fmt.Errorf("pruning versions of %s: %w", file, err)
+			}
+		}
+	}
+	if report.Deleted > 0 {
+		temporalTimes.Lock()
+		delete(temporalTimes.times, sizeKey(dir))
+		temporalTimes.Unlock()
+	}
+	return report, nil
+}
+
+// pruneShardVersions deletes the versions of one .s file settings no longer
+// keeps. Files without versions are not opened for writing.
+func pruneShardVersions(filePath string, settings TemporalSettings) (int64, error) {
+	shard, release, err := acquireShardRetrying(context.Background(), filePath)
+	if err != nil {
+		return 0, err
+	}
+	tableNames, err := listVersionsTables(shard.db)
+	release()
+	if err != nil || len(tableNames) == 0 {
+		return 0, err
+	}
+	db, done, err := openShardForWriteRetrying(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	var deleted int64
+	for _, tableName := range tableNames {
+		statements := make([]string, 0, 2)
+		args := make([][]interface{}, 0, 2)
+		if settings.KeepVersions > 0 {
+			statements = append(statements, "delete from "+tableName+" where (select count(*) from "+tableName+" as newer where newer.ID = "+tableName+".ID and newer.Time > "+tableName+".Time) >= ?")
+			args = append(args, []interface{}{settings.KeepVersions})
+		}
+		if settings.KeepDays > 0 {
+			cutoff := time.Now().AddDate(0, 0, -settings.KeepDays).Unix()
+			statements = append(statements, "delete from "+tableName+" where Time < ? and Time < (select max(Time) from "+tableName+" as newest where newest.ID = "+tableName+".ID)")
+			args = append(args, []interface{}{cutoff})
+		}
+		for i, statement := range statements {
+			result, err := tx.Exec(statement, args[i]...)
+			if err != nil {
+				_ = tx.Rollback()
+				return 0, err
+			}
+			if n, err := result.RowsAffected(); err == nil {
+				deleted += n
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
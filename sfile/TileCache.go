@@ -0,0 +1,196 @@
+package sfile
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TileKey identifies a tile of a repository in the tile cache
+type TileKey struct {
+	Repository string
+	Z          int8
+	X          int64
+	Y          int64
+	Variant    string // tells renderings of the stored tile apart, such as watermarked ones; "" for the tile as stored
+}
+
+// Stored returns the key of the tile as stored, of which key may be a variant
+func (k TileKey) Stored() TileKey {
+	k.Variant = ""
+	return k
+}
+
+// CachedTile is a tile blob kept in memory with its sniffed content type.
+// Missing is set for a cached negative result, which has no data.
+type CachedTile struct {
+	Data        []byte
+	ContentType string
+	Missing     bool
+	Source      string    // where a tile that was not cached came from, see Tile.Source
+	Modified    time.Time // see Tile.Modified
+	Encoding    string    // see Tile.Encoding
+}
+
+// TileCacheStats are the counters of a TileCache
+type TileCacheStats struct {
+	Entries      int   `json:"entries"`
+	Bytes        int64 `json:"bytes"`
+	Budget       int64 `json:"budget"`
+	Hits         int64 `json:"hits"`
+	NegativeHits int64 `json:"negative_hits"`
+	Misses       int64 `json:"misses"`
+	Evictions    int64 `json:"evictions"`
+}
+
+// tileCacheEntry is a cached tile together with its bookkeeping
+type tileCacheEntry struct {
+	key     TileKey
+	tile    CachedTile
+	cost    int64
+	expires time.Time // set for negative results and tiles of repositories with a TTL
+}
+
+// tileEntryOverhead approximates the memory used by an entry besides its data
+const tileEntryOverhead = 128
+
+// TileCache is an LRU of tile blobs bounded by a byte budget. Negative results
+// are kept for a short TTL only, so a tile written later shows up quickly, and
+// tiles that expire are dropped when they do.
+type TileCache struct {
+	budget      int64
+	negativeTTL time.Duration
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List // front is the most recently used entry
+	entries map[TileKey]*list.Element
+
+	hits         atomic.Int64
+	negativeHits atomic.Int64
+	misses       atomic.Int64
+	evictions    atomic.Int64
+}
+
+// NewTileCache creates a TileCache holding at most budget bytes. A budget of 0
+// disables the cache, a negativeTTL of 0 disables caching of missing tiles.
+func NewTileCache(budget int64, negativeTTL time.Duration) *TileCache {
+	return &TileCache{
+		budget:      max(budget, 0),
+		negativeTTL: negativeTTL,
+		order:       list.New(),
+		entries:     make(map[TileKey]*list.Element),
+	}
+}
+
+// Get returns the cached tile of key
+func (c *TileCache) Get(key TileKey) (CachedTile, bool) {
+	if c.budget == 0 {
+		return CachedTile{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return CachedTile{}, false
+	}
+	entry := element.Value.(*tileCacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.remove(element)
+		c.misses.Add(1)
+		return CachedTile{}, false
+	}
+	c.order.MoveToFront(element)
+	if entry.tile.Missing {
+		c.negativeHits.Add(1)
+	} else {
+		c.hits.Add(1)
+	}
+	return entry.tile, true
+}
+
+// Put caches the blob of a tile. Blobs larger than a quarter of the budget are
+// not cached so a few huge tiles cannot flush everything else.
+func (c *TileCache) Put(key TileKey, data []byte, contentType string) {
+	c.PutUntil(key, CachedTile{Data: data, ContentType: contentType}, time.Time{})
+}
+
+// PutUntil caches tile like Put until expires, for ever when it is zero
+func (c *TileCache) PutUntil(key TileKey, tile CachedTile, expires time.Time) {
+	cost := int64(len(tile.Data)) + int64(len(key.Repository)+len(key.Variant)) + tileEntryOverhead
+	if c.budget == 0 || cost > c.budget/4 {
+		return
+	}
+	c.put(&tileCacheEntry{key: key, tile: tile, cost: cost, expires: expires})
+}
+
+// PutMissing remembers that a tile does not exist for the negative TTL
+func (c *TileCache) PutMissing(key TileKey) {
+	if c.budget == 0 || c.negativeTTL <= 0 {
+		return
+	}
+	c.put(&tileCacheEntry{
+		key:     key,
+		tile:    CachedTile{Missing: true},
+		cost:    int64(len(key.Repository)) + tileEntryOverhead,
+		expires: time.Now().Add(c.negativeTTL),
+	})
+}
+
+func (c *TileCache) put(entry *tileCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[entry.key]; ok {
+		c.remove(element)
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	c.size += entry.cost
+	for c.size > c.budget {
+		c.remove(c.order.Back())
+		c.evictions.Add(1)
+	}
+}
+
+// EvictIf drops every cached tile whose key matches and returns how many were dropped
+func (c *TileCache) EvictIf(match func(key TileKey) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	evicted := 0
+	for key, element := range c.entries {
+		if match(key) {
+			c.remove(element)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// EvictRepository drops every cached tile of the named repository
+func (c *TileCache) EvictRepository(name string) int {
+	return c.EvictIf(func(key TileKey) bool { return key.Repository == name })
+}
+
+// Stats returns the current counters of the cache
+func (c *TileCache) Stats() TileCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return TileCacheStats{
+		Entries:      c.order.Len(),
+		Bytes:        c.size,
+		Budget:       c.budget,
+		Hits:         c.hits.Load(),
+		NegativeHits: c.negativeHits.Load(),
+		Misses:       c.misses.Load(),
+		Evictions:    c.evictions.Load(),
+	}
+}
+
+// remove takes an entry out of the cache, the caller must hold c.mu
+func (c *TileCache) remove(element *list.Element) {
+	entry := element.Value.(*tileCacheEntry)
+	c.order.Remove(element)
+	delete(c.entries, entry.key)
+	c.size -= entry.cost
+}
@@ -0,0 +1,240 @@
+package sfile
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	"sort"
+	"strings"
+)
+
+// mixedFormat is recorded in the meta table of a .s file holding tiles of several formats
+const mixedFormat = "mixed"
+
+// Sampling of the tiles analysis detects the formats of a repository from
+const (
+	formatSampleFiles = 8 // .s files read per zoom
+	formatSampleTiles = 8 // tiles read per file
+)
+
+// formatContentTypes are the content types of the tile formats that settle it;
+// pbf tiles may or may not be gzipped and are still sniffed
+var formatContentTypes = map[string]string{
+	"png":  "image/png",
+	"jpg":  "image/jpeg",
+	"webp": "image/webp",
+	"gif":  "image/gif",
+	"json": "application/json",
+}
+
+// tileContentType returns the content type of a tile of a .s file whose meta
+// table records format, sniffing data when the format does not settle it
+func tileContentType(format string, data []byte) string {
+	if contentType, ok := formatContentTypes[format]; ok {
+		return contentType
+	}
+	return DetectContentType(data)
+}
+
+// shardFormat returns the format recorded in the meta table of a .s file, "" when
+// the file does not record one
+func shardFormat(db queryRower) (string, error) {
+	var format string
+	err := db.QueryRow("select value from meta where key = 'format'").Scan(&format)
+	if err != nil && (errors.Is(err, sql.ErrNoRows) || strings.Contains(err.Error(), "no such table")) {
+		return "", nil
+	}
+	return format, err
+}
+
+// recordShardFormat records in the meta table of the file written in tx the
+// format of the tiles just written to it, formats holding one entry per format.
+// A file that already held tiles before it recorded a format has those sampled
+// first, and a file with tiles of several formats records mixedFormat.
+func recordShardFormat(tx *sql.Tx, dedup bool, formats map[string]bool) error {
+	if len(formats) == 0 {
+		return nil
+	}
+	if _, err := tx.Exec("create table if not exists meta (key TEXT PRIMARY KEY, value TEXT)"); err != nil {
+		return err
+	}
+	current, err := shardFormat(tx)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for format := range formats {
+		seen[format] = true
+	}
+	if current == "" {
+		// the tiles written before the file recorded its format are not known yet
+		tableNames, err := listTileTables(tx)
+		if err != nil {
+			return err
+		}
+		for _, tableName := range tableNames {
+			_, err := sampleTableFormats(tx, tableName, dedup, formatSampleTiles, func(format string, data []byte) {
+				seen[format] = true
+			})
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		seen[current] = true
+	}
+	format := mixedFormat
+	if len(seen) == 1 {
+		for only := range seen {
+			format = only
+		}
+	}
+	if format == current {
+		return nil
+	}
+	_, err = tx.Exec("insert or replace into meta (key, value) values ('format', ?)", format)
+	return err
+}
+
+// tableQuerier is a *sql.DB or a *sql.Tx
+type tableQuerier interface {
+	queryRower
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// sampleTableFormats calls fn with the format and data of each of up to limit
+// tiles of a table, decompressed when stored compressed, and returns how many
+// tiles it sampled
+func sampleTableFormats(db tableQuerier, tableName string, dedup bool, limit int, fn func(format string, data []byte)) (int, error) {
+	encoding, err := encodingColumn(db, tableName)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := db.Query("select "+tileData(tableName, dedup)+", "+encoding+" from "+tableName+" limit ?", limit)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	sampled := 0
+	for rows.Next() {
+		var data []byte
+		var encoding sql.NullString
+		if err := rows.Scan(&data, &encoding); err != nil {
+			return sampled, err
+		}
+		if data, err = DecodeTile(data, encoding.String); err != nil {
+			return sampled, fmt.Errorf("decode a tile of %s: %w", tableName, err)
+		}
+		if len(data) > 0 {
+			fn(tileFormat(data), data)
+			sampled++
+		}
+	}
+	return sampled, rows.Err()
+}
+
+// formatCounts counts tiles per format for each zoom
+type formatCounts map[int]map[string]int64
+
+func (c formatCounts) add(zoom int, format string, tiles int64) {
+	if c[zoom] == nil {
+		c[zoom] = make(map[string]int64)
+	}
+	c[zoom][format] += tiles
+}
+
+// summarize returns the format of most tiles of each zoom and overall, and
+// whether tiles of more than one format were counted
+func (c formatCounts) summarize() (map[int]string, string, bool) {
+	zoomFormats := make(map[int]string, len(c))
+	total := make(map[string]int64)
+	for zoom, counts := range c {
+		zoomFormats[zoom] = dominantFormat(counts)
+		for format, tiles := range counts {
+			total[format] += tiles
+		}
+	}
+	return zoomFormats, dominantFormat(total), len(total) > 1
+}
+
+// dominantFormat returns the format of most tiles, the first by name on a tie
+func dominantFormat(counts map[string]int64) string {
+	formats := make([]string, 0, len(counts))
+	for format := range counts {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	dominant := ""
+	for _, format := range formats {
+		if dominant == "" || counts[format] > counts[dominant] {
+			dominant = format
+		}
+	}
+	return dominant
+}
+
+// tileSizes counts raster tiles per width in pixels
+type tileSizes map[int]int64
+
+// add counts the width of a raster tile, tiles that are not square images are left out
+func (s tileSizes) add(format string, data []byte) {
+	switch format {
+	case "png", "jpg", "webp", "gif":
+	default:
+		return
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err == nil && config.Width > 0 && config.Width == config.Height {
+		s[config.Width]++
+	}
+}
+
+// dominant returns the width of most tiles, the smallest on a tie, and
+// DefaultTileSize when no tile was counted
+func (s tileSizes) dominant() int {
+	size := 0
+	for width, count := range s {
+		if size == 0 || count > s[size] || count == s[size] && width < size {
+			size = width
+		}
+	}
+	if size == 0 {
+		return DefaultTileSize
+	}
+	return size
+}
+
+// sampleZoomFormats counts the formats and sizes of up to formatSampleTiles tiles
+// of each of up to formatSampleFiles .s files of one zoom, spread over the files
+// so one odd file does not decide the format of the zoom
+func sampleZoomFormats(zoom int, files []string, counts formatCounts, sizes tileSizes) {
+	picked := min(len(files), formatSampleFiles)
+	for i := 0; i < picked; i++ {
+		shard, release, err := openShardMetadata(files[i*len(files)/picked])
+		if err != nil {
+			continue
+		}
+		tableNames, err := listTables(shard.db)
+		if err != nil {
+			release()
+			continue
+		}
+		remaining := formatSampleTiles
+		for _, tableName := range tableNames {
+			if remaining == 0 {
+				break
+			}
+			if !validTableName.MatchString(tableName) {
+				continue
+			}
+			sampled, _ := sampleTableFormats(shard.db, tableName, shard.dedup, remaining, func(format string, data []byte) {
+				counts.add(zoom, format, 1)
+				sizes.add(format, data)
+			})
+			remaining -= sampled
+		}
+		release()
+	}
+}
@@ -0,0 +1,282 @@
+package sfile
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// The tile math of the web mercator (EPSG:3857) tile system served by SirServer.
+//
+// Three coordinate systems are involved:
+//   - lng/lat, WGS84 degrees, lat limited to ±MaxLatitude
+//   - meters, web mercator with the origin at lng/lat 0/0, x growing eastwards
+//     and y northwards, both within ±ORIGIN_SHIFT
+//   - pixels and tiles, with the origin at the top left (north west) corner of
+//     the world, x growing eastwards and y southwards. Tile x/y/z is the XYZ
+//     scheme of OSM and Google; TMS, used by MBTiles and gdal2tiles, counts
+//     rows from the bottom instead, see FlipY.
+//
+// Repositories declaring GridGeodetic address their tiles the same way but map
+// them onto lng/lat directly, see TileGrid.
+
+var INITIALIZE_RESOLUTION = 2. * math.Pi * 6378137 / DefaultTileSize
+
+var ORIGIN_SHIFT = 2 * math.Pi * 6378137 / 2.0
+
+// MaxLatitude is the latitude of the top edge of tile 0/0/0, web mercator
+// leaves out the poles
+const MaxLatitude = 85.05112877980659
+
+// Resolution returns the meters per pixel at zoom z of tiles DefaultTileSize
+// pixels wide, exact on the equator only
+func Resolution(z int) float64 {
+	return INITIALIZE_RESOLUTION / math.Exp2(float64(z))
+}
+
+// LngLatToMeters converts a WGS84 coordinate to web mercator meters
+func LngLatToMeters(lng float64, lat float64) (float64, float64) {
+	mx := lng * ORIGIN_SHIFT / 180.0
+	my := math.Log(math.Tan((90+lat)*math.Pi/360.0)) / (math.Pi / 180.0)
+	my = my * ORIGIN_SHIFT / 180.0
+	return mx, my
+}
+
+// MetersToLngLat converts web mercator meters to a WGS84 coordinate, the
+// inverse of LngLatToMeters
+func MetersToLngLat(mx float64, my float64) (float64, float64) {
+	lon := (mx / ORIGIN_SHIFT) * 180.0
+	lat := (my / ORIGIN_SHIFT) * 180.0
+
+	lat = 180 / math.Pi * (2*math.Atan(math.Exp(lat*math.Pi/180.0)) - math.Pi/2.0)
+	return lon, lat
+}
+
+// pixelsToMeters converts global pixel coordinates at zoom to web mercator meters
+func pixelsToMeters(px float64, py float64, zoom int) (float64, float64) {
+	//zoom级别 每个像素对应的地面米数 该值只在赤道上是准确的 其他地方都有偏差，但是这个偏差只是为了对位置的一个描述
+	res := Resolution(zoom)
+	//    墨卡托 米     离左上角的米数       墨卡托的坐标原点X
+	mx := px*res - ORIGIN_SHIFT
+	//     墨卡托 米       离左上角的米数 Y方向      墨卡托的坐标原点Y
+	my := -(py*res - ORIGIN_SHIFT)
+	return mx, my
+}
+
+// metersToPixels converts web mercator meters to global pixel coordinates at zoom,
+// the inverse of pixelsToMeters
+func metersToPixels(mx float64, my float64, zoom int) (float64, float64) {
+	res := Resolution(zoom)
+	px := (mx + ORIGIN_SHIFT) / res
+	py := (ORIGIN_SHIFT - my) / res
+	return px, py
+}
+
+// LngLatToPixels converts a WGS84 coordinate to global pixel coordinates at zoom,
+// with the origin at the top left corner of tile 0/0 and y growing southwards
+func LngLatToPixels(lng float64, lat float64, zoom int32) (float64, float64) {
+	mx, my := LngLatToMeters(lng, lat)
+	return metersToPixels(mx, my, int(zoom))
+}
+
+// LngLatToTile returns the XYZ tile at zoom z holding a WGS84 coordinate.
+// Coordinates outside the world, such as lat beyond ±MaxLatitude, are clamped
+// to its edge tiles; a coordinate on the border of two tiles belongs to the
+// east and south one.
+func LngLatToTile(lng float64, lat float64, z int) (x int64, y int64) {
+	lng = min(max(lng, -180), 180)
+	lat = min(max(lat, -MaxLatitude), MaxLatitude)
+	px, py := LngLatToPixels(lng, lat, int32(z))
+	last := int64(1)<<z - 1
+	clamp := func(v float64) int64 {
+		return min(max(int64(math.Floor(v/DefaultTileSize)), 0), last)
+	}
+	return clamp(px), clamp(py)
+}
+
+// TileToBounds returns the WGS84 bounds of XYZ tile x/y at zoom z. The bounds
+// do not depend on the pixel size of the tiles.
+func TileToBounds(x int64, y int64, z int) Box {
+	mx0, my0 := pixelsToMeters(float64(x)*DefaultTileSize, float64(y)*DefaultTileSize, z)
+	lng0, lat0 := MetersToLngLat(mx0, my0)
+	mx1, my1 := pixelsToMeters(float64(x+1)*DefaultTileSize, float64(y+1)*DefaultTileSize, z)
+	lng1, lat1 := MetersToLngLat(mx1, my1)
+	return Box{MinX: lng0, MinY: lat1, MaxX: lng1, MaxY: lat0}
+}
+
+// FlipY converts the row of a tile at zoom z between the XYZ and the TMS
+// scheme, which count rows from the top and from the bottom of the world
+func FlipY(y int64, z int) int64 {
+	return int64(1)<<z - 1 - y
+}
+
+// TileRange returns the inclusive range of tiles at zoom covering bbox, given as
+// minLng, minLat, maxLng, maxLat. The range is clamped to the tiles of the world.
+func TileRange(bbox [4]float64, zoom int8) (minX int64, minY int64, maxX int64, maxY int64) {
+	minX, minY = LngLatToTile(bbox[0], bbox[3], int(zoom))
+	maxX, maxY = LngLatToTile(bbox[2], bbox[1], int(zoom))
+	return minX, minY, maxX, maxY
+}
+
+// TileGrid is the tiling scheme of a repository. It decides which part of the
+// world a tile x/y/z covers, the tiles are addressed the same way in both.
+type TileGrid string
+
+const (
+	// GridMercator is the web mercator (EPSG:3857) grid with one root tile, the
+	// grid of a repository that declares none
+	GridMercator TileGrid = "mercator"
+	// GridGeodetic is the WGS84 geodetic (EPSG:4326) grid with two root tiles side
+	// by side, each 180 degrees wide. Rows count from the top, lat 90, like XYZ.
+	GridGeodetic TileGrid = "geodetic"
+)
+
+// ErrTileGridMismatch is returned when tiles would be written to a repository in
+// another grid than the one its tiles are cut in
+var ErrTileGridMismatch = errors.New("tile grid does not match the repository")
+
+// ParseTileGrid parses the grid of a repository, "" being GridMercator
+func ParseTileGrid(value string) (TileGrid, error) {
+	switch TileGrid(value) {
+	case "", GridMercator:
+		return GridMercator, nil
+	case GridGeodetic:
+		return GridGeodetic, nil
+	default:
+		return "", fmt.Errorf("unknown tile grid %q, expected %s or %s", value, GridMercator, GridGeodetic)
+	}
+}
+
+// GeodeticResolution returns the degrees per pixel at zoom z of the geodetic
+// grid with tiles DefaultTileSize pixels wide
+func GeodeticResolution(z int) float64 {
+	return 180.0 / DefaultTileSize / math.Exp2(float64(z))
+}
+
+// GeodeticLngLatToTile returns the geodetic tile at zoom z holding a WGS84
+// coordinate, clamped to the tiles of the world. Zoom z has 2^(z+1) columns
+// and 2^z rows.
+func GeodeticLngLatToTile(lng float64, lat float64, z int) (x int64, y int64) {
+	px, py := GridGeodetic.LngLatToPixels(lng, lat, z)
+	columns, rows := GridGeodetic.Matrix(z)
+	x = min(max(int64(math.Floor(px/DefaultTileSize)), 0), columns-1)
+	y = min(max(int64(math.Floor(py/DefaultTileSize)), 0), rows-1)
+	return x, y
+}
+
+// GeodeticTileToBounds returns the WGS84 bounds of geodetic tile x/y at zoom z
+func GeodeticTileToBounds(x int64, y int64, z int) Box {
+	span := 180.0 / math.Exp2(float64(z))
+	return Box{
+		MinX: -180 + float64(x)*span,
+		MinY: 90 - float64(y+1)*span,
+		MaxX: -180 + float64(x+1)*span,
+		MaxY: 90 - float64(y)*span,
+	}
+}
+
+// ErrInvalidCoordinate is matched by every CoordinateError
+var ErrInvalidCoordinate = errors.New("invalid tile coordinate")
+
+// CoordinateError reports tile coordinates that address no tile, as given. Err
+// is ErrZoomOutOfRange wrapped with details for a zoom the shard naming cannot
+// address, and nil for a tile outside the world of its grid.
+type CoordinateError struct {
+	Z       int
+	X       int64
+	Y       int64
+	Columns int64 // tiles across the world at zoom Z, 0 when the zoom is invalid
+	Rows    int64 // tiles down the world at zoom Z, 0 when the zoom is invalid
+	Err     error
+}
+
+func (e *CoordinateError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("tile %d/%d/%d: %s: %s", e.Z, e.X, e.Y, ErrInvalidCoordinate, e.Err)
+	}
+	return fmt.Sprintf("tile %d/%d/%d: %s: outside the world, x must be within 0..%d and y within 0..%d", e.Z, e.X, e.Y, ErrInvalidCoordinate, e.Columns-1, e.Rows-1)
+}
+
+func (e *CoordinateError) Is(target error) bool {
+	return target == ErrInvalidCoordinate
+}
+
+func (e *CoordinateError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateXYZ returns a *CoordinateError when x/y/z addresses no tile of the web
+// mercator grid, before anything reaches the file system. z is taken as an int so
+// zooms overflowing an int8 are rejected rather than wrapped around.
+func ValidateXYZ(x int64, y int64, z int) error {
+	return GridMercator.ValidateXYZ(x, y, z)
+}
+
+// ValidateXYZ returns a *CoordinateError when x/y/z addresses no tile of the grid
+func (g TileGrid) ValidateXYZ(x int64, y int64, z int) error {
+	if err := checkZoom(z); err != nil {
+		return &CoordinateError{Z: z, X: x, Y: y, Err: err}
+	}
+	columns, rows := g.Matrix(z)
+	if x < 0 || y < 0 || x >= columns || y >= rows {
+		return &CoordinateError{Z: z, X: x, Y: y, Columns: columns, Rows: rows}
+	}
+	return nil
+}
+
+// checkTile is ValidateXYZ for the int8 zooms used past the validation
+func (g TileGrid) checkTile(x int64, y int64, z int8) error {
+	return g.ValidateXYZ(x, y, int(z))
+}
+
+// TileRange returns the inclusive range of tiles at zoom covering bbox, given as
+// minLng, minLat, maxLng, maxLat, clamped to the tiles of the world
+func (g TileGrid) TileRange(bbox [4]float64, zoom int8) (minX int64, minY int64, maxX int64, maxY int64) {
+	minX, minY = g.LngLatToTile(bbox[0], bbox[3], int(zoom))
+	maxX, maxY = g.LngLatToTile(bbox[2], bbox[1], int(zoom))
+	return minX, minY, maxX, maxY
+}
+
+// MaxLatitude returns the latitude of the top edge of the grid
+func (g TileGrid) MaxLatitude() float64 {
+	if g == GridGeodetic {
+		return 90
+	}
+	return MaxLatitude
+}
+
+// Matrix returns the columns and rows of tiles at zoom z
+func (g TileGrid) Matrix(z int) (columns int64, rows int64) {
+	if g == GridGeodetic {
+		return int64(2) << z, int64(1) << z
+	}
+	return int64(1) << z, int64(1) << z
+}
+
+// LngLatToPixels converts a WGS84 coordinate to global pixel coordinates at
+// zoom z, with the origin at the top left corner of tile 0/0 and y growing
+// southwards
+func (g TileGrid) LngLatToPixels(lng float64, lat float64, z int) (float64, float64) {
+	if g == GridGeodetic {
+		res := GeodeticResolution(z)
+		return (lng + 180) / res, (90 - lat) / res
+	}
+	return LngLatToPixels(lng, lat, int32(z))
+}
+
+// LngLatToTile returns the tile at zoom z holding a WGS84 coordinate, see
+// LngLatToTile and GeodeticLngLatToTile
+func (g TileGrid) LngLatToTile(lng float64, lat float64, z int) (x int64, y int64) {
+	if g == GridGeodetic {
+		return GeodeticLngLatToTile(lng, lat, z)
+	}
+	return LngLatToTile(lng, lat, z)
+}
+
+// TileToBounds returns the WGS84 bounds of tile x/y at zoom z
+func (g TileGrid) TileToBounds(x int64, y int64, z int) Box {
+	if g == GridGeodetic {
+		return GeodeticTileToBounds(x, y, z)
+	}
+	return TileToBounds(x, y, z)
+}
@@ -0,0 +1,262 @@
+package sfile
+
+import (
+	"errors"
+	"maps"
+	"math"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// coordinateSeeds are corpus entries on and around the edges of the
+// coordinate space
+var coordinateSeeds = []struct {
+	x, y int64
+	z    int
+}{
+	{0, 0, 0}, {1, 0, 0}, {0, 1, 0}, {-1, 0, 0}, {0, -1, 0},
+	{1, 0, 1}, {2, 0, 1}, {3, 1, 1}, {3, 2, 1},
+	{1<<20 - 1, 1<<20 - 1, 20}, {1 << 20, 0, 20},
+	{1<<30 - 1, 1<<30 - 1, 30}, {1 << 30, 0, 30}, {0, 0, 31}, {0, 0, -1},
+	{math.MaxInt64, math.MaxInt64, 30}, {math.MinInt64, math.MinInt64, 30},
+	{0, 0, math.MaxInt32}, {0, 0, math.MinInt32}, {0, 0, 120}, {0, 0, 256 + 4},
+}
+
+// FuzzValidateXYZ checks ValidateXYZ never panics and accepts exactly the tiles
+// of the world of each grid, worked out with big integers, refusing the others
+// with a CoordinateError matching ErrInvalidCoordinate
+func FuzzValidateXYZ(f *testing.F) {
+	for _, seed := range coordinateSeeds {
+		f.Add(seed.x, seed.y, seed.z)
+	}
+	f.Fuzz(func(t *testing.T, x int64, y int64, z int) {
+		for _, grid := range []TileGrid{GridMercator, GridGeodetic} {
+			err := grid.ValidateXYZ(x, y, z)
+			valid := z >= 0 && z <= MaxTileZoom && x >= 0 && y >= 0
+			if valid {
+				columns := new(big.Int).Lsh(big.NewInt(1), uint(z))
+				rows := new(big.Int).Set(columns)
+				if grid == GridGeodetic {
+					columns.Lsh(columns, 1)
+				}
+				valid = big.NewInt(x).Cmp(columns) < 0 && big.NewInt(y).Cmp(rows) < 0
+			}
+			if valid {
+				if err != nil {
+					t.Fatalf("%s ValidateXYZ(%d, %d, %d): %v, want valid", grid, x, y, z, err)
+				}
+				continue
+			}
+			var coordinateErr *CoordinateError
+			if !errors.Is(err, ErrInvalidCoordinate) || !errors.As(err, &coordinateErr) {
+				t.Fatalf("%s ValidateXYZ(%d, %d, %d): %v, want a CoordinateError", grid, x, y, z, err)
+			}
+			if outOfRange := z < 0 || z > MaxTileZoom; errors.Is(err, ErrZoomOutOfRange) != outOfRange {
+				t.Fatalf("%s ValidateXYZ(%d, %d, %d): %v, zoom out of range %v", grid, x, y, z, err, outOfRange)
+			}
+		}
+	})
+}
+
+// FuzzInvalidTileAccess reads and writes tiles at fuzzed coordinates and checks
+// those ValidateXYZ refuses are refused with ErrInvalidCoordinate before the
+// file system is touched: no shard opened, no file or directory created
+func FuzzInvalidTileAccess(f *testing.F) {
+	for _, seed := range coordinateSeeds {
+		f.Add(seed.x, seed.y, int8(seed.z))
+	}
+	f.Add(int64(0), int64(0), int8(math.MinInt8))
+	f.Add(int64(0), int64(0), int8(math.MaxInt8))
+	repo, root := newTestRepository(f, "")
+	if err := repo.WriteXYZ(0, 0, 1, []byte("tile")); err != nil {
+		f.Fatal(err)
+	}
+	FlushHandles(func(path string) bool { return strings.HasPrefix(path, root) })
+	before := snapshotTree(f, root)
+
+	f.Fuzz(func(t *testing.T, x int64, y int64, z int8) {
+		if GridMercator.ValidateXYZ(x, y, int(z)) == nil {
+			return
+		}
+		if _, err := repo.GetXYZ(x, y, z); !errors.Is(err, ErrInvalidCoordinate) {
+			t.Fatalf("GetXYZ(%d, %d, %d): %v, want ErrInvalidCoordinate", x, y, z, err)
+		}
+		if err := repo.WriteXYZ(x, y, z, []byte("tile")); !errors.Is(err, ErrInvalidCoordinate) {
+			t.Fatalf("WriteXYZ(%d, %d, %d): %v, want ErrInvalidCoordinate", x, y, z, err)
+		}
+		if n := FlushHandles(func(path string) bool { return strings.HasPrefix(path, root) }); n != 0 {
+			t.Fatalf("tile %d/%d/%d opened %d shards", z, x, y, n)
+		}
+		if after := snapshotTree(t, root); !maps.Equal(before, after) {
+			t.Fatalf("tile %d/%d/%d changed the repository from %v to %v", z, x, y, before, after)
+		}
+	})
+}
+
+// closeTo tells whether got is within 1e-9 of want, the precision the
+// reference values below are given to
+func closeTo(got float64, want float64) bool {
+	return math.Abs(got-want) <= 1e-9*max(1, math.Abs(want))
+}
+
+// closeBox tells whether the corners of got are within closeTo of want
+func closeBox(got Box, want Box) bool {
+	return closeTo(got.MinX, want.MinX) && closeTo(got.MinY, want.MinY) && closeTo(got.MaxX, want.MaxX) && closeTo(got.MaxY, want.MaxY)
+}
+
+// TestLngLatToTile checks the tiles of landmarks against the slippy map
+// reference formula of the OSM wiki, and the clamping at the edges of the world
+func TestLngLatToTile(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		lng, lat float64
+		z        int
+		x, y     int64
+	}{
+		{"whole world", 13.405, 52.52, 0, 0, 0},
+		{"Berlin", 13.405, 52.52, 10, 550, 335},
+		{"Eiffel tower", 2.2945, 48.8584, 15, 16592, 11272},
+		{"Statue of Liberty", -74.0445, 40.6892, 12, 1205, 1540},
+		{"Sydney opera", 151.2153, -33.8568, 14, 15073, 9831},
+		{"Tian'anmen", 116.3913, 39.9075, 18, 215825, 99330},
+		{"null island belongs to the south east tile", 0, 0, 1, 1, 1},
+		{"just north west of null island", -0.0001, 0.0001, 1, 0, 0},
+		{"north west corner", -180, MaxLatitude, 2, 0, 0},
+		{"south east corner", 180, -MaxLatitude, 2, 3, 3},
+		{"north pole clamped", 10, 90, 3, 4, 0},
+		{"beyond the antimeridian clamped", 200, -90, 3, 7, 7},
+	} {
+		if x, y := LngLatToTile(tc.lng, tc.lat, tc.z); x != tc.x || y != tc.y {
+			t.Errorf("%s: LngLatToTile(%g, %g, %d) = %d/%d, want %d/%d", tc.name, tc.lng, tc.lat, tc.z, x, y, tc.x, tc.y)
+		}
+	}
+}
+
+// TestTileToBounds checks tile bounds against the slippy map reference
+// formula, and that every tile holds its own center
+func TestTileToBounds(t *testing.T) {
+	for _, tc := range []struct {
+		x, y int64
+		z    int
+		want Box
+	}{
+		{0, 0, 0, Box{MinX: -180, MinY: -MaxLatitude, MaxX: 180, MaxY: MaxLatitude}},
+		{1, 0, 1, Box{MinX: 0, MinY: 0, MaxX: 180, MaxY: MaxLatitude}},
+		{1, 1, 2, Box{MinX: -90, MinY: 0, MaxX: 0, MaxY: 66.51326044311186}},
+		{3, 4, 3, Box{MinX: -45, MinY: -40.97989806962013, MaxX: 0, MaxY: 0}},
+		{550, 335, 10, Box{MinX: 13.359375, MinY: 52.48278022207821, MaxX: 13.7109375, MaxY: 52.69636107827448}},
+	} {
+		got := TileToBounds(tc.x, tc.y, tc.z)
+		if !closeBox(got, tc.want) {
+			t.Errorf("TileToBounds(%d, %d, %d) = %+v, want %+v", tc.x, tc.y, tc.z, got, tc.want)
+		}
+		if x, y := LngLatToTile((got.MinX+got.MaxX)/2, (got.MinY+got.MaxY)/2, tc.z); x != tc.x || y != tc.y {
+			t.Errorf("center of tile %d/%d/%d is in tile %d/%d", tc.z, tc.x, tc.y, x, y)
+		}
+	}
+}
+
+// TestMetersToLngLat checks web mercator meters against reference coordinates
+// and the round trip through LngLatToMeters
+func TestMetersToLngLat(t *testing.T) {
+	for _, tc := range []struct {
+		mx, my   float64
+		lng, lat float64
+	}{
+		{0, 0, 0, 0},
+		{ORIGIN_SHIFT, 0, 180, 0},
+		{-ORIGIN_SHIFT, -ORIGIN_SHIFT, -180, -MaxLatitude},
+		{0, ORIGIN_SHIFT, 0, MaxLatitude},
+		{-8238310.235647004, 4970071.579142427, -74.006, 40.7128},
+		{1492237.6708, 6894699.8004, 13.404999072185548, 52.51999999517656},
+	} {
+		lng, lat := MetersToLngLat(tc.mx, tc.my)
+		if !closeTo(lng, tc.lng) || !closeTo(lat, tc.lat) {
+			t.Errorf("MetersToLngLat(%g, %g) = %.12g, %.12g, want %.12g, %.12g", tc.mx, tc.my, lng, lat, tc.lng, tc.lat)
+		}
+		if mx, my := LngLatToMeters(tc.lng, tc.lat); math.Abs(mx-tc.mx) > 1e-6 || math.Abs(my-tc.my) > 1e-6 {
+			t.Errorf("LngLatToMeters(%g, %g) = %.6f, %.6f, want %.6f, %.6f", tc.lng, tc.lat, mx, my, tc.mx, tc.my)
+		}
+	}
+}
+
+// TestResolution checks the meters per pixel against the reference values of
+// the OSM wiki, 156543.03 m at zoom 0 halving with every zoom
+func TestResolution(t *testing.T) {
+	for _, tc := range []struct {
+		z    int
+		want float64
+	}{
+		{0, 156543.03392804097},
+		{1, 78271.51696402048},
+		{10, 152.8740565703525},
+		{19, 0.29858214173896974},
+		{24, 0.009330691929342804},
+	} {
+		if got := Resolution(tc.z); !closeTo(got, tc.want) {
+			t.Errorf("Resolution(%d) = %.17g, want %.17g", tc.z, got, tc.want)
+		}
+	}
+}
+
+// TestGeodeticGrid checks the geodetic grid has its origin at the top left,
+// lng -180 lat 90, with rows growing southwards, and is twice as wide as it is
+// high: two root tiles side by side at zoom 0
+func TestGeodeticGrid(t *testing.T) {
+	if columns, rows := GridGeodetic.Matrix(0); columns != 2 || rows != 1 {
+		t.Fatalf("zoom 0 of %d x %d tiles, want 2 x 1", columns, rows)
+	}
+	if columns, rows := GridGeodetic.Matrix(5); columns != 64 || rows != 32 {
+		t.Fatalf("zoom 5 of %d x %d tiles, want 64 x 32", columns, rows)
+	}
+	if px, py := GridGeodetic.LngLatToPixels(-180, 90, 0); px != 0 || py != 0 {
+		t.Errorf("north west corner at pixel %g, %g, want the origin", px, py)
+	}
+	if px, py := GridGeodetic.LngLatToPixels(180, -90, 0); px != 2*DefaultTileSize || py != DefaultTileSize {
+		t.Errorf("south east corner at pixel %g, %g, want %d, %d", px, py, 2*DefaultTileSize, DefaultTileSize)
+	}
+	if res := GeodeticResolution(0); res != 0.703125 {
+		t.Errorf("zoom 0 resolution %g degrees per pixel, want 0.703125", res)
+	}
+
+	for _, tc := range []struct {
+		x, y int64
+		z    int
+		want Box
+	}{
+		{0, 0, 0, Box{MinX: -180, MinY: -90, MaxX: 0, MaxY: 90}},
+		{1, 0, 0, Box{MinX: 0, MinY: -90, MaxX: 180, MaxY: 90}},
+		{0, 0, 1, Box{MinX: -180, MinY: 0, MaxX: -90, MaxY: 90}},
+		{3, 1, 1, Box{MinX: 90, MinY: -90, MaxX: 180, MaxY: 0}},
+		{1686, 285, 10, Box{MinX: 116.3671875, MinY: 39.7265625, MaxX: 116.54296875, MaxY: 39.90234375}},
+	} {
+		got := GridGeodetic.TileToBounds(tc.x, tc.y, tc.z)
+		if !closeBox(got, tc.want) {
+			t.Errorf("geodetic bounds of %d/%d/%d = %+v, want %+v", tc.z, tc.x, tc.y, got, tc.want)
+		}
+		if got.Width() != got.Height() {
+			t.Errorf("geodetic tile %d/%d/%d of %g x %g degrees, want square", tc.z, tc.x, tc.y, got.Width(), got.Height())
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		lng, lat float64
+		z        int
+		x, y     int64
+	}{
+		{"western hemisphere", -100, 45, 0, 0, 0},
+		{"eastern hemisphere", 100, -45, 0, 1, 0},
+		{"north west corner", -180, 90, 1, 0, 0},
+		{"south west corner", -180, -90, 1, 0, 1},
+		{"south east corner clamped", 180, -90, 1, 3, 1},
+		{"north of the equator is row 0", 10, 0.0001, 1, 2, 0},
+		{"the equator belongs to the south row", 10, 0, 1, 2, 1},
+		{"Beijing", 116.4, 39.9, 10, 1686, 285},
+	} {
+		if x, y := GridGeodetic.LngLatToTile(tc.lng, tc.lat, tc.z); x != tc.x || y != tc.y {
+			t.Errorf("%s: geodetic tile of %g, %g at zoom %d = %d/%d, want %d/%d", tc.name, tc.lng, tc.lat, tc.z, x, y, tc.x, tc.y)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package sfile
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Tile is a stored tile with the content type detected from its bytes
+type Tile struct {
+	Data        []byte
+	ContentType string
+	Source      string    // TileSourceLocal, or TileSourceUpstream when it was just fetched
+	Expires     time.Time // when the tile expires in a repository with a TTL, zero when it does not
+	Modified    time.Time // when the tile was written, zero when its repository does not know
+	Encoding    string    // EncodingGzip when Data is compressed, only set by GetEncodedTile
+}
+
+// TileSource is a repository tiles are served from, whatever its storage format
+type TileSource interface {
+	GetTile(ctx context.Context, z int8, x int64, y int64) (Tile, error)
+	Metadata() Repository
+	Close() error
+}
+
+// TileRangeReader is implemented by tile sources that read a block of tiles in one pass
+type TileRangeReader interface {
+	GetXYZRange(z int8, xMin int64, xMax int64, yMin int64, yMax int64, fn func(x int64, y int64, data []byte) error) error
+}
+
+// TileLister is implemented by tile sources that can enumerate the tiles of a zoom
+type TileLister interface {
+	ListTiles(z int8, fn func(x int64, y int64) error) error
+}
+
+// EncodedTileReader is implemented by tile sources storing tiles compressed. It
+// returns the tile as stored with its Encoding, so it can be sent with
+// Content-Encoding without decompressing it first.
+type EncodedTileReader interface {
+	GetEncodedTile(ctx context.Context, z int8, x int64, y int64) (Tile, error)
+}
+
+// TemporalReader is implemented by tile sources that may keep the earlier
+// versions of their tiles. GetTileAt returns the version current at a time as
+// stored, or ErrNotTemporal when the source keeps none.
+type TemporalReader interface {
+	GetTileAt(ctx context.Context, z int8, x int64, y int64, at time.Time) (Tile, error)
+}
+
+// ModifiedLister is implemented by tile sources that know when their tiles were
+// written and can enumerate the tiles of a zoom written since a time
+type ModifiedLister interface {
+	ListTilesModifiedSince(z int8, since time.Time, fn func(x int64, y int64) error) error
+}
+
+// TileBackend opens the repositories of one storage format. Match is given the
+// full path of a repository and Open the root directory and repository name.
+type TileBackend struct {
+	Name  string
+	Match func(path string) bool
+	Open  func(root string, name string) (TileSource, error)
+}
+
+// tileBackends are the registered backends, tried in registration order before
+// falling back to a directory of .s files
+var tileBackends = struct {
+	sync.RWMutex
+	list []*TileBackend
+}{}
+
+// RegisterTileSource adds a storage backend, usually from the init function of
+// the file implementing it. The returned function removes it again, for
+// backends that only serve for a while, such as those of tests.
+func RegisterTileSource(backend TileBackend) (unregister func()) {
+	tileBackends.Lock()
+	defer tileBackends.Unlock()
+	registered := &backend
+	tileBackends.list = append(tileBackends.list, registered)
+	return func() {
+		tileBackends.Lock()
+		defer tileBackends.Unlock()
+		tileBackends.list = slices.DeleteFunc(tileBackends.list, func(b *TileBackend) bool { return b == registered })
+	}
+}
+
+// tileBackendFor returns the registered backend serving the repository at path
+func tileBackendFor(path string) (TileBackend, bool) {
+	tileBackends.RLock()
+	defer tileBackends.RUnlock()
+	for _, backend := range tileBackends.list {
+		if backend.Match(path) {
+			return *backend, true
+		}
+	}
+	return TileBackend{}, false
+}
+
+// OpenTileSource returns the repository named name under root, choosing the
+// backend from the file or directory found there. Repositories no registered
+// backend claims are read as a directory of .s files, which fill themselves from
+// their upstream when repository.json has one.
+func OpenTileSource(root string, name string) (TileSource, error) {
+	if location, ok := s3RootFor(root); ok {
+		return s3Source{root: location, name: name}, nil
+	}
+	if backend, ok := tileBackendFor(filepath.Join(root, filepath.FromSlash(name))); ok {
+		source, err := backend.Open(root, name)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %s: %w", ErrRepositoryNotFound, name, err)
+		}
+		return source, err
+	}
+	repository, err := NewRepository(filepath.Join(root, filepath.FromSlash(name)), false)
+	if err != nil {
+		return nil, err
+	}
+	repository.root, repository.name = root, name
+	repository.indexed = true
+	if config, ok := upstream.config(repository.dir); ok {
+		return upstreamRepository{SRepository: repository, config: config}, nil
+	}
+	return repository, nil
+}
+
+// IsArchive reports whether the repository at path is served by a registered
+// backend, such as a .pmtiles archive or a GeoPackage layer, rather than a
+// directory of .s files
+func IsArchive(path string) bool {
+	_, ok := tileBackendFor(path)
+	return ok
+}
+
+// GetTile returns tile x/y/z of the repository, decompressed when it is stored compressed
+func (f *SRepository) GetTile(ctx context.Context, z int8, x int64, y int64) (Tile, error) {
+	tile, err := f.GetEncodedTile(ctx, z, x, y)
+	if err != nil || tile.Encoding == "" {
+		return tile, err
+	}
+	if tile.Data, err = DecodeTile(tile.Data, tile.Encoding); err != nil {
+		return Tile{}, fmt.Errorf("decode %d/%d/%d: %w", z, x, y, err)
+	}
+	tile.Encoding = ""
+	return tile, nil
+}
+
+// GetEncodedTile returns tile x/y/z of the repository as stored, with the
+// content type of the tile it holds
+func (f *SRepository) GetEncodedTile(ctx context.Context, z int8, x int64, y int64) (Tile, error) {
+	stored, err := f.tracedXYZ(ctx, x, y, z)
+	if err != nil {
+		return Tile{}, err
+	}
+	data := stored.data.Bytes()
+	tile := Tile{Data: data, ContentType: tileContentType(stored.format, data), Source: TileSourceLocal, Encoding: stored.encoding}
+	if _, ok := formatContentTypes[stored.format]; !ok && stored.encoding != "" {
+		// the content type is that of the tile, not of its gzip stream
+		if decoded, err := DecodeTile(data, stored.encoding); err == nil {
+			tile.ContentType = DetectContentType(decoded)
+		}
+	}
+	if !stored.written.IsZero() {
+		tile.Modified = stored.written
+		if f.ttl > 0 {
+			tile.Expires = stored.written.Add(f.ttl)
+		}
+	}
+	return tile, nil
+}
+
+// Metadata returns the repository.json of the repository, analysing it when missing
+func (f *SRepository) Metadata() Repository {
+	if f.name == "" {
+		return LoadRepository(filepath.Dir(f.dir), filepath.Base(f.dir))
+	}
+	return LoadRepository(f.root, f.name)
+}
+
+// Close does nothing, the .s files are opened through the shared handle cache
+func (f *SRepository) Close() error {
+	return nil
+}
+
+// archiveSource serves a repository of a cached single file archive. The
+// archive stays open for other requests, so Close does nothing.
+type archiveSource struct {
+	read     func(ctx context.Context, x int64, y int64, z int8) (*bytes.Buffer, error)
+	metadata func() Repository
+}
+
+func (s archiveSource) GetTile(ctx context.Context, z int8, x int64, y int64) (Tile, error) {
+	data, err := s.read(ctx, x, y, z)
+	if err != nil {
+		return Tile{}, err
+	}
+	return Tile{Data: data.Bytes(), ContentType: DetectContentType(data.Bytes()), Source: TileSourceLocal}, nil
+}
+
+func (s archiveSource) Metadata() Repository {
+	return s.metadata()
+}
+
+func (s archiveSource) Close() error {
+	return nil
+}
@@ -0,0 +1,38 @@
+package sfile
+
+import (
+	"bytes"
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// tracer creates the sfile spans. Until a tracer provider is installed it is a no-op.
+var tracer = otel.Tracer("SirServer/sfile")
+
+// GetXYZContext is GetXYZ recorded as a child span of ctx
+func (f SRepository) GetXYZContext(ctx context.Context, x int64, y int64, z int8) (*bytes.Buffer, error) {
+	tile, err := f.tracedXYZ(ctx, x, y, z)
+	return tile.data, err
+}
+
+// tracedXYZ is getXYZ recorded as a child span of ctx
+func (f SRepository) tracedXYZ(ctx context.Context, x int64, y int64, z int8) (storedTile, error) {
+	_, span := tracer.Start(ctx, "sfile.GetXYZ")
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("sir.repository.dir", f.dir),
+		attribute.Int64("sir.tile.z", int64(z)),
+		attribute.Int64("sir.tile.x", x),
+		attribute.Int64("sir.tile.y", y),
+	)
+	tile, err := f.getXYZ(ctx, x, y, z)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return storedTile{}, err
+	}
+	span.SetAttributes(attribute.Int("sir.tile.bytes", tile.data.Len()))
+	return tile, nil
+}
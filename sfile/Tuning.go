@@ -0,0 +1,111 @@
+package sfile
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// Every .s file is opened through the shardDriver, which applies the PRAGMAs of
+// the SQLiteTuning to each connection as the pool creates it; the journal mode
+// and synchronous setting of writes go in the DSN of openShardForWrite instead.
+// The zero tuning sets nothing, so files are opened as they always were.
+
+// shardDriver is the database/sql driver name openShard opens files with, see
+// Tuning_cgo.go
+const shardDriver = "sqlite3_sirserver"
+
+// SQLiteTuning are the sqlite settings the .s files are opened with. The zero
+// value is what SirServer always used: the page cache and temp store of sqlite,
+// no memory mapping, new files in WAL mode and writes with synchronous=NORMAL.
+type SQLiteTuning struct {
+	CacheSize   int    `json:"cache_size"`   // pages per connection, KiB when negative as in PRAGMA cache_size, sqlite's default when 0
+	MmapSize    int64  `json:"mmap_size"`    // bytes of a file memory mapped, none when 0
+	TempStore   string `json:"temp_store"`   // default, file or memory
+	JournalMode string `json:"journal_mode"` // of the files written, delete, truncate, persist, memory or wal; "" creates files in wal and keeps the mode of the others
+	Synchronous string `json:"synchronous"`  // of writes, off, normal, full or extra
+}
+
+// sqliteTuning is the tuning set with SetSQLiteTuning
+var sqliteTuning atomic.Pointer[SQLiteTuning]
+
+func init() {
+	sqliteTuning.Store(&SQLiteTuning{})
+}
+
+// Validate rejects unknown values, and journal modes that either cannot roll a
+// failed write back or are not crash safe with the synchronous setting given
+func (t SQLiteTuning) Validate() error {
+	if t.MmapSize < 0 {
+		return fmt.Errorf("mmap_size must not be negative, got %d", t.MmapSize)
+	}
+	choices := []struct {
+		name    string
+		value   string
+		allowed []string
+	}{
+		{"temp_store", t.TempStore, []string{"default", "file", "memory"}},
+		{"journal_mode", t.JournalMode, []string{"delete", "truncate", "persist", "memory", "wal", "off"}},
+		{"synchronous", t.Synchronous, []string{"off", "normal", "full", "extra"}},
+	}
+	for _, choice := range choices {
+		if choice.value != "" && !containsFold(choice.allowed, choice.value) {
+			return fmt.Errorf("%s must be one of %s, got %q", choice.name, strings.Join(choice.allowed, ", "), choice.value)
+		}
+	}
+	journal := strings.ToLower(t.JournalMode)
+	if journal == "off" {
+		return fmt.Errorf("journal_mode=off cannot roll a failed write back and leaves .s files corrupt")
+	}
+	if journal != "" && journal != "wal" && (t.Synchronous == "" || strings.EqualFold(t.Synchronous, "normal")) {
+		return fmt.Errorf("synchronous=normal is only crash safe with journal_mode=wal, set synchronous to full or extra for journal_mode=%s", journal)
+	}
+	return nil
+}
+
+// containsFold reports whether values holds value, ignoring case
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetSQLiteTuning validates tuning and opens the .s files with it from now on.
+// Handles already open keep their settings, so it belongs before serving starts.
+func SetSQLiteTuning(tuning SQLiteTuning) error {
+	if err := tuning.Validate(); err != nil {
+		return err
+	}
+	tuning.TempStore = strings.ToLower(tuning.TempStore)
+	tuning.JournalMode = strings.ToLower(tuning.JournalMode)
+	tuning.Synchronous = strings.ToLower(tuning.Synchronous)
+	sqliteTuning.Store(&tuning)
+	return nil
+}
+
+// EffectiveSQLiteTuning returns the tuning the .s files are opened with, with
+// the settings left to their default spelled out
+func EffectiveSQLiteTuning() SQLiteTuning {
+	tuning := *sqliteTuning.Load()
+	if tuning.TempStore == "" {
+		tuning.TempStore = "default"
+	}
+	if tuning.Synchronous == "" {
+		tuning.Synchronous = "normal"
+	}
+	return tuning
+}
+
+// writeSynchronous is the synchronous setting of the DSN of writes
+func writeSynchronous() string {
+	return strings.ToUpper(EffectiveSQLiteTuning().Synchronous)
+}
+
+// writeJournalMode is the journal mode set on the files written, "" to create
+// them in WAL mode and leave existing files alone
+func writeJournalMode() string {
+	return sqliteTuning.Load().JournalMode
+}
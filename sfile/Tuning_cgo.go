@@ -0,0 +1,35 @@
+//go:build cgo
+
+package sfile
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	sql.Register(shardDriver, &sqlite3.SQLiteDriver{ConnectHook: tuneConnection})
+}
+
+// tuneConnection applies the PRAGMAs of the tuning to a new connection
+func tuneConnection(conn *sqlite3.SQLiteConn) error {
+	tuning := sqliteTuning.Load()
+	pragmas := make([]string, 0, 3)
+	if tuning.CacheSize != 0 {
+		pragmas = append(pragmas, fmt.Sprintf("pragma cache_size=%d", tuning.CacheSize))
+	}
+	if tuning.MmapSize > 0 {
+		pragmas = append(pragmas, fmt.Sprintf("pragma mmap_size=%d", tuning.MmapSize))
+	}
+	if tuning.TempStore != "" {
+		pragmas = append(pragmas, "pragma temp_store="+tuning.TempStore)
+	}
+	for _, pragma := range pragmas {
+		if _, err := conn.Exec(pragma, nil); err != nil {
+			return fmt.Errorf("%s: %w", pragma, err)
+		}
+	}
+	return nil
+}
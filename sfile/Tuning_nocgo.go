@@ -0,0 +1,15 @@
+//go:build !cgo
+
+package sfile
+
+import (
+	"database/sql"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Without cgo the sqlite driver is a stub that fails to open anything, so
+// there are no connections to tune and the plain driver is registered
+func init() {
+	sql.Register(shardDriver, &sqlite3.SQLiteDriver{})
+}
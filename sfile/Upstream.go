@@ -0,0 +1,257 @@
+package sfile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sources a tile can be served from, as reported in Tile.Source
+const (
+	TileSourceLocal    = "local"
+	TileSourceUpstream = "upstream"
+)
+
+const (
+	// DefaultUpstreamRate is how many upstream requests are made per second, over all repositories
+	DefaultUpstreamRate = 10
+	// upstreamMissingTTL is how long an upstream 404 is remembered before asking again
+	upstreamMissingTTL = 5 * time.Minute
+	// upstreamMaxTileSize bounds the body read from upstream
+	upstreamMaxTileSize = 16 << 20
+)
+
+// upstream is the client shared by every upstream repository, so the rate limit
+// holds for the server as a whole
+var upstream = &upstreamClient{
+	client:  &http.Client{Timeout: 30 * time.Second},
+	limiter: rateLimiter{interval: time.Second / DefaultUpstreamRate},
+	missing: make(map[string]time.Time),
+	configs: make(map[string]upstreamConfig),
+}
+
+type upstreamClient struct {
+	client  *http.Client
+	limiter rateLimiter
+
+	mu      sync.Mutex
+	missing map[string]time.Time // upstream URL -> when its 404 expires
+	configs map[string]upstreamConfig
+}
+
+// rateLimiter spaces the requests of any number of goroutines evenly
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration // minimum time between two requests, no limit when 0
+	next     time.Time     // earliest time of the next request
+}
+
+// upstreamConfig is the upstream part of a repository.json, cached by modification time
+type upstreamConfig struct {
+	modTime  time.Time
+	template string
+	headers  map[string]string
+	maxZoom  *int
+}
+
+// SetUpstreamRate sets how many requests per second all upstream repositories
+// make together. A rate that is not positive removes the limit.
+func SetUpstreamRate(perSecond float64) {
+	upstream.limiter.setRate(perSecond)
+}
+
+// setRate allows perSecond requests per second, any number when it is not positive
+func (l *rateLimiter) setRate(perSecond float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if perSecond <= 0 {
+		l.interval = 0
+		return
+	}
+	l.interval = time.Duration(float64(time.Second) / perSecond)
+}
+
+// config returns the upstream settings of the repository in dir, ok is false
+// when it has no repository.json or no upstream
+func (c *upstreamClient) config(dir string) (upstreamConfig, bool) {
+	infoPath := filepath.Join(dir, "repository.json")
+	info, err := os.Stat(infoPath)
+	if err != nil {
+		return upstreamConfig{}, false
+	}
+	c.mu.Lock()
+	cached, ok := c.configs[infoPath]
+	c.mu.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) {
+		return cached, cached.template != ""
+	}
+	repo, err := readRepositoryInfo(filepath.Dir(dir), filepath.Base(dir))
+	if err != nil {
+		return upstreamConfig{}, false
+	}
+	cached = upstreamConfig{modTime: info.ModTime(), template: repo.Upstream, headers: repo.UpstreamHeaders, maxZoom: repo.UpstreamMaxZoom}
+	c.mu.Lock()
+	c.configs[infoPath] = cached
+	c.mu.Unlock()
+	return cached, cached.template != ""
+}
+
+// wait blocks until the rate limit allows another request or ctx ends
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	now := time.Now()
+	slot := l.next
+	if slot.Before(now) {
+		slot = now
+	}
+	l.next = slot.Add(l.interval)
+	l.mu.Unlock()
+	if delay := time.Until(slot); delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// isMissing reports whether target answered 404 recently
+func (c *upstreamClient) isMissing(target string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires, ok := c.missing[target]
+	if ok && time.Now().After(expires) {
+		delete(c.missing, target)
+		return false
+	}
+	return ok
+}
+
+func (c *upstreamClient) setMissing(target string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for key, expires := range c.missing {
+		if now.After(expires) {
+			delete(c.missing, key)
+		}
+	}
+	c.missing[target] = now.Add(upstreamMissingTTL)
+}
+
+// fetch downloads target once the rate limit allows it. A 404 is returned as ErrTileNotFound.
+func (c *upstreamClient) fetch(ctx context.Context, target string, headers map[string]string) ([]byte, error) {
+	if err := c.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	return fetchTile(ctx, c.client, target, headers)
+}
+
+// fetchTile downloads the tile at target with client. A 404 or an empty body is
+// returned as ErrTileNotFound.
+func fetchTile(ctx context.Context, client *http.Client, target string, headers map[string]string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		// url errors carry the full URL, which may contain an api key
+		var urlError *url.Error
+		if errors.As(err, &urlError) {
+			err = urlError.Err
+		}
+		return nil, fmt.Errorf("upstream %s: %w", redactURL(target), err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: upstream %s returned %s", ErrTileNotFound, redactURL(target), response.Status)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream %s returned %s", redactURL(target), response.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(response.Body, upstreamMaxTileSize))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%w: upstream %s returned an empty tile", ErrTileNotFound, redactURL(target))
+	}
+	return data, nil
+}
+
+// upstreamURL fills the {z}, {x} and {y} placeholders of template
+func upstreamURL(template string, z int8, x int64, y int64) string {
+	return strings.NewReplacer(
+		"{z}", strconv.Itoa(int(z)),
+		"{x}", strconv.FormatInt(x, 10),
+		"{y}", strconv.FormatInt(y, 10),
+	).Replace(template)
+}
+
+// upstreamRepository is a repository of .s files that fetches the tiles it is
+// missing from its upstream and keeps them, so it gradually becomes an offline
+// copy of the areas actually used
+type upstreamRepository struct {
+	*SRepository
+	config upstreamConfig
+}
+
+// GetTile returns the stored tile, or fetches, stores and returns it from
+// upstream. Upstream failures are reported like a local miss.
+func (u upstreamRepository) GetTile(ctx context.Context, z int8, x int64, y int64) (Tile, error) {
+	tile, err := u.SRepository.GetTile(ctx, z, x, y)
+	if !errors.Is(err, ErrTileNotFound) || (u.config.maxZoom != nil && int(z) > *u.config.maxZoom) {
+		return tile, err
+	}
+	target := upstreamURL(u.config.template, z, x, y)
+	if upstream.isMissing(target) {
+		return Tile{}, err
+	}
+	data, fetchErr := upstream.fetch(ctx, target, u.config.headers)
+	if errors.Is(fetchErr, ErrTileNotFound) {
+		upstream.setMissing(target)
+		return Tile{}, err
+	}
+	if fetchErr != nil {
+		if ctx.Err() == nil {
+			log.Printf("Fetching %d/%d/%d of %s failed: %v", z, x, y, u.dir, fetchErr)
+			RecordError("upstream", fetchErr)
+		}
+		return Tile{}, err
+	}
+	if writeErr := u.WriteXYZ(x, y, z, data); writeErr != nil {
+		// the tile is still served, it is fetched again next time
+		RecordError("upstream", fmt.Errorf("store %d/%d/%d in %s: %w", z, x, y, u.dir, writeErr))
+	}
+	tile = Tile{Data: data, ContentType: DetectContentType(data), Source: TileSourceUpstream, Modified: time.Now()}
+	if u.ttl > 0 {
+		tile.Expires = tile.Modified.Add(u.ttl)
+	}
+	return tile, nil
+}
+
+// GetEncodedTile returns the stored tile as stored, or fetches it like GetTile
+func (u upstreamRepository) GetEncodedTile(ctx context.Context, z int8, x int64, y int64) (Tile, error) {
+	tile, err := u.SRepository.GetEncodedTile(ctx, z, x, y)
+	if errors.Is(err, ErrTileNotFound) {
+		return u.GetTile(ctx, z, x, y)
+	}
+	return tile, err
+}
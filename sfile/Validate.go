@@ -0,0 +1,291 @@
+package sfile
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"image"
+	_ "image/gif" // register the gif decoder for sampled tiles
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// Severities of validation findings
+const (
+	SeverityError   = "error"   // tiles of the file are lost or cannot be served
+	SeverityWarning = "warning" // the file works but holds something it should not
+)
+
+// maxIntegrityFindings bounds the problems of PRAGMA integrity_check reported per file
+const maxIntegrityFindings = 10
+
+// validFileName matches the name of a .s file, ZOOM_x_y.s, see zoomName
+var validFileName = regexp.MustCompile(`^([A-Z]{1,2})_(\d+)_(\d+)\.s$`)
+
+// Finding is a problem found in a .s file
+type Finding struct {
+	File     string `json:"file"` // relative to the repository directory
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// Report is the result of validating a repository
+type Report struct {
+	Files    int       `json:"files"`
+	Tiles    int64     `json:"tiles"`
+	Sampled  int64     `json:"sampled"` // blobs decoded
+	Errors   int       `json:"errors"`
+	Warnings int       `json:"warnings"`
+	Findings []Finding `json:"findings"`
+}
+
+// Valid reports whether no error was found
+func (r Report) Valid() bool {
+	return r.Errors == 0
+}
+
+func (r *Report) add(file string, severity string, format string, args ...interface{}) {
+	r.Findings = append(r.Findings, Finding{File: file, Severity: severity, Message: fmt.Sprintf(format, args...)})
+	if severity == SeverityError {
+		r.Errors++
+	} else {
+		r.Warnings++
+	}
+}
+
+// ValidateOptions controls ValidateWithOptions
+type ValidateOptions struct {
+	Sample   int // blobs per file decoded to check they are valid images, none when not positive
+	Progress func(ValidateProgress)
+}
+
+// ValidateProgress counts the .s files validated so far
+type ValidateProgress struct {
+	Files   int `json:"files"`
+	Checked int `json:"checked"`
+}
+
+// Validate checks every .s file of the repository in dir without decoding any tile,
+// see ValidateWithOptions
+func Validate(dir string) (Report, error) {
+	return ValidateWithOptions(dir, ValidateOptions{})
+}
+
+// ValidateWithOptions checks that every .s file of the repository in dir opens as
+// sqlite and passes PRAGMA integrity_check, that its tables are named after the
+// file and that the IDs and coordinates of its rows agree with the table. Problems
+// are collected in the report and never stop the validation; an error is only
+// returned when the repository itself cannot be listed. The files are opened read
+// only, so a repository can be validated while it is served.
+func ValidateWithOptions(dir string, opts ValidateOptions) (Report, error) {
+	report := Report{Findings: make([]Finding, 0)}
+	subDirs, err := listSubDir(dir)
+	if err != nil {
+		return report, err
+	}
+	scheme, err := repositoryScheme(dir)
+	if err != nil {
+		return report, err
+	}
+	layout := repositoryLayout(dir)
+	if warning := layoutWarning(dir, layout); warning != "" {
+		report.add(".", SeverityWarning, "%s", warning)
+	}
+	files := make([]string, 0)
+	for _, sub := range subDirs {
+		subFiles, err := listAllFile(sub)
+		if err != nil {
+			return report, err
+		}
+		files = append(files, subFiles...)
+	}
+	report.Files = len(files)
+	for i, file := range files {
+		name, err := filepath.Rel(dir, file)
+		if err != nil {
+			name = file
+		}
+		validateShard(file, filepath.ToSlash(name), scheme, layout == LayoutFlat, opts.Sample, &report)
+		if opts.Progress != nil {
+			opts.Progress(ValidateProgress{Files: len(files), Checked: i + 1})
+		}
+	}
+	return report, nil
+}
+
+// validateShard adds the findings of one .s file to report, of a flat
+// repository when flat
+func validateShard(filePath string, name string, scheme ShardScheme, flat bool, sample int, report *Report) {
+	zoomDir := filepath.Base(filepath.Dir(filePath))
+	parts := validFileName.FindStringSubmatch(filepath.Base(filePath))
+	if parts != nil && flat {
+		zoomDir = parts[1]
+	}
+	if parts == nil || parts[1] != zoomDir {
+		report.add(name, SeverityError, "file name does not match %s_x_y.s", zoomDir)
+		return
+	}
+	fileX, _ := strconv.ParseInt(parts[2], 10, 64)
+	fileY, _ := strconv.ParseInt(parts[3], 10, 64)
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		report.add(name, SeverityError, "cannot stat: %v", err)
+		return
+	}
+	if info.Size() == 0 {
+		report.add(name, SeverityError, "file is empty")
+		return
+	}
+	db, err := openShardForRead(filePath)
+	if err != nil {
+		report.add(name, SeverityError, "cannot open: %v", err)
+		return
+	}
+	defer closeShard(db)
+
+	if !checkIntegrity(db, name, report) {
+		return
+	}
+	version, err := shardSchema(db)
+	if err != nil {
+		report.add(name, SeverityError, "cannot read the layout version: %v", err)
+		return
+	}
+	if version > shardSchemaDedup {
+		report.add(name, SeverityError, "unknown layout version %d", version)
+		return
+	}
+	dedup := version == shardSchemaDedup
+	tableNames, err := listAllTables(db)
+	if err != nil {
+		report.add(name, SeverityError, "cannot list tables: %v", err)
+		return
+	}
+	remaining := sample
+	for _, tableName := range tableNames {
+		if tableName == "meta" || tableName == quarantineTable || dedup && tableName == "blobs" {
+			continue
+		}
+		if !validTableName.MatchString(tableName) {
+			report.add(name, SeverityWarning, "unexpected table %s", tableName)
+			continue
+		}
+		z, tableX, tableY, ok := parseShardName(tableName)
+		if !ok || zoomName(z) != zoomDir ||
+			tableX/(scheme.File/scheme.Table) != fileX || tableY/(scheme.File/scheme.Table) != fileY {
+			report.add(name, SeverityError, "table %s does not belong in this file", tableName)
+			continue
+		}
+		validateTable(db, name, tableName, scheme, tableX, tableY, dedup, report)
+		if remaining > 0 {
+			remaining -= sampleBlobs(db, name, tableName, dedup, remaining, report)
+		}
+	}
+}
+
+// listAllTables returns the name of every table, listTables leaves out most of
+// those that do not belong in a .s file
+func listAllTables(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("select name from sqlite_master where type = 'table' order by name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tableNames := make([]string, 0)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tableNames = append(tableNames, name)
+	}
+	return tableNames, rows.Err()
+}
+
+// checkIntegrity runs PRAGMA integrity_check, reporting whether the file passed
+func checkIntegrity(db *sql.DB, name string, report *Report) bool {
+	rows, err := db.Query("pragma integrity_check(" + strconv.Itoa(maxIntegrityFindings) + ")")
+	if err != nil {
+		report.add(name, SeverityError, "not a readable sqlite database: %v", err)
+		return false
+	}
+	defer rows.Close()
+	ok := true
+	for rows.Next() {
+		var message string
+		if err := rows.Scan(&message); err != nil {
+			report.add(name, SeverityError, "integrity check failed: %v", err)
+			return false
+		}
+		if message != "ok" {
+			report.add(name, SeverityError, "integrity check: %s", message)
+			ok = false
+		}
+	}
+	if err := rows.Err(); err != nil {
+		report.add(name, SeverityError, "integrity check failed: %v", err)
+		return false
+	}
+	return ok
+}
+
+// validateTable checks the IDs and coordinates of the rows of a table, which
+// holds the tiles tableX*side..tableX*side+side-1, tableY*side..tableY*side+side-1
+// for the table side of the scheme
+func validateTable(db *sql.DB, name string, tableName string, scheme ShardScheme, tableX int64, tableY int64, dedup bool, report *Report) {
+	var count, badID, badXY, empty int64
+	side := scheme.Table
+	err := db.QueryRow("select count(*),"+
+		" coalesce(sum(ID < 0 or ID >= ?), 0),"+
+		" coalesce(sum(X / ? != ? or Y / ? != ? or ID != X % ? + ? * (Y % ?)), 0),"+
+		" coalesce(sum(coalesce(length("+tileData(tableName, dedup)+"), 0) = 0), 0)"+
+		" from "+tableName, scheme.tableIDs(), side, tableX, side, tableY, side, side, side).Scan(&count, &badID, &badXY, &empty)
+	if err != nil {
+		report.add(name, SeverityError, "cannot read table %s: %v", tableName, err)
+		return
+	}
+	report.Tiles += count
+	if badID > 0 {
+		report.add(name, SeverityError, "table %s has %d rows with an ID outside 0..%d", tableName, badID, scheme.tableIDs()-1)
+	}
+	if badXY > 0 {
+		report.add(name, SeverityError, "table %s has %d rows whose X and Y do not match the table or their ID", tableName, badXY)
+	}
+	if empty > 0 {
+		report.add(name, SeverityWarning, "table %s has %d rows without data", tableName, empty)
+	}
+}
+
+// sampleBlobs decodes up to limit random raster blobs of a table, returning how many were decoded.
+// Vector and JSON tiles have no decoder here and are not counted.
+func sampleBlobs(db *sql.DB, name string, tableName string, dedup bool, limit int, report *Report) int {
+	rows, err := db.Query("select X, Y, "+tileData(tableName, dedup)+" from "+tableName+" order by random() limit ?", limit)
+	if err != nil {
+		report.add(name, SeverityError, "cannot read table %s: %v", tableName, err)
+		return 0
+	}
+	defer rows.Close()
+	decoded := 0
+	for rows.Next() {
+		var x, y int64
+		var data []byte
+		if err := rows.Scan(&x, &y, &data); err != nil {
+			report.add(name, SeverityError, "cannot read table %s: %v", tableName, err)
+			return decoded
+		}
+		switch tileFormat(data) {
+		case "png", "jpg", "webp", "gif":
+		default:
+			continue
+		}
+		decoded++
+		report.Sampled++
+		if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+			report.add(name, SeverityError, "tile %d/%d is not a valid image: %v", x, y, err)
+		}
+	}
+	return decoded
+}
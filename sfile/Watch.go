@@ -0,0 +1,208 @@
+package sfile
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Debouncing of the changes seen by a RepositoryWatcher
+const (
+	watchQuiet    = 2 * time.Second  // changes are applied once none arrived for this long
+	watchMaxDelay = 30 * time.Second // a steady stream of changes is still applied this often
+)
+
+// watchPollInterval is how often the root is listed when it cannot be watched
+const watchPollInterval = 10 * time.Second
+
+// RepositoryWatcher follows the directories created in, removed from or renamed
+// below the repository root and the repository.json files directly in them. After
+// a burst of changes has settled it invalidates the catalog and queues brand-new
+// repositories for background analysis. Where the root cannot be watched it lists
+// the root periodically instead.
+type RepositoryWatcher struct {
+	root    string
+	catalog *RepositoryCatalog
+
+	changes   chan string // names of the root entries that changed, "" for all of them
+	failures  chan error
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	notifier  io.Closer // nil while polling
+}
+
+// WatchRepositories starts watching the repository root of catalog. It never
+// fails: when the platform or the file system offers no notifications the root is
+// polled with a warning. Close stops the watcher.
+func WatchRepositories(catalog *RepositoryCatalog) *RepositoryWatcher {
+	w := &RepositoryWatcher{
+		root:     catalog.root,
+		catalog:  catalog,
+		changes:  make(chan string, 1024),
+		failures: make(chan error, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	notifier, err := startNotifier(w.root, w.notify, w.fail)
+	if err != nil {
+		log.Printf("Warning: cannot watch repository root %s, listing it every %s instead: %v", w.root, watchPollInterval, err)
+	} else {
+		w.notifier = notifier
+		log.Printf("Watching repository root %s", w.root)
+	}
+	go w.run()
+	return w
+}
+
+// Close stops the watcher and waits until it has
+func (w *RepositoryWatcher) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.stop)
+		<-w.done
+		if w.notifier != nil {
+			err = w.notifier.Close()
+		}
+	})
+	return err
+}
+
+// notify reports a changed root entry, called by the notifier
+func (w *RepositoryWatcher) notify(name string) {
+	select {
+	case w.changes <- name:
+	case <-w.stop:
+	}
+}
+
+// fail reports that the notifier stopped delivering changes
+func (w *RepositoryWatcher) fail(err error) {
+	select {
+	case w.failures <- err:
+	default:
+	}
+}
+
+// run debounces the changes until the watcher is closed
+func (w *RepositoryWatcher) run() {
+	defer close(w.done)
+	pending := make(map[string]bool)
+	var first time.Time
+	settle := time.NewTimer(watchQuiet)
+	settle.Stop()
+	var poll <-chan time.Time
+	var snapshot map[string]time.Time
+	startPolling := func() {
+		ticker := time.NewTicker(watchPollInterval)
+		go func() {
+			<-w.done
+			ticker.Stop()
+		}()
+		poll = ticker.C
+		snapshot = listRootEntries(w.root)
+	}
+	if w.notifier == nil {
+		startPolling()
+	}
+	for {
+		select {
+		case <-w.stop:
+			settle.Stop()
+			return
+		case name := <-w.changes:
+			if len(pending) == 0 {
+				first = time.Now()
+			}
+			pending[name] = true
+			settle.Reset(max(min(watchQuiet, watchMaxDelay-time.Since(first)), 0))
+		case <-settle.C:
+			w.apply(pending)
+			pending = make(map[string]bool)
+		case err := <-w.failures:
+			log.Printf("Warning: lost the watch of repository root %s, listing it every %s instead: %v", w.root, watchPollInterval, err)
+			RecordError("watch", err)
+			if poll == nil {
+				startPolling()
+			}
+			// whatever changed since the last notification was missed
+			w.apply(map[string]bool{"": true})
+		case <-poll:
+			current := listRootEntries(w.root)
+			changed := make(map[string]bool)
+			for name, modified := range current {
+				if previous, ok := snapshot[name]; !ok || !previous.Equal(modified) {
+					changed[name] = true
+				}
+			}
+			for name := range snapshot {
+				if _, ok := current[name]; !ok {
+					changed[name] = true
+				}
+			}
+			snapshot = current
+			if len(changed) > 0 {
+				w.apply(changed)
+			}
+		}
+	}
+}
+
+// apply queues the new repositories among the changed root entries for analysis
+// and rescans the catalog
+func (w *RepositoryWatcher) apply(changed map[string]bool) {
+	defer w.catalog.rescan()
+	names := make([]string, 0, len(changed))
+	for name := range changed {
+		// hidden entries hold in-progress restores and are never listed
+		if name != "" && !strings.HasPrefix(name, ".") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) > 0 {
+		log.Printf("Repository root changed: %s", strings.Join(names, ", "))
+	}
+	options := w.catalog.scanOptions()
+	for _, name := range names {
+		dir := filepath.Join(w.root, name)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+		// a directory below a deeper root is only a repository once it looks like one
+		if options.Depth <= 1 || IsRepositoryDir(dir) {
+			// queues the analysis unless repository.json is present already
+			listedRepository(w.root, name)
+		}
+	}
+}
+
+// listRootEntries returns the modification time of each directory of the root,
+// or of its repository.json when that is newer, for polling
+func listRootEntries(root string) map[string]time.Time {
+	entries := make(map[string]time.Time)
+	dirs, err := os.ReadDir(root)
+	if err != nil {
+		return entries
+	}
+	for _, dir := range dirs {
+		if strings.HasPrefix(dir.Name(), ".") {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(root, dir.Name()))
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		modified := info.ModTime()
+		if repoInfo, err := os.Stat(filepath.Join(root, dir.Name(), "repository.json")); err == nil && repoInfo.ModTime().After(modified) {
+			modified = repoInfo.ModTime()
+		}
+		entries[dir.Name()] = modified
+	}
+	return entries
+}
@@ -0,0 +1,148 @@
+package sfile
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// notifyWatcher watches the repository root and each directory directly in it
+// with the notifications of the platform: inotify, kqueue, ReadDirectoryChangesW
+// or FEN
+type notifyWatcher struct {
+	watcher *fsnotify.Watcher
+	root    string
+	entries map[string]map[string]bool // sub directories of each watched root entry
+}
+
+// startNotifier watches root, calling changed with the name of each root entry
+// that changed until the returned closer is closed, or failed once the watch
+// broke
+func startNotifier(root string, changed func(name string), failed func(error)) (io.Closer, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	w := &notifyWatcher{watcher: watcher, root: root, entries: make(map[string]map[string]bool)}
+	if err := watcher.Add(root); err != nil {
+		_ = watcher.Close()
+		return nil, err
+	}
+	w.addEntries()
+	go w.read(changed, failed)
+	return w, nil
+}
+
+// Close stops the watch
+func (w *notifyWatcher) Close() error {
+	return w.watcher.Close()
+}
+
+// addEntries watches the directories of the root not watched yet
+func (w *notifyWatcher) addEntries() {
+	dirs, err := os.ReadDir(w.root)
+	if err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		if _, watched := w.entries[dir.Name()]; !watched && !strings.HasPrefix(dir.Name(), ".") {
+			w.addDir(dir.Name())
+		}
+	}
+}
+
+// addDir watches the root entry name when it is a directory, symlinks included,
+// remembering its sub directories so their removal can be told from that of a
+// file
+func (w *notifyWatcher) addDir(name string) {
+	dir := filepath.Join(w.root, name)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return
+	}
+	// the directory may be gone again already, its removal is reported anyway
+	if err := w.watcher.Add(dir); err != nil {
+		return
+	}
+	subDirs := make(map[string]bool)
+	if entries, err := os.ReadDir(dir); err == nil {
+		for _, entry := range entries {
+			if entry.IsDir() {
+				subDirs[entry.Name()] = true
+			}
+		}
+	}
+	w.entries[name] = subDirs
+}
+
+// read turns notifications into changed root entries until the watch is closed
+func (w *notifyWatcher) read(changed func(name string), failed func(error)) {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			w.handle(event, changed)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				// events were dropped, every entry may have changed
+				w.addEntries()
+				changed("")
+				continue
+			}
+			failed(err)
+			return
+		}
+	}
+}
+
+// handle reports the root entry event changed, if any
+func (w *notifyWatcher) handle(event fsnotify.Event, changed func(name string)) {
+	if event.Op == fsnotify.Chmod {
+		return
+	}
+	parent, name := filepath.Split(filepath.Clean(event.Name))
+	parent = filepath.Clean(parent)
+	if parent != filepath.Clean(w.root) {
+		entry := filepath.Base(parent)
+		subDirs, ok := w.entries[entry]
+		if !ok || filepath.Dir(parent) != filepath.Clean(w.root) {
+			return
+		}
+		// in a repository directory only its sub directories and repository.json
+		// matter, not the shards and journals written next to them
+		switch {
+		case name == "repository.json":
+			changed(entry)
+		case event.Has(fsnotify.Create):
+			if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+				subDirs[name] = true
+				changed(entry)
+			}
+		case event.Has(fsnotify.Remove) || event.Has(fsnotify.Rename):
+			if subDirs[name] {
+				delete(subDirs, name)
+				changed(entry)
+			}
+		}
+		return
+	}
+	if strings.HasPrefix(name, ".") || !event.Has(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) {
+		return
+	}
+	if event.Has(fsnotify.Create) {
+		w.addDir(name)
+	} else {
+		// the watch of a removed or renamed directory ends with it
+		_ = w.watcher.Remove(event.Name)
+		delete(w.entries, name)
+	}
+	changed(name)
+}
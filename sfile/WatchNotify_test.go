@@ -0,0 +1,89 @@
+package sfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestNotifier checks the notifier reports the root entries that changed:
+// directories created in and removed from the root, and the sub directories and
+// repository.json of those, but neither hidden entries nor the other files
+// written in a repository
+func TestNotifier(t *testing.T) {
+	root := t.TempDir()
+	changes := make(chan string, 64)
+	notifier, err := startNotifier(root, func(name string) { changes <- name }, func(err error) { t.Errorf("watch failed: %v", err) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer notifier.Close()
+
+	expect := func(action string, want string) {
+		t.Helper()
+		select {
+		case name := <-changes:
+			if name != want {
+				t.Fatalf("%s: change of %q, want %q", action, name, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: no change reported, want %q", action, want)
+		}
+		// a single action may be reported more than once
+		for {
+			select {
+			case name := <-changes:
+				if name != want {
+					t.Fatalf("%s: change of %q, want only %q", action, name, want)
+				}
+			case <-time.After(200 * time.Millisecond):
+				return
+			}
+		}
+	}
+	quiet := func(action string) {
+		t.Helper()
+		select {
+		case name := <-changes:
+			t.Fatalf("%s: change of %q reported, want none", action, name)
+		case <-time.After(300 * time.Millisecond):
+		}
+	}
+	do := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	repo := filepath.Join(root, "repo")
+	do(os.Mkdir(repo, 0755))
+	expect("repository created", "repo")
+	do(os.WriteFile(filepath.Join(repo, "repository.json"), []byte("{}"), 0644))
+	expect("repository.json written", "repo")
+	do(os.WriteFile(filepath.Join(repo, "0.s-journal"), nil, 0644))
+	do(os.Remove(filepath.Join(repo, "0.s-journal")))
+	quiet("journal written and removed")
+	do(os.Mkdir(filepath.Join(repo, "5"), 0755))
+	expect("zoom directory created", "repo")
+	do(os.Remove(filepath.Join(repo, "5")))
+	expect("zoom directory removed", "repo")
+	do(os.Mkdir(filepath.Join(root, ".restore"), 0755))
+	quiet("hidden directory created")
+	do(os.Rename(repo, filepath.Join(root, "renamed")))
+	got := map[string]bool{}
+	for len(got) < 2 {
+		select {
+		case name := <-changes:
+			got[name] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("repository renamed: changes %v, want repo and renamed", got)
+		}
+	}
+	if !got["repo"] || !got["renamed"] {
+		t.Fatalf("repository renamed: changes %v, want repo and renamed", got)
+	}
+	do(os.WriteFile(filepath.Join(root, "renamed", "repository.json"), []byte("{}"), 0644))
+	expect("repository.json of the renamed repository written", "renamed")
+}
@@ -0,0 +1,71 @@
+package sfile
+
+import (
+	"SirServer/canvas"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"strings"
+)
+
+// WatermarkSettings overlay an attribution on the raster tiles served from a
+// repository, see canvas.ApplyWatermark. Vector tiles are served as stored.
+type WatermarkSettings struct {
+	Text     string  `json:"text,omitempty"`
+	Corner   string  `json:"corner,omitempty"`    // top-left, top-right, bottom-left or bottom-right, the default
+	Opacity  float64 `json:"opacity,omitempty"`   // of the whole watermark in 0..1, canvas.DefaultWatermarkOpacity when 0
+	FontSize float64 `json:"font_size,omitempty"` // in points, canvas.DefaultWatermarkFontSize when 0
+	Color    string  `json:"color,omitempty"`     // of the text, see canvas.ParseColor, white when unset
+	Margin   int     `json:"margin,omitempty"`    // pixels from the edges, canvas.DefaultWatermarkMargin when 0
+
+	// Logo is a PNG or JPEG image drawn left of the text, base64 encoded and
+	// optionally written as a data: URL
+	Logo string `json:"logo,omitempty"`
+}
+
+// Key returns a digest of the settings, telling tiles watermarked with other
+// settings apart in caches
+func (s WatermarkSettings) Key() string {
+	data, _ := json.Marshal(s)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Options returns the settings as canvas options, decoding the color and logo
+func (s WatermarkSettings) Options() (canvas.WatermarkOptions, error) {
+	options := canvas.WatermarkOptions{Corner: s.Corner, Opacity: s.Opacity, FontSize: s.FontSize, Margin: s.Margin}
+	if s.Corner != "" && !canvas.IsCorner(s.Corner) {
+		return options, fmt.Errorf("invalid watermark corner %q", s.Corner)
+	}
+	if s.Opacity < 0 || s.Opacity > 1 {
+		return options, fmt.Errorf("watermark opacity %g is not within 0..1", s.Opacity)
+	}
+	if s.Color != "" {
+		textColor, err := canvas.ParseColor(s.Color)
+		if err != nil {
+			return options, fmt.Errorf("invalid watermark color: %w", err)
+		}
+		options.Color = textColor
+	}
+	if s.Logo != "" {
+		encoded := s.Logo
+		if strings.HasPrefix(encoded, "data:") {
+			// data:image/png;base64,<data>
+			_, encoded, _ = strings.Cut(encoded, ",")
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return options, fmt.Errorf("invalid watermark logo: %w", err)
+		}
+		logo, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return options, fmt.Errorf("invalid watermark logo: %w", err)
+		}
+		options.Logo = logo
+	}
+	return options, nil
+}
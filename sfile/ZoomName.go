@@ -0,0 +1,103 @@
+package sfile
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The tiles of zoom z are stored in a directory named after the zoom, in .s
+// files and tables whose names start with it. Zooms 0..25 are the single letters
+// A..Z, the layout of every repository written before higher zooms were
+// supported. Zooms from 26 on are two letters counting from AA, so 26 is AA, 27
+// is AB and MaxTileZoom is AE. A name never mixes the two, so old repositories
+// are read and written exactly as before.
+
+// MaxTileZoom is the highest zoom a repository stores tiles of. At this zoom a
+// web mercator tile is about 4cm wide on the equator.
+const MaxTileZoom = 30
+
+// singleLetterZooms is the number of zooms named by a single letter
+const singleLetterZooms = 26
+
+// ErrZoomOutOfRange is returned for a zoom outside 0..MaxTileZoom, which no
+// shard name addresses
+var ErrZoomOutOfRange = errors.New("zoom out of range")
+
+// checkZoom returns an error wrapping ErrZoomOutOfRange for a zoom outside 0..MaxTileZoom
+func checkZoom(z int) error {
+	if z < 0 || z > MaxTileZoom {
+		return fmt.Errorf("%w: zoom %d is outside 0..%d", ErrZoomOutOfRange, z, MaxTileZoom)
+	}
+	return nil
+}
+
+// zoomName returns the name of the directory of zoom z, which also starts the
+// names of its .s files and tables. z must be within 0..MaxTileZoom.
+func zoomName(z int8) string {
+	if z < singleLetterZooms {
+		return string(rune('A' + z))
+	}
+	n := int(z) - singleLetterZooms
+	return string([]byte{byte('A' + n/26), byte('A' + n%26)})
+}
+
+// nameZoom returns the zoom named by name, the inverse of zoomName, false when
+// name names no zoom within 0..MaxTileZoom
+func nameZoom(name string) (int8, bool) {
+	var z int
+	switch {
+	case len(name) == 1 && 'A' <= name[0] && name[0] <= 'Z':
+		z = int(name[0] - 'A')
+	case len(name) == 2 && 'A' <= name[0] && name[0] <= 'Z' && 'A' <= name[1] && name[1] <= 'Z':
+		z = singleLetterZooms + int(name[0]-'A')*26 + int(name[1]-'A')
+	default:
+		return 0, false
+	}
+	if z > MaxTileZoom {
+		return 0, false
+	}
+	return int8(z), true
+}
+
+// shardName returns the name of .s file or table x/y of zoom z, without the
+// .s extension
+func shardName(z int8, x int64, y int64) string {
+	return zoomName(z) + "_" + strconv.FormatInt(x, 10) + "_" + strconv.FormatInt(y, 10)
+}
+
+// parseShardName parses a name made by shardName, false when name is not one
+func parseShardName(name string) (z int8, x int64, y int64, ok bool) {
+	parts := strings.Split(name, "_")
+	if len(parts) != 3 {
+		return 0, 0, 0, false
+	}
+	z, ok = nameZoom(parts[0])
+	if !ok {
+		return 0, 0, 0, false
+	}
+	x, errX := strconv.ParseInt(parts[1], 10, 64)
+	y, errY := strconv.ParseInt(parts[2], 10, 64)
+	if errX != nil || errY != nil || x < 0 || y < 0 {
+		return 0, 0, 0, false
+	}
+	return z, x, y, true
+}
+
+// subDirZoom returns the zoom of a directory returned by listSubDir
+func subDirZoom(sub string) int8 {
+	z, _ := nameZoom(filepath.Base(sub))
+	return z
+}
+
+// shardZoom returns the zoom of the .s file at filePath from its name, false
+// when the name is not that of a .s file, see validFileName
+func shardZoom(filePath string) (int8, bool) {
+	parts := validFileName.FindStringSubmatch(filepath.Base(filePath))
+	if parts == nil {
+		return 0, false
+	}
+	return nameZoom(parts[1])
+}
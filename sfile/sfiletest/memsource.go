@@ -0,0 +1,160 @@
+package sfiletest
+
+import (
+	"SirServer/sfile"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemSource is an sfile.TileSource keeping its tiles in memory, for tests of code
+// serving tiles that should not need .s files on disk. Besides storing tiles it
+// can slow reads down and make them fail, see SetLatency, FailEvery and
+// FailTile. It is safe for concurrent use.
+type MemSource struct {
+	mu        sync.RWMutex
+	meta      sfile.Repository
+	tiles     map[sfile.TileCoord]memTile
+	latency   time.Duration
+	failEvery int64 // every failEvery-th read fails with failErr, none when 0
+	failErr   error
+	failTiles map[sfile.TileCoord]error
+	reads     int64
+	sinceFail int64 // reads since FailEvery was called
+}
+
+// memTile is a tile of a MemSource with the time it was put
+type memTile struct {
+	data     []byte
+	modified time.Time
+}
+
+// NewMemSource returns an empty MemSource whose Metadata is meta
+func NewMemSource(meta sfile.Repository) *MemSource {
+	return &MemSource{meta: meta, tiles: make(map[sfile.TileCoord]memTile), failTiles: make(map[sfile.TileCoord]error)}
+}
+
+// Put stores data as tile x/y/z, replacing the tile stored there
+func (s *MemSource) Put(z int8, x int64, y int64, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tiles[sfile.TileCoord{Z: z, X: x, Y: y}] = memTile{data: append([]byte(nil), data...), modified: time.Now()}
+}
+
+// Delete removes tile x/y/z and reports whether it was stored
+func (s *MemSource) Delete(z int8, x int64, y int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := sfile.TileCoord{Z: z, X: x, Y: y}
+	_, ok := s.tiles[key]
+	delete(s.tiles, key)
+	return ok
+}
+
+// SetLatency makes every read wait for latency before it answers, or until its
+// context ends
+func (s *MemSource) SetLatency(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = latency
+}
+
+// FailEvery makes every n-th read fail with err, counting from the first read
+// after the call. n of 0 stops failing reads.
+func (s *MemSource) FailEvery(n int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failEvery, s.failErr, s.sinceFail = int64(n), err, 0
+}
+
+// FailTile makes the reads of tile x/y/z fail with err, whether it is stored or
+// not. A nil err lets them succeed again.
+func (s *MemSource) FailTile(z int8, x int64, y int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := sfile.TileCoord{Z: z, X: x, Y: y}
+	if err == nil {
+		delete(s.failTiles, key)
+		return
+	}
+	s.failTiles[key] = err
+}
+
+// Reads returns how many reads the source answered, failed ones included
+func (s *MemSource) Reads() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.reads
+}
+
+// GetTile returns tile x/y/z, sfile.ErrTileNotFound when it is not stored
+func (s *MemSource) GetTile(ctx context.Context, z int8, x int64, y int64) (sfile.Tile, error) {
+	s.mu.Lock()
+	s.reads++
+	s.sinceFail++
+	reads, latency := s.sinceFail, s.latency
+	failEvery, failErr := s.failEvery, s.failErr
+	key := sfile.TileCoord{Z: z, X: x, Y: y}
+	tileErr := s.failTiles[key]
+	tile, ok := s.tiles[key]
+	s.mu.Unlock()
+
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return sfile.Tile{}, ctx.Err()
+		}
+	}
+	switch {
+	case failEvery > 0 && reads%failEvery == 0:
+		return sfile.Tile{}, failErr
+	case tileErr != nil:
+		return sfile.Tile{}, tileErr
+	case !ok:
+		return sfile.Tile{}, fmt.Errorf("%w: %d/%d/%d not in memory source %s", sfile.ErrTileNotFound, z, x, y, s.meta.Name)
+	}
+	data := append([]byte(nil), tile.data...)
+	return sfile.Tile{Data: data, ContentType: sfile.DetectContentType(data), Source: sfile.TileSourceLocal, Modified: tile.modified}, nil
+}
+
+// ListTiles calls fn with the tiles stored at zoom z, ordered by x then y
+func (s *MemSource) ListTiles(z int8, fn func(x int64, y int64) error) error {
+	s.mu.RLock()
+	tiles := make([]sfile.TileCoord, 0)
+	for key := range s.tiles {
+		if key.Z == z {
+			tiles = append(tiles, key)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(tiles, func(i, j int) bool {
+		if tiles[i].X != tiles[j].X {
+			return tiles[i].X < tiles[j].X
+		}
+		return tiles[i].Y < tiles[j].Y
+	})
+	for _, tile := range tiles {
+		if err := fn(tile.X, tile.Y); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Metadata returns the repository the source was created with
+func (s *MemSource) Metadata() sfile.Repository {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.meta
+}
+
+// Close does nothing, like the sources of archives the source is shared by
+// every request opening it
+func (s *MemSource) Close() error {
+	return nil
+}
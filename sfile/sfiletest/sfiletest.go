@@ -0,0 +1,36 @@
+// Package sfiletest provides tile sources for tests of code built on the sfile
+// and api packages, which can then serve tiles without .s files on disk
+package sfiletest
+
+import (
+	"SirServer/sfile"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// Serve makes sfile.OpenTileSource return source for the repository named name
+// under root, and so the api handlers of an ApiContext with that repository
+// root serve it. The returned function stops serving it and removes its
+// backend from the registry of sfile.
+func Serve(root string, name string, source sfile.TileSource) func() {
+	path := filepath.Join(root, filepath.FromSlash(name))
+	var stopped atomic.Bool
+	unregister := sfile.RegisterTileSource(sfile.TileBackend{
+		Name: "memory",
+		Match: func(candidate string) bool {
+			return !stopped.Load() && candidate == path
+		},
+		Open: func(string, string) (sfile.TileSource, error) {
+			if stopped.Load() {
+				return nil, os.ErrNotExist
+			}
+			return source, nil
+		},
+	})
+	return func() {
+		// handlers that matched the backend before may still open it
+		stopped.Store(true)
+		unregister()
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"strings"
+)
+
+// setupTracing installs a global tracer provider exporting spans over OTLP/gRPC to
+// endpoint, given either as host:port or as a URL (http:// disables TLS). The
+// returned function flushes pending spans and must be called before exiting.
+func setupTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	option := otlptracegrpc.WithEndpoint(endpoint)
+	if strings.Contains(endpoint, "://") {
+		option = otlptracegrpc.WithEndpointURL(endpoint)
+	}
+	exporter, err := otlptracegrpc.New(ctx, option)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(sirServer.Name),
+		semconv.ServiceVersion(sirServer.Version),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,104 @@
+package updater
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ChannelStable is the channel of releases everyone gets, the one the top
+// level of update_info.json describes
+const ChannelStable = "stable"
+
+// ErrUnknownChannel is returned when the update info has no section for the
+// channel asked for
+var ErrUnknownChannel = errors.New("unknown release channel")
+
+// ErrDowngrade is returned when the latest version of the channel is older than
+// the running one and downgrading was not allowed, see Updater.AllowDowngrade
+var ErrDowngrade = errors.New("update would downgrade")
+
+// updateState is what the state file remembers between updates
+type updateState struct {
+	Channel string `json:"channel"`
+}
+
+// DefaultStateFile returns the path of the state file remembering the channel
+// updates come from, in the configuration directory of the user
+func DefaultStateFile() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the configuration directory: %w", err)
+	}
+	return filepath.Join(dir, "SirServer", "update.json"), nil
+}
+
+// LoadChannel returns the channel the state file at path remembers,
+// ChannelStable when there is none
+func LoadChannel(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ChannelStable, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read update state: %w", err)
+	}
+	var state updateState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return "", fmt.Errorf("failed to decode update state %s: %w", path, err)
+	}
+	if state.Channel == "" {
+		return ChannelStable, nil
+	}
+	return state.Channel, nil
+}
+
+// SaveChannel makes the state file at path remember channel, so later updates
+// come from it too
+func SaveChannel(path string, channel string) error {
+	content, _ := json.MarshalIndent(updateState{Channel: channel}, "", "  ")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create update state directory: %w", err)
+	}
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return fmt.Errorf("failed to write update state: %w", err)
+	}
+	return nil
+}
+
+// Channel returns the section of the update info for the channel named name.
+// The top level is the stable channel unless Channels lists its own.
+func (info *UpdateInfo) Channel(name string) (*UpdateInfo, error) {
+	if name == "" {
+		name = ChannelStable
+	}
+	if channel, ok := info.Channels[name]; ok {
+		return &channel, nil
+	}
+	if name == ChannelStable && info.LatestVersion != "" {
+		stable := *info
+		stable.Channels = nil
+		return &stable, nil
+	}
+	return nil, fmt.Errorf("%w %q, the update info has %s", ErrUnknownChannel, name, strings.Join(info.channelNames(), ", "))
+}
+
+// channelNames returns the sorted names of the channels of the update info
+func (info *UpdateInfo) channelNames() []string {
+	names := make([]string, 0, len(info.Channels)+1)
+	if _, ok := info.Channels[ChannelStable]; !ok && info.LatestVersion != "" {
+		names = append(names, ChannelStable)
+	}
+	for name := range info.Channels {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return []string{"none"}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,102 @@
+package updater
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// channelInfo is update info with a stable top level and beta and nightly
+// channels
+func channelInfo() *UpdateInfo {
+	return &UpdateInfo{
+		LatestVersion: "1.5.0",
+		MinVersion:    "1.0.0",
+		Channels: map[string]UpdateInfo{
+			"beta":    {LatestVersion: "2.0.0-beta.1", MinVersion: "1.0.0"},
+			"nightly": {LatestVersion: "2.1.0-nightly.20260101", MinVersion: "1.0.0"},
+		},
+	}
+}
+
+// TestChannel checks channels are picked from the update info, the top level
+// being the stable one
+func TestChannel(t *testing.T) {
+	info := channelInfo()
+	for name, version := range map[string]string{"": "1.5.0", ChannelStable: "1.5.0", "beta": "2.0.0-beta.1", "nightly": "2.1.0-nightly.20260101"} {
+		channel, err := info.Channel(name)
+		if err != nil {
+			t.Fatalf("channel %q: %v", name, err)
+		}
+		if channel.LatestVersion != version || channel.Channels != nil {
+			t.Fatalf("channel %q: %+v, want latest %s and no channels", name, channel, version)
+		}
+	}
+	if _, err := info.Channel("alpha"); !errors.Is(err, ErrUnknownChannel) {
+		t.Fatalf("channel alpha: %v, want ErrUnknownChannel", err)
+	}
+
+	// a stable section of its own takes precedence over the top level
+	info.Channels[ChannelStable] = UpdateInfo{LatestVersion: "1.6.0"}
+	if channel, _ := info.Channel(ChannelStable); channel.LatestVersion != "1.6.0" {
+		t.Fatalf("stable channel %s, want its own section 1.6.0", channel.LatestVersion)
+	}
+}
+
+// TestChannelState checks the state file remembers the channel, stable until
+// one is saved
+func TestChannelState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "SirServer", "update.json")
+	if channel, err := LoadChannel(path); err != nil || channel != ChannelStable {
+		t.Fatalf("channel without a state file: %q, %v, want stable", channel, err)
+	}
+	if err := SaveChannel(path, "beta"); err != nil {
+		t.Fatal(err)
+	}
+	if channel, err := LoadChannel(path); err != nil || channel != "beta" {
+		t.Fatalf("saved channel: %q, %v, want beta", channel, err)
+	}
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadChannel(path); err == nil {
+		t.Fatal("corrupt state file accepted")
+	}
+}
+
+// TestDowngradeGuard goes back from the beta channel to stable, which Check
+// only offers and Apply only installs with AllowDowngrade
+func TestDowngradeGuard(t *testing.T) {
+	u := NewUpdater("2.0.0-beta.1", "", "")
+	info := channelInfo()
+	newReleaseServer(t, u, info)
+
+	u.Channel = "beta"
+	if _, available, err := u.Check(); err != nil || available {
+		t.Fatalf("Check of the beta channel on its latest: available %v, %v, want up to date", available, err)
+	}
+
+	u.Channel = ChannelStable
+	stable, available, err := u.Check()
+	if err != nil || available {
+		t.Fatalf("Check of the older stable channel: available %v, %v, want no downgrade offered", available, err)
+	}
+	if err := u.Apply(stable); !errors.Is(err, ErrDowngrade) {
+		t.Fatalf("Apply of the older stable channel: %v, want ErrDowngrade", err)
+	}
+
+	u.AllowDowngrade = true
+	if _, available, err := u.Check(); err != nil || !available {
+		t.Fatalf("Check allowing downgrades: available %v, %v, want the stable channel offered", available, err)
+	}
+	// allowed, it gets as far as finding the download, which stable lacks
+	if err := u.Apply(stable); err == nil || errors.Is(err, ErrDowngrade) {
+		t.Fatalf("Apply allowing downgrades: %v, want the downgrade let through", err)
+	}
+
+	u.Channel = "alpha"
+	if _, _, err := u.Check(); !errors.Is(err, ErrUnknownChannel) {
+		t.Fatalf("Check of an unknown channel: %v, want ErrUnknownChannel", err)
+	}
+}
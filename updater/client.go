@@ -0,0 +1,68 @@
+package updater
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// Timeouts of the HTTP client of the updater. The download as a whole may take
+// long on slow links, connecting and the first response may not.
+const (
+	DownloadTimeout       = 10 * time.Minute
+	DialTimeout           = 30 * time.Second
+	TLSHandshakeTimeout   = 15 * time.Second
+	ResponseHeaderTimeout = time.Minute
+)
+
+// ClientOptions are the settings of the HTTP client of the updater
+type ClientOptions struct {
+	// CACertFile is a PEM file of certificates trusted besides those of the
+	// system, such as the CA of a TLS intercepting proxy
+	CACertFile string
+	// InsecureSkipVerify accepts any server certificate, a last resort that lets
+	// anyone on the way serve an update. Signatures still protect the download
+	// when the binary embeds a release key.
+	InsecureSkipVerify bool
+}
+
+// NewHTTPClient returns the HTTP client the updater fetches the update info and
+// downloads with. It goes through the proxies of the HTTP_PROXY, HTTPS_PROXY
+// and NO_PROXY environment variables, as the rest of the system does.
+func NewHTTPClient(options ClientOptions) (*http.Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if options.CACertFile != "" {
+		pem, err := os.ReadFile(options.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificates: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates in %s", options.CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if options.InsecureSkipVerify {
+		color.Red("WARNING: TLS certificates of the update server are not verified, anyone between this machine and it can serve the update.")
+		tlsConfig.InsecureSkipVerify = true
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: DialTimeout, KeepAlive: 30 * time.Second}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   TLSHandshakeTimeout,
+		ResponseHeaderTimeout: ResponseHeaderTimeout,
+		IdleConnTimeout:       90 * time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+	return &http.Client{Transport: transport, Timeout: DownloadTimeout}, nil
+}
@@ -0,0 +1,57 @@
+package updater
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestHTTPClientCACert fetches the update info from a TLS server with a
+// certificate of its own CA, as behind an intercepting proxy: refused by
+// default, accepted with the CA in CACertFile or without verification
+func TestHTTPClientCACert(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(UpdateInfo{LatestVersion: "1.1.0", MinVersion: "1.0.0"})
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	caCert := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caCert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(options ClientOptions) error {
+		t.Helper()
+		client, err := NewHTTPClient(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u := NewUpdater("1.0.0", server.URL+"/update_info.json", server.URL)
+		u.HTTPClient = client
+		_, _, err = u.Check()
+		return err
+	}
+	if err := check(ClientOptions{}); err == nil {
+		t.Fatal("certificate of an unknown CA accepted")
+	}
+	if err := check(ClientOptions{CACertFile: caCert}); err != nil {
+		t.Fatalf("with the CA certificate: %v", err)
+	}
+	if err := check(ClientOptions{InsecureSkipVerify: true}); err != nil {
+		t.Fatalf("without verification: %v", err)
+	}
+
+	notPEM := filepath.Join(dir, "ca.txt")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{notPEM, filepath.Join(dir, "missing.pem")} {
+		if _, err := NewHTTPClient(ClientOptions{CACertFile: path}); err == nil {
+			t.Fatalf("CA certificates of %s accepted", path)
+		}
+	}
+}
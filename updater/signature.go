@@ -0,0 +1,129 @@
+package updater
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrSignatureInvalid is returned when a downloaded update is not signed by the
+// release key, whatever its checksum says
+var ErrSignatureInvalid = errors.New("invalid signature")
+
+// releasePublicKey is the base64 Ed25519 public key releases are signed with,
+// see SignRelease. Builds without one do not verify signatures.
+//
+// The key pair belongs to the maintainers: it is generated once with
+// "SirServer sign-release --generate-key --key release.key", the public key it
+// prints is committed to release.pub and the content of release.key is kept as
+// the RELEASE_SIGNING_KEY secret the release workflow signs artifacts with.
+// Nothing else may go into release.pub, a key whose private half the
+// maintainers do not hold would make every release fail verification.
+//
+//go:embed release.pub
+var releasePublicKey string
+
+// ReleasePublicKey returns the release key embedded in the binary, nil when
+// there is none
+func ReleasePublicKey() (ed25519.PublicKey, error) {
+	if strings.TrimSpace(releasePublicKey) == "" {
+		return nil, nil
+	}
+	key, err := ParsePublicKey(releasePublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid embedded release key: %w", err)
+	}
+	return key, nil
+}
+
+// ParsePublicKey parses a base64 Ed25519 public key
+func ParsePublicKey(text string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode public key: %w", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("public key is %d bytes, expected %d", len(key), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// ParsePrivateKey parses a base64 Ed25519 private key, either the 32 byte seed
+// or the 64 byte key
+func ParsePrivateKey(text string) (ed25519.PrivateKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode private key: %w", err)
+	}
+	switch len(key) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(key), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(key), nil
+	}
+	return nil, fmt.Errorf("private key is %d bytes, expected %d or %d", len(key), ed25519.SeedSize, ed25519.PrivateKeySize)
+}
+
+// GenerateReleaseKey returns a new release key pair, both base64. The public
+// key goes into updater/release.pub, the private key stays with the release
+// pipeline.
+func GenerateReleaseKey() (publicKey string, privateKey string, err error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate release key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(public), base64.StdEncoding.EncodeToString(private.Seed()), nil
+}
+
+// SignDigest returns the base64 signature of the SHA-256 digest of an artifact
+func SignDigest(key ed25519.PrivateKey, digest []byte) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, digest))
+}
+
+// VerifySignature checks that signature, base64, is the signature by key of
+// the SHA-256 digest of an artifact
+func VerifySignature(key ed25519.PublicKey, digest []byte, signature string) error {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+	if err != nil {
+		return fmt.Errorf("%w: failed to decode: %v", ErrSignatureInvalid, err)
+	}
+	if !ed25519.Verify(key, digest, decoded) {
+		return fmt.Errorf("%w: not signed by the release key", ErrSignatureInvalid)
+	}
+	return nil
+}
+
+// SignRelease returns the update info entry of the artifact at path, with its
+// checksum and its signature by key. The os and arch are taken from file names
+// such as SirServer-linux-amd64.tar.gz and left empty otherwise.
+func SignRelease(key ed25519.PrivateKey, path string) (Download, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Download{}, fmt.Errorf("failed to open artifact: %w", err)
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return Download{}, fmt.Errorf("failed to read artifact: %w", err)
+	}
+	digest := hash.Sum(nil)
+	download := Download{
+		Filename:  filepath.Base(path),
+		SHA256:    hex.EncodeToString(digest),
+		Signature: SignDigest(key, digest),
+	}
+	name := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(download.Filename, ".exe"), ".zip"), ".tar.gz")
+	if parts := strings.Split(name, "-"); len(parts) >= 3 {
+		download.OS, download.Arch = parts[len(parts)-2], parts[len(parts)-1]
+	}
+	return download, nil
+}
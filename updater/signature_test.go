@@ -0,0 +1,112 @@
+package updater
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// testReleaseKey returns a release key pair for the tests
+func testReleaseKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	publicText, privateText, err := GenerateReleaseKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := ParsePublicKey(publicText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := ParsePrivateKey(privateText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public, private
+}
+
+// TestEmbeddedReleaseKey checks release.pub is empty or holds a valid key
+func TestEmbeddedReleaseKey(t *testing.T) {
+	if _, err := ReleasePublicKey(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSignRelease signs an artifact and verifies the entry it lists, then the
+// same signature for an artifact with one byte flipped
+func TestSignRelease(t *testing.T) {
+	public, private := testReleaseKey(t)
+	artifact := []byte("the SirServer executable")
+	path := filepath.Join(t.TempDir(), "SirServer-linux-amd64.tar.gz")
+	if err := os.WriteFile(path, artifact, 0644); err != nil {
+		t.Fatal(err)
+	}
+	download, err := SignRelease(private, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if download.OS != "linux" || download.Arch != "amd64" || download.Filename != "SirServer-linux-amd64.tar.gz" {
+		t.Fatalf("entry %+v, want linux/amd64 SirServer-linux-amd64.tar.gz", download)
+	}
+	digest := sha256.Sum256(artifact)
+	if err := VerifySignature(public, digest[:], download.Signature); err != nil {
+		t.Fatalf("signature of the artifact: %v", err)
+	}
+
+	artifact[0] ^= 1
+	tampered := sha256.Sum256(artifact)
+	if err := VerifySignature(public, tampered[:], download.Signature); !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatalf("signature of the tampered artifact: %v, want ErrSignatureInvalid", err)
+	}
+	other, _ := testReleaseKey(t)
+	if err := VerifySignature(other, digest[:], download.Signature); !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatalf("signature checked with another key: %v, want ErrSignatureInvalid", err)
+	}
+	if err := VerifySignature(public, digest[:], "not base64!"); !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatalf("undecodable signature: %v, want ErrSignatureInvalid", err)
+	}
+}
+
+// TestApplyWithoutReleaseKey checks a build without a release key updates
+// without verifying signatures, while one with a key refuses unsigned updates
+func TestApplyWithoutReleaseKey(t *testing.T) {
+	embedded := releasePublicKey
+	releasePublicKey = ""
+	defer func() { releasePublicKey = embedded }()
+
+	info := &UpdateInfo{LatestVersion: "1.1.0", MinVersion: "1.0.0", Downloads: []Download{{
+		OS: runtime.GOOS, Arch: runtime.GOARCH, Filename: "SirServer",
+	}}}
+	// it gets as far as the missing checksum
+	u := NewUpdater("1.0.0", "", "")
+	if err := u.Apply(info); err == nil || errors.Is(err, ErrSignatureInvalid) {
+		t.Fatalf("Apply without a release key: %v, want the missing checksum refused", err)
+	}
+
+	public, _ := testReleaseKey(t)
+	releasePublicKey = base64.StdEncoding.EncodeToString(public)
+	u = NewUpdater("1.0.0", "", "")
+	if err := u.Apply(info); !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatalf("Apply of an unsigned update with a release key: %v, want ErrSignatureInvalid", err)
+	}
+}
+
+// TestParseKeys checks keys of the wrong size are rejected
+func TestParseKeys(t *testing.T) {
+	short := base64.StdEncoding.EncodeToString(make([]byte, 16))
+	if _, err := ParsePublicKey(short); err == nil {
+		t.Error("16 byte public key accepted")
+	}
+	if _, err := ParsePrivateKey(short); err == nil {
+		t.Error("16 byte private key accepted")
+	}
+	_, private := testReleaseKey(t)
+	full, err := ParsePrivateKey(base64.StdEncoding.EncodeToString(private))
+	if err != nil || !full.Equal(private) {
+		t.Errorf("64 byte private key: %v", err)
+	}
+}
@@ -4,27 +4,49 @@ import (
 	"archive/tar"   // For Linux .tar.gz
 	"archive/zip"   // For Windows .zip
 	"compress/gzip" // For Linux .tar.gz
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/schollz/progressbar/v3"
+	"hash"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
-	"time"
 
 	"github.com/blang/semver"              // For semantic version comparison
 	"github.com/fatih/color"               // For colored output
 	"github.com/inconshreveable/go-update" // The core update library
+	"golang.org/x/term"
 )
 
+// ErrChecksumMismatch is returned when a downloaded update does not have the
+// SHA-256 checksum its update info lists
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ErrNotConfirmed is returned when an update would have to be confirmed but
+// cannot be, see Updater.AssumeYes
+var ErrNotConfirmed = errors.New("update not confirmed")
+
+// ErrTooOld is returned when the running version is older than the minimum
+// the update info lists, so it cannot update itself
+var ErrTooOld = errors.New("version too old to update automatically")
+
 // UpdateInfo reflects the structure of your update_info.json
 type UpdateInfo struct {
 	LatestVersion string     `json:"latest_version"`
 	MinVersion    string     `json:"min_version"`
 	Downloads     []Download `json:"downloads"`
+
+	// Channels are the sections of release channels such as beta or nightly,
+	// each with its own versions and downloads, see Channel
+	Channels map[string]UpdateInfo `json:"channels,omitempty"`
 }
 
 // Download represents a single downloadable binary entry
@@ -33,6 +55,11 @@ type Download struct {
 	Arch     string `json:"arch"`
 	Filename string `json:"filename"` // e.g., "SirServer-linux-amd64.tar.gz" or "SirServer-windows-amd64.zip"
 	ID       string `json:"id"`       // The ID your file server uses to retrieve the file
+	SHA256   string `json:"sha256"`   // hex SHA-256 of the file as downloaded, the update is refused when it differs
+
+	// Signature is the base64 Ed25519 signature by the release key of the
+	// SHA-256 digest of the file, see SignRelease
+	Signature string `json:"signature,omitempty"`
 }
 
 // Updater struct holds dependencies and constants for the update process
@@ -40,70 +67,161 @@ type Updater struct {
 	CurrentVersion  string
 	VersionInfoURL  string       // URL to your update_info.json
 	DownloadBaseURL string       // Base URL for file downloads, e.g., "https://lc.cangling.cn:22002/api/v1/file/download/"
-	httpClient      *http.Client // Add an HTTP client with timeout
+	HTTPClient      *http.Client // Fetches the update info and downloads, see NewHTTPClient
+
+	// Channel is the release channel updates come from, ChannelStable when empty
+	Channel string
+	// StateFile remembers Channel once an update info has it, so later updates
+	// come from it too. Nothing is remembered when empty.
+	StateFile string
+	// AllowDowngrade installs the latest version of Channel when it is older
+	// than the running one, such as when going back from beta to stable
+	AllowDowngrade bool
+	// AssumeYes updates without asking for a confirmation
+	AssumeYes bool
+	// AllowMissingChecksum applies downloads the update info lists no checksum
+	// for, after a warning. They are refused otherwise.
+	AllowMissingChecksum bool
+	// PublicKey verifies the signatures of downloads, the key embedded in the
+	// binary when nil. Without either, signatures are not verified.
+	PublicKey ed25519.PublicKey
 }
 
 // NewUpdater creates and returns a new Updater instance
 func NewUpdater(currentVersion, versionInfoURL, downloadBaseURL string) *Updater {
+	// without a CA file the client cannot fail
+	client, _ := NewHTTPClient(ClientOptions{})
 	return &Updater{
 		CurrentVersion:  currentVersion,
 		VersionInfoURL:  versionInfoURL,
 		DownloadBaseURL: downloadBaseURL,
-		httpClient: &http.Client{
-			Timeout: 10 * 60 * time.Second, // Recommended: Set a timeout for HTTP requests
-		},
+		HTTPClient:      client,
 	}
 }
 
 // PerformUpdate handles the entire update process
 // This function will attempt to update and then exit the application.
 // The caller (e.g., main function) should then restart the application.
+// It asks before updating unless AssumeYes is set, and refuses when it
+// cannot ask because stdin is not a terminal.
 func (u *Updater) PerformUpdate() error {
 	color.Yellow("Checking for updates...")
 
 	// 1. Get latest update information
-	updateInfo, err := u.getUpdateInfo()
+	updateInfo, available, err := u.Check()
 	if err != nil {
-		return fmt.Errorf("failed to get update info: %w", err)
+		return err
 	}
 
-	color.Green("Current version: %s", u.CurrentVersion)
-	color.Green("Latest available: %s", updateInfo.LatestVersion)
-
-	currentSemVer, err := semver.ParseTolerant(u.CurrentVersion)
-	if err != nil {
-		return fmt.Errorf("failed to parse current version '%s': %w", u.CurrentVersion, err)
-	}
-	latestSemVer, err := semver.ParseTolerant(updateInfo.LatestVersion)
-	if err != nil {
-		return fmt.Errorf("failed to parse latest version from server '%s': %w", updateInfo.LatestVersion, err)
-	}
-	minSemVer, err := semver.ParseTolerant(updateInfo.MinVersion)
-	if err != nil {
-		return fmt.Errorf("failed to parse minimum version from server '%s': %w", updateInfo.MinVersion, err)
+	if u.StateFile != "" {
+		if err := SaveChannel(u.StateFile, u.channel()); err != nil {
+			color.Yellow("WARNING: the %s channel is not remembered for later updates: %s", u.channel(), err.Error())
+		}
 	}
 
+	color.Green("Current version: %s", u.CurrentVersion)
+	color.Green("Latest available: %s (%s channel)", updateInfo.LatestVersion, u.channel())
+
 	// 2. Check if an update is needed
-	if latestSemVer.LTE(currentSemVer) {
+	if !available {
+		if order, err := u.compareLatest(updateInfo); err == nil && order < 0 {
+			color.Yellow("The latest version of the %s channel is older than the running one. Run the update with --allow-downgrade to install it.", u.channel())
+			return nil
+		}
 		color.Yellow("You are already running the latest version.")
 		return nil // No update needed
 	}
 
 	// 3. Check minimum version compatibility
-	if currentSemVer.LT(minSemVer) {
-		color.Red("Your current version (%s) is too old to auto-update to %s (minimum required: %s). Please update manually.",
-			u.CurrentVersion, updateInfo.LatestVersion, updateInfo.MinVersion)
+	if err := u.checkMinVersion(updateInfo); errors.Is(err, ErrTooOld) {
 		return nil // Not an error, just can't update automatically
+	} else if err != nil {
+		return err
 	}
 
 	// 4. Confirm with user
-	color.Cyan("A new version (%s) is available. Do you want to update? (y/N): ", updateInfo.LatestVersion)
-	var confirmation string
-	_, _ = fmt.Scanln(&confirmation)
+	offer := fmt.Sprintf("A new version (%s)", updateInfo.LatestVersion)
+	if order, _ := u.compareLatest(updateInfo); order < 0 {
+		offer = fmt.Sprintf("An older version (%s) of the %s channel", updateInfo.LatestVersion, u.channel())
+	}
+	if !u.AssumeYes {
+		if !stdinIsTerminal() {
+			color.Red("%s is available, but stdin is not a terminal to confirm the update on. Run the update with --yes to apply it without asking.", offer)
+			return ErrNotConfirmed
+		}
+		color.Cyan("%s is available. Do you want to update? (y/N): ", offer)
+		var confirmation string
+		_, _ = fmt.Scanln(&confirmation)
+
+		if strings.ToLower(confirmation) != "y" {
+			color.Red("Update cancelled by user.")
+			return nil // User cancelled
+		}
+	}
+
+	if err := u.Apply(updateInfo); err != nil {
+		return err
+	}
+	color.Green("Update successful! Please restart SirServer to apply the changes.")
+	// It's crucial to exit after a successful update so the OS can load the new binary.
+	os.Exit(0)
+	return nil // Unreachable
+}
+
+// Check fetches the update info of Channel and reports whether its latest
+// version is newer than CurrentVersion, or older when AllowDowngrade is set,
+// without downloading anything
+func (u *Updater) Check() (*UpdateInfo, bool, error) {
+	updateInfo, err := u.getUpdateInfo()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get update info: %w", err)
+	}
+	order, err := u.compareLatest(updateInfo)
+	if err != nil {
+		return nil, false, err
+	}
+	return updateInfo, order > 0 || (order < 0 && u.AllowDowngrade), nil
+}
+
+// compareLatest returns 1 when the latest version of updateInfo is newer than
+// CurrentVersion, -1 when it is older and 0 when they are the same
+func (u *Updater) compareLatest(updateInfo *UpdateInfo) (int, error) {
+	currentSemVer, err := semver.ParseTolerant(u.CurrentVersion)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse current version '%s': %w", u.CurrentVersion, err)
+	}
+	latestSemVer, err := semver.ParseTolerant(updateInfo.LatestVersion)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse latest version from server '%s': %w", updateInfo.LatestVersion, err)
+	}
+	return latestSemVer.Compare(currentSemVer), nil
+}
 
-	if strings.ToLower(confirmation) != "y" {
-		color.Red("Update cancelled by user.")
-		return nil // User cancelled
+// channel returns the release channel of the updater
+func (u *Updater) channel() string {
+	if u.Channel == "" {
+		return ChannelStable
+	}
+	return u.Channel
+}
+
+// Apply downloads the latest version updateInfo lists for this system,
+// verifies it and replaces the running executable with it, without asking.
+// Versions older than the minimum updateInfo lists are refused with
+// ErrTooOld, they have to be updated by hand, and so are downgrades with
+// ErrDowngrade unless AllowDowngrade is set.
+func (u *Updater) Apply(updateInfo *UpdateInfo) error {
+	if err := u.checkMinVersion(updateInfo); err != nil {
+		return err
+	}
+	order, err := u.compareLatest(updateInfo)
+	if err != nil {
+		return err
+	}
+	if order < 0 && !u.AllowDowngrade {
+		color.Red("The latest version of the %s channel (%s) is older than the running one (%s). Run the update with --allow-downgrade to install it.",
+			u.channel(), updateInfo.LatestVersion, u.CurrentVersion)
+		return fmt.Errorf("%w: %s to %s", ErrDowngrade, u.CurrentVersion, updateInfo.LatestVersion)
 	}
 
 	// 5. Find the appropriate download
@@ -118,13 +236,31 @@ func (u *Updater) PerformUpdate() error {
 	if targetDownload == nil {
 		return fmt.Errorf("no update binary found for your system (%s/%s) in the update info", runtime.GOOS, runtime.GOARCH)
 	}
+	if u.PublicKey == nil {
+		if u.PublicKey, err = ReleasePublicKey(); err != nil {
+			return err
+		}
+	}
+	if u.PublicKey == nil {
+		color.Yellow("WARNING: this build embeds no release key, the signature of the update is not verified.")
+	} else if targetDownload.Signature == "" {
+		color.Red("The update info lists no signature for %s, refusing an update that cannot be verified to come from the SirServer releases.", targetDownload.Filename)
+		return fmt.Errorf("%w: no signature for %s in the update info", ErrSignatureInvalid, targetDownload.Filename)
+	}
+	if targetDownload.SHA256 == "" {
+		color.Red("WARNING: the update info lists no sha256 checksum for %s, a truncated or tampered download cannot be detected.", targetDownload.Filename)
+		if !u.AllowMissingChecksum {
+			color.Red("Refusing to update without a checksum. Run the update with --insecure-no-checksum to apply it anyway.")
+			return fmt.Errorf("no checksum for %s in the update info", targetDownload.Filename)
+		}
+	}
 
 	// Construct the full download URL using the ID from the JSON
 	downloadURL := u.DownloadBaseURL + "/" + updateInfo.LatestVersion + "/" + targetDownload.Filename
 	//color.Yellow("Downloading update from: %s", downloadURL)
 
 	// 6. Download the archive/binary
-	newBinaryReader, err := u.downloadAndPrepareBinary(downloadURL, targetDownload.Filename)
+	newBinaryReader, checksum, err := u.downloadAndPrepareBinary(downloadURL, *targetDownload)
 	if err != nil {
 		color.Red("failed to download and prepare new binary:%s", err.Error())
 		return fmt.Errorf("failed to download and prepare new binary: %w", err)
@@ -136,23 +272,47 @@ func (u *Updater) PerformUpdate() error {
 		}
 	}()
 
-	// 7. Apply the update using go-update
+	// 7. Apply the update using go-update, which checks the executable it writes
+	// is the one extracted from the verified download
 	color.Yellow("Applying update...")
-	err = update.Apply(newBinaryReader, update.Options{})
+	err = update.Apply(newBinaryReader, update.Options{Checksum: checksum, Hash: crypto.SHA256})
 	if err != nil {
 		color.Red("failed to apply update: %s", err.Error())
 		return fmt.Errorf("failed to apply update: %w", err)
 	}
 
-	color.Green("Update successful! Please restart SirServer to apply the changes.")
-	// It's crucial to exit after a successful update so the OS can load the new binary.
-	os.Exit(0)
-	return nil // Unreachable
+	return nil
+}
+
+// checkMinVersion returns ErrTooOld, after telling the user to update by hand,
+// when CurrentVersion is older than the minimum updateInfo lists
+func (u *Updater) checkMinVersion(updateInfo *UpdateInfo) error {
+	currentSemVer, err := semver.ParseTolerant(u.CurrentVersion)
+	if err != nil {
+		return fmt.Errorf("failed to parse current version '%s': %w", u.CurrentVersion, err)
+	}
+	minSemVer, err := semver.ParseTolerant(updateInfo.MinVersion)
+	if err != nil {
+		return fmt.Errorf("failed to parse minimum version from server '%s': %w", updateInfo.MinVersion, err)
+	}
+	if currentSemVer.LT(minSemVer) {
+		color.Red("Your current version (%s) is too old to auto-update to %s (minimum required: %s). Please update manually.",
+			u.CurrentVersion, updateInfo.LatestVersion, updateInfo.MinVersion)
+		return fmt.Errorf("%w: %s is older than %s", ErrTooOld, u.CurrentVersion, updateInfo.MinVersion)
+	}
+	return nil
+}
+
+// stdinIsTerminal reports whether stdin is a terminal a confirmation can be
+// typed on, rather than a pipe, a file or /dev/null as under cron. Tests stand
+// in for the terminal.
+var stdinIsTerminal = func() bool {
+	return term.IsTerminal(int(os.Stdin.Fd()))
 }
 
 // getUpdateInfo fetches and parses the update_info.json
 func (u *Updater) getUpdateInfo() (*UpdateInfo, error) {
-	resp, err := http.Get(u.VersionInfoURL)
+	resp, err := u.HTTPClient.Get(u.VersionInfoURL)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch version info from %s: %w", u.VersionInfoURL, err)
 	}
@@ -166,25 +326,29 @@ func (u *Updater) getUpdateInfo() (*UpdateInfo, error) {
 	if err := json.NewDecoder(resp.Body).Decode(&updateInfo); err != nil {
 		return nil, fmt.Errorf("failed to decode update info JSON: %w", err)
 	}
-	return &updateInfo, nil
+	return updateInfo.Channel(u.channel())
 }
 
-// downloadAndPrepareBinary downloads the specified file and returns an io.ReadCloser for the extracted executable.
+// downloadAndPrepareBinary downloads the specified file and returns an io.ReadCloser for the extracted executable,
+// together with the SHA-256 checksum of the executable. The download is hashed while it is written and refused
+// with ErrChecksumMismatch unless its checksum is the one download lists, which is not checked when empty, and
+// with ErrSignatureInvalid unless download is signed by PublicKey, when it is set.
 // The caller is responsible for closing the returned io.ReadCloser.
-func (u *Updater) downloadAndPrepareBinary(url, filename string) (io.ReadCloser, error) { // Return io.ReadCloser
+func (u *Updater) downloadAndPrepareBinary(url string, download Download) (io.ReadCloser, []byte, error) { // Return io.ReadCloser
+	filename := download.Filename
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+		return nil, nil, fmt.Errorf("failed to create HTTP request: %w", err)
 	}
 
-	resp, err := u.httpClient.Do(req) // Use the configured HTTP client
+	resp, err := u.HTTPClient.Do(req) // Use the configured HTTP client
 	if err != nil {
-		return nil, fmt.Errorf("failed to download file: %w", err)
+		return nil, nil, fmt.Errorf("failed to download file: %w", err)
 	}
 	defer resp.Body.Close() // Close the HTTP response body
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to download file, HTTP status %s", resp.Status)
+		return nil, nil, fmt.Errorf("failed to download file, HTTP status %s", resp.Status)
 	}
 
 	// Get content length for the progress bar
@@ -202,29 +366,43 @@ func (u *Updater) downloadAndPrepareBinary(url, filename string) (io.ReadCloser,
 	// Create a temporary file to store the downloaded content
 	tmpDownloadedFile, err := os.CreateTemp("", "sirserver-update-download-*.tmp")
 	if err != nil {
-		return nil, fmt.Errorf("failed to create temporary download file: %w", err)
+		return nil, nil, fmt.Errorf("failed to create temporary download file: %w", err)
 	}
 	// We defer the removal of this file for later cleanup, *after* we're done with its content.
 	// The responsibility for closing tmpDownloadedFile will be handled by io.Copy or its usage.
 
-	// Copy with progress bar. io.Copy will read from resp.Body and write to both tmpDownloadedFile and bar.
-	_, err = io.Copy(io.MultiWriter(tmpDownloadedFile, bar), resp.Body)
+	// Copy with progress bar. io.Copy will read from resp.Body and write to tmpDownloadedFile, bar and the hash.
+	downloadHash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmpDownloadedFile, bar, downloadHash), resp.Body)
 	if err != nil {
 		tmpDownloadedFile.Close()
 		os.Remove(tmpDownloadedFile.Name())
-		return nil, fmt.Errorf("failed to write downloaded content to temporary file: %w", err)
+		return nil, nil, fmt.Errorf("failed to write downloaded content to temporary file: %w", err)
 	}
 	tmpDownloadedFile.Close() // Close the writer handle after copying all content
+	if err := verifyChecksum(filename, download.SHA256, downloadHash); err != nil {
+		os.Remove(tmpDownloadedFile.Name())
+		return nil, nil, err
+	}
+	if u.PublicKey != nil {
+		if err := VerifySignature(u.PublicKey, downloadHash.Sum(nil), download.Signature); err != nil {
+			color.Red("The download of %s is not signed by the SirServer release key, it may have been tampered with. Refusing to update.", filename)
+			os.Remove(tmpDownloadedFile.Name())
+			return nil, nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		color.Green("Signature of %s verified.", filename)
+	}
 
 	// Now open the downloaded temporary file for reading and decompression/extraction
 	tempFileForReading, err := os.Open(tmpDownloadedFile.Name())
 	if err != nil {
 		os.Remove(tmpDownloadedFile.Name()) // Clean up on error
-		return nil, fmt.Errorf("failed to open temporary downloaded file for reading: %w", err)
+		return nil, nil, fmt.Errorf("failed to open temporary downloaded file for reading: %w", err)
 	}
 	// DO NOT DEFER CLOSURE OF tempFileForReading HERE. It's the returned reader.
 
 	var newBinaryReader io.ReadCloser
+	executableHash := sha256.New()
 	executableName := filepath.Base(os.Args[0])
 	if runtime.GOOS == "windows" {
 		executableName = strings.TrimSuffix(executableName, ".exe")
@@ -236,7 +414,7 @@ func (u *Updater) downloadAndPrepareBinary(url, filename string) (io.ReadCloser,
 		if err != nil {
 			tempFileForReading.Close()
 			os.Remove(tmpDownloadedFile.Name())
-			return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+			return nil, nil, fmt.Errorf("failed to create gzip reader: %w", err)
 		}
 		defer gzr.Close()
 
@@ -250,7 +428,7 @@ func (u *Updater) downloadAndPrepareBinary(url, filename string) (io.ReadCloser,
 			if err != nil {
 				tempFileForReading.Close()
 				os.Remove(tmpDownloadedFile.Name())
-				return nil, fmt.Errorf("failed to read tar header: %w", err)
+				return nil, nil, fmt.Errorf("failed to read tar header: %w", err)
 			}
 
 			if header.Typeflag == tar.TypeReg && strings.TrimSuffix(filepath.Base(header.Name), ".exe") == executableName {
@@ -258,14 +436,14 @@ func (u *Updater) downloadAndPrepareBinary(url, filename string) (io.ReadCloser,
 				if err != nil {
 					tempFileForReading.Close()
 					os.Remove(tmpDownloadedFile.Name())
-					return nil, fmt.Errorf("failed to create temp exe file for tar: %w", err)
+					return nil, nil, fmt.Errorf("failed to create temp exe file for tar: %w", err)
 				}
-				if _, err := io.Copy(tmpExeFile, tr); err != nil {
+				if _, err := io.Copy(io.MultiWriter(tmpExeFile, executableHash), tr); err != nil {
 					tmpExeFile.Close()
 					os.Remove(tmpExeFile.Name())
 					tempFileForReading.Close()
 					os.Remove(tmpDownloadedFile.Name())
-					return nil, fmt.Errorf("failed to copy extracted tar entry to temp file: %w", err)
+					return nil, nil, fmt.Errorf("failed to copy extracted tar entry to temp file: %w", err)
 				}
 				tmpExeFile.Seek(0, io.SeekStart)
 				newBinaryReader = tmpExeFile
@@ -276,7 +454,7 @@ func (u *Updater) downloadAndPrepareBinary(url, filename string) (io.ReadCloser,
 		if !found {
 			tempFileForReading.Close()
 			os.Remove(tmpDownloadedFile.Name())
-			return nil, fmt.Errorf("could not find executable (%s) inside .tar.gz archive", executableName)
+			return nil, nil, fmt.Errorf("could not find executable (%s) inside .tar.gz archive", executableName)
 		}
 	} else if strings.HasSuffix(filename, ".zip") {
 		color.Yellow("Decompressing .zip archive...")
@@ -284,7 +462,7 @@ func (u *Updater) downloadAndPrepareBinary(url, filename string) (io.ReadCloser,
 		if err != nil {
 			tempFileForReading.Close()
 			os.Remove(tmpDownloadedFile.Name())
-			return nil, fmt.Errorf("failed to open zip file: %w", err)
+			return nil, nil, fmt.Errorf("failed to open zip file: %w", err)
 		}
 		defer zipReader.Close()
 
@@ -298,14 +476,14 @@ func (u *Updater) downloadAndPrepareBinary(url, filename string) (io.ReadCloser,
 		if exeFile == nil {
 			tempFileForReading.Close()
 			os.Remove(tmpDownloadedFile.Name())
-			return nil, fmt.Errorf("could not find executable (%s) inside .zip archive", executableName)
+			return nil, nil, fmt.Errorf("could not find executable (%s) inside .zip archive", executableName)
 		}
 
 		rc, err := exeFile.Open()
 		if err != nil {
 			tempFileForReading.Close()
 			os.Remove(tmpDownloadedFile.Name())
-			return nil, fmt.Errorf("failed to open executable in zip: %w", err)
+			return nil, nil, fmt.Errorf("failed to open executable in zip: %w", err)
 		}
 		defer rc.Close()
 
@@ -313,19 +491,20 @@ func (u *Updater) downloadAndPrepareBinary(url, filename string) (io.ReadCloser,
 		if err != nil {
 			tempFileForReading.Close()
 			os.Remove(tmpDownloadedFile.Name())
-			return nil, fmt.Errorf("failed to create temp exe file for zip: %w", err)
+			return nil, nil, fmt.Errorf("failed to create temp exe file for zip: %w", err)
 		}
-		if _, err := io.Copy(tmpExeFile, rc); err != nil {
+		if _, err := io.Copy(io.MultiWriter(tmpExeFile, executableHash), rc); err != nil {
 			tmpExeFile.Close()
 			os.Remove(tmpExeFile.Name())
 			tempFileForReading.Close()
 			os.Remove(tmpDownloadedFile.Name())
-			return nil, fmt.Errorf("failed to copy extracted zip entry to temp file: %w", err)
+			return nil, nil, fmt.Errorf("failed to copy extracted zip entry to temp file: %w", err)
 		}
 		tmpExeFile.Seek(0, io.SeekStart)
 		newBinaryReader = tmpExeFile
 	} else {
 		// If it's not a known archive, assume it's the raw binary itself.
+		executableHash = downloadHash
 		tempFileForReading.Seek(0, io.SeekStart)
 		newBinaryReader = tempFileForReading
 	}
@@ -333,12 +512,27 @@ func (u *Updater) downloadAndPrepareBinary(url, filename string) (io.ReadCloser,
 	if newBinaryReader == nil {
 		tempFileForReading.Close()
 		os.Remove(tmpDownloadedFile.Name())
-		return nil, fmt.Errorf("internal error: new binary reader is nil after download and preparation")
+		return nil, nil, fmt.Errorf("internal error: new binary reader is nil after download and preparation")
 	}
 
 	// Clean up the original downloaded archive file here.
 	// We only need the extracted executable (newBinaryReader).
 	os.Remove(tmpDownloadedFile.Name())
 
-	return newBinaryReader, nil
+	return newBinaryReader, executableHash.Sum(nil), nil
+}
+
+// verifyChecksum checks that the hash of the download of filename is the hex
+// SHA-256 checksum expected, which is not checked when empty
+func verifyChecksum(filename string, expected string, downloaded hash.Hash) error {
+	if expected == "" {
+		return nil
+	}
+	actual := hex.EncodeToString(downloaded.Sum(nil))
+	if !strings.EqualFold(strings.TrimSpace(expected), actual) {
+		color.Red("The download of %s is corrupt: expected sha256 %s, got %s", filename, expected, actual)
+		return fmt.Errorf("%w: %s: expected sha256 %s, got %s", ErrChecksumMismatch, filename, expected, actual)
+	}
+	color.Green("Checksum of %s verified.", filename)
+	return nil
 }
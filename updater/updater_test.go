@@ -0,0 +1,206 @@
+package updater
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// testArtifact is the executable the test release server hands out
+var testArtifact = []byte("#!/bin/sh\necho SirServer 1.1.0\n")
+
+// testRelease returns the update info of a release of testArtifact as the
+// raw executable for this system, signed by a new key the updater trusts
+func testRelease(t *testing.T, u *Updater) *UpdateInfo {
+	t.Helper()
+	public, private := testReleaseKey(t)
+	u.PublicKey = public
+	digest := sha256.Sum256(testArtifact)
+	return &UpdateInfo{LatestVersion: "1.1.0", MinVersion: "1.0.0", Downloads: []Download{{
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		Filename:  "SirServer",
+		SHA256:    hex.EncodeToString(digest[:]),
+		Signature: SignDigest(private, digest[:]),
+	}}}
+}
+
+// newReleaseServer serves info as update_info.json and testArtifact as the
+// downloads of every version, and points u at it
+func newReleaseServer(t *testing.T, u *Updater, info *UpdateInfo) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/update_info.json", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(info)
+	})
+	mux.HandleFunc("/download/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testArtifact)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	u.VersionInfoURL = server.URL + "/update_info.json"
+	u.DownloadBaseURL = server.URL + "/download"
+	return server
+}
+
+// TestVerifyChecksum checks matching checksums in any case pass, others fail
+// with ErrChecksumMismatch and missing ones are not checked
+func TestVerifyChecksum(t *testing.T) {
+	digest := sha256.Sum256(testArtifact)
+	sum := hex.EncodeToString(digest[:])
+	hashOf := func(content []byte) hash.Hash {
+		h := sha256.New()
+		h.Write(content)
+		return h
+	}
+	tests := []struct {
+		name     string
+		expected string
+		content  []byte
+		err      error
+	}{
+		{"match", sum, testArtifact, nil},
+		{"match upper case", "  " + strings.ToUpper(sum) + "\n", testArtifact, nil},
+		{"mismatch", sum, append([]byte("x"), testArtifact...), ErrChecksumMismatch},
+		{"missing", "", []byte("anything"), nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := verifyChecksum("SirServer", test.expected, hashOf(test.content)); !errors.Is(err, test.err) {
+				t.Fatalf("verifyChecksum: %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+// TestDownloadVerifiesChecksum downloads a release and checks the executable
+// handed to go-update is the one downloaded, and that a download the checksum
+// of the update info does not match is refused
+func TestDownloadVerifiesChecksum(t *testing.T) {
+	u := NewUpdater("1.0.0", "", "")
+	info := testRelease(t, u)
+	server := newReleaseServer(t, u, info)
+
+	reader, checksum, err := u.downloadAndPrepareBinary(server.URL+"/download/1.1.0/SirServer", info.Downloads[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != string(testArtifact) {
+		t.Fatalf("executable %q, want %q", content, testArtifact)
+	}
+	if digest := sha256.Sum256(testArtifact); hex.EncodeToString(checksum) != hex.EncodeToString(digest[:]) {
+		t.Fatalf("checksum %x, want %x", checksum, digest)
+	}
+
+	corrupt := info.Downloads[0]
+	corrupt.SHA256 = hex.EncodeToString(make([]byte, sha256.Size))
+	if _, _, err := u.downloadAndPrepareBinary(server.URL+"/download/1.1.0/SirServer", corrupt); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("download of a corrupt file: %v, want ErrChecksumMismatch", err)
+	}
+}
+
+// TestApplyChecksum checks Apply refuses downloads the checksum does not match,
+// and releases listing no checksum unless AllowMissingChecksum is set
+func TestApplyChecksum(t *testing.T) {
+	u := NewUpdater("1.0.0", "", "")
+	info := testRelease(t, u)
+	newReleaseServer(t, u, info)
+
+	info.Downloads[0].SHA256 = hex.EncodeToString(make([]byte, sha256.Size))
+	if err := u.Apply(info); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("Apply of a mismatching download: %v, want ErrChecksumMismatch", err)
+	}
+
+	info.Downloads[0].SHA256 = ""
+	if err := u.Apply(info); err == nil {
+		t.Fatal("Apply of a release without a checksum succeeded")
+	}
+	// allowed, the download is still refused when its signature does not match
+	u.AllowMissingChecksum = true
+	_, other := testReleaseKey(t)
+	info.Downloads[0].Signature = SignDigest(other, []byte("other"))
+	if err := u.Apply(info); !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatalf("Apply allowing a missing checksum: %v, want the signature checked", err)
+	}
+}
+
+// TestCheck checks an update is reported available only when the release is
+// newer than the running version
+func TestCheck(t *testing.T) {
+	u := NewUpdater("1.0.0", "", "")
+	newReleaseServer(t, u, testRelease(t, u))
+	info, available, err := u.Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !available || info.LatestVersion != "1.1.0" {
+		t.Fatalf("Check from 1.0.0: %s available %v, want 1.1.0 available", info.LatestVersion, available)
+	}
+
+	u.CurrentVersion = "1.1.0"
+	if _, available, err := u.Check(); err != nil || available {
+		t.Fatalf("Check from 1.1.0: available %v, %v, want up to date", available, err)
+	}
+}
+
+// TestPerformUpdateConfirmation checks an update is refused with
+// ErrNotConfirmed when stdin is not a terminal, applied without asking with
+// AssumeYes, and asked for on a terminal
+func TestPerformUpdateConfirmation(t *testing.T) {
+	terminal := false
+	defer func(isTerminal func() bool) { stdinIsTerminal = isTerminal }(stdinIsTerminal)
+	stdinIsTerminal = func() bool { return terminal }
+
+	u := NewUpdater("1.0.0", "", "")
+	info := testRelease(t, u)
+	// a corrupt download, so an update that gets to Apply fails rather than
+	// replace the test binary
+	info.Downloads[0].SHA256 = hex.EncodeToString(make([]byte, sha256.Size))
+	newReleaseServer(t, u, info)
+
+	if err := u.PerformUpdate(); !errors.Is(err, ErrNotConfirmed) {
+		t.Fatalf("PerformUpdate without a terminal: %v, want ErrNotConfirmed", err)
+	}
+
+	u.AssumeYes = true
+	if err := u.PerformUpdate(); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("PerformUpdate with AssumeYes: %v, want the download applied", err)
+	}
+
+	u.AssumeYes = false
+	terminal = true
+	answer := func(text string) {
+		t.Helper()
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.WriteString(text)
+		w.Close()
+		stdin := os.Stdin
+		os.Stdin = r
+		t.Cleanup(func() { os.Stdin = stdin; r.Close() })
+	}
+	answer("n\n")
+	if err := u.PerformUpdate(); err != nil {
+		t.Fatalf("PerformUpdate declined on a terminal: %v, want cancelled", err)
+	}
+	answer("y\n")
+	if err := u.PerformUpdate(); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("PerformUpdate confirmed on a terminal: %v, want the download applied", err)
+	}
+}